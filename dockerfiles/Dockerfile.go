@@ -7,8 +7,13 @@ RUN apk add --no-cache git ca-certificates
 
 COPY go-services/ .
 
+# Build metadata reported by /version and service_build_info.
+ARG VERSION
+ARG COMMIT
+ARG BUILD_DATE
+
 RUN go mod tidy && \
-    go build -o app .
+    go build -ldflags "-X main.version=${VERSION} -X main.commit=${COMMIT} -X main.buildDate=${BUILD_DATE}" -o app .
 
 # Stage 2: Run
 FROM gcr.io/distroless/static:nonroot
@@ -20,4 +25,8 @@ COPY --from=builder /app/app /
 # Use non-root user
 USER nonroot:nonroot
 
+# No shell or curl in distroless; the binary probes its own /readyz.
+HEALTHCHECK --interval=30s --timeout=5s --start-period=30s --retries=3 \
+    CMD ["/app", "-healthcheck"]
+
 ENTRYPOINT ["/app"]
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+)
+
+// withAccessLog logs one line per request once the handler has finished.
+// Routes listed in AccessLogExclude, such as probes and scrapes, are not
+// logged. The request ID is added by the logger from the request context.
+func (s *Server) withAccessLog(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := s.routeLabel(r)
+		if slices.Contains(s.cfg.AccessLogExclude, route) {
+			handler(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		handler(rec, r)
+
+		s.logger.InfoContext(r.Context(), "HTTP request",
+			"method", r.Method,
+			"route", route,
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"bytes", rec.bytes,
+			"remote_ip", s.clientIP(r),
+			"user_agent", r.UserAgent(),
+		)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// accessLogs returns the access log entries written to buf.
+func accessLogs(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("log line is not valid JSON: %v\n%s", err, sc.Text())
+		}
+		if entry["msg"] == "HTTP request" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestWithAccessLog_LogsRequest(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	s, _, _ := newTestServer(t)
+	s.logger = newLogger(&buf, slog.LevelInfo)
+	testProducts(s).add(testProduct(1, "Widget", 9.99, time.Now()))
+
+	req := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	req.Header.Set("User-Agent", "curl/8.0")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	entries := accessLogs(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 access log line, got %d", len(entries))
+	}
+	entry := entries[0]
+	want := map[string]any{
+		"method":     "GET",
+		"route":      "/products/{id}",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(w.Body.Len()),
+		"remote_ip":  "192.0.2.1",
+		"user_agent": "curl/8.0",
+		"request_id": "req-42",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+	if _, ok := entry["duration_ms"].(float64); !ok {
+		t.Errorf("expected a numeric duration_ms, got %v", entry["duration_ms"])
+	}
+}
+
+func TestWithAccessLog_SkipsExcludedRoutes(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	s, _, _ := newTestServer(t)
+	s.logger = newLogger(&buf, slog.LevelInfo)
+	s.cfg.AccessLogExclude = []string{"/livez"}
+
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/livez", nil))
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	entries := accessLogs(t, &buf)
+	if len(entries) != 1 || entries[0]["route"] != unknownRoute {
+		t.Errorf("expected only the unmatched request to be logged, got %v", entries)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-service/store"
+)
+
+const (
+	// auditBuffer is how many audit events may wait for runAuditWriter.
+	auditBuffer = 1024
+	// auditBatchSize is the most events written with one insert.
+	auditBatchSize = 100
+	// auditFlushInterval is how long an event may wait for a batch to
+	// fill.
+	auditFlushInterval = time.Second
+	// auditFlushTimeout bounds the last write on shutdown.
+	auditFlushTimeout = 5 * time.Second
+	// maxAuditUserAgent caps the user agent kept with an event.
+	maxAuditUserAgent = 512
+)
+
+// Audited actions.
+const (
+	auditLoginSucceeded         = "login.succeeded"
+	auditLoginFailed            = "login.failed"
+	auditLogout                 = "logout"
+	auditSessionsRevoked        = "sessions.revoked"
+	auditMaintenanceUpdated     = "maintenance.updated"
+	auditLogLevelChanged        = "log_level.changed"
+	auditConfigReloaded         = "config.reloaded"
+	auditFlagChanged            = "flag.changed"
+	auditWebhookChanged         = "webhook.changed"
+	auditCachePurged            = "cache.purged"
+	auditProductRestored        = "product.restored"
+	auditRoleChanged            = "user.role_changed"
+	auditPasswordResetRequested = "user.password_reset_requested"
+	auditPasswordReset          = "user.password_reset"
+)
+
+// anonymousActor is the actor of an event whose request was not
+// authenticated, such as a login.
+const anonymousActor = "anonymous"
+
+// audit queues an audit event for runAuditWriter: action, done by the
+// caller of r, concerning the user userID when positive. The actor, client
+// address, user agent and request ID are taken from r. It never blocks; an
+// event that does not fit in the queue is logged and counted instead.
+func (s *Server) audit(r *http.Request, action string, userID int64, metadata map[string]any) {
+	ctx := r.Context()
+	ev := store.AuditEvent{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Actor:     auditActor(ctx),
+		ActorRole: roleFrom(ctx),
+		ClientIP:  s.clientIP(r),
+		UserAgent: truncate(r.UserAgent(), maxAuditUserAgent),
+		RequestID: requestIDFrom(ctx),
+	}
+	if userID > 0 {
+		ev.UserID = &userID
+	}
+	if metadata != nil {
+		body, err := json.Marshal(metadata)
+		if err != nil {
+			s.logger.ErrorContext(ctx, "Failed to encode audit metadata", "action", action, "err", err)
+		}
+		ev.Metadata = body
+	}
+
+	select {
+	case s.auditQueue <- ev:
+	default:
+		s.metrics.auditEvents.WithLabelValues("dropped").Inc()
+		s.logger.ErrorContext(ctx, "Audit queue full, event not written", "event", ev)
+	}
+}
+
+// auditActor returns who made the request of ctx: the holder of
+// AdminAuthToken, the user let through by requireSession or requireRole, or
+// anonymousActor.
+func auditActor(ctx context.Context) string {
+	if actor := adminActor(ctx); actor != "" {
+		return actor
+	}
+	if id, ok := userIDFrom(ctx); ok {
+		return "user:" + strconv.FormatInt(id, 10)
+	}
+	return anonymousActor
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// runAuditWriter writes the events queued by audit in batches of up to
+// auditBatchSize, at least every auditFlushInterval. Once ctx is done it
+// writes whatever is still queued and returns, so it must be stopped after
+// the listeners have drained.
+func (s *Server) runAuditWriter(ctx context.Context) {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]store.AuditEvent, 0, auditBatchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) > 0 {
+			s.writeAudit(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case ev := <-s.auditQueue:
+			batch = append(batch, ev)
+			if len(batch) == auditBatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditFlushTimeout)
+			defer cancel()
+			for {
+				select {
+				case ev := <-s.auditQueue:
+					batch = append(batch, ev)
+					if len(batch) == auditBatchSize {
+						flush(flushCtx)
+					}
+				default:
+					flush(flushCtx)
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeAudit inserts events. Events that cannot be written are logged in
+// full, so the record survives in the logs.
+func (s *Server) writeAudit(ctx context.Context, events []store.AuditEvent) {
+	if err := s.audits.Insert(ctx, events); err != nil {
+		s.metrics.auditEvents.WithLabelValues("failed").Add(float64(len(events)))
+		s.logger.ErrorContext(ctx, "Failed to write audit events", "count", len(events), "events", events, "err", err)
+		return
+	}
+	s.metrics.auditEvents.WithLabelValues("written").Add(float64(len(events)))
+}
+
+// auditPage is the response body of GET /admin/audit. NextCursor is empty
+// once the oldest matching event has been returned.
+type auditPage struct {
+	Items      []store.AuditEvent `json:"items"`
+	Limit      int                `json:"limit"`
+	NextCursor string             `json:"next_cursor"`
+}
+
+// auditHandler lists audit events, newest first, optionally only those of
+// ?user_id= and those at or after ?since= (RFC 3339). It pages with ?limit=
+// and ?cursor=. It is only served on the internal listener, behind
+// requireRole.
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	l := store.AuditList{Limit: defaultPageLimit}
+	if v := q.Get("user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "user_id must be a positive integer")
+			return
+		}
+		l.UserID = id
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+		l.Since = since
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "limit must be an integer between 1 and "+strconv.Itoa(maxPageLimit))
+			return
+		}
+		l.Limit = n
+	}
+	before, err := decodeCursor(q.Get("cursor"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "cursor is invalid")
+		return
+	}
+	l.BeforeID = before
+
+	// One more than the limit, so the last page is recognised without an
+	// extra, empty request.
+	limit := l.Limit
+	l.Limit++
+	events, err := s.audits.List(ctx, l)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	page := auditPage{Items: events, Limit: limit}
+	if len(events) > limit {
+		page.Items = events[:limit]
+		page.NextCursor = encodeCursor(page.Items[limit-1].ID)
+	}
+	s.writeJSON(w, http.StatusOK, page)
+}
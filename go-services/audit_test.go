@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go-service/store"
+)
+
+// queueAudits queues n events for user 1 on s.
+func queueAudits(s *Server, n int) {
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	for range n {
+		s.audit(req, auditLoginSucceeded, 1, nil)
+	}
+}
+
+func TestAuditWriter_WritesFullBatches(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	queueAudits(s, 2*auditBatchSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runAuditWriter(ctx)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(testAudits(s).written()) < 2*auditBatchSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events to be written, got %d", 2*auditBatchSize, len(testAudits(s).written()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if got := testAudits(s).batchSizes(); !slices.Equal(got, []int{auditBatchSize, auditBatchSize}) {
+		t.Errorf("expected two full batches, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.auditEvents.WithLabelValues("written")); got != 2*auditBatchSize {
+		t.Errorf("expected %d written events counted, got %v", 2*auditBatchSize, got)
+	}
+}
+
+func TestAuditWriter_FlushesQueueOnShutdown(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	queueAudits(s, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.runAuditWriter(ctx)
+
+	if got := testAudits(s).written(); len(got) != 3 {
+		t.Errorf("expected the 3 queued events to be written on shutdown, got %d", len(got))
+	}
+	if len(s.auditQueue) != 0 {
+		t.Errorf("expected an empty queue, %d events left", len(s.auditQueue))
+	}
+}
+
+func TestAuditWriter_LogsAndCountsFailedWrites(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	s, _, _ := newTestServer(t)
+	s.logger = newLogger(&buf, nil)
+	testAudits(s).fail(errors.New("connection refused"))
+	queueAudits(s, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.runAuditWriter(ctx)
+
+	if got := testutil.ToFloat64(s.metrics.auditEvents.WithLabelValues("failed")); got != 2 {
+		t.Errorf("expected 2 failed events counted, got %v", got)
+	}
+	if logs := buf.String(); !strings.Contains(logs, `"msg":"Failed to write audit events"`) || !strings.Contains(logs, auditLoginSucceeded) {
+		t.Errorf("expected the failed events to be logged, got:\n%s", logs)
+	}
+}
+
+func TestAudit_DropsWhenQueueFull(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.auditQueue = make(chan store.AuditEvent, 1)
+
+	queueAudits(s, 3)
+
+	if got := testutil.ToFloat64(s.metrics.auditEvents.WithLabelValues("dropped")); got != 2 {
+		t.Errorf("expected 2 dropped events counted, got %v", got)
+	}
+}
+
+func TestAudit_RecordsFailedLogin(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"ghost","password":"wrong"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.RemoteAddr = "192.0.2.7:4321"
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+
+	select {
+	case ev := <-s.auditQueue:
+		if ev.Action != auditLoginFailed || ev.Actor != anonymousActor || ev.UserID != nil {
+			t.Errorf("unexpected event %+v", ev)
+		}
+		if ev.ClientIP != "192.0.2.7" || ev.UserAgent != "curl/8.0" || ev.RequestID == "" {
+			t.Errorf("expected the client, user agent and request ID, got %+v", ev)
+		}
+		if !strings.Contains(string(ev.Metadata), `"username":"ghost"`) {
+			t.Errorf("expected the username in the metadata, got %s", ev.Metadata)
+		}
+	default:
+		t.Fatal("expected an audit event")
+	}
+}
+
+func auditRequestTo(s *Server, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/admin/audit"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func decodeAuditPage(t *testing.T, w *httptest.ResponseRecorder) auditPage {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var page auditPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	return page
+}
+
+func TestAuditHandler_FiltersAndPages(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	var events []store.AuditEvent
+	for i := range 5 {
+		userID := int64(1 + i%2)
+		events = append(events, store.AuditEvent{Time: start.Add(time.Duration(i) * time.Hour), Action: auditLoginSucceeded, UserID: &userID})
+	}
+	if err := testAudits(s).Insert(context.Background(), events); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	ids := func(page auditPage) []int64 {
+		var ids []int64
+		for _, ev := range page.Items {
+			ids = append(ids, ev.ID)
+		}
+		return ids
+	}
+
+	page := decodeAuditPage(t, auditRequestTo(s, "?user_id=1&limit=2"))
+	if got := ids(page); !slices.Equal(got, []int64{5, 3}) || page.NextCursor == "" {
+		t.Fatalf("expected events 5 and 3 with a cursor, got %v (%q)", got, page.NextCursor)
+	}
+	page = decodeAuditPage(t, auditRequestTo(s, "?user_id=1&limit=2&cursor="+page.NextCursor))
+	if got := ids(page); !slices.Equal(got, []int64{1}) || page.NextCursor != "" {
+		t.Errorf("expected event 1 on the last page, got %v (%q)", got, page.NextCursor)
+	}
+
+	page = decodeAuditPage(t, auditRequestTo(s, "?since=2024-01-02T06:00:00Z"))
+	if got := ids(page); !slices.Equal(got, []int64{5, 4}) {
+		t.Errorf("expected the events from 06:00, got %v", got)
+	}
+}
+
+func TestAuditHandler_RejectsBadParameters(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	for _, query := range []string{"?user_id=abc", "?user_id=0", "?since=yesterday", "?limit=0", "?cursor=!!"} {
+		if w := auditRequestTo(s, query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestAuditHandler_RequiresAdminToken(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/audit", nil)
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+}
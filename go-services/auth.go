@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"go-service/store"
+)
+
+// maxSmallBodyBytes caps the body of requests carrying a few short fields,
+// such as credentials, a toggle or a role.
+const maxSmallBodyBytes = 4 << 10
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// dummyPasswordHash is compared against when the user does not exist so that
+// unknown usernames take as long to reject as wrong passwords.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+	return h
+})
+
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	var v validator
+	v.check(req.Username != "", "username", "is required")
+	v.check(req.Password != "", "password", "is required")
+	if err := v.err(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	limitKeys := s.loginFailureKeys(r, req.Username)
+	if wait := s.loginLockedFor(ctx, limitKeys); wait > 0 {
+		s.metrics.loginAttempts.WithLabelValues("locked").Inc()
+		s.logger.InfoContext(ctx, "Login rejected", "reason", "locked out")
+		s.audit(r, auditLoginFailed, 0, map[string]any{"username": req.Username, "reason": "locked out"})
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		s.writeError(w, http.StatusTooManyRequests, codeTooManyRequests, "too many failed login attempts")
+		return
+	}
+
+	creds, err := s.users.Credentials(ctx, req.Username)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(req.Password))
+		s.loginFailed(ctx, limitKeys)
+		s.logger.InfoContext(ctx, "Login failed", "reason", "unknown user")
+		s.audit(r, auditLoginFailed, 0, map[string]any{"username": req.Username, "reason": "unknown user"})
+		s.writeError(w, http.StatusUnauthorized, codeInvalidCredentials, "invalid username or password")
+		return
+	case errors.Is(err, store.ErrTimeout), errors.Is(err, errDependencyUnavailable):
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+
+	userID := creds.ID
+	if err := bcrypt.CompareHashAndPassword(creds.PasswordHash, []byte(req.Password)); err != nil {
+		s.loginFailed(ctx, limitKeys)
+		s.logger.InfoContext(ctx, "Login failed", "reason", "bad password", "user_id", userID)
+		s.audit(r, auditLoginFailed, userID, map[string]any{"reason": "bad password"})
+		s.writeError(w, http.StatusUnauthorized, codeInvalidCredentials, "invalid username or password")
+		return
+	}
+
+	token, expiresIn, err := s.issueToken(ctx, userID, creds.Role)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to issue token", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+
+	s.resetLoginFailures(ctx, limitKeys)
+	s.metrics.loginAttempts.WithLabelValues("success").Inc()
+	s.logger.InfoContext(ctx, "Login succeeded", "user_id", userID)
+	s.audit(r, auditLoginSucceeded, userID, nil)
+	s.writeJSON(w, http.StatusOK, loginResponse{
+		Token:     token,
+		ExpiresIn: int64(expiresIn.Seconds()),
+	})
+}
+
+// issueToken returns a JWT when JWTs are enabled and a new Redis session
+// otherwise, along with how long it is valid. Either carries role, so a
+// role change applies to the user's next login.
+func (s *Server) issueToken(ctx context.Context, userID int64, role string) (string, time.Duration, error) {
+	if s.jwt != nil {
+		token, err := s.jwt.sign(userID, role, time.Now())
+		return token, s.jwt.ttl, err
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return "", 0, fmt.Errorf("generate session token: %w", err)
+	}
+	if err := s.storeSession(ctx, token, userID, role); err != nil {
+		return "", 0, fmt.Errorf("store session: %w", err)
+	}
+	return token, s.cfg.SessionTTL, nil
+}
+
+// loginFailed charges a failed attempt to the brute-force limiter.
+func (s *Server) loginFailed(ctx context.Context, limitKeys []string) {
+	s.recordLoginFailure(ctx, limitKeys)
+	s.metrics.loginAttempts.WithLabelValues("failure").Inc()
+}
+
+// sessionTokenBytes is the amount of randomness in a session token.
+const sessionTokenBytes = 32
+
+// newSessionToken returns a random 256-bit token, hex encoded.
+func newSessionToken() (string, error) {
+	b := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	return string(h)
+}
+
+func postLogin(s *Server, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.loginHandler(w, req)
+	return w
+}
+
+func TestLoginHandler_Success(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.SessionTTL = time.Hour
+
+	testUsers(s).add(7, "admin", mustHash(t, "admin123"))
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectSet(`session:[0-9a-f]{64}`, "^7:user$", time.Hour).SetVal("OK")
+	redisMock.Regexp().ExpectSAdd(testKeys.userSessions(7), `session:[0-9a-f]{64}`).SetVal(1)
+	redisMock.ExpectExpire(testKeys.userSessions(7), time.Hour).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	w := postLogin(s, `{"username":"admin","password":"admin123"}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp loginResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if len(resp.Token) != 64 {
+		t.Errorf("expected a 256-bit hex token, got %q", resp.Token)
+	}
+	if resp.ExpiresIn != 3600 {
+		t.Errorf("expected expires_in 3600, got %d", resp.ExpiresIn)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestLoginHandler_BadPasswordAndUnknownUserLookAlike(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	testUsers(s).add(7, "admin", mustHash(t, "admin123"))
+
+	badPassword := postLogin(s, `{"username":"admin","password":"wrong"}`)
+	unknownUser := postLogin(s, `{"username":"ghost","password":"wrong"}`)
+
+	for name, w := range map[string]*httptest.ResponseRecorder{"bad password": badPassword, "unknown user": unknownUser} {
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, w.Code)
+		}
+	}
+	if badPassword.Body.String() != unknownUser.Body.String() {
+		t.Errorf("responses differ: %q vs %q", badPassword.Body.String(), unknownUser.Body.String())
+	}
+}
+
+func TestLoginHandler_RejectsBadRequests(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"malformed JSON", http.MethodPost, `{"username":`, http.StatusBadRequest},
+		{"missing password", http.MethodPost, `{"username":"admin"}`, http.StatusBadRequest},
+		{"oversized body", http.MethodPost, `{"username":"` + strings.Repeat("a", maxSmallBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/login", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// errDependencyUnavailable is returned, wrapped, instead of calling a
+// dependency whose circuit breaker is open.
+var errDependencyUnavailable = errors.New("dependency unavailable")
+
+// breakerState is a circuit breaker state, exported as the value of
+// circuit_breaker_state.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (st breakerState) String() string {
+	switch st {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker fails calls to a dependency fast once it looks down. After
+// threshold consecutive failures it opens and rejects calls for cooldown;
+// then it lets one probe through (half-open), and closes again if the probe
+// succeeds or reopens if it fails.
+type circuitBreaker struct {
+	dependency string
+	threshold  int
+	cooldown   time.Duration
+	logger     *slog.Logger
+	gauge      prometheus.Gauge
+	// now is the clock, replaced in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	// since is when the breaker opened or, half-open, when the probe
+	// started.
+	since   time.Time
+	probing bool
+}
+
+func newCircuitBreaker(dependency string, cfg Config, logger *slog.Logger, m *metrics) *circuitBreaker {
+	return &circuitBreaker{
+		dependency: dependency,
+		threshold:  cfg.BreakerThreshold,
+		cooldown:   cfg.BreakerCooldown,
+		logger:     logger,
+		gauge:      m.breakerState.WithLabelValues(dependency),
+		now:        time.Now,
+	}
+}
+
+// allow returns nil if a call may go ahead, and an error wrapping
+// errDependencyUnavailable otherwise. Every allowed call must be followed by
+// done.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.since) < b.cooldown {
+			return b.unavailable()
+		}
+		b.setState(breakerHalfOpen)
+	case breakerHalfOpen:
+		// A probe that never reported back does not wedge the breaker.
+		if b.probing && now.Sub(b.since) < b.cooldown {
+			return b.unavailable()
+		}
+	default:
+		return nil
+	}
+	b.probing, b.since = true, now
+	return nil
+}
+
+// done records the outcome of an allowed call.
+func (b *circuitBreaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !failed:
+		b.failures = 0
+		if b.state == breakerHalfOpen {
+			b.probing = false
+			b.setState(breakerClosed)
+		}
+	case b.state == breakerHalfOpen:
+		b.probing, b.since = false, b.now()
+		b.setState(breakerOpen)
+	case b.state == breakerClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.failures, b.since = 0, b.now()
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+func (b *circuitBreaker) unavailable() error {
+	return fmt.Errorf("%w: %s circuit is %s", errDependencyUnavailable, b.dependency, b.state)
+}
+
+// setState moves to st, logging and exporting the change. b.mu must be
+// held.
+func (b *circuitBreaker) setState(st breakerState) {
+	if st == b.state {
+		return
+	}
+	level := slog.LevelWarn
+	if st == breakerClosed {
+		level = slog.LevelInfo
+	}
+	b.logger.Log(context.Background(), level, "Circuit breaker state changed",
+		"dependency", b.dependency, "from", b.state.String(), "to", st.String())
+	b.state = st
+	b.gauge.Set(float64(st))
+}
+
+// call runs fn through the breaker, counting the errors failed reports.
+func (b *circuitBreaker) call(fn func() error, failed func(error) bool) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.done(failed(err))
+	return err
+}
+
+// redisFailed reports whether err means Redis is in trouble. A missing key
+// is an answer, and a cancelled request says nothing about Redis.
+func redisFailed(err error) bool {
+	return err != nil && !errors.Is(err, redis.Nil) && !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, errDependencyUnavailable)
+}
+
+// breakerHook is a go-redis hook that sends every command and pipeline
+// through a circuit breaker.
+type breakerHook struct {
+	breaker *circuitBreaker
+}
+
+func (h breakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h breakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := h.breaker.call(func() error { return next(ctx, cmd) }, redisFailed)
+		if errors.Is(err, errDependencyUnavailable) {
+			cmd.SetErr(err)
+		}
+		return err
+	}
+}
+
+func (h breakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := h.breaker.call(func() error { return next(ctx, cmds) }, redisFailed)
+		if errors.Is(err, errDependencyUnavailable) {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+
+	"go-service/store"
+)
+
+var errConnRefused = errors.New("connection refused")
+
+// newTestBreaker returns a breaker opening after three failures for ten
+// seconds, on a clock the test moves by hand.
+func newTestBreaker(s *Server, dependency string) (*circuitBreaker, *time.Time) {
+	cfg := Config{BreakerThreshold: 3, BreakerCooldown: 10 * time.Second}
+	b := newCircuitBreaker(dependency, cfg, s.logger, s.metrics)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+// failCalls makes n calls through b that fail with err.
+func failCalls(b *circuitBreaker, n int, err error) {
+	for range n {
+		_ = b.call(func() error { return err }, postgresFailed)
+	}
+}
+
+func TestCircuitBreaker_OpensAndRecovers(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	b, now := newTestBreaker(s, "postgres")
+	gauge := s.metrics.breakerState.WithLabelValues("postgres")
+
+	failCalls(b, 2, errConnRefused)
+	if b.state != breakerClosed {
+		t.Fatalf("expected the breaker to stay closed below the threshold, got %s", b.state)
+	}
+	failCalls(b, 1, errConnRefused)
+	if b.state != breakerOpen || testutil.ToFloat64(gauge) != 1 {
+		t.Fatalf("expected the breaker to open, got %s (gauge %v)", b.state, testutil.ToFloat64(gauge))
+	}
+
+	ran := false
+	err := b.call(func() error { ran = true; return nil }, postgresFailed)
+	if ran || !errors.Is(err, errDependencyUnavailable) {
+		t.Fatalf("expected an open breaker to fail fast, got %v (ran %v)", err, ran)
+	}
+
+	*now = now.Add(10 * time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a probe after the cooldown, got %v", err)
+	}
+	if b.state != breakerHalfOpen || testutil.ToFloat64(gauge) != 2 {
+		t.Fatalf("expected the breaker to be half-open, got %s (gauge %v)", b.state, testutil.ToFloat64(gauge))
+	}
+	if err := b.allow(); !errors.Is(err, errDependencyUnavailable) {
+		t.Errorf("expected a second call to wait for the probe, got %v", err)
+	}
+
+	b.done(false)
+	if b.state != breakerClosed || testutil.ToFloat64(gauge) != 0 {
+		t.Fatalf("expected a good probe to close the breaker, got %s (gauge %v)", b.state, testutil.ToFloat64(gauge))
+	}
+	if err := b.call(func() error { return nil }, postgresFailed); err != nil {
+		t.Errorf("expected a closed breaker to pass calls, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_FailedProbeReopens(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	b, now := newTestBreaker(s, "postgres")
+
+	failCalls(b, 3, errConnRefused)
+	*now = now.Add(10 * time.Second)
+	failCalls(b, 1, errConnRefused)
+	if b.state != breakerOpen {
+		t.Fatalf("expected a failed probe to reopen the breaker, got %s", b.state)
+	}
+
+	// The cooldown starts over from the failed probe.
+	*now = now.Add(5 * time.Second)
+	if err := b.allow(); !errors.Is(err, errDependencyUnavailable) {
+		t.Errorf("expected the breaker to stay open for a new cooldown, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_IgnoresAnswers(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	b, _ := newTestBreaker(s, "postgres")
+
+	failCalls(b, 5, store.ErrNotFound)
+	failCalls(b, 5, context.Canceled)
+	failCalls(b, 2, errConnRefused)
+	failCalls(b, 1, nil)
+	failCalls(b, 2, errConnRefused)
+	if b.state != breakerClosed {
+		t.Errorf("expected only consecutive failures to count, got %s", b.state)
+	}
+}
+
+func TestProductHandler_BreakerOpen(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	b, _ := newTestBreaker(s, "postgres")
+	fake := testProducts(s)
+	fake.fail(errConnRefused)
+	s.products = breakerProducts{next: fake, breaker: b}
+	h := s.Handler()
+
+	for range 3 {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/7", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected 500 while the breaker is closed, got %d", w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/7", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the breaker opened, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeDependencyUnavailable {
+		t.Errorf("expected code %q, got %+v", codeDependencyUnavailable, got)
+	}
+	if fake.calls != 3 {
+		t.Errorf("expected the open breaker to keep calls from the store, got %d calls", fake.calls)
+	}
+}
+
+func TestBreakerHook_FailsRedisFast(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	b, _ := newTestBreaker(s, "redis")
+
+	// Nothing listens on port 1, so every dial is refused.
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { rdb.Close() })
+	rdb.AddHook(breakerHook{breaker: b})
+	ctx := context.Background()
+
+	for range 3 {
+		if err := rdb.Get(ctx, "k").Err(); err == nil || errors.Is(err, errDependencyUnavailable) {
+			t.Fatalf("expected a dial error, got %v", err)
+		}
+	}
+	if err := rdb.Get(ctx, "k").Err(); !errors.Is(err, errDependencyUnavailable) {
+		t.Errorf("expected the open breaker to fail the command, got %v", err)
+	}
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Get(ctx, "k")
+		return nil
+	})
+	if !errors.Is(err, errDependencyUnavailable) {
+		t.Errorf("expected the open breaker to fail the pipeline, got %v", err)
+	}
+}
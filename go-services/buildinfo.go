@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Any left empty falls back to what the Go toolchain embedded in the binary.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// unknownBuildValue stands in for metadata that is available from neither
+// the linker flags nor the embedded build info.
+const unknownBuildValue = "unknown"
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// readBuildInfo returns the build metadata of the running binary. Values
+// not set through -ldflags are taken from debug.ReadBuildInfo: the module
+// version and the VCS revision and commit time recorded by go build.
+func readBuildInfo() buildInfo {
+	b := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && bi.Main.Version != "(devel)" {
+			b.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildDate == "":
+				b.BuildDate = s.Value
+			}
+		}
+	}
+
+	for _, v := range []*string{&b.Version, &b.Commit, &b.BuildDate} {
+		if *v == "" {
+			*v = unknownBuildValue
+		}
+	}
+	return b
+}
+
+// versionHandler reports which build is running and the database schema
+// version it found at startup.
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, struct {
+		buildInfo
+		SchemaVersion int64 `json:"schema_version"`
+	}{s.build, s.schemaVersion})
+}
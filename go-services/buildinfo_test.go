@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// setLinkerVars sets the -ldflags build variables for the duration of the
+// test. Tests using it must not be parallel.
+func setLinkerVars(t *testing.T, v, c, d string) {
+	t.Helper()
+	oldVersion, oldCommit, oldDate := version, commit, buildDate
+	version, commit, buildDate = v, c, d
+	t.Cleanup(func() { version, commit, buildDate = oldVersion, oldCommit, oldDate })
+}
+
+func TestReadBuildInfo_PrefersLinkerFlags(t *testing.T) {
+	setLinkerVars(t, "v1.4.0", "0123abcd", "2026-10-16T09:00:00Z")
+
+	got := readBuildInfo()
+	want := buildInfo{Version: "v1.4.0", Commit: "0123abcd", BuildDate: "2026-10-16T09:00:00Z", GoVersion: runtime.Version()}
+	if got != want {
+		t.Errorf("readBuildInfo() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadBuildInfo_FallsBackWithoutLinkerFlags(t *testing.T) {
+	setLinkerVars(t, "", "", "")
+
+	got := readBuildInfo()
+	if got.Version == "" || got.Commit == "" || got.BuildDate == "" {
+		t.Errorf("expected every field to be filled, got %+v", got)
+	}
+	if got.GoVersion != runtime.Version() {
+		t.Errorf("GoVersion = %q, want %q", got.GoVersion, runtime.Version())
+	}
+}
+
+func TestMetrics_ExportsBuildInfo(t *testing.T) {
+	setLinkerVars(t, "v1.4.0", "0123abcd", "2026-10-16T09:00:00Z")
+	s, _, _ := newTestServer(t)
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := s.metrics.register(reg); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	s.metrics.setBuildInfo(readBuildInfo())
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	var found bool
+	for _, mf := range families {
+		if mf.GetName() != "service_build_info" {
+			continue
+		}
+		found = true
+		if len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected one series, got %d", len(mf.GetMetric()))
+		}
+		m := mf.GetMetric()[0]
+		if got := m.GetGauge().GetValue(); got != 1 {
+			t.Errorf("expected value 1, got %v", got)
+		}
+		labels := make(map[string]string)
+		for _, lp := range m.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		want := map[string]string{
+			"version":    "v1.4.0",
+			"commit":     "0123abcd",
+			"build_date": "2026-10-16T09:00:00Z",
+			"go_version": runtime.Version(),
+		}
+		for k, v := range want {
+			if labels[k] != v {
+				t.Errorf("label %s = %q, want %q", k, labels[k], v)
+			}
+		}
+	}
+	if !found {
+		t.Error("expected service_build_info in the registry")
+	}
+}
+
+func TestVersionHandler_ReturnsBuildInfo(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.build = buildInfo{Version: "v1.4.0", Commit: "0123abcd", BuildDate: "2026-10-16T09:00:00Z", GoVersion: "go1.23.5"}
+	s.schemaVersion = 3
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	want := map[string]any{
+		"version":        "v1.4.0",
+		"commit":         "0123abcd",
+		"build_date":     "2026-10-16T09:00:00Z",
+		"go_version":     "go1.23.5",
+		"schema_version": 3.0,
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected exactly %d fields, got %v", len(want), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"go-service/store"
+)
+
+// bulkResult is the outcome for one product of a bulk import, by its
+// position in the request.
+type bulkResult struct {
+	Index int          `json:"index"`
+	ID    int64        `json:"id,omitempty"`
+	Error *errorDetail `json:"error,omitempty"`
+}
+
+// bulkResponse summarises a bulk import.
+type bulkResponse struct {
+	Created int          `json:"created"`
+	Failed  int          `json:"failed"`
+	Results []bulkResult `json:"results"`
+}
+
+// bulkItem is one decoded product of a bulk import, or why it could not be
+// decoded.
+type bulkItem struct {
+	in  productInput
+	err error
+}
+
+// bulkCreateProductsHandler imports products from a JSON array or NDJSON
+// body. By default every valid product is inserted, in transactions of
+// store.InsertBatchSize, and the others are reported: 201 if all were
+// created, 207 otherwise. With ?atomic=true one invalid product rejects the
+// request with 400 and a database error rolls everything back.
+func (s *Server) bulkCreateProductsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	atomic := false
+	if v := r.URL.Query().Get("atomic"); v != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "atomic must be true or false")
+			return
+		}
+	}
+	items, ok := s.decodeBulk(w, r)
+	if !ok {
+		return
+	}
+
+	resp := bulkResponse{Results: make([]bulkResult, len(items))}
+	var valid []store.ProductInput
+	var validIndex []int
+	for i, item := range items {
+		resp.Results[i].Index = i
+		err := item.err
+		if err == nil {
+			err = item.in.validate()
+		}
+		if err != nil {
+			resp.Results[i].Error = &errorDetail{Code: codeValidation, Message: err.Error(), Fields: fieldErrors(err)}
+			resp.Failed++
+			continue
+		}
+		valid = append(valid, item.in.store())
+		validIndex = append(validIndex, i)
+	}
+	if atomic && resp.Failed > 0 {
+		s.writeJSON(w, http.StatusBadRequest, resp.failures())
+		return
+	}
+
+	batch := store.InsertBatchSize
+	if atomic {
+		batch = max(len(valid), 1)
+	}
+	for start := 0; start < len(valid); start += batch {
+		end := min(start+batch, len(valid))
+		ids, err := s.products.CreateMany(ctx, valid[start:end])
+		if err != nil {
+			s.logger.ErrorContext(ctx, "DB bulk insert failed", "err", err, "path", r.URL.Path, "created", resp.Created)
+			if resp.Created == 0 {
+				s.writeDBError(w, err)
+				return
+			}
+			_, detail := dbError(err)
+			for _, i := range validIndex[start:] {
+				resp.Results[i].Error = &detail
+			}
+			resp.Failed += len(valid) - start
+			break
+		}
+		for j, id := range ids {
+			resp.Results[validIndex[start+j]].ID = id
+		}
+		resp.Created += len(ids)
+	}
+
+	if resp.Created > 0 {
+		keys := []string{s.keys.products()}
+		for _, res := range resp.Results {
+			if res.ID != 0 {
+				keys = append(keys, s.keys.product(res.ID))
+			}
+		}
+		s.cacheInvalidate(ctx, keys...)
+		for _, res := range resp.Results {
+			if res.ID != 0 {
+				s.publishProductEvent(ctx, eventProductCreated, res.ID, productRef{ID: res.ID})
+			}
+		}
+	}
+	s.logger.InfoContext(ctx, "Products imported", "created", resp.Created, "failed", resp.Failed)
+	status := http.StatusCreated
+	if resp.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	s.writeJSON(w, status, resp)
+}
+
+// failures returns the response with only the failed results.
+func (r bulkResponse) failures() bulkResponse {
+	failed := make([]bulkResult, 0, r.Failed)
+	for _, res := range r.Results {
+		if res.Error != nil {
+			failed = append(failed, res)
+		}
+	}
+	r.Results = failed
+	return r
+}
+
+// decodeBulk reads the products of a bulk import: a JSON array for
+// application/json, one object per line for application/x-ndjson. A product
+// of the wrong shape is returned with its error, for the caller to report;
+// a malformed or oversized body gets an error response and false.
+func (s *Server) decodeBulk(w http.ResponseWriter, r *http.Request) ([]bulkItem, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	array := mediaType == "application/json"
+	if !array && mediaType != "application/x-ndjson" {
+		s.writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Content-Type must be application/json or application/x-ndjson")
+		return nil, false
+	}
+	limit := int64(s.cfg.BulkMaxBytes)
+	if r.ContentLength > limit {
+		s.writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "request body too large")
+		return nil, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	items, err := decodeBulkItems(dec, array, s.cfg.BulkMaxItems)
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		s.writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "request body too large")
+		return nil, false
+	case errors.Is(err, errTooManyItems):
+		s.writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+			fmt.Sprintf("at most %d products can be imported at once", s.cfg.BulkMaxItems))
+		return nil, false
+	case err != nil:
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return nil, false
+	case len(items) == 0:
+		s.writeError(w, http.StatusBadRequest, codeValidation, "at least one product is required")
+		return nil, false
+	}
+	return items, true
+}
+
+var errTooManyItems = errors.New("too many products")
+
+// decodeBulkItems decodes at most limit products from dec, returning
+// errTooManyItems past that. Errors other than the body's are suitable for
+// the client.
+func decodeBulkItems(dec *json.Decoder, array bool, limit int) ([]bulkItem, error) {
+	invalidBody := errors.New("invalid JSON body")
+	if array {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return nil, bodyError(err, errors.New("body must be a JSON array of products"))
+		}
+	}
+
+	var items []bulkItem
+	for dec.More() {
+		if len(items) == limit {
+			return nil, errTooManyItems
+		}
+		var item bulkItem
+		err := dec.Decode(&item.in)
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case err == nil:
+		case errors.As(err, &typeErr) && typeErr.Field == "":
+			item.err = errors.New("product must be a JSON object")
+		default:
+			f, ok := decodeFieldError(err)
+			if !ok {
+				return nil, bodyError(err, invalidBody)
+			}
+			item.err = validationError{f}
+		}
+		items = append(items, item)
+	}
+
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return nil, bodyError(err, invalidBody)
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, bodyError(err, invalidBody)
+	}
+	return items, nil
+}
+
+// bodyError returns err if it came from reading an oversized body, and
+// otherwise the error for the client.
+func bodyError(err, client error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return err
+	}
+	return client
+}
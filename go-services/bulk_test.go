@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redismock/v9"
+
+	"go-service/store"
+)
+
+func postBulk(s *Server, contentType, query, body string) *httptest.ResponseRecorder {
+	r := asAdmin(httptest.NewRequest(http.MethodPost, "/products:batch"+query, strings.NewReader(body)))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+// bulkArray returns a JSON array of n valid products.
+func bulkArray(n int) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"name":"Product %d","price":1}`, i+1)
+	}
+	return "[" + strings.Join(items, ",") + "]"
+}
+
+func decodeBulk(t *testing.T, w *httptest.ResponseRecorder) bulkResponse {
+	t.Helper()
+	var resp bulkResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func (f *fakeProducts) batchSizes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.batches)
+}
+
+// expectImported expects the cache invalidation after products 1 to n were
+// imported.
+func expectImported(redisMock redismock.ClientMock, n int) {
+	keys := []string{testKeys.products()}
+	for id := range int64(n) {
+		keys = append(keys, testKeys.product(id+1))
+	}
+	expectUnlinkKeys(redisMock, keys...)
+}
+
+func TestBulkCreateProducts_Batches(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		n       int
+		query   string
+		batches []int
+	}{
+		{1, "", []int{1}},
+		{store.InsertBatchSize, "", []int{store.InsertBatchSize}},
+		{store.InsertBatchSize + 1, "", []int{store.InsertBatchSize, 1}},
+		{2*store.InsertBatchSize + 3, "", []int{store.InsertBatchSize, store.InsertBatchSize, 3}},
+		// Atomic imports are one transaction; the store splits statements.
+		{2*store.InsertBatchSize + 3, "?atomic=true", []int{2*store.InsertBatchSize + 3}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.n, tt.query), func(t *testing.T) {
+			t.Parallel()
+			s, _, redisMock := newTestServer(t)
+			expectImported(redisMock, tt.n)
+
+			w := postBulk(s, "application/json", tt.query, bulkArray(tt.n))
+
+			if w.Code != http.StatusCreated {
+				t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+			}
+			resp := decodeBulk(t, w)
+			if resp.Created != tt.n || resp.Failed != 0 || len(resp.Results) != tt.n {
+				t.Fatalf("expected %d created, got %+v", tt.n, resp)
+			}
+			for i, res := range resp.Results {
+				if res.Index != i || res.ID != int64(i+1) || res.Error != nil {
+					t.Fatalf("unexpected result %d: %+v", i, res)
+				}
+			}
+			if got := testProducts(s).batchSizes(); !slices.Equal(got, tt.batches) {
+				t.Errorf("expected batches %v, got %v", tt.batches, got)
+			}
+			if err := redisMock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet redis expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestBulkCreateProducts_ReportsInvalidItems(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	expectImported(redisMock, 2)
+
+	body := `{"name":"Chair","price":49.5}
+{"name":"","price":1}
+{"name":"Lamp","price":"cheap"}
+42
+{"name":"Rug","price":10}
+{"name":"Vase","price":5,"colour":"blue"}
+`
+	w := postBulk(s, "application/x-ndjson", "", body)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", w.Code, w.Body)
+	}
+	resp := decodeBulk(t, w)
+	if resp.Created != 2 || resp.Failed != 4 {
+		t.Errorf("expected 2 created and 4 failed, got %+v", resp)
+	}
+	wantErrors := map[int]string{
+		1: "name is required",
+		2: "price must be a number",
+		3: "product must be a JSON object",
+		5: "colour is not a known field",
+	}
+	for _, res := range resp.Results {
+		want, failed := wantErrors[res.Index]
+		switch {
+		case failed && (res.Error == nil || res.Error.Code != codeValidation || res.Error.Message != want):
+			t.Errorf("item %d: expected validation error %q, got %+v", res.Index, want, res)
+		case !failed && (res.ID == 0 || res.Error != nil):
+			t.Errorf("item %d: expected an id, got %+v", res.Index, res)
+		}
+	}
+	if got := testProducts(s).batchSizes(); !slices.Equal(got, []int{2}) {
+		t.Errorf("expected the two valid products inserted together, got %v", got)
+	}
+}
+
+func TestBulkCreateProducts_AtomicRejectsInvalidItems(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := postBulk(s, "application/json", "?atomic=true", `[{"name":"Chair","price":1},{"name":"Lamp","price":-2}]`)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+	resp := decodeBulk(t, w)
+	if resp.Created != 0 || resp.Failed != 1 || len(resp.Results) != 1 || resp.Results[0].Index != 1 {
+		t.Errorf("expected only the invalid item reported, got %+v", resp)
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected nothing inserted, got %d store calls", n)
+	}
+}
+
+func TestBulkCreateProducts_DBFailure(t *testing.T) {
+	t.Parallel()
+	n := 2*store.InsertBatchSize + 3
+
+	t.Run("non-atomic keeps committed batches", func(t *testing.T) {
+		t.Parallel()
+		s, _, redisMock := newTestServer(t)
+		expectImported(redisMock, store.InsertBatchSize)
+		testProducts(s).failFrom(1, errors.New("connection reset"))
+
+		w := postBulk(s, "application/json", "", bulkArray(n))
+
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("expected 207, got %d: %s", w.Code, w.Body)
+		}
+		resp := decodeBulk(t, w)
+		if resp.Created != store.InsertBatchSize || resp.Failed != n-store.InsertBatchSize {
+			t.Fatalf("expected the first batch created, got %d created, %d failed", resp.Created, resp.Failed)
+		}
+		if res := resp.Results[store.InsertBatchSize-1]; res.ID == 0 {
+			t.Errorf("expected the last item of the first batch created, got %+v", res)
+		}
+		if res := resp.Results[store.InsertBatchSize]; res.Error == nil || res.Error.Code != codeDBError {
+			t.Errorf("expected the second batch to fail with a db_error, got %+v", res)
+		}
+		// Nothing is attempted after the failed batch.
+		if got := testProducts(s).batchSizes(); len(got) != 2 {
+			t.Errorf("expected two batches, got %v", got)
+		}
+	})
+
+	t.Run("atomic rolls back", func(t *testing.T) {
+		t.Parallel()
+		s, _, _ := newTestServer(t)
+		testProducts(s).fail(errors.New("connection reset"))
+
+		w := postBulk(s, "application/json", "?atomic=true", bulkArray(n))
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected 500, got %d: %s", w.Code, w.Body)
+		}
+		if got := decodeError(t, w); got.Code != codeDBError {
+			t.Errorf("expected a db_error, got %+v", got)
+		}
+	})
+}
+
+func TestBulkCreateProducts_RejectsBadRequests(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		contentType string
+		query       string
+		body        string
+		status      int
+		code        string
+	}{
+		{"too many items", "application/json", "", bulkArray(4), http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"too many NDJSON lines", "application/x-ndjson", "", strings.Repeat(`{"name":"A","price":1}`+"\n", 4), http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"too many bytes", "application/json", "", `[{"name":"` + strings.Repeat("a", 512) + `","price":1}]`, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"not an array", "application/json", "", `{"name":"Chair","price":1}`, http.StatusBadRequest, codeBadRequest},
+		{"malformed", "application/json", "", `[{"name":"Chair",`, http.StatusBadRequest, codeBadRequest},
+		{"trailing data", "application/json", "", `[] []`, http.StatusBadRequest, codeBadRequest},
+		{"empty", "application/json", "", `[]`, http.StatusBadRequest, codeValidation},
+		{"empty NDJSON", "application/x-ndjson", "", "", http.StatusBadRequest, codeValidation},
+		{"wrong content type", "text/csv", "", "name,price\n", http.StatusUnsupportedMediaType, codeUnsupportedMedia},
+		{"bad atomic flag", "application/json", "?atomic=maybe", bulkArray(1), http.StatusBadRequest, codeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s, _, _ := newTestServer(t)
+			s.cfg.BulkMaxItems = 3
+			s.cfg.BulkMaxBytes = 256
+
+			w := postBulk(s, tt.contentType, tt.query, tt.body)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if got := decodeError(t, w); got.Code != tt.code {
+				t.Errorf("expected code %q, got %+v", tt.code, got)
+			}
+			if n := testProducts(s).callCount(); n != 0 {
+				t.Errorf("expected no store access, got %d calls", n)
+			}
+		})
+	}
+}
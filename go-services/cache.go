@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache keys carry the REDIS_KEY_PREFIX; see redisKeys. Entries written
+// before the prefix was introduced are never read again: every lookup is by
+// the prefixed key, so they count as misses and expire with their TTL.
+
+// productsCacheField is the field of the products and productsStale hashes
+// holding the product list page described by p and f.
+func productsCacheField(p pageParams, f productFilter) string {
+	field := p.cacheField()
+	if ff := f.cacheField(); ff != "" {
+		field += ":" + ff
+	}
+	return field
+}
+
+// productsETagField is the field of the products hash holding the ETag of
+// the page in field. It is written with the page, so a hit can be answered
+// conditionally without hashing the body again.
+func productsETagField(field string) string {
+	return field + "#etag"
+}
+
+// cacheGet returns the cached JSON stored under key. name labels the hit and
+// miss counters. A Redis failure is treated as a miss so the caller falls
+// back to Postgres.
+func (s *Server) cacheGet(ctx context.Context, name, key string) ([]byte, bool) {
+	if s.settings().ProductsCacheTTL <= 0 {
+		return nil, false
+	}
+
+	body, err := s.rdb.Get(ctx, key).Bytes()
+	return s.cacheResult(ctx, name, key, body, err)
+}
+
+// cacheGetPage returns the cached product list page in field and its ETag.
+func (s *Server) cacheGetPage(ctx context.Context, field string) (body []byte, etag string, ok bool) {
+	if s.settings().ProductsCacheTTL <= 0 {
+		return nil, "", false
+	}
+
+	key := s.keys.products()
+	vals, err := s.rdb.HMGet(ctx, key, field, productsETagField(field)).Result()
+	if err == nil {
+		if v, isString := vals[0].(string); isString {
+			body = []byte(v)
+			etag, _ = vals[1].(string)
+		} else {
+			err = redis.Nil
+		}
+	}
+	if body, ok = s.cacheResult(ctx, "products", key, body, err); ok && etag == "" {
+		// Cached before ETags were stored alongside pages.
+		etag = etagFor(body)
+	}
+	return body, etag, ok
+}
+
+// cacheResult decodes a value read from the cache, counting the outcome. A
+// value that cannot be decoded counts as a failed read.
+func (s *Server) cacheResult(ctx context.Context, name, key string, body []byte, err error) ([]byte, bool) {
+	if err == nil {
+		body, err = s.cacheCodec.decode(body)
+	}
+	switch {
+	case err == nil:
+		s.metrics.cacheHits.WithLabelValues(name).Inc()
+		s.metrics.cacheOperations.WithLabelValues(name, "hit").Inc()
+		return body, true
+	case errors.Is(err, redis.Nil):
+		s.metrics.cacheOperations.WithLabelValues(name, "miss").Inc()
+	default:
+		s.logger.WarnContext(ctx, "Cache read failed", "key", key, "err", err)
+		s.metrics.cacheOperations.WithLabelValues(name, "error").Inc()
+	}
+	s.metrics.cacheMisses.WithLabelValues(name).Inc()
+	return nil, false
+}
+
+// cacheInvalidate deletes keys so that writes are visible immediately rather
+// than after the TTL. It runs even when caching is disabled, in case entries
+// remain from before it was turned off. Failures are logged and otherwise
+// ignored.
+func (s *Server) cacheInvalidate(ctx context.Context, keys ...string) {
+	if _, err := unlinkKeys(ctx, s.rdb, keys...); err != nil {
+		s.logger.WarnContext(ctx, "Cache invalidation failed", "keys", keys, "err", err)
+	}
+}
+
+// cacheSetPage stores a product list page and its ETag in the products
+// hash. The TTL is set only when the hash is created, so the first cached
+// page bounds how long all of them live. Failures are logged and returned
+// for callers that care; handlers ignore them.
+func (s *Server) cacheSetPage(ctx context.Context, field string, body []byte, etag string) error {
+	ttl := s.settings().ProductsCacheTTL
+	if ttl <= 0 {
+		return nil
+	}
+	key := s.keys.products()
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, field, s.cacheEncode(ctx, "products", body), productsETagField(field), etag)
+		pipe.ExpireNX(ctx, key, s.cacheTTL(ttl))
+		return nil
+	})
+	if err != nil {
+		s.logger.WarnContext(ctx, "Cache write failed", "key", key, "field", field, "err", err)
+	}
+	return err
+}
+
+// cacheSet stores body under key for ProductsCacheTTL. Failures are logged
+// and otherwise ignored.
+func (s *Server) cacheSet(ctx context.Context, key string, body []byte) {
+	ttl := s.settings().ProductsCacheTTL
+	if ttl <= 0 {
+		return
+	}
+	if err := s.rdb.Set(ctx, key, s.cacheEncode(ctx, "product", body), s.cacheTTL(ttl)).Err(); err != nil {
+		s.logger.WarnContext(ctx, "Cache write failed", "key", key, "err", err)
+	}
+}
+
+// cacheMissing is cached in place of a product that does not exist. It is
+// neither JSON nor a format byte (see cacheCodec), so it cannot be taken for
+// a cached body, and it is replaced or dropped like one when the product is
+// created.
+var cacheMissing = []byte{0}
+
+// cacheSetMissing remembers for ProductsMissingTTL that key has no product.
+// A product created meanwhile invalidates the entry. Failures are logged and
+// otherwise ignored.
+func (s *Server) cacheSetMissing(ctx context.Context, key string) {
+	cfg := s.settings()
+	if cfg.ProductsCacheTTL <= 0 || cfg.ProductsMissingTTL <= 0 {
+		return
+	}
+	if err := s.rdb.Set(ctx, key, cacheMissing, s.cacheTTL(cfg.ProductsMissingTTL)).Err(); err != nil {
+		s.logger.WarnContext(ctx, "Cache write failed", "key", key, "err", err)
+	}
+}
+
+// cacheTTL spreads ttl by up to ±CacheTTLJitter percent, so that entries
+// written at the same time, such as the product list by every replica, do
+// not all expire at once.
+func (s *Server) cacheTTL(ttl time.Duration) time.Duration {
+	spread := ttl * time.Duration(s.settings().CacheTTLJitter) / 100
+	if spread <= 0 {
+		return ttl
+	}
+	return ttl - spread + rand.N(2*spread+1)
+}
+
+// staleSetField keeps body as the fallback copy of a product list page. Each
+// write pushes the hash's expiry out by ProductsStaleTTL, so pages are kept
+// as long as the list is being read.
+func (s *Server) staleSetField(ctx context.Context, field string, body []byte) {
+	ttl := s.settings().ProductsStaleTTL
+	if ttl <= 0 {
+		return
+	}
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.keys.productsStale(), field, s.cacheEncode(ctx, "products_stale", body))
+		pipe.Expire(ctx, s.keys.productsStale(), s.cacheTTL(ttl))
+		return nil
+	})
+	if err != nil {
+		s.logger.WarnContext(ctx, "Stale copy write failed", "key", s.keys.productsStale(), "field", field, "err", err)
+	}
+}
+
+// staleGetField returns the fallback copy of a product list page, if any.
+func (s *Server) staleGetField(ctx context.Context, field string) ([]byte, bool) {
+	if s.settings().ProductsStaleTTL <= 0 {
+		return nil, false
+	}
+	body, err := s.rdb.HGet(ctx, s.keys.productsStale(), field).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			s.logger.WarnContext(ctx, "Stale copy read failed", "key", s.keys.productsStale(), "err", err)
+		}
+		return nil, false
+	}
+	if body, err = s.cacheCodec.decode(body); err != nil {
+		s.logger.WarnContext(ctx, "Stale copy read failed", "key", s.keys.productsStale(), "err", err)
+		return nil, false
+	}
+	return body, true
+}
+
+// cacheEncode returns the value to store for body in the cache name, in the
+// format set by CacheSerialization and CacheCompression, and counts its size
+// before and after compression. A body that cannot be encoded is stored as
+// it is: plain JSON always decodes.
+func (s *Server) cacheEncode(ctx context.Context, name string, body []byte) []byte {
+	value, serialized, err := s.cacheCodec.encode(body)
+	if err != nil {
+		s.logger.WarnContext(ctx, "Cache value encoding failed, storing plain JSON", "cache", name, "err", err)
+		value, serialized = body, len(body)
+	}
+	s.metrics.cacheValueBytes.WithLabelValues(name, "serialized").Add(float64(serialized))
+	s.metrics.cacheValueBytes.WithLabelValues(name, "stored").Add(float64(len(value)))
+	return value
+}
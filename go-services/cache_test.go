@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProductsHandler_CacheHit(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	cached := `{"items":[],"total":3,"limit":10,"offset":20}`
+	redisMock.ExpectHMGet(testKeys.products(), "limit=10:offset=20", productsETagField("limit=10:offset=20")).SetVal([]any{cached, nil})
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products?limit=10&offset=20", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != cached {
+		t.Fatalf("expected cached body, got %d %q", w.Code, w.Body.String())
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheHits.WithLabelValues("products")); got != 1 {
+		t.Errorf("expected 1 cache hit, got %v", got)
+	}
+}
+
+func TestProductsHandler_CacheMissPopulatesCache(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = 42 * time.Second
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testProducts(s).add(testProduct(1, "Product A", 10.99, created))
+
+	want := `{"items":[{"id":1,"name":"Product A","description":"","price":10.99,"created_at":"2024-01-02T03:04:05Z"}],"total":1,"limit":50,"offset":0}`
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{nil, nil})
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHSet(testKeys.products(), field, []byte(want), productsETagField(field), etagFor([]byte(want))).SetVal(1)
+	redisMock.ExpectExpireNX(testKeys.products(), 42*time.Second).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("expected DB body, got %d %q", w.Code, w.Body.String())
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheMisses.WithLabelValues("products")); got != 1 {
+		t.Errorf("expected 1 cache miss, got %v", got)
+	}
+}
+
+func TestProductsHandler_RedisDownFallsBackToDB(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetErr(errors.New("dial tcp: connection refused"))
+	testProducts(s).add(testProduct(1, "Product A", 10.99, time.Now()))
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectHSet(testKeys.products(), field, `.*`, productsETagField(field), `.*`).SetErr(errors.New("dial tcp: connection refused"))
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from DB fallback, got %d", w.Code)
+	}
+	if n := testProducts(s).callCount(); n != 2 {
+		t.Errorf("expected the list and count read from the store, got %d calls", n)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheOperations.WithLabelValues("products", "error")); got != 1 {
+		t.Errorf("expected 1 cache error, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheOperations.WithLabelValues("products", "miss")); got != 0 {
+		t.Errorf("expected errors not to count as misses, got %v", got)
+	}
+}
+
+func TestProductHandler_CacheHitSkipsDB(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	cached := `{"id":3,"name":"Cached","price":1,"created_at":"2024-01-01T00:00:00Z"}`
+	redisMock.ExpectGet(testKeys.product(3)).SetVal(cached)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/3", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != cached {
+		t.Fatalf("expected cached body, got %d %q", w.Code, w.Body.String())
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheHits.WithLabelValues("product")); got != 1 {
+		t.Errorf("expected 1 cache hit, got %v", got)
+	}
+}
+
+func TestProductsHandler_FreshReadsRefreshStaleCopy(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	s.cfg.ProductsStaleTTL = 24 * time.Hour
+
+	// A fresh cache hit is served as is and leaves the stale copy alone.
+	cached := `{"items":[],"total":0,"limit":50,"offset":0}`
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{cached, nil})
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusOK || w.Body.String() != cached {
+		t.Fatalf("expected cached body, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Data-Stale"); got != "" {
+		t.Errorf("expected no X-Data-Stale on a fresh hit, got %q", got)
+	}
+
+	// A database read updates both copies.
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testProducts(s).add(testProduct(1, "Product A", 10.99, created))
+	want := `{"items":[{"id":1,"name":"Product A","description":"","price":10.99,"created_at":"2024-01-02T03:04:05Z"}],"total":1,"limit":50,"offset":0}`
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{nil, nil})
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHSet(testKeys.products(), field, []byte(want), productsETagField(field), etagFor([]byte(want))).SetVal(1)
+	redisMock.ExpectExpireNX(testKeys.products(), time.Minute).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHSet(testKeys.productsStale(), field, []byte(want)).SetVal(1)
+	redisMock.ExpectExpire(testKeys.productsStale(), 24*time.Hour).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	w = httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("expected DB body, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Data-Stale"); got != "" {
+		t.Errorf("expected no X-Data-Stale on a DB read, got %q", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestProductsHandler_DBDownServesStaleCopy(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	s.cfg.ProductsStaleTTL = 24 * time.Hour
+
+	stale := `{"items":[{"id":1,"name":"Product A"}],"total":1,"limit":50,"offset":0}`
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{nil, nil})
+	testProducts(s).fail(errors.New("dial tcp: connection refused"))
+	redisMock.ExpectHGet(testKeys.productsStale(), field).SetVal(stale)
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != stale {
+		t.Fatalf("expected the stale body, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Data-Stale"); got != "true" {
+		t.Errorf("expected X-Data-Stale true, got %q", got)
+	}
+	if got := w.Header().Get("Warning"); got != `110 - "Response is Stale"` {
+		t.Errorf("unexpected Warning header %q", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.staleCacheServes.WithLabelValues("products")); got != 1 {
+		t.Errorf("expected 1 stale serve, got %v", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestProductsHandler_DBAndStaleCopyDownReturns500(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	s.cfg.ProductsStaleTTL = 24 * time.Hour
+
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{nil, nil})
+	testProducts(s).fail(errors.New("dial tcp: connection refused"))
+	redisMock.ExpectHGet(testKeys.productsStale(), field).RedisNil()
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeDBError {
+		t.Errorf("expected code %q, got %+v", codeDBError, got)
+	}
+	if got := testutil.ToFloat64(s.metrics.staleCacheServes.WithLabelValues("products")); got != 0 {
+		t.Errorf("expected no stale serves, got %v", got)
+	}
+}
+
+func TestCacheTTL_StaysWithinJitter(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	if got := s.cacheTTL(time.Minute); got != time.Minute {
+		t.Errorf("expected no jitter by default, got %v", got)
+	}
+
+	s.cfg.CacheTTLJitter = 10
+	seen := make(map[time.Duration]bool)
+	for range 1000 {
+		got := s.cacheTTL(time.Minute)
+		if got < 54*time.Second || got > 66*time.Second {
+			t.Fatalf("TTL %v outside 1m ± 10%%", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected jittered TTLs, got %v", seen)
+	}
+}
+
+func TestCacheSet_JittersTTL(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = 100 * time.Second
+	s.cfg.CacheTTLJitter = 20
+
+	var ttl time.Duration
+	redisMock.CustomMatch(func(_, actual []any) error {
+		// SET key value EX seconds, or PX milliseconds.
+		n, _ := actual[4].(int64)
+		if ttl = time.Duration(n) * time.Millisecond; actual[3] == "ex" {
+			ttl = time.Duration(n) * time.Second
+		}
+		return nil
+	}).ExpectSet(testKeys.product(1), []byte("{}"), time.Second).SetVal("OK")
+	s.cacheSet(context.Background(), testKeys.product(1), []byte("{}"))
+
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet redis expectations: %v", err)
+	}
+	if ttl < 80*time.Second || ttl > 120*time.Second {
+		t.Errorf("TTL %v outside 100s ± 20%%", ttl)
+	}
+}
+
+func TestProductHandler_CachesMissingProduct(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	s.cfg.ProductsMissingTTL = 5 * time.Second
+	testProducts(s).add(testProduct(41, "Lamp", 20, time.Now()))
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/42", nil))
+		return w.Code
+	}
+
+	redisMock.ExpectGet(testKeys.product(42)).RedisNil()
+	redisMock.ExpectSet(testKeys.product(42), cacheMissing, 5*time.Second).SetVal("OK")
+	if code := get(); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+	redisMock.ExpectGet(testKeys.product(42)).SetVal(string(cacheMissing))
+	if code := get(); code != http.StatusNotFound {
+		t.Fatalf("expected 404 from the cache, got %d", code)
+	}
+	if n := testProducts(s).callCount(); n != 1 {
+		t.Errorf("expected only the first lookup to reach the store, got %d calls", n)
+	}
+
+	// Creating the product, which gets id 42, drops the negative entry.
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(42))
+	if w := postProduct(s, `{"name":"Chair","price":49.5}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestProductHandler_NegativeCachingDisabled(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	redisMock.ExpectGet(testKeys.product(42)).RedisNil()
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/42", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// cacheScanCount is the COUNT hint of each SCAN, roughly how many keys
+	// one call examines.
+	cacheScanCount = 1000
+	// maxCacheScanPages bounds the SCAN calls one admin request makes on
+	// each node, so that a huge keyspace cannot keep Redis busy for long.
+	// A purge cut short reports it and can be repeated.
+	maxCacheScanPages = 500
+)
+
+// scanKeys walks the keys matching pattern a SCAN page at a time, calling
+// page with each page's keys and the client of the node holding them. In a
+// cluster every master is scanned. It reports whether the walk finished
+// rather than stopping at maxCacheScanPages.
+//
+// SCAN may return a key more than once, and keys written during the walk
+// may be missed, so counts built on it are approximate.
+func (s *Server) scanKeys(ctx context.Context, pattern string, page func(ctx context.Context, node redis.Cmdable, keys []string) error) (complete bool, err error) {
+	scanNode := func(ctx context.Context, node redis.Cmdable) (bool, error) {
+		var cursor uint64
+		for range maxCacheScanPages {
+			keys, next, err := node.Scan(ctx, cursor, pattern, cacheScanCount).Result()
+			if err != nil {
+				return false, err
+			}
+			if len(keys) > 0 {
+				if err := page(ctx, node, keys); err != nil {
+					return false, err
+				}
+			}
+			if next == 0 {
+				return true, nil
+			}
+			cursor = next
+		}
+		return false, nil
+	}
+
+	cluster, ok := s.rdb.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, s.rdb)
+	}
+	var truncated atomic.Bool
+	err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		done, err := scanNode(ctx, node)
+		if !done {
+			truncated.Store(true)
+		}
+		return err
+	})
+	return !truncated.Load(), err
+}
+
+// cachePurge is the response body of DELETE /admin/cache/products.
+type cachePurge struct {
+	// Deleted counts the cache keys removed.
+	Deleted int64 `json:"deleted"`
+	// Complete is false when the purge stopped at maxCacheScanPages;
+	// repeating it removes the rest.
+	Complete bool `json:"complete"`
+}
+
+// purgeProductsCacheHandler removes the cached product list, including its
+// stale copy, and every cached product. It is only served on the internal
+// listener, behind requireRole.
+func (s *Server) purgeProductsCacheHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := s.purgeProductsCache(ctx)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to purge the products cache", "deleted", res.Deleted, "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+
+	s.auditCachePurge(r, map[string]any{"scope": "products", "deleted": res.Deleted, "complete": res.Complete})
+	s.writeJSON(w, http.StatusOK, res)
+}
+
+// purgeProductsCache removes the cached product list, its stale copy and
+// every cached product.
+func (s *Server) purgeProductsCache(ctx context.Context) (cachePurge, error) {
+	return s.purgeCachedProducts(ctx, s.keys.products(), s.keys.productsStale())
+}
+
+// purgeCachedProducts removes the given product list keys and every cached
+// product.
+func (s *Server) purgeCachedProducts(ctx context.Context, lists ...string) (cachePurge, error) {
+	deleted, err := unlinkKeys(ctx, s.rdb, lists...)
+	if err != nil {
+		return cachePurge{}, err
+	}
+	var n atomic.Int64
+	complete, err := s.scanKeys(ctx, s.keys.productPattern(), func(ctx context.Context, node redis.Cmdable, keys []string) error {
+		removed, err := unlinkKeys(ctx, node, keys...)
+		n.Add(removed)
+		return err
+	})
+	return cachePurge{Deleted: deleted + n.Load(), Complete: complete}, err
+}
+
+// purgeProductCacheHandler removes the cached product {id} and the cached
+// product list, whose pages may include it.
+func (s *Server) purgeProductCacheHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, ok := s.productID(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := unlinkKeys(ctx, s.rdb, s.keys.product(id), s.keys.products())
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to purge the product cache", "id", id, "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+
+	s.auditCachePurge(r, map[string]any{"scope": "product", "product_id": id, "deleted": deleted})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditCachePurge records a cache purge described by metadata.
+func (s *Server) auditCachePurge(r *http.Request, metadata map[string]any) {
+	args := []any{"audit", true, "actor", auditActor(r.Context()), "remote_ip", s.clientIP(r)}
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		args = append(args, k, metadata[k])
+	}
+	// Logged at warn so the purge is recorded whatever the level.
+	s.logger.WarnContext(r.Context(), "Cache purged", args...)
+	s.audit(r, auditCachePurged, 0, metadata)
+}
+
+// cacheStats is the response body of GET /admin/cache/stats.
+type cacheStats struct {
+	// Hits and Misses count this replica's lookups since it started, by
+	// cache.
+	Hits   map[string]uint64 `json:"hits"`
+	Misses map[string]uint64 `json:"misses"`
+	// Keys is the approximate number of keys with the prefix; KeysComplete
+	// is false when counting stopped at maxCacheScanPages.
+	Keys         int64       `json:"keys"`
+	KeysComplete bool        `json:"keys_complete"`
+	Memory       redisMemory `json:"memory"`
+}
+
+// redisMemory holds the highlights of INFO memory. In a cluster they are
+// those of whichever node answered.
+type redisMemory struct {
+	UsedBytes          int64   `json:"used_bytes"`
+	PeakBytes          int64   `json:"peak_bytes"`
+	MaxBytes           int64   `json:"max_bytes"`
+	EvictionPolicy     string  `json:"eviction_policy"`
+	FragmentationRatio float64 `json:"fragmentation_ratio"`
+}
+
+// parseRedisMemory picks the highlights out of the reply to INFO memory.
+// Fields missing from the reply are left zero.
+func parseRedisMemory(info string) redisMemory {
+	var m redisMemory
+	sc := bufio.NewScanner(strings.NewReader(info))
+	for sc.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "used_memory":
+			m.UsedBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "used_memory_peak":
+			m.PeakBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "maxmemory":
+			m.MaxBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "maxmemory_policy":
+			m.EvictionPolicy = value
+		case "mem_fragmentation_ratio":
+			m.FragmentationRatio, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	return m
+}
+
+// counterTotals sums the counters of c by the value of label.
+func counterTotals(c *prometheus.CounterVec, label string) map[string]uint64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	totals := make(map[string]uint64)
+	for metric := range ch {
+		var pb dto.Metric
+		if metric.Write(&pb) != nil {
+			continue
+		}
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == label {
+				totals[l.GetValue()] += uint64(pb.GetCounter().GetValue())
+			}
+		}
+	}
+	return totals
+}
+
+// cacheStatsHandler reports the cache hit and miss counters, how many keys
+// the service holds and how much memory Redis uses. It is only served on
+// the internal listener, behind requireRole.
+func (s *Server) cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	stats := cacheStats{
+		Hits:   counterTotals(s.metrics.cacheHits, "cache"),
+		Misses: counterTotals(s.metrics.cacheMisses, "cache"),
+	}
+	var keys atomic.Int64
+	complete, err := s.scanKeys(ctx, s.keys.all(), func(_ context.Context, _ redis.Cmdable, page []string) error {
+		keys.Add(int64(len(page)))
+		return nil
+	})
+	stats.Keys, stats.KeysComplete = keys.Load(), complete
+	if err == nil {
+		var info string
+		info, err = s.rdb.Info(ctx, "memory").Result()
+		stats.Memory = parseRedisMemory(info)
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to read cache stats", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, stats)
+}
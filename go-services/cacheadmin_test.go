@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// cacheAdminRequest serves an admin request to the cache endpoints on the
+// internal listener.
+func cacheAdminRequest(s *Server, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestCacheAdmin_PurgeProductsScansAndUnlinks(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	redisMock.ExpectUnlink(testKeys.products()).SetVal(1)
+	redisMock.ExpectUnlink(testKeys.productsStale()).SetVal(0)
+	redisMock.ExpectScan(0, testKeys.productPattern(), cacheScanCount).SetVal([]string{testKeys.product(1), testKeys.product(2)}, 17)
+	redisMock.ExpectUnlink(testKeys.product(1)).SetVal(1)
+	redisMock.ExpectUnlink(testKeys.product(2)).SetVal(1)
+	// A page can be empty without the walk being over.
+	redisMock.ExpectScan(17, testKeys.productPattern(), cacheScanCount).SetVal(nil, 42)
+	redisMock.ExpectScan(42, testKeys.productPattern(), cacheScanCount).SetVal([]string{testKeys.product(3)}, 0)
+	redisMock.ExpectUnlink(testKeys.product(3)).SetVal(1)
+
+	w := cacheAdminRequest(s, http.MethodDelete, "/admin/cache/products")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var res cachePurge
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != (cachePurge{Deleted: 4, Complete: true}) {
+		t.Errorf("unexpected purge result %+v", res)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	if n := len(s.auditQueue); n != 1 {
+		t.Fatalf("expected the purge audited, got %d events", n)
+	}
+	ev := <-s.auditQueue
+	var metadata map[string]any
+	if err := json.Unmarshal(ev.Metadata, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Action != auditCachePurged || ev.Actor != adminTokenActor || metadata["scope"] != "products" || metadata["deleted"] != float64(4) {
+		t.Errorf("unexpected audit event %+v with metadata %v", ev, metadata)
+	}
+}
+
+func TestCacheAdmin_PurgeProductsStopsAtPageLimit(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	redisMock.ExpectUnlink(testKeys.products()).SetVal(0)
+	redisMock.ExpectUnlink(testKeys.productsStale()).SetVal(0)
+	for i := range uint64(maxCacheScanPages) {
+		redisMock.ExpectScan(i, testKeys.productPattern(), cacheScanCount).SetVal(nil, i+1)
+	}
+
+	w := cacheAdminRequest(s, http.MethodDelete, "/admin/cache/products")
+	var res cachePurge
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || res.Complete {
+		t.Errorf("expected 200 with the purge reported incomplete, got %d %+v", w.Code, res)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCacheAdmin_PurgeProductsFailure(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	redisMock.ExpectUnlink(testKeys.products()).SetVal(1)
+	redisMock.ExpectUnlink(testKeys.productsStale()).SetVal(1)
+	redisMock.ExpectScan(0, testKeys.productPattern(), cacheScanCount).SetErr(errors.New("connection refused"))
+
+	if w := cacheAdminRequest(s, http.MethodDelete, "/admin/cache/products"); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if n := len(s.auditQueue); n != 0 {
+		t.Errorf("expected a failed purge not audited, got %d events", n)
+	}
+}
+
+func TestCacheAdmin_PurgeProduct(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	redisMock.ExpectUnlink(testKeys.product(7)).SetVal(1)
+	redisMock.ExpectUnlink(testKeys.products()).SetVal(1)
+
+	if w := cacheAdminRequest(s, http.MethodDelete, "/admin/cache/products/7"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if ev := <-s.auditQueue; ev.Action != auditCachePurged || string(ev.Metadata) != `{"deleted":2,"product_id":7,"scope":"product"}` {
+		t.Errorf("unexpected audit event %+v", ev)
+	}
+
+	if w := cacheAdminRequest(s, http.MethodDelete, "/admin/cache/products/abc"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad id, got %d", w.Code)
+	}
+}
+
+func TestCacheAdmin_Stats(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	s.metrics.cacheHits.WithLabelValues("product").Add(3)
+	s.metrics.cacheHits.WithLabelValues("products").Add(5)
+	s.metrics.cacheMisses.WithLabelValues("product").Add(2)
+
+	redisMock.ExpectScan(0, testKeys.all(), cacheScanCount).SetVal([]string{"a", "b", "c"}, 9)
+	redisMock.ExpectScan(9, testKeys.all(), cacheScanCount).SetVal([]string{"d"}, 0)
+	redisMock.ExpectInfo("memory").SetVal("# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\nused_memory_peak:2097152\r\n" +
+		"maxmemory:4194304\r\nmaxmemory_policy:allkeys-lru\r\nmem_fragmentation_ratio:1.25\r\n")
+
+	w := cacheAdminRequest(s, http.MethodGet, "/admin/cache/stats")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var stats cacheStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits["product"] != 3 || stats.Hits["products"] != 5 || stats.Misses["product"] != 2 || len(stats.Misses) != 1 {
+		t.Errorf("unexpected counters: hits %v, misses %v", stats.Hits, stats.Misses)
+	}
+	if stats.Keys != 4 || !stats.KeysComplete {
+		t.Errorf("expected 4 keys counted in full, got %d (complete %t)", stats.Keys, stats.KeysComplete)
+	}
+	want := redisMemory{UsedBytes: 1 << 20, PeakBytes: 2 << 20, MaxBytes: 4 << 20, EvictionPolicy: "allkeys-lru", FragmentationRatio: 1.25}
+	if stats.Memory != want {
+		t.Errorf("memory = %+v, want %+v", stats.Memory, want)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCacheAdmin_RequiresAdminToken(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodDelete, "/admin/cache/products"},
+		{http.MethodDelete, "/admin/cache/products/1"},
+		{http.MethodGet, "/admin/cache/stats"},
+	} {
+		w := httptest.NewRecorder()
+		s.InternalHandler().ServeHTTP(w, httptest.NewRequest(route.method, route.path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401, got %d", route.method, route.path, w.Code)
+		}
+	}
+}
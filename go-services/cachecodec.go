@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Cache value serializations and compressions, as named in
+// CACHE_SERIALIZATION and CACHE_COMPRESSION.
+const (
+	cacheJSON    = "json"
+	cacheMsgpack = "msgpack"
+
+	cacheUncompressed = "none"
+	cacheGzip         = "gzip"
+	cacheSnappy       = "snappy"
+)
+
+// A cached value in any other format than plain JSON starts with a format
+// byte: cacheFormatMarker with the serialization and compression flags
+// below. JSON never starts with a byte with the high bit set, so values
+// written before formats existed, or by replicas that predate them, still
+// decode.
+const (
+	cacheFormatMarker  byte = 0x80
+	cacheFormatMsgpack byte = 0x01
+	cacheFormatGzip    byte = 0x02
+	cacheFormatSnappy  byte = 0x04
+
+	cacheFormatKnown = cacheFormatMarker | cacheFormatMsgpack | cacheFormatGzip | cacheFormatSnappy
+)
+
+// cacheCodec turns the JSON bodies the handlers cache into the values stored
+// in Redis and back. Its zero value stores plain JSON.
+type cacheCodec struct {
+	// msgpack stores bodies as MessagePack rather than JSON.
+	msgpack bool
+	// compression is cacheGzip, cacheSnappy, or empty or cacheUncompressed
+	// for none.
+	compression string
+	// minCompress is the smallest serialized value that is compressed.
+	minCompress int
+}
+
+func newCacheCodec(cfg Config) cacheCodec {
+	return cacheCodec{
+		msgpack:     cfg.CacheSerialization == cacheMsgpack,
+		compression: cfg.CacheCompression,
+		minCompress: cfg.CacheCompressMinBytes,
+	}
+}
+
+// encode returns the value to store for body, along with its size before
+// compression. Plain JSON, the default, is stored as it is, so that
+// replicas without formats can read it during a rollout.
+func (c cacheCodec) encode(body []byte) (value []byte, serialized int, err error) {
+	format := cacheFormatMarker
+	payload := body
+	if c.msgpack {
+		if payload, err = jsonToMsgpack(body); err != nil {
+			return nil, 0, err
+		}
+		format |= cacheFormatMsgpack
+	}
+	serialized = len(payload)
+
+	if len(payload) >= c.minCompress {
+		switch c.compression {
+		case cacheGzip:
+			var buf bytes.Buffer
+			zw := gzipWriters.Get().(*gzip.Writer)
+			defer gzipWriters.Put(zw)
+			zw.Reset(&buf)
+			if _, err := zw.Write(payload); err != nil {
+				return nil, 0, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, 0, err
+			}
+			payload = buf.Bytes()
+			format |= cacheFormatGzip
+		case cacheSnappy:
+			payload = snappy.Encode(nil, payload)
+			format |= cacheFormatSnappy
+		}
+	}
+
+	if format == cacheFormatMarker {
+		return body, serialized, nil
+	}
+	value = make([]byte, 0, 1+len(payload))
+	value = append(value, format)
+	return append(value, payload...), serialized, nil
+}
+
+// decode returns the JSON body stored as value, in whichever format it was
+// written.
+func (c cacheCodec) decode(value []byte) ([]byte, error) {
+	if len(value) == 0 || value[0]&cacheFormatMarker == 0 {
+		return value, nil
+	}
+	format, payload := value[0], value[1:]
+	if format&^cacheFormatKnown != 0 || (format&cacheFormatGzip != 0 && format&cacheFormatSnappy != 0) {
+		return nil, fmt.Errorf("unknown cache value format %#x", format)
+	}
+
+	var err error
+	switch {
+	case format&cacheFormatGzip != 0:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(payload)); err != nil {
+			return nil, err
+		}
+		if payload, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	case format&cacheFormatSnappy != 0:
+		if payload, err = snappy.Decode(nil, payload); err != nil {
+			return nil, err
+		}
+	}
+	if format&cacheFormatMsgpack != 0 {
+		return msgpackToJSON(payload)
+	}
+	return payload, nil
+}
+
+// jsonToMsgpack transcodes a JSON document to MessagePack, keeping the order
+// of object keys so that msgpackToJSON gives back the same bytes. Integers
+// are stored as such and other numbers as float64, which round-trips
+// anything encoding/json writes.
+func jsonToMsgpack(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	v, err := readJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	if err := writeMsgpackValue(enc, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonObject is a JSON object with its keys in document order.
+type jsonObject struct {
+	keys   []string
+	values []any
+}
+
+func readJSONValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		var obj jsonObject
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.keys = append(obj.keys, key.(string))
+			obj.values = append(obj.values, v)
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []any{}
+		for dec.More() {
+			v, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
+
+func writeMsgpackValue(enc *msgpack.Encoder, v any) error {
+	switch v := v.(type) {
+	case jsonObject:
+		if err := enc.EncodeMapLen(len(v.keys)); err != nil {
+			return err
+		}
+		for i, key := range v.keys {
+			if err := enc.EncodeString(key); err != nil {
+				return err
+			}
+			if err := writeMsgpackValue(enc, v.values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		if err := enc.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, elem := range v {
+			if err := writeMsgpackValue(enc, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return enc.EncodeInt(n)
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return enc.EncodeUint(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return enc.EncodeFloat64(f)
+	}
+	return enc.Encode(v)
+}
+
+// msgpackToJSON is the inverse of jsonToMsgpack.
+func msgpackToJSON(value []byte) ([]byte, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(value))
+	var buf bytes.Buffer
+	if err := writeJSONValue(&buf, dec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeJSONValue(buf *bytes.Buffer, dec *msgpack.Decoder) error {
+	code, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+	switch {
+	case msgpcode.IsFixedMap(code), code == msgpcode.Map16, code == msgpcode.Map32:
+		n, err := dec.DecodeMapLen()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('{')
+		for i := range n {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := dec.DecodeString()
+			if err != nil {
+				return err
+			}
+			if err := writeJSONScalar(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeJSONValue(buf, dec); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case msgpcode.IsFixedArray(code), code == msgpcode.Array16, code == msgpcode.Array32:
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('[')
+		for i := range n {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSONValue(buf, dec); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	v, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	return writeJSONScalar(buf, v)
+}
+
+func writeJSONScalar(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+		return nil
+	case uint64:
+		buf.WriteString(strconv.FormatUint(v, 10))
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
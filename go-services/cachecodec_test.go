@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testCacheBody is a product list page as the handlers cache it, with
+// enough repetition to be worth compressing.
+func testCacheBody(t *testing.T) []byte {
+	t.Helper()
+	type product struct {
+		ID          int64     `json:"id"`
+		Name        string    `json:"name"`
+		Description *string   `json:"description"`
+		Price       *float64  `json:"price"`
+		CreatedAt   time.Time `json:"created_at"`
+	}
+	desc, price := "Fits <most> phones & tablets — ünïcode", 10.99
+	var items []product
+	for i := range 40 {
+		p := product{ID: int64(i + 1), Name: "Product", CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+		if i%2 == 0 {
+			p.Description, p.Price = &desc, &price
+		}
+		items = append(items, p)
+	}
+	body, err := json.Marshal(map[string]any{
+		"items":   items,
+		"total":   uint64(1 << 63),
+		"ratio":   1e-7,
+		"limit":   -50,
+		"filters": map[string]any{},
+		"tags":    []string{},
+		"more":    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode body: %v", err)
+	}
+	return body
+}
+
+func TestCacheCodec_RoundTripsEveryFormat(t *testing.T) {
+	t.Parallel()
+	body := testCacheBody(t)
+
+	for _, serialization := range []string{cacheJSON, cacheMsgpack} {
+		for _, compression := range []string{cacheUncompressed, cacheGzip, cacheSnappy} {
+			name := serialization + "+" + compression
+			c := newCacheCodec(Config{CacheSerialization: serialization, CacheCompression: compression, CacheCompressMinBytes: 64})
+
+			value, serialized, err := c.encode(body)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", name, err)
+			}
+			plain := serialization == cacheJSON && compression == cacheUncompressed
+			if plain != bytes.Equal(value, body) {
+				t.Errorf("%s: expected only plain JSON to be stored as it is", name)
+			}
+			if !plain && value[0]&cacheFormatMarker == 0 {
+				t.Errorf("%s: expected a format byte, got %#x", name, value[0])
+			}
+			if compression != cacheUncompressed && len(value) >= serialized {
+				t.Errorf("%s: expected compression to shrink %d bytes, got %d", name, serialized, len(value))
+			}
+
+			got, err := c.decode(value)
+			if err != nil {
+				t.Fatalf("%s: decode: %v", name, err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("%s: round trip changed the body:\n got %s\nwant %s", name, got, body)
+			}
+		}
+	}
+}
+
+func TestCacheCodec_SmallValuesAreNotCompressed(t *testing.T) {
+	t.Parallel()
+	c := newCacheCodec(Config{CacheSerialization: cacheJSON, CacheCompression: cacheGzip, CacheCompressMinBytes: 512})
+
+	body := []byte(`{"id":1,"name":"Product"}`)
+	value, _, err := c.encode(body)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if !bytes.Equal(value, body) {
+		t.Errorf("expected a small value to be stored as it is, got %q", value)
+	}
+}
+
+func TestCacheCodec_DecodesAnyFormatWhateverTheSetting(t *testing.T) {
+	t.Parallel()
+	body := testCacheBody(t)
+	writer := newCacheCodec(Config{CacheSerialization: cacheMsgpack, CacheCompression: cacheSnappy})
+	value, _, err := writer.encode(body)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	// A replica still on the defaults reads the new values, and a legacy
+	// plain JSON value without a format byte.
+	var reader cacheCodec
+	for name, v := range map[string][]byte{"new": value, "legacy": body} {
+		got, err := reader.decode(v)
+		if err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%s value: got %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestCacheCodec_RejectsUnknownFormats(t *testing.T) {
+	t.Parallel()
+	var c cacheCodec
+	for _, v := range [][]byte{
+		{0xff, '{', '}'},
+		{cacheFormatMarker | cacheFormatGzip | cacheFormatSnappy, 0},
+		{cacheFormatMarker | cacheFormatGzip, 'n', 'o', 't'},
+		{cacheFormatMarker | cacheFormatMsgpack, 0xc1},
+	} {
+		if _, err := c.decode(v); err == nil {
+			t.Errorf("%#v: expected an error", v)
+		}
+	}
+}
+
+func TestCache_StoresEncodedValues(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	s.cacheCodec = newCacheCodec(Config{CacheSerialization: cacheMsgpack, CacheCompression: cacheGzip})
+	body := testCacheBody(t)
+	value, _, err := s.cacheCodec.encode(body)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	key := testKeys.product(1)
+	redisMock.ExpectSet(key, value, time.Minute).SetVal("OK")
+	s.cacheSet(context.Background(), key, body)
+	redisMock.ExpectGet(key).SetVal(string(value))
+	got, ok := s.cacheGet(context.Background(), "product", key)
+	if !ok || !bytes.Equal(got, body) {
+		t.Errorf("expected the body back, got %v %q", ok, got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	serialized := testutil.ToFloat64(s.metrics.cacheValueBytes.WithLabelValues("product", "serialized"))
+	stored := testutil.ToFloat64(s.metrics.cacheValueBytes.WithLabelValues("product", "stored"))
+	if stored != float64(len(value)) || serialized <= stored {
+		t.Errorf("expected %d bytes stored out of more serialized, got %v of %v", len(value), stored, serialized)
+	}
+}
+
+func TestCache_UndecodableValueIsAMiss(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	key := testKeys.product(1)
+	redisMock.ExpectGet(key).SetVal(string([]byte{cacheFormatMarker | cacheFormatSnappy, 0xff}))
+	if _, ok := s.cacheGet(context.Background(), "product", key); ok {
+		t.Error("expected a corrupt value to be a miss")
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheOperations.WithLabelValues("product", "error")); got != 1 {
+		t.Errorf("expected the read to count as an error, got %v", got)
+	}
+}
+
+func TestJSONToMsgpack_RejectsInvalidJSON(t *testing.T) {
+	t.Parallel()
+	for _, body := range []string{`{"a":`, `{} {}`, ``} {
+		if _, err := jsonToMsgpack([]byte(body)); err == nil {
+			t.Errorf("%q: expected an error", body)
+		}
+	}
+	if _, err := jsonToMsgpack([]byte(strings.Repeat("[", 3) + strings.Repeat("]", 3))); err != nil {
+		t.Errorf("nested arrays: %v", err)
+	}
+}
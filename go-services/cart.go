@@ -0,0 +1,315 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// maxCartQuantity bounds the quantity of a single cart line.
+	maxCartQuantity = 99
+	// cartCookie names an anonymous cart. Its value is the cart id and the
+	// id's signature, joined by a dot.
+	cartCookie = "cart_id"
+	// cartIDBytes is the amount of randomness in an anonymous cart id.
+	cartIDBytes = 16
+)
+
+// cartItemInput is the request body for putting a product in the cart.
+type cartItemInput struct {
+	ProductID int64 `json:"product_id"`
+	Quantity  int   `json:"quantity"`
+}
+
+func (in cartItemInput) validate() error {
+	var v validator
+	v.check(in.ProductID > 0, "product_id", "must be a positive integer")
+	v.check(in.Quantity >= 1 && in.Quantity <= maxCartQuantity, "quantity", fmt.Sprintf("must be between 1 and %d", maxCartQuantity))
+	return v.err()
+}
+
+// cartLine is a cart line with the product's current name and price.
+type cartLine struct {
+	ProductID int64    `json:"product_id"`
+	Name      string   `json:"name"`
+	UnitPrice *float64 `json:"unit_price"`
+	Quantity  int      `json:"quantity"`
+}
+
+// cartResponse is the response body of GET /cart. Total leaves out lines of
+// products without a price.
+type cartResponse struct {
+	Items []cartLine `json:"items"`
+	Total float64    `json:"total"`
+}
+
+// cartEntry is a line as stored in a cart hash.
+type cartEntry struct {
+	productID int64
+	quantity  int
+}
+
+// parseCart returns the lines of a cart hash in product id order, and the
+// fields that do not hold a line.
+func parseCart(fields map[string]string) (entries []cartEntry, corrupt []string) {
+	for field, val := range fields {
+		id, err := strconv.ParseInt(field, 10, 64)
+		quantity, qerr := strconv.Atoi(val)
+		if err != nil || qerr != nil || id < 1 || quantity < 1 {
+			corrupt = append(corrupt, field)
+			continue
+		}
+		entries = append(entries, cartEntry{productID: id, quantity: quantity})
+	}
+	slices.SortFunc(entries, func(a, b cartEntry) int { return cmp.Compare(a.productID, b.productID) })
+	return entries, corrupt
+}
+
+// cartKey returns the key of the caller's cart, answering the request and
+// returning false if it has none. A request with an Authorization header
+// uses the cart of its user. Otherwise, if anonymous carts are enabled, the
+// cart named by the cart cookie is used, and a new one is started when the
+// cookie is missing or its signature does not check out. The cookie is sent
+// again with every use, so like the cart it expires CartTTL after the last.
+func (s *Server) cartKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Header.Get("Authorization") != "" {
+		userID, _, ok := s.authenticate(w, r)
+		if !ok {
+			return "", false
+		}
+		return s.keys.cart(userID), true
+	}
+	if s.cfg.CartCookieSecret == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeError(w, http.StatusUnauthorized, codeUnauthorized, "authentication required")
+		return "", false
+	}
+
+	id, ok := "", false
+	if c, err := r.Cookie(cartCookie); err == nil {
+		id, ok = s.verifyCartCookie(c.Value)
+	}
+	if !ok {
+		b := make([]byte, cartIDBytes)
+		if _, err := rand.Read(b); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to generate cart id", "err", err)
+			s.writeInternalError(w, err)
+			return "", false
+		}
+		id = hex.EncodeToString(b)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cartCookie,
+		Value:    id + "." + s.signCartID(id),
+		Path:     "/",
+		MaxAge:   int(s.cfg.CartTTL.Seconds()),
+		Secure:   s.isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return s.keys.anonCart(id), true
+}
+
+// signCartID returns the signature of an anonymous cart id.
+func (s *Server) signCartID(id string) string {
+	mac := hmac.New(sha256.New, []byte(s.cfg.CartCookieSecret))
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCartCookie returns the cart id of a cart cookie value, and false if
+// it is malformed or not signed with CartCookieSecret.
+func (s *Server) verifyCartCookie(value string) (string, bool) {
+	id, sig, ok := strings.Cut(value, ".")
+	if !ok || len(id) != cartIDBytes*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.signCartID(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// cartHandler answers GET /cart with the cart's lines at the products'
+// current names and prices. Lines of products that no longer exist are left
+// out and removed from the cart.
+func (s *Server) cartHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key, ok := s.cartKey(w, r)
+	if !ok {
+		return
+	}
+
+	var fields *redis.MapStringStringCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		fields = pipe.HGetAll(ctx, key)
+		pipe.Expire(ctx, key, s.cfg.CartTTL)
+		return nil
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Cart read failed", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	entries, stale := parseCart(fields.Val())
+
+	ids := make([]int64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.productID
+	}
+	products, err := s.productsByID(ctx, ids)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	resp := cartResponse{Items: []cartLine{}}
+	var total float64
+	for _, e := range entries {
+		p, ok := products[e.productID]
+		if !ok {
+			stale = append(stale, strconv.FormatInt(e.productID, 10))
+			continue
+		}
+		resp.Items = append(resp.Items, cartLine{ProductID: p.ID, Name: p.Name, UnitPrice: p.Price, Quantity: e.quantity})
+		if p.Price != nil {
+			total += *p.Price * float64(e.quantity)
+		}
+	}
+	resp.Total = math.Round(total*100) / 100
+
+	// A line left behind only costs the next read another lookup, so a
+	// failure here is only logged.
+	if len(stale) > 0 {
+		if err := s.rdb.HDel(ctx, key, stale...).Err(); err != nil {
+			s.logger.WarnContext(ctx, "Failed to remove stale cart lines", "err", err)
+		}
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// putCartItemHandler answers POST /cart/items, setting the quantity of a
+// product in the cart. The product must exist.
+func (s *Server) putCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var in cartItemInput
+	if !s.decodeJSON(w, r, int64(s.cfg.MaxBodyBytes), &in) {
+		return
+	}
+	if err := in.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+	key, ok := s.cartKey(w, r)
+	if !ok {
+		return
+	}
+
+	products, err := s.productsByID(ctx, []int64{in.ProductID})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	if _, ok := products[in.ProductID]; !ok {
+		var v validator
+		v.check(false, "product_id", fmt.Sprintf("product %d does not exist", in.ProductID))
+		s.writeValidationError(w, v.err())
+		return
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, strconv.FormatInt(in.ProductID, 10), in.Quantity)
+		pipe.Expire(ctx, key, s.cfg.CartTTL)
+		return nil
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Cart write failed", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteCartItemHandler answers DELETE /cart/items/{product_id}. Removing a
+// product that is not in the cart succeeds.
+func (s *Server) deleteCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.ParseInt(r.PathValue("product_id"), 10, 64)
+	if err != nil || id < 1 {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "product_id must be a positive integer")
+		return
+	}
+	key, ok := s.cartKey(w, r)
+	if !ok {
+		return
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, key, strconv.FormatInt(id, 10))
+		pipe.Expire(ctx, key, s.cfg.CartTTL)
+		return nil
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Cart write failed", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// claimCart empties the cart at key and returns its lines, in one
+// transaction so that a line added meanwhile is either claimed or kept.
+func (s *Server) claimCart(ctx context.Context, key string) ([]orderItemInput, error) {
+	var fields *redis.MapStringStringCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		fields = pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := parseCart(fields.Val())
+	items := make([]orderItemInput, len(entries))
+	for i, e := range entries {
+		items[i] = orderItemInput{ProductID: e.productID, Quantity: e.quantity}
+	}
+	return items, nil
+}
+
+// restoreCart puts claimed lines back after the order failed. A line the
+// cart has gained since keeps its new quantity. It runs even if the request
+// was canceled, which may be why the order failed.
+func (s *Server) restoreCart(ctx context.Context, key string, items []orderItemInput) {
+	ctx = context.WithoutCancel(ctx)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, item := range items {
+			pipe.HSetNX(ctx, key, strconv.FormatInt(item.ProductID, 10), item.Quantity)
+		}
+		pipe.Expire(ctx, key, s.cfg.CartTTL)
+		return nil
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to restore cart", "items", len(items), "err", err)
+	}
+}
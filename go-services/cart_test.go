@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	redismock "github.com/go-redis/redismock/v9"
+
+	"go-service/store"
+)
+
+const testCartTTL = 30 * 24 * time.Hour
+
+// newCartServer returns a test server with carts enabled, anonymous ones
+// included.
+func newCartServer(t *testing.T) (*Server, sqlmock.Sqlmock, redismock.ClientMock) {
+	t.Helper()
+	s, mockSQL, redisMock := newTestServer(t)
+	s.cfg.CartTTL = testCartTTL
+	s.cfg.CartCookieSecret = "cart-secret"
+	return s, mockSQL, redisMock
+}
+
+// expectCartSession expects the lookup of testToken as a session of user 7.
+func expectCartSession(redisMock redismock.ClientMock) {
+	redisMock.ExpectGet(testKeys.session(testToken)).SetVal("7")
+}
+
+// cartRequest sends a cart request, signed in with testToken unless cookie
+// is set. A JSON body is sent when body is not empty.
+func cartRequest(s *Server, method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+testToken)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+// responseCartCookie returns the cart cookie set by a response.
+func responseCartCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cartCookie {
+			return c
+		}
+	}
+	t.Fatalf("expected a %s cookie, got %q", cartCookie, w.Header().Values("Set-Cookie"))
+	return nil
+}
+
+func assertRedisMet(t *testing.T, redisMock redismock.ClientMock) {
+	t.Helper()
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestCart_PutRefreshesTTL(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+	testProducts(s).add(testProduct(3, "Chair", 49.5, time.Now()))
+
+	expectCartSession(redisMock)
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHSet(testKeys.cart(7), "3", 2).SetVal(1)
+	redisMock.ExpectExpire(testKeys.cart(7), testCartTTL).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	w := cartRequest(s, http.MethodPost, "/v1/cart/items", `{"product_id":3,"quantity":2}`, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	assertRedisMet(t, redisMock)
+}
+
+func TestCart_GetJoinsProductsAndRefreshesTTL(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+	now := time.Now()
+	unpriced := testProduct(2, "Sample", 0, now)
+	unpriced.Price = nil
+	testProducts(s).add(testProduct(1, "Chair", 49.5, now), unpriced, testProduct(4, "Desk", 300.25, now))
+
+	expectCartSession(redisMock)
+	key := testKeys.cart(7)
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHGetAll(key).SetVal(map[string]string{"4": "1", "1": "2", "2": "5", "9": "1"})
+	redisMock.ExpectExpire(key, testCartTTL).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+	// Product 9 no longer exists.
+	redisMock.ExpectHDel(key, "9").SetVal(1)
+
+	w := cartRequest(s, http.MethodGet, "/v1/cart", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got cartResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 3 || got.Items[0].ProductID != 1 || got.Items[0].Name != "Chair" || got.Items[0].Quantity != 2 ||
+		got.Items[1].UnitPrice != nil || got.Items[2].ProductID != 4 || *got.Items[2].UnitPrice != 300.25 {
+		t.Errorf("unexpected lines %+v", got.Items)
+	}
+	if got.Total != 399.25 {
+		t.Errorf("expected total 399.25, got %v", got.Total)
+	}
+	assertRedisMet(t, redisMock)
+}
+
+func TestCart_DeleteRefreshesTTL(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+
+	expectCartSession(redisMock)
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHDel(testKeys.cart(7), "3").SetVal(0)
+	redisMock.ExpectExpire(testKeys.cart(7), testCartTTL).SetVal(false)
+	redisMock.ExpectTxPipelineExec()
+
+	w := cartRequest(s, http.MethodDelete, "/v1/cart/items/3", "", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	assertRedisMet(t, redisMock)
+}
+
+func TestCart_PutRejects(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+	testProducts(s).add(testProduct(3, "Chair", 49.5, time.Now()))
+
+	for _, body := range []string{
+		`{"product_id":3,"quantity":0}`,
+		`{"product_id":3,"quantity":100}`,
+		`{"product_id":0,"quantity":1}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/cart/items", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || decodeError(t, w).Code != codeValidation {
+			t.Errorf("%s: expected 400 %s, got %d: %s", body, codeValidation, w.Code, w.Body)
+		}
+	}
+
+	// A product that does not exist is never added.
+	expectCartSession(redisMock)
+	w := cartRequest(s, http.MethodPost, "/v1/cart/items", `{"product_id":8,"quantity":1}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); len(got.Fields) != 1 || got.Fields[0].Field != "product_id" {
+		t.Errorf("expected product_id to be named, got %+v", got)
+	}
+	assertRedisMet(t, redisMock)
+}
+
+func TestCart_AnonymousCookie(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+
+	// Without a cookie a cart is started and named in a new one.
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectHGetAll(`cart:anon:[0-9a-f]{32}$`).SetVal(map[string]string{})
+	redisMock.Regexp().ExpectExpire(`cart:anon:[0-9a-f]{32}$`, testCartTTL).SetVal(false)
+	redisMock.ExpectTxPipelineExec()
+
+	w := cartRequest(s, http.MethodGet, "/v1/cart", "", &http.Cookie{Name: "other", Value: "x"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	issued := responseCartCookie(t, w)
+	if !issued.HttpOnly || issued.SameSite != http.SameSiteLaxMode || issued.MaxAge != int(testCartTTL.Seconds()) || issued.Path != "/" {
+		t.Errorf("unexpected cookie attributes %+v", issued)
+	}
+	id, ok := s.verifyCartCookie(issued.Value)
+	if !ok {
+		t.Fatalf("issued cookie %q does not verify", issued.Value)
+	}
+	assertRedisMet(t, redisMock)
+
+	// The cookie names the same cart next time, and is sent again to slide
+	// its expiry along with the cart's.
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHDel(testKeys.anonCart(id), "3").SetVal(1)
+	redisMock.ExpectExpire(testKeys.anonCart(id), testCartTTL).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	w = cartRequest(s, http.MethodDelete, "/v1/cart/items/3", "", issued)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if again := responseCartCookie(t, w); again.Value != issued.Value {
+		t.Errorf("expected the cookie %q renewed, got %q", issued.Value, again.Value)
+	}
+	assertRedisMet(t, redisMock)
+
+	// A cookie with a forged signature gets a cart of its own instead.
+	forged := &http.Cookie{Name: cartCookie, Value: strings.Repeat("c", 2*cartIDBytes) + "." + strings.SplitN(issued.Value, ".", 2)[1]}
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectHGetAll(`cart:anon:[0-9a-f]{32}$`).SetVal(map[string]string{})
+	redisMock.Regexp().ExpectExpire(`cart:anon:[0-9a-f]{32}$`, testCartTTL).SetVal(false)
+	redisMock.ExpectTxPipelineExec()
+
+	w = cartRequest(s, http.MethodGet, "/v1/cart", "", forged)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got := responseCartCookie(t, w); got.Value == forged.Value || got.Value == issued.Value {
+		t.Errorf("expected a new cart for a forged cookie, got %q", got.Value)
+	}
+	assertRedisMet(t, redisMock)
+}
+
+func TestCart_AnonymousDisabled(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+	s.cfg.CartCookieSecret = ""
+
+	w := cartRequest(s, http.MethodGet, "/v1/cart", "", &http.Cookie{Name: cartCookie, Value: "x"})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d: %s", w.Code, w.Body)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected no cookie, got %q", w.Header().Values("Set-Cookie"))
+	}
+	assertRedisMet(t, redisMock)
+}
+
+// expectClaimCart expects the transaction emptying the cart at key.
+func expectClaimCart(redisMock redismock.ClientMock, key string, lines map[string]string) {
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHGetAll(key).SetVal(lines)
+	redisMock.ExpectDel(key).SetVal(1)
+	redisMock.ExpectTxPipelineExec()
+}
+
+func TestCreateOrderHandler_FromCartClearsCart(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newCartServer(t)
+	usePostgresStores(s)
+
+	expectCartSession(redisMock)
+	expectClaimCart(redisMock, testKeys.cart(7), map[string]string{"2": "1", "1": "2"})
+	mockSQL.ExpectBegin()
+	expectOrderItem(mockSQL, 1, 2, 10.99, true)
+	expectOrderItem(mockSQL, 2, 1, 5.49, true)
+	mockSQL.ExpectQuery("INSERT INTO orders").WithArgs(27.47).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+	mockSQL.ExpectExec("INSERT INTO order_items").WithArgs(int64(5), int64(1), 2, 10.99).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectExec("INSERT INTO order_items").WithArgs(int64(5), int64(2), 1, 5.49).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit()
+
+	w := cartRequest(s, http.MethodPost, "/v1/orders", `{"from_cart":true}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var order store.Order
+	if err := json.Unmarshal(w.Body.Bytes(), &order); err != nil {
+		t.Fatal(err)
+	}
+	if order.ID != 5 || len(order.Items) != 2 {
+		t.Errorf("unexpected order %+v", order)
+	}
+	assertRedisMet(t, redisMock)
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateOrderHandler_FromCartRestoresOnFailure(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newCartServer(t)
+	usePostgresStores(s)
+
+	id := strings.Repeat("ab", cartIDBytes)
+	cookie := &http.Cookie{Name: cartCookie, Value: id + "." + s.signCartID(id)}
+	key := testKeys.anonCart(id)
+
+	expectClaimCart(redisMock, key, map[string]string{"2": "50", "1": "2"})
+	mockSQL.ExpectBegin()
+	expectOrderItem(mockSQL, 1, 2, 10.99, true)
+	expectOrderItem(mockSQL, 2, 50, 5.49, false)
+	mockSQL.ExpectRollback()
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHSetNX(key, "1", 2).SetVal(true)
+	redisMock.ExpectHSetNX(key, "2", 50).SetVal(true)
+	redisMock.ExpectExpire(key, testCartTTL).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	w := cartRequest(s, http.MethodPost, "/v1/orders", `{"from_cart":true}`, cookie)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+	assertRedisMet(t, redisMock)
+}
+
+func TestCreateOrderHandler_FromCartRejects(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+
+	w := cartRequest(s, http.MethodPost, "/v1/orders", `{"from_cart":true,"items":[{"product_id":1,"quantity":1}]}`, &http.Cookie{Name: "other"})
+	if w.Code != http.StatusBadRequest || decodeError(t, w).Code != codeValidation {
+		t.Errorf("expected 400 %s with items, got %d: %s", codeValidation, w.Code, w.Body)
+	}
+
+	expectCartSession(redisMock)
+	expectClaimCart(redisMock, testKeys.cart(7), map[string]string{})
+	w = cartRequest(s, http.MethodPost, "/v1/orders", `{"from_cart":true}`, nil)
+	if w.Code != http.StatusBadRequest || decodeError(t, w).Code != codeBadRequest {
+		t.Errorf("expected 400 %s for an empty cart, got %d: %s", codeBadRequest, w.Code, w.Body)
+	}
+	assertRedisMet(t, redisMock)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go-service/store"
+)
+
+// maxCategoryNameLen is the longest category name accepted, in characters.
+const maxCategoryNameLen = 100
+
+// slugPattern matches a category slug: lowercase words of letters and
+// digits joined by single hyphens, at most 64 characters.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// validSlug reports whether s is a well-formed category slug.
+func validSlug(s string) bool {
+	return len(s) <= 64 && slugPattern.MatchString(s)
+}
+
+// categoryInput is the request body for creating or replacing a category.
+type categoryInput struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// validate reports every rule the input breaks, as a validationError.
+func (in categoryInput) validate() error {
+	var v validator
+	v.check(in.Slug != "", "slug", "is required")
+	v.check(in.Slug == "" || validSlug(in.Slug), "slug", "must be lowercase letters and digits separated by single hyphens, at most 64 characters")
+	v.check(strings.TrimSpace(in.Name) != "", "name", "is required")
+	v.check(utf8.RuneCountInString(in.Name) <= maxCategoryNameLen, "name", fmt.Sprintf("must be at most %d characters", maxCategoryNameLen))
+	return v.err()
+}
+
+// store returns the input for the category store. It must only be called
+// on input that validates.
+func (in categoryInput) store() store.CategoryInput {
+	return store.CategoryInput{Slug: in.Slug, Name: in.Name}
+}
+
+// categoryID parses the {id} path segment. On failure it writes a 400 and
+// returns false.
+func (s *Server) categoryID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "category id must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// writeCategoryError answers a failed call to the category store.
+func (s *Server) writeCategoryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, codeNotFound, "category not found")
+	case errors.Is(err, store.ErrDuplicate):
+		s.writeError(w, http.StatusConflict, codeConflict, "a category with this slug already exists")
+	default:
+		s.logger.ErrorContext(r.Context(), "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+	}
+}
+
+// listCategoriesHandler lists every category, in name order.
+func (s *Server) listCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	categories, err := s.categories.List(r.Context())
+	if err != nil {
+		s.writeCategoryError(w, r, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, categories)
+}
+
+func (s *Server) categoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.categoryID(w, r)
+	if !ok {
+		return
+	}
+	c, err := s.categories.Get(r.Context(), id)
+	if err != nil {
+		s.writeCategoryError(w, r, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Server) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var in categoryInput
+	if !s.decodeJSON(w, r, int64(s.cfg.MaxBodyBytes), &in) {
+		return
+	}
+	if err := in.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	c, err := s.categories.Create(r.Context(), in.store())
+	if err != nil {
+		s.writeCategoryError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", s.apiPath("/categories/"+strconv.FormatInt(c.ID, 10)))
+	s.writeJSON(w, http.StatusCreated, c)
+}
+
+// updateCategoryHandler replaces a category. Its name is part of every
+// product in it, so the product caches are purged.
+func (s *Server) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.categoryID(w, r)
+	if !ok {
+		return
+	}
+	var in categoryInput
+	if !s.decodeJSON(w, r, int64(s.cfg.MaxBodyBytes), &in) {
+		return
+	}
+	if err := in.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	c, err := s.categories.Update(r.Context(), id, in.store())
+	if err != nil {
+		s.writeCategoryError(w, r, err)
+		return
+	}
+	s.invalidateCategoryProducts(r.Context(), id)
+	s.writeJSON(w, http.StatusOK, c)
+}
+
+// deleteCategoryHandler removes a category. One that still has products is
+// refused with a 409, unless ?force=true, which leaves them without a
+// category.
+func (s *Server) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.categoryID(w, r)
+	if !ok {
+		return
+	}
+	var force bool
+	if v := r.URL.Query().Get("force"); v != "" {
+		var err error
+		if force, err = strconv.ParseBool(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "force must be true or false")
+			return
+		}
+	}
+
+	err := s.categories.Delete(r.Context(), id, force)
+	if errors.Is(err, store.ErrForeignKey) {
+		s.writeError(w, http.StatusConflict, codeConflict, "category still has products; delete it with force=true to leave them without a category")
+		return
+	}
+	if err != nil {
+		s.writeCategoryError(w, r, err)
+		return
+	}
+	if force {
+		s.invalidateCategoryProducts(r.Context(), id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// invalidateCategoryProducts purges the product caches after a change to
+// category id. Cached products are not indexed by category, so all of them
+// go. The stale copy of the list is kept, like after any other write. A
+// failure is only logged: the entries expire with ProductsCacheTTL.
+func (s *Server) invalidateCategoryProducts(ctx context.Context, id int64) {
+	if res, err := s.purgeCachedProducts(ctx, s.keys.products()); err != nil || !res.Complete {
+		s.logger.WarnContext(ctx, "Failed to purge the products cache after a category change",
+			"category_id", id, "deleted", res.Deleted, "complete", res.Complete, "err", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	redismock "github.com/go-redis/redismock/v9"
+
+	"go-service/store"
+)
+
+// categoryRequest serves a request to the category endpoints, as an admin.
+func categoryRequest(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	req := asAdmin(httptest.NewRequest(method, path, strings.NewReader(body)))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+// expectProductsCachePurge expects the product list and every cached
+// product purged, with none found, and the stale copy of the list kept.
+func expectProductsCachePurge(redisMock redismock.ClientMock) {
+	redisMock.ExpectUnlink(testKeys.products()).SetVal(1)
+	redisMock.ExpectScan(0, testKeys.productPattern(), cacheScanCount).SetVal(nil, 0)
+}
+
+func TestCategories_CRUD(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	w := categoryRequest(s, http.MethodPost, "/v1/categories", `{"slug":"chairs","name":"Chairs"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/v1/categories/1" {
+		t.Fatalf("expected 201 with a Location, got %d %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	categoryRequest(s, http.MethodPost, "/v1/categories", `{"slug":"beds","name":"Beds"}`)
+
+	w = categoryRequest(s, http.MethodGet, "/v1/categories", "")
+	var list []store.Category
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 2 || list[0].Slug != "beds" || list[1].Slug != "chairs" {
+		t.Fatalf("expected both categories in name order, got %s", w.Body)
+	}
+
+	// A product in the category is served with it, and with its new name
+	// once renamed.
+	expectCreate(redisMock, 1)
+	w = categoryRequest(s, http.MethodPost, "/v1/products", `{"name":"Oak chair","price":49.5,"category_id":1}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var p store.Product
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Category == nil || *p.Category != (store.ProductCategory{ID: 1, Name: "Chairs"}) {
+		t.Errorf("expected the product in category 1, Chairs; got %+v", p.Category)
+	}
+
+	expectProductsCachePurge(redisMock)
+	w = categoryRequest(s, http.MethodPut, "/v1/categories/1", `{"slug":"seating","name":"Seating"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got, _ := s.products.Get(context.Background(), p.ID); got.Category == nil || got.Category.Name != "Seating" {
+		t.Errorf("expected the product in the renamed category, got %+v", got.Category)
+	}
+
+	w = categoryRequest(s, http.MethodGet, "/v1/categories/1", "")
+	var c store.Category
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || c.Slug != "seating" {
+		t.Errorf("expected the updated category, got %s", w.Body)
+	}
+
+	w = categoryRequest(s, http.MethodDelete, "/v1/categories/2", "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w = categoryRequest(s, http.MethodGet, "/v1/categories/2", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the deleted category not found, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the product caches purged on rename only: %v", err)
+	}
+}
+
+func TestCategories_DeleteInUseNeedsForce(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	testCategories(s).add(store.Category{ID: 3, Slug: "chairs", Name: "Chairs"})
+	chair := testProduct(1, "Oak chair", 49.5, time.Now())
+	chair.Category = &store.ProductCategory{ID: 3, Name: "Chairs"}
+	testProducts(s).add(chair)
+
+	w := categoryRequest(s, http.MethodDelete, "/v1/categories/3", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeConflict || !strings.Contains(got.Message, "force=true") {
+		t.Errorf("expected a conflict pointing at force, got %+v", got)
+	}
+
+	expectProductsCachePurge(redisMock)
+	if w = categoryRequest(s, http.MethodDelete, "/v1/categories/3?force=true", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := s.categories.Get(context.Background(), 3); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected the category deleted, got %v", err)
+	}
+	if got, _ := s.products.Get(context.Background(), 1); got.Category != nil {
+		t.Errorf("expected the product left without a category, got %+v", got.Category)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the product caches purged: %v", err)
+	}
+}
+
+func TestCategories_Rejects(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testCategories(s).add(store.Category{ID: 1, Slug: "chairs", Name: "Chairs"})
+
+	tests := []struct {
+		name, method, path, body string
+		code                     int
+	}{
+		{"slug with spaces", http.MethodPost, "/v1/categories", `{"slug":"Garden Tools","name":"Garden tools"}`, http.StatusBadRequest},
+		{"missing name", http.MethodPost, "/v1/categories", `{"slug":"garden"}`, http.StatusBadRequest},
+		{"taken slug", http.MethodPost, "/v1/categories", `{"slug":"chairs","name":"More chairs"}`, http.StatusConflict},
+		{"bad id", http.MethodGet, "/v1/categories/abc", "", http.StatusBadRequest},
+		{"unknown category", http.MethodPut, "/v1/categories/9", `{"slug":"beds","name":"Beds"}`, http.StatusNotFound},
+		{"bad force", http.MethodDelete, "/v1/categories/1?force=maybe", "", http.StatusBadRequest},
+		{"product in unknown category", http.MethodPost, "/v1/products", `{"name":"Lamp","price":15,"category_id":9}`, http.StatusUnprocessableEntity},
+		{"product with bad category id", http.MethodPost, "/v1/products", `{"name":"Lamp","price":15,"category_id":0}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := categoryRequest(s, tt.method, tt.path, tt.body); w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.code, w.Code, w.Body)
+		}
+	}
+	if got, _ := s.categories.Get(context.Background(), 1); got.Name != "Chairs" {
+		t.Errorf("expected the category untouched, got %+v", got)
+	}
+}
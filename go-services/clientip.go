@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP returns the address of the client that made r, for the access
+// log, the login limiter and the audit log. Forwarded headers are only
+// believed when the connection comes from one of TrustedProxies, so that a
+// client cannot spoof its address by sending them itself. X-Forwarded-For is
+// then read right to left, skipping further trusted proxies; without a
+// usable X-Forwarded-For, X-Real-IP is used, and without that the peer.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := remoteHost(r)
+	peer, err := netip.ParseAddr(ip)
+	if err != nil || !s.trustedProxy(peer) {
+		return ip
+	}
+
+	if forwarded, ok := s.forwardedFor(r); ok {
+		return forwarded
+	}
+	if addr, ok := parseForwardedAddr(r.Header.Get("X-Real-IP")); ok {
+		return addr.String()
+	}
+	return peer.Unmap().String()
+}
+
+// forwardedFor walks the X-Forwarded-For hops of r from the right and
+// returns the first that is not a trusted proxy, or the leftmost when all
+// are. A malformed hop ends the walk, as nothing to its left can be
+// believed; ok is false when not even the rightmost hop is usable.
+func (s *Server) forwardedFor(r *http.Request) (ip string, ok bool) {
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, valid := parseForwardedAddr(hops[i])
+		if !valid {
+			break
+		}
+		ip, ok = hop.String(), true
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip, ok
+}
+
+// parseForwardedAddr parses an address from a forwarding header. Some
+// proxies append the client's port, as in "192.0.2.1:4321" or
+// "[2001:db8::1]:443"; it is dropped, as is any IPv6 zone.
+func parseForwardedAddr(v string) (netip.Addr, bool) {
+	v = strings.TrimSpace(v)
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(v)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.settings().TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of the connection's remote address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.TrustedProxies = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"direct client", "192.0.2.1:1234", nil, "", "192.0.2.1"},
+		{"untrusted peer cannot spoof", "192.0.2.1:1234", []string{"203.0.113.9"}, "", "192.0.2.1"},
+		{"untrusted peer cannot spoof X-Real-IP", "192.0.2.1:1234", nil, "203.0.113.9", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.5:1234", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"chain of trusted proxies", "10.0.0.5:1234", []string{"203.0.113.9, 10.1.1.1"}, "", "203.0.113.9"},
+		{"client-supplied prefix ignored", "10.0.0.5:1234", []string{"1.2.3.4, 203.0.113.9, 10.1.1.1"}, "", "203.0.113.9"},
+		{"repeated headers", "10.0.0.5:1234", []string{"1.2.3.4", "203.0.113.9"}, "", "203.0.113.9"},
+		{"only trusted hops", "10.0.0.5:1234", []string{"10.2.2.2, 10.1.1.1"}, "", "10.2.2.2"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:443", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"IPv6 client through IPv6 proxies", "[2001:db8::1]:443", []string{"2001:db9::7, 2001:db8::2"}, "", "2001:db9::7"},
+		{"IPv4-mapped hop", "10.0.0.5:1234", []string{"::ffff:203.0.113.9"}, "", "203.0.113.9"},
+		{"hop with port", "10.0.0.5:1234", []string{"203.0.113.9:4321"}, "", "203.0.113.9"},
+		{"IPv6 hop with port", "10.0.0.5:1234", []string{"[2001:db9::7]:443"}, "", "2001:db9::7"},
+		{"malformed hop", "10.0.0.5:1234", []string{"203.0.113.9, junk"}, "", "10.0.0.5"},
+		{"malformed hop left of a proxy", "10.0.0.5:1234", []string{"junk, 10.1.1.1"}, "", "10.1.1.1"},
+		{"empty header", "10.0.0.5:1234", []string{""}, "", "10.0.0.5"},
+		{"X-Real-IP without X-Forwarded-For", "10.0.0.5:1234", nil, "203.0.113.9", "203.0.113.9"},
+		{"X-Forwarded-For wins over X-Real-IP", "10.0.0.5:1234", []string{"198.51.100.7"}, "203.0.113.9", "198.51.100.7"},
+		{"X-Real-IP after a malformed X-Forwarded-For", "10.0.0.5:1234", []string{"unknown"}, "203.0.113.9", "203.0.113.9"},
+		{"malformed X-Real-IP", "10.0.0.5:1234", nil, "not-an-ip", "10.0.0.5"},
+		{"trusted proxy without headers", "10.0.0.5:1234", nil, "", "10.0.0.5"},
+		{"no port", "pipe", nil, "", "pipe"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := s.clientIP(req); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoginFailureKeys_UseClientIP(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.RemoteAddr = "10.0.0.5:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.1.1.1")
+
+	want := []string{testKeys.loginFailures("user", "admin"), testKeys.loginFailures("ip", "203.0.113.9")}
+	if got := s.loginFailureKeys(req, "admin"); !slices.Equal(got, want) {
+		t.Errorf("expected the limiter to charge the forwarded client, got %v", got)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// incompressibleTypes are media types that are already compressed, so
+// gzipping them only costs CPU.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-brotli",
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// withCompression gzips responses for clients that accept it. Bodies smaller
+// than CompressMinBytes, already encoded responses and already compressed
+// media types are sent as they are. Routes listed in CompressExclude are
+// never touched. It sits inside withMetrics, so the recorded status and size
+// are those of what is actually sent.
+func (s *Server) withCompression(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(s.cfg.CompressExclude, s.routeLabel(r)) {
+			handler(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		// An upgraded connection has no response body to compress.
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" || !acceptsGzip(r) {
+			handler(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: s.cfg.CompressMinBytes, status: http.StatusOK}
+		defer func() {
+			if err := gw.Close(); err != nil {
+				s.logger.WarnContext(r.Context(), "Failed to finish compressed response", "err", err)
+			}
+		}()
+		handler(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(enc, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of the body until it holds minSize
+// bytes, or the handler finishes, and only then decides whether to
+// compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	// started is set once the header has been sent, compressed or not.
+	started     bool
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	if !bodyAllowed(code) {
+		w.started = true
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if w.started {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) < w.minSize {
+		return len(b), nil
+	}
+	if err := w.start(true); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// start sends the header, compressing the body if allowed and the content
+// type is worth it, then writes out whatever was buffered.
+func (w *gzipResponseWriter) start(allowed bool) error {
+	w.started = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if allowed && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Close sends a body that never reached minSize uncompressed, or finishes
+// the gzip stream.
+func (w *gzipResponseWriter) Close() error {
+	if !w.started {
+		return w.start(false)
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz.Reset(nil)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+	return err
+}
+
+// Flush commits to compressing regardless of the size so far, since the
+// handler wants the client to see what it wrote.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func compressible(contentType string) bool {
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyAllowed reports whether a response with status code may have a body.
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("body is not gzip: %v", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("failed to decompress body: %v", err)
+	}
+	return string(out)
+}
+
+func gzipRequest(path string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	return req
+}
+
+func TestWithCompression_CompressesLargeBodies(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.CompressMinBytes = 64
+
+	body := `{"items":"` + strings.Repeat("widget ", 100) + `"}`
+	h := s.withCompression(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		// Written in pieces so the threshold is crossed mid-body.
+		for _, part := range []string{body[:10], body[10:100], body[100:]} {
+			_, _ = io.WriteString(w, part)
+		}
+	})
+
+	w := httptest.NewRecorder()
+	rec := newStatusRecorder(w)
+	h(rec, gzipRequest("/products"))
+
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected Content-Encoding gzip, got %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("expected Vary Accept-Encoding, got %q", got)
+	}
+	if got := gunzip(t, w.Body.Bytes()); got != body {
+		t.Errorf("decompressed body differs:\n got %q\nwant %q", got, body)
+	}
+	// The recorder outside the middleware sees what went on the wire.
+	if rec.status != http.StatusCreated {
+		t.Errorf("expected recorded status 201, got %d", rec.status)
+	}
+	if rec.bytes != int64(w.Body.Len()) || rec.bytes >= int64(len(body)) {
+		t.Errorf("expected recorded size %d (compressed), got %d", w.Body.Len(), rec.bytes)
+	}
+}
+
+func TestWithCompression_LeavesResponsesAlone(t *testing.T) {
+	t.Parallel()
+
+	large := strings.Repeat("a", 2048)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		accept      string
+	}{
+		{"below threshold", "application/json", `{"ok":true}`, "gzip"},
+		{"client does not accept gzip", "application/json", large, "br"},
+		{"gzip refused with q=0", "application/json", large, "gzip;q=0"},
+		{"already compressed type", "image/png", large, "gzip"},
+	}
+	for _, tt := range tests {
+		s, _, _ := newTestServer(t)
+		s.cfg.CompressMinBytes = 1024
+		h := s.withCompression(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			_, _ = io.WriteString(w, tt.body)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/products", nil)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		w := httptest.NewRecorder()
+		rec := newStatusRecorder(w)
+		h(rec, req)
+
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: expected no Content-Encoding, got %q", tt.name, got)
+		}
+		if w.Body.String() != tt.body {
+			t.Errorf("%s: body was altered", tt.name)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: expected Vary Accept-Encoding, got %q", tt.name, w.Header().Get("Vary"))
+		}
+		if rec.bytes != int64(len(tt.body)) {
+			t.Errorf("%s: expected recorded size %d, got %d", tt.name, len(tt.body), rec.bytes)
+		}
+	}
+}
+
+func TestWithCompression_NoBodyStatuses(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	h := s.withCompression(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	w := httptest.NewRecorder()
+	h(w, gzipRequest("/products/1"))
+
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected a bare 204, got %d %q %q", w.Code, w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+}
+
+func TestWithCompression_ExcludedRoutesAndMetrics(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.CompressExclude = []string{"/"}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, gzipRequest("/"))
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "" {
+		t.Errorf("expected an excluded route to be untouched, got headers %v", w.Header())
+	}
+
+	// promhttp negotiates compression itself; its output must reach the
+	// client exactly as it produced it, compressed once.
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, gzipRequest("/metrics"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from /metrics, got %d", w.Code)
+	}
+	body := w.Body.Bytes()
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		body = []byte(gunzip(t, body))
+	}
+	if !bytes.Contains(body, []byte("# HELP")) {
+		t.Errorf("expected the Prometheus text format, got %q", body[:min(len(body), 64)])
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	t.Parallel()
+
+	for header, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"GZIP":              true,
+		"deflate, gzip":     true,
+		"gzip;q=0.5":        true,
+		"gzip; q=0":         false,
+		"gzip;q=0.000":      false,
+		"br, identity":      false,
+		"gzip;q=nonsense":   false,
+		"x-gzip, deflate":   false,
+		"deflate,gzip;q=1.": true,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set("Accept-Encoding", header)
+		}
+		if got := acceptsGzip(req); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
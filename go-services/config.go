@@ -0,0 +1,1176 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+
+	"go-service/flags"
+)
+
+// Config holds every setting the service reads from the environment. The
+// reloadableSettings are read again on SIGHUP; the rest need a restart.
+type Config struct {
+	DBHost     string
+	DBPort     string
+	DBUser     string
+	DBPassword string
+	DBName     string
+	// DBSSLMode is the lib/pq sslmode: disable, require, verify-ca or
+	// verify-full.
+	DBSSLMode string
+	// DatabaseURL, a postgres:// URL, is used instead of the settings above
+	// when set; they are then filled in from it for logs and metrics.
+	DatabaseURL string
+
+	// DBMaxOpenConns, DBMaxIdleConns and DBConnMaxLifetime tune the
+	// database/sql connection pool.
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	// DBQueryTimeout bounds each query from the application's side;
+	// DBStatementTimeout is set as statement_timeout on every connection,
+	// so the server also gives up on queries whose client has gone. Zero
+	// disables either.
+	DBQueryTimeout     time.Duration
+	DBStatementTimeout time.Duration
+
+	// DBReplicaHost and DBReplicaPort locate a read replica, reached with
+	// the primary's credentials, that serves product reads. Empty disables
+	// it. After a failed ping the replica is avoided for
+	// DBReplicaRetryInterval.
+	DBReplicaHost          string
+	DBReplicaPort          string
+	DBReplicaRetryInterval time.Duration
+
+	// MigrationsDisabled skips the schema migrations normally applied at
+	// startup, for environments where a DBA applies them.
+	MigrationsDisabled bool
+
+	// RedisMode is single, sentinel or cluster. Single mode connects to
+	// RedisHost and RedisPort; sentinel mode asks RedisSentinelAddrs for
+	// the master named RedisMasterName; cluster mode discovers the cluster
+	// from RedisClusterAddrs.
+	RedisMode          string
+	RedisHost          string
+	RedisPort          string
+	RedisSentinelAddrs []string
+	RedisMasterName    string
+	RedisClusterAddrs  []string
+	// RedisUsername and RedisPassword authenticate with Redis ACLs; a
+	// password alone uses the default user.
+	RedisUsername string
+	RedisPassword string
+	// RedisDB is the database index selected on connect.
+	RedisDB int
+	// RedisTLSEnabled connects over TLS, verified against the system roots
+	// or, if set, the CAs in RedisTLSCAFile.
+	RedisTLSEnabled bool
+	RedisTLSCAFile  string
+	// RedisPoolSize caps the client's connections; zero keeps the go-redis
+	// default of 10 per CPU. RedisMinIdleConns are kept open when idle.
+	RedisPoolSize     int
+	RedisMinIdleConns int
+	// RedisKeyPrefix starts every key the service writes, keeping them
+	// apart from other services sharing the instance.
+	RedisKeyPrefix string
+	// RedisURL, a redis:// or rediss:// URL, is used instead of the host,
+	// port, credentials, database and TLS settings above when set; they
+	// are then filled in from it for logs.
+	RedisURL string
+
+	// HTTPAddr is the public listener serving application routes.
+	HTTPAddr string
+	// InternalAddr is the listener serving /metrics, /readyz and, with
+	// EnablePprof, /debug/pprof and /debug/vars. When empty, /metrics is
+	// served on HTTPAddr instead.
+	InternalAddr string
+	// GRPCAddr is the listener serving the gRPC ProductService and health
+	// service; empty disables it.
+	GRPCAddr string
+	// BasePath prefixes every public route but the probes, for ingresses
+	// that forward a path prefix unchanged. The versioned API is served
+	// under BasePath + "/v1".
+	BasePath string
+	// LegacyRoutesSunset is announced in the Sunset header of the
+	// unversioned routes kept as deprecated aliases of /v1.
+	LegacyRoutesSunset time.Time
+	// EnablePprof exposes the pprof and expvar endpoints on InternalAddr.
+	EnablePprof bool
+
+	// MetricsAuthToken (bearer) and MetricsBasicAuthUser/Pass protect
+	// /metrics; when both are set either credential is accepted. Unset,
+	// /metrics is open.
+	MetricsAuthToken     string
+	MetricsBasicAuthUser string
+	MetricsBasicAuthPass string
+
+	// AdminAuthToken is the bearer token required by POST
+	// /admin/maintenance. Unset, that endpoint is disabled.
+	AdminAuthToken string
+
+	// PaymentWebhookSecret is the key the payment provider signs its
+	// deliveries to POST /webhooks/payments with. Deliveries timestamped
+	// more than PaymentWebhookTolerance from now are rejected as replays.
+	// Unset, that endpoint is disabled.
+	PaymentWebhookSecret    string
+	PaymentWebhookTolerance time.Duration
+
+	// SentryDSN or, failing that, ErrorWebhookURL turns on reporting of
+	// panics and 5xx responses. Unset, errors are only logged.
+	SentryDSN       string
+	ErrorWebhookURL string
+
+	// TLSCertFile and TLSKeyFile enable TLS on the public listener;
+	// TLSClientCAFile additionally requires client certificates signed by
+	// one of its CAs. The files are re-read on SIGHUP.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	// LogLevel is the least severe level logged. initLog reads LOG_LEVEL
+	// itself, before the rest of the configuration.
+	LogLevel slog.Level
+
+	// TrustedProxies are the peers, such as the load balancer and the
+	// ingress, whose X-Forwarded-For and X-Real-IP headers are believed when
+	// determining the client address. It is read from TRUSTED_PROXY_CIDRS,
+	// or from its former name TRUSTED_PROXIES.
+	TrustedProxies []netip.Prefix
+
+	// AccessLogExclude lists routes, such as probes, that are not access
+	// logged.
+	AccessLogExclude []string
+
+	// CORSAllowedOrigins lists the origins, or "*", that browsers may call
+	// the API from. Empty disables CORS.
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSAllowCredentials bool
+	// CORSMaxAge is how long browsers may cache a preflight response.
+	CORSMaxAge time.Duration
+
+	// ContentTypeOptions, FrameOptions, ReferrerPolicy,
+	// ContentSecurityPolicy and StrictTransportSecurity are the values of
+	// the corresponding security headers; an empty value omits the header.
+	// SecurityHeaderExceptions maps a route to headers it must not get.
+	ContentTypeOptions       string
+	FrameOptions             string
+	ReferrerPolicy           string
+	ContentSecurityPolicy    string
+	StrictTransportSecurity  string
+	SecurityHeaderExceptions map[string][]string
+
+	// CompressMinBytes is the smallest response body worth gzipping.
+	// CompressExclude lists routes that are never compressed.
+	CompressMinBytes int
+	CompressExclude  []string
+
+	// MaxBodyBytes caps JSON request bodies. Endpoints whose payloads are
+	// known to be small, such as login, use a tighter limit of their own.
+	MaxBodyBytes int
+	// BulkMaxItems and BulkMaxBytes cap the number of products and the
+	// body size of one bulk import.
+	BulkMaxItems int
+	BulkMaxBytes int
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout are
+	// applied to every http.Server so slow clients cannot hold connections
+	// open indefinitely.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// ShutdownTimeout bounds how long in-flight requests may drain after
+	// SIGTERM.
+	ShutdownTimeout time.Duration
+	// PreStopDelay is how long the service keeps serving after SIGTERM,
+	// reporting itself unready, before the listeners close, so that load
+	// balancers stop routing to it first. Zero closes them at once.
+	PreStopDelay time.Duration
+
+	// MaxInFlight caps the requests served at once; zero means no limit.
+	// Beyond it a request waits up to MaxInFlightWait for a slot and is
+	// then answered 503. Health checks are never held back.
+	MaxInFlight     int
+	MaxInFlightWait time.Duration
+
+	// WSMaxConnections caps the WebSocket connections open on a replica;
+	// upgrades beyond it are answered 503.
+	WSMaxConnections int
+
+	// BreakerThreshold is how many consecutive failures of Postgres or of
+	// Redis open its circuit breaker; zero disables the breakers. An open
+	// breaker fails calls with 503 for BreakerCooldown before letting a
+	// probe through.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// RequestTimeout bounds the time a handler may spend on a request.
+	// Zero disables the timeout.
+	RequestTimeout time.Duration
+
+	// HealthCheckTimeout bounds each dependency check in /readyz.
+	HealthCheckTimeout time.Duration
+	// HealthCacheTTL is how long a readiness result is reused, so that
+	// probes arriving together share one round of checks. Zero runs the
+	// checks on every probe.
+	HealthCacheTTL time.Duration
+
+	// ProductsCacheTTL is how long the product list is cached in Redis.
+	// Zero disables caching.
+	ProductsCacheTTL time.Duration
+	// ProductsStaleTTL is how long the last good copy of each product list
+	// page is kept for serving while Postgres is down. Zero disables it.
+	ProductsStaleTTL time.Duration
+	// ProductsMissingTTL is how long a product id found not to exist is
+	// remembered, so that repeated lookups of it do not reach Postgres.
+	// Zero disables it.
+	ProductsMissingTTL time.Duration
+	// CacheTTLJitter spreads every cache TTL by up to ± this percentage, so
+	// that entries written together by all replicas do not expire together.
+	CacheTTLJitter int
+	// CacheSerialization (json or msgpack) and CacheCompression (none, gzip
+	// or snappy) choose how cached product payloads are stored in Redis.
+	// Values smaller than CacheCompressMinBytes once serialized are not
+	// compressed. Values in either format are read whatever the setting, but
+	// replicas that predate the settings only read json without compression,
+	// so the others should only be enabled once those are gone.
+	CacheSerialization    string
+	CacheCompression      string
+	CacheCompressMinBytes int
+	// ProductsRefreshInterval is how often the cache warmer reloads the
+	// first page of the product list into Redis. Zero disables it.
+	ProductsRefreshInterval time.Duration
+	// ProductsNotifyChannel is the Postgres channel LISTENed on for product
+	// changes made outside this service, which invalidate the product
+	// caches. Empty disables the listener.
+	ProductsNotifyChannel string
+
+	// ResponseCacheRoutes are the GET routes, named as in RATE_LIMITS,
+	// whose 200 responses are cached in Redis for ResponseCacheTTL. Writes
+	// do not invalidate them, so only routes that can be up to a TTL out of
+	// date belong here. Empty disables the cache.
+	ResponseCacheRoutes []string
+	ResponseCacheTTL    time.Duration
+
+	// FlagsRefresh is how long feature flags read from Redis are cached
+	// before they are read again.
+	FlagsRefresh time.Duration
+
+	// EventsPublisher (redis or kafka) publishes every product change to
+	// EventsTopic, for other services to follow: a Redis stream, named
+	// under RedisKeyPrefix and trimmed to about EventsStreamMaxLen
+	// entries, or a Kafka topic on KafkaBrokers. Events that fail to
+	// publish are kept in the outbox table and retried every
+	// OutboxRelayInterval. Empty disables publishing.
+	EventsPublisher     string
+	EventsTopic         string
+	EventsStreamMaxLen  int
+	KafkaBrokers        []string
+	OutboxRelayInterval time.Duration
+
+	// WebhookTimeout bounds each delivery to a webhook subscription. A
+	// delivery not answered with a 2xx is retried with backoff, and after
+	// WebhookMaxAttempts attempts kept as a dead letter. Due deliveries
+	// are looked for every WebhookPollInterval.
+	WebhookTimeout      time.Duration
+	WebhookMaxAttempts  int
+	WebhookPollInterval time.Duration
+
+	// StockReconcileInterval is how often stock reserved on the Redis
+	// counters is written back to Postgres. Zero disables the write-back.
+	StockReconcileInterval time.Duration
+
+	// ProductPurgeAfter is how long a deleted product can be restored
+	// before it is removed for good. Deleted products are looked for every
+	// ProductPurgeInterval. Zero keeps them forever.
+	ProductPurgeAfter    time.Duration
+	ProductPurgeInterval time.Duration
+
+	// IdempotencyTTL is how long the response to a write carrying an
+	// Idempotency-Key is kept for replay. Zero disables the header.
+	IdempotencyTTL time.Duration
+
+	// SessionTTL is how long a login session stays valid in Redis.
+	SessionTTL time.Duration
+
+	// CartTTL is how long a cart is kept after it was last used.
+	// CartCookieSecret signs the cookie naming an anonymous cart; empty
+	// disables anonymous carts, so only signed-in users have one.
+	CartTTL          time.Duration
+	CartCookieSecret string
+
+	// PasswordResetTTL is how long a password reset token stays valid.
+	// Tokens are mailed through the SMTP server at SMTPAddr, from
+	// SMTPFrom, logging in with SMTPUsername and SMTPPassword when set;
+	// without SMTPAddr they are not sent anywhere.
+	PasswordResetTTL time.Duration
+	SMTPAddr         string
+	SMTPFrom         string
+	SMTPUsername     string
+	SMTPPassword     string
+
+	// MaintenanceCacheTTL is how long the maintenance flag read from Redis
+	// is reused before it is looked up again.
+	MaintenanceCacheTTL time.Duration
+
+	// BcryptCost is the work factor for hashing passwords at registration.
+	BcryptCost int
+
+	// LoginMaxAttempts is how many failed logins a username or client
+	// address may make within LoginLockoutWindow before further attempts
+	// are rejected with 429. Zero disables the limit.
+	LoginMaxAttempts   int
+	LoginLockoutWindow time.Duration
+
+	// RateLimits limits the requests each client may make per route and
+	// tenant; see rateLimits. It is read from the JSON in RATE_LIMITS or
+	// the file named by RATE_LIMITS_FILE. Empty disables rate limiting.
+	RateLimits rateLimits
+
+	// JWTSigningKey (HS256) or JWTPrivateKeyFile (RS256, PEM) switches
+	// logins from Redis sessions to stateless JWT access tokens valid for
+	// JWTTTL. At most one of them may be set.
+	JWTSigningKey     string
+	JWTPrivateKeyFile string
+	JWTIssuer         string
+	JWTTTL            time.Duration
+
+	// DBConnect and RedisConnect control how long startup keeps retrying a
+	// dependency that is not yet reachable.
+	DBConnect    backoff
+	RedisConnect backoff
+}
+
+const (
+	defaultHTTPAddr        = ":8080"
+	defaultLegacySunset    = "2027-06-30"
+	defaultAccessLogSkip   = "/livez,/readyz,/healthz,/metrics"
+	defaultCompressMin     = 1024
+	defaultCacheMinBytes   = 512
+	defaultMaxBodyBytes    = 1 << 20
+	defaultBulkMaxItems    = 10000
+	defaultBulkMaxBytes    = 16 << 20
+	defaultReferrerPolicy  = "strict-origin-when-cross-origin"
+	defaultHSTS            = "max-age=63072000; includeSubDomains"
+	defaultCORSMethods     = "GET,POST,PUT,DELETE"
+	defaultCORSHeaders     = "Authorization,Content-Type,X-Request-ID,Idempotency-Key"
+	defaultCORSMaxAge      = 10 * time.Minute
+	defaultInternalAddr    = ":9090"
+	defaultShutdownTimeout = 15 * time.Second
+	defaultPreStopDelay    = 5 * time.Second
+	defaultReadHeaderTime  = 5 * time.Second
+	defaultReadTimeout     = 10 * time.Second
+	defaultWriteTimeout    = 30 * time.Second
+	defaultIdleTimeout     = 120 * time.Second
+	defaultRequestTimeout  = 10 * time.Second
+	defaultInFlightWait    = 100 * time.Millisecond
+	defaultBreakerCooldown = 10 * time.Second
+	defaultSessionTTL      = 24 * time.Hour
+	defaultCartTTL         = 30 * 24 * time.Hour
+	defaultPasswordReset   = 30 * time.Minute
+	defaultIdempotencyTTL  = 24 * time.Hour
+	defaultMaintenanceTTL  = 2 * time.Second
+	defaultWebhookSkew     = 5 * time.Minute
+	defaultLoginAttempts   = 5
+	defaultBreakerFailures = 5
+	defaultWSConnections   = 1000
+	defaultLoginWindow     = 15 * time.Minute
+	defaultJWTIssuer       = "go-service"
+	defaultJWTTTL          = 15 * time.Minute
+	defaultProductsTTL     = 60 * time.Second
+	defaultStaleTTL        = 24 * time.Hour
+	defaultMissingTTL      = 5 * time.Second
+	defaultResponseTTL     = 5 * time.Second
+	defaultCacheTTLJitter  = 10
+	defaultRefreshInterval = 30 * time.Second
+	defaultNotifyChannel   = "products_changed"
+	defaultEventsTopic     = "products-events"
+	defaultEventsMaxLen    = 1000000
+	defaultOutboxInterval  = 10 * time.Second
+	defaultWebhookTimeout  = 5 * time.Second
+	defaultWebhookAttempts = 8
+	defaultWebhookPoll     = time.Second
+	defaultStockReconcile  = 10 * time.Second
+	defaultPurgeAfter      = 30 * 24 * time.Hour
+	defaultPurgeInterval   = time.Hour
+	defaultHealthTimeout   = time.Second
+	defaultHealthCacheTTL  = 2 * time.Second
+	defaultDBMaxOpenConns  = 25
+	defaultDBMaxIdleConns  = 25
+	defaultDBConnLifetime  = 5 * time.Minute
+	defaultReplicaRetry    = 10 * time.Second
+	defaultRedisPrefix     = "gosvc:"
+	defaultQueryTimeout    = 5 * time.Second
+	defaultStmtTimeout     = 30 * time.Second
+	defaultConnectRetries  = 5
+	defaultConnectTimeout  = 30 * time.Second
+	defaultConnectBaseWait = 500 * time.Millisecond
+	defaultConnectMaxWait  = 10 * time.Second
+)
+
+// LoadConfig reads the Config from the process environment. It reports every
+// missing or malformed variable at once rather than stopping at the first.
+func LoadConfig() (Config, error) {
+	return loadConfig(os.LookupEnv)
+}
+
+func loadConfig(lookup func(string) (string, bool)) (Config, error) {
+	e := &envReader{lookup: lookup}
+
+	// With a DATABASE_URL the individual DB_* settings are not needed.
+	databaseURL := e.str("DATABASE_URL", "")
+	dbSetting := e.required
+	if databaseURL != "" {
+		dbSetting = func(key string) string { return e.str(key, "") }
+	}
+	// Likewise for REDIS_URL and REDIS_HOST, which only single mode uses.
+	redisMode := e.str("REDIS_MODE", redisSingle)
+	redisURL := e.str("REDIS_URL", "")
+	redisHost := e.required
+	if redisURL != "" || redisMode != redisSingle {
+		redisHost = func(key string) string { return e.str(key, "") }
+	}
+
+	cfg := Config{
+		DBHost:      dbSetting("DB_HOST"),
+		DBPort:      e.port("DB_PORT", "5432"),
+		DBUser:      dbSetting("DB_USER"),
+		DBPassword:  e.str("DB_PASSWORD", ""),
+		DBName:      dbSetting("DB_NAME"),
+		DBSSLMode:   e.str("DB_SSLMODE", "disable"),
+		DatabaseURL: databaseURL,
+
+		DBMaxOpenConns:    e.integer("DB_MAX_OPEN_CONNS", defaultDBMaxOpenConns),
+		DBMaxIdleConns:    e.integer("DB_MAX_IDLE_CONNS", defaultDBMaxIdleConns),
+		DBConnMaxLifetime: e.duration("DB_CONN_MAX_LIFETIME", defaultDBConnLifetime),
+
+		DBQueryTimeout:     e.duration("DB_QUERY_TIMEOUT", defaultQueryTimeout),
+		DBStatementTimeout: e.duration("DB_STATEMENT_TIMEOUT", defaultStmtTimeout),
+
+		DBReplicaHost:          e.str("DB_REPLICA_HOST", ""),
+		DBReplicaPort:          e.port("DB_REPLICA_PORT", e.str("DB_PORT", "5432")),
+		DBReplicaRetryInterval: e.duration("DB_REPLICA_RETRY_INTERVAL", defaultReplicaRetry),
+
+		MigrationsDisabled: e.boolean("MIGRATIONS_DISABLED", false),
+
+		RedisMode:          redisMode,
+		RedisHost:          redisHost("REDIS_HOST"),
+		RedisPort:          e.port("REDIS_PORT", "6379"),
+		RedisSentinelAddrs: e.list("REDIS_SENTINEL_ADDRS", ""),
+		RedisMasterName:    e.str("REDIS_MASTER_NAME", ""),
+		RedisClusterAddrs:  e.list("REDIS_CLUSTER_ADDRS", ""),
+		RedisUsername:      e.str("REDIS_USERNAME", ""),
+		RedisPassword:      e.str("REDIS_PASSWORD", ""),
+		RedisDB:            e.integer("REDIS_DB", 0),
+		RedisTLSEnabled:    e.boolean("REDIS_TLS_ENABLED", false),
+		RedisTLSCAFile:     e.str("REDIS_TLS_CA_FILE", ""),
+		RedisPoolSize:      e.integer("REDIS_POOL_SIZE", 0),
+		RedisMinIdleConns:  e.integer("REDIS_MIN_IDLE_CONNS", 0),
+		RedisKeyPrefix:     e.optional("REDIS_KEY_PREFIX", defaultRedisPrefix),
+		RedisURL:           redisURL,
+
+		HTTPAddr:     e.str("HTTP_ADDR", defaultHTTPAddr),
+		InternalAddr: e.optional("INTERNAL_ADDR", defaultInternalAddr),
+		GRPCAddr:     e.str("GRPC_ADDR", ""),
+		BasePath:     e.str("BASE_PATH", ""),
+
+		LegacyRoutesSunset: e.date("LEGACY_ROUTES_SUNSET", defaultLegacySunset),
+		EnablePprof:        e.boolean("ENABLE_PPROF", false),
+
+		MetricsAuthToken:     e.str("METRICS_AUTH_TOKEN", ""),
+		MetricsBasicAuthUser: e.str("METRICS_BASIC_AUTH_USER", ""),
+		MetricsBasicAuthPass: e.str("METRICS_BASIC_AUTH_PASS", ""),
+		AdminAuthToken:       e.str("ADMIN_AUTH_TOKEN", ""),
+
+		PaymentWebhookSecret:    e.str("PAYMENT_WEBHOOK_SECRET", ""),
+		PaymentWebhookTolerance: e.duration("PAYMENT_WEBHOOK_TOLERANCE", defaultWebhookSkew),
+
+		SentryDSN:       e.str("SENTRY_DSN", ""),
+		ErrorWebhookURL: e.str("ERROR_WEBHOOK_URL", ""),
+
+		TLSCertFile:     e.str("TLS_CERT_FILE", ""),
+		TLSKeyFile:      e.str("TLS_KEY_FILE", ""),
+		TLSClientCAFile: e.str("TLS_CLIENT_CA_FILE", ""),
+
+		TrustedProxies:   e.prefixes(e.renamed("TRUSTED_PROXY_CIDRS", "TRUSTED_PROXIES")),
+		AccessLogExclude: e.list("ACCESS_LOG_EXCLUDE", defaultAccessLogSkip),
+
+		CORSAllowedOrigins:   e.list("CORS_ALLOWED_ORIGINS", ""),
+		CORSAllowedMethods:   e.list("CORS_ALLOWED_METHODS", defaultCORSMethods),
+		CORSAllowedHeaders:   e.list("CORS_ALLOWED_HEADERS", defaultCORSHeaders),
+		CORSAllowCredentials: e.boolean("CORS_ALLOW_CREDENTIALS", false),
+		CORSMaxAge:           e.duration("CORS_MAX_AGE", defaultCORSMaxAge),
+
+		ContentTypeOptions:       e.optional("SECURITY_CONTENT_TYPE_OPTIONS", "nosniff"),
+		FrameOptions:             e.optional("SECURITY_FRAME_OPTIONS", "DENY"),
+		ReferrerPolicy:           e.optional("SECURITY_REFERRER_POLICY", defaultReferrerPolicy),
+		ContentSecurityPolicy:    e.str("SECURITY_CSP", ""),
+		StrictTransportSecurity:  e.optional("SECURITY_HSTS", defaultHSTS),
+		SecurityHeaderExceptions: e.headerExceptions("SECURITY_HEADER_EXCEPTIONS"),
+
+		CompressMinBytes: e.integer("COMPRESS_MIN_BYTES", defaultCompressMin),
+		CompressExclude:  e.list("COMPRESS_EXCLUDE", ""),
+
+		MaxBodyBytes: e.integer("MAX_BODY_BYTES", defaultMaxBodyBytes),
+		BulkMaxItems: e.integer("BULK_MAX_ITEMS", defaultBulkMaxItems),
+		BulkMaxBytes: e.integer("BULK_MAX_BYTES", defaultBulkMaxBytes),
+
+		ReadHeaderTimeout: e.duration("HTTP_READ_HEADER_TIMEOUT", defaultReadHeaderTime),
+		ReadTimeout:       e.duration("HTTP_READ_TIMEOUT", defaultReadTimeout),
+		WriteTimeout:      e.duration("HTTP_WRITE_TIMEOUT", defaultWriteTimeout),
+		IdleTimeout:       e.duration("HTTP_IDLE_TIMEOUT", defaultIdleTimeout),
+
+		ShutdownTimeout:         e.duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		PreStopDelay:            e.duration("PRE_STOP_DELAY", defaultPreStopDelay),
+		RequestTimeout:          e.duration("REQUEST_TIMEOUT", defaultRequestTimeout),
+		MaxInFlight:             e.integer("MAX_IN_FLIGHT", 0),
+		MaxInFlightWait:         e.duration("MAX_IN_FLIGHT_WAIT", defaultInFlightWait),
+		WSMaxConnections:        e.integer("WS_MAX_CONNECTIONS", defaultWSConnections),
+		BreakerThreshold:        e.integer("CIRCUIT_BREAKER_THRESHOLD", defaultBreakerFailures),
+		BreakerCooldown:         e.duration("CIRCUIT_BREAKER_COOLDOWN", defaultBreakerCooldown),
+		HealthCheckTimeout:      e.duration("HEALTH_CHECK_TIMEOUT", defaultHealthTimeout),
+		HealthCacheTTL:          e.duration("HEALTH_CACHE_TTL", defaultHealthCacheTTL),
+		ProductsCacheTTL:        e.duration("PRODUCTS_CACHE_TTL", defaultProductsTTL),
+		ProductsStaleTTL:        e.duration("PRODUCTS_STALE_TTL", defaultStaleTTL),
+		ProductsMissingTTL:      e.duration("PRODUCTS_NEGATIVE_CACHE_TTL", defaultMissingTTL),
+		CacheTTLJitter:          e.integer("CACHE_TTL_JITTER_PERCENT", defaultCacheTTLJitter),
+		CacheSerialization:      e.str("CACHE_SERIALIZATION", cacheJSON),
+		CacheCompression:        e.str("CACHE_COMPRESSION", cacheUncompressed),
+		CacheCompressMinBytes:   e.integer("CACHE_COMPRESS_MIN_BYTES", defaultCacheMinBytes),
+		ProductsRefreshInterval: e.duration("PRODUCTS_REFRESH_INTERVAL", defaultRefreshInterval),
+		ProductsNotifyChannel:   e.optional("PRODUCTS_NOTIFY_CHANNEL", defaultNotifyChannel),
+		ResponseCacheRoutes:     e.list("RESPONSE_CACHE_ROUTES", ""),
+		ResponseCacheTTL:        e.duration("RESPONSE_CACHE_TTL", defaultResponseTTL),
+		StockReconcileInterval:  e.duration("STOCK_RECONCILE_INTERVAL", defaultStockReconcile),
+		ProductPurgeAfter:       e.duration("PRODUCT_PURGE_AFTER", defaultPurgeAfter),
+		ProductPurgeInterval:    e.duration("PRODUCT_PURGE_INTERVAL", defaultPurgeInterval),
+		FlagsRefresh:            e.duration("FLAGS_REFRESH_INTERVAL", flags.DefaultRefresh),
+		EventsPublisher:         e.str("EVENTS_PUBLISHER", ""),
+		EventsTopic:             e.str("EVENTS_TOPIC", defaultEventsTopic),
+		EventsStreamMaxLen:      e.integer("EVENTS_STREAM_MAX_LEN", defaultEventsMaxLen),
+		KafkaBrokers:            e.list("KAFKA_BROKERS", ""),
+		OutboxRelayInterval:     e.duration("OUTBOX_RELAY_INTERVAL", defaultOutboxInterval),
+		WebhookTimeout:          e.duration("WEBHOOK_TIMEOUT", defaultWebhookTimeout),
+		WebhookMaxAttempts:      e.integer("WEBHOOK_MAX_ATTEMPTS", defaultWebhookAttempts),
+		WebhookPollInterval:     e.duration("WEBHOOK_POLL_INTERVAL", defaultWebhookPoll),
+		IdempotencyTTL:          e.duration("IDEMPOTENCY_TTL", defaultIdempotencyTTL),
+		SessionTTL:              e.duration("SESSION_TTL", defaultSessionTTL),
+		CartTTL:                 e.duration("CART_TTL", defaultCartTTL),
+		CartCookieSecret:        e.str("CART_COOKIE_SECRET", ""),
+		PasswordResetTTL:        e.duration("PASSWORD_RESET_TTL", defaultPasswordReset),
+		SMTPAddr:                e.str("SMTP_ADDR", ""),
+		SMTPFrom:                e.str("SMTP_FROM", ""),
+		SMTPUsername:            e.str("SMTP_USERNAME", ""),
+		SMTPPassword:            e.str("SMTP_PASSWORD", ""),
+		MaintenanceCacheTTL:     e.duration("MAINTENANCE_CACHE_TTL", defaultMaintenanceTTL),
+		BcryptCost:              e.integer("BCRYPT_COST", bcrypt.DefaultCost),
+
+		LoginMaxAttempts:   e.integer("LOGIN_MAX_ATTEMPTS", defaultLoginAttempts),
+		LoginLockoutWindow: e.duration("LOGIN_LOCKOUT_WINDOW", defaultLoginWindow),
+		RateLimits:         e.rateLimits("RATE_LIMITS", "RATE_LIMITS_FILE"),
+
+		JWTSigningKey:     e.str("JWT_SIGNING_KEY", ""),
+		JWTPrivateKeyFile: e.str("JWT_PRIVATE_KEY_FILE", ""),
+		JWTIssuer:         e.str("JWT_ISSUER", defaultJWTIssuer),
+		JWTTTL:            e.duration("JWT_TTL", defaultJWTTTL),
+
+		DBConnect:    e.connectBackoff("DB"),
+		RedisConnect: e.connectBackoff("REDIS"),
+	}
+
+	// initLog has already warned about an invalid LOG_LEVEL and fallen
+	// back to info.
+	cfg.LogLevel, _ = parseLogLevel(e.str("LOG_LEVEL", ""))
+
+	if !slices.Contains(sslModes, cfg.DBSSLMode) {
+		e.invalid("DB_SSLMODE", fmt.Sprintf("%q is not one of %s", cfg.DBSSLMode, strings.Join(sslModes, ", ")))
+	}
+	if cfg.DatabaseURL != "" {
+		u, err := url.Parse(cfg.DatabaseURL)
+		if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			// Not quoted: the URL may hold the password.
+			e.invalid("DATABASE_URL", "must be a postgres:// or postgresql:// URL")
+		} else {
+			cfg.describeDatabaseURL(u)
+		}
+	}
+	switch cfg.RedisMode {
+	case redisSingle:
+	case redisSentinel:
+		if len(cfg.RedisSentinelAddrs) == 0 || cfg.RedisMasterName == "" {
+			e.invalid("REDIS_MODE", "sentinel mode requires REDIS_SENTINEL_ADDRS and REDIS_MASTER_NAME")
+		}
+	case redisCluster:
+		if len(cfg.RedisClusterAddrs) == 0 {
+			e.invalid("REDIS_MODE", "cluster mode requires REDIS_CLUSTER_ADDRS")
+		}
+		if cfg.RedisDB != 0 {
+			e.invalid("REDIS_DB", "must be 0 in cluster mode")
+		}
+	default:
+		e.invalid("REDIS_MODE", fmt.Sprintf("%q is not single, sentinel or cluster", cfg.RedisMode))
+	}
+	if cfg.RedisURL != "" && cfg.RedisMode != redisSingle {
+		e.invalid("REDIS_URL", "only applies in single mode")
+	} else if cfg.RedisURL != "" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			// Not quoted: the URL may hold the password.
+			e.invalid("REDIS_URL", "must be a redis:// or rediss:// URL with an optional /db index")
+		} else {
+			cfg.describeRedisOptions(opts)
+		}
+	}
+	if cfg.RedisDB < 0 {
+		e.invalid("REDIS_DB", "must not be negative")
+	}
+	if cfg.RedisTLSCAFile != "" && !cfg.RedisTLSEnabled {
+		e.invalid("REDIS_TLS_CA_FILE", "requires REDIS_TLS_ENABLED or a rediss:// REDIS_URL")
+	}
+	if cfg.RedisPoolSize < 0 {
+		e.invalid("REDIS_POOL_SIZE", "must not be negative")
+	}
+	if cfg.RedisMinIdleConns < 0 {
+		e.invalid("REDIS_MIN_IDLE_CONNS", "must not be negative")
+	}
+	if cfg.DBMaxOpenConns < 1 {
+		e.invalid("DB_MAX_OPEN_CONNS", "must be at least 1")
+	}
+	if cfg.DBMaxIdleConns < 0 || cfg.DBMaxIdleConns > cfg.DBMaxOpenConns {
+		e.invalid("DB_MAX_IDLE_CONNS", "must be between 0 and DB_MAX_OPEN_CONNS")
+	}
+	if cfg.DBStatementTimeout > 0 && cfg.DBStatementTimeout < time.Millisecond {
+		e.invalid("DB_STATEMENT_TIMEOUT", "must be 0 or at least 1ms")
+	}
+	if (cfg.MetricsBasicAuthUser == "") != (cfg.MetricsBasicAuthPass == "") {
+		e.invalid("METRICS_BASIC_AUTH_USER", "METRICS_BASIC_AUTH_USER and METRICS_BASIC_AUTH_PASS must be set together")
+	}
+	if cfg.SentryDSN != "" {
+		if _, _, err := parseSentryDSN(cfg.SentryDSN); err != nil {
+			// Not quoted: the DSN holds the project key.
+			e.invalid("SENTRY_DSN", err.Error())
+		}
+	}
+	if cfg.ErrorWebhookURL != "" {
+		if u, err := url.Parse(cfg.ErrorWebhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			e.invalid("ERROR_WEBHOOK_URL", "must be an http:// or https:// URL")
+		}
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		e.invalid("TLS_CERT_FILE", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		e.invalid("TLS_CLIENT_CA_FILE", "requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if cfg.CORSAllowCredentials && slices.Contains(cfg.CORSAllowedOrigins, "*") {
+		e.invalid("CORS_ALLOW_CREDENTIALS", `cannot be combined with CORS_ALLOWED_ORIGINS="*"; list the origins`)
+	}
+	if cfg.PaymentWebhookTolerance <= 0 {
+		e.invalid("PAYMENT_WEBHOOK_TOLERANCE", "must be greater than zero")
+	}
+	if cfg.CompressMinBytes < 0 {
+		e.invalid("COMPRESS_MIN_BYTES", "must not be negative")
+	}
+	if cfg.MaxBodyBytes < 1 {
+		e.invalid("MAX_BODY_BYTES", "must be positive")
+	}
+	for _, route := range cfg.ResponseCacheRoutes {
+		if !strings.HasPrefix(route, "/") {
+			e.invalid("RESPONSE_CACHE_ROUTES", fmt.Sprintf("route %q must start with /", route))
+		}
+	}
+	switch cfg.EventsPublisher {
+	case "", eventsRedis:
+	case eventsKafka:
+		if len(cfg.KafkaBrokers) == 0 {
+			e.invalid("KAFKA_BROKERS", "must be set when EVENTS_PUBLISHER is kafka")
+		}
+	default:
+		e.invalid("EVENTS_PUBLISHER", fmt.Sprintf("%q is not redis or kafka", cfg.EventsPublisher))
+	}
+	if cfg.EventsStreamMaxLen < 0 {
+		e.invalid("EVENTS_STREAM_MAX_LEN", "must not be negative")
+	}
+	if cfg.EventsPublisher != "" && cfg.OutboxRelayInterval <= 0 {
+		e.invalid("OUTBOX_RELAY_INTERVAL", "must be greater than zero")
+	}
+	if cfg.WebhookTimeout <= 0 {
+		e.invalid("WEBHOOK_TIMEOUT", "must be greater than zero")
+	}
+	if cfg.WebhookMaxAttempts < 1 {
+		e.invalid("WEBHOOK_MAX_ATTEMPTS", "must be at least 1")
+	}
+	if cfg.WebhookPollInterval <= 0 {
+		e.invalid("WEBHOOK_POLL_INTERVAL", "must be greater than zero")
+	}
+	if cfg.ProductPurgeAfter > 0 && cfg.ProductPurgeInterval <= 0 {
+		e.invalid("PRODUCT_PURGE_INTERVAL", "must be greater than zero when PRODUCT_PURGE_AFTER is set")
+	}
+	if cfg.MaxInFlight < 0 {
+		e.invalid("MAX_IN_FLIGHT", "must not be negative")
+	}
+	if cfg.BasePath != "" && (!strings.HasPrefix(cfg.BasePath, "/") || strings.HasSuffix(cfg.BasePath, "/") || strings.ContainsAny(cfg.BasePath, "{} ")) {
+		e.invalid("BASE_PATH", fmt.Sprintf("%q must start with / and not end with one", cfg.BasePath))
+	}
+	if cfg.WSMaxConnections < 1 {
+		e.invalid("WS_MAX_CONNECTIONS", "must be positive")
+	}
+	if cfg.BreakerThreshold < 0 {
+		e.invalid("CIRCUIT_BREAKER_THRESHOLD", "must not be negative")
+	}
+	if cfg.BreakerThreshold > 0 && cfg.BreakerCooldown <= 0 {
+		e.invalid("CIRCUIT_BREAKER_COOLDOWN", "must be positive")
+	}
+	if cfg.BulkMaxItems < 1 {
+		e.invalid("BULK_MAX_ITEMS", "must be positive")
+	}
+	if cfg.BulkMaxBytes < 1 {
+		e.invalid("BULK_MAX_BYTES", "must be positive")
+	}
+	if cfg.ShutdownTimeout == 0 {
+		e.invalid("SHUTDOWN_TIMEOUT", "must be greater than zero")
+	}
+	if cfg.SessionTTL == 0 {
+		e.invalid("SESSION_TTL", "must be greater than zero")
+	}
+	if cfg.CartTTL == 0 {
+		e.invalid("CART_TTL", "must be greater than zero")
+	}
+	if cfg.PasswordResetTTL == 0 {
+		e.invalid("PASSWORD_RESET_TTL", "must be greater than zero")
+	}
+	if cfg.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddr); err != nil {
+			e.invalid("SMTP_ADDR", "must be host:port")
+		}
+		if a, err := mail.ParseAddress(cfg.SMTPFrom); err != nil || a.Address != cfg.SMTPFrom {
+			e.invalid("SMTP_FROM", "must be an email address when SMTP_ADDR is set")
+		}
+	}
+	if (cfg.SMTPUsername == "") != (cfg.SMTPPassword == "") {
+		e.invalid("SMTP_USERNAME", "SMTP_USERNAME and SMTP_PASSWORD must be set together")
+	}
+
+	if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+		e.invalid("BCRYPT_COST", fmt.Sprintf("must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	if cfg.LoginMaxAttempts < 0 {
+		e.invalid("LOGIN_MAX_ATTEMPTS", "must not be negative")
+	}
+	if cfg.LoginMaxAttempts > 0 && cfg.LoginLockoutWindow == 0 {
+		e.invalid("LOGIN_LOCKOUT_WINDOW", "must be greater than zero")
+	}
+	if cfg.CacheTTLJitter < 0 || cfg.CacheTTLJitter > 50 {
+		e.invalid("CACHE_TTL_JITTER_PERCENT", "must be between 0 and 50")
+	}
+	if cfg.CacheSerialization != cacheJSON && cfg.CacheSerialization != cacheMsgpack {
+		e.invalid("CACHE_SERIALIZATION", fmt.Sprintf("%q is not json or msgpack", cfg.CacheSerialization))
+	}
+	switch cfg.CacheCompression {
+	case cacheUncompressed, cacheGzip, cacheSnappy:
+	default:
+		e.invalid("CACHE_COMPRESSION", fmt.Sprintf("%q is not none, gzip or snappy", cfg.CacheCompression))
+	}
+	if cfg.CacheCompressMinBytes < 0 {
+		e.invalid("CACHE_COMPRESS_MIN_BYTES", "must not be negative")
+	}
+	if cfg.JWTSigningKey != "" && cfg.JWTPrivateKeyFile != "" {
+		e.invalid("JWT_PRIVATE_KEY_FILE", "cannot be combined with JWT_SIGNING_KEY")
+	}
+	if cfg.JWTTTL == 0 {
+		e.invalid("JWT_TTL", "must be greater than zero")
+	}
+
+	if err := e.err(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// describeDatabaseURL sets the DB_* fields that name the database from u,
+// so that logs and metrics agree with the URL actually used.
+func (c *Config) describeDatabaseURL(u *url.URL) {
+	c.DBHost = u.Hostname()
+	c.DBPort = cmp.Or(u.Port(), "5432")
+	c.DBUser = u.User.Username()
+	c.DBPassword = ""
+	c.DBName = strings.TrimPrefix(u.Path, "/")
+}
+
+// describeRedisOptions sets the Redis connection fields from opts, parsed
+// from RedisURL, so that logs agree with the URL actually used.
+func (c *Config) describeRedisOptions(opts *redis.Options) {
+	c.RedisHost, c.RedisPort, _ = net.SplitHostPort(opts.Addr)
+	c.RedisUsername = opts.Username
+	c.RedisPassword = ""
+	c.RedisDB = opts.DB
+	c.RedisTLSEnabled = opts.TLSConfig != nil
+}
+
+// LogValue renders the Config for the startup log with secrets masked.
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("db_host", c.DBHost),
+		slog.String("db_port", c.DBPort),
+		slog.String("db_user", c.DBUser),
+		slog.String("db_password", redact(c.DBPassword)),
+		slog.String("db_name", c.DBName),
+		slog.String("db_sslmode", c.DBSSLMode),
+		slog.String("database_url", redactURL(c.DatabaseURL)),
+		slog.Int("db_max_open_conns", c.DBMaxOpenConns),
+		slog.Int("db_max_idle_conns", c.DBMaxIdleConns),
+		slog.Duration("db_conn_max_lifetime", c.DBConnMaxLifetime),
+		slog.Duration("db_query_timeout", c.DBQueryTimeout),
+		slog.Duration("db_statement_timeout", c.DBStatementTimeout),
+		slog.String("db_replica_host", c.DBReplicaHost),
+		slog.String("db_replica_port", c.DBReplicaPort),
+		slog.Duration("db_replica_retry_interval", c.DBReplicaRetryInterval),
+		slog.Bool("migrations_disabled", c.MigrationsDisabled),
+		slog.String("redis_mode", c.RedisMode),
+		slog.String("redis_host", c.RedisHost),
+		slog.String("redis_port", c.RedisPort),
+		slog.Any("redis_sentinel_addrs", c.RedisSentinelAddrs),
+		slog.String("redis_master_name", c.RedisMasterName),
+		slog.Any("redis_cluster_addrs", c.RedisClusterAddrs),
+		slog.String("redis_username", c.RedisUsername),
+		slog.String("redis_password", redact(c.RedisPassword)),
+		slog.Int("redis_db", c.RedisDB),
+		slog.Bool("redis_tls_enabled", c.RedisTLSEnabled),
+		slog.String("redis_tls_ca_file", c.RedisTLSCAFile),
+		slog.Int("redis_pool_size", c.RedisPoolSize),
+		slog.Int("redis_min_idle_conns", c.RedisMinIdleConns),
+		slog.String("redis_key_prefix", c.RedisKeyPrefix),
+		slog.String("redis_url", redactURL(c.RedisURL)),
+		slog.String("http_addr", c.HTTPAddr),
+		slog.String("internal_addr", c.InternalAddr),
+		slog.String("grpc_addr", c.GRPCAddr),
+		slog.String("base_path", c.BasePath),
+		slog.String("legacy_routes_sunset", c.LegacyRoutesSunset.Format(time.DateOnly)),
+		slog.Bool("enable_pprof", c.EnablePprof),
+		slog.String("metrics_auth_token", redact(c.MetricsAuthToken)),
+		slog.String("metrics_basic_auth_user", c.MetricsBasicAuthUser),
+		slog.String("metrics_basic_auth_pass", redact(c.MetricsBasicAuthPass)),
+		slog.String("admin_auth_token", redact(c.AdminAuthToken)),
+		slog.String("payment_webhook_secret", redact(c.PaymentWebhookSecret)),
+		slog.Duration("payment_webhook_tolerance", c.PaymentWebhookTolerance),
+		slog.String("sentry_dsn", redact(c.SentryDSN)),
+		slog.String("error_webhook_url", redact(c.ErrorWebhookURL)),
+		slog.String("tls_cert_file", c.TLSCertFile),
+		slog.String("tls_key_file", c.TLSKeyFile),
+		slog.String("tls_client_ca_file", c.TLSClientCAFile),
+		slog.String("log_level", levelName(c.LogLevel)),
+		slog.Any("trusted_proxies", c.TrustedProxies),
+		slog.Any("access_log_exclude", c.AccessLogExclude),
+		slog.Any("cors_allowed_origins", c.CORSAllowedOrigins),
+		slog.Any("cors_allowed_methods", c.CORSAllowedMethods),
+		slog.Any("cors_allowed_headers", c.CORSAllowedHeaders),
+		slog.Bool("cors_allow_credentials", c.CORSAllowCredentials),
+		slog.Duration("cors_max_age", c.CORSMaxAge),
+		slog.String("security_content_type_options", c.ContentTypeOptions),
+		slog.String("security_frame_options", c.FrameOptions),
+		slog.String("security_referrer_policy", c.ReferrerPolicy),
+		slog.String("security_csp", c.ContentSecurityPolicy),
+		slog.String("security_hsts", c.StrictTransportSecurity),
+		slog.Any("security_header_exceptions", c.SecurityHeaderExceptions),
+		slog.Int("compress_min_bytes", c.CompressMinBytes),
+		slog.Any("compress_exclude", c.CompressExclude),
+		slog.Int("max_body_bytes", c.MaxBodyBytes),
+		slog.Int("bulk_max_items", c.BulkMaxItems),
+		slog.Int("bulk_max_bytes", c.BulkMaxBytes),
+		slog.Duration("http_read_header_timeout", c.ReadHeaderTimeout),
+		slog.Duration("http_read_timeout", c.ReadTimeout),
+		slog.Duration("http_write_timeout", c.WriteTimeout),
+		slog.Duration("http_idle_timeout", c.IdleTimeout),
+		slog.Duration("shutdown_timeout", c.ShutdownTimeout),
+		slog.Duration("pre_stop_delay", c.PreStopDelay),
+		slog.Duration("request_timeout", c.RequestTimeout),
+		slog.Int("max_in_flight", c.MaxInFlight),
+		slog.Duration("max_in_flight_wait", c.MaxInFlightWait),
+		slog.Int("ws_max_connections", c.WSMaxConnections),
+		slog.Int("circuit_breaker_threshold", c.BreakerThreshold),
+		slog.Duration("circuit_breaker_cooldown", c.BreakerCooldown),
+		slog.Duration("health_check_timeout", c.HealthCheckTimeout),
+		slog.Duration("health_cache_ttl", c.HealthCacheTTL),
+		slog.Duration("products_cache_ttl", c.ProductsCacheTTL),
+		slog.Duration("products_stale_ttl", c.ProductsStaleTTL),
+		slog.Duration("products_negative_cache_ttl", c.ProductsMissingTTL),
+		slog.Int("cache_ttl_jitter_percent", c.CacheTTLJitter),
+		slog.String("cache_serialization", c.CacheSerialization),
+		slog.String("cache_compression", c.CacheCompression),
+		slog.Int("cache_compress_min_bytes", c.CacheCompressMinBytes),
+		slog.Duration("products_refresh_interval", c.ProductsRefreshInterval),
+		slog.Duration("stock_reconcile_interval", c.StockReconcileInterval),
+		slog.Duration("product_purge_after", c.ProductPurgeAfter),
+		slog.Duration("product_purge_interval", c.ProductPurgeInterval),
+		slog.Duration("flags_refresh_interval", c.FlagsRefresh),
+		slog.String("events_publisher", c.EventsPublisher),
+		slog.String("events_topic", c.EventsTopic),
+		slog.Int("events_stream_max_len", c.EventsStreamMaxLen),
+		slog.Any("kafka_brokers", c.KafkaBrokers),
+		slog.Duration("outbox_relay_interval", c.OutboxRelayInterval),
+		slog.Duration("webhook_timeout", c.WebhookTimeout),
+		slog.Int("webhook_max_attempts", c.WebhookMaxAttempts),
+		slog.Duration("webhook_poll_interval", c.WebhookPollInterval),
+		slog.String("products_notify_channel", c.ProductsNotifyChannel),
+		slog.Any("response_cache_routes", c.ResponseCacheRoutes),
+		slog.Duration("response_cache_ttl", c.ResponseCacheTTL),
+		slog.Duration("idempotency_ttl", c.IdempotencyTTL),
+		slog.Duration("session_ttl", c.SessionTTL),
+		slog.Duration("cart_ttl", c.CartTTL),
+		slog.String("cart_cookie_secret", redact(c.CartCookieSecret)),
+		slog.Duration("password_reset_ttl", c.PasswordResetTTL),
+		slog.String("smtp_addr", c.SMTPAddr),
+		slog.String("smtp_from", c.SMTPFrom),
+		slog.String("smtp_username", c.SMTPUsername),
+		slog.String("smtp_password", redact(c.SMTPPassword)),
+		slog.Duration("maintenance_cache_ttl", c.MaintenanceCacheTTL),
+		slog.Int("bcrypt_cost", c.BcryptCost),
+		slog.Int("login_max_attempts", c.LoginMaxAttempts),
+		slog.Duration("login_lockout_window", c.LoginLockoutWindow),
+		slog.Bool("rate_limits", c.RateLimits.enabled()),
+		slog.String("jwt_signing_key", redact(c.JWTSigningKey)),
+		slog.String("jwt_private_key_file", c.JWTPrivateKeyFile),
+		slog.String("jwt_issuer", c.JWTIssuer),
+		slog.Duration("jwt_ttl", c.JWTTTL),
+		slog.Int("db_connect_retries", c.DBConnect.Attempts),
+		slog.Duration("db_connect_timeout", c.DBConnect.Timeout),
+		slog.Int("redis_connect_retries", c.RedisConnect.Attempts),
+		slog.Duration("redis_connect_timeout", c.RedisConnect.Timeout),
+	)
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "****"
+}
+
+// redactURL masks the password in a URL, or the whole value if it does not
+// parse.
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return redact(v)
+	}
+	return u.Redacted()
+}
+
+// envReader parses environment variables, collecting every problem so they
+// can be reported together.
+type envReader struct {
+	lookup  func(string) (string, bool)
+	missing []string
+	errs    []error
+}
+
+func (e *envReader) str(key, def string) string {
+	if v, ok := e.lookup(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// optional is like str, but an explicitly empty value is kept rather than
+// replaced by def.
+func (e *envReader) optional(key, def string) string {
+	if v, ok := e.lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+// list splits a comma-separated value. Like optional, an explicitly empty
+// value yields no entries rather than def.
+func (e *envReader) list(key, def string) []string {
+	var out []string
+	for _, v := range strings.Split(e.optional(key, def), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// renamed returns key, or old, the variable's former name, when only that
+// is set, so that existing deployments keep working.
+func (e *envReader) renamed(key, old string) string {
+	if _, ok := e.lookup(key); !ok {
+		if _, ok := e.lookup(old); ok {
+			return old
+		}
+	}
+	return key
+}
+
+// prefixes parses a comma-separated list of CIDRs. A bare address is taken
+// as a single-host prefix.
+func (e *envReader) prefixes(key string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, v := range e.list(key, "") {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(v)
+			if addrErr != nil {
+				e.invalid(key, fmt.Sprintf("%q is not a CIDR or IP address", v))
+				continue
+			}
+			p = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		out = append(out, p.Masked())
+	}
+	return out
+}
+
+// rateLimits parses the RATE_LIMITS in key or, when set instead, in the
+// file named by fileKey.
+func (e *envReader) rateLimits(key, fileKey string) rateLimits {
+	data, path := e.str(key, ""), e.str(fileKey, "")
+	switch {
+	case data != "" && path != "":
+		e.invalid(fileKey, "cannot be combined with "+key)
+		return rateLimits{}
+	case path != "":
+		b, err := os.ReadFile(path)
+		if err != nil {
+			e.invalid(fileKey, err.Error())
+			return rateLimits{}
+		}
+		data, key = string(b), fileKey
+	case data == "":
+		return rateLimits{}
+	}
+	l, err := parseRateLimits([]byte(data))
+	if err != nil {
+		e.invalid(key, err.Error())
+	}
+	return l
+}
+
+// headerExceptions parses a comma-separated list of route:Header pairs,
+// such as "/docs:X-Frame-Options", into the headers to omit per route.
+func (e *envReader) headerExceptions(key string) map[string][]string {
+	out := make(map[string][]string)
+	for _, v := range e.list(key, "") {
+		route, header, ok := strings.Cut(v, ":")
+		route, header = strings.TrimSpace(route), strings.TrimSpace(header)
+		if !ok || route == "" || header == "" {
+			e.invalid(key, fmt.Sprintf("%q is not a route:Header pair", v))
+			continue
+		}
+		out[route] = append(out[route], http.CanonicalHeaderKey(header))
+	}
+	return out
+}
+
+func (e *envReader) required(key string) string {
+	v := e.str(key, "")
+	if v == "" {
+		e.missing = append(e.missing, key)
+	}
+	return v
+}
+
+func (e *envReader) port(key, def string) string {
+	v := e.str(key, def)
+	if n, err := strconv.Atoi(v); err != nil || n < 1 || n > 65535 {
+		e.invalid(key, fmt.Sprintf("%q is not a valid port", v))
+	}
+	return v
+}
+
+func (e *envReader) duration(key string, def time.Duration) time.Duration {
+	v := e.str(key, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		e.invalid(key, fmt.Sprintf("%q is not a non-negative duration", v))
+		return def
+	}
+	return d
+}
+
+func (e *envReader) integer(key string, def int) int {
+	v := e.str(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.invalid(key, fmt.Sprintf("%q is not an integer", v))
+		return def
+	}
+	return n
+}
+
+// date parses a YYYY-MM-DD date, as midnight UTC.
+func (e *envReader) date(key, def string) time.Time {
+	v := e.str(key, def)
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		e.invalid(key, fmt.Sprintf("%q is not a YYYY-MM-DD date", v))
+	}
+	return t
+}
+
+func (e *envReader) boolean(key string, def bool) bool {
+	v := e.str(key, "")
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.invalid(key, fmt.Sprintf("%q is not a boolean", v))
+		return def
+	}
+	return b
+}
+
+// connectBackoff reads <prefix>_CONNECT_RETRIES and <prefix>_CONNECT_TIMEOUT.
+func (e *envReader) connectBackoff(prefix string) backoff {
+	attempts := e.integer(prefix+"_CONNECT_RETRIES", defaultConnectRetries)
+	if attempts < 1 {
+		e.invalid(prefix+"_CONNECT_RETRIES", "must be at least 1")
+	}
+	return backoff{
+		Attempts: attempts,
+		Timeout:  e.duration(prefix+"_CONNECT_TIMEOUT", defaultConnectTimeout),
+		BaseWait: defaultConnectBaseWait,
+		MaxWait:  defaultConnectMaxWait,
+	}
+}
+
+func (e *envReader) invalid(key, reason string) {
+	e.errs = append(e.errs, fmt.Errorf("invalid env %s: %s", key, reason))
+}
+
+func (e *envReader) err() error {
+	errs := e.errs
+	if len(e.missing) > 0 {
+		sort.Strings(e.missing)
+		errs = append([]error{fmt.Errorf("missing required env %s", strings.Join(e.missing, ", "))}, errs...)
+	}
+	return errors.Join(errs...)
+}
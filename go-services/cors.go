@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// withCORS adds CORS headers for the origins in CORSAllowedOrigins and
+// answers preflight requests itself, before routing, so they never reach the
+// route middlewares or a 405 handler. Requests from other origins get no
+// CORS headers, which makes the browser refuse them, rather than an error.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	if len(s.cfg.CORSAllowedOrigins) == 0 {
+		return next
+	}
+	wildcard := slices.Contains(s.cfg.CORSAllowedOrigins, "*")
+	methods := strings.Join(s.cfg.CORSAllowedMethods, ", ")
+	headers := strings.Join(s.cfg.CORSAllowedHeaders, ", ")
+	maxAge := strconv.Itoa(int(s.cfg.CORSMaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		if !wildcard {
+			h.Add("Vary", "Origin")
+		}
+		allowed := origin != "" && (wildcard || slices.Contains(s.cfg.CORSAllowedOrigins, origin))
+		if allowed {
+			if wildcard && !s.cfg.CORSAllowCredentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if s.cfg.CORSAllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed {
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			if s.cfg.CORSMaxAge > 0 {
+				h.Set("Access-Control-Max-Age", maxAge)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
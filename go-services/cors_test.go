@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newCORSTestServer(t *testing.T, origins ...string) *Server {
+	t.Helper()
+	s, _, _ := newTestServer(t)
+	s.cfg.CORSAllowedOrigins = origins
+	s.cfg.CORSAllowedMethods = []string{"GET", "POST"}
+	s.cfg.CORSAllowedHeaders = []string{"Authorization", "Content-Type"}
+	s.cfg.CORSMaxAge = 10 * time.Minute
+	return s
+}
+
+func preflight(s *Server, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodOptions, "/products", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestCORS_PreflightAllowed(t *testing.T) {
+	t.Parallel()
+	s := newCORSTestServer(t, "https://shop.example")
+
+	w := preflight(s, "https://shop.example")
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://shop.example",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("expected no credentials header, got %q", got)
+	}
+	// The preflight never reached the routed handlers or their metrics.
+	if n := testutil.CollectAndCount(s.metrics.httpRequestCount); n != 0 {
+		t.Errorf("expected no request metrics for a preflight, got %d series", n)
+	}
+}
+
+func TestCORS_PreflightDenied(t *testing.T) {
+	t.Parallel()
+	s := newCORSTestServer(t, "https://shop.example")
+
+	w := preflight(s, "https://evil.example")
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	for _, k := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods", "Access-Control-Allow-Headers"} {
+		if got := w.Header().Get(k); got != "" {
+			t.Errorf("expected no %s for a foreign origin, got %q", k, got)
+		}
+	}
+}
+
+func TestCORS_SimpleRequest(t *testing.T) {
+	t.Parallel()
+	s := newCORSTestServer(t, "https://shop.example")
+	s.cfg.CORSAllowCredentials = true
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://shop.example")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the handler to run, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://shop.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "" {
+		t.Errorf("expected preflight headers only on preflights, got %q", got)
+	}
+}
+
+func TestCORS_WildcardAndDisabled(t *testing.T) {
+	t.Parallel()
+
+	s := newCORSTestServer(t, "*")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://anyone.example")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("wildcard: Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := w.Header().Get("Vary"); got == "Origin" {
+		t.Errorf("wildcard: responses do not vary by origin, got Vary %q", got)
+	}
+
+	// Without configured origins an OPTIONS request is routed as usual.
+	s = newCORSTestServer(t)
+	if w := preflight(s, "https://shop.example"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("disabled: expected 405, got %d", w.Code)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "net/http"
+
+// Drain marks the server as shutting down: readiness fails at once, without
+// checking dependencies, and responses other than the probes close their
+// connection so that keep-alive clients reconnect to another pod. It is
+// called when shutdown begins, PreStopDelay before the listeners close.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// drainingReadiness is the readiness reported while draining.
+func drainingReadiness() healthResponse {
+	return healthResponse{Status: "unavailable", Checks: map[string]checkResult{"shutdown": {Status: "draining"}}}
+}
+
+// withDraining asks clients to close the connection once Drain was called,
+// except on the probe routes.
+func (s *Server) withDraining(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() && !probeRoutes[s.routeLabel(r)] {
+			w.Header().Set("Connection", "close")
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDrain_FailsReadinessWithoutChecks(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	s.Drain()
+
+	w := httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if body := decodeHealth(t, w); body.Checks["shutdown"].Status != "draining" {
+		t.Errorf("expected the shutdown reported, got %+v", body)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected DB call: %v", err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected Redis call: %v", err)
+	}
+}
+
+func TestDrain_ClosesConnectionsExceptProbes(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	h := s.Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if got := w.Header().Get("Connection"); got != "" {
+		t.Errorf("expected keep-alive before draining, got Connection %q", got)
+	}
+
+	s.Drain()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Connection") != "close" {
+		t.Errorf("expected 200 with Connection: close while draining, got %d %q", w.Code, w.Header().Get("Connection"))
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if got := w.Header().Get("Connection"); got != "" {
+		t.Errorf("expected the probe left alone, got Connection %q", got)
+	}
+}
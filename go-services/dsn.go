@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// sslModes are the DB_SSLMODE values lib/pq supports.
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// postgresDSN returns the lib/pq connection string for the primary: the
+// DATABASE_URL when one is set, otherwise one built from the DB_* settings.
+func postgresDSN(cfg Config) string {
+	var dsn string
+	if cfg.DatabaseURL != "" {
+		// loadConfig has already rejected URLs that do not parse.
+		dsn, _ = pq.ParseURL(cfg.DatabaseURL)
+	} else {
+		dsn = dsnPairs(
+			"host", cfg.DBHost,
+			"port", cfg.DBPort,
+			"user", cfg.DBUser,
+			"password", cfg.DBPassword,
+			"dbname", cfg.DBName,
+			"sslmode", cfg.DBSSLMode,
+		)
+	}
+	if cfg.DBStatementTimeout > 0 {
+		// lib/pq sends unrecognised keys to the server as session settings.
+		dsn += fmt.Sprintf(" statement_timeout=%d", cfg.DBStatementTimeout.Milliseconds())
+	}
+	return dsn
+}
+
+// replicaDSN returns the lib/pq connection string for the read replica: the
+// primary's, pointed at the replica. lib/pq keeps the last value of a
+// repeated key.
+func replicaDSN(cfg Config) string {
+	return postgresDSN(cfg) + " " + dsnPairs("host", cfg.DBReplicaHost, "port", cfg.DBReplicaPort)
+}
+
+var dsnEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// dsnPairs formats alternating keys and values as a keyword/value
+// connection string. Values are quoted, so spaces, quotes and backslashes
+// in a password survive.
+func dsnPairs(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, kv[i]+"='"+dsnEscaper.Replace(kv[i+1])+"'")
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// etagFor returns a strong ETag for body: a hash of the bytes, so equal
+// responses get equal tags on every replica without any shared state.
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeJSONBodyTagged writes body like writeJSONBody, tagged with etag, or
+// answers 304 with no body when the request's If-None-Match already names
+// it.
+func writeJSONBodyTagged(w http.ResponseWriter, r *http.Request, body []byte, etag string) {
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSONBody(w, body)
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+// As RFC 9110 requires for If-None-Match, the comparison is weak: W/"x"
+// matches "x".
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func getProducts(t *testing.T, s *Server, ifNoneMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/products", nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestProductsHandler_ETag(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testProducts(s).add(testProduct(1, "Product A", 10.99, created))
+
+	first := getProducts(t, s, "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || etag != etagFor(first.Body.Bytes()) {
+		t.Fatalf("expected 200 with the body's ETag, got %d ETag %q", first.Code, etag)
+	}
+
+	w := getProducts(t, s, etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("expected the 304 to repeat ETag %q, got %q", etag, got)
+	}
+	if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues("/products", "GET", "304")); got != 1 {
+		t.Errorf("expected one request counted as 304, got %v", got)
+	}
+
+	if w := getProducts(t, s, `"stale"`); w.Code != http.StatusOK || w.Body.String() != first.Body.String() {
+		t.Errorf("expected a stale tag to get the full body, got %d %q", w.Code, w.Body.String())
+	}
+
+	testProducts(s).add(testProduct(2, "Product B", 5, created))
+	w = getProducts(t, s, etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after a write, got %d", w.Code)
+	}
+	if got := w.Header().Get("ETag"); got == etag {
+		t.Errorf("expected the ETag to change after a write, still %q", got)
+	}
+}
+
+func TestProductsHandler_CacheHitAnswersConditionally(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	cached := `{"items":[],"total":0,"limit":50,"offset":0}`
+	etag := etagFor([]byte(cached))
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{cached, etag})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/products", nil)
+	r.Header.Set("If-None-Match", `W/`+etag)
+	s.productsHandler(w, r)
+
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304, got %d %q", w.Code, w.Body.String())
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	t.Parallel()
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`"xyz"`, false},
+		{`abc`, false},
+		{`*`, true},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
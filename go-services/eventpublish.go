@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go-service/publish"
+	"go-service/store"
+)
+
+// Event publishers, as named in EVENTS_PUBLISHER.
+const (
+	eventsRedis = "redis"
+	eventsKafka = "kafka"
+)
+
+// productChangeSchema is the schema_version of the productChange events.
+// It is raised only when a field is removed or changes meaning; consumers
+// ignore fields they do not know.
+const productChangeSchema = 1
+
+const (
+	// publishTimeout bounds each attempt to publish an event, so a broker
+	// outage delays a write by no more than this before the event is left
+	// to the outbox.
+	publishTimeout = 2 * time.Second
+	// outboxBatch is the most events a relay round retries.
+	outboxBatch = 100
+	// outboxRelayLock is taken by the replica relaying the outbox, so that
+	// an event is not published by several at once.
+	outboxRelayLock = "outbox-relay"
+)
+
+// outboxBackoff spaces out the retries of an event that keeps failing.
+var outboxBackoff = backoff{BaseWait: 5 * time.Second, MaxWait: 10 * time.Minute}
+
+// productChange is the event published to EVENTS_PUBLISHER for every
+// product change, keyed by the product id so that the changes to a product
+// stay in order. Data is the product for product.created and
+// product.updated, and only {"id": ...} for product.deleted and for
+// products created by a bulk import, as on the SSE stream. An event retried
+// from the outbox may arrive after a later change to the same product, or
+// twice: consumers should compare OccurredAt and ignore duplicate IDs.
+type productChange struct {
+	SchemaVersion int             `json:"schema_version"`
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	ProductID     int64           `json:"product_id"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// encodeProductChange returns a new productChange event as JSON.
+func encodeProductChange(typ string, id int64, data json.RawMessage) ([]byte, error) {
+	return json.Marshal(productChange{
+		SchemaVersion: productChangeSchema,
+		ID:            uuid.NewString(),
+		Type:          typ,
+		OccurredAt:    time.Now().UTC(),
+		ProductID:     id,
+		Data:          data,
+	})
+}
+
+// newPublisher returns the publisher chosen by cfg.EventsPublisher, or nil
+// when publishing is off. A Redis stream is named with keys, like every
+// other key of the service.
+func newPublisher(cfg Config, rdb redisClient, keys redisKeys) publish.Publisher {
+	switch cfg.EventsPublisher {
+	case eventsRedis:
+		// Every go-redis client has the stream commands, though this release
+		// leaves them out of redis.Cmdable.
+		return publish.NewRedisStream(rdb.(redis.StreamCmdable), keys.eventStream(cfg.EventsTopic), int64(cfg.EventsStreamMaxLen))
+	case eventsKafka:
+		return publish.NewKafka(cfg.KafkaBrokers, cfg.EventsTopic)
+	}
+	return nil
+}
+
+// publishProductChange publishes a committed change to the product with id
+// to EVENTS_PUBLISHER. An event that fails to publish is stored in the
+// outbox for runOutboxRelay to retry; only if that fails too is it lost.
+// Either way the write has succeeded, so nothing is returned.
+func (s *Server) publishProductChange(ctx context.Context, typ string, id int64, data json.RawMessage) {
+	if s.publisher == nil {
+		return
+	}
+	// The client going away must not lose the event.
+	ctx = context.WithoutCancel(ctx)
+	value, err := encodeProductChange(typ, id, data)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to encode product event", "type", typ, "product_id", id, "err", err)
+		return
+	}
+	msg := publish.Message{Key: strconv.FormatInt(id, 10), Value: value}
+
+	pubCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+	err = s.publisher.Publish(pubCtx, msg)
+	cancel()
+	if err == nil {
+		s.metrics.productEvents.WithLabelValues("published").Inc()
+		return
+	}
+	s.metrics.productEvents.WithLabelValues("failed").Inc()
+	s.logger.WarnContext(ctx, "Failed to publish product event; queued for retry", "type", typ, "product_id", id, "err", err)
+
+	if addErr := s.outbox.Add(ctx, store.OutboxEvent{Key: msg.Key, Payload: msg.Value, LastError: err.Error()}); addErr != nil {
+		s.metrics.productEvents.WithLabelValues("lost").Inc()
+		s.logger.ErrorContext(ctx, "Failed to store product event in the outbox", "type", typ, "product_id", id, "err", addErr)
+	}
+}
+
+// runOutboxRelay retries the events in the outbox every interval until ctx
+// is cancelled. Failures are logged and retried on the next tick.
+func (s *Server) runOutboxRelay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := s.relayOutbox(ctx, refreshLockTTL(interval))
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			s.logger.WarnContext(ctx, "Outbox relay failed", "published", n, "err", err)
+		case n > 0:
+			s.logger.InfoContext(ctx, "Outbox events published", "published", n)
+		}
+	}
+}
+
+// relayOutbox publishes the events due for a retry, oldest first, deleting
+// each once it is published. It stops at the first that fails, which is
+// put off by outboxBackoff: the broker is most likely still down, and
+// going on would publish later events ahead of it. It returns how many
+// events were published. Another replica holding the relay lock is not an
+// error; the work is bounded by lockTTL so it cannot outlast the lock.
+func (s *Server) relayOutbox(ctx context.Context, lockTTL time.Duration) (int, error) {
+	if _, err := newRedisLocker(s.rdb, s.keys).Acquire(ctx, outboxRelayLock, lockTTL); err != nil {
+		if errors.Is(err, errLockHeld) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lockTTL)
+	defer cancel()
+	due, err := s.outbox.Due(ctx, outboxBatch)
+	if err != nil {
+		return 0, fmt.Errorf("read outbox: %w", err)
+	}
+
+	var published int
+	for _, ev := range due {
+		pubCtx, cancelPublish := context.WithTimeout(ctx, publishTimeout)
+		err := s.publisher.Publish(pubCtx, publish.Message{Key: ev.Key, Value: ev.Payload})
+		cancelPublish()
+		if err != nil {
+			s.metrics.productEvents.WithLabelValues("failed").Inc()
+			next := time.Now().Add(outboxBackoff.delay(ev.Attempts))
+			if retryErr := s.outbox.Retry(ctx, ev.ID, next, err.Error()); retryErr != nil {
+				err = errors.Join(err, fmt.Errorf("reschedule event %d: %w", ev.ID, retryErr))
+			}
+			return published, fmt.Errorf("publish event %d: %w", ev.ID, err)
+		}
+		s.metrics.productEvents.WithLabelValues("retried").Inc()
+		published++
+		// An event left behind is published again on the next round,
+		// which consumers already have to tolerate.
+		if err := s.outbox.Delete(ctx, ev.ID); err != nil {
+			return published, fmt.Errorf("delete event %d: %w", ev.ID, err)
+		}
+	}
+	return published, nil
+}
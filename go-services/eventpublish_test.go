@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+
+	"go-service/publish"
+)
+
+var testOutboxLockKey = testKeys.lock(outboxRelayLock)
+
+// usePublisher gives s a publisher that fails its first failures calls,
+// and a fake outbox.
+func usePublisher(s *Server, failures int) (*flakyPublisher, *fakeOutbox) {
+	p := &flakyPublisher{failures: failures}
+	s.publisher = p
+	return p, testOutbox(s)
+}
+
+func productEventCount(s *Server, result string) float64 {
+	return testutil.ToFloat64(s.metrics.productEvents.WithLabelValues(result))
+}
+
+func TestCreateProductHandler_PublishesChange(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	p, _ := usePublisher(s, 0)
+
+	r := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(`{"name":"Chair","price":49.5}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.createProductHandler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	sent := p.sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one event published, got %d", len(sent))
+	}
+	var ev map[string]any
+	if err := json.Unmarshal(sent[0].Value, &ev); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ev["data"].(map[string]any)
+	if ev["type"] != eventProductCreated || data["name"] != "Chair" || data["price"] != 49.5 {
+		t.Errorf("expected the created product in the event, got %s", sent[0].Value)
+	}
+	if sent[0].Key != "1" || ev["product_id"] != float64(1) {
+		t.Errorf("expected the event keyed by the product id, got key %q and %s", sent[0].Key, sent[0].Value)
+	}
+	if got := productEventCount(s, "published"); got != 1 {
+		t.Errorf("expected the event counted as published, got %v", got)
+	}
+}
+
+func TestPublishProductChange_PayloadShape(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	p, _ := usePublisher(s, 0)
+
+	redisMock.ExpectPublish(testKeys.productEvents(), []byte(`{"type":"product.deleted","data":{"id":7}}`)).SetVal(1)
+	before := time.Now()
+	s.publishProductEvent(context.Background(), eventProductDeleted, 7, productRef{ID: 7})
+
+	sent := p.sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one event published, got %d", len(sent))
+	}
+	var ev productChange
+	dec := json.NewDecoder(strings.NewReader(string(sent[0].Value)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ev); err != nil {
+		t.Fatalf("unexpected payload %s: %v", sent[0].Value, err)
+	}
+	if ev.SchemaVersion != 1 || ev.Type != eventProductDeleted || ev.ProductID != 7 || string(ev.Data) != `{"id":7}` {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if _, err := uuid.Parse(ev.ID); err != nil {
+		t.Errorf("expected a UUID event id, got %q", ev.ID)
+	}
+	if ev.OccurredAt.Before(before.Truncate(time.Second)) || ev.OccurredAt.Location() != time.UTC {
+		t.Errorf("expected the event time in UTC, got %v", ev.OccurredAt)
+	}
+
+	// The SSE stream is told regardless.
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublishProductChange_FailureGoesToOutbox(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	p, outbox := usePublisher(s, 1)
+
+	s.publishProductChange(context.Background(), eventProductUpdated, 7, json.RawMessage(`{"id":7}`))
+
+	if len(p.sent()) != 0 {
+		t.Fatal("expected the publish to fail")
+	}
+	pending := outbox.pending()
+	if len(pending) != 1 || pending[0].Key != "7" || pending[0].LastError != "broker unavailable" {
+		t.Fatalf("expected the event in the outbox, got %+v", pending)
+	}
+	var ev productChange
+	if err := json.Unmarshal(pending[0].Payload, &ev); err != nil || ev.Type != eventProductUpdated {
+		t.Errorf("expected the event kept as it was to be published, got %s", pending[0].Payload)
+	}
+	if got := productEventCount(s, "failed"); got != 1 {
+		t.Errorf("expected the failure counted, got %v", got)
+	}
+}
+
+func TestPublishProductChange_LostWhenOutboxFails(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	_, outbox := usePublisher(s, 1)
+	outbox.fail(errors.New("connection refused"))
+
+	s.publishProductChange(context.Background(), eventProductUpdated, 7, json.RawMessage(`{"id":7}`))
+	if got := productEventCount(s, "lost"); got != 1 {
+		t.Errorf("expected the event counted as lost, got %v", got)
+	}
+}
+
+func TestPublishProductChange_Disabled(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	// Neither a publisher nor an outbox is set: either would panic.
+	s.publishProductChange(context.Background(), eventProductUpdated, 7, json.RawMessage(`{"id":7}`))
+}
+
+func TestNewPublisher_PrefixesRedisStream(t *testing.T) {
+	t.Parallel()
+	rdb, redisMock := redismock.NewClientMock()
+	t.Cleanup(func() { rdb.Close() })
+	cfg := Config{EventsPublisher: eventsRedis, EventsTopic: "products-events", EventsStreamMaxLen: 1000}
+	p := newPublisher(cfg, rdb, redisKeys{prefix: "shop:"})
+
+	redisMock.ExpectXAdd(&redis.XAddArgs{
+		Stream: "shop:events:products-events",
+		MaxLen: 1000,
+		Approx: true,
+		Values: []any{"key", "7", "event", `{"id":7}`},
+	}).SetVal("1700000000000-0")
+	if err := p.Publish(context.Background(), publish.Message{Key: "7", Value: []byte(`{"id":7}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the stream under the key prefix: %v", err)
+	}
+}
+
+func TestRelayOutbox_RetriesFlakyPublisher(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	// The first publish goes to the outbox along with the second, then the
+	// first relay round fails once more.
+	p, outbox := usePublisher(s, 3)
+	ctx := context.Background()
+	s.publishProductChange(ctx, eventProductCreated, 1, json.RawMessage(`{"id":1}`))
+	s.publishProductChange(ctx, eventProductCreated, 2, json.RawMessage(`{"id":2}`))
+	if n := len(outbox.pending()); n != 2 {
+		t.Fatalf("expected both events in the outbox, got %d", n)
+	}
+
+	redisMock.Regexp().ExpectSetNX(testOutboxLockKey, `^[0-9a-f]{32}$`, time.Second).SetVal(true)
+	before := time.Now()
+	n, err := s.relayOutbox(ctx, time.Second)
+	if err == nil || n != 0 {
+		t.Fatalf("expected the round to stop at the first failure, got %d published and %v", n, err)
+	}
+	pending := outbox.pending()
+	if len(pending) != 2 || pending[0].Attempts != 2 || pending[1].Attempts != 1 {
+		t.Fatalf("expected only the first event retried, got %+v", pending)
+	}
+	if next := outbox.nextAttempt(pending[0].ID); !next.After(before) || next.After(before.Add(outboxBackoff.BaseWait*2)) {
+		t.Errorf("expected the retry put off by the backoff, got %v", next.Sub(before))
+	}
+
+	redisMock.Regexp().ExpectSetNX(testOutboxLockKey, `^[0-9a-f]{32}$`, time.Second).SetVal(true)
+	n, err = s.relayOutbox(ctx, time.Second)
+	if err != nil || n != 2 {
+		t.Fatalf("expected both events published, got %d and %v", n, err)
+	}
+	if len(outbox.pending()) != 0 {
+		t.Errorf("expected the outbox emptied, got %+v", outbox.pending())
+	}
+	sent := p.sent()
+	if len(sent) != 2 || sent[0].Key != "1" || sent[1].Key != "2" {
+		t.Errorf("expected the events published oldest first, got %+v", sent)
+	}
+	for result, want := range map[string]float64{"failed": 3, "retried": 2, "published": 0} {
+		if got := productEventCount(s, result); got != want {
+			t.Errorf("%s: counted %v, want %v", result, got, want)
+		}
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelayOutbox_SkipsWhileLockHeld(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	p, outbox := usePublisher(s, 1)
+	s.publishProductChange(context.Background(), eventProductCreated, 1, json.RawMessage(`{"id":1}`))
+
+	redisMock.Regexp().ExpectSetNX(testOutboxLockKey, `^[0-9a-f]{32}$`, time.Second).SetVal(false)
+	if n, err := s.relayOutbox(context.Background(), time.Second); n != 0 || err != nil {
+		t.Fatalf("expected the round skipped, got %d and %v", n, err)
+	}
+	if len(p.sent()) != 0 || len(outbox.pending()) != 1 {
+		t.Error("expected nothing relayed while another replica holds the lock")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-service/store"
+)
+
+// Product event types, published on the products event channel and sent
+// as SSE event names.
+const (
+	eventProductCreated = "product.created"
+	eventProductUpdated = "product.updated"
+	eventProductDeleted = "product.deleted"
+	// eventProducts is the first event of a stream: the whole product list.
+	eventProducts = "products"
+)
+
+const (
+	// streamHeartbeat is how often an idle stream gets a comment line, so
+	// that proxies do not close it.
+	streamHeartbeat = 15 * time.Second
+	// streamBuffer is how many events may wait for a slow client before
+	// its stream is closed; it reconnects and starts over from the list.
+	streamBuffer = 64
+)
+
+// streamRoutes hold their response open to push events. The request
+// timeout, the in-flight limit and the latency histogram are for requests
+// that end, so these routes are exempt from them. The paths are relative
+// to the API version.
+var streamRoutes = map[string]bool{
+	"/products/stream": true,
+	"/ws":              true,
+}
+
+// isStream reports whether r was routed to one of the streamRoutes.
+func (s *Server) isStream(r *http.Request) bool {
+	return s.streams[r.Pattern]
+}
+
+// productEvent is a change to the products, as published by the write
+// handlers. Data is the product for product.created and product.updated,
+// and only {"id": ...} for product.deleted and for products created by a
+// bulk import.
+type productEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// productRef identifies a product in an event without its fields.
+type productRef struct {
+	ID int64 `json:"id"`
+}
+
+// publishProductEvent tells every replica's streams, EVENTS_PUBLISHER and
+// the webhook subscriptions about a committed change to the product with
+// id. The write has already succeeded, so a failure is only logged: clients
+// catch up when they reconnect.
+func (s *Server) publishProductEvent(ctx context.Context, typ string, id int64, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		s.logger.WarnContext(ctx, "Failed to publish product event", "type", typ, "err", err)
+		return
+	}
+	msg, err := json.Marshal(productEvent{Type: typ, Data: raw})
+	if err == nil {
+		err = s.rdb.Publish(ctx, s.keys.productEvents(), msg).Err()
+	}
+	if err != nil {
+		s.logger.WarnContext(ctx, "Failed to publish product event", "type", typ, "err", err)
+	}
+	s.publishProductChange(ctx, typ, id, raw)
+	s.queueWebhooks(ctx, typ, id, raw)
+}
+
+// eventSubscription is a Redis Pub/Sub subscription; *redis.PubSub
+// satisfies it.
+type eventSubscription interface {
+	Channel(opts ...redis.ChannelOption) <-chan *redis.Message
+	Close() error
+}
+
+// runProductEventRelay subscribes to the products event channel and hands
+// every event to this replica's streams until ctx is cancelled. go-redis
+// resubscribes by itself after a dropped connection; events published in
+// between are lost.
+func (s *Server) runProductEventRelay(ctx context.Context) {
+	sub := s.rdb.Subscribe(ctx, s.keys.productEvents())
+	defer sub.Close()
+	s.relayProductEvents(ctx, sub)
+}
+
+func (s *Server) relayProductEvents(ctx context.Context, sub eventSubscription) {
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var ev productEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil || ev.Type == "" {
+				s.logger.WarnContext(ctx, "Ignoring malformed product event", "channel", msg.Channel, "err", err)
+				continue
+			}
+			s.events.broadcast(ev)
+		}
+	}
+}
+
+// eventHub fans product events out to the streams open on this replica.
+// The zero value is ready to use.
+type eventHub struct {
+	mu      sync.Mutex
+	streams map[chan productEvent]struct{}
+	// closed is closed by close, ending every stream.
+	closed   chan struct{}
+	isClosed bool
+}
+
+// subscribe returns a channel of events and a function to stop receiving
+// them. The channel is closed if the stream falls streamBuffer events
+// behind.
+func (h *eventHub) subscribe() (<-chan productEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams == nil {
+		h.streams = make(map[chan productEvent]struct{})
+	}
+	ch := make(chan productEvent, streamBuffer)
+	h.streams[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.streams[ch]; ok {
+			delete(h.streams, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *eventHub) broadcast(ev productEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.streams {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.streams, ch)
+			close(ch)
+		}
+	}
+}
+
+// done returns a channel closed once the hub is closed.
+func (h *eventHub) done() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closedLocked()
+}
+
+func (h *eventHub) closedLocked() chan struct{} {
+	if h.closed == nil {
+		h.closed = make(chan struct{})
+	}
+	return h.closed
+}
+
+// close ends every open stream and any opened later. http.Server.Shutdown
+// waits for handlers to return, so it must be called when shutdown starts.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.isClosed {
+		h.isClosed = true
+		close(h.closedLocked())
+	}
+}
+
+// CloseStreams ends the open event streams and WebSocket connections. It is registered with
+// http.Server.RegisterOnShutdown.
+func (s *Server) CloseStreams() {
+	s.events.close()
+}
+
+// productStreamHandler streams product changes as Server-Sent Events: the
+// current list first, then every change published after it, with a
+// heartbeat comment every streamHeartbeat.
+func (s *Server) productStreamHandler(w http.ResponseWriter, r *http.Request) {
+	s.streamProducts(w, r, streamHeartbeat)
+}
+
+func (s *Server) streamProducts(w http.ResponseWriter, r *http.Request, heartbeat time.Duration) {
+	ctx := r.Context()
+
+	// Subscribe before reading the list, so that no change made in
+	// between is missed; a client may see one twice instead.
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	products := []store.Product{}
+	err := s.products.Stream(ctx, store.ProductFilter{}, func(p store.Product) error {
+		products = append(products, p)
+		return nil
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	list, err := json.Marshal(products)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to encode products", "err", err)
+		s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The server's WriteTimeout would cut the stream off.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.logger.WarnContext(ctx, "Failed to clear the write deadline", "err", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(write func() error) bool {
+		if err := write(); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if !send(func() error { return writeEvent(w, eventProducts, list) }) {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	done := s.events.done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case ev, ok := <-events:
+			if !ok {
+				s.logger.WarnContext(ctx, "Closing a stream that fell behind", "path", r.URL.Path)
+				return
+			}
+			if !send(func() error { return writeEvent(w, ev.Type, ev.Data) }) {
+				return
+			}
+		case <-ticker.C:
+			if !send(func() error { _, err := io.WriteString(w, ": heartbeat\n\n"); return err }) {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes one Server-Sent Event. data is compact JSON, so it
+// fits on a single data line.
+func writeEvent(w io.Writer, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeSubscription is an eventSubscription fed by the test.
+type fakeSubscription struct {
+	ch chan *redis.Message
+}
+
+func (f fakeSubscription) Channel(...redis.ChannelOption) <-chan *redis.Message { return f.ch }
+func (f fakeSubscription) Close() error                                         { return nil }
+
+// openStream serves streamProducts with heartbeat and returns a reader of
+// the response body, the function that disconnects the client and a
+// channel closed once the handler returned.
+func openStream(t *testing.T, s *Server, heartbeat time.Duration) (*bufio.Reader, context.CancelFunc, <-chan struct{}) {
+	t.Helper()
+	returned := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(returned)
+		s.streamProducts(w, r, heartbeat)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	return bufio.NewReader(resp.Body), cancel, returned
+}
+
+// readEvent reads up to the blank line ending the next event or comment.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, line)
+	}
+}
+
+func waitReturned(t *testing.T, returned <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream handler did not return")
+	}
+}
+
+func TestStreamProducts_SendsListThenEvents(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).add(testProduct(7, "Chair", 49.5, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)))
+
+	sub := fakeSubscription{ch: make(chan *redis.Message)}
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	go s.relayProductEvents(relayCtx, sub)
+
+	body, disconnect, returned := openStream(t, s, time.Hour)
+
+	want := `event: products` + "\n" + `data: [{"id":7,"name":"Chair","description":"","price":49.5,"created_at":"2024-05-01T00:00:00Z"}]`
+	if got := readEvent(t, body); got != want {
+		t.Fatalf("expected the list first, got %q", got)
+	}
+
+	sub.ch <- &redis.Message{Channel: testKeys.productEvents(), Payload: `not json`}
+	sub.ch <- &redis.Message{Channel: testKeys.productEvents(), Payload: `{"type":"product.deleted","data":{"id":7}}`}
+	if got, want := readEvent(t, body), "event: product.deleted\ndata: {\"id\":7}"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	disconnect()
+	waitReturned(t, returned)
+	if n := len(s.events.streams); n != 0 {
+		t.Errorf("expected the stream unsubscribed, %d left", n)
+	}
+}
+
+func TestStreamProducts_Heartbeat(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	body, _, _ := openStream(t, s, 10*time.Millisecond)
+	if got := readEvent(t, body); got != "event: products\ndata: []" {
+		t.Fatalf("expected an empty list, got %q", got)
+	}
+	if got := readEvent(t, body); got != ": heartbeat" {
+		t.Errorf("expected a heartbeat comment, got %q", got)
+	}
+}
+
+func TestStreamProducts_EndsOnShutdown(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	body, _, returned := openStream(t, s, time.Hour)
+	readEvent(t, body)
+
+	s.CloseStreams()
+	waitReturned(t, returned)
+	if _, err := body.ReadString('\n'); err == nil {
+		t.Error("expected the stream to end")
+	}
+}
+
+func TestStreamProducts_ListFailure(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(errors.New("connection reset"))
+
+	w := httptest.NewRecorder()
+	s.streamProducts(w, httptest.NewRequest(http.MethodGet, "/products/stream", nil), time.Hour)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if len(s.events.streams) != 0 {
+		t.Error("expected the stream unsubscribed")
+	}
+}
+
+func TestEventHub_ClosesSlowStreams(t *testing.T) {
+	t.Parallel()
+	var h eventHub
+	slow, _ := h.subscribe()
+	fast, unsubscribe := h.subscribe()
+	defer unsubscribe()
+
+	for range streamBuffer {
+		h.broadcast(productEvent{Type: eventProductUpdated})
+		<-fast
+	}
+	h.broadcast(productEvent{Type: eventProductUpdated})
+
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != streamBuffer {
+		t.Errorf("expected the %d buffered events before the close, got %d", streamBuffer, n)
+	}
+	if ev := <-fast; ev.Type != eventProductUpdated {
+		t.Errorf("expected the fast stream to keep its events, got %+v", ev)
+	}
+}
+
+func TestDeleteProductHandler_PublishesEvent(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	testProducts(s).add(testProduct(7, "Chair", 49.5, time.Now()))
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(7))
+	redisMock.ExpectPublish(testKeys.productEvents(), []byte(`{"type":"product.deleted","data":{"id":7}}`)).SetVal(1)
+
+	r := httptest.NewRequest(http.MethodDelete, "/products/7", nil)
+	r.SetPathValue("id", "7")
+	w := httptest.NewRecorder()
+	s.deleteProductHandler(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-service/store"
+)
+
+// exportFlushRows is how many rows an export writes between flushes, so
+// that clients see progress and the server never holds more than a batch.
+const exportFlushRows = 500
+
+// partialHeader is sent, as a trailer where the protocol allows, on an
+// export that failed after its status was sent.
+const partialHeader = "X-Partial-Response"
+
+// productEncoder writes products in an export format. Output may be
+// buffered until flush; close ends the document, complete or not.
+type productEncoder interface {
+	encode(p store.Product) error
+	flush() error
+	close() error
+}
+
+// exportFormat is a media type GET /products can stream instead of the
+// paged JSON document.
+type exportFormat struct {
+	contentType string
+	// filename, when set, is offered to clients saving the export.
+	filename   string
+	newEncoder func(io.Writer) productEncoder
+}
+
+var (
+	csvExport    = &exportFormat{contentType: "text/csv; charset=utf-8", filename: "products.csv", newEncoder: newCSVEncoder}
+	ndjsonExport = &exportFormat{contentType: "application/x-ndjson", newEncoder: newNDJSONEncoder}
+	// jsonExport is a bare JSON array, asked for with ?stream=true. The
+	// paged document stays the default: caching and ETags need its whole
+	// body.
+	jsonExport = &exportFormat{contentType: "application/json", newEncoder: newJSONArrayEncoder}
+)
+
+// negotiateExport returns the export format r asks for, or nil for the
+// paged JSON document. The first type listed in Accept that the server
+// knows wins, so a client listing application/json first gets JSON, which
+// ?stream=true turns into a streamed array.
+func negotiateExport(r *http.Request) *exportFormat {
+	stream := r.URL.Query().Get("stream") == "true"
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(v)
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return csvExport
+		case "application/x-ndjson":
+			return ndjsonExport
+		case "application/json", "application/*", "*/*":
+			return jsonIf(stream)
+		}
+	}
+	return jsonIf(stream)
+}
+
+func jsonIf(stream bool) *exportFormat {
+	if stream {
+		return jsonExport
+	}
+	return nil
+}
+
+// exportProducts streams every product matching filter in format, writing
+// rows as the store reads them. Paging parameters do not apply. An error
+// before anything was sent gets the usual error response; after that the
+// status is gone, so the error is logged, the document is closed validly
+// and partialHeader is set.
+func (s *Server) exportProducts(w http.ResponseWriter, r *http.Request, filter productFilter, format *exportFormat) {
+	ctx := r.Context()
+
+	out := &sentWriter{w: w}
+	enc := format.newEncoder(out)
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", format.contentType)
+	if format.filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": format.filename}))
+	}
+	w.Header().Set("Trailer", partialHeader)
+
+	rows := 0
+	err := s.products.Stream(ctx, store.ProductFilter(filter), func(p store.Product) error {
+		if err := enc.encode(p); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows != 0 {
+			return nil
+		}
+		if err := enc.flush(); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	})
+	if err != nil && !out.sent {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Trailer")
+		s.writeDBError(w, err)
+		return
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Product export cut short", "err", err, "rows", rows, "path", r.URL.Path)
+		w.Header().Set(partialHeader, "true")
+	}
+	if err := enc.close(); err != nil {
+		s.logger.WarnContext(ctx, "Failed to finish product export", "err", err, "path", r.URL.Path)
+	}
+}
+
+// sentWriter records whether anything has been written to w.
+type sentWriter struct {
+	w    io.Writer
+	sent bool
+}
+
+func (s *sentWriter) Write(b []byte) (int, error) {
+	s.sent = true
+	return s.w.Write(b)
+}
+
+// csvEncoder writes products as RFC 4180 CSV under a header row.
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) productEncoder {
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	_ = cw.Write([]string{"id", "name", "description", "price", "created_at"})
+	return csvEncoder{w: cw}
+}
+
+func (e csvEncoder) encode(p store.Product) error {
+	var price string
+	if p.Price != nil {
+		price = strconv.FormatFloat(*p.Price, 'f', -1, 64)
+	}
+	return e.w.Write([]string{
+		strconv.FormatInt(p.ID, 10),
+		p.Name,
+		p.Description,
+		price,
+		p.CreatedAt.Format(time.RFC3339Nano),
+	})
+}
+
+func (e csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e csvEncoder) close() error { return e.flush() }
+
+// ndjsonEncoder writes each product as a JSON object on its own line.
+type ndjsonEncoder struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) productEncoder {
+	buf := bufio.NewWriter(w)
+	return ndjsonEncoder{buf: buf, enc: json.NewEncoder(buf)}
+}
+
+func (e ndjsonEncoder) encode(p store.Product) error {
+	return e.enc.Encode(p)
+}
+
+func (e ndjsonEncoder) flush() error {
+	return e.buf.Flush()
+}
+
+func (e ndjsonEncoder) close() error { return e.flush() }
+
+// jsonArrayEncoder writes products as the elements of one JSON array.
+type jsonArrayEncoder struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+	n   int
+}
+
+func newJSONArrayEncoder(w io.Writer) productEncoder {
+	buf := bufio.NewWriter(w)
+	_ = buf.WriteByte('[')
+	return &jsonArrayEncoder{buf: buf, enc: json.NewEncoder(buf)}
+}
+
+func (e *jsonArrayEncoder) encode(p store.Product) error {
+	if e.n > 0 {
+		_ = e.buf.WriteByte(',')
+	}
+	e.n++
+	// Encode ends each value with a newline, which JSON allows between
+	// elements.
+	return e.enc.Encode(p)
+}
+
+func (e *jsonArrayEncoder) flush() error {
+	return e.buf.Flush()
+}
+
+func (e *jsonArrayEncoder) close() error {
+	_, _ = e.buf.WriteString("]\n")
+	return e.buf.Flush()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-service/store"
+)
+
+func exportRequest(accept, query string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/products"+query, nil)
+	r.Header.Set("Accept", accept)
+	return r
+}
+
+func TestProductsHandler_ExportsCSV(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	awkward := testProduct(2, `Chair, "the comfy one"`, 49.5, created)
+	awkward.Description = "line one\nline two"
+	unpriced := testProduct(3, "Lamp", 0, created)
+	unpriced.Price = nil
+	testProducts(s).add(testProduct(1, "Rug", 10.99, created), awkward, unpriced)
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, exportRequest("text/csv", "?sort=price_desc&limit=1"))
+
+	want := "id,name,description,price,created_at\r\n" +
+		"2,\"Chair, \"\"the comfy one\"\"\",\"line one\r\nline two\",49.5,2024-01-02T03:04:05Z\r\n" +
+		"1,Rug,,10.99,2024-01-02T03:04:05Z\r\n" +
+		"3,Lamp,,,2024-01-02T03:04:05Z\r\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("expected every product as CSV, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "attachment; filename=products.csv" {
+		t.Errorf("unexpected Content-Disposition %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept" {
+		t.Errorf("expected Vary: Accept, got %q", got)
+	}
+}
+
+func TestProductsHandler_ExportsNDJSON(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for id := int64(1); id <= exportFlushRows+1; id++ {
+		testProducts(s).add(testProduct(id, "Product", 1, created))
+	}
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, exportRequest("application/x-ndjson", ""))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an NDJSON export, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !w.Flushed {
+		t.Errorf("expected the export to be flushed as it was written")
+	}
+	lines := bufio.NewScanner(w.Body)
+	var n int64
+	for lines.Scan() {
+		n++
+		var p store.Product
+		if err := json.Unmarshal(lines.Bytes(), &p); err != nil || p.ID != n {
+			t.Fatalf("line %d: expected product %d, got %+v, %v", n, n, p, err)
+		}
+	}
+	if n != exportFlushRows+1 {
+		t.Errorf("expected %d lines, got %d", exportFlushRows+1, n)
+	}
+}
+
+func TestProductsHandler_StreamsJSONArray(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testProducts(s).add(testProduct(1, "Rug", 10.99, created), testProduct(2, "Lamp", 5, created))
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, exportRequest("application/json", "?stream=true&q=a"))
+
+	var got []store.Product
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("expected a JSON array, got %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusOK || len(got) != 1 || got[0].Name != "Lamp" {
+		t.Errorf("expected the matching product, got %d %+v", w.Code, got)
+	}
+	if got := w.Result().Trailer.Get(partialHeader); got != "" {
+		t.Errorf("expected a complete response, got %s: %q", partialHeader, got)
+	}
+
+	// No match is an empty array, not null.
+	w = httptest.NewRecorder()
+	s.productsHandler(w, exportRequest("", "?stream=true&q=zzz"))
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Errorf("expected an empty array, got %q", got)
+	}
+}
+
+func TestProductsHandler_StreamFailingMidwayIsPartial(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for id := int64(1); id <= exportFlushRows+10; id++ {
+		testProducts(s).add(testProduct(id, "Product", 1, created))
+	}
+	// The first batch is flushed, so the status is gone when the
+	// connection to the database is lost.
+	testProducts(s).failStreamAfter(exportFlushRows+5, errors.New("connection reset"))
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, exportRequest("application/json", "?stream=true"))
+
+	var got []store.Product
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("expected the array to be closed validly, got %v", err)
+	}
+	if w.Code != http.StatusOK || len(got) != exportFlushRows+5 {
+		t.Errorf("expected the %d products read, got %d %d", exportFlushRows+5, w.Code, len(got))
+	}
+	if got := w.Result().Trailer.Get(partialHeader); got != "true" {
+		t.Errorf("expected the %s trailer, got %q", partialHeader, got)
+	}
+}
+
+func TestProductsHandler_ExportErrorBeforeFirstRow(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(errors.New("connection refused"))
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, exportRequest("text/csv", ""))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d %q", w.Code, w.Body.String())
+	}
+	if got := decodeError(t, w); got.Code != codeDBError {
+		t.Errorf("expected a db_error, got %+v", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "" {
+		t.Errorf("expected no attachment for an error, got %q", got)
+	}
+	if got := w.Header().Get("Trailer"); got != "" {
+		t.Errorf("expected no trailer for an error, got %q", got)
+	}
+}
+
+func TestNegotiateExport(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		accept, query string
+		want          *exportFormat
+	}{
+		{"", "", nil},
+		{"*/*", "", nil},
+		{"application/json", "", nil},
+		{"text/csv", "", csvExport},
+		{"text/csv; charset=utf-8", "", csvExport},
+		{"application/x-ndjson", "", ndjsonExport},
+		{"text/html, text/csv;q=0.9", "", csvExport},
+		{"application/json, text/csv", "", nil},
+		{"text/csv;q=0, application/x-ndjson", "", ndjsonExport},
+		{"text/plain", "", nil},
+		{"", "?stream=true", jsonExport},
+		{"application/json", "?stream=true", jsonExport},
+		{"text/csv", "?stream=true", csvExport},
+		{"application/json", "?stream=1", nil},
+	}
+	for _, tt := range tests {
+		if got := negotiateExport(exportRequest(tt.accept, tt.query)); got != tt.want {
+			t.Errorf("negotiateExport(%q, %q) = %v, want %v", tt.accept, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestProductsHandler_JSONByDefault(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, exportRequest("text/html, */*", ""))
+
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), `{"items":[]`) {
+		t.Errorf("expected the JSON page, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// BenchmarkProductsJSON compares building the whole array before writing it
+// with streaming it product by product.
+func BenchmarkProductsJSON(b *testing.B) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	products := make([]store.Product, 10000)
+	for i := range products {
+		products[i] = testProduct(int64(i+1), "Product", 9.99, created)
+	}
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			// As the paged document is built: every row in a slice, then
+			// one body.
+			var items []store.Product
+			for _, p := range products {
+				items = append(items, p)
+			}
+			body, err := json.Marshal(items)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, _ = io.Discard.Write(body)
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			enc := newJSONArrayEncoder(io.Discard)
+			for i, p := range products {
+				if err := enc.encode(p); err != nil {
+					b.Fatal(err)
+				}
+				if (i+1)%exportFlushRows == 0 {
+					_ = enc.flush()
+				}
+			}
+			if err := enc.close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
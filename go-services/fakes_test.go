@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go-service/publish"
+	"go-service/store"
+)
+
+// fakeProducts is an in-memory store.ProductStore that can be made to
+// fail. It also holds the categories, served by fakeCategories, so the two
+// see each other as the joined tables do.
+type fakeProducts struct {
+	mu       sync.Mutex
+	products map[int64]store.Product
+	nextID   int64
+
+	categories     map[int64]store.Category
+	nextCategoryID int64
+
+	// err is returned by every call after the first failAfter.
+	err       error
+	failAfter int
+	calls     int
+	// lists records the List calls, for tests about what was asked for.
+	lists []store.ProductList
+	// batches records the size of each CreateMany call.
+	batches []int
+	// searches records the Search calls.
+	searches []store.ProductSearch
+	// streamErr, when set, ends every Stream with it after streamRows
+	// products.
+	streamErr  error
+	streamRows int
+}
+
+func newFakeProducts() *fakeProducts {
+	return &fakeProducts{
+		products:       make(map[int64]store.Product),
+		nextID:         1,
+		categories:     make(map[int64]store.Category),
+		nextCategoryID: 1,
+	}
+}
+
+// testProducts returns the fake product store of a server from
+// newTestServer.
+func testProducts(s *Server) *fakeProducts {
+	return s.products.(*fakeProducts)
+}
+
+// add stores products as given, keeping ids assigned later above theirs.
+func (f *fakeProducts) add(products ...store.Product) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range products {
+		f.products[p.ID] = p
+		f.nextID = max(f.nextID, p.ID+1)
+	}
+}
+
+// fail makes every later call return err.
+func (f *fakeProducts) fail(err error) {
+	f.failFrom(0, err)
+}
+
+// failFrom lets n more calls succeed and makes the rest return err.
+func (f *fakeProducts) failFrom(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err, f.failAfter = err, f.calls+n
+}
+
+// failStreamAfter makes Stream return err once it has sent n products, as a
+// connection lost mid-query would.
+func (f *fakeProducts) failStreamAfter(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streamErr, f.streamRows = err, n
+}
+
+// callCount returns how many calls the store has served.
+func (f *fakeProducts) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeProducts) begin() error {
+	f.mu.Lock()
+	f.calls++
+	if f.calls <= f.failAfter {
+		return nil
+	}
+	return f.err
+}
+
+func (f *fakeProducts) List(_ context.Context, l store.ProductList) ([]store.Product, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	f.lists = append(f.lists, l)
+	if err != nil {
+		return nil, err
+	}
+
+	items := f.matching(l.Filter)
+	if l.Keyset {
+		items = slices.DeleteFunc(items, func(p store.Product) bool { return p.ID <= l.AfterID })
+	} else {
+		sortProducts(items, l.Filter.Sort)
+		items = items[min(l.Offset, len(items)):]
+	}
+	return items[:min(l.Limit, len(items))], nil
+}
+
+func (f *fakeProducts) Stream(_ context.Context, filter store.ProductFilter, fn func(store.Product) error) error {
+	err := f.begin()
+	items := f.matching(filter)
+	streamErr, streamRows := f.streamErr, f.streamRows
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sortProducts(items, filter.Sort)
+	for i, p := range items {
+		if streamErr != nil && i == streamRows {
+			return streamErr
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return streamErr
+}
+
+func (f *fakeProducts) Count(_ context.Context, filter store.ProductFilter) (int64, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(f.matching(filter))), nil
+}
+
+func (f *fakeProducts) Get(_ context.Context, id int64) (store.Product, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return store.Product{}, err
+	}
+	p, ok := f.live(id)
+	if !ok {
+		return store.Product{}, store.ErrNotFound
+	}
+	return p, nil
+}
+
+func (f *fakeProducts) GetMany(_ context.Context, ids []int64) ([]store.Product, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	products := []store.Product{}
+	for _, id := range ids {
+		if p, ok := f.live(id); ok {
+			products = append(products, p)
+		}
+	}
+	return products, nil
+}
+
+func (f *fakeProducts) Create(_ context.Context, in store.ProductInput) (store.Product, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return store.Product{}, err
+	}
+	category, err := f.productCategory(in.CategoryID)
+	if err != nil {
+		return store.Product{}, err
+	}
+	p := store.Product{ID: f.nextID, Name: in.Name, Description: in.Description, Price: &in.Price, Category: category, CreatedAt: time.Now()}
+	f.products[p.ID] = p
+	f.nextID++
+	return p, nil
+}
+
+func (f *fakeProducts) CreateMany(_ context.Context, in []store.ProductInput) ([]int64, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, len(in))
+	if err != nil {
+		return nil, err
+	}
+	categories := make([]*store.ProductCategory, len(in))
+	for i, p := range in {
+		if categories[i], err = f.productCategory(p.CategoryID); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]int64, len(in))
+	for i, p := range in {
+		ids[i] = f.nextID
+		f.products[f.nextID] = store.Product{ID: f.nextID, Name: p.Name, Description: p.Description, Price: &p.Price, Category: categories[i], CreatedAt: time.Now()}
+		f.nextID++
+	}
+	return ids, nil
+}
+
+func (f *fakeProducts) Update(_ context.Context, id int64, in store.ProductInput) (store.Product, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return store.Product{}, err
+	}
+	p, ok := f.live(id)
+	if !ok {
+		return store.Product{}, store.ErrNotFound
+	}
+	category, err := f.productCategory(in.CategoryID)
+	if err != nil {
+		return store.Product{}, err
+	}
+	p.Name, p.Description, p.Price, p.Category = in.Name, in.Description, &in.Price, category
+	f.products[id] = p
+	return p, nil
+}
+
+func (f *fakeProducts) Delete(_ context.Context, id int64) error {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if p, ok := f.live(id); ok {
+		deleted := time.Now()
+		p.DeletedAt = &deleted
+		f.products[id] = p
+	}
+	return nil
+}
+
+func (f *fakeProducts) Restore(_ context.Context, id int64) (store.Product, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return store.Product{}, err
+	}
+	p, ok := f.products[id]
+	if !ok || p.DeletedAt == nil {
+		return store.Product{}, store.ErrNotFound
+	}
+	p.DeletedAt = nil
+	f.products[id] = p
+	return p, nil
+}
+
+func (f *fakeProducts) Purge(_ context.Context, before time.Time) (int64, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for id, p := range f.products {
+		if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+			delete(f.products, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Search matches products containing every term of the query, scoring a
+// term in the name above one in the description, as the weights of the
+// search vector do. A short single term matches names only, scoring 0.
+func (f *fakeProducts) Search(_ context.Context, q store.ProductSearch) ([]store.ProductMatch, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	f.searches = append(f.searches, q)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := strings.Fields(strings.ToLower(q.Query))
+	short := len(terms) == 1 && len([]rune(terms[0])) < store.ShortSearchTermLen
+	matches := []store.ProductMatch{}
+	for _, p := range f.matching(store.ProductFilter{}) {
+		name, description := strings.ToLower(p.Name), strings.ToLower(p.Description)
+		score, found := 0.0, true
+		for _, term := range terms {
+			switch {
+			case strings.Contains(name, term):
+				score++
+			case !short && strings.Contains(description, term):
+				score += 0.4
+			default:
+				found = false
+			}
+		}
+		if !found {
+			continue
+		}
+		if short {
+			score = 0
+		}
+		matches = append(matches, store.ProductMatch{Product: p, Score: score})
+	}
+	slices.SortStableFunc(matches, func(a, b store.ProductMatch) int {
+		if short {
+			return cmp.Compare(a.Name, b.Name)
+		}
+		return cmp.Compare(b.Score, a.Score)
+	})
+	matches = matches[min(q.Offset, len(matches)):]
+	return matches[:min(q.Limit, len(matches))], nil
+}
+
+// live returns the product id unless it is missing or deleted.
+func (f *fakeProducts) live(id int64) (store.Product, bool) {
+	p, ok := f.products[id]
+	return p, ok && p.DeletedAt == nil
+}
+
+// productCategory returns the category a product written with id joins
+// to, or ErrForeignKey if there is no such category.
+func (f *fakeProducts) productCategory(id *int64) (*store.ProductCategory, error) {
+	if id == nil {
+		return nil, nil
+	}
+	c, ok := f.categories[*id]
+	if !ok {
+		return nil, store.ErrForeignKey
+	}
+	return &store.ProductCategory{ID: c.ID, Name: c.Name}, nil
+}
+
+// inCategory reports whether p is in the category with the given slug.
+func (f *fakeProducts) inCategory(p store.Product, slug string) bool {
+	if p.Category == nil {
+		return false
+	}
+	return f.categories[p.Category.ID].Slug == slug
+}
+
+// matching returns the products filter selects, in id order.
+func (f *fakeProducts) matching(filter store.ProductFilter) []store.Product {
+	items := []store.Product{}
+	for _, p := range f.products {
+		switch {
+		case p.DeletedAt != nil && !filter.IncludeDeleted:
+		case filter.Category != "" && !f.inCategory(p, filter.Category):
+		case filter.Query != "" && !strings.Contains(strings.ToLower(p.Name), strings.ToLower(filter.Query)):
+		case filter.MinPrice != nil && (p.Price == nil || *p.Price < *filter.MinPrice):
+		case filter.MaxPrice != nil && (p.Price == nil || *p.Price > *filter.MaxPrice):
+		default:
+			items = append(items, p)
+		}
+	}
+	slices.SortFunc(items, func(a, b store.Product) int { return cmp.Compare(a.ID, b.ID) })
+	return items
+}
+
+// fakeCategories is the store.CategoryStore over the categories of a
+// fakeProducts. It shares its lock and failures.
+type fakeCategories struct {
+	f *fakeProducts
+}
+
+// testCategories returns the fake category store of a server from
+// newTestServer.
+func testCategories(s *Server) fakeCategories {
+	return s.categories.(fakeCategories)
+}
+
+// add stores categories as given, keeping ids assigned later above theirs.
+func (c fakeCategories) add(categories ...store.Category) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	for _, category := range categories {
+		c.f.categories[category.ID] = category
+		c.f.nextCategoryID = max(c.f.nextCategoryID, category.ID+1)
+	}
+}
+
+func (c fakeCategories) List(context.Context) ([]store.Category, error) {
+	err := c.f.begin()
+	defer c.f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	categories := []store.Category{}
+	for _, category := range c.f.categories {
+		categories = append(categories, category)
+	}
+	slices.SortFunc(categories, func(a, b store.Category) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+	})
+	return categories, nil
+}
+
+func (c fakeCategories) Get(_ context.Context, id int64) (store.Category, error) {
+	err := c.f.begin()
+	defer c.f.mu.Unlock()
+	if err != nil {
+		return store.Category{}, err
+	}
+	category, ok := c.f.categories[id]
+	if !ok {
+		return store.Category{}, store.ErrNotFound
+	}
+	return category, nil
+}
+
+func (c fakeCategories) Create(_ context.Context, in store.CategoryInput) (store.Category, error) {
+	err := c.f.begin()
+	defer c.f.mu.Unlock()
+	if err != nil {
+		return store.Category{}, err
+	}
+	if c.slugTaken(in.Slug, 0) {
+		return store.Category{}, store.ErrDuplicate
+	}
+	category := store.Category{ID: c.f.nextCategoryID, Slug: in.Slug, Name: in.Name, CreatedAt: time.Now()}
+	c.f.categories[category.ID] = category
+	c.f.nextCategoryID++
+	return category, nil
+}
+
+func (c fakeCategories) Update(_ context.Context, id int64, in store.CategoryInput) (store.Category, error) {
+	err := c.f.begin()
+	defer c.f.mu.Unlock()
+	if err != nil {
+		return store.Category{}, err
+	}
+	category, ok := c.f.categories[id]
+	if !ok {
+		return store.Category{}, store.ErrNotFound
+	}
+	if c.slugTaken(in.Slug, id) {
+		return store.Category{}, store.ErrDuplicate
+	}
+	category.Slug, category.Name = in.Slug, in.Name
+	c.f.categories[id] = category
+	for pid, p := range c.f.products {
+		if p.Category != nil && p.Category.ID == id {
+			p.Category = &store.ProductCategory{ID: id, Name: in.Name}
+			c.f.products[pid] = p
+		}
+	}
+	return category, nil
+}
+
+func (c fakeCategories) Delete(_ context.Context, id int64, force bool) error {
+	err := c.f.begin()
+	defer c.f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, ok := c.f.categories[id]; !ok {
+		return store.ErrNotFound
+	}
+	for pid, p := range c.f.products {
+		if p.Category == nil || p.Category.ID != id {
+			continue
+		}
+		if !force {
+			return store.ErrForeignKey
+		}
+		p.Category = nil
+		c.f.products[pid] = p
+	}
+	delete(c.f.categories, id)
+	return nil
+}
+
+// slugTaken reports whether a category other than id has the slug.
+func (c fakeCategories) slugTaken(slug string, id int64) bool {
+	for _, category := range c.f.categories {
+		if category.Slug == slug && category.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// sortProducts orders id-sorted products by one of the store's sort names.
+func sortProducts(items []store.Product, sort string) {
+	field, desc := strings.CutSuffix(sort, "_desc")
+	compare := func(a, b store.Product) int {
+		switch field {
+		case "name":
+			return cmp.Compare(a.Name, b.Name)
+		case "price":
+			return cmp.Compare(priceOf(a), priceOf(b))
+		case "created_at":
+			return a.CreatedAt.Compare(b.CreatedAt)
+		}
+		return cmp.Compare(a.ID, b.ID)
+	}
+	slices.SortStableFunc(items, func(a, b store.Product) int {
+		if desc {
+			return compare(b, a)
+		}
+		return compare(a, b)
+	})
+}
+
+func priceOf(p store.Product) float64 {
+	if p.Price == nil {
+		return 0
+	}
+	return *p.Price
+}
+
+// fakeUsers is an in-memory store.UserStore. When err is set every call
+// fails with it.
+type fakeUsers struct {
+	mu     sync.Mutex
+	users  map[int64]fakeUser
+	nextID int64
+	err    error
+	calls  int
+}
+
+type fakeUser struct {
+	username     string
+	role         string
+	email        string
+	passwordHash []byte
+}
+
+func newFakeUsers() *fakeUsers {
+	return &fakeUsers{users: make(map[int64]fakeUser), nextID: 1}
+}
+
+// testUsers returns the fake user store of a server from newTestServer.
+func testUsers(s *Server) *fakeUsers {
+	return s.users.(*fakeUsers)
+}
+
+// add stores a user with the given id and the user role.
+func (f *fakeUsers) add(id int64, username, passwordHash string) {
+	f.addWithRole(id, username, passwordHash, store.RoleUser)
+}
+
+// addWithRole stores a user with the given id and role.
+func (f *fakeUsers) addWithRole(id int64, username, passwordHash, role string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[id] = fakeUser{username: username, role: role, passwordHash: []byte(passwordHash)}
+	f.nextID = max(f.nextID, id+1)
+}
+
+// role returns the role of user id, or "" if there is no such user.
+// setEmail gives user id an email address.
+func (f *fakeUsers) setEmail(id int64, email string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := f.users[id]
+	u.email = email
+	f.users[id] = u
+}
+
+// passwordHash returns the password hash of user id.
+func (f *fakeUsers) passwordHash(id int64) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.users[id].passwordHash
+}
+
+func (f *fakeUsers) role(id int64) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.users[id].role
+}
+
+// fail makes every later call return err.
+func (f *fakeUsers) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// callCount returns how many calls the store has served.
+func (f *fakeUsers) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeUsers) begin() error {
+	f.mu.Lock()
+	f.calls++
+	return f.err
+}
+
+func (f *fakeUsers) Credentials(_ context.Context, username string) (store.Credentials, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return store.Credentials{}, err
+	}
+	for id, u := range f.users {
+		if u.username == username {
+			return store.Credentials{ID: id, Role: u.role, PasswordHash: u.passwordHash}, nil
+		}
+	}
+	return store.Credentials{}, store.ErrNotFound
+}
+
+func (f *fakeUsers) Username(_ context.Context, id int64) (string, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	u, ok := f.users[id]
+	if !ok {
+		return "", store.ErrNotFound
+	}
+	return u.username, nil
+}
+
+func (f *fakeUsers) Contact(_ context.Context, username string) (store.Contact, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return store.Contact{}, err
+	}
+	for id, u := range f.users {
+		if u.username == username {
+			return store.Contact{ID: id, Email: u.email}, nil
+		}
+	}
+	return store.Contact{}, store.ErrNotFound
+}
+
+func (f *fakeUsers) Create(_ context.Context, username, email string, passwordHash []byte) (int64, error) {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range f.users {
+		if u.username == username {
+			return 0, store.ErrDuplicate
+		}
+	}
+	id := f.nextID
+	f.users[id] = fakeUser{username: username, role: store.RoleUser, email: email, passwordHash: passwordHash}
+	f.nextID++
+	return id, nil
+}
+
+func (f *fakeUsers) SetPassword(_ context.Context, id int64, passwordHash []byte) error {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	u, ok := f.users[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	u.passwordHash = passwordHash
+	f.users[id] = u
+	return nil
+}
+
+func (f *fakeUsers) SetRole(_ context.Context, id int64, role string) error {
+	err := f.begin()
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	u, ok := f.users[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	if u.role == store.RoleAdmin && role != store.RoleAdmin {
+		admins := 0
+		for _, other := range f.users {
+			if other.role == store.RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return store.ErrLastAdmin
+		}
+	}
+	u.role = role
+	f.users[id] = u
+	return nil
+}
+
+// fakeAudits is an in-memory store.AuditStore. When err is set every call
+// fails with it.
+type fakeAudits struct {
+	mu     sync.Mutex
+	events []store.AuditEvent
+	// batches records the size of each Insert call.
+	batches []int
+	err     error
+}
+
+// testAudits returns the fake audit store of a server from newTestServer.
+func testAudits(s *Server) *fakeAudits {
+	return s.audits.(*fakeAudits)
+}
+
+// fail makes every later call return err.
+func (f *fakeAudits) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// written returns the events inserted so far, oldest first.
+func (f *fakeAudits) written() []store.AuditEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.events)
+}
+
+// batchSizes returns the size of each Insert call so far.
+func (f *fakeAudits) batchSizes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.batches)
+}
+
+func (f *fakeAudits) Insert(_ context.Context, events []store.AuditEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.batches = append(f.batches, len(events))
+	for _, ev := range events {
+		ev.ID = int64(len(f.events) + 1)
+		f.events = append(f.events, ev)
+	}
+	return nil
+}
+
+func (f *fakeAudits) List(_ context.Context, l store.AuditList) ([]store.AuditEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	events := []store.AuditEvent{}
+	for _, ev := range slices.Backward(f.events) {
+		switch {
+		case l.UserID > 0 && (ev.UserID == nil || *ev.UserID != l.UserID),
+			!l.Since.IsZero() && ev.Time.Before(l.Since),
+			l.BeforeID > 0 && ev.ID >= l.BeforeID:
+			continue
+		}
+		if len(events) == l.Limit {
+			break
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// testProduct returns a priced product.
+func testProduct(id int64, name string, price float64, created time.Time) store.Product {
+	return store.Product{ID: id, Name: name, Price: &price, CreatedAt: created}
+}
+
+// fakeOutbox is an in-memory store.OutboxStore. It ignores the time an
+// event is next due: Due returns every event, and tests check the
+// scheduled time directly. When err is set every call fails with it.
+type fakeOutbox struct {
+	mu     sync.Mutex
+	events []store.OutboxEvent
+	next   map[int64]time.Time
+	nextID int64
+	err    error
+}
+
+// testOutbox gives s a fake outbox and returns it.
+func testOutbox(s *Server) *fakeOutbox {
+	f := &fakeOutbox{next: make(map[int64]time.Time)}
+	s.outbox = f
+	return f
+}
+
+// fail makes every later call return err.
+func (f *fakeOutbox) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// pending returns the events still in the outbox, oldest first.
+func (f *fakeOutbox) pending() []store.OutboxEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.events)
+}
+
+// nextAttempt returns when the event with id was last rescheduled for.
+func (f *fakeOutbox) nextAttempt(id int64) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.next[id]
+}
+
+func (f *fakeOutbox) Add(_ context.Context, ev store.OutboxEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.nextID++
+	ev.ID, ev.Attempts = f.nextID, 1
+	f.events = append(f.events, ev)
+	return nil
+}
+
+func (f *fakeOutbox) Due(_ context.Context, limit int) ([]store.OutboxEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return slices.Clone(f.events[:min(limit, len(f.events))]), nil
+}
+
+func (f *fakeOutbox) Retry(_ context.Context, id int64, next time.Time, lastErr string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	for i := range f.events {
+		if f.events[i].ID == id {
+			f.events[i].Attempts++
+			f.events[i].LastError = lastErr
+			f.next[id] = next
+		}
+	}
+	return nil
+}
+
+func (f *fakeOutbox) Delete(_ context.Context, id int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.events = slices.DeleteFunc(f.events, func(ev store.OutboxEvent) bool { return ev.ID == id })
+	return nil
+}
+
+// flakyPublisher is a publish.Publisher that fails its first failures
+// calls and records the messages it accepts after that.
+type flakyPublisher struct {
+	mu        sync.Mutex
+	failures  int
+	calls     int
+	published []publish.Message
+}
+
+// sent returns the messages published so far.
+func (p *flakyPublisher) sent() []publish.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.published)
+}
+
+func (p *flakyPublisher) Publish(_ context.Context, msg publish.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	if p.calls <= p.failures {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, msg)
+	return nil
+}
+
+func (p *flakyPublisher) Close() error {
+	return nil
+}
+
+// fakeWebhooks is an in-memory store.WebhookStore.
+type fakeWebhooks struct {
+	mu     sync.Mutex
+	subs   []store.WebhookSubscription
+	nextID int64
+}
+
+// testWebhooks gives s a fake webhook store and an empty fake delivery
+// queue, and returns them.
+func testWebhooks(s *Server) (*fakeWebhooks, *fakeDeliveries) {
+	subs, queue := &fakeWebhooks{}, &fakeDeliveries{}
+	s.webhookSubs, s.deliveries = subs, queue
+	return subs, queue
+}
+
+func (f *fakeWebhooks) List(context.Context) ([]store.WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.subs), nil
+}
+
+func (f *fakeWebhooks) Get(_ context.Context, id int64) (store.WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, sub := range f.subs {
+		if sub.ID == id {
+			return sub, nil
+		}
+	}
+	return store.WebhookSubscription{}, store.ErrNotFound
+}
+
+func (f *fakeWebhooks) Create(_ context.Context, in store.WebhookSubscriptionInput) (store.WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	sub := store.WebhookSubscription{ID: f.nextID, URL: in.URL, Secret: in.Secret, Events: in.Events, Active: in.Active, CreatedAt: time.Now()}
+	f.subs = append(f.subs, sub)
+	return sub, nil
+}
+
+func (f *fakeWebhooks) Update(_ context.Context, id int64, in store.WebhookSubscriptionInput) (store.WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, sub := range f.subs {
+		if sub.ID == id {
+			sub.URL, sub.Events, sub.Active = in.URL, in.Events, in.Active
+			if in.Secret != "" {
+				sub.Secret = in.Secret
+			}
+			f.subs[i] = sub
+			return sub, nil
+		}
+	}
+	return store.WebhookSubscription{}, store.ErrNotFound
+}
+
+func (f *fakeWebhooks) Delete(_ context.Context, id int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.subs)
+	f.subs = slices.DeleteFunc(f.subs, func(sub store.WebhookSubscription) bool { return sub.ID == id })
+	if len(f.subs) == n {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (f *fakeWebhooks) Subscribed(_ context.Context, event string) ([]store.WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var subs []store.WebhookSubscription
+	for _, sub := range f.subs {
+		if sub.Active && slices.Contains(sub.Events, event) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+// fakeDeliveries is an in-memory deliveryQueue.
+type fakeDeliveries struct {
+	mu     sync.Mutex
+	queued []queuedDelivery
+	dead   []webhookDelivery
+}
+
+type queuedDelivery struct {
+	webhookDelivery
+	at time.Time
+}
+
+// pending returns the deliveries queued, in the order they were pushed.
+func (f *fakeDeliveries) pending() []queuedDelivery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.queued)
+}
+
+func (f *fakeDeliveries) Push(_ context.Context, d webhookDelivery, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queued = append(f.queued, queuedDelivery{webhookDelivery: d, at: at})
+	return nil
+}
+
+func (f *fakeDeliveries) Claim(_ context.Context, now time.Time, n int) ([]webhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var due []webhookDelivery
+	f.queued = slices.DeleteFunc(f.queued, func(q queuedDelivery) bool {
+		if len(due) < n && !q.at.After(now) {
+			due = append(due, q.webhookDelivery)
+			return true
+		}
+		return false
+	})
+	return due, nil
+}
+
+func (f *fakeDeliveries) DeadLetter(_ context.Context, d webhookDelivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dead = append([]webhookDelivery{d}, f.dead...)
+	return nil
+}
+
+func (f *fakeDeliveries) DeadLetters(_ context.Context, n int) ([]webhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.dead[:min(n, len(f.dead))]), nil
+}
+
+func (f *fakeDeliveries) DeadLetterCount(context.Context) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.dead)), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"go-service/flags"
+)
+
+// Feature flags the service reads, with the default each lookup passes.
+const (
+	// flagCursorPagination allows cursor (keyset) pagination of the product
+	// list. It defaults to on, as cursors were served before flags existed.
+	flagCursorPagination = "cursor_pagination"
+)
+
+// flagName is what a flag may be called: short, and safe to use as a
+// metric label.
+var flagName = regexp.MustCompile(`^[a-z0-9_.-]{1,64}$`)
+
+type flagRequest struct {
+	// Value is a string or a boolean; booleans are stored as "true" or
+	// "false".
+	Value any `json:"value"`
+}
+
+// validate reports every rule the request breaks, as a validationError.
+func (in flagRequest) validate() error {
+	var v validator
+	v.check(in.Value != nil, "value", "is required")
+	_, ok := in.stored()
+	v.check(ok, "value", "must be a string or a boolean")
+	return v.err()
+}
+
+// stored is the value as it is kept in the flags hash.
+func (in flagRequest) stored() (string, bool) {
+	switch v := in.Value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+type flagResponse struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// flagFromPath returns the {name} path value, writing a 400 and returning
+// false when it is not a valid flag name.
+func (s *Server) flagFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := r.PathValue("name")
+	if !flagName.MatchString(name) {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "flag name must be 1 to 64 lowercase letters, digits, '_', '.' or '-'")
+		return "", false
+	}
+	return name, true
+}
+
+// getFlagHandler returns a feature flag as it is in Redis, not as this
+// replica has cached it. It is only served on the internal listener, behind
+// requireRole.
+func (s *Server) getFlagHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, ok := s.flagFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	value, err := s.flags.Get(ctx, name)
+	if errors.Is(err, flags.ErrNotSet) {
+		s.writeError(w, http.StatusNotFound, codeNotFound, "flag not set")
+		return
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to read feature flag", "flag", name, "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, flagResponse{Name: name, Value: value})
+}
+
+// putFlagHandler sets a feature flag. It is only served on the internal
+// listener, behind requireRole. This replica uses the new value at once;
+// the others within FlagsRefresh.
+func (s *Server) putFlagHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, ok := s.flagFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req flagRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	value, _ := req.stored()
+	if err := s.flags.Set(ctx, name, value); err != nil {
+		s.logger.ErrorContext(ctx, "Failed to set feature flag", "flag", name, "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	// Logged at warn so the change is recorded whatever the level.
+	s.logger.WarnContext(ctx, "Feature flag changed",
+		"audit", true,
+		"actor", auditActor(ctx),
+		"remote_ip", s.clientIP(r),
+		"flag", name,
+		"value", value,
+	)
+	s.audit(r, auditFlagChanged, 0, map[string]any{"flag": name, "value": value})
+	s.writeJSON(w, http.StatusOK, flagResponse{Name: name, Value: value})
+}
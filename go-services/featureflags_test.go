@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-service/flags"
+)
+
+// useFlags gives s feature flags over its Redis mock, as NewServer does.
+func useFlags(s *Server) {
+	s.flags = flags.New(s.rdb, flags.Config{
+		Key:         testKeys.flags(),
+		Refresh:     time.Hour,
+		Evaluations: s.metrics.flagEvaluations,
+		Logger:      s.logger,
+	})
+}
+
+func flagRequestTo(s *Server, method, name, auth, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/admin/flags/"+name, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func decodeFlag(t *testing.T, w *httptest.ResponseRecorder) flagResponse {
+	t.Helper()
+	var resp flagResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	return resp
+}
+
+func TestFlagHandlers_SetAndReadBack(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	useFlags(s)
+	auth := "Bearer " + testAdminToken
+
+	redisMock.ExpectHGetAll(testKeys.flags()).SetVal(map[string]string{})
+	if s.flags.Bool(context.Background(), "streaming_products", false) {
+		t.Fatal("expected the flag to start off")
+	}
+	redisMock.ExpectHSet(testKeys.flags(), "streaming_products", "true").SetVal(1)
+	w := flagRequestTo(s, http.MethodPut, "streaming_products", auth, `{"value":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeFlag(t, w); got != (flagResponse{Name: "streaming_products", Value: "true"}) {
+		t.Errorf("unexpected response: %+v", got)
+	}
+	// The replica that took the change uses it without waiting for a
+	// refresh, which would read the whole hash.
+	if !s.flags.Bool(context.Background(), "streaming_products", false) {
+		t.Error("expected the flag to be on at once")
+	}
+
+	redisMock.ExpectHSet(testKeys.flags(), "encoder", "v2").SetVal(1)
+	if w := flagRequestTo(s, http.MethodPut, "encoder", auth, `{"value":"v2"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected a string value to be accepted, got %d: %s", w.Code, w.Body)
+	}
+
+	redisMock.ExpectHGet(testKeys.flags(), "encoder").SetVal("v2")
+	w = flagRequestTo(s, http.MethodGet, "encoder", auth, "")
+	if got := decodeFlag(t, w); w.Code != http.StatusOK || got.Value != "v2" {
+		t.Errorf("expected v2 to read back, got %d %+v", w.Code, got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	if n := len(s.auditQueue); n != 2 {
+		t.Fatalf("expected both changes audited, got %d events", n)
+	}
+	if ev := <-s.auditQueue; ev.Action != auditFlagChanged || string(ev.Metadata) != `{"flag":"streaming_products","value":"true"}` {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestFlagHandlers_UnsetFlagIs404(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	useFlags(s)
+
+	redisMock.ExpectHGet(testKeys.flags(), "streaming_products").RedisNil()
+	w := flagRequestTo(s, http.MethodGet, "streaming_products", "Bearer "+testAdminToken, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeNotFound {
+		t.Errorf("expected code %q, got %+v", codeNotFound, got)
+	}
+}
+
+func TestFlagHandlers_RejectInvalidRequests(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	useFlags(s)
+	auth := "Bearer " + testAdminToken
+
+	for _, tt := range []struct {
+		name, body, code string
+	}{
+		{"streaming_products", `{}`, codeValidation},
+		{"streaming_products", `{"value":1}`, codeValidation},
+		{"streaming_products", `{"value":["a"]}`, codeValidation},
+		{"Streaming", `{"value":true}`, codeBadRequest},
+		{strings.Repeat("a", 65), `{"value":true}`, codeBadRequest},
+	} {
+		w := flagRequestTo(s, http.MethodPut, tt.name, auth, tt.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected 400, got %d", tt.name, tt.body, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != tt.code {
+			t.Errorf("%s %s: expected code %q, got %+v", tt.name, tt.body, tt.code, got)
+		}
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nothing written: %v", err)
+	}
+}
+
+func TestFlagHandlers_RequireAdminToken(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	useFlags(s)
+
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		if w := flagRequestTo(s, method, "streaming_products", "Bearer wrong", `{"value":true}`); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", method, w.Code)
+		}
+	}
+}
+
+func TestFlagHandlers_RedisErrorIs500(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	useFlags(s)
+
+	redisMock.ExpectHSet(testKeys.flags(), "streaming_products", "false").SetErr(errors.New("connection refused"))
+	if w := flagRequestTo(s, http.MethodPut, "streaming_products", "Bearer "+testAdminToken, `{"value":false}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if len(s.auditQueue) != 0 {
+		t.Error("expected a failed change not to be audited")
+	}
+}
+
+func TestProductsHandler_CursorPaginationFlag(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	useFlags(s)
+
+	redisMock.ExpectHGetAll(testKeys.flags()).SetVal(map[string]string{flagCursorPagination: "false"})
+	w := getPath(s, "/products?cursor=")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 with cursors turned off, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Message != "cursor pagination is disabled" {
+		t.Errorf("unexpected error %+v", got)
+	}
+}
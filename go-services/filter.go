@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go-service/store"
+)
+
+// productFilter narrows and orders GET /products.
+type productFilter store.ProductFilter
+
+// parseFilter reads q, min_price, max_price, category and sort from the
+// query string. The returned error is suitable for the client.
+func parseFilter(q url.Values) (productFilter, error) {
+	f := productFilter{Query: strings.TrimSpace(q.Get("q")), Sort: store.DefaultProductSort}
+
+	var err error
+	if f.MinPrice, err = parsePrice(q, "min_price"); err != nil {
+		return productFilter{}, err
+	}
+	if f.MaxPrice, err = parsePrice(q, "max_price"); err != nil {
+		return productFilter{}, err
+	}
+	if f.MinPrice != nil && f.MaxPrice != nil && *f.MinPrice > *f.MaxPrice {
+		return productFilter{}, errors.New("min_price must not exceed max_price")
+	}
+
+	if f.Category = q.Get("category"); f.Category != "" && !validSlug(f.Category) {
+		return productFilter{}, errors.New("category must be a category slug")
+	}
+
+	if v := q.Get("sort"); v != "" {
+		if !store.IsProductSort(v) {
+			return productFilter{}, fmt.Errorf("unknown sort %q", v)
+		}
+		f.Sort = v
+	}
+	return f, nil
+}
+
+func parsePrice(q url.Values, key string) (*float64, error) {
+	v := q.Get(key)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return nil, fmt.Errorf("%s must be a non-negative number", key)
+	}
+	return &n, nil
+}
+
+// cacheField identifies the filter within the products cache hash.
+func (f productFilter) cacheField() string {
+	v := url.Values{}
+	if f.Query != "" {
+		v.Set("q", f.Query)
+	}
+	if f.MinPrice != nil {
+		v.Set("min_price", strconv.FormatFloat(*f.MinPrice, 'g', -1, 64))
+	}
+	if f.MaxPrice != nil {
+		v.Set("max_price", strconv.FormatFloat(*f.MaxPrice, 'g', -1, 64))
+	}
+	if f.Category != "" {
+		v.Set("category", f.Category)
+	}
+	if f.Sort != store.DefaultProductSort {
+		v.Set("sort", f.Sort)
+	}
+	return v.Encode()
+}
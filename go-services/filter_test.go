@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go-service/store"
+)
+
+func TestParseFilter_Rejects(t *testing.T) {
+	t.Parallel()
+
+	for _, query := range []string{
+		"sort=" + url.QueryEscape("price;DROP TABLE products"),
+		"sort=popularity",
+		"min_price=100&max_price=10",
+		"min_price=-1",
+		"max_price=cheap",
+		"min_price=NaN",
+		"category=Garden+Tools",
+		"category=garden--tools",
+	} {
+		q, _ := url.ParseQuery(query)
+		if _, err := parseFilter(q); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+func TestProductsHandler_PassesFilterToStore(t *testing.T) {
+	t.Parallel()
+
+	ten, hundred, fiveHalf := 10.0, 100.0, 5.5
+	tests := []struct {
+		name  string
+		query string
+		want  store.ProductList
+	}{
+		{
+			name:  "search with price range and sort",
+			query: "q=chair&min_price=10&max_price=100&sort=price_desc",
+			want: store.ProductList{
+				Filter: store.ProductFilter{Query: "chair", MinPrice: &ten, MaxPrice: &hundred, Sort: "price_desc"},
+				Limit:  50,
+			},
+		},
+		{
+			name:  "max price only",
+			query: "max_price=5.5&limit=10",
+			want:  store.ProductList{Filter: store.ProductFilter{MaxPrice: &fiveHalf, Sort: "id"}, Limit: 10},
+		},
+		{
+			name:  "sort by name without filters",
+			query: "sort=name_desc&offset=20",
+			want:  store.ProductList{Filter: store.ProductFilter{Sort: "name_desc"}, Limit: 50, Offset: 20},
+		},
+		{
+			name:  "category",
+			query: "category=garden-tools",
+			want:  store.ProductList{Filter: store.ProductFilter{Category: "garden-tools", Sort: "id"}, Limit: 50},
+		},
+		{
+			name:  "search is trimmed",
+			query: "q=" + url.QueryEscape("  lamp "),
+			want:  store.ProductList{Filter: store.ProductFilter{Query: "lamp", Sort: "id"}, Limit: 50},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s, _, _ := newTestServer(t)
+
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?"+tt.query, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+			}
+			lists := testProducts(s).lists
+			if len(lists) != 1 || !reflect.DeepEqual(lists[0], tt.want) {
+				t.Errorf("expected one list of %+v, got %+v", tt.want, lists)
+			}
+		})
+	}
+}
+
+func TestProductsHandler_FiltersResults(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	now := time.Now()
+	testProducts(s).add(
+		testProduct(1, "Oak chair", 49.5, now),
+		testProduct(2, "Pine chair", 19, now),
+		testProduct(3, "Oak table", 120, now),
+	)
+
+	w := getPath(s, "/products?q=CHAIR&max_price=50&sort=price")
+	var body productPage
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Total != 2 || len(body.Items) != 2 || body.Items[0].ID != 2 || body.Items[1].ID != 1 {
+		t.Errorf("expected both chairs cheapest first, got %+v", body)
+	}
+}
+
+func TestProductsHandler_FiltersByCategory(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	now := time.Now()
+	testCategories(s).add(store.Category{ID: 1, Slug: "chairs", Name: "Chairs"}, store.Category{ID: 2, Slug: "tables", Name: "Tables"})
+	chairs, tables := &store.ProductCategory{ID: 1, Name: "Chairs"}, &store.ProductCategory{ID: 2, Name: "Tables"}
+	oak, pine, table := testProduct(1, "Oak chair", 49.5, now), testProduct(2, "Pine chair", 19, now), testProduct(3, "Oak table", 120, now)
+	oak.Category, pine.Category, table.Category = chairs, chairs, tables
+	testProducts(s).add(oak, pine, table, testProduct(4, "Lamp", 15, now))
+
+	w := getPath(s, "/products?category=chairs&q=oak")
+	var body productPage
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Total != 1 || len(body.Items) != 1 || body.Items[0].ID != 1 || *body.Items[0].Category != *chairs {
+		t.Errorf("expected only the oak chair, with its category, got %+v", body)
+	}
+}
+
+func TestProductFilter_CacheFieldIncludesCategory(t *testing.T) {
+	t.Parallel()
+
+	all := productFilter{Sort: store.DefaultProductSort}
+	chairs := all
+	chairs.Category = "chairs"
+	if all.cacheField() == chairs.cacheField() {
+		t.Errorf("expected the category filter cached apart, both are %q", all.cacheField())
+	}
+	if got := chairs.cacheField(); got != "category=chairs" {
+		t.Errorf("unexpected cache field %q", got)
+	}
+}
+
+func TestProductsHandler_RejectsBadFilters(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for _, q := range []string{"sort=rating", "min_price=9&max_price=1", "cursor=&sort=price"} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?"+q, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", q, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeBadRequest {
+			t.Errorf("%s: expected code %q, got %+v", q, codeBadRequest, got)
+		}
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+}
+
+func TestProductsHandler_MetricsLabelIgnoresQueryString(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?q=chair&sort=price", nil))
+
+	if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues("/products", "GET", "200")); got != 1 {
+		t.Errorf("expected the request labelled /products, got %v", got)
+	}
+}
@@ -0,0 +1,149 @@
+// Package flags reads feature flags from a Redis hash, so that behaviour can
+// be switched per environment without a deploy. Flags are cached in memory
+// and read again at most once per refresh interval; while Redis cannot be
+// read every flag takes its default.
+package flags
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRefresh is how long flags are cached when Config.Refresh is zero.
+const DefaultRefresh = 10 * time.Second
+
+// ErrNotSet is returned by Get for a flag that is not in the hash.
+var ErrNotSet = errors.New("flag not set")
+
+// Config configures a Flags.
+type Config struct {
+	// Key is the Redis hash holding one field per flag.
+	Key string
+	// Refresh is how long flags read from Redis are used before they are
+	// read again.
+	Refresh time.Duration
+	// Evaluations, when set, counts every lookup, labelled by the flag and
+	// the value returned.
+	Evaluations *prometheus.CounterVec
+	Logger      *slog.Logger
+}
+
+// Flags is a cached view of the flags hash. A nil *Flags has no flags set:
+// every lookup returns its default.
+type Flags struct {
+	rdb         redis.Cmdable
+	key         string
+	refresh     time.Duration
+	evaluations *prometheus.CounterVec
+	logger      *slog.Logger
+	// now is replaced in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	values   map[string]string
+	loadedAt time.Time
+}
+
+// New returns a Flags reading cfg.Key from rdb.
+func New(rdb redis.Cmdable, cfg Config) *Flags {
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = DefaultRefresh
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Flags{
+		rdb:         rdb,
+		key:         cfg.Key,
+		refresh:     cfg.Refresh,
+		evaluations: cfg.Evaluations,
+		logger:      cfg.Logger,
+		now:         time.Now,
+	}
+}
+
+// Bool returns flag name as a boolean ("true", "1", "false", "0" and the
+// other forms strconv.ParseBool accepts), or def when it is unset, not a
+// boolean, or the flags cannot be read.
+func (f *Flags) Bool(ctx context.Context, name string, def bool) bool {
+	v := def
+	if s, ok := f.lookup(ctx, name); ok {
+		if b, err := strconv.ParseBool(s); err == nil {
+			v = b
+		}
+	}
+	f.count(name, strconv.FormatBool(v))
+	return v
+}
+
+// String returns flag name, or def when it is unset or the flags cannot be
+// read.
+func (f *Flags) String(ctx context.Context, name, def string) string {
+	v, ok := f.lookup(ctx, name)
+	if !ok {
+		v = def
+	}
+	f.count(name, v)
+	return v
+}
+
+// Get reads flag name from Redis, bypassing the cache, and returns ErrNotSet
+// when it is not in the hash.
+func (f *Flags) Get(ctx context.Context, name string) (string, error) {
+	v, err := f.rdb.HGet(ctx, f.key, name).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotSet
+	}
+	return v, err
+}
+
+// Set stores flag name. It is used by this process at once, and by the
+// others on their next refresh.
+func (f *Flags) Set(ctx context.Context, name, value string) error {
+	if err := f.rdb.HSet(ctx, f.key, name, value).Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.values == nil {
+		f.values = make(map[string]string)
+	}
+	f.values[name] = value
+	return nil
+}
+
+// lookup returns flag name from the cache, reading the hash again first
+// when the cache is older than the refresh interval.
+func (f *Flags) lookup(ctx context.Context, name string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := f.now(); now.Sub(f.loadedAt) >= f.refresh {
+		values, err := f.rdb.HGetAll(ctx, f.key).Result()
+		if err != nil {
+			// Defaults until the next refresh, rather than a Redis call
+			// on every lookup while it is down.
+			f.logger.WarnContext(ctx, "Feature flags unavailable, using defaults", "key", f.key, "err", err)
+			values = nil
+		}
+		f.values, f.loadedAt = values, now
+	}
+	v, ok := f.values[name]
+	return v, ok
+}
+
+func (f *Flags) count(name, value string) {
+	if f != nil && f.evaluations != nil {
+		f.evaluations.WithLabelValues(name, value).Inc()
+	}
+}
@@ -0,0 +1,172 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testKey = "gosvc:flags"
+
+// newTestFlags returns Flags over a Redis mock, on a clock the test moves
+// by assigning to *now.
+func newTestFlags(t *testing.T) (*Flags, redismock.ClientMock, *time.Time) {
+	t.Helper()
+	rdb, mock := redismock.NewClientMock()
+	t.Cleanup(func() { rdb.Close() })
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := New(rdb, Config{
+		Key:     testKey,
+		Refresh: 10 * time.Second,
+		Evaluations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "feature_flag_evaluations_total"},
+			[]string{"flag", "value"},
+		),
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	f.now = func() time.Time { return now }
+	return f, mock, &now
+}
+
+func TestFlags_CachesUntilRefresh(t *testing.T) {
+	t.Parallel()
+	f, mock, now := newTestFlags(t)
+	ctx := context.Background()
+
+	mock.ExpectHGetAll(testKey).SetVal(map[string]string{"streaming_products": "true", "encoder": "v2"})
+	if !f.Bool(ctx, "streaming_products", false) {
+		t.Error("expected streaming_products to be on")
+	}
+	// Within the refresh interval nothing is read from Redis: the mock
+	// fails any call it does not expect.
+	*now = now.Add(9 * time.Second)
+	if got := f.String(ctx, "encoder", "v1"); got != "v2" {
+		t.Errorf("expected the cached encoder, got %q", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	*now = now.Add(time.Second)
+	mock.ExpectHGetAll(testKey).SetVal(map[string]string{"streaming_products": "0"})
+	if f.Bool(ctx, "streaming_products", true) {
+		t.Error("expected the refreshed value to turn streaming_products off")
+	}
+	if got := f.String(ctx, "encoder", "v1"); got != "v1" {
+		t.Errorf("expected a removed flag to take its default, got %q", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlags_DefaultsWhenUnsetOrInvalid(t *testing.T) {
+	t.Parallel()
+	f, mock, _ := newTestFlags(t)
+	ctx := context.Background()
+
+	mock.ExpectHGetAll(testKey).SetVal(map[string]string{"streaming_products": "maybe"})
+	if !f.Bool(ctx, "streaming_products", true) {
+		t.Error("expected a value that is not a boolean to take the default")
+	}
+	if f.Bool(ctx, "unset", false) {
+		t.Error("expected an unset flag to take the default")
+	}
+}
+
+func TestFlags_FallBackToDefaultsWhenRedisIsDown(t *testing.T) {
+	t.Parallel()
+	f, mock, now := newTestFlags(t)
+	ctx := context.Background()
+
+	mock.ExpectHGetAll(testKey).SetVal(map[string]string{"streaming_products": "true"})
+	f.Bool(ctx, "streaming_products", false)
+
+	*now = now.Add(time.Minute)
+	mock.ExpectHGetAll(testKey).SetErr(errors.New("connection refused"))
+	if f.Bool(ctx, "streaming_products", false) {
+		t.Error("expected the default while Redis is down")
+	}
+	// The failure is not retried on every lookup.
+	if f.Bool(ctx, "streaming_products", false) {
+		t.Error("expected the default until the next refresh")
+	}
+
+	*now = now.Add(10 * time.Second)
+	mock.ExpectHGetAll(testKey).SetVal(map[string]string{"streaming_products": "true"})
+	if !f.Bool(ctx, "streaming_products", false) {
+		t.Error("expected the flag back once Redis is")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlags_SetIsUsedAtOnce(t *testing.T) {
+	t.Parallel()
+	f, mock, _ := newTestFlags(t)
+	ctx := context.Background()
+
+	mock.ExpectHGetAll(testKey).SetVal(map[string]string{})
+	f.Bool(ctx, "streaming_products", false)
+
+	mock.ExpectHSet(testKey, "streaming_products", "true").SetVal(1)
+	if err := f.Set(ctx, "streaming_products", "true"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if !f.Bool(ctx, "streaming_products", false) {
+		t.Error("expected the new value without waiting for a refresh")
+	}
+
+	mock.ExpectHGet(testKey, "streaming_products").SetVal("true")
+	mock.ExpectHGet(testKey, "unset").RedisNil()
+	if v, err := f.Get(ctx, "streaming_products"); v != "true" || err != nil {
+		t.Errorf("Get: got %q, %v", v, err)
+	}
+	if _, err := f.Get(ctx, "unset"); !errors.Is(err, ErrNotSet) {
+		t.Errorf("expected ErrNotSet, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlags_CountsEvaluations(t *testing.T) {
+	t.Parallel()
+	f, mock, _ := newTestFlags(t)
+	ctx := context.Background()
+
+	mock.ExpectHGetAll(testKey).SetVal(map[string]string{"streaming_products": "1"})
+	f.Bool(ctx, "streaming_products", false)
+	f.Bool(ctx, "streaming_products", false)
+	f.String(ctx, "encoder", "v1")
+
+	for _, tt := range []struct {
+		flag, value string
+		want        float64
+	}{
+		{"streaming_products", "true", 2},
+		{"streaming_products", "false", 0},
+		{"encoder", "v1", 1},
+	} {
+		if got := testutil.ToFloat64(f.evaluations.WithLabelValues(tt.flag, tt.value)); got != tt.want {
+			t.Errorf("%s=%s: counted %v, want %v", tt.flag, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFlags_NilHasOnlyDefaults(t *testing.T) {
+	t.Parallel()
+	var f *Flags
+	if !f.Bool(context.Background(), "streaming_products", true) || f.String(context.Background(), "encoder", "v1") != "v1" {
+		t.Error("expected a nil Flags to return the defaults")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+//go:generate protoc -I proto --go_out=proto --go_opt=paths=source_relative --go-grpc_out=proto --go-grpc_opt=paths=source_relative product/v1/product.proto
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	productv1 "go-service/proto/product/v1"
+	"go-service/store"
+)
+
+// grpcHealthWatchInterval is how often a health Watch re-runs the readiness
+// checks.
+const grpcHealthWatchInterval = 5 * time.Second
+
+// GRPCServer returns the gRPC server for the GRPCAddr listener: the
+// ProductService over the same stores as the HTTP API, and the standard
+// health service answering from the /readyz checks.
+func (s *Server) GRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(s.grpcStreamInterceptor),
+	)
+	productv1.RegisterProductServiceServer(srv, grpcProducts{s: s})
+	healthpb.RegisterHealthServer(srv, grpcHealth{s: s})
+	return srv
+}
+
+// grpcProducts implements ProductService.
+type grpcProducts struct {
+	productv1.UnimplementedProductServiceServer
+	s *Server
+}
+
+func (g grpcProducts) ListProducts(ctx context.Context, req *productv1.ListProductsRequest) (*productv1.ListProductsResponse, error) {
+	limit := int(req.GetPageSize())
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if limit < 1 || limit > maxPageLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must be between 1 and %d", maxPageLimit)
+	}
+	after, err := decodeCursor(req.GetPageToken())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "page_token is invalid")
+	}
+
+	filter := productFilter{Query: strings.TrimSpace(req.GetQuery()), Sort: store.DefaultProductSort}
+	page, err := g.s.keysetPage(ctx, filter, pageParams{Limit: limit, Keyset: true, AfterID: after})
+	if err != nil {
+		return nil, g.s.grpcStoreError(ctx, err)
+	}
+	resp := &productv1.ListProductsResponse{
+		Products:      make([]*productv1.Product, len(page.Items)),
+		NextPageToken: page.NextCursor,
+	}
+	for i, p := range page.Items {
+		resp.Products[i] = productMessage(p)
+	}
+	return resp, nil
+}
+
+func (g grpcProducts) GetProduct(ctx context.Context, req *productv1.GetProductRequest) (*productv1.Product, error) {
+	if req.GetId() < 1 {
+		return nil, status.Error(codes.InvalidArgument, "id must be a positive integer")
+	}
+	p, err := g.s.products.Get(ctx, req.GetId())
+	if err != nil {
+		return nil, g.s.grpcStoreError(ctx, err)
+	}
+	return productMessage(p), nil
+}
+
+// CreateProduct validates and creates a product like POST /products,
+// including the cache invalidation and the product.created event.
+func (g grpcProducts) CreateProduct(ctx context.Context, req *productv1.CreateProductRequest) (*productv1.Product, error) {
+	in := productInput{Name: req.GetName(), Description: req.GetDescription(), Price: req.Price}
+	if err := in.validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	p, err := g.s.products.Create(ctx, in.store())
+	if err != nil {
+		return nil, g.s.grpcStoreError(ctx, err)
+	}
+	g.s.cacheInvalidate(ctx, g.s.keys.products(), g.s.keys.product(p.ID))
+	g.s.publishProductEvent(ctx, eventProductCreated, p.ID, p)
+	return productMessage(p), nil
+}
+
+func productMessage(p store.Product) *productv1.Product {
+	return &productv1.Product{
+		Id:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+		Price:       p.Price,
+		CreatedAt:   timestamppb.New(p.CreatedAt),
+	}
+}
+
+// grpcStoreError maps a store error to a gRPC status the way dbError maps
+// it to an HTTP status, logging the unexpected ones.
+func (s *Server) grpcStoreError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return status.Error(codes.NotFound, "product not found")
+	case errors.Is(err, store.ErrDuplicate):
+		return status.Error(codes.AlreadyExists, "already exists")
+	case errors.Is(err, store.ErrSerialization):
+		return status.Error(codes.Aborted, "conflicted with a concurrent request; retry it")
+	case errors.Is(err, store.ErrForeignKey):
+		return status.Error(codes.FailedPrecondition, "references a resource that does not exist")
+	case errors.Is(err, store.ErrCanceled), errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request canceled")
+	case errors.Is(err, store.ErrTimeout):
+		return status.Error(codes.DeadlineExceeded, "database timed out")
+	case errors.Is(err, errDependencyUnavailable):
+		return status.Error(codes.Unavailable, "database unavailable")
+	}
+	s.logger.ErrorContext(ctx, "DB query failed", "err", err)
+	return status.Error(codes.Internal, "database error")
+}
+
+// grpcHealth implements the standard health service. The server as a whole
+// ("") and ProductService are serving when /readyz would answer 200.
+type grpcHealth struct {
+	healthpb.UnimplementedHealthServer
+	s *Server
+}
+
+func (h grpcHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if !knownHealthService(req.GetService()) {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: h.servingStatus(ctx)}, nil
+}
+
+// Watch sends the serving status whenever it changes, checking every
+// grpcHealthWatchInterval, and NOT_SERVING once the server shuts down.
+func (h grpcHealth) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if !knownHealthService(req.GetService()) {
+		return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN})
+	}
+	ctx := stream.Context()
+	ticker := time.NewTicker(grpcHealthWatchInterval)
+	defer ticker.Stop()
+	done := h.s.events.done()
+
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if st := h.servingStatus(ctx); st != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-done:
+			return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h grpcHealth) servingStatus(ctx context.Context) healthpb.HealthCheckResponse_ServingStatus {
+	if h.s.checkReadiness(ctx).Status != "ok" {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+func knownHealthService(name string) bool {
+	return name == "" || name == productv1.ProductService_ServiceDesc.ServiceName
+}
+
+// grpcUnaryInterceptor traces, times and counts unary calls, and turns a
+// panic into an Internal error.
+func (s *Server) grpcUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	start := time.Now()
+	service, method := splitFullMethod(info.FullMethod)
+	err = s.observeGRPC(ctx, info.FullMethod, func(ctx context.Context) error {
+		resp, err = handler(ctx, req)
+		return err
+	})
+	s.metrics.grpcDuration.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// grpcStreamInterceptor traces and counts streaming calls. Like the HTTP
+// event streams they are left out of the latency histogram.
+func (s *Server) grpcStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return s.observeGRPC(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+		return handler(srv, contextStream{ServerStream: ss, ctx: ctx})
+	})
+}
+
+// observeGRPC runs call in a server span continuing the trace in the
+// incoming metadata, and counts it by status code.
+func (s *Server) observeGRPC(ctx context.Context, fullMethod string, call func(context.Context) error) (err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	service, method := splitFullMethod(fullMethod)
+	ctx, span := s.tracer.Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(method)),
+	)
+	defer span.End()
+
+	defer func() {
+		if p := recover(); p != nil {
+			s.logger.ErrorContext(ctx, "gRPC handler panicked",
+				"method", fullMethod,
+				"panic", p,
+				"stack", string(debug.Stack()),
+			)
+			err = status.Error(codes.Internal, "internal error")
+		}
+		code := status.Code(err)
+		s.metrics.grpcHandled.WithLabelValues(service, method, code.String()).Inc()
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+		if grpcServerFault(code) {
+			span.SetStatus(otelcodes.Error, code.String())
+		}
+	}()
+	return call(ctx)
+}
+
+// grpcServerFault reports whether code blames the server, the gRPC
+// counterpart of a 5xx.
+func grpcServerFault(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// splitFullMethod splits "/product.v1.ProductService/GetProduct" into its
+// service and method names.
+func splitFullMethod(fullMethod string) (service, method string) {
+	service, method, _ = strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	return service, method
+}
+
+// metadataCarrier lets the OpenTelemetry propagator read gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// contextStream is a ServerStream whose context carries the server span.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
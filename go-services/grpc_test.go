@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	productv1 "go-service/proto/product/v1"
+	"go-service/store"
+)
+
+// dialGRPC serves s.GRPCServer on an in-memory listener and returns a
+// client connection to it.
+func dialGRPC(t *testing.T, s *Server) *grpc.ClientConn {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	srv := s.GRPCServer()
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPC_GetProduct(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testProducts(s).add(testProduct(7, "Chair", 49.5, created))
+	client := productv1.NewProductServiceClient(dialGRPC(t, s))
+
+	got, err := client.GetProduct(context.Background(), &productv1.GetProductRequest{Id: 7})
+	if err != nil {
+		t.Fatalf("GetProduct: %v", err)
+	}
+	if got.GetName() != "Chair" || got.GetPrice() != 49.5 || !got.GetCreatedAt().AsTime().Equal(created) {
+		t.Errorf("unexpected product %v", got)
+	}
+
+	_, err = client.GetProduct(context.Background(), &productv1.GetProductRequest{Id: 8})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	_, err = client.GetProduct(context.Background(), &productv1.GetProductRequest{Id: 0})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+	if got := testutil.ToFloat64(s.metrics.grpcHandled.WithLabelValues("product.v1.ProductService", "GetProduct", "NotFound")); got != 1 {
+		t.Errorf("expected 1 NotFound call counted, got %v", got)
+	}
+}
+
+func TestGRPC_ListProductsPages(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).add(
+		testProduct(1, "Chair", 10, time.Now()),
+		testProduct(2, "Desk", 20, time.Now()),
+		testProduct(3, "Lamp", 30, time.Now()),
+	)
+	client := productv1.NewProductServiceClient(dialGRPC(t, s))
+
+	first, err := client.ListProducts(context.Background(), &productv1.ListProductsRequest{PageSize: 2})
+	if err != nil {
+		t.Fatalf("ListProducts: %v", err)
+	}
+	if len(first.GetProducts()) != 2 || first.GetNextPageToken() == "" {
+		t.Fatalf("expected a full first page with a token, got %v", first)
+	}
+	second, err := client.ListProducts(context.Background(), &productv1.ListProductsRequest{PageSize: 2, PageToken: first.GetNextPageToken()})
+	if err != nil {
+		t.Fatalf("ListProducts: %v", err)
+	}
+	if len(second.GetProducts()) != 1 || second.GetProducts()[0].GetId() != 3 || second.GetNextPageToken() != "" {
+		t.Errorf("expected the last product alone, got %v", second)
+	}
+
+	for _, req := range []*productv1.ListProductsRequest{
+		{PageSize: maxPageLimit + 1},
+		{PageSize: -1},
+		{PageToken: "!"},
+	} {
+		if _, err := client.ListProducts(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", req, err)
+		}
+	}
+}
+
+func TestGRPC_ListProductsUnavailable(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(errDependencyUnavailable)
+	client := productv1.NewProductServiceClient(dialGRPC(t, s))
+
+	_, err := client.ListProducts(context.Background(), &productv1.ListProductsRequest{})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected Unavailable, got %v", err)
+	}
+}
+
+func TestGRPC_CreateProduct(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(1))
+	client := productv1.NewProductServiceClient(dialGRPC(t, s))
+
+	got, err := client.CreateProduct(context.Background(), &productv1.CreateProductRequest{Name: "Chair", Price: proto.Float64(49.5)})
+	if err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	if got.GetId() == 0 || got.GetName() != "Chair" {
+		t.Errorf("unexpected product %v", got)
+	}
+	if _, err := s.products.Get(context.Background(), got.GetId()); err != nil {
+		t.Errorf("expected the product stored: %v", err)
+	}
+
+	for _, req := range []*productv1.CreateProductRequest{
+		{Name: "Chair"},
+		{Name: " ", Price: proto.Float64(1)},
+		{Name: "Chair", Price: proto.Float64(-1)},
+	} {
+		_, err := client.CreateProduct(context.Background(), req)
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", req, err)
+		}
+	}
+}
+
+func TestGRPCStoreError(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{store.ErrNotFound, codes.NotFound},
+		{store.ErrTimeout, codes.DeadlineExceeded},
+		{errDependencyUnavailable, codes.Unavailable},
+		{context.Canceled, codes.Canceled},
+		{errors.New("syntax error"), codes.Internal},
+	}
+	for _, tt := range tests {
+		if got := status.Code(s.grpcStoreError(context.Background(), tt.err)); got != tt.want {
+			t.Errorf("%v: expected %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestGRPC_HealthCheck(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	client := healthpb.NewHealthClient(dialGRPC(t, s))
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "product.v1.ProductService"})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected SERVING, got %v, %v", resp, err)
+	}
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetErr(errors.New("connection refused"))
+	resp, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expected NOT_SERVING with Redis down, got %v, %v", resp, err)
+	}
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "nope"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("expected NotFound for an unknown service, got %v", err)
+	}
+}
+
+func TestGRPC_HealthWatchEndsOnShutdown(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	client := healthpb.NewHealthClient(dialGRPC(t, s))
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected SERVING first, got %v, %v", resp, err)
+	}
+
+	s.CloseStreams()
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expected NOT_SERVING on shutdown, got %v, %v", resp, err)
+	}
+}
+
+func TestStopGRPC_CancelsAtDeadline(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	ln := bufconn.Listen(1 << 20)
+	srv := s.GRPCServer()
+	go srv.Serve(ln)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// A Watch stream outlives a graceful stop unless the streams are
+	// closed first, so the deadline has to cut it off.
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := stopGRPC(ctx, srv); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline error, got %v", err)
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Error("expected the stream to be cut off")
+	}
+}
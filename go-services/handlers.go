@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go-service/store"
+)
+
+func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.InfoContext(r.Context(), "Root endpoint called")
+	s.writeJSON(w, http.StatusOK, map[string]string{"message": "Welcome to the Go service!"})
+}
+
+func (s *Server) notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, http.StatusNotFound, codeNotFound, "not found")
+}
+
+// methodNotAllowed answers with 405 and an Allow header listing methods. GET
+// routes also serve HEAD, so it is advertised alongside them.
+func (s *Server) methodNotAllowed(methods []string) http.HandlerFunc {
+	allow := slices.Clone(methods)
+	if slices.Contains(allow, http.MethodGet) {
+		allow = append(allow, http.MethodHead)
+	}
+	header := strings.Join(allow, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", header)
+		s.writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) productsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Add("Vary", "Accept")
+
+	page, err := parsePage(r.URL.Query())
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if format := negotiateExport(r); format != nil {
+		s.exportProducts(w, r, filter, format)
+		return
+	}
+	if page.Keyset && filter.Sort != store.DefaultProductSort {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "cursor pagination only supports sorting by id")
+		return
+	}
+	if page.Keyset && !s.flags.Bool(ctx, flagCursorPagination, true) {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "cursor pagination is disabled")
+		return
+	}
+
+	field := productsCacheField(page, filter)
+	if body, etag, ok := s.cacheGetPage(ctx, field); ok {
+		writeJSONBodyTagged(w, r, body, etag)
+		return
+	}
+
+	var resp any
+	if page.Keyset {
+		resp, err = s.keysetPage(ctx, filter, page)
+	} else {
+		resp, err = s.offsetPage(ctx, filter, page)
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		if body, ok := s.staleGetField(ctx, field); ok {
+			s.metrics.staleCacheServes.WithLabelValues("products").Inc()
+			s.logger.WarnContext(ctx, "Serving stale products", "field", field)
+			w.Header().Set("X-Data-Stale", "true")
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+			writeJSONBodyTagged(w, r, body, etagFor(body))
+			return
+		}
+		s.writeDBError(w, err)
+		return
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to encode products", "err", err)
+		s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+	etag := etagFor(body)
+	s.cacheSetPage(ctx, field, body, etag)
+	s.staleSetField(ctx, field, body)
+	writeJSONBodyTagged(w, r, body, etag)
+}
+
+func (s *Server) createProductHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var in productInput
+	if !s.decodeJSON(w, r, int64(s.cfg.MaxBodyBytes), &in) {
+		return
+	}
+	if err := in.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	p, err := s.products.Create(ctx, in.store())
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB insert failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	s.cacheInvalidate(ctx, s.keys.products(), s.keys.product(p.ID))
+	s.publishProductEvent(ctx, eventProductCreated, p.ID, p)
+
+	w.Header().Set("Location", s.apiPath("/products/"+strconv.FormatInt(p.ID, 10)))
+	s.writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *Server) updateProductHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := s.productID(w, r)
+	if !ok {
+		return
+	}
+	var in productInput
+	if !s.decodeJSON(w, r, int64(s.cfg.MaxBodyBytes), &in) {
+		return
+	}
+	if err := in.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	p, err := s.products.Update(ctx, id, in.store())
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB update failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	s.cacheInvalidate(ctx, s.keys.products(), s.keys.product(id))
+	s.publishProductEvent(ctx, eventProductUpdated, id, p)
+
+	s.writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := s.productID(w, r)
+	if !ok {
+		return
+	}
+	if err := s.products.Delete(ctx, id); err != nil {
+		s.logger.ErrorContext(ctx, "DB delete failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	s.cacheInvalidate(ctx, s.keys.products(), s.keys.product(id))
+	s.publishProductEvent(ctx, eventProductDeleted, id, productRef{ID: id})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// productID parses the {id} path segment. On failure it writes a 400 and
+// returns false.
+func (s *Server) productID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "product id must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) productHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := s.productID(w, r)
+	if !ok {
+		return
+	}
+
+	key := s.keys.product(id)
+	if body, ok := s.cacheGet(ctx, "product", key); ok {
+		if bytes.Equal(body, cacheMissing) {
+			s.writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+			return
+		}
+		s.countView(id)
+		writeJSONBody(w, body)
+		return
+	}
+
+	p, err := s.products.Get(ctx, id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.cacheSetMissing(ctx, key)
+		s.writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to encode product", "err", err)
+		s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+	s.cacheSet(ctx, key, body)
+	s.countView(id)
+	writeJSONBody(w, body)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	redismock "github.com/go-redis/redismock/v9"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"go-service/store"
+)
+
+var discardLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+// testKeys is the key namespace of newTestServer, so that tests show each
+// key gets the prefix.
+var testKeys = redisKeys{prefix: "test:"}
+
+// newTestServer returns a Server backed by in-memory fake stores, with
+// sqlmock standing in for the pool the health checks ping and redismock for
+// Redis. The mocks are closed when the test finishes; testProducts and
+// testUsers return the fakes. testAdminToken signs in as an admin.
+func newTestServer(t *testing.T) (*Server, sqlmock.Sqlmock, redismock.ClientMock) {
+	t.Helper()
+
+	mockDB, mockSQL, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	mockRedis, redisMock := redismock.NewClientMock()
+
+	products := newFakeProducts()
+	s := &Server{
+		cfg:        Config{MaxBodyBytes: defaultMaxBodyBytes, BulkMaxItems: defaultBulkMaxItems, BulkMaxBytes: defaultBulkMaxBytes, AdminAuthToken: testAdminToken},
+		db:         mockDB,
+		rdb:        mockRedis,
+		logger:     discardLogger,
+		logLevel:   newLogLevelControl(new(slog.LevelVar)),
+		metrics:    newMetrics(mockDB, "test"),
+		tracer:     noop.NewTracerProvider().Tracer(""),
+		products:   products,
+		categories: fakeCategories{products},
+		users:      newFakeUsers(),
+		audits:     &fakeAudits{},
+		keys:       testKeys,
+
+		auditQueue: make(chan store.AuditEvent, auditBuffer),
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, mockSQL, redisMock
+}
+
+// asAdmin signs req in with testAdminToken, for the routes that change the
+// catalog.
+func asAdmin(req *http.Request) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+// usePostgresStores swaps the fakes for the Postgres stores over the
+// server's sqlmock pool, for tests of how the two are wired together. The
+// order and stock stores have no fakes and are only set here.
+func usePostgresStores(s *Server) {
+	pg := store.Postgres{DB: s.db, Replica: s.replica, Tracer: s.tracer, QueryDuration: s.metrics.dbQueryDuration, Errors: s.metrics.dbErrors, Logger: s.logger, QueryTimeout: s.cfg.DBQueryTimeout}
+	s.products, s.users = store.NewPostgresProducts(pg), store.NewPostgresUsers(pg)
+	s.categories = store.NewPostgresCategories(pg)
+	s.orders, s.stock = store.NewPostgresOrders(pg), store.NewPostgresStock(pg)
+}
+
+// productRowColumns are the columns of a product read, its category's
+// joined on; selectProducts matches the start of such a read.
+var productRowColumns = []string{"id", "name", "description", "price", "created_at", "id", "name"}
+
+const selectProducts = "SELECT p.id, p.name, p.description, p.price, p.created_at, c.id, c.name FROM products p LEFT JOIN categories c ON c.id = p.category_id"
+
+// expectCount expects the total-count query issued alongside a product list.
+func expectCount(mockSQL sqlmock.Sqlmock, n int64) {
+	mockSQL.ExpectQuery("SELECT COUNT\\(\\*\\) FROM products").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(n))
+}
+
+func TestProductsHandler_ReturnsProducts(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testProducts(s).add(
+		testProduct(1, "Product A", 10.99, created),
+		testProduct(2, "Product B", 5.49, created),
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	w := httptest.NewRecorder()
+	s.productsHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", w.Code)
+	}
+	var body productPage
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if len(body.Items) != 2 || body.Total != 2 {
+		t.Fatalf("expected 2 of 2 products, got %d of %d", len(body.Items), body.Total)
+	}
+	if p := body.Items[0]; p.ID != 1 || p.Name != "Product A" || p.Price == nil || *p.Price != 10.99 {
+		t.Errorf("unexpected first product: %+v", p)
+	}
+	if !body.Items[1].CreatedAt.Equal(created) {
+		t.Errorf("expected created_at %v, got %v", created, body.Items[1].CreatedAt)
+	}
+}
+
+func TestProductsHandler_EmptyTableReturnsEmptyArray(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	w := httptest.NewRecorder()
+	s.productsHandler(w, req)
+
+	want := `{"items":[],"total":0,"limit":50,"offset":0}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestProductsHandler_NullPrice(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).add(store.Product{ID: 3, Name: "Unpriced", CreatedAt: time.Now()})
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	w := httptest.NewRecorder()
+	s.productsHandler(w, req)
+
+	var body struct {
+		Items []map[string]any `json:"items"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if len(body.Items) != 1 {
+		t.Fatalf("expected 1 product, got %d", len(body.Items))
+	}
+	price, ok := body.Items[0]["price"]
+	if !ok || price != nil {
+		t.Errorf("expected price to be null, got %v (present=%v)", price, ok)
+	}
+}
+
+func TestHandler_RejectsUnsupportedMethod(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	tests := []struct {
+		method, path, allow string
+	}{
+		{http.MethodPut, "/products", "GET, POST, HEAD"},
+		{http.MethodDelete, "/healthz", "GET, HEAD"},
+		{http.MethodGet, "/login", "POST"},
+		{http.MethodPost, "/products/top", "GET, HEAD"},
+		{http.MethodPost, "/products/7", "GET, PUT, DELETE, HEAD"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expected 405, got %d", tt.method, tt.path, w.Code)
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tt.method, tt.path, tt.allow, got)
+		}
+		if got := decodeError(t, w); got.Code != codeMethodNotAllowed {
+			t.Errorf("%s %s: expected code %q, got %+v", tt.method, tt.path, codeMethodNotAllowed, got)
+		}
+	}
+}
+
+func TestHandler_UnknownPathReturnsJSON404(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nonexistent", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeNotFound {
+		t.Errorf("expected code %q, got %+v", codeNotFound, got)
+	}
+}
+
+func TestHandler_RootServesOnlyExactPath(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 for /, got %d", w.Code)
+	}
+}
+
+func TestProductHandler_ReturnsProduct(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testProducts(s).add(testProduct(7, "Product G", 3.5, created))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/7", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got store.Product
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got.ID != 7 || got.Name != "Product G" || got.Price == nil || *got.Price != 3.5 || !got.CreatedAt.Equal(created) {
+		t.Errorf("unexpected product %+v", got)
+	}
+}
+
+func TestProductHandler_NotFound(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/99", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeNotFound {
+		t.Errorf("expected code %q, got %+v", codeNotFound, got)
+	}
+}
+
+func TestProductHandler_DBTimeout(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	s.cfg.DBQueryTimeout = 20 * time.Millisecond
+	usePostgresStores(s)
+
+	mockSQL.ExpectQuery("SELECT (.+) FROM products p (.+) WHERE p.id = \\$1").
+		WithArgs(int64(7)).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows(productRowColumns))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/7", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeDBTimeout {
+		t.Errorf("expected code %q, got %+v", codeDBTimeout, got)
+	}
+}
+
+func TestProductHandler_RejectsBadID(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for _, id := range []string{"abc", "1.5", "0", "-3", "99999999999999999999"} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/"+id, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", id, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeBadRequest {
+			t.Errorf("%s: expected code %q, got %+v", id, codeBadRequest, got)
+		}
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+}
+
+func postProduct(s *Server, body string) *httptest.ResponseRecorder {
+	req := asAdmin(httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body)))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateProductHandler_Created(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	testProducts(s).add(testProduct(11, "Table", 120, time.Now()))
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(12))
+
+	w := postProduct(s, `{"name":"Chair","description":"Oak, four legs","price":49.5}`)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if loc := w.Header().Get("Location"); loc != "/v1/products/12" {
+		t.Errorf("expected Location /v1/products/12, got %q", loc)
+	}
+	var got store.Product
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got.ID != 12 || got.Name != "Chair" || got.Description != "Oak, four legs" ||
+		got.Price == nil || *got.Price != 49.5 || got.CreatedAt.IsZero() {
+		t.Errorf("unexpected product %+v", got)
+	}
+	if stored, err := s.products.Get(context.Background(), 12); err != nil || stored.Name != "Chair" {
+		t.Errorf("expected the product stored, got %+v, %v", stored, err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestCreateProductHandler_RejectsInvalidInput(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+		code string
+	}{
+		{"malformed JSON", `{"name":`, http.StatusBadRequest, codeBadRequest},
+		{"missing name", `{"price":1}`, http.StatusBadRequest, codeValidation},
+		{"blank name", `{"name":"  ","price":1}`, http.StatusBadRequest, codeValidation},
+		{"name too long", `{"name":"` + strings.Repeat("x", maxProductNameLen+1) + `","price":1}`, http.StatusBadRequest, codeValidation},
+		{"missing price", `{"name":"Chair"}`, http.StatusBadRequest, codeValidation},
+		{"negative price", `{"name":"Chair","price":-0.01}`, http.StatusBadRequest, codeValidation},
+		{"oversized body", `{"name":"` + strings.Repeat("x", defaultMaxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+	}
+	for _, tt := range tests {
+		w := postProduct(s, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != tt.code {
+			t.Errorf("%s: expected code %q, got %+v", tt.name, tt.code, got)
+		}
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+}
+
+func TestCreateProductHandler_DBError(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(errors.New("pq: connection reset by peer"))
+
+	w := postProduct(s, `{"name":"Chair","price":49.5}`)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeDBError {
+		t.Errorf("expected code %q, got %+v", codeDBError, got)
+	}
+}
+
+func putProduct(s *Server, id, body string) *httptest.ResponseRecorder {
+	req := asAdmin(httptest.NewRequest(http.MethodPut, "/products/"+id, strings.NewReader(body)))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestUpdateProductHandler_Updates(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testProducts(s).add(testProduct(4, "Chair", 49.5, created))
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(4))
+
+	w := putProduct(s, "4", `{"name":"Stool","description":"Three legs","price":20}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got store.Product
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got.ID != 4 || got.Name != "Stool" || got.Description != "Three legs" || got.Price == nil || *got.Price != 20 ||
+		!got.CreatedAt.Equal(created) {
+		t.Errorf("unexpected product %+v", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestUpdateProductHandler_NotFound(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	w := putProduct(s, "404", `{"name":"Stool","price":20}`)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeNotFound {
+		t.Errorf("expected code %q, got %+v", codeNotFound, got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected redis access: %v", err)
+	}
+}
+
+func TestUpdateProductHandler_ValidatesLikeCreate(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := putProduct(s, "4", `{"name":"Stool","price":-1}`)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeValidation {
+		t.Errorf("expected code %q, got %+v", codeValidation, got)
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+}
+
+func TestDeleteProductHandler_IsIdempotent(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	testProducts(s).add(testProduct(5, "Lamp", 15, time.Now()))
+
+	// The second delete finds nothing to remove and nothing cached, but
+	// still answers 204 and still issues the DEL.
+	for range 2 {
+		expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(5))
+
+		req := asAdmin(httptest.NewRequest(http.MethodDelete, "/products/5", nil))
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("expected an empty body, got %q", w.Body)
+		}
+	}
+	if _, err := s.products.Get(context.Background(), 5); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected the product deleted, got %v", err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	// LastError and LastSuccess are only reported with ?verbose=1. They
+	// describe the most recent failed and successful checks, which may be
+	// older than the one reported.
+	LastError   string     `json:"last_error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+	// CheckedAt is when the checks reported ran; only reported with
+	// ?verbose=1.
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+// healthCheck is a dependency check run by checkReadiness.
+type healthCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// dependencyHistory is what the last checks of a dependency found.
+type dependencyHistory struct {
+	lastError   string
+	lastSuccess time.Time
+}
+
+// healthState shares readiness results between probes: concurrent probes
+// wait for one round of checks, and its result is reused for
+// HealthCacheTTL.
+type healthState struct {
+	// now is the clock, replaced in tests; nil means time.Now.
+	now    func() time.Time
+	flight singleflight.Group
+
+	mu      sync.Mutex
+	checked time.Time
+	last    healthResponse
+	deps    map[string]dependencyHistory
+}
+
+func (h *healthState) clock() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+// cached returns the last result if it was checked less than ttl ago.
+func (h *healthState) cached(ttl time.Duration) (healthResponse, time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checked.IsZero() || h.clock().Sub(h.checked) >= ttl {
+		return healthResponse{}, time.Time{}, false
+	}
+	return h.last, h.checked, true
+}
+
+func (h *healthState) store(resp healthResponse, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checked, h.last = at, resp
+}
+
+// record notes the outcome of a check of the dependency name.
+func (h *healthState) record(name string, err error, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.deps == nil {
+		h.deps = make(map[string]dependencyHistory)
+	}
+	d := h.deps[name]
+	if err != nil {
+		d.lastError = err.Error()
+	} else {
+		d.lastSuccess = at
+	}
+	h.deps[name] = d
+}
+
+// verbose returns a copy of resp, checked at, with each dependency's
+// history.
+func (h *healthState) verbose(resp healthResponse, at time.Time) healthResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	checks := make(map[string]checkResult, len(resp.Checks))
+	for name, c := range resp.Checks {
+		if d, ok := h.deps[name]; ok {
+			c.LastError = d.lastError
+			if !d.lastSuccess.IsZero() {
+				c.LastSuccess = &d.lastSuccess
+			}
+		}
+		checks[name] = c
+	}
+	return healthResponse{Status: resp.Status, Checks: checks, CheckedAt: &at}
+}
+
+// livezHandler reports whether the process is serving. It never touches
+// dependencies so a Redis or Postgres blip can't get the pod restarted.
+func (s *Server) livezHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// readyzHandler reports whether Postgres and Redis are reachable. Each check
+// is bounded by HealthCheckTimeout so a hung dependency can't make the probe
+// outlive the kubelet deadline. During maintenance, and once shutdown
+// begins, the pod reports itself unready so that the load balancer drains
+// it. The read replica is reported
+// too but does not affect readiness, since reads fall back to the primary;
+// its check also decides whether they have to. With ?verbose=1 each check
+// also carries its last error and last success.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp, at := s.readiness(r.Context())
+	code := http.StatusOK
+	if resp.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		resp = s.health.verbose(resp, at)
+	}
+	s.writeJSON(w, code, resp)
+}
+
+// checkReadiness runs the readiness checks behind /readyz and the gRPC
+// health service. Status is "ok" when the pod should receive traffic and
+// "unavailable" otherwise.
+func (s *Server) checkReadiness(ctx context.Context) healthResponse {
+	resp, _ := s.readiness(ctx)
+	return resp
+}
+
+// readiness returns the readiness result and when its checks ran. A result
+// younger than HealthCacheTTL is reused; otherwise the checks run once for
+// every caller waiting on them. They run detached from ctx, so that a probe
+// giving up does not fail them for the others, and are bounded by
+// HealthCheckTimeout instead. Once Drain was called the pod is unready
+// whatever the checks would say.
+func (s *Server) readiness(ctx context.Context) (healthResponse, time.Time) {
+	if s.draining.Load() {
+		return drainingReadiness(), s.health.clock()
+	}
+	if resp, at, ok := s.health.cached(s.cfg.HealthCacheTTL); ok {
+		return resp, at
+	}
+
+	ch := s.health.flight.DoChan("readiness", func() (any, error) {
+		res := checkedReadiness{at: s.health.clock()}
+		res.resp = s.runReadinessChecks(context.WithoutCancel(ctx))
+		s.health.store(res.resp, res.at)
+		return res, nil
+	})
+	select {
+	case res := <-ch:
+		checked := res.Val.(checkedReadiness)
+		return checked.resp, checked.at
+	case <-ctx.Done():
+		return healthResponse{Status: "unavailable"}, s.health.clock()
+	}
+}
+
+// checkedReadiness is a readiness result and when its checks ran.
+type checkedReadiness struct {
+	resp healthResponse
+	at   time.Time
+}
+
+// runReadinessChecks checks every dependency, concurrently, so that the
+// slowest check rather than their sum bounds the probe.
+func (s *Server) runReadinessChecks(ctx context.Context) healthResponse {
+	checks := []healthCheck{
+		{"database", s.db.PingContext},
+		{"redis", func(ctx context.Context) error {
+			return s.rdb.Ping(ctx).Err()
+		}},
+	}
+	if s.replica != nil {
+		checks = append(checks, healthCheck{"database_replica", s.replica.Ping})
+	}
+	results := s.runChecks(ctx, checks)
+	if s.currentMaintenance(ctx).active {
+		results["maintenance"] = checkResult{Status: "active"}
+	}
+
+	resp := healthResponse{Status: "ok", Checks: results}
+	for name, c := range results {
+		if c.Status != "ok" && name != "database_replica" {
+			resp.Status = "unavailable"
+		}
+	}
+
+	s.logger.InfoContext(ctx, "Health check", "status", resp.Status, "checks", results)
+	return resp
+}
+
+// runChecks runs checks concurrently and returns their results by name.
+func (s *Server) runChecks(ctx context.Context, checks []healthCheck) map[string]checkResult {
+	results := make([]checkResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.runCheck(ctx, c.name, c.check)
+		}()
+	}
+	wg.Wait()
+
+	byName := make(map[string]checkResult, len(checks))
+	for i, c := range checks {
+		byName[c.name] = results[i]
+	}
+	return byName
+}
+
+func (s *Server) runCheck(ctx context.Context, name string, check func(context.Context) error) checkResult {
+	if s.cfg.HealthCheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.HealthCheckTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := check(ctx)
+	res := checkResult{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = "unreachable"
+		s.logger.WarnContext(ctx, "Dependency check failed", "check", name, "err", err)
+	}
+	s.health.record(name, err, s.health.clock())
+	return res
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+
+	"go-service/store"
+)
+
+func decodeHealth(t *testing.T, w *httptest.ResponseRecorder) healthResponse {
+	t.Helper()
+	var body healthResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	return body
+}
+
+func TestHealthHandler_MockDBRedis(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+
+	// create test HTTP request
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w := httptest.NewRecorder()
+
+	// call handler
+	s.readyzHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 OK, got %d", w.Code)
+	}
+
+	body := decodeHealth(t, w)
+	if body.Checks["database"].Status != "ok" {
+		t.Errorf("expected database to be ok, got %s", body.Checks["database"].Status)
+	}
+	if body.Checks["redis"].Status != "ok" {
+		t.Errorf("expected redis to be ok, got %s", body.Checks["redis"].Status)
+	}
+	if body.Checks["database"].LatencyMS < 0 {
+		t.Errorf("expected a latency, got %v", body.Checks["database"].LatencyMS)
+	}
+}
+
+func TestReadyzHandler_RedisDown(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetErr(errors.New("connection refused"))
+
+	w := httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	body := decodeHealth(t, w)
+	if body.Checks["database"].Status != "ok" || body.Checks["redis"].Status != "unreachable" {
+		t.Errorf("unexpected checks: %+v", body.Checks)
+	}
+}
+
+func TestReadyzHandler_BothDown(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+
+	mockSQL.ExpectPing().WillReturnError(errors.New("connection refused"))
+	redisMock.ExpectPing().SetErr(errors.New("connection refused"))
+
+	w := httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	body := decodeHealth(t, w)
+	if body.Status != "unavailable" || body.Checks["database"].Status != "unreachable" || body.Checks["redis"].Status != "unreachable" {
+		t.Errorf("unexpected body: %+v", body)
+	}
+}
+
+func TestReadyzHandler_SlowPingTimesOut(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	s.cfg.HealthCheckTimeout = 50 * time.Millisecond
+
+	mockSQL.ExpectPing().WillDelayFor(5 * time.Second)
+	redisMock.ExpectPing().SetVal("PONG")
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("probe hung for %v despite the check timeout", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if body := decodeHealth(t, w); body.Checks["database"].Status != "unreachable" {
+		t.Errorf("expected database to be unreachable, got %+v", body.Checks)
+	}
+}
+
+func TestLivezHandler_IgnoresDependencies(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.livezHandler(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected DB call: %v", err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected Redis call: %v", err)
+	}
+}
+
+func TestReadyzHandler_ReportsReplicaWithoutFailingReadiness(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	replicaDB, replicaSQL, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	s.replica = store.NewReplica(replicaDB, time.Minute)
+	usePostgresStores(s)
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	replicaSQL.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+	w := httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with only the replica down, got %d", w.Code)
+	}
+	body := decodeHealth(t, w)
+	if body.Status != "ok" || body.Checks["database"].Status != "ok" || body.Checks["database_replica"].Status != "unreachable" {
+		t.Errorf("unexpected health %+v", body)
+	}
+
+	// The failed check sends product reads to the primary.
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.id").
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(1, "Chair", "", 49.5, time.Now(), nil, nil))
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the primary to serve the read, got %d: %s", w.Code, w.Body)
+	}
+	if err := replicaSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet replica expectations: %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet primary expectations: %v", err)
+	}
+}
+
+func TestReadyzHandler_CachesResultWithinTTL(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	s.cfg.HealthCacheTTL = 2 * time.Second
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.health.now = func() time.Time { return now }
+
+	probe := func() int {
+		w := httptest.NewRecorder()
+		s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	// Within the TTL no check runs; an unexpected ping would fail.
+	now = now.Add(2*time.Second - time.Millisecond)
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("expected the cached 200, got %d", code)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	now = now.Add(time.Millisecond)
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetErr(errors.New("connection refused"))
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the checks to run again once the TTL passed, got %d", code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadyzHandler_ConcurrentProbesShareOneCheck(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+
+	// One ping each: a probe running checks of its own would find no
+	// expectation left and report the dependency unreachable.
+	mockSQL.ExpectPing().WillDelayFor(100 * time.Millisecond)
+	redisMock.ExpectPing().SetVal("PONG")
+
+	const probes = 5
+	codes := make(chan int, probes)
+	for range probes {
+		go func() {
+			w := httptest.NewRecorder()
+			s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			codes <- w.Code
+		}()
+	}
+	for range probes {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected every probe to get the shared 200, got %d", code)
+		}
+	}
+}
+
+func TestRunChecks_RunsConcurrently(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.HealthCheckTimeout = time.Second
+
+	// Each check waits for the others to start, so run one after another
+	// they would all time out.
+	var started sync.WaitGroup
+	started.Add(3)
+	check := func(ctx context.Context) error {
+		started.Done()
+		done := make(chan struct{})
+		go func() {
+			started.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	start := time.Now()
+	results := s.runChecks(context.Background(), []healthCheck{{"a", check}, {"b", check}, {"c", check}})
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("checks took %v, as long as a timeout", elapsed)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if results[name].Status != "ok" {
+			t.Errorf("%s: expected ok, got %+v", name, results[name])
+		}
+	}
+}
+
+func TestReadyzHandler_VerboseReportsHistory(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.health.now = func() time.Time { return now }
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	s.readyzHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	now = now.Add(time.Minute)
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetErr(errors.New("connection refused"))
+	w := httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz?verbose=1", nil))
+
+	body := decodeHealth(t, w)
+	if body.CheckedAt == nil || !body.CheckedAt.Equal(now) {
+		t.Errorf("expected checked_at %v, got %v", now, body.CheckedAt)
+	}
+	redis := body.Checks["redis"]
+	if redis.Status != "unreachable" || redis.LastError != "connection refused" || redis.LastSuccess == nil || !redis.LastSuccess.Equal(now.Add(-time.Minute)) {
+		t.Errorf("unexpected redis check %+v", redis)
+	}
+	if db := body.Checks["database"]; db.LastError != "" || db.LastSuccess == nil || !db.LastSuccess.Equal(now) {
+		t.Errorf("unexpected database check %+v", db)
+	}
+
+	// Without verbose the history is left out.
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	w = httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if body := decodeHealth(t, w); body.CheckedAt != nil || body.Checks["redis"].LastError != "" {
+		t.Errorf("expected no history without verbose, got %+v", body)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthcheckTimeout bounds the whole -healthcheck probe, well inside the
+// Docker HEALTHCHECK default of 30s.
+const healthcheckTimeout = 3 * time.Second
+
+// runHealthcheck probes the readiness endpoint of a service listening on
+// addr and returns the process exit code: 0 when ready, 1 otherwise. It
+// backs the -healthcheck flag, which lets distroless images without a shell
+// or curl define a HEALTHCHECK, and so must not touch the database, Redis
+// or the tracer.
+func runHealthcheck(w io.Writer, addr string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), healthcheckTimeout)
+	defer cancel()
+
+	if err := checkReady(ctx, http.DefaultClient, healthcheckURL(addr)); err != nil {
+		fmt.Fprintln(w, "unhealthy:", err)
+		return 1
+	}
+	return 0
+}
+
+// healthcheckAddr returns the listener the -healthcheck probe targets: the
+// internal one unless INTERNAL_ADDR disables it, since it never uses TLS,
+// otherwise the public one.
+func healthcheckAddr(lookup func(string) (string, bool)) string {
+	e := &envReader{lookup: lookup}
+	if addr := e.optional("INTERNAL_ADDR", defaultInternalAddr); addr != "" {
+		return addr
+	}
+	return e.str("HTTP_ADDR", defaultHTTPAddr)
+}
+
+// healthcheckURL returns the /readyz URL for a listener bound to addr,
+// dialing localhost when addr does not name a specific host.
+func healthcheckURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "", addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/readyz"
+}
+
+// checkReady GETs url and fails unless it answers 200.
+func checkReady(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunHealthcheck_Healthy(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	s.cfg.HealthCheckTimeout = defaultHealthTimeout
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	var out bytes.Buffer
+	if code := runHealthcheck(&out, srv.Listener.Addr().String()); code != 0 {
+		t.Errorf("expected exit code 0, got %d: %s", code, out.String())
+	}
+}
+
+func TestRunHealthcheck_Unhealthy(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	s.cfg.HealthCheckTimeout = defaultHealthTimeout
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetErr(errors.New("connection refused"))
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	var out bytes.Buffer
+	if code := runHealthcheck(&out, srv.Listener.Addr().String()); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(out.String(), "503") {
+		t.Errorf("expected the status in the output, got %q", out.String())
+	}
+}
+
+func TestRunHealthcheck_NothingListening(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	if code := runHealthcheck(&bytes.Buffer{}, addr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+}
+
+func TestHealthcheckURL(t *testing.T) {
+	t.Parallel()
+
+	for addr, want := range map[string]string{
+		":8080":          "http://localhost:8080/readyz",
+		"0.0.0.0:8080":   "http://localhost:8080/readyz",
+		"[::]:8080":      "http://localhost:8080/readyz",
+		"127.0.0.1:9000": "http://127.0.0.1:9000/readyz",
+		"[::1]:9000":     "http://[::1]:9000/readyz",
+		"8080":           "http://localhost:8080/readyz",
+	} {
+		if got := healthcheckURL(addr); got != want {
+			t.Errorf("healthcheckURL(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestHealthcheckAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{}, defaultInternalAddr},
+		{map[string]string{"INTERNAL_ADDR": ":9999", "HTTP_ADDR": ":8443"}, ":9999"},
+		{map[string]string{"INTERNAL_ADDR": "", "HTTP_ADDR": ":8443"}, ":8443"},
+		{map[string]string{"INTERNAL_ADDR": ""}, defaultHTTPAddr},
+	}
+	for _, tt := range tests {
+		if got := healthcheckAddr(lookupFrom(tt.env)); got != tt.want {
+			t.Errorf("healthcheckAddr(%v) = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Package httpclient is the HTTP client for calls to other services. It
+// bounds every call in time, retries idempotent requests that fail
+// transiently, propagates the caller's trace, and times each attempt by
+// destination.
+package httpclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Defaults for the zero fields of Config.
+const (
+	DefaultConnectTimeout   = 2 * time.Second
+	DefaultTimeout          = 5 * time.Second
+	DefaultMaxRetries       = 2
+	DefaultRetryBackoff     = 100 * time.Millisecond
+	DefaultMaxResponseBytes = 1 << 20
+)
+
+// maxRetryBackoff caps the wait before a retry however many came before it.
+const maxRetryBackoff = 2 * time.Second
+
+// ErrResponseTooLarge is returned by GetJSON for a body over
+// Config.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// StatusError is returned by GetJSON for a response that is not a 2xx.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Config configures a Client. Zero fields take the defaults above.
+type Config struct {
+	// ConnectTimeout bounds establishing a connection, TLS included.
+	ConnectTimeout time.Duration
+	// Timeout bounds a whole call, retries and reading the body included.
+	Timeout time.Duration
+	// MaxRetries is how many times a failed idempotent request is retried;
+	// a negative value disables retries.
+	MaxRetries int
+	// RetryBackoff is the base of the jittered, exponential wait between
+	// attempts.
+	RetryBackoff time.Duration
+	// MaxResponseBytes bounds the bodies GetJSON reads.
+	MaxResponseBytes int64
+	// Duration, when set, is observed once per attempt, labelled by the
+	// target host.
+	Duration *prometheus.HistogramVec
+}
+
+// Client is an *http.Client configured for calls to other services.
+type Client struct {
+	*http.Client
+	maxResponseBytes int64
+}
+
+// New returns a Client configured by cfg.
+func New(cfg Config) *Client {
+	cfg = withDefaults(cfg)
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	base.TLSHandshakeTimeout = cfg.ConnectTimeout
+
+	// Retries wrap the tracing transport, so each attempt gets its own
+	// span and its own traceparent.
+	var next http.RoundTripper = base
+	if cfg.Duration != nil {
+		next = timedTransport{next: next, duration: cfg.Duration}
+	}
+	next = otelhttp.NewTransport(next)
+	if cfg.MaxRetries > 0 {
+		next = retryTransport{next: next, retries: cfg.MaxRetries, backoff: cfg.RetryBackoff}
+	}
+	return &Client{
+		Client:           &http.Client{Transport: next, Timeout: cfg.Timeout},
+		maxResponseBytes: cfg.MaxResponseBytes,
+	}
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	if cfg.MaxResponseBytes <= 0 {
+		cfg.MaxResponseBytes = DefaultMaxResponseBytes
+	}
+	return cfg
+}
+
+// GetJSON fetches url and decodes its JSON body into out. It fails with a
+// *StatusError for a response other than 2xx and with ErrResponseTooLarge
+// for a body over the client's limit.
+func (c *Client) GetJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.maxResponseBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > c.maxResponseBytes {
+		return ErrResponseTooLarge
+	}
+	return json.Unmarshal(body, out)
+}
+
+// timedTransport observes the duration of every round trip by target host.
+type timedTransport struct {
+	next     http.RoundTripper
+	duration *prometheus.HistogramVec
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	t.duration.WithLabelValues(req.URL.Host).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// retryTransport retries idempotent requests that fail to connect or get a
+// 5xx, waiting a jittered, exponentially growing backoff between attempts.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) {
+		return t.next.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt == t.retries || !retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			// Drain so the connection can be reused.
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), t.wait(attempt)); err != nil {
+			return nil, err
+		}
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait returns the backoff before retry attempt+1: a random duration up to
+// backoff doubled once per earlier attempt, capped at maxRetryBackoff.
+func (t retryTransport) wait(attempt int) time.Duration {
+	d := min(t.backoff<<attempt, maxRetryBackoff)
+	return rand.N(d) + 1
+}
+
+// idempotent reports whether req may be sent more than once. Its body, if
+// any, must be replayable.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+// retryable reports whether an attempt that ended with resp and err is
+// worth repeating: it failed to get a response, or got a 5xx.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500
+}
+
+// rewind returns req ready to be sent again, with a fresh body.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
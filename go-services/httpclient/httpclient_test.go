@@ -0,0 +1,214 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMain(m *testing.M) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	os.Exit(m.Run())
+}
+
+// newTestClient returns a Client with short timeouts and backoff.
+func newTestClient(cfg Config) *Client {
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = time.Millisecond
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second
+	}
+	return New(cfg)
+}
+
+// failFirst returns a server answering the first n requests with status
+// and the rest with body, and a count of the requests it served.
+func failFirst(t *testing.T, n int32, status int, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= n {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestGetJSON_RetriesServerErrors(t *testing.T) {
+	t.Parallel()
+	srv, hits := failFirst(t, 2, http.StatusServiceUnavailable, `{"stock":3}`)
+
+	var out struct{ Stock int }
+	if err := newTestClient(Config{}).GetJSON(context.Background(), srv.URL, &out); err != nil {
+		t.Fatalf("GetJSON: %v", err)
+	}
+	if out.Stock != 3 || hits.Load() != 3 {
+		t.Errorf("expected stock 3 after 3 attempts, got %d after %d", out.Stock, hits.Load())
+	}
+}
+
+func TestGetJSON_GivesUpAfterMaxRetries(t *testing.T) {
+	t.Parallel()
+	srv, hits := failFirst(t, 10, http.StatusBadGateway, `{}`)
+
+	var out struct{}
+	err := newTestClient(Config{MaxRetries: 1}).GetJSON(context.Background(), srv.URL, &out)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a 502 StatusError, got %v", err)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected 2 attempts, got %d", hits.Load())
+	}
+}
+
+func TestClient_DoesNotRetryClientErrorsOrPosts(t *testing.T) {
+	t.Parallel()
+	notFound, notFoundHits := failFirst(t, 10, http.StatusNotFound, `{}`)
+	unavailable, postHits := failFirst(t, 10, http.StatusServiceUnavailable, `{}`)
+	c := newTestClient(Config{})
+
+	var out struct{}
+	if err := c.GetJSON(context.Background(), notFound.URL, &out); err == nil {
+		t.Error("expected an error for a 404")
+	}
+	resp, err := c.Post(unavailable.URL, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+
+	if notFoundHits.Load() != 1 || postHits.Load() != 1 {
+		t.Errorf("expected one attempt each, got %d for the 404 and %d for the POST", notFoundHits.Load(), postHits.Load())
+	}
+}
+
+func TestGetJSON_RetriesConnectionErrors(t *testing.T) {
+	t.Parallel()
+	// A listener that hangs up on every connection.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+
+	var out struct{}
+	if err := newTestClient(Config{}).GetJSON(context.Background(), "http://"+ln.Addr().String(), &out); err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if got := accepted.Load(); got != 1+DefaultMaxRetries {
+		t.Errorf("expected %d attempts, got %d", 1+DefaultMaxRetries, got)
+	}
+}
+
+func TestGetJSON_Timeout(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	var out struct{}
+	err := newTestClient(Config{Timeout: 50 * time.Millisecond}).GetJSON(context.Background(), srv.URL, &out)
+	if err == nil || !os.IsTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the call to end at the timeout, took %v", elapsed)
+	}
+}
+
+func TestGetJSON_LimitsResponseSize(t *testing.T) {
+	t.Parallel()
+	srv, _ := failFirst(t, 0, 0, `{"name":"`+strings.Repeat("x", 100)+`"}`)
+
+	var out struct{ Name string }
+	err := newTestClient(Config{MaxResponseBytes: 64}).GetJSON(context.Background(), srv.URL, &out)
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("expected ErrResponseTooLarge, got %v", err)
+	}
+}
+
+func TestClient_PropagatesTrace(t *testing.T) {
+	t.Parallel()
+	traceparent := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	var out struct{}
+	if err := newTestClient(Config{}).GetJSON(ctx, srv.URL, &out); err != nil {
+		t.Fatalf("GetJSON: %v", err)
+	}
+	if got := <-traceparent; !strings.HasPrefix(got, "00-"+traceID.String()+"-") {
+		t.Errorf("expected the caller's trace in traceparent, got %q", got)
+	}
+}
+
+func TestClient_TimesAttemptsByTarget(t *testing.T) {
+	t.Parallel()
+	srv, _ := failFirst(t, 1, http.StatusInternalServerError, `{}`)
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "outbound_request_duration_seconds"}, []string{"target"})
+
+	var out struct{}
+	if err := newTestClient(Config{Duration: duration}).GetJSON(context.Background(), srv.URL, &out); err != nil {
+		t.Fatalf("GetJSON: %v", err)
+	}
+	target := strings.TrimPrefix(srv.URL, "http://")
+	if n := testutil.CollectAndCount(duration); n != 1 {
+		t.Fatalf("expected one target series, got %d", n)
+	}
+	var pb dto.Metric
+	if err := duration.WithLabelValues(target).(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	if got := pb.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("expected both attempts timed under %s, got %d", target, got)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// maxIdempotencyKeyLen bounds the Idempotency-Key header.
+	maxIdempotencyKeyLen = 255
+	// idempotencyPendingMin and idempotencyPendingMargin set how long a key
+	// stays claimed by a request that has not finished; see
+	// idempotencyPendingTTL.
+	idempotencyPendingMin    = time.Minute
+	idempotencyPendingMargin = 30 * time.Second
+	// idempotencyWait is how long a retry waits for a request with the same
+	// key to finish before giving up with 409.
+	idempotencyWait = time.Second
+	// idempotencyPoll is how often the waiting retry checks.
+	idempotencyPoll = 50 * time.Millisecond
+)
+
+// idempotencyReplayHeaders are the response headers stored and replayed
+// along with the body.
+var idempotencyReplayHeaders = []string{"Content-Type", "Location"}
+
+// idempotentResponse is what is stored under an Idempotency-Key. Status is
+// zero while the first request is still running.
+type idempotentResponse struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Status int               `json:"status,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty"`
+}
+
+func (r idempotentResponse) matches(req *http.Request) bool {
+	return r.Method == req.Method && r.Path == req.URL.Path
+}
+
+// withIdempotency makes retries of a write that carry the same
+// Idempotency-Key header return the first response instead of running the
+// handler again. Keys are scoped to the caller, so two callers picking the
+// same key do not see each other's responses. The first request claims the key with SET NX; a retry that
+// arrives while it runs waits up to idempotencyWait and then gets 409.
+// Responses are kept for IdempotencyTTL, except 5xx responses, which release
+// the key so the client can try again. If Redis is unavailable the request
+// runs without protection.
+func (s *Server) withIdempotency(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || s.cfg.IdempotencyTTL <= 0 {
+			handler(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "Idempotency-Key must be 1 to 255 printable ASCII characters")
+			return
+		}
+
+		ctx := r.Context()
+		redisKey := s.keys.idempotency(idempotencyCaller(r), key)
+		pending, _ := json.Marshal(idempotentResponse{Method: r.Method, Path: r.URL.Path})
+		claimed, err := s.rdb.SetNX(ctx, redisKey, string(pending), s.idempotencyPendingTTL()).Result()
+		if err != nil {
+			s.logger.WarnContext(ctx, "Idempotency key claim failed; running request unprotected", "err", err)
+			handler(w, r)
+			return
+		}
+		if !claimed {
+			s.replayIdempotent(w, r, redisKey)
+			return
+		}
+
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+
+		// The response is kept even if the client has gone away, since
+		// that is exactly when it will retry.
+		ctx = context.WithoutCancel(ctx)
+		if rec.status >= http.StatusInternalServerError {
+			if err := s.rdb.Del(ctx, redisKey).Err(); err != nil {
+				s.logger.WarnContext(ctx, "Failed to release idempotency key", "err", err)
+			}
+			return
+		}
+		stored := idempotentResponse{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Status: rec.status,
+			Header: make(map[string]string),
+			Body:   rec.body.Bytes(),
+		}
+		for _, h := range idempotencyReplayHeaders {
+			if v := rec.Header().Get(h); v != "" {
+				stored.Header[h] = v
+			}
+		}
+		body, err := json.Marshal(stored)
+		if err == nil {
+			err = s.rdb.Set(ctx, redisKey, string(body), s.cfg.IdempotencyTTL).Err()
+		}
+		if err != nil {
+			s.logger.WarnContext(ctx, "Failed to store idempotent response", "err", err)
+		}
+	}
+}
+
+// idempotencyPendingTTL is how long a key stays claimed by a request that
+// has not finished. It only matters if the replica dies mid-request, and
+// outlasts RequestTimeout by idempotencyPendingMargin so that a slow request
+// is not run twice.
+func (s *Server) idempotencyPendingTTL() time.Duration {
+	return max(idempotencyPendingMin, s.cfg.RequestTimeout+idempotencyPendingMargin)
+}
+
+// replayIdempotent answers a request whose key is already claimed, waiting
+// briefly if the first request is still running.
+func (s *Server) replayIdempotent(w http.ResponseWriter, r *http.Request, redisKey string) {
+	ctx := r.Context()
+	deadline := time.Now().Add(idempotencyWait)
+	for {
+		stored, err := s.loadIdempotent(ctx, redisKey)
+		switch {
+		case errors.Is(err, redis.Nil):
+			// The first request failed and released the key, or it expired,
+			// between our claim and this read; the client should retry.
+		case err != nil:
+			s.logger.ErrorContext(ctx, "Idempotency lookup failed", "err", err)
+			s.writeInternalError(w, err)
+			return
+		case !stored.matches(r):
+			s.writeError(w, http.StatusConflict, codeConflict, "Idempotency-Key was already used for a different request")
+			return
+		case stored.Status != 0:
+			for h, v := range stored.Header {
+				w.Header().Set(h, v)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			_, _ = w.Write(stored.Body)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(idempotencyPoll):
+		}
+	}
+	w.Header().Set("Retry-After", retryAfterSeconds(idempotencyWait))
+	s.writeError(w, http.StatusConflict, codeConflict, "a request with this Idempotency-Key is in progress; retry later")
+}
+
+func (s *Server) loadIdempotent(ctx context.Context, redisKey string) (idempotentResponse, error) {
+	var stored idempotentResponse
+	raw, err := s.rdb.Get(ctx, redisKey).Bytes()
+	if err != nil {
+		return stored, err
+	}
+	err = json.Unmarshal(raw, &stored)
+	return stored, err
+}
+
+// idempotencyCaller hashes the credentials r acts with, the Authorization
+// header and the cart cookie, so that a key is only ever replayed to the
+// caller that sent it. Anonymous callers without a cart share one scope.
+func idempotencyCaller(r *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(r.Header.Get("Authorization")))
+	h.Write([]byte{0})
+	if c, err := r.Cookie(cartCookie); err == nil {
+		h.Write([]byte(c.Value))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	return !strings.ContainsFunc(key, func(c rune) bool { return c < 0x21 || c > 0x7e })
+}
+
+// responseCapture passes a response through while keeping a copy of its
+// status and body.
+type responseCapture struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.status = code
+		c.wroteHeader = true
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.wroteHeader = true
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
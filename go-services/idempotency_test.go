@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	redismock "github.com/go-redis/redismock/v9"
+)
+
+const (
+	testIdemKey    = "import-42"
+	testIdemBody   = `{"name":"Chair","price":49.5}`
+	pendingProduct = `{"method":"POST","path":"/products"}`
+)
+
+// testIdemRedis is where testIdemKey is stored for an admin.
+var testIdemRedis = testKeys.idempotency(idempotencyCaller(asAdmin(httptest.NewRequest(http.MethodPost, "/products", nil))), testIdemKey)
+
+// newIdempotencyServer returns a server whose next created product gets
+// id 12.
+func newIdempotencyServer(t *testing.T) (*Server, *fakeProducts, redismock.ClientMock) {
+	t.Helper()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.IdempotencyTTL = 24 * time.Hour
+	products := testProducts(s)
+	products.add(testProduct(11, "Desk", 120, time.Now()))
+	return s, products, redisMock
+}
+
+func postProductWithKey(s *Server, key, body string) *httptest.ResponseRecorder {
+	req := asAdmin(httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+// expectCreate expects the cache invalidation behind one successful POST
+// /products, creating the product id.
+func expectCreate(redisMock redismock.ClientMock, id int64) {
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(id))
+}
+
+func storedProduct(t *testing.T, status int, header map[string]string, body string) string {
+	t.Helper()
+	raw, err := json.Marshal(idempotentResponse{Method: http.MethodPost, Path: "/products", Status: status, Header: header, Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestIdempotency_RetryReplaysStoredResponse(t *testing.T) {
+	t.Parallel()
+	s, products, redisMock := newIdempotencyServer(t)
+
+	redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetVal(true)
+	expectCreate(redisMock, 12)
+	redisMock.Regexp().ExpectSet(testIdemRedis, `"status":201`, 24*time.Hour).SetVal("OK")
+
+	first := postProductWithKey(s, testIdemKey, testIdemBody)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", first.Code, first.Body)
+	}
+
+	stored := storedProduct(t, first.Code, map[string]string{
+		"Content-Type": first.Header().Get("Content-Type"),
+		"Location":     first.Header().Get("Location"),
+	}, first.Body.String())
+	redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetVal(false)
+	redisMock.ExpectGet(testIdemRedis).SetVal(stored)
+
+	retry := postProductWithKey(s, testIdemKey, testIdemBody)
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("expected the stored 201 replayed, got %d %q", retry.Code, retry.Body)
+	}
+	if got := retry.Header().Get("Location"); got != "/v1/products/12" {
+		t.Errorf("expected the stored Location, got %q", got)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected the replay to be marked")
+	}
+	if n := products.callCount(); n != 1 {
+		t.Errorf("expected only the first request to insert, got %d store calls", n)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestIdempotency_ConcurrentRetryWaitsForWinner(t *testing.T) {
+	t.Parallel()
+	s, products, redisMock := newIdempotencyServer(t)
+
+	// Another request holds the key and finishes while this one waits.
+	redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetVal(false)
+	redisMock.ExpectGet(testIdemRedis).SetVal(pendingProduct)
+	redisMock.ExpectGet(testIdemRedis).SetVal(pendingProduct)
+	redisMock.ExpectGet(testIdemRedis).SetVal(storedProduct(t, http.StatusCreated,
+		map[string]string{"Content-Type": "application/json"}, `{"id":12}`))
+
+	w := postProductWithKey(s, testIdemKey, testIdemBody)
+	if w.Code != http.StatusCreated || w.Body.String() != `{"id":12}` {
+		t.Errorf("expected the winner's response, got %d %q", w.Code, w.Body)
+	}
+	if n := products.callCount(); n != 0 {
+		t.Errorf("expected the loser not to touch the DB, got %d store calls", n)
+	}
+}
+
+func TestIdempotency_ConcurrentRetryGivesUpWith409(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newIdempotencyServer(t)
+
+	redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetVal(false)
+	for range 2 * int(idempotencyWait/idempotencyPoll) {
+		redisMock.ExpectGet(testIdemRedis).SetVal(pendingProduct)
+	}
+
+	start := time.Now()
+	w := postProductWithKey(s, testIdemKey, testIdemBody)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeConflict || !strings.Contains(got.Message, "retry later") {
+		t.Errorf("unexpected error %+v", got)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After 1, got %q", w.Header().Get("Retry-After"))
+	}
+	if waited := time.Since(start); waited < idempotencyWait {
+		t.Errorf("expected to wait %v for the winner, waited %v", idempotencyWait, waited)
+	}
+}
+
+func TestIdempotency_ExpiredKeyRunsAgain(t *testing.T) {
+	t.Parallel()
+	s, products, redisMock := newIdempotencyServer(t)
+
+	for id := range int64(2) {
+		// Once the stored response has expired the key can be claimed again.
+		redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetVal(true)
+		expectCreate(redisMock, 12+id)
+		redisMock.Regexp().ExpectSet(testIdemRedis, `"status":201`, 24*time.Hour).SetVal("OK")
+		if w := postProductWithKey(s, testIdemKey, testIdemBody); w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+		}
+	}
+	if n := products.callCount(); n != 2 {
+		t.Errorf("expected both requests to insert, got %d store calls", n)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestIdempotency_ServerErrorReleasesKey(t *testing.T) {
+	t.Parallel()
+	s, products, redisMock := newIdempotencyServer(t)
+
+	redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetVal(true)
+	products.fail(errors.New("connection refused"))
+	redisMock.ExpectDel(testIdemRedis).SetVal(1)
+
+	if w := postProductWithKey(s, testIdemKey, testIdemBody); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the key to be released: %v", err)
+	}
+}
+
+func TestIdempotency_KeyReusedForDifferentRequest(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newIdempotencyServer(t)
+
+	redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetVal(false)
+	redisMock.ExpectGet(testIdemRedis).SetVal(`{"method":"DELETE","path":"/products/3","status":204}`)
+
+	w := postProductWithKey(s, testIdemKey, testIdemBody)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+	if got := decodeError(t, w); !strings.Contains(got.Message, "different request") {
+		t.Errorf("unexpected error %+v", got)
+	}
+}
+
+func TestIdempotency_ScopedToTheCaller(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newCartServer(t)
+	s.cfg.IdempotencyTTL = 24 * time.Hour
+	testProducts(s).add(testProduct(3, "Chair", 49.5, time.Now()))
+
+	// Two users happen to pick the same key; each gets their own request
+	// run rather than the other's response.
+	other := strings.Repeat("cd", sessionTokenBytes)
+	for _, caller := range []struct {
+		token  string
+		userID int64
+	}{{testToken, 7}, {other, 8}} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/cart/items", strings.NewReader(`{"product_id":3,"quantity":2}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+caller.token)
+		req.Header.Set("Idempotency-Key", testIdemKey)
+		key := regexp.QuoteMeta(testKeys.idempotency(idempotencyCaller(req), testIdemKey))
+
+		redisMock.Regexp().ExpectSetNX(key, `"path"`, s.idempotencyPendingTTL()).SetVal(true)
+		redisMock.ExpectGet(testKeys.session(caller.token)).SetVal(strconv.FormatInt(caller.userID, 10))
+		redisMock.ExpectTxPipeline()
+		redisMock.ExpectHSet(testKeys.cart(caller.userID), "3", 2).SetVal(1)
+		redisMock.ExpectExpire(testKeys.cart(caller.userID), testCartTTL).SetVal(true)
+		redisMock.ExpectTxPipelineExec()
+		redisMock.Regexp().ExpectSet(key, `"status":204`, 24*time.Hour).SetVal("OK")
+
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("user %d: expected their own 204, got %d %v: %s", caller.userID, w.Code, w.Header(), w.Body)
+		}
+	}
+	assertRedisMet(t, redisMock)
+}
+
+func TestIdempotency_InvalidKeyAndRedisDown(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newIdempotencyServer(t)
+
+	for _, key := range []string{strings.Repeat("k", maxIdempotencyKeyLen+1), "has space", "naïve"} {
+		if w := postProductWithKey(s, key, testIdemBody); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", key, w.Code)
+		}
+	}
+
+	// Without Redis the write still goes through, just unprotected.
+	redisMock.ExpectSetNX(testIdemRedis, pendingProduct, s.idempotencyPendingTTL()).SetErr(errors.New("connection refused"))
+	expectCreate(redisMock, 12)
+	if w := postProductWithKey(s, testIdemKey, testIdemBody); w.Code != http.StatusCreated {
+		t.Errorf("expected 201 with Redis down, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotency_PendingClaimOutlastsRequestTimeout(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for _, tt := range []struct {
+		timeout, want time.Duration
+	}{
+		{0, time.Minute},
+		{10 * time.Second, time.Minute},
+		{5 * time.Minute, 5*time.Minute + idempotencyPendingMargin},
+	} {
+		s.cfg.RequestTimeout = tt.timeout
+		if got := s.idempotencyPendingTTL(); got != tt.want {
+			t.Errorf("REQUEST_TIMEOUT %v: claimed for %v, want %v", tt.timeout, got, tt.want)
+		}
+	}
+}
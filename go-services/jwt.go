@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"go-service/store"
+)
+
+// jwtIssuer signs and verifies stateless access tokens. A nil *jwtIssuer
+// means JWTs are disabled and logins issue Redis sessions instead.
+type jwtIssuer struct {
+	method jwt.SigningMethod
+	// signKey and verifyKey are the same []byte for HS256, and the private
+	// and public halves of the key pair for RS256.
+	signKey   any
+	verifyKey any
+	issuer    string
+	ttl       time.Duration
+}
+
+// newJWTIssuer builds the issuer described by cfg: HS256 with JWTSigningKey,
+// or RS256 with the PEM private key at JWTPrivateKeyFile. It returns nil
+// when neither is set.
+func newJWTIssuer(cfg Config) (*jwtIssuer, error) {
+	iss := &jwtIssuer{issuer: cfg.JWTIssuer, ttl: cfg.JWTTTL}
+	switch {
+	case cfg.JWTSigningKey != "":
+		iss.method = jwt.SigningMethodHS256
+		iss.signKey = []byte(cfg.JWTSigningKey)
+		iss.verifyKey = iss.signKey
+	case cfg.JWTPrivateKeyFile != "":
+		pem, err := os.ReadFile(cfg.JWTPrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read JWT private key: %w", err)
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("parse JWT private key %s: %w", cfg.JWTPrivateKeyFile, err)
+		}
+		iss.method = jwt.SigningMethodRS256
+		iss.signKey = key
+		iss.verifyKey = &key.PublicKey
+	default:
+		return nil, nil
+	}
+	return iss, nil
+}
+
+// accessClaims are the claims of an access token: the registered ones and
+// the user's role.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Role string `json:"role,omitempty"`
+}
+
+// sign returns a token for userID acting as role, carrying the sub, iat,
+// exp and iss claims and a role claim.
+func (j *jwtIssuer) sign(userID int64, role string, now time.Time) (string, error) {
+	claims := accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(userID, 10),
+			Issuer:    j.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(j.ttl)),
+		},
+		Role: role,
+	}
+	return jwt.NewWithClaims(j.method, claims).SignedString(j.signKey)
+}
+
+var (
+	errTokenExpired      = errors.New("token expired")
+	errTokenBadSignature = errors.New("token signature is invalid")
+	errTokenInvalid      = errors.New("token is invalid")
+)
+
+// verify checks the token's signature, algorithm, issuer and expiry and
+// returns the user id in its subject and its role. Tokens issued before
+// roles carry none and act as store.RoleUser. Failures are reported as
+// errTokenExpired, errTokenBadSignature or errTokenInvalid so callers can
+// tell clients which one happened.
+func (j *jwtIssuer) verify(token string) (int64, string, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(token, &claims,
+		func(*jwt.Token) (any, error) { return j.verifyKey, nil },
+		jwt.WithValidMethods([]string{j.method.Alg()}),
+		jwt.WithIssuer(j.issuer),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
+	switch {
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return 0, "", errTokenBadSignature
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return 0, "", errTokenExpired
+	case err != nil:
+		return 0, "", fmt.Errorf("%w: %w", errTokenInvalid, err)
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: subject %q is not a user id", errTokenInvalid, claims.Subject)
+	}
+	if claims.Role == "" {
+		claims.Role = store.RoleUser
+	}
+	if !store.ValidRole(claims.Role) {
+		return 0, "", fmt.Errorf("%w: unknown role %q", errTokenInvalid, claims.Role)
+	}
+	return userID, claims.Role, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"go-service/store"
+)
+
+func hmacIssuer(t *testing.T, key string) *jwtIssuer {
+	t.Helper()
+	iss, err := newJWTIssuer(Config{JWTSigningKey: key, JWTIssuer: "test", JWTTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("newJWTIssuer: %v", err)
+	}
+	return iss
+}
+
+// rsaIssuer writes a fresh RSA key to a PEM file and loads it the way
+// NewServer does.
+func rsaIssuer(t *testing.T) *jwtIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	iss, err := newJWTIssuer(Config{JWTPrivateKeyFile: path, JWTIssuer: "test", JWTTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("newJWTIssuer: %v", err)
+	}
+	return iss
+}
+
+func TestJWTIssuer_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for name, iss := range map[string]*jwtIssuer{
+		"HS256": hmacIssuer(t, "secret"),
+		"RS256": rsaIssuer(t),
+	} {
+		token, err := iss.sign(7, store.RoleUser, time.Now())
+		if err != nil {
+			t.Fatalf("%s: sign: %v", name, err)
+		}
+		id, role, err := iss.verify(token)
+		if err != nil || id != 7 || role != store.RoleUser {
+			t.Errorf("%s: verify = %d, %q, %v; want 7, user, nil", name, id, role, err)
+		}
+
+		var claims accessClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+			t.Fatalf("%s: parse: %v", name, err)
+		}
+		if claims.Subject != "7" || claims.Role != store.RoleUser || claims.Issuer != "test" || claims.IssuedAt == nil ||
+			claims.ExpiresAt.Sub(claims.IssuedAt.Time) != time.Minute {
+			t.Errorf("%s: unexpected claims %+v", name, claims)
+		}
+	}
+}
+
+func TestJWTIssuer_RejectsBadTokens(t *testing.T) {
+	t.Parallel()
+	iss := hmacIssuer(t, "secret")
+
+	wrongKey, _ := hmacIssuer(t, "other-secret").sign(7, store.RoleUser, time.Now())
+	expired, _ := iss.sign(7, store.RoleUser, time.Now().Add(-time.Hour))
+	otherIssuer := hmacIssuer(t, "secret")
+	otherIssuer.issuer = "someone-else"
+	foreign, _ := otherIssuer.sign(7, store.RoleUser, time.Now())
+	rsaSigned, _ := rsaIssuer(t).sign(7, store.RoleUser, time.Now())
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"wrong key", wrongKey, errTokenBadSignature},
+		{"expired", expired, errTokenExpired},
+		{"wrong issuer", foreign, errTokenInvalid},
+		{"wrong algorithm", rsaSigned, errTokenBadSignature},
+		{"garbage", "not.a.jwt", errTokenInvalid},
+	}
+	for _, tt := range tests {
+		if _, _, err := iss.verify(tt.token); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNewJWTIssuer_DisabledAndBadKeyFile(t *testing.T) {
+	t.Parallel()
+
+	if iss, err := newJWTIssuer(Config{}); iss != nil || err != nil {
+		t.Errorf("expected no issuer without keys, got %v, %v", iss, err)
+	}
+	path := filepath.Join(t.TempDir(), "bad.pem")
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newJWTIssuer(Config{JWTPrivateKeyFile: path}); err == nil {
+		t.Error("expected an error for an invalid PEM file")
+	}
+}
+
+func TestLogin_IssuesJWT(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.jwt = hmacIssuer(t, "secret")
+
+	testUsers(s).add(7, "admin", mustHash(t, "admin123"))
+
+	w := postLogin(s, `{"username":"admin","password":"admin123"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp loginResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if resp.ExpiresIn != 60 {
+		t.Errorf("expected expires_in 60, got %d", resp.ExpiresIn)
+	}
+	if id, role, err := s.jwt.verify(resp.Token); err != nil || id != 7 || role != store.RoleUser {
+		t.Errorf("issued token does not verify: %d, %q, %v", id, role, err)
+	}
+	// No session is written to Redis.
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestRequireSession_JWT(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.jwt = rsaIssuer(t)
+
+	valid, _ := s.jwt.sign(7, store.RoleUser, time.Now())
+	expired, _ := s.jwt.sign(7, store.RoleUser, time.Now().Add(-time.Hour))
+	wrongKey, _ := rsaIssuer(t).sign(7, store.RoleUser, time.Now())
+
+	testUsers(s).add(7, "admin", "")
+	if w := getMe(s, "Bearer "+valid); w.Code != http.StatusOK {
+		t.Errorf("valid JWT: expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	for token, want := range map[string]string{
+		expired:  codeTokenExpired,
+		wrongKey: codeInvalidSignature,
+		"a.b.c":  codeInvalidToken,
+	} {
+		w := getMe(s, "Bearer "+token)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", want, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != want {
+			t.Errorf("expected code %q, got %+v", want, got)
+		}
+		if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), `Bearer error="invalid_token"`) {
+			t.Errorf("%s: unexpected WWW-Authenticate %q", want, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// Opaque sessions issued before JWTs were enabled are still honoured.
+	redisMock.ExpectGet(testKeys.session(testToken)).SetVal("7")
+	testUsers(s).add(7, "admin", "")
+	if w := getMe(s, "Bearer "+testToken); w.Code != http.StatusOK {
+		t.Errorf("session token: expected 200, got %d", w.Code)
+	}
+}
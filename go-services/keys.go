@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisKeys builds every Redis key the service uses. Each key is the prefix
+// followed by its parts joined with colons; the parts never include the
+// prefix, so it appears exactly once however a key is composed. The prefix
+// keeps these keys apart from other services sharing the instance.
+type redisKeys struct {
+	prefix string
+}
+
+func (k redisKeys) key(parts ...string) string {
+	return k.prefix + strings.Join(parts, ":")
+}
+
+// products is a hash holding one field per cached page of the product
+// list, so a single DEL invalidates every page.
+func (k redisKeys) products() string {
+	return k.key("products", "all")
+}
+
+// productsStale mirrors products with the last page of each kind read from
+// Postgres. It is refreshed by reads and deliberately not invalidated by
+// writes, so that a copy is available to serve while the database is down.
+func (k redisKeys) productsStale() string {
+	return k.key("products", "all", "stale")
+}
+
+// product is the cache key for a single product's JSON, or cacheMissing
+// when it does not exist.
+func (k redisKeys) product(id int64) string {
+	return k.key("product", strconv.FormatInt(id, 10))
+}
+
+// productPattern is a SCAN pattern matching every product key.
+func (k redisKeys) productPattern() string {
+	return globEscaper.Replace(k.prefix) + "product:*"
+}
+
+// all is a SCAN pattern matching every key with the prefix.
+func (k redisKeys) all() string {
+	return globEscaper.Replace(k.prefix) + "*"
+}
+
+// globEscaper escapes the characters special to Redis glob patterns, so a
+// prefix matches only itself.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// session holds the user id of a session token.
+func (k redisKeys) session(token string) string {
+	return k.key("session", token)
+}
+
+// userSessions is the set of a user's session keys that makes revoking
+// every session of the user possible.
+func (k redisKeys) userSessions(userID int64) string {
+	return k.key("user_sessions", strconv.FormatInt(userID, 10))
+}
+
+// passwordReset holds the user id a password reset token was issued to.
+// It is named by the token's SHA-256 hash, so that a copy of Redis holds no
+// token that could be used.
+func (k redisKeys) passwordReset(hash string) string {
+	return k.key("password_reset", hash)
+}
+
+// userPasswordResets is the set of a user's password reset keys, so that
+// resetting the password spends every token the user was sent.
+func (k redisKeys) userPasswordResets(userID int64) string {
+	return k.key("password_resets", strconv.FormatInt(userID, 10))
+}
+
+// cart is the hash of a signed-in user's cart, one field per product id
+// holding its quantity.
+func (k redisKeys) cart(userID int64) string {
+	return k.key("cart", strconv.FormatInt(userID, 10))
+}
+
+// anonCart is the hash of the cart named by an anonymous cart cookie.
+func (k redisKeys) anonCart(id string) string {
+	return k.key("cart", "anon", id)
+}
+
+// idempotency holds the stored response for an Idempotency-Key sent by
+// the caller identified by the hash caller.
+func (k redisKeys) idempotency(caller, key string) string {
+	return k.key("idem", caller, key)
+}
+
+// loginFailures counts failed logins; kind is "user" or "ip".
+func (k redisKeys) loginFailures(kind, value string) string {
+	return k.key("login_failures", kind, value)
+}
+
+// maintenance is set while the service is in maintenance mode. Its value is
+// the RFC 3339 time the maintenance window ends, or empty when it lasts
+// until the key is deleted.
+func (k redisKeys) maintenance() string {
+	return k.key("maintenance")
+}
+
+// stock is the key of the reservable stock counter of product id. The id is
+// a hash tag, so in a cluster the counter and stockPending share a slot and
+// a script can update both.
+func (k redisKeys) stock(id int64) string {
+	return k.key("stock", "{"+strconv.FormatInt(id, 10)+"}")
+}
+
+// stockPending is the key of the net change to product id's stock not yet
+// written back to Postgres.
+func (k redisKeys) stockPending(id int64) string {
+	return k.stock(id) + ":pending"
+}
+
+// stockDirty is the key of the set of product ids with a pending stock
+// change.
+func (k redisKeys) stockDirty() string {
+	return k.key("stock", "dirty")
+}
+
+// productViews is the key of the sorted set counting the views of each
+// product on the UTC day of t. The view keys share a hash tag, so in a
+// cluster they can be unioned.
+func (k redisKeys) productViews(t time.Time) string {
+	return k.key("products", "{views}", t.UTC().Format(time.DateOnly))
+}
+
+// productViewsTop is the key of the union of the recent view sets.
+func (k redisKeys) productViewsTop() string {
+	return k.key("products", "{views}", "top")
+}
+
+// productEvents is the Pub/Sub channel product changes are published on.
+func (k redisKeys) productEvents() string {
+	return k.key("events", "products")
+}
+
+// eventStream is the Redis stream product changes are published to when
+// EVENTS_PUBLISHER is redis.
+func (k redisKeys) eventStream(topic string) string {
+	return k.key("events", topic)
+}
+
+// flags is the hash of feature flags, one field per flag.
+func (k redisKeys) flags() string {
+	return k.key("flags")
+}
+
+// rateLimit counts the requests client made under the rate limit rule in
+// the window numbered window. The client is the hash tag, spreading clients
+// across a cluster rather than a popular rule's counters.
+func (k redisKeys) rateLimit(client, rule string, window int64) string {
+	return k.key("ratelimit", "{"+client+"}", rule, strconv.FormatInt(window, 10))
+}
+
+// response holds a response cached by withResponseCache; hash identifies
+// the request.
+func (k redisKeys) response(hash string) string {
+	return k.key("response", hash)
+}
+
+// webhookEvent marks the payment webhook event with id as delivered.
+func (k redisKeys) webhookEvent(id string) string {
+	return k.key("webhook", "payments", id)
+}
+
+// webhookQueue is the sorted set of outgoing webhook deliveries, scored by
+// the Unix millisecond each is due.
+func (k redisKeys) webhookQueue() string {
+	return k.key("webhook", "outbound", "queue")
+}
+
+// webhookDeadLetters is the list of outgoing webhook deliveries that ran
+// out of attempts, newest first.
+func (k redisKeys) webhookDeadLetters() string {
+	return k.key("webhook", "outbound", "dead-letters")
+}
+
+// lock is the key of the distributed lock named name.
+func (k redisKeys) lock(name string) string {
+	return k.key("lock", name)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisKeys_PrefixEveryKeyOnce(t *testing.T) {
+	t.Parallel()
+	k := redisKeys{prefix: defaultRedisPrefix}
+
+	tests := []struct {
+		subsystem string
+		got       string
+		want      string
+	}{
+		{"products cache", k.products(), "gosvc:products:all"},
+		{"stale products", k.productsStale(), "gosvc:products:all:stale"},
+		{"product cache", k.product(42), "gosvc:product:42"},
+		{"product pattern", k.productPattern(), "gosvc:product:*"},
+		{"session", k.session("abc123"), "gosvc:session:abc123"},
+		{"user sessions", k.userSessions(7), "gosvc:user_sessions:7"},
+		{"password reset", k.passwordReset("ab12"), "gosvc:password_reset:ab12"},
+		{"user password resets", k.userPasswordResets(7), "gosvc:password_resets:7"},
+		{"cart", k.cart(7), "gosvc:cart:7"},
+		{"anonymous cart", k.anonCart("ab12"), "gosvc:cart:anon:ab12"},
+		{"idempotency", k.idempotency("ab12", "import-42"), "gosvc:idem:ab12:import-42"},
+		{"login limit", k.loginFailures("ip", "192.0.2.1"), "gosvc:login_failures:ip:192.0.2.1"},
+		{"maintenance", k.maintenance(), "gosvc:maintenance"},
+		{"stock", k.stock(42), "gosvc:stock:{42}"},
+		{"pending stock", k.stockPending(42), "gosvc:stock:{42}:pending"},
+		{"dirty stock", k.stockDirty(), "gosvc:stock:dirty"},
+		{"product views", k.productViews(time.Date(2024, 3, 10, 23, 0, 0, 0, time.FixedZone("", -2*3600))), "gosvc:products:{views}:2024-03-11"},
+		{"top products", k.productViewsTop(), "gosvc:products:{views}:top"},
+		{"product events", k.productEvents(), "gosvc:events:products"},
+		{"event stream", k.eventStream("products-events"), "gosvc:events:products-events"},
+		{"feature flags", k.flags(), "gosvc:flags"},
+		{"rate limit", k.rateLimit("192.0.2.1", "route:/login", 42), "gosvc:ratelimit:{192.0.2.1}:route:/login:42"},
+		{"response cache", k.response("ab12"), "gosvc:response:ab12"},
+		{"webhook event", k.webhookEvent("evt_1"), "gosvc:webhook:payments:evt_1"},
+		{"webhook queue", k.webhookQueue(), "gosvc:webhook:outbound:queue"},
+		{"webhook dead letters", k.webhookDeadLetters(), "gosvc:webhook:outbound:dead-letters"},
+		{"lock", k.lock(productsRefreshLock), "gosvc:lock:" + productsRefreshLock},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.subsystem, tt.got, tt.want)
+		}
+		if n := strings.Count(tt.got, defaultRedisPrefix); n != 1 {
+			t.Errorf("%s: prefix appears %d times in %q", tt.subsystem, n, tt.got)
+		}
+	}
+}
+
+func TestRedisKeys_ServerUsesConfiguredPrefix(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.keys = redisKeys{prefix: "shop:"}
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	got := s.loginFailureKeys(r, "admin")
+	if want := []string{"shop:login_failures:user:admin", "shop:login_failures:ip:192.0.2.1"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("login failure keys = %v, want %v", got, want)
+	}
+}
+
+func TestRedisKeys_PatternsEscapePrefix(t *testing.T) {
+	t.Parallel()
+	k := redisKeys{prefix: `shop[1]*?\:`}
+
+	if got, want := k.all(), `shop\[1\]\*\?\\:*`; got != want {
+		t.Errorf("all() = %q, want %q", got, want)
+	}
+	if got, want := k.productPattern(), `shop\[1\]\*\?\\:product:*`; got != want {
+		t.Errorf("productPattern() = %q, want %q", got, want)
+	}
+}
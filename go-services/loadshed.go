@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// loadShedRetryAfter is advertised in Retry-After on a shed request: a
+// spike is expected to pass within seconds.
+const loadShedRetryAfter = time.Second
+
+// withInFlightLimit serves at most cfg.MaxInFlight requests at once. A
+// request over the limit waits up to cfg.MaxInFlightWait for another to
+// finish and is then answered 503, so that a spike is turned away at the
+// door instead of slowing every request down until the database pool runs
+// dry. Probe and stream routes are never held back.
+func (s *Server) withInFlightLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if route := s.routeLabel(r); s.inFlight == nil || probeRoutes[route] || s.isStream(r) {
+			handler(w, r)
+			return
+		}
+		if !s.acquireInFlight(r) {
+			if r.Context().Err() != nil {
+				return
+			}
+			route := s.routeLabel(r)
+			s.metrics.requestsShed.WithLabelValues(route).Inc()
+			s.logger.WarnContext(r.Context(), "Request shed", "path", route, "max_in_flight", s.cfg.MaxInFlight)
+			w.Header().Set("Retry-After", retryAfterSeconds(loadShedRetryAfter))
+			s.writeError(w, http.StatusServiceUnavailable, codeOverloaded, "server is overloaded, retry later")
+			return
+		}
+		defer func() { <-s.inFlight }()
+		handler(w, r)
+	}
+}
+
+// acquireInFlight takes a slot, waiting up to cfg.MaxInFlightWait, and
+// reports whether it got one. It gives up early if the client goes away.
+func (s *Server) acquireInFlight(r *http.Request) bool {
+	select {
+	case s.inFlight <- struct{}{}:
+		return true
+	default:
+	}
+	if s.cfg.MaxInFlightWait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(s.cfg.MaxInFlightWait)
+	defer timer.Stop()
+	select {
+	case s.inFlight <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
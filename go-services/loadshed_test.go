@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingHandler answers 204 once release is closed, signalling started
+// when it begins.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestWithInFlightLimit_ShedsOverLimit(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MaxInFlight = 2
+	s.cfg.MaxInFlightWait = 10 * time.Millisecond
+	s.inFlight = make(chan struct{}, s.cfg.MaxInFlight)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	h := s.withMetrics(s.withInFlightLimit(blockingHandler(started, release)))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, s.cfg.MaxInFlight)
+	for range s.cfg.MaxInFlight {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+			codes <- w.Code
+		}()
+		<-started
+	}
+	if got := testutil.ToFloat64(s.metrics.httpInFlight); got != 2 {
+		t.Errorf("expected 2 requests in flight, got %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 503 with Retry-After: 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := decodeError(t, w); got.Code != codeOverloaded {
+		t.Errorf("expected an overloaded error, got %+v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.requestsShed.WithLabelValues(unknownRoute)); got != 1 {
+		t.Errorf("expected 1 shed request, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.httpInFlight); got != 2 {
+		t.Errorf("expected the shed request to leave 2 in flight, got %v", got)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusNoContent {
+			t.Errorf("expected the admitted requests to be served, got %d", code)
+		}
+	}
+	if got := testutil.ToFloat64(s.metrics.httpInFlight); got != 0 {
+		t.Errorf("expected no requests in flight, got %v", got)
+	}
+}
+
+func TestWithInFlightLimit_WaitingRequestGetsFreedSlot(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MaxInFlight = 1
+	s.cfg.MaxInFlightWait = time.Minute
+	s.inFlight = make(chan struct{}, s.cfg.MaxInFlight)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	h := s.withMetrics(s.withInFlightLimit(blockingHandler(started, release)))
+
+	done := make(chan int, 2)
+	serve := func() {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+		done <- w.Code
+	}
+	go serve()
+	<-started
+	go serve()
+	// The second request is in flight, waiting for the first one's slot.
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(s.metrics.httpInFlight) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("second request never arrived")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	<-started
+	for range 2 {
+		if code := <-done; code != http.StatusNoContent {
+			t.Errorf("expected both requests served, got %d", code)
+		}
+	}
+	if got := testutil.ToFloat64(s.metrics.requestsShed.WithLabelValues(unknownRoute)); got != 0 {
+		t.Errorf("expected nothing shed, got %v", got)
+	}
+}
+
+func TestWithInFlightLimit_ProbesAreExempt(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MaxInFlight = 1
+	h := s.Handler()
+	s.inFlight <- struct{}{} // the only slot is taken
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected /livez to be served, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /products to be shed, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(s.metrics.requestsShed.WithLabelValues("/products")); got != 1 {
+		t.Errorf("expected the shed request labelled /products, got %v", got)
+	}
+}
+
+func TestWithInFlightLimit_UnlimitedByDefault(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.Handler()
+
+	if s.inFlight != nil {
+		t.Fatalf("expected no limit without MAX_IN_FLIGHT")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// levelFatal is logged just before the process exits on an unrecoverable
+// startup error.
+const levelFatal = slog.Level(12)
+
+// logLevel is the level of the logger set up by initLog, which
+// /admin/loglevel changes at runtime.
+var logLevel = new(slog.LevelVar)
+
+// newLogger returns a JSON logger writing to w. Level names are lowercased to
+// match the format the log pipeline already indexes.
+func newLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.LevelKey {
+				if lvl, ok := a.Value.Any().(slog.Level); ok && lvl == levelFatal {
+					return slog.String(slog.LevelKey, "fatal")
+				}
+				return slog.String(slog.LevelKey, strings.ToLower(a.Value.String()))
+			}
+			return a
+		},
+	})})
+}
+
+// contextHandler adds request-scoped attributes carried in the context, such
+// as the request ID and the active span, to every record logged with a
+// *Context method. Records logged outside a request carry none of them.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// parseLogLevel maps a LOG_LEVEL value to a slog level. An empty value means
+// info.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// fatal logs msg at fatal level and exits the process.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Log(context.Background(), levelFatal, msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestLogger_EscapesErrorsAsValidJSON(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	s, _, _ := newTestServer(t)
+	s.logger = newLogger(&buf, slog.LevelInfo)
+	testProducts(s).fail(errors.New("pq: relation \"products\" does not exist\nHINT: run migrations"))
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	s.productsHandler(httptest.NewRecorder(), req)
+
+	lines := 0
+	var found bool
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		lines++
+		var entry map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("log line is not valid JSON: %v\n%s", err, sc.Text())
+		}
+		if entry["msg"] == "DB query failed" {
+			found = true
+			if entry["level"] != "error" {
+				t.Errorf("expected level error, got %v", entry["level"])
+			}
+			if entry["err"] != "pq: relation \"products\" does not exist\nHINT: run migrations" {
+				t.Errorf("error field was not preserved: %q", entry["err"])
+			}
+			if entry["path"] != "/products" {
+				t.Errorf("expected path field, got %v", entry["path"])
+			}
+		}
+	}
+	if lines == 0 || !found {
+		t.Fatalf("expected a DB query failed log line, got:\n%s", buf.String())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in      string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"WARN", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", slog.LevelInfo, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLogLevel(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("parseLogLevel(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLogger_RespectsLevel(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := newLogger(&buf, slog.LevelWarn)
+	logger.Info("dropped")
+	logger.Warn("kept")
+
+	var entry map[string]any
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry); err != nil {
+		t.Fatalf("expected exactly one JSON line, got %q: %v", buf.String(), err)
+	}
+	if entry["msg"] != "kept" || entry["level"] != "warn" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func TestLogger_AddsTraceAndSpanIDsDuringTracedRequest(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	s, _, _ := newTestServer(t)
+	s.logger = newLogger(&buf, slog.LevelInfo)
+	exp := withSpanRecorder(t, s)
+
+	testProducts(s).fail(errors.New("connection refused"))
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	var server tracetest.SpanStub
+	for _, sp := range exp.GetSpans() {
+		if sp.SpanKind == trace.SpanKindServer {
+			server = sp
+		}
+	}
+	if !server.SpanContext.IsValid() {
+		t.Fatal("expected a server span")
+	}
+
+	var found bool
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("log line is not valid JSON: %v\n%s", err, sc.Text())
+		}
+		if entry["msg"] != "DB query failed" {
+			continue
+		}
+		found = true
+		if got, want := entry["trace_id"], server.SpanContext.TraceID().String(); got != want {
+			t.Errorf("expected trace_id %s, got %v", want, got)
+		}
+		if got, want := entry["span_id"], server.SpanContext.SpanID().String(); got != want {
+			t.Errorf("expected span_id %s, got %v", want, got)
+		}
+	}
+	if !found {
+		t.Fatalf("expected a DB query failed log line, got:\n%s", buf.String())
+	}
+}
+
+func TestLogger_OmitsTraceIDsOutsideRequests(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := newLogger(&buf, slog.LevelInfo)
+	logger.InfoContext(context.Background(), "Connected to Redis")
+
+	var entry map[string]any
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry); err != nil {
+		t.Fatalf("expected exactly one JSON line, got %q: %v", buf.String(), err)
+	}
+	for _, key := range []string{"trace_id", "span_id", "request_id"} {
+		if _, ok := entry[key]; ok {
+			t.Errorf("expected no %s outside a request, got %v", key, entry)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	redismock "github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	userFailuresKey = testKeys.loginFailures("user", "admin")
+	ipFailuresKey   = testKeys.loginFailures("ip", "192.0.2.1")
+)
+
+func newLimitedTestServer(t *testing.T) (*Server, redismock.ClientMock) {
+	t.Helper()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.LoginMaxAttempts = 3
+	s.cfg.LoginLockoutWindow = 15 * time.Minute
+	s.cfg.SessionTTL = time.Hour
+	return s, redisMock
+}
+
+func TestLogin_LocksOutAfterMaxFailures(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newLimitedTestServer(t)
+	keys := []string{userFailuresKey, ipFailuresKey}
+	testUsers(s).add(7, "admin", mustHash(t, "admin123"))
+
+	for i := 1; i <= s.cfg.LoginMaxAttempts; i++ {
+		expectGetKeys(redisMock, keys, nilOrCount(i-1), nilOrCount(i-1))
+		redisMock.ExpectTxPipeline()
+		redisMock.ExpectIncr(userFailuresKey).SetVal(int64(i))
+		redisMock.ExpectExpireNX(userFailuresKey, 15*time.Minute).SetVal(i == 1)
+		redisMock.ExpectIncr(ipFailuresKey).SetVal(int64(i))
+		redisMock.ExpectExpireNX(ipFailuresKey, 15*time.Minute).SetVal(i == 1)
+		redisMock.ExpectTxPipelineExec()
+
+		if w := postLogin(s, `{"username":"admin","password":"wrong"}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, w.Code)
+		}
+	}
+
+	// The correct password no longer helps, and the database is not asked.
+	expectGetKeys(redisMock, keys, "3", "3")
+	redisMock.ExpectTTL(userFailuresKey).SetVal(90*time.Second + 500*time.Millisecond)
+	w := postLogin(s, `{"username":"admin","password":"admin123"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != "91" {
+		t.Errorf("expected Retry-After 91, got %q", got)
+	}
+	if got := decodeError(t, w); got.Code != codeTooManyRequests {
+		t.Errorf("expected code %q, got %+v", codeTooManyRequests, got)
+	}
+
+	// Both counters reached the limit on the same attempt.
+	if got := testutil.ToFloat64(s.metrics.loginLockouts); got != 2 {
+		t.Errorf("expected 2 lockouts, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.loginAttempts.WithLabelValues("failure")); got != 3 {
+		t.Errorf("expected 3 failures, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.loginAttempts.WithLabelValues("locked")); got != 1 {
+		t.Errorf("expected 1 locked attempt, got %v", got)
+	}
+	if n := testUsers(s).callCount(); n != s.cfg.LoginMaxAttempts {
+		t.Errorf("expected only the unlocked attempts to look up the user, got %d", n)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestLogin_RecoversAfterWindowAndResetsOnSuccess(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newLimitedTestServer(t)
+	keys := []string{userFailuresKey, ipFailuresKey}
+
+	// Locked out by the address counter alone.
+	expectGetKeys(redisMock, keys, "1", "3")
+	redisMock.ExpectTTL(ipFailuresKey).SetVal(time.Second)
+	if w := postLogin(s, `{"username":"admin","password":"admin123"}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+
+	// Once the counters have expired the login goes through and clears them.
+	expectGetKeys(redisMock, keys, nil, nil)
+	testUsers(s).add(7, "admin", mustHash(t, "admin123"))
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectSet(`session:[0-9a-f]{64}`, "7", time.Hour).SetVal("OK")
+	redisMock.Regexp().ExpectSAdd(testKeys.userSessions(7), `session:[0-9a-f]{64}`).SetVal(1)
+	redisMock.ExpectExpire(testKeys.userSessions(7), time.Hour).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+	expectUnlinkKeys(redisMock, keys...)
+
+	if w := postLogin(s, `{"username":"admin","password":"admin123"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after the window, got %d: %s", w.Code, w.Body)
+	}
+	if got := testutil.ToFloat64(s.metrics.loginAttempts.WithLabelValues("success")); got != 1 {
+		t.Errorf("expected 1 success, got %v", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestLogin_LimiterFailsOpen(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newLimitedTestServer(t)
+
+	redisMock.ExpectGet(userFailuresKey).SetErr(errors.New("dial tcp: connection refused"))
+	testUsers(s).add(7, "admin", mustHash(t, "admin123"))
+
+	w := postLogin(s, `{"username":"admin","password":"wrong"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the attempt to reach the database and fail with 401, got %d", w.Code)
+	}
+}
+
+func nilOrCount(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLogLevelTTL caps how long a changed log level may last before it
+// reverts, so debug logging is never left on for days.
+const maxLogLevelTTL = 24 * time.Hour
+
+// logLevelControl changes the level of the service's logger at runtime and,
+// when asked to, reverts the change after a while.
+type logLevelControl struct {
+	level *slog.LevelVar
+	// now and afterFunc are the clock, replaced in tests.
+	now       func() time.Time
+	afterFunc func(d time.Duration, f func()) (stop func() bool)
+
+	mu sync.Mutex
+	// base is the level reverted to; it is the current level unless a
+	// change with a TTL is pending.
+	base     slog.Level
+	revertAt time.Time
+	stop     func() bool
+	// gen tells a revert scheduled for an earlier change to do nothing.
+	gen int
+}
+
+func newLogLevelControl(level *slog.LevelVar) *logLevelControl {
+	return &logLevelControl{
+		level: level,
+		now:   time.Now,
+		afterFunc: func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		},
+		base: level.Level(),
+	}
+}
+
+// get returns the current level and, if a change is pending, when it
+// reverts.
+func (c *logLevelControl) get() (slog.Level, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.level.Level(), c.revertAt
+}
+
+// set switches to level. With a positive ttl the previous level comes back
+// after it; otherwise level stays until changed again. onRevert is called
+// after a revert, with the level reverted to.
+func (c *logLevelControl) set(level slog.Level, ttl time.Duration, onRevert func(slog.Level)) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+	}
+	c.gen++
+	c.level.Set(level)
+	if ttl <= 0 {
+		c.base, c.revertAt = level, time.Time{}
+		return c.revertAt
+	}
+	c.revertAt = c.now().Add(ttl)
+	gen := c.gen
+	c.stop = c.afterFunc(ttl, func() {
+		if base, ok := c.revert(gen); ok {
+			onRevert(base)
+		}
+	})
+	return c.revertAt
+}
+
+// revert restores the base level unless another change came after the one
+// numbered gen.
+func (c *logLevelControl) revert(gen int) (slog.Level, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return 0, false
+	}
+	c.level.Set(c.base)
+	c.revertAt, c.stop = time.Time{}, nil
+	return c.base, true
+}
+
+// levelName is the name of level as LOG_LEVEL and the log output spell it.
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+	// TTLSeconds reverts to the previous level after that many seconds;
+	// zero keeps the new level until it is changed again.
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+// validate reports every rule the request breaks, as a validationError.
+func (in logLevelRequest) validate() error {
+	var v validator
+	v.check(in.Level != "", "level", "is required")
+	_, err := parseLogLevel(in.Level)
+	v.check(err == nil, "level", "must be debug, info, warn or error")
+	v.check(in.TTLSeconds >= 0, "ttl_seconds", "must not be negative")
+	v.check(time.Duration(in.TTLSeconds)*time.Second <= maxLogLevelTTL, "ttl_seconds", "must be at most 86400")
+	return v.err()
+}
+
+type logLevelResponse struct {
+	Level string `json:"level"`
+	// RevertAt is when a temporary level ends.
+	RevertAt *time.Time `json:"revert_at,omitempty"`
+}
+
+func newLogLevelResponse(level slog.Level, revertAt time.Time) logLevelResponse {
+	resp := logLevelResponse{Level: levelName(level)}
+	if !revertAt.IsZero() {
+		t := revertAt.UTC().Truncate(time.Second)
+		resp.RevertAt = &t
+	}
+	return resp
+}
+
+// getLogLevelHandler returns the current log level. It is only served on
+// the internal listener, behind requireRole.
+func (s *Server) getLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, newLogLevelResponse(s.logLevel.get()))
+}
+
+// putLogLevelHandler changes the log level of this replica. It is only
+// served on the internal listener, behind requireRole.
+func (s *Server) putLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req logLevelRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	level, _ := parseLogLevel(req.Level)
+	previous, _ := s.logLevel.get()
+	revertAt := s.logLevel.set(level, time.Duration(req.TTLSeconds)*time.Second, func(base slog.Level) {
+		s.logger.Warn("Log level reverted", "level", levelName(base))
+	})
+	// Logged at warn so the change is recorded whatever the level.
+	s.logger.WarnContext(ctx, "Log level changed",
+		"audit", true,
+		"actor", auditActor(ctx),
+		"remote_ip", s.clientIP(r),
+		"previous_level", levelName(previous),
+		"level", levelName(level),
+		"ttl_seconds", req.TTLSeconds,
+	)
+	s.audit(r, auditLogLevelChanged, 0, map[string]any{
+		"previous_level": levelName(previous),
+		"level":          levelName(level),
+		"ttl_seconds":    req.TTLSeconds,
+	})
+	s.writeJSON(w, http.StatusOK, newLogLevelResponse(level, revertAt))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTimers stands in for time.AfterFunc, holding the scheduled functions
+// until the test fires them.
+type fakeTimers struct {
+	funcs []func()
+	after []time.Duration
+}
+
+func (f *fakeTimers) afterFunc(d time.Duration, fn func()) func() bool {
+	f.funcs = append(f.funcs, fn)
+	f.after = append(f.after, d)
+	return func() bool { return true }
+}
+
+// fire runs the most recently scheduled function.
+func (f *fakeTimers) fire() {
+	f.funcs[len(f.funcs)-1]()
+}
+
+// useFakeClock puts s's log level control on a fixed clock and fake timers.
+func useFakeClock(s *Server) (*fakeTimers, time.Time) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	timers := &fakeTimers{}
+	s.logLevel.now = func() time.Time { return now }
+	s.logLevel.afterFunc = timers.afterFunc
+	return timers, now
+}
+
+func logLevelRequestTo(s *Server, method, auth, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/admin/loglevel", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func decodeLogLevel(t *testing.T, w *httptest.ResponseRecorder) logLevelResponse {
+	t.Helper()
+	var resp logLevelResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	return resp
+}
+
+func TestLogLevelHandler_SetsAndReadsBack(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	s.logger = newLogger(&buf, s.logLevel.level)
+
+	s.logger.Debug("before")
+	w := logLevelRequestTo(s, http.MethodPut, "Bearer "+testAdminToken, `{"level":"debug"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeLogLevel(t, w); got.Level != "debug" || got.RevertAt != nil {
+		t.Errorf("unexpected response: %+v", got)
+	}
+	s.logger.Debug("after")
+
+	w = logLevelRequestTo(s, http.MethodGet, "Bearer "+testAdminToken, "")
+	if got := decodeLogLevel(t, w); got.Level != "debug" {
+		t.Errorf("expected debug to read back, got %+v", got)
+	}
+	logs := buf.String()
+	if strings.Contains(logs, `"msg":"before"`) || !strings.Contains(logs, `"msg":"after"`) {
+		t.Errorf("expected only debug lines after the change, got:\n%s", logs)
+	}
+	if !strings.Contains(logs, `"msg":"Log level changed"`) || !strings.Contains(logs, `"actor":"admin-token"`) || !strings.Contains(logs, `"previous_level":"info"`) {
+		t.Errorf("expected an audit line with the actor, got:\n%s", logs)
+	}
+}
+
+func TestLogLevelHandler_RejectsInvalidLevel(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	for _, body := range []string{`{"level":"verbose"}`, `{}`, `{"level":"debug","ttl_seconds":-1}`} {
+		w := logLevelRequestTo(s, http.MethodPut, "Bearer "+testAdminToken, body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeValidation {
+			t.Errorf("%s: expected code %q, got %+v", body, codeValidation, got)
+		}
+	}
+	if level, _ := s.logLevel.get(); level != slog.LevelInfo {
+		t.Errorf("expected the level to stay info, got %v", level)
+	}
+}
+
+func TestLogLevelHandler_RequiresAdminToken(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	if w := logLevelRequestTo(s, http.MethodGet, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a token: expected 401, got %d", w.Code)
+	}
+	if w := logLevelRequestTo(s, http.MethodPut, "Bearer wrong", `{"level":"debug"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("PUT with a wrong token: expected 401, got %d", w.Code)
+	}
+	if level, _ := s.logLevel.get(); level != slog.LevelInfo {
+		t.Errorf("expected the level to stay info, got %v", level)
+	}
+}
+
+func TestLogLevelHandler_RevertsAfterTTL(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	timers, now := useFakeClock(s)
+
+	w := logLevelRequestTo(s, http.MethodPut, "Bearer "+testAdminToken, `{"level":"debug","ttl_seconds":600}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	got := decodeLogLevel(t, w)
+	if want := now.Add(10 * time.Minute); got.RevertAt == nil || !got.RevertAt.Equal(want) {
+		t.Errorf("expected revert_at %v, got %+v", want, got)
+	}
+	if len(timers.after) != 1 || timers.after[0] != 10*time.Minute {
+		t.Fatalf("expected a revert in 10m, got %v", timers.after)
+	}
+
+	timers.fire()
+	if level, revertAt := s.logLevel.get(); level != slog.LevelInfo || !revertAt.IsZero() {
+		t.Errorf("expected info with nothing pending after the TTL, got %v until %v", level, revertAt)
+	}
+}
+
+func TestLogLevelControl_LaterChangeCancelsRevert(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	timers, _ := useFakeClock(s)
+	c := s.logLevel
+
+	c.set(slog.LevelDebug, time.Minute, func(slog.Level) {})
+	stale := timers.funcs[0]
+	c.set(slog.LevelWarn, 0, func(slog.Level) {})
+
+	stale()
+	if level, _ := c.get(); level != slog.LevelWarn {
+		t.Errorf("expected the earlier revert to leave warn in place, got %v", level)
+	}
+}
+
+func TestLogLevelControl_RevertsToLevelBeforeTemporaryChanges(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	timers, _ := useFakeClock(s)
+	c := s.logLevel
+
+	var reverted slog.Level
+	c.set(slog.LevelWarn, 0, func(slog.Level) {})
+	c.set(slog.LevelDebug, time.Minute, func(l slog.Level) { reverted = l })
+	c.set(slog.LevelError, time.Minute, func(l slog.Level) { reverted = l })
+
+	timers.fire()
+	if level, _ := c.get(); level != slog.LevelWarn || reverted != slog.LevelWarn {
+		t.Errorf("expected a revert to warn, got %v (reported %v)", level, reverted)
+	}
+}
@@ -2,201 +2,357 @@ package main
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/redis/go-redis/v9"
-
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-)
-
-var (
-	db  *sql.DB
-	rdb *redis.Client
-	ctx = context.Background()
-
-	httpRequestCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Total number of HTTP requests",
-		},
-		[]string{"path", "method"},
-	)
-
-	httpRequestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "Duration of HTTP requests",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"path"},
-	)
+	"google.golang.org/grpc"
 )
 
 func main() {
-	initLog()
-	initMetrics()
-	initTracer()
-	initDB()
-	initRedis()
-
-	http.HandleFunc("/", withMetrics(rootHandler))
-	http.HandleFunc("/healthz", withMetrics(healthHandler))
-	http.HandleFunc("/login", withMetrics(loginHandler))
-	http.HandleFunc("/products", withMetrics(productsHandler))
-	http.Handle("/metrics", promhttp.Handler())
-
-	log.Println(`{"level":"info","msg":"Go service started on :8080"}`)
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf(`{"level":"fatal","msg":"Failed to start server","error":"%v"}`, err)
+	healthcheck := flag.Bool("healthcheck", false, "probe /readyz on HTTP_ADDR and exit 0 if ready, 1 otherwise")
+	migrateOnly := flag.Bool("migrate-only", false, "apply database migrations and exit, even with MIGRATIONS_DISABLED")
+	flag.Parse()
+	if *healthcheck {
+		os.Exit(runHealthcheck(os.Stderr, healthcheckAddr(os.LookupEnv)))
 	}
-}
 
-func initLog() {
-	log.SetFlags(0)
-	log.SetOutput(os.Stdout)
-}
+	logger := initLog()
+	tp := initTracer(logger)
 
-func initMetrics() {
-	prometheus.MustRegister(httpRequestCount)
-	prometheus.MustRegister(httpRequestDuration)
-	log.Println(`{"level":"info","msg":"Prometheus metrics registered"}`)
-}
+	cfg, err := LoadConfig()
+	if err != nil {
+		fatal(logger, "Invalid configuration", "err", err)
+	}
+	logger.Info("Configuration loaded", "config", cfg)
+
+	if *migrateOnly {
+		cfg.MigrationsDisabled = false
+		db, err := initDB(cfg, logger)
+		if err != nil {
+			fatal(logger, "Failed to migrate database", "err", err)
+		}
+		db.Close()
+		return
+	}
 
-func initTracer() {
-	exporter, err := stdouttrace.New()
+	app, err := NewServer(cfg)
 	if err != nil {
-		log.Fatalf(`{"level":"fatal","msg":"Failed to initialize tracer","error":"%v"}`, err)
+		fatal(logger, "Failed to initialize server", "err", err)
 	}
-	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
-	otel.SetTracerProvider(tp)
-	log.Println(`{"level":"info","msg":"OpenTelemetry tracer initialized"}`)
-}
+	initMetrics(logger, app.metrics)
 
-func initDB() {
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbUser := os.Getenv("DB_USER")
-	dbPass := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPass, dbName)
+	app.reloadConfigOnSIGHUP(sigCtx)
 
-	var err error
-	db, err = sql.Open("postgres", dsn)
-	if err != nil {
-		log.Fatalf(`{"level":"fatal","msg":"Failed to connect to DB","error":"%v"}`, err)
+	public := newHTTPServer(cfg, app.Handler())
+	if cfg.TLSCertFile != "" {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+		if err != nil {
+			fatal(logger, "Failed to load TLS certificate", "err", err)
+		}
+		public.TLSConfig = certs.tlsConfig()
+		reloadOnSIGHUP(sigCtx, logger, certs)
 	}
-	if err = db.Ping(); err != nil {
-		log.Fatalf(`{"level":"fatal","msg":"Failed to ping DB","error":"%v"}`, err)
+	// Shutdown waits for handlers to return, which streams only do when
+	// told to.
+	public.RegisterOnShutdown(app.CloseStreams)
+
+	// Background work stops with the listeners, whether on a signal or
+	// because one of them failed.
+	bgCtx, stopBackground := context.WithCancel(sigCtx)
+	var background sync.WaitGroup
+	if cfg.ProductsRefreshInterval > 0 && cfg.ProductsCacheTTL > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			app.runProductsWarmer(bgCtx, cfg.ProductsRefreshInterval)
+		}()
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		app.runViewRecorder(bgCtx)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		app.runProductEventRelay(bgCtx)
+	}()
+	if cfg.PaymentWebhookSecret != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			app.runWebhookWorker(bgCtx)
+		}()
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		app.runWebhookDeliveries(bgCtx, cfg.WebhookPollInterval)
+	}()
+	if app.reporter != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			app.runErrorReporter(bgCtx)
+		}()
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		app.runResetMailer(bgCtx)
+	}()
+	if cfg.StockReconcileInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			app.runStockReconciler(bgCtx, cfg.StockReconcileInterval)
+		}()
+	}
+	if cfg.ProductPurgeAfter > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			app.runProductPurger(bgCtx, cfg.ProductPurgeInterval)
+		}()
+	}
+	if app.publisher != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			app.runOutboxRelay(bgCtx, cfg.OutboxRelayInterval)
+		}()
+	}
+	if cfg.ProductsNotifyChannel != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			app.runProductsListener(bgCtx, dialNotify(postgresDSN(cfg), cfg.ProductsNotifyChannel), cfg.DBConnect)
+		}()
 	}
 
-	log.Println(`{"level":"info","msg":"Connected to PostgreSQL"}`)
-}
-
-func initRedis() {
-	redisHost := os.Getenv("REDIS_HOST")
-	redisPort := os.Getenv("REDIS_PORT")
+	// The audit writer outlives the listeners so that events recorded while
+	// they drain are still written.
+	auditCtx, stopAudit := context.WithCancel(context.Background())
+	auditDone := make(chan struct{})
+	go func() {
+		defer close(auditDone)
+		app.runAuditWriter(auditCtx)
+	}()
+
+	listeners := []listener{mustListen(logger, "public", cfg.HTTPAddr, public)}
+	if cfg.InternalAddr != "" {
+		listeners = append(listeners, mustListen(logger, "internal", cfg.InternalAddr, newHTTPServer(cfg, app.InternalHandler())))
+	}
+	if cfg.GRPCAddr != "" {
+		l := mustListen(logger, "grpc", cfg.GRPCAddr, nil)
+		l.grpc = app.GRPCServer()
+		listeners = append(listeners, l)
+	}
 
-	rdb = redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%s", redisHost, redisPort),
-		DB:   0,
-	})
+	logger.Info("Go service started",
+		"addr", cfg.HTTPAddr,
+		"internal_addr", cfg.InternalAddr,
+		"grpc_addr", cfg.GRPCAddr,
+		"tls", cfg.TLSCertFile != "",
+		"mtls", cfg.TLSClientCAFile != "",
+		"version", app.build.Version,
+		"commit", app.build.Commit,
+		"build_date", app.build.BuildDate,
+		"go_version", app.build.GoVersion,
+		"read_header_timeout", cfg.ReadHeaderTimeout,
+		"read_timeout", cfg.ReadTimeout,
+		"write_timeout", cfg.WriteTimeout,
+		"idle_timeout", cfg.IdleTimeout,
+	)
+	shutdown := shutdownOptions{drain: app.Drain, delay: cfg.PreStopDelay, timeout: cfg.ShutdownTimeout}
+	if err := serve(sigCtx, logger, shutdown, listeners...); err != nil {
+		logger.Error("Server shutdown failed", "err", err)
+	}
+	stopBackground()
+	background.Wait()
+	stopAudit()
+	<-auditDone
 
-	ctxTimeout, cancel := context.WithTimeout(ctx, 2*time.Second)
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if err := tp.Shutdown(flushCtx); err != nil {
+		logger.Error("Failed to flush tracer", "err", err)
+	}
+	if err := app.Close(); err != nil {
+		logger.Error("Failed to close connections", "err", err)
+	}
+	logger.Info("Go service stopped")
+}
+
+// listener pairs an http.Server, or a gRPC server, with the socket it
+// serves on.
+type listener struct {
+	name string
+	srv  *http.Server
+	// grpc, when set, is served instead of srv.
+	grpc *grpc.Server
+	ln   net.Listener
+}
 
-	if err := rdb.Ping(ctxTimeout).Err(); err != nil {
-		log.Fatalf(`{"level":"fatal","msg":"Failed to connect to Redis","error":"%v"}`, err)
+func mustListen(logger *slog.Logger, name, addr string, srv *http.Server) listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal(logger, "Failed to start server", "listener", name, "addr", addr, "err", err)
 	}
-	log.Println(`{"level":"info","msg":"Connected to Redis"}`)
+	return listener{name: name, srv: srv, ln: ln}
 }
 
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(`{"level":"info","msg":"Root endpoint called"}`)
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte("Welcome to the Go service!")); err != nil {
-		log.Printf(`{"level":"error","msg":"Failed to write root response","error":"%v"}`, err)
+// newHTTPServer returns an http.Server for h with the connection timeouts
+// from cfg applied.
+func newHTTPServer(cfg Config, h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
 	}
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	dbErr := db.Ping()
-	redisErr := rdb.Ping(ctx).Err()
+// shutdownOptions describes how serve shuts the listeners down.
+type shutdownOptions struct {
+	// drain, when set, is called as soon as shutdown begins.
+	drain func()
+	// delay is how long the listeners keep serving after drain, for load
+	// balancers to notice the pod is unready.
+	delay time.Duration
+	// timeout bounds how long in-flight requests and RPCs may take to
+	// finish once the listeners close.
+	timeout time.Duration
+}
 
-	status := map[string]string{
-		"database": "ok",
-		"redis":    "ok",
+// serve runs every listener until ctx is cancelled or one of them fails,
+// serving TLS on those whose server has a TLSConfig. It then drains as opts
+// describes and shuts them all down together, letting in-flight requests
+// and RPCs finish for at most opts.timeout before returning.
+func serve(ctx context.Context, logger *slog.Logger, opts shutdownOptions, listeners ...listener) error {
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			var err error
+			switch {
+			case l.grpc != nil:
+				// Serve returns nil once stopped.
+				err = l.grpc.Serve(l.ln)
+			case l.srv.TLSConfig != nil:
+				err = l.srv.ServeTLS(l.ln, "", "")
+			default:
+				err = l.srv.Serve(l.ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("%s listener: %w", l.name, err)
+			}
+		}()
 	}
 
-	code := http.StatusOK
-	if dbErr != nil {
-		status["database"] = "unreachable"
-		code = http.StatusServiceUnavailable
+	var serveErr error
+	select {
+	case serveErr = <-errCh:
+		logger.Error("Listener failed, shutting down", "err", serveErr)
+	case <-ctx.Done():
+		logger.Info("Shutdown signal received, draining connections")
 	}
-	if redisErr != nil {
-		status["redis"] = "unreachable"
-		code = http.StatusServiceUnavailable
+
+	if opts.drain != nil {
+		opts.drain()
+	}
+	if opts.delay > 0 {
+		logger.Info("Draining, waiting before closing the listeners", "delay", opts.delay)
+		time.Sleep(opts.delay)
 	}
 
-	statusJSON, _ := json.Marshal(status)
-	log.Printf(`{"level":"info","msg":"Health check","status":%s}`, statusJSON)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
 
-	w.WriteHeader(code)
-	if err := json.NewEncoder(w).Encode(status); err != nil {
-		log.Printf(`{"level":"error","msg":"Failed to encode health response","error":"%v"}`, err)
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.grpc != nil {
+				errs[i] = stopGRPC(shutdownCtx, l.grpc)
+			} else {
+				errs[i] = l.srv.Shutdown(shutdownCtx)
+			}
+		}()
 	}
+	wg.Wait()
+	return errors.Join(append(errs, serveErr)...)
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(`{"level":"info","msg":"Login endpoint called"}`)
-	if _, err := w.Write([]byte("Logged in")); err != nil {
-		log.Printf(`{"level":"error","msg":"Failed to write login response","error":"%v"}`, err)
+// stopGRPC stops srv gracefully, letting in-flight RPCs finish, and
+// cancels those still running when ctx is done.
+func stopGRPC(ctx context.Context, srv *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		<-stopped
+		return ctx.Err()
 	}
 }
 
-func productsHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT name FROM products")
+func initLog() *slog.Logger {
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	logLevel.Set(level)
+	logger := newLogger(os.Stdout, logLevel)
+	slog.SetDefault(logger)
 	if err != nil {
-		log.Printf(`{"level":"error","msg":"DB query failed","error":"%v"}`, err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var products []string
-	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			log.Printf(`{"level":"error","msg":"Row scan failed","error":"%v"}`, err)
-			continue
-		}
-		products = append(products, name)
+		logger.Warn("Invalid LOG_LEVEL, defaulting to info", "err", err)
 	}
+	return logger
+}
 
-	if err := json.NewEncoder(w).Encode(products); err != nil {
-		log.Printf(`{"level":"error","msg":"Failed to encode products","error":"%v"}`, err)
+func initMetrics(logger *slog.Logger, m *metrics) {
+	if err := m.register(prometheus.DefaultRegisterer); err != nil {
+		fatal(logger, "Failed to register metrics", "err", err)
 	}
+	logger.Info("Prometheus metrics registered")
 }
 
-func withMetrics(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		handler(w, r)
-		duration := time.Since(start).Seconds()
-
-		httpRequestCount.WithLabelValues(r.URL.Path, r.Method).Inc()
-		httpRequestDuration.WithLabelValues(r.URL.Path).Observe(duration)
+func initTracer(logger *slog.Logger) *sdktrace.TracerProvider {
+	cfg, err := tracerConfigFromEnv()
+	if err != nil {
+		fatal(logger, "Invalid tracing configuration", "err", err)
 	}
+	tp, err := newTracerProvider(context.Background(), cfg)
+	if err != nil {
+		fatal(logger, "Failed to initialize tracer", "err", err, "exporter", cfg.Exporter)
+	}
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	logger.Info("OpenTelemetry tracer initialized",
+		"exporter", cfg.Exporter, "endpoint", cfg.Endpoint, "sample_ratio", cfg.SampleRatio,
+		"service", cfg.ServiceName, "environment", cfg.Environment)
+	return tp
 }
@@ -3,56 +3,338 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
-
-	sqlmock "github.com/DATA-DOG/go-sqlmock"
-	redismock "github.com/go-redis/redismock/v9"
+	"time"
 )
 
-func TestHealthHandler_MockDBRedis(t *testing.T) {
-	// mock PostgreSQL
-	mockDB, mockSQL, err := sqlmock.New()
+func TestServe_DrainsInFlightRequestsOnShutdown(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	listenerClosed := make(chan struct{})
+	srv := &http.Server{Handler: mux}
+	srv.RegisterOnShutdown(func() { close(listenerClosed) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, discardLogger, shutdownOptions{timeout: 5 * time.Second}, listener{name: "test", srv: srv, ln: ln})
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		slow <- result{body: string(b), err: err}
+	}()
+
+	<-started
+	cancel()
+	<-listenerClosed
+
+	// new connections are refused once shutdown has begun
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("expected new connection to be refused after shutdown began")
+	}
+
+	// the in-flight request still completes
+	res := <-slow
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.body != "done" {
+		t.Errorf("expected body %q, got %q", "done", res.body)
+	}
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("expected clean shutdown, got %v", err)
+	}
+}
+
+func TestServe_FailsReadinessBeforeClosingListeners(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	publicLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	internalLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	})
+	public := &http.Server{Handler: mux}
+	listenerClosed := make(chan struct{})
+	public.RegisterOnShutdown(func() { close(listenerClosed) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, discardLogger, shutdownOptions{drain: s.Drain, delay: 300 * time.Millisecond, timeout: 5 * time.Second},
+			listener{name: "public", srv: public, ln: publicLn},
+			listener{name: "internal", srv: &http.Server{Handler: s.InternalHandler()}, ln: internalLn},
+		)
+	}()
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + publicLn.Addr().String() + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		slow <- string(b)
+	}()
+	<-started
+	cancel()
+
+	// Readiness fails while the listeners still serve.
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get("http://" + internalLn.Addr().String() + "/readyz")
+		if err != nil {
+			t.Fatalf("readyz failed: %v", err)
+		}
+		var body healthResponse
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable && body.Checks["shutdown"].Status == "draining" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readyz still answers %d %+v after shutdown began", resp.StatusCode, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-listenerClosed:
+		t.Fatal("listener closed before readiness failed")
+	default:
+	}
+
+	<-listenerClosed
+	close(release)
+	if body := <-slow; body != "done" {
+		t.Errorf("expected the in-flight request to complete, got %q", body)
+	}
+	if err := <-serveErr; err != nil {
+		t.Errorf("expected clean shutdown, got %v", err)
+	}
+}
+
+func TestServe_SegregatesPublicAndInternalRoutes(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.InternalAddr = "127.0.0.1:0"
+	s.cfg.EnablePprof = true
+
+	publicLn, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("failed to create sqlmock: %v", err)
+		t.Fatalf("failed to listen: %v", err)
+	}
+	internalLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, discardLogger, shutdownOptions{timeout: 5 * time.Second},
+			listener{name: "public", srv: &http.Server{Handler: s.Handler()}, ln: publicLn},
+			listener{name: "internal", srv: &http.Server{Handler: s.InternalHandler()}, ln: internalLn},
+		)
+	}()
+
+	get := func(ln net.Listener, path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
 	}
-	defer mockDB.Close()
-	db = mockDB
 
-	mockSQL.ExpectPing()
+	if code, body := get(internalLn, "/metrics"); code != http.StatusOK || !strings.Contains(body, "# HELP") {
+		t.Errorf("expected metrics on the internal listener, got %d", code)
+	}
+	if _, body := get(publicLn, "/metrics"); strings.Contains(body, "# HELP") {
+		t.Errorf("metrics must not be served on the public listener")
+	}
+	if code, _ := get(internalLn, "/debug/pprof/"); code != http.StatusOK {
+		t.Errorf("expected pprof on the internal listener, got %d", code)
+	}
+	if code, body := get(publicLn, "/debug/pprof/"); code != http.StatusNotFound || strings.Contains(body, "profile") {
+		t.Errorf("pprof must not be served on the public listener, got %d", code)
+	}
+	if code, body := get(internalLn, "/debug/vars"); code != http.StatusOK || !strings.Contains(body, "memstats") {
+		t.Errorf("expected expvar on the internal listener, got %d", code)
+	}
+	if code, _ := get(publicLn, "/debug/vars"); code != http.StatusNotFound {
+		t.Errorf("expvar must not be served on the public listener, got %d", code)
+	}
+	if code, _ := get(internalLn, "/products"); code != http.StatusNotFound {
+		t.Errorf("expected /products to 404 on the internal listener, got %d", code)
+	}
+	if code, _ := get(publicLn, "/products"); code != http.StatusOK {
+		t.Errorf("expected /products on the public listener, got %d", code)
+	}
 
-	// mock Redis
-	mockRedis, redisMock := redismock.NewClientMock()
-	defer mockRedis.Close()
-	rdb = mockRedis
-	ctx = context.Background()
+	cancel()
+	if err := <-serveErr; err != nil {
+		t.Errorf("expected clean shutdown, got %v", err)
+	}
+	for _, ln := range []net.Listener{publicLn, internalLn} {
+		if conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+			conn.Close()
+			t.Errorf("expected %s to be closed after shutdown", ln.Addr())
+		}
+	}
+}
 
-	redisMock.ExpectPing().SetVal("PONG")
+func TestHandler_ServesMetricsPubliclyWithoutInternalListener(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
 
-	// create test HTTP request
-	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
 	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "# HELP") {
+		t.Errorf("expected metrics on the public handler when INTERNAL_ADDR is empty")
+	}
+}
 
-	// call handler
-	healthHandler(w, req)
+func TestInternalHandler_HidesDebugEndpointsByDefault(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
 
-	resp := w.Result()
-	defer resp.Body.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/vars"} {
+		w := httptest.NewRecorder()
+		s.InternalHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404 without ENABLE_PPROF, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestNewHTTPServer_ClosesConnectionAfterWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("too late"))
+	})
+
+	cfg := Config{
+		ReadHeaderTimeout: time.Second,
+		ReadTimeout:       time.Second,
+		WriteTimeout:      50 * time.Millisecond,
+		IdleTimeout:       time.Second,
+	}
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config = newHTTPServer(cfg, handler)
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL)
+	if err == nil {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr == nil {
+			t.Fatalf("expected the connection to be closed, got %d %q", resp.StatusCode, body)
+		}
+	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected 200 OK, got %d", resp.StatusCode)
+func TestNewHTTPServer_AppliesConfiguredTimeouts(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		ReadHeaderTimeout: 1 * time.Second,
+		ReadTimeout:       2 * time.Second,
+		WriteTimeout:      3 * time.Second,
+		IdleTimeout:       4 * time.Second,
 	}
+	srv := newHTTPServer(cfg, http.NotFoundHandler())
 
-	var body map[string]string
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		t.Fatalf("failed to decode body: %v", err)
+	if srv.ReadHeaderTimeout != cfg.ReadHeaderTimeout || srv.ReadTimeout != cfg.ReadTimeout ||
+		srv.WriteTimeout != cfg.WriteTimeout || srv.IdleTimeout != cfg.IdleTimeout {
+		t.Errorf("timeouts not applied: %+v", srv)
 	}
+}
+
+func TestServe_StopsGRPCWithHTTP(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, discardLogger, shutdownOptions{timeout: 5 * time.Second},
+			listener{name: "public", srv: &http.Server{Handler: s.Handler()}, ln: httpLn},
+			listener{name: "grpc", grpc: s.GRPCServer(), ln: grpcLn},
+		)
+	}()
 
-	if body["database"] != "ok" {
-		t.Errorf("expected database to be ok, got %s", body["database"])
+	cancel()
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return")
 	}
-	if body["redis"] != "ok" {
-		t.Errorf("expected redis to be ok, got %s", body["redis"])
+	if conn, err := net.DialTimeout("tcp", grpcLn.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("expected the gRPC listener closed")
 	}
 }
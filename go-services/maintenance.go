@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultMaintenanceRetryAfter is advertised in Retry-After when the
+// maintenance window has no end time.
+const defaultMaintenanceRetryAfter = time.Minute
+
+// probeRoutes are the health check routes. They are served during
+// maintenance and overload alike, so that probes keep reporting on the pod
+// rather than failing with 503.
+var probeRoutes = map[string]bool{
+	"/livez":   true,
+	"/readyz":  true,
+	"/healthz": true,
+}
+
+type maintenanceState struct {
+	active bool
+	// until is when maintenance ends; zero when it has no end time.
+	until time.Time
+}
+
+// maintenanceCache remembers the last maintenance state read from Redis so
+// that requests within MaintenanceCacheTTL of each other share one lookup.
+type maintenanceCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	state   maintenanceState
+}
+
+func (c *maintenanceCache) get(now time.Time, ttl time.Duration) (maintenanceState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked.IsZero() || now.Sub(c.checked) >= ttl {
+		return maintenanceState{}, false
+	}
+	return c.state, true
+}
+
+func (c *maintenanceCache) last() maintenanceState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *maintenanceCache) set(now time.Time, state maintenanceState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked, c.state = now, state
+}
+
+// currentMaintenance reports whether maintenance mode is active. A Redis
+// failure keeps the last known state, so an outage neither takes the
+// service down nor ends a maintenance window early.
+func (s *Server) currentMaintenance(ctx context.Context) maintenanceState {
+	now := time.Now()
+	if state, ok := s.maintenance.get(now, s.settings().MaintenanceCacheTTL); ok {
+		return state
+	}
+
+	var state maintenanceState
+	val, err := s.rdb.Get(ctx, s.keys.maintenance()).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+	case err != nil:
+		s.logger.WarnContext(ctx, "Maintenance lookup failed", "err", err)
+		state = s.maintenance.last()
+	default:
+		state.active = true
+		if val != "" {
+			state.until, _ = time.Parse(time.RFC3339, val)
+		}
+	}
+	s.maintenance.set(now, state)
+	return state
+}
+
+// withMaintenance answers 503 while maintenance mode is active, except on
+// the probe routes.
+func (s *Server) withMaintenance(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if probeRoutes[s.routeLabel(r)] {
+			handler(w, r)
+			return
+		}
+		state := s.currentMaintenance(r.Context())
+		if !state.active {
+			handler(w, r)
+			return
+		}
+
+		wait := defaultMaintenanceRetryAfter
+		if !state.until.IsZero() {
+			wait = max(time.Until(state.until), time.Second)
+		}
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		s.writeError(w, http.StatusServiceUnavailable, codeMaintenance, "service is down for maintenance")
+	}
+}
+
+type maintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+	// TTLSeconds ends maintenance automatically after that many seconds;
+	// zero means it lasts until disabled.
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+// maintenanceHandler turns maintenance mode on or off. It is only served on
+// the internal listener, behind requireRole. Other replicas notice the
+// change within MaintenanceCacheTTL.
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req maintenanceRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	if req.TTLSeconds < 0 {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "ttl_seconds must not be negative")
+		return
+	}
+
+	var (
+		state maintenanceState
+		err   error
+	)
+	if req.Enabled {
+		ttl := time.Duration(req.TTLSeconds) * time.Second
+		state.active = true
+		var val string
+		if ttl > 0 {
+			state.until = time.Now().Add(ttl).UTC().Truncate(time.Second)
+			val = state.until.Format(time.RFC3339)
+		}
+		err = s.rdb.Set(ctx, s.keys.maintenance(), val, ttl).Err()
+	} else {
+		err = s.rdb.Del(ctx, s.keys.maintenance()).Err()
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to update maintenance mode", "enabled", req.Enabled, "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+
+	s.maintenance.set(time.Now(), state)
+	s.logger.InfoContext(ctx, "Maintenance mode updated", "enabled", req.Enabled, "ttl_seconds", req.TTLSeconds)
+	s.audit(r, auditMaintenanceUpdated, 0, map[string]any{"enabled": req.Enabled, "ttl_seconds": req.TTLSeconds})
+	w.WriteHeader(http.StatusNoContent)
+}
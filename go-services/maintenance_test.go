@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-secret"
+
+func postMaintenance(s *Server, auth, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/admin/maintenance", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func getPath(s *Server, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestMaintenance_ActiveKeyReturns503WithRetryAfter(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.MaintenanceCacheTTL = time.Hour
+
+	until := time.Now().Add(90 * time.Second).UTC().Format(time.RFC3339)
+	redisMock.ExpectGet(testKeys.maintenance()).SetVal(until)
+
+	w := getPath(s, "/")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeMaintenance {
+		t.Errorf("expected code %q, got %+v", codeMaintenance, got)
+	}
+	if got := w.Header().Get("Retry-After"); got != "89" && got != "90" {
+		t.Errorf("expected Retry-After of about 90s, got %q", got)
+	}
+
+	// Within the cache window the flag is not read from Redis again.
+	if w := getPath(s, "/products"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the cached flag to keep answering 503, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestMaintenance_RereadsFlagAfterCacheWindow(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.MaintenanceCacheTTL = 2 * time.Second
+
+	// Cached as active, but checked longer ago than the window.
+	s.maintenance.set(time.Now().Add(-3*time.Second), maintenanceState{active: true})
+	redisMock.ExpectGet(testKeys.maintenance()).RedisNil()
+
+	if w := getPath(s, "/"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 once the key is gone, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestMaintenance_UnboundedWindowUsesDefaultRetryAfter(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MaintenanceCacheTTL = time.Hour
+	s.maintenance.set(time.Now(), maintenanceState{active: true})
+
+	w := getPath(s, "/")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After 60, got %q", got)
+	}
+}
+
+func TestMaintenance_ExemptsHealthRoutesAndFailsReadiness(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	s.cfg.MaintenanceCacheTTL = time.Hour
+	s.maintenance.set(time.Now(), maintenanceState{active: true})
+
+	if w := getPath(s, "/livez"); w.Code != http.StatusOK {
+		t.Errorf("expected /livez to stay up, got %d", w.Code)
+	}
+
+	mockSQL.ExpectPing()
+	redisMock.ExpectPing().SetVal("PONG")
+	w := getPath(s, "/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected /readyz to report unready, got %d", w.Code)
+	}
+	body := decodeHealth(t, w)
+	if body.Checks["maintenance"].Status != "active" || body.Checks["database"].Status != "ok" {
+		t.Errorf("unexpected checks: %+v", body.Checks)
+	}
+	if w.Header().Get("Retry-After") != "" {
+		t.Errorf("expected the readiness response itself, not the maintenance error")
+	}
+}
+
+func TestMaintenanceHandler_TogglesMode(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	s.cfg.MaintenanceCacheTTL = time.Hour
+
+	redisMock.Regexp().ExpectSet(testKeys.maintenance(), `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ$`, 10*time.Minute).SetVal("OK")
+	if w := postMaintenance(s, "Bearer "+testAdminToken, `{"enabled":true,"ttl_seconds":600}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	// This replica does not wait for the cache window to notice.
+	if w := getPath(s, "/"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 right after enabling, got %d", w.Code)
+	}
+
+	redisMock.ExpectDel(testKeys.maintenance()).SetVal(1)
+	if w := postMaintenance(s, "Bearer "+testAdminToken, `{"enabled":false}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := getPath(s, "/"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 right after disabling, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestMaintenanceHandler_RequiresAdminToken(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := postMaintenance(s, "Bearer anything", `{"enabled":true}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without ADMIN_AUTH_TOKEN, got %d", w.Code)
+	}
+
+	s.cfg.AdminAuthToken = testAdminToken
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testAdminToken} {
+		w := postMaintenance(s, auth, `{"enabled":true}`)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", auth, w.Code)
+		}
+		if got := decodeError(t, w); got.Code != codeUnauthorized {
+			t.Errorf("%q: expected code %q, got %+v", auth, codeUnauthorized, got)
+		}
+	}
+
+	if w := postMaintenance(s, "Bearer "+testAdminToken, `{"enabled":true,"ttl_seconds":-1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative TTL, got %d", w.Code)
+	}
+	if w := getPath(s, "/admin/maintenance"); w.Code != http.StatusNotFound {
+		t.Errorf("expected the admin endpoint to be absent from the public handler, got %d", w.Code)
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type metrics struct {
+	httpRequestCount     *prometheus.CounterVec
+	httpRequestDuration  *prometheus.HistogramVec
+	httpStreamDuration   *prometheus.HistogramVec
+	httpInFlight         prometheus.Gauge
+	requestsShed         *prometheus.CounterVec
+	requestsRateLimited  *prometheus.CounterVec
+	productViewsDropped  prometheus.Counter
+	wsOpen               prometheus.Gauge
+	wsConnections        *prometheus.CounterVec
+	wsMessages           *prometheus.CounterVec
+	breakerState         *prometheus.GaugeVec
+	cacheHits            *prometheus.CounterVec
+	cacheMisses          *prometheus.CounterVec
+	cacheOperations      *prometheus.CounterVec
+	cacheValueBytes      *prometheus.CounterVec
+	flagEvaluations      *prometheus.CounterVec
+	responseCache        *prometheus.CounterVec
+	staleCacheServes     *prometheus.CounterVec
+	cacheRefreshes       *prometheus.HistogramVec
+	cacheRefreshSuccess  *prometheus.GaugeVec
+	pgNotifications      *prometheus.CounterVec
+	pgLastNotification   *prometheus.GaugeVec
+	dbQueryDuration      *prometheus.HistogramVec
+	dbErrors             *prometheus.CounterVec
+	redisCommandDuration *prometheus.HistogramVec
+	redisErrors          *prometheus.CounterVec
+	outboundDuration     *prometheus.HistogramVec
+	grpcHandled          *prometheus.CounterVec
+	grpcDuration         *prometheus.HistogramVec
+	httpPanics           *prometheus.CounterVec
+	errorReports         *prometheus.CounterVec
+	auditEvents          *prometheus.CounterVec
+	productEvents        *prometheus.CounterVec
+	webhookDeliveries    *prometheus.CounterVec
+	webhookAttempts      *prometheus.CounterVec
+	webhookDeadLetters   prometheus.Gauge
+	loginAttempts        *prometheus.CounterVec
+	loginLockouts        prometheus.Counter
+	buildInfo            *prometheus.GaugeVec
+	dbStats              prometheus.Collector
+	// replicaStats exports the replica pool's db.Stats(); nil without a
+	// replica.
+	replicaStats prometheus.Collector
+}
+
+// newMetrics creates the service metrics. db is exported through a
+// collector that reads db.Stats() on every scrape.
+func newMetrics(db *sql.DB, dbName string) *metrics {
+	return &metrics{
+		httpRequestCount: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_total",
+				Help: "Total number of HTTP requests",
+			},
+			[]string{"path", "method", "status"},
+		),
+		httpRequestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_duration_seconds",
+				Help:    "Duration of HTTP requests",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"path", "status"},
+		),
+		httpStreamDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_stream_duration_seconds",
+				Help:    "How long event streams stayed open; kept out of http_request_duration_seconds",
+				Buckets: []float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600},
+			},
+			[]string{"path"},
+		),
+		httpInFlight: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "http_requests_in_flight",
+				Help: "Number of HTTP requests being served, including those waiting for a slot",
+			},
+		),
+		requestsShed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "requests_shed_total",
+				Help: "Total number of requests answered 503 because MAX_IN_FLIGHT requests were already being served",
+			},
+			[]string{"path"},
+		),
+		requestsRateLimited: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "requests_rate_limited_total",
+				Help: "Total number of requests answered 429 because their client was over its RATE_LIMITS",
+			},
+			[]string{"path"},
+		),
+		productViewsDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "product_views_dropped_total",
+				Help: "Total number of product views not counted because the view queue was full",
+			},
+		),
+		wsOpen: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "websocket_connections_open",
+				Help: "Number of open WebSocket connections",
+			},
+		),
+		wsConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "websocket_connections_total",
+				Help: "Total number of WebSocket upgrade requests by result: accepted or rejected at WS_MAX_CONNECTIONS",
+			},
+			[]string{"result"},
+		),
+		wsMessages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "websocket_messages_total",
+				Help: "Total number of WebSocket data messages by direction: sent or received",
+			},
+			[]string{"direction"},
+		),
+		breakerState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "circuit_breaker_state",
+				Help: "State of the circuit breaker around a dependency: 0 closed, 1 open, 2 half-open",
+			},
+			[]string{"dependency"},
+		),
+		cacheHits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cache_hits_total",
+				Help: "Total number of Redis cache hits",
+			},
+			[]string{"cache"},
+		),
+		cacheMisses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cache_misses_total",
+				Help: "Total number of Redis cache misses, including lookups that failed",
+			},
+			[]string{"cache"},
+		),
+		cacheOperations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cache_operations_total",
+				Help: "Total number of Redis cache lookups by result: hit, miss or error",
+			},
+			[]string{"cache", "result"},
+		),
+		cacheValueBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cache_value_bytes_total",
+				Help: "Total size of the values written to the Redis cache, serialized (before compression) and stored (after)",
+			},
+			[]string{"cache", "stage"},
+		),
+		responseCache: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "response_cache_requests_total",
+				Help: "Total number of requests to RESPONSE_CACHE_ROUTES by result: hit, shared, miss or bypass",
+			},
+			[]string{"path", "result"},
+		),
+		flagEvaluations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "feature_flag_evaluations_total",
+				Help: "Total number of feature flag lookups by flag and the value returned",
+			},
+			[]string{"flag", "value"},
+		),
+		staleCacheServes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "stale_cache_serves_total",
+				Help: "Total number of responses served from a stale copy because Postgres failed",
+			},
+			[]string{"cache"},
+		),
+		cacheRefreshes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "cache_refresh_duration_seconds",
+				Help:    "Duration of background cache refreshes, including failed ones",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"cache"},
+		),
+		cacheRefreshSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cache_refresh_last_success_timestamp_seconds",
+				Help: "Unix time of the last background cache refresh this replica completed",
+			},
+			[]string{"cache"},
+		),
+		pgNotifications: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pg_notifications_received_total",
+				Help: "Total number of Postgres notifications received by channel",
+			},
+			[]string{"channel"},
+		),
+		pgLastNotification: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pg_notification_last_received_timestamp_seconds",
+				Help: "Unix time of the last Postgres notification received by channel",
+			},
+			[]string{"channel"},
+		),
+		dbQueryDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "db_query_duration_seconds",
+				Help:    "Duration of database queries by call site and pool (primary or replica)",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"query", "pool"},
+		),
+		dbErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "db_errors_total",
+				Help: "Total number of failed database queries by SQLSTATE, or deadline_exceeded, canceled or other for errors without one",
+			},
+			[]string{"code"},
+		),
+		redisCommandDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "redis_command_duration_seconds",
+				Help:    "Duration of Redis commands by command, with whole pipelines as pipeline",
+				Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+			},
+			[]string{"command"},
+		),
+		redisErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "redis_errors_total",
+				Help: "Total number of failed Redis commands by error type (timeout, network or redis-error)",
+			},
+			[]string{"type"},
+		),
+		outboundDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "outbound_request_duration_seconds",
+				Help:    "Duration of each attempt of an HTTP request to another service, by target host",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"target"},
+		),
+		grpcHandled: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "grpc_server_handled_total",
+				Help: "Total number of gRPC calls completed on the server, by method and status code",
+			},
+			[]string{"grpc_service", "grpc_method", "grpc_code"},
+		),
+		grpcDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "grpc_server_handling_seconds",
+				Help:    "Duration of unary gRPC calls on the server",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"grpc_service", "grpc_method"},
+		),
+		httpPanics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_panics_total",
+				Help: "Total number of HTTP handler panics recovered",
+			},
+			[]string{"path"},
+		),
+		errorReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "error_reports_total",
+				Help: "Total number of server errors by reporting result: sent, failed, deduplicated, rate_limited or dropped",
+			},
+			[]string{"result"},
+		),
+		auditEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "audit_events_total",
+				Help: "Total number of audit events by outcome: written, failed or dropped",
+			},
+			[]string{"result"},
+		),
+		productEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "product_events_total",
+				Help: "Total number of product events sent to EVENTS_PUBLISHER by result: published, failed, retried (published from the outbox) or lost",
+			},
+			[]string{"result"},
+		),
+		webhookDeliveries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "webhook_deliveries_total",
+				Help: "Total number of payment webhook deliveries by result: accepted, duplicate, invalid_signature, stale, malformed, dropped or error",
+			},
+			[]string{"result"},
+		),
+		webhookAttempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "webhook_notification_attempts_total",
+				Help: "Total number of attempts to deliver a webhook notification by result: delivered, failed (retried later) or dead_lettered",
+			},
+			[]string{"result"},
+		),
+		webhookDeadLetters: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "webhook_dead_letters",
+				Help: "Number of webhook notifications kept as dead letters after running out of attempts",
+			},
+		),
+		loginAttempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "login_attempts_total",
+				Help: "Total number of login attempts by result: success, failure or locked",
+			},
+			[]string{"result"},
+		),
+		loginLockouts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "login_lockouts_total",
+				Help: "Total number of times a username or client address was locked out of login",
+			},
+		),
+		buildInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "service_build_info",
+				Help: "Build metadata of the running binary; always 1",
+			},
+			[]string{"version", "commit", "build_date", "go_version"},
+		),
+		dbStats: collectors.NewDBStatsCollector(db, dbName),
+	}
+}
+
+// setReplica exports the stats of the read replica pool, labelled with
+// dbName and a "_replica" suffix.
+func (m *metrics) setReplica(db *sql.DB, dbName string) {
+	m.replicaStats = collectors.NewDBStatsCollector(db, dbName+"_replica")
+}
+
+// setBuildInfo exports b as the labels of service_build_info.
+func (m *metrics) setBuildInfo(b buildInfo) {
+	m.buildInfo.WithLabelValues(b.Version, b.Commit, b.BuildDate, b.GoVersion).Set(1)
+}
+
+func (m *metrics) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		m.httpRequestCount,
+		m.httpRequestDuration,
+		m.httpStreamDuration,
+		m.httpInFlight,
+		m.requestsShed,
+		m.requestsRateLimited,
+		m.productViewsDropped,
+		m.wsOpen,
+		m.wsConnections,
+		m.wsMessages,
+		m.breakerState,
+		m.cacheHits,
+		m.cacheMisses,
+		m.cacheOperations,
+		m.cacheValueBytes,
+		m.flagEvaluations,
+		m.responseCache,
+		m.staleCacheServes,
+		m.cacheRefreshes,
+		m.cacheRefreshSuccess,
+		m.pgNotifications,
+		m.pgLastNotification,
+		m.dbQueryDuration,
+		m.dbErrors,
+		m.redisCommandDuration,
+		m.redisErrors,
+		m.outboundDuration,
+		m.grpcHandled,
+		m.grpcDuration,
+		m.httpPanics,
+		m.errorReports,
+		m.auditEvents,
+		m.productEvents,
+		m.webhookDeliveries,
+		m.webhookAttempts,
+		m.webhookDeadLetters,
+		m.loginAttempts,
+		m.loginLockouts,
+		m.buildInfo,
+		m.dbStats,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	if m.replicaStats != nil {
+		return reg.Register(m.replicaStats)
+	}
+	return nil
+}
+
+// withMetrics counts and times requests. It must run inside withTracing so
+// that durations can carry the request's trace id as an exemplar. Streams
+// are timed in their own histogram, where hours-long durations do not
+// drown the latency percentiles.
+func (s *Server) withMetrics(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.metrics.httpInFlight.Inc()
+		defer s.metrics.httpInFlight.Dec()
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		handler(rec, r)
+		duration := time.Since(start).Seconds()
+
+		route := s.routeLabel(r)
+		status := strconv.Itoa(rec.status)
+		s.metrics.httpRequestCount.WithLabelValues(route, r.Method, status).Inc()
+		if s.isStream(r) {
+			s.metrics.httpStreamDuration.WithLabelValues(route).Observe(duration)
+			return
+		}
+		observeWithTraceID(r.Context(), s.metrics.httpRequestDuration.WithLabelValues(route, status), duration)
+	}
+}
+
+// observeWithTraceID records v on obs, attaching the trace id of the span in
+// ctx as an exemplar when the span is sampled. Unsampled and no-op spans
+// would point at traces that were never exported, so they are left out.
+func observeWithTraceID(ctx context.Context, obs prometheus.Observer, v float64) {
+	sc := trace.SpanContextFromContext(ctx)
+	eo, ok := obs.(prometheus.ExemplarObserver)
+	if !ok || !sc.IsValid() || !sc.IsSampled() {
+		obs.Observe(v)
+		return
+	}
+	eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": sc.TraceID().String()})
+}
+
+// unknownRoute is the path label for requests that did not match a
+// registered route.
+const unknownRoute = "unknown"
+
+// routeLabel returns the path of the mux pattern that matched r, so that
+// /products/1 and /products/2 share a series. Anything outside the
+// registered set, including raw client-supplied paths, is reported as
+// unknownRoute.
+func (s *Server) routeLabel(r *http.Request) string {
+	if label, ok := s.routes[r.Pattern]; ok {
+		return label
+	}
+	return unknownRoute
+}
+
+// routePath strips the method and the trailing {$} anchor from a mux
+// pattern, turning "GET /{$}" into "/".
+func routePath(pattern string) string {
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	return strings.TrimSuffix(pattern, "{$}")
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler. Handlers that never call WriteHeader are recorded as 200, matching
+// net/http.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack takes over the connection for a protocol upgrade, which is
+// recorded as 101 Switching Protocols. WebSocket libraries assert
+// http.Hijacker on the writer itself rather than unwrapping it.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && !r.wroteHeader {
+		r.status = http.StatusSwitchingProtocols
+		r.wroteHeader = true
+	}
+	return conn, rw, err
+}
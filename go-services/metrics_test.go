@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestWithMetrics_RecordsStatusLabel(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(errors.New("connection refused"))
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+
+	if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues("/products", "GET", "500")); got != 1 {
+		t.Errorf("expected one request with status 500, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues("/products", "GET", "200")); got != 0 {
+		t.Errorf("expected no requests with status 200, got %v", got)
+	}
+	if n := testutil.CollectAndCount(s.metrics.httpRequestDuration); n != 1 {
+		t.Errorf("expected one duration series, got %d", n)
+	}
+}
+
+func TestWithMetrics_DefaultsStatusTo200(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues("/", "GET", "200")); got != 1 {
+		t.Errorf("expected one request with status 200, got %v", got)
+	}
+}
+
+func TestWithMetrics_DoesNotLabelByRawPath(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	h := s.Handler()
+
+	for _, path := range []string{"/products/123/../../etc", "/products/123", "/wp-admin.php"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	ch := make(chan prometheus.Metric, 16)
+	s.metrics.httpRequestCount.Collect(ch)
+	close(ch)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range pb.GetLabel() {
+			if l.GetName() != "path" {
+				continue
+			}
+			if l.GetValue() != "/products/{id}" && l.GetValue() != unknownRoute {
+				t.Errorf("unexpected path label %q", l.GetValue())
+			}
+		}
+	}
+}
+
+func TestWithMetrics_LabelsUnmatchedRequestsUnknown(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/products/123/../../etc", nil)
+	s.withMetrics(s.rootHandler)(httptest.NewRecorder(), req)
+
+	if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues(unknownRoute, "GET", "200")); got != 1 {
+		t.Errorf("expected the request labelled %q, got %v", unknownRoute, got)
+	}
+}
+
+func TestMetrics_ExportsDBPoolStats(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := s.metrics.register(reg); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+
+	got := make(map[string]bool)
+	for _, mf := range families {
+		got[mf.GetName()] = true
+	}
+	for _, name := range []string{
+		"go_sql_open_connections",
+		"go_sql_in_use_connections",
+		"go_sql_idle_connections",
+		"go_sql_wait_count_total",
+		"go_sql_wait_duration_seconds_total",
+	} {
+		if !got[name] {
+			t.Errorf("expected metric family %s", name)
+		}
+	}
+}
+
+func TestMetrics_CacheAndQueryTimingAfterProducts(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := s.metrics.register(reg); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{nil, nil})
+	mockSQL.ExpectQuery(selectProducts).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(1, "Product A", "", 10.99, time.Now(), nil, nil))
+	expectCount(mockSQL, 1)
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectHSet(testKeys.products(), field, `.*`, productsETagField(field), `.*`).SetVal(1)
+	redisMock.ExpectExpireNX(testKeys.products(), time.Minute).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+	redisMock.ExpectHMGet(testKeys.products(), field, productsETagField(field)).SetVal([]any{`{"items":[]}`, nil})
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	samples := make(map[string]float64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName()
+			for _, l := range m.GetLabel() {
+				key += "," + l.GetName() + "=" + l.GetValue()
+			}
+			switch {
+			case m.GetCounter() != nil:
+				samples[key] = m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				samples[key] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	for key, want := range map[string]float64{
+		"cache_operations_total,cache=products,result=miss":           1,
+		"cache_operations_total,cache=products,result=hit":            1,
+		"db_query_duration_seconds,pool=primary,query=list_products":  1,
+		"db_query_duration_seconds,pool=primary,query=count_products": 1,
+		"http_requests_total,method=GET,path=/products,status=200":    2,
+	} {
+		if got := samples[key]; got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	if _, ok := samples["cache_operations_total,cache=products,result=error"]; ok {
+		t.Error("expected no cache errors")
+	}
+}
+
+// durationExemplars returns the exemplars on the http_request_duration_seconds
+// buckets gathered from reg.
+func durationExemplars(t *testing.T, reg *prometheus.Registry) []*dto.Exemplar {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	var exemplars []*dto.Exemplar
+	for _, mf := range families {
+		if mf.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, b := range m.GetHistogram().GetBucket() {
+				if e := b.GetExemplar(); e != nil {
+					exemplars = append(exemplars, e)
+				}
+			}
+		}
+	}
+	return exemplars
+}
+
+func TestWithMetrics_AttachesTraceIDExemplarWhenSampled(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	exp := withSpanRecorder(t, s)
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := s.metrics.register(reg); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	exemplars := durationExemplars(t, reg)
+	if len(exemplars) != 1 {
+		t.Fatalf("expected 1 exemplar, got %d", len(exemplars))
+	}
+	labels := exemplars[0].GetLabel()
+	if len(labels) != 1 || labels[0].GetName() != "trace_id" {
+		t.Fatalf("expected a single trace_id label, got %v", labels)
+	}
+	if want := spans[0].SpanContext.TraceID().String(); labels[0].GetValue() != want {
+		t.Errorf("expected trace_id %s, got %s", want, labels[0].GetValue())
+	}
+}
+
+func TestWithMetrics_OmitsExemplarWhenNotSampled(t *testing.T) {
+	t.Parallel()
+	for name, tracer := range map[string]trace.Tracer{
+		"no-op":       noop.NewTracerProvider().Tracer(tracerName),
+		"not sampled": sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())).Tracer(tracerName),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			s, _, _ := newTestServer(t)
+			s.tracer = tracer
+
+			reg := prometheus.NewPedanticRegistry()
+			if err := s.metrics.register(reg); err != nil {
+				t.Fatalf("register: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+
+			if n := testutil.CollectAndCount(s.metrics.httpRequestDuration); n != 1 {
+				t.Fatalf("expected the request to be timed, got %d series", n)
+			}
+			if got := durationExemplars(t, reg); len(got) != 0 {
+				t.Errorf("expected no exemplars, got %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsHandler serves the Prometheus registry, behind withMetricsAuth.
+// OpenMetrics is offered to scrapers that ask for it, since exemplars are
+// only exposed in that format.
+func (s *Server) metricsHandler() http.Handler {
+	return s.withMetricsAuth(promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	))
+}
+
+// withMetricsAuth requires the bearer token in MetricsAuthToken or the basic
+// auth credentials in MetricsBasicAuthUser/Pass, whichever are configured.
+// With neither configured, requests pass through unchanged.
+func (s *Server) withMetricsAuth(next http.Handler) http.Handler {
+	token := s.cfg.MetricsAuthToken
+	user, pass := s.cfg.MetricsBasicAuthUser, s.cfg.MetricsBasicAuthPass
+	if token == "" && user == "" {
+		return next
+	}
+
+	var challenges []string
+	if token != "" {
+		challenges = append(challenges, `Bearer realm="metrics"`)
+	}
+	if user != "" {
+		challenges = append(challenges, `Basic realm="metrics"`)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+			if ok && strings.EqualFold(scheme, "Bearer") && secureEqual(got, token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if user != "" {
+			gotUser, gotPass, ok := r.BasicAuth()
+			// Both comparisons always run so timing does not reveal which
+			// one failed.
+			userOK := secureEqual(gotUser, user)
+			passOK := secureEqual(gotPass, pass)
+			if ok && userOK && passOK {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		for _, c := range challenges {
+			w.Header().Add("WWW-Authenticate", c)
+		}
+		s.writeError(w, http.StatusUnauthorized, codeUnauthorized, "metrics require authentication")
+	})
+}
+
+// secureEqual compares a and b in constant time. Hashing first keeps the
+// time independent of the lengths too.
+func secureEqual(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
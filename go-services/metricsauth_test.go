@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getMetrics(h http.Handler, set func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if set != nil {
+		set(req)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func basic(user, pass string) func(*http.Request) {
+	return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+}
+
+func TestMetricsAuth_Unset(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for name, h := range map[string]http.Handler{"public": s.Handler(), "internal": s.InternalHandler()} {
+		if w := getMetrics(h, nil); w.Code != http.StatusOK {
+			t.Errorf("%s: expected open /metrics, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestMetricsAuth_BearerToken(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MetricsAuthToken = "scrape-secret"
+	h := s.InternalHandler()
+
+	if w := getMetrics(h, bearer("scrape-secret")); w.Code != http.StatusOK {
+		t.Errorf("correct token: expected 200, got %d", w.Code)
+	}
+	for name, set := range map[string]func(*http.Request){
+		"missing":          nil,
+		"wrong token":      bearer("scrape-secre"),
+		"token as basic":   basic("prometheus", "scrape-secret"),
+		"wrong scheme":     func(r *http.Request) { r.Header.Set("Authorization", "Token scrape-secret") },
+		"token with extra": bearer("scrape-secret "),
+	} {
+		w := getMetrics(h, set)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, w.Code)
+			continue
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != `Bearer realm="metrics"` {
+			t.Errorf("%s: WWW-Authenticate = %q", name, got)
+		}
+		if got := decodeError(t, w); got.Code != codeUnauthorized {
+			t.Errorf("%s: expected code %q, got %+v", name, codeUnauthorized, got)
+		}
+	}
+}
+
+func TestMetricsAuth_BasicAuth(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MetricsBasicAuthUser = "prometheus"
+	s.cfg.MetricsBasicAuthPass = "hunter2"
+	h := s.Handler()
+
+	if w := getMetrics(h, basic("prometheus", "hunter2")); w.Code != http.StatusOK {
+		t.Errorf("correct credentials: expected 200, got %d", w.Code)
+	}
+	for name, set := range map[string]func(*http.Request){
+		"wrong password": basic("prometheus", "hunter3"),
+		"wrong user":     basic("grafana", "hunter2"),
+		"bearer":         bearer("hunter2"),
+	} {
+		if w := getMetrics(h, set); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestMetricsAuth_EitherCredential(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MetricsAuthToken = "scrape-secret"
+	s.cfg.MetricsBasicAuthUser = "prometheus"
+	s.cfg.MetricsBasicAuthPass = "hunter2"
+	h := s.InternalHandler()
+
+	if w := getMetrics(h, bearer("scrape-secret")); w.Code != http.StatusOK {
+		t.Errorf("bearer: expected 200, got %d", w.Code)
+	}
+	if w := getMetrics(h, basic("prometheus", "hunter2")); w.Code != http.StatusOK {
+		t.Errorf("basic: expected 200, got %d", w.Code)
+	}
+	w := getMetrics(h, nil)
+	if got := w.Header().Values("WWW-Authenticate"); len(got) != 2 {
+		t.Errorf("expected both challenges, got %q", got)
+	}
+}
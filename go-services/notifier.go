@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+const (
+	// resetMailBuffer is how many password reset mails may wait for
+	// runResetMailer; more are dropped.
+	resetMailBuffer = 64
+	// notifyTimeout bounds sending one mail.
+	notifyTimeout = 30 * time.Second
+)
+
+// Notifier tells users about their account. runResetMailer calls it from a
+// single goroutine.
+type Notifier interface {
+	SendPasswordReset(ctx context.Context, m resetMail) error
+}
+
+// resetMail is a password reset token on its way to its user.
+type resetMail struct {
+	To        string
+	Username  string
+	Token     string
+	ExpiresIn time.Duration
+}
+
+// newNotifier returns the Notifier mailing through SMTPAddr, or one that
+// sends nothing when it is not set.
+func newNotifier(cfg Config) Notifier {
+	if cfg.SMTPAddr == "" {
+		return noopNotifier{}
+	}
+	host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+	n := smtpNotifier{addr: cfg.SMTPAddr, host: host, from: cfg.SMTPFrom}
+	if cfg.SMTPUsername != "" {
+		n.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return n
+}
+
+// noopNotifier drops every notification.
+type noopNotifier struct{}
+
+func (noopNotifier) SendPasswordReset(context.Context, resetMail) error { return nil }
+
+// smtpNotifier mails notifications through an SMTP server, upgrading the
+// connection with STARTTLS whenever the server offers it.
+type smtpNotifier struct {
+	addr string
+	host string
+	from string
+	// auth logs in to the server, or is nil to send without logging in.
+	auth smtp.Auth
+}
+
+func (n smtpNotifier) SendPasswordReset(ctx context.Context, m resetMail) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: Reset your password\r\n", n.from, m.To)
+	fmt.Fprintf(&body, "Date: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Hello %s,\r\n\r\nUse this code to choose a new password:\r\n\r\n%s\r\n\r\n", m.Username, m.Token)
+	fmt.Fprintf(&body, "It expires in %d minutes and works once. If you did not ask to reset your password, ignore this mail.\r\n", int(m.ExpiresIn.Round(time.Minute).Minutes()))
+	return n.send(ctx, m.To, body.Bytes())
+}
+
+// send delivers msg to to. Unlike smtp.SendMail it gives up when ctx is
+// done.
+func (n smtpNotifier) send(ctx context.Context, to string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if n.auth != nil {
+		if err := c.Auth(n.auth); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// runResetMailer sends the queued password reset mails until ctx is done.
+func (s *Server) runResetMailer(ctx context.Context) {
+	for {
+		select {
+		case m := <-s.resetMails:
+			sendCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+			err := s.notifier.SendPasswordReset(sendCtx, m)
+			cancel()
+			if err != nil {
+				s.logger.WarnContext(ctx, "Failed to send password reset", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts one connection on a local port, speaking just enough
+// SMTP to take a mail, and returns its address and a channel receiving the
+// commands and message it got.
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	got := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var transcript strings.Builder
+		defer func() { got <- transcript.String() }()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for inData := false; ; {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case inData:
+				if cmd == "." {
+					inData = false
+					reply("250 queued")
+				}
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(cmd, "AUTH"):
+				reply("235 accepted")
+			case cmd == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestSMTPNotifier_SendsPasswordReset(t *testing.T) {
+	t.Parallel()
+	addr, got := fakeSMTP(t)
+
+	n := newNotifier(Config{SMTPAddr: addr, SMTPFrom: "shop@example.com", SMTPUsername: "shop", SMTPPassword: "secret"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := n.SendPasswordReset(ctx, resetMail{To: "alice@example.com", Username: "alice", Token: "abc123", ExpiresIn: 30 * time.Minute})
+	if err != nil {
+		t.Fatalf("SendPasswordReset: %v", err)
+	}
+
+	transcript := <-got
+	for _, want := range []string{
+		"AUTH PLAIN",
+		"MAIL FROM:<shop@example.com>",
+		"RCPT TO:<alice@example.com>",
+		"To: alice@example.com",
+		"Hello alice,",
+		"abc123",
+		"It expires in 30 minutes",
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("expected %q in the session:\n%s", want, transcript)
+		}
+	}
+}
+
+func TestNewNotifier_NoopWithoutSMTP(t *testing.T) {
+	t.Parallel()
+
+	if _, ok := newNotifier(Config{}).(noopNotifier); !ok {
+		t.Error("expected the no-op notifier without SMTP_ADDR")
+	}
+}
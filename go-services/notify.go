@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// listenerPingInterval is how often an idle listener connection is
+	// pinged, so that one dropped without a TCP reset is still noticed.
+	listenerPingInterval = 90 * time.Second
+	// listenerConnectTimeout bounds each connection attempt; lib/pq's
+	// listener connections take no context.
+	listenerConnectTimeout = 10 * time.Second
+	// listenerBuffer is how many notifications may queue while one is
+	// being handled.
+	listenerBuffer = 32
+)
+
+// notifyConn is a connection subscribed to a Postgres notification channel.
+type notifyConn interface {
+	// Notifications is closed when the connection is lost.
+	Notifications() <-chan *pq.Notification
+	// Err is why the connection was lost. It is only valid once
+	// Notifications is closed.
+	Err() error
+	Ping() error
+	Close() error
+}
+
+// pqNotifyConn is a notifyConn backed by a lib/pq listener connection.
+type pqNotifyConn struct {
+	*pq.ListenerConn
+	ch chan *pq.Notification
+}
+
+func (c pqNotifyConn) Notifications() <-chan *pq.Notification { return c.ch }
+
+// dialNotify returns a function that connects to Postgres with dsn and
+// LISTENs on channel.
+func dialNotify(dsn, channel string) func(context.Context) (notifyConn, error) {
+	dsn += " connect_timeout=" + strconv.Itoa(int(listenerConnectTimeout.Seconds()))
+	return func(context.Context) (notifyConn, error) {
+		ch := make(chan *pq.Notification, listenerBuffer)
+		lc, err := pq.NewListenerConn(dsn, ch)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := lc.Listen(channel); err != nil {
+			lc.Close()
+			return nil, fmt.Errorf("listen %s: %w", channel, err)
+		}
+		return pqNotifyConn{ListenerConn: lc, ch: ch}, nil
+	}
+}
+
+// runProductsListener invalidates the product caches whenever Postgres
+// reports a change on ProductsNotifyChannel (see store/migrations/0002_products_notify.sql),
+// so that writes made outside this service show up without waiting for the
+// TTL. A lost
+// connection is re-established with b's delays until ctx is cancelled;
+// because notifications sent while disconnected are lost, the list cache is
+// dropped after every reconnect.
+func (s *Server) runProductsListener(ctx context.Context, dial func(context.Context) (notifyConn, error), b backoff) {
+	channel := s.cfg.ProductsNotifyChannel
+	failures := 0
+	connected := false
+	for {
+		conn, err := dial(ctx)
+		if err == nil {
+			s.logger.InfoContext(ctx, "Listening for product changes", "channel", channel, "reconnect", connected)
+			if connected {
+				s.cacheInvalidate(ctx, s.keys.products())
+			}
+			failures, connected = 0, true
+			err = s.consumeProductNotifications(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		failures++
+		wait := b.delay(failures)
+		s.logger.WarnContext(ctx, "Product change listener disconnected",
+			"channel", channel, "attempt", failures, "retry_in", wait.String(), "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// consumeProductNotifications handles notifications from conn until the
+// connection is lost or ctx is cancelled, and closes it.
+func (s *Server) consumeProductNotifications(ctx context.Context, conn notifyConn) error {
+	defer conn.Close()
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ping.C:
+			if err := conn.Ping(); err != nil {
+				return fmt.Errorf("ping: %w", err)
+			}
+		case n, ok := <-conn.Notifications():
+			if !ok {
+				if err := conn.Err(); err != nil {
+					return err
+				}
+				return errors.New("connection closed")
+			}
+			s.handleProductChange(ctx, n.Extra)
+			// A bulk write sends one notification per row; coalesce
+			// whatever has queued so the list is reloaded once.
+			for pending := len(conn.Notifications()); pending > 0; pending-- {
+				if n, ok := <-conn.Notifications(); ok {
+					s.handleProductChange(ctx, n.Extra)
+				}
+			}
+			if s.settings().ProductsCacheTTL <= 0 {
+				continue
+			}
+			if err := s.loadProductsCache(ctx); err != nil && ctx.Err() == nil {
+				s.logger.WarnContext(ctx, "Products cache reload after change failed", "err", err)
+			}
+		}
+	}
+}
+
+// handleProductChange drops the cached copies affected by a change. payload
+// is the changed product's id; without one only the list is dropped, and
+// single-product entries are left to expire.
+func (s *Server) handleProductChange(ctx context.Context, payload string) {
+	channel := s.cfg.ProductsNotifyChannel
+	s.metrics.pgNotifications.WithLabelValues(channel).Inc()
+	s.metrics.pgLastNotification.WithLabelValues(channel).SetToCurrentTime()
+
+	keys := []string{s.keys.products()}
+	if id, err := strconv.ParseInt(payload, 10, 64); err == nil {
+		keys = append(keys, s.keys.product(id))
+	}
+	s.logger.DebugContext(ctx, "Product change received", "channel", channel, "payload", payload)
+	s.cacheInvalidate(ctx, keys...)
+}
@@ -0,0 +1,161 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	redismock "github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go-service/store"
+)
+
+// These tests need a disposable Postgres, e.g.
+//
+//	TEST_DATABASE_DSN="host=localhost user=postgres password=postgres dbname=postgres sslmode=disable" \
+//		go test -tags integration -run Integration .
+//
+// They apply the schema migrations, which install the products trigger.
+
+func integrationDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open DB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := store.Migrate(context.Background(), db, discardLogger); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db, dsn
+}
+
+// reserveProductID returns an id for insertProduct, so that the Redis
+// expectations can be set before the listener starts: the mock is not safe
+// to change while the listener goroutine uses it.
+func reserveProductID(t *testing.T, db *sql.DB) int64 {
+	t.Helper()
+	var id int64
+	if err := db.QueryRow(`SELECT nextval(pg_get_serial_sequence('products', 'id'))`).Scan(&id); err != nil {
+		t.Fatalf("reserve id: %v", err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM products WHERE id = $1`, id) })
+	return id
+}
+
+func insertProduct(t *testing.T, db *sql.DB, id int64) {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO products (id, name, price) VALUES ($1, 'Listener test', 1)`, id); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+}
+
+// startListener runs the products listener until the test ends. Every
+// successful connection is signalled on the returned channel.
+func startListener(t *testing.T, s *Server, dsn string) <-chan struct{} {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	connected := make(chan struct{}, 4)
+	dial := dialNotify(dsn, defaultNotifyChannel)
+	go func() {
+		defer close(done)
+		s.runProductsListener(ctx, func(ctx context.Context) (notifyConn, error) {
+			conn, err := dial(ctx)
+			if err == nil {
+				connected <- struct{}{}
+			}
+			return conn, err
+		}, backoff{BaseWait: 100 * time.Millisecond, MaxWait: time.Second})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return connected
+}
+
+// checkRedisAfterListener verifies the Redis expectations once the test
+// ends. Cleanups run last-registered first, so calling it before
+// startListener makes the check run after the listener has stopped.
+func checkRedisAfterListener(t *testing.T, redisMock redismock.ClientMock) {
+	t.Cleanup(func() {
+		if err := redisMock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet redis expectations: %v", err)
+		}
+	})
+}
+
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// waitForNotifications polls the counter, which is safe to read while the
+// listener runs.
+func waitForNotifications(t *testing.T, s *Server, want float64) {
+	t.Helper()
+	counter := s.metrics.pgNotifications.WithLabelValues(defaultNotifyChannel)
+	deadline := time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(counter) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v notifications, got %v", want, testutil.ToFloat64(counter))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIntegration_ProductsListenerInvalidatesOnInsert(t *testing.T) {
+	db, dsn := integrationDB(t)
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsNotifyChannel = defaultNotifyChannel
+
+	id := reserveProductID(t, db)
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(id))
+	checkRedisAfterListener(t, redisMock)
+
+	waitFor(t, startListener(t, s, dsn), "the listener to connect")
+	insertProduct(t, db, id)
+	waitForNotifications(t, s, 1)
+
+}
+
+func TestIntegration_ProductsListenerReconnectsAfterTermination(t *testing.T) {
+	db, dsn := integrationDB(t)
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsNotifyChannel = defaultNotifyChannel
+
+	id := reserveProductID(t, db)
+	// The reconnect drops the list, since notifications may have been
+	// missed, and then the insert is seen on the new connection.
+	expectUnlinkKeys(redisMock, testKeys.products())
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(id))
+	checkRedisAfterListener(t, redisMock)
+
+	connected := startListener(t, s, dsn)
+	waitFor(t, connected, "the listener to connect")
+	_, err := db.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE query LIKE 'LISTEN %' AND pid <> pg_backend_pid()`)
+	if err != nil {
+		t.Fatalf("terminate listener: %v", err)
+	}
+	waitFor(t, connected, "the listener to reconnect")
+
+	insertProduct(t, db, id)
+	waitForNotifications(t, s, 1)
+
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeNotifyConn is a notifyConn whose notifications the test sends.
+type fakeNotifyConn struct {
+	ch     chan *pq.Notification
+	err    error
+	closed atomic.Bool
+}
+
+func newFakeNotifyConn() *fakeNotifyConn {
+	return &fakeNotifyConn{ch: make(chan *pq.Notification, listenerBuffer)}
+}
+
+func (c *fakeNotifyConn) Notifications() <-chan *pq.Notification { return c.ch }
+func (c *fakeNotifyConn) Err() error                             { return c.err }
+func (c *fakeNotifyConn) Ping() error                            { return nil }
+func (c *fakeNotifyConn) Close() error                           { c.closed.Store(true); return nil }
+
+// drop simulates the connection being lost.
+func (c *fakeNotifyConn) drop(err error) {
+	c.err = err
+	close(c.ch)
+}
+
+func (c *fakeNotifyConn) notify(payload string) {
+	c.ch <- &pq.Notification{Channel: defaultNotifyChannel, Extra: payload}
+}
+
+func TestHandleProductChange_InvalidatesAffectedKeys(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsNotifyChannel = defaultNotifyChannel
+
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(7))
+	s.handleProductChange(context.Background(), "7")
+	// TRUNCATE carries no id, so only the list is dropped.
+	expectUnlinkKeys(redisMock, testKeys.products())
+	s.handleProductChange(context.Background(), "")
+
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+	if got := testutil.ToFloat64(s.metrics.pgNotifications.WithLabelValues(defaultNotifyChannel)); got != 2 {
+		t.Errorf("expected 2 notifications counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.pgLastNotification.WithLabelValues(defaultNotifyChannel)); got == 0 {
+		t.Errorf("expected the last-notification timestamp to be set")
+	}
+}
+
+func TestConsumeProductNotifications_CoalescesReload(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsNotifyChannel = defaultNotifyChannel
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	conn := newFakeNotifyConn()
+	for _, id := range []string{"1", "2", "3"} {
+		conn.notify(id)
+		expectUnlinkKeys(redisMock, testKeys.products(), testKeys.key("product", id))
+	}
+	conn.drop(io.ErrUnexpectedEOF)
+
+	// One reload for the three queued notifications.
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectHSet(testKeys.products(), pageParams{Limit: defaultPageLimit}.cacheField(), `.*`, productsETagField(pageParams{Limit: defaultPageLimit}.cacheField()), `.*`).SetVal(1)
+	redisMock.ExpectExpireNX(testKeys.products(), time.Minute).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	err := s.consumeProductNotifications(context.Background(), conn)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected the connection error, got %v", err)
+	}
+	if !conn.closed.Load() {
+		t.Error("expected the connection to be closed")
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+	if n := testProducts(s).callCount(); n != 2 {
+		t.Errorf("expected one reload to list and count, got %d calls", n)
+	}
+}
+
+func TestRunProductsListener_ReconnectsWithBackoff(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsNotifyChannel = defaultNotifyChannel
+
+	first, second := newFakeNotifyConn(), newFakeNotifyConn()
+	first.drop(io.ErrUnexpectedEOF)
+	// Notifications may have been missed while reconnecting.
+	expectUnlinkKeys(redisMock, testKeys.products())
+
+	// The first dial fails, the second connection drops straight away, and
+	// the third stays up until the listener is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	var dials []time.Time
+	dial := func(context.Context) (notifyConn, error) {
+		dials = append(dials, time.Now())
+		switch len(dials) {
+		case 1:
+			return nil, errors.New("connection refused")
+		case 2:
+			return first, nil
+		case 3:
+			cancel()
+			return second, nil
+		}
+		t.Error("unexpected dial after cancellation")
+		return nil, errors.New("unexpected dial")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runProductsListener(ctx, dial, backoff{BaseWait: 10 * time.Millisecond, MaxWait: 10 * time.Millisecond})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cancel()
+		t.Fatal("listener did not stop after cancellation")
+	}
+
+	if len(dials) != 3 {
+		t.Fatalf("expected 3 dials, got %d", len(dials))
+	}
+	for i := 1; i < len(dials); i++ {
+		if gap := dials[i].Sub(dials[i-1]); gap > time.Second {
+			t.Errorf("dial %d waited %v, longer than the backoff allows", i+1, gap)
+		}
+	}
+	if !first.closed.Load() || !second.closed.Load() {
+		t.Error("expected every connection to be closed")
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestRunProductsListener_StopsWhileWaitingToReconnect(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dial := func(context.Context) (notifyConn, error) {
+		cancel()
+		return nil, errors.New("connection refused")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runProductsListener(ctx, dial, backoff{BaseWait: time.Hour, MaxWait: time.Hour})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener kept waiting to reconnect after cancellation")
+	}
+}
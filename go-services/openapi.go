@@ -0,0 +1,81 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPIYAML describes the routes registered by Handler. It is edited by
+// hand; TestOpenAPI_CoversRoutes fails when a route is missing from it.
+//
+//go:embed openapi.yaml
+var openAPIYAML []byte
+
+// docsHTML is a Swagger UI page for /openapi.json. The UI's script and
+// styles load from a CDN, so a SECURITY_CSP that blocks them needs a
+// SECURITY_HEADER_EXCEPTIONS entry for /docs.
+//
+//go:embed docs.html
+var docsHTML []byte
+
+type openAPIJSON struct {
+	body []byte
+	etag string
+}
+
+// loadOpenAPI converts the specification to JSON, moving its server URLs
+// under BasePath. The probes' stay at the root, where they are served.
+func (s *Server) loadOpenAPI() (openAPIJSON, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(openAPIYAML, &doc); err != nil {
+		return openAPIJSON{}, fmt.Errorf("parse openapi.yaml: %w", err)
+	}
+	if base := s.cfg.BasePath; base != "" {
+		prefixServers(doc, base)
+		paths, _ := doc["paths"].(map[string]any)
+		for _, rt := range s.siteRoutes() {
+			if item, ok := paths[routePath(rt.path)].(map[string]any); ok {
+				prefixServers(item, base)
+			}
+		}
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return openAPIJSON{}, fmt.Errorf("encode openapi.yaml: %w", err)
+	}
+	return openAPIJSON{body: body, etag: etagFor(body)}, nil
+}
+
+// prefixServers puts base in front of the URLs in obj's servers list.
+func prefixServers(obj map[string]any, base string) {
+	servers, _ := obj["servers"].([]any)
+	for _, srv := range servers {
+		if srv, ok := srv.(map[string]any); ok {
+			if u, ok := srv["url"].(string); ok {
+				srv["url"] = base + strings.TrimSuffix(u, "/")
+			}
+		}
+	}
+}
+
+// openAPIHandler serves the OpenAPI specification as JSON.
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := s.openAPI()
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to load the OpenAPI document", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	writeJSONBodyTagged(w, r, doc.body, doc.etag)
+}
+
+// docsHandler serves Swagger UI for the specification.
+func (s *Server) docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(docsHTML)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// openAPISpec loads s's document.
+func openAPISpec(t *testing.T, s *Server) (spec struct {
+	OpenAPI string                                `json:"openapi"`
+	Servers []struct{ URL string }                `json:"servers"`
+	Paths   map[string]map[string]json.RawMessage `json:"paths"`
+}) {
+	t.Helper()
+	doc, err := s.loadOpenAPI()
+	if err != nil {
+		t.Fatalf("failed to load the document: %v", err)
+	}
+	if err := json.Unmarshal(doc.body, &spec); err != nil {
+		t.Fatalf("failed to decode the document: %v", err)
+	}
+	return spec
+}
+
+func TestOpenAPI_CoversRoutes(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	spec := openAPISpec(t, s)
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("expected an OpenAPI 3 document, got %q", spec.OpenAPI)
+	}
+
+	routes := slices.Concat(s.healthRoutes(), s.siteRoutes(), s.v1Routes())
+	routed := make(map[string]bool)
+	for _, rt := range routes {
+		path := routePath(rt.path)
+		routed[path] = true
+		if _, ok := spec.Paths[path][strings.ToLower(rt.method)]; !ok {
+			t.Errorf("%s %s is not documented", rt.method, path)
+		}
+	}
+	for path := range spec.Paths {
+		if !routed[path] {
+			t.Errorf("%s is documented but not routed", path)
+		}
+	}
+}
+
+func TestOpenAPI_BasePath(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.BasePath = "/api"
+	spec := openAPISpec(t, s)
+
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "/api/v1" {
+		t.Errorf("expected the API under /api/v1, got %+v", spec.Servers)
+	}
+	servers := func(path string) string {
+		var servers []struct{ URL string }
+		if json.Unmarshal(spec.Paths[path]["servers"], &servers) != nil || len(servers) != 1 {
+			return ""
+		}
+		return servers[0].URL
+	}
+	if got := servers("/version"); got != "/api" {
+		t.Errorf("expected /version under /api, got %q", got)
+	}
+	if got := servers("/livez"); got != "/" {
+		t.Errorf("expected /livez at the root, got %q", got)
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	h := s.Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("expected the JSON document, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a current ETag, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `url: "openapi.json"`) {
+		t.Errorf("expected the Swagger UI page, got %d", w.Code)
+	}
+}
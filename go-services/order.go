@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go-service/store"
+)
+
+const (
+	// maxOrderItems bounds the number of lines in one order.
+	maxOrderItems = 100
+	// maxItemQuantity bounds the quantity of a single line.
+	maxItemQuantity = 10000
+)
+
+// orderInput is the request body for placing an order. With FromCart the
+// order is placed for the caller's cart instead of Items.
+type orderInput struct {
+	Items    []orderItemInput `json:"items"`
+	FromCart bool             `json:"from_cart"`
+}
+
+type orderItemInput struct {
+	ProductID int64 `json:"product_id"`
+	Quantity  int   `json:"quantity"`
+}
+
+// validate reports every rule the input breaks, as a validationError.
+// Item fields are named by index, such as "items.2.quantity".
+func (in orderInput) validate() error {
+	var v validator
+	if in.FromCart {
+		v.check(len(in.Items) == 0, "items", "must be omitted with from_cart")
+		return v.err()
+	}
+	v.check(len(in.Items) > 0, "items", "are required")
+	v.check(len(in.Items) <= maxOrderItems, "items", fmt.Sprintf("must number at most %d", maxOrderItems))
+	if v.failed("items") {
+		return v.err()
+	}
+	seen := make(map[int64]bool, len(in.Items))
+	for i, item := range in.Items {
+		field := "items." + strconv.Itoa(i) + "."
+		v.check(item.ProductID > 0, field+"product_id", "must be a positive integer")
+		v.check(!seen[item.ProductID], field+"product_id", fmt.Sprintf("lists product %d more than once", item.ProductID))
+		v.check(item.Quantity >= 1 && item.Quantity <= maxItemQuantity, field+"quantity", fmt.Sprintf("must be between 1 and %d", maxItemQuantity))
+		seen[item.ProductID] = true
+	}
+	return v.err()
+}
+
+// store returns the items for the order store.
+func (in orderInput) store() []store.OrderItem {
+	items := make([]store.OrderItem, len(in.Items))
+	for i, item := range in.Items {
+		items[i] = store.OrderItem{ProductID: item.ProductID, Quantity: item.Quantity}
+	}
+	return items
+}
+
+// createOrderHandler places an order. An order from the cart claims the
+// cart's lines up front, so two checkouts cannot both order them, and puts
+// them back if the order fails.
+func (s *Server) createOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var in orderInput
+	if !s.decodeJSON(w, r, int64(s.cfg.MaxBodyBytes), &in) {
+		return
+	}
+	if err := in.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	var cart string
+	if in.FromCart {
+		var ok bool
+		if cart, ok = s.cartKey(w, r); !ok {
+			return
+		}
+		items, err := s.claimCart(ctx, cart)
+		if err != nil {
+			s.logger.ErrorContext(ctx, "Cart read failed", "err", err)
+			s.writeInternalError(w, err)
+			return
+		}
+		if len(items) == 0 {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "cart is empty")
+			return
+		}
+		in = orderInput{Items: items}
+		if err := in.validate(); err != nil {
+			s.restoreCart(ctx, cart, items)
+			s.writeValidationError(w, err)
+			return
+		}
+	}
+
+	order, err := s.orders.Create(ctx, in.store())
+	if err != nil && cart != "" {
+		s.restoreCart(ctx, cart, in.Items)
+	}
+	var itemErr *store.OrderItemError
+	switch {
+	case errors.As(err, &itemErr) && errors.Is(err, store.ErrInsufficientStock):
+		s.writeError(w, http.StatusConflict, codeInsufficientStock,
+			fmt.Sprintf("not enough of product %d in stock", itemErr.ProductID))
+		return
+	case errors.As(err, &itemErr) && errors.Is(err, store.ErrNoPrice):
+		s.writeError(w, http.StatusConflict, codeConflict,
+			fmt.Sprintf("product %d has no price and cannot be ordered", itemErr.ProductID))
+		return
+	case errors.As(err, &itemErr) && errors.Is(err, store.ErrNotFound):
+		s.writeError(w, http.StatusBadRequest, codeValidation,
+			fmt.Sprintf("product %d does not exist", itemErr.ProductID))
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "Order transaction failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	s.takeOrderedStock(ctx, order.Items)
+	s.logger.InfoContext(ctx, "Order created", "order_id", order.ID, "items", len(order.Items), "from_cart", cart != "")
+	s.writeJSON(w, http.StatusCreated, order)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+
+	"go-service/store"
+)
+
+func postOrder(s *Server, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+// expectOrderItem expects the price lookup and stock update for one item;
+// the update matches a row only if inStock.
+func expectOrderItem(mockSQL sqlmock.Sqlmock, productID int64, quantity int, price float64, inStock bool) {
+	mockSQL.ExpectQuery(regexp.QuoteMeta("SELECT price FROM products WHERE id = $1")).
+		WithArgs(productID).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(price))
+	affected := int64(0)
+	if inStock {
+		affected = 1
+	}
+	mockSQL.ExpectExec(regexp.QuoteMeta("UPDATE products SET stock = stock - $1 WHERE id = $2 AND stock >= $1")).
+		WithArgs(quantity, productID).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+func TestCreateOrderHandler_Success(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	usePostgresStores(s)
+
+	mockSQL.ExpectBegin()
+	expectOrderItem(mockSQL, 1, 2, 10.99, true)
+	expectOrderItem(mockSQL, 2, 1, 5.49, true)
+	mockSQL.ExpectQuery("INSERT INTO orders").WithArgs(27.47).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+	mockSQL.ExpectExec("INSERT INTO order_items").WithArgs(int64(5), int64(1), 2, 10.99).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectExec("INSERT INTO order_items").WithArgs(int64(5), int64(2), 1, 5.49).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit()
+
+	w := postOrder(s, `{"items":[{"product_id":2,"quantity":1},{"product_id":1,"quantity":2}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var order store.Order
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if order.ID != 5 || order.Total != 27.47 || len(order.Items) != 2 {
+		t.Errorf("unexpected order %+v", order)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateOrderHandler_InsufficientStockRollsBack(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	usePostgresStores(s)
+
+	mockSQL.ExpectBegin()
+	expectOrderItem(mockSQL, 1, 2, 10.99, true)
+	expectOrderItem(mockSQL, 2, 50, 5.49, false)
+	mockSQL.ExpectRollback()
+
+	w := postOrder(s, `{"items":[{"product_id":1,"quantity":2},{"product_id":2,"quantity":50}]}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeInsufficientStock || !strings.Contains(got.Message, "product 2") {
+		t.Errorf("unexpected error %+v", got)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateOrderHandler_DBErrorRollsBack(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	usePostgresStores(s)
+
+	mockSQL.ExpectBegin()
+	expectOrderItem(mockSQL, 1, 2, 10.99, true)
+	mockSQL.ExpectQuery("INSERT INTO orders").WillReturnError(errors.New("connection reset by peer"))
+	mockSQL.ExpectRollback()
+
+	w := postOrder(s, `{"items":[{"product_id":1,"quantity":2}]}`)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeDBError {
+		t.Errorf("expected code %q, got %+v", codeDBError, got)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateOrderHandler_DBTimeoutRollsBack(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	s.cfg.DBQueryTimeout = 20 * time.Millisecond
+	usePostgresStores(s)
+
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectQuery(regexp.QuoteMeta("SELECT price FROM products WHERE id = $1")).
+		WithArgs(int64(1)).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(10.99))
+	mockSQL.ExpectRollback()
+
+	w := postOrder(s, `{"items":[{"product_id":1,"quantity":2}]}`)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeDBTimeout {
+		t.Errorf("expected code %q, got %+v", codeDBTimeout, got)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateOrderHandler_UnknownProduct(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	usePostgresStores(s)
+
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectQuery(regexp.QuoteMeta("SELECT price FROM products WHERE id = $1")).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}))
+	mockSQL.ExpectRollback()
+
+	w := postOrder(s, `{"items":[{"product_id":9,"quantity":1}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeValidation || !strings.Contains(got.Message, "product 9") {
+		t.Errorf("unexpected error %+v", got)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateOrderHandler_ProductWithoutPrice(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	usePostgresStores(s)
+
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectQuery(regexp.QuoteMeta("SELECT price FROM products WHERE id = $1")).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(nil))
+	mockSQL.ExpectRollback()
+
+	w := postOrder(s, `{"items":[{"product_id":9,"quantity":1}]}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeConflict || !strings.Contains(got.Message, "product 9") {
+		t.Errorf("unexpected error %+v", got)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateOrderHandler_Validation(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	usePostgresStores(s)
+
+	tooMany := make([]orderItemInput, maxOrderItems+1)
+	for i := range tooMany {
+		tooMany[i] = orderItemInput{ProductID: int64(i + 1), Quantity: 1}
+	}
+	tooManyBody, _ := json.Marshal(orderInput{Items: tooMany})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no items", `{"items":[]}`},
+		{"missing items", `{}`},
+		{"zero quantity", `{"items":[{"product_id":1,"quantity":0}]}`},
+		{"huge quantity", `{"items":[{"product_id":1,"quantity":10001}]}`},
+		{"bad product id", `{"items":[{"product_id":0,"quantity":1}]}`},
+		{"duplicate product", `{"items":[{"product_id":1,"quantity":1},{"product_id":1,"quantity":2}]}`},
+		{"too many items", string(tooManyBody)},
+	}
+	for _, tt := range tests {
+		w := postOrder(s, tt.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.name, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeValidation {
+			t.Errorf("%s: expected code %q, got %+v", tt.name, codeValidation, got)
+		}
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("validation failures must not reach the DB: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"go-service/store"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// pageParams is the window of rows requested on GET /products. Offset mode
+// uses ?limit= and ?offset=. Keyset mode is selected by the presence of
+// ?cursor=, empty for the first page, and continues after AfterID.
+type pageParams struct {
+	Limit  int
+	Offset int
+
+	Keyset  bool
+	AfterID int64
+}
+
+// parsePage reads the page window from the query string, applying the
+// default limit when it is absent. The returned error is suitable for the
+// client.
+func parsePage(q url.Values) (pageParams, error) {
+	p := pageParams{Limit: defaultPageLimit}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return pageParams{}, fmt.Errorf("limit must be an integer between 1 and %d", maxPageLimit)
+		}
+		p.Limit = n
+	}
+
+	if q.Has("cursor") {
+		if q.Has("offset") {
+			return pageParams{}, errors.New("cursor and offset cannot be combined")
+		}
+		after, err := decodeCursor(q.Get("cursor"))
+		if err != nil {
+			return pageParams{}, errors.New("cursor is invalid")
+		}
+		p.Keyset, p.AfterID = true, after
+		return p, nil
+	}
+
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return pageParams{}, errors.New("offset must be a non-negative integer")
+		}
+		p.Offset = n
+	}
+	return p, nil
+}
+
+// cacheField identifies the page within the products cache hash.
+func (p pageParams) cacheField() string {
+	if p.Keyset {
+		return "limit=" + strconv.Itoa(p.Limit) + ":after=" + strconv.FormatInt(p.AfterID, 10)
+	}
+	return "limit=" + strconv.Itoa(p.Limit) + ":offset=" + strconv.Itoa(p.Offset)
+}
+
+// encodeCursor returns the opaque cursor for continuing after id.
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+// decodeCursor returns the id a cursor continues after. The empty cursor
+// starts from the beginning.
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("malformed cursor")
+	}
+	return id, nil
+}
+
+// productPage is the response body of GET /products in offset mode.
+type productPage struct {
+	Items  []store.Product `json:"items"`
+	Total  int64           `json:"total"`
+	Limit  int             `json:"limit"`
+	Offset int             `json:"offset"`
+}
+
+// cursorPage is the response body of GET /products in keyset mode.
+// NextCursor is empty once the last page has been returned.
+type cursorPage struct {
+	Items      []store.Product `json:"items"`
+	Limit      int             `json:"limit"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+func (s *Server) offsetPage(ctx context.Context, f productFilter, p pageParams) (productPage, error) {
+	items, err := s.products.List(ctx, store.ProductList{Filter: store.ProductFilter(f), Limit: p.Limit, Offset: p.Offset})
+	if err != nil {
+		return productPage{}, err
+	}
+	total, err := s.products.Count(ctx, store.ProductFilter(f))
+	if err != nil {
+		return productPage{}, fmt.Errorf("count products: %w", err)
+	}
+	return productPage{Items: items, Total: total, Limit: p.Limit, Offset: p.Offset}, nil
+}
+
+// keysetPage fetches one row more than the limit so that the last page is
+// recognised without an extra, empty request.
+func (s *Server) keysetPage(ctx context.Context, f productFilter, p pageParams) (cursorPage, error) {
+	items, err := s.products.List(ctx, store.ProductList{
+		Filter:  store.ProductFilter(f),
+		Limit:   p.Limit + 1,
+		Keyset:  true,
+		AfterID: p.AfterID,
+	})
+	if err != nil {
+		return cursorPage{}, err
+	}
+	page := cursorPage{Items: items, Limit: p.Limit}
+	if len(items) > p.Limit {
+		page.Items = items[:p.Limit]
+		page.NextCursor = encodeCursor(page.Items[p.Limit-1].ID)
+	}
+	return page, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"go-service/store"
+)
+
+// addProducts stores products with ids 1 to n.
+func addProducts(s *Server, n int) {
+	for id := range int64(n) {
+		testProducts(s).add(testProduct(id+1, "Product", 1, time.Now()))
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		query   string
+		want    pageParams
+		wantErr bool
+	}{
+		{"", pageParams{Limit: 50, Offset: 0}, false},
+		{"limit=10&offset=30", pageParams{Limit: 10, Offset: 30}, false},
+		{"limit=500", pageParams{Limit: 500}, false},
+		{"limit=501", pageParams{}, true},
+		{"limit=0", pageParams{}, true},
+		{"limit=-5", pageParams{}, true},
+		{"limit=ten", pageParams{}, true},
+		{"offset=-1", pageParams{}, true},
+		{"offset=1e3", pageParams{}, true},
+		{"cursor=", pageParams{Limit: 50, Keyset: true}, false},
+		{"cursor=" + encodeCursor(42) + "&limit=5", pageParams{Limit: 5, Keyset: true, AfterID: 42}, false},
+		{"cursor=&offset=0", pageParams{}, true},
+		{"cursor=not-base64!", pageParams{}, true},
+		{"cursor=" + base64.RawURLEncoding.EncodeToString([]byte("abc")), pageParams{}, true},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := parsePage(q)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error %v", tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestProductsHandler_ReturnsRequestedPage(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	addProducts(s, 9)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?limit=2&offset=4", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var body productPage
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Total != 9 || body.Limit != 2 || body.Offset != 4 || len(body.Items) != 2 || body.Items[0].ID != 5 {
+		t.Errorf("unexpected page %+v", body)
+	}
+}
+
+func TestProductsHandler_EmptyPagePastTheEnd(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	addProducts(s, 3)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?offset=100", nil))
+
+	var body productPage
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Items == nil || len(body.Items) != 0 || body.Total != 3 {
+		t.Errorf("expected an empty page with the full total, got %+v", body)
+	}
+}
+
+func TestProductsHandler_RejectsOutOfRangeLimit(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for _, q := range []string{"limit=1000", "limit=0", "offset=-1", "limit=abc"} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?"+q, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", q, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeBadRequest {
+			t.Errorf("%s: expected code %q, got %+v", q, codeBadRequest, got)
+		}
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+}
+
+func TestProductsHandler_CursorWalksAllPages(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	addProducts(s, 5)
+
+	var seen []int64
+	cursor := ""
+	for page := 1; ; page++ {
+		if page > 3 {
+			t.Fatal("cursor did not terminate after three pages")
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?limit=2&cursor="+url.QueryEscape(cursor), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d: expected 200, got %d: %s", page, w.Code, w.Body)
+		}
+
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("page %d: failed to decode body: %v", page, err)
+		}
+		if _, ok := body["next_cursor"]; !ok {
+			t.Fatalf("page %d: expected next_cursor in %s", page, w.Body)
+		}
+		var got cursorPage
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range got.Items {
+			seen = append(seen, p.ID)
+		}
+		if got.NextCursor == "" {
+			break
+		}
+		cursor = got.NextCursor
+	}
+
+	if want := []int64{1, 2, 3, 4, 5}; !slices.Equal(seen, want) {
+		t.Errorf("expected ids %v, got %v", want, seen)
+	}
+	// Each page asks for one product more than it returns.
+	for i, l := range testProducts(s).lists {
+		if want := (store.ProductList{Filter: store.ProductFilter{Sort: "id"}, Limit: 3, Keyset: true, AfterID: int64(2 * i)}); l != want {
+			t.Errorf("page %d: expected %+v, got %+v", i+1, want, l)
+		}
+	}
+}
+
+func TestProductsHandler_RejectsCursorWithOffset(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products?cursor="+encodeCursor(10)+"&offset=20", nil))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeBadRequest {
+		t.Errorf("expected code %q, got %+v", codeBadRequest, got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+
+	"go-service/store"
+)
+
+type forgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (in resetPasswordRequest) validate() error {
+	var v validator
+	v.check(in.Token != "", "token", "is required")
+	checkPassword(&v, in.Password)
+	return v.err()
+}
+
+// hashResetToken returns the hash a password reset token is stored under.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// forgotPasswordHandler answers POST /password/forgot by sending a password
+// reset token to the user's email address. The answer is 202 whether or not
+// the user exists, has an address, or could be looked up, and whether or not
+// the token could be stored, so that it tells nothing about the account;
+// what happened is only logged.
+func (s *Server) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req forgotPasswordRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	var v validator
+	v.check(req.Username != "", "username", "is required")
+	if err := v.err(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	contact, err := s.users.Contact(ctx, req.Username)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.logger.InfoContext(ctx, "Password reset not sent", "reason", "unknown user")
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+	case contact.Email == "":
+		s.logger.InfoContext(ctx, "Password reset not sent", "reason", "no email", "user_id", contact.ID)
+	default:
+		s.sendPasswordReset(ctx, contact, req.Username)
+		s.audit(r, auditPasswordResetRequested, contact.ID, nil)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset stores a new reset token for contact and queues it for
+// runResetMailer.
+func (s *Server) sendPasswordReset(ctx context.Context, contact store.Contact, username string) {
+	token, err := newSessionToken()
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to generate password reset token", "err", err)
+		return
+	}
+	key := s.keys.passwordReset(hashResetToken(token))
+	setKey := s.keys.userPasswordResets(contact.ID)
+	ttl := s.cfg.PasswordResetTTL
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, contact.ID, ttl)
+		pipe.SAdd(ctx, setKey, key)
+		pipe.Expire(ctx, setKey, ttl)
+		return nil
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to store password reset token", "user_id", contact.ID, "err", err)
+		return
+	}
+
+	select {
+	case s.resetMails <- resetMail{To: contact.Email, Username: username, Token: token, ExpiresIn: ttl}:
+		s.logger.InfoContext(ctx, "Password reset queued", "user_id", contact.ID)
+	default:
+		s.logger.WarnContext(ctx, "Password reset dropped", "reason", "queue full", "user_id", contact.ID)
+	}
+}
+
+// resetPasswordHandler answers POST /password/reset, setting the password
+// of the user a reset token was sent to. Trying a token spends it, unless
+// the new password could not be stored. A reset revokes the user's other
+// reset tokens and all their sessions.
+func (s *Server) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req resetPasswordRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	key := s.keys.passwordReset(hashResetToken(req.Token))
+	userID, ttl, err := s.claimResetToken(ctx, key)
+	switch {
+	case errors.Is(err, redis.Nil):
+		s.logger.InfoContext(ctx, "Password reset rejected", "reason", "unknown token")
+		s.writeError(w, http.StatusBadRequest, codeInvalidToken, "reset token is invalid or expired")
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "Failed to read password reset token", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), s.cfg.BcryptCost)
+	if err != nil {
+		s.restoreResetToken(ctx, key, userID, ttl)
+		s.logger.ErrorContext(ctx, "Failed to hash password", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	err = s.users.SetPassword(ctx, userID, hash)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.logger.InfoContext(ctx, "Password reset rejected", "reason", "unknown user", "user_id", userID)
+		s.writeError(w, http.StatusBadRequest, codeInvalidToken, "reset token is invalid or expired")
+		return
+	case err != nil:
+		s.restoreResetToken(ctx, key, userID, ttl)
+		s.logger.ErrorContext(ctx, "DB update failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	// The password is changed by now, so what the old one gave access to
+	// and could not be revoked is logged loudly rather than answered.
+	if _, err := s.deleteKeySet(ctx, s.keys.userPasswordResets(userID)); err != nil {
+		s.logger.ErrorContext(ctx, "Failed to revoke password reset tokens", "user_id", userID, "err", err)
+	}
+	sessions, err := s.revokeSessions(ctx, userID)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to revoke sessions after password reset", "user_id", userID, "err", err)
+	}
+
+	s.logger.InfoContext(ctx, "Password reset", "user_id", userID, "sessions", sessions)
+	s.audit(r, auditPasswordReset, userID, map[string]any{"sessions": sessions})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// claimResetToken deletes the reset token at key and returns the user it
+// was issued to and how long it had left, or redis.Nil if there is no such
+// token. Reading and deleting in one transaction lets a token be used once
+// however many requests race for it.
+func (s *Server) claimResetToken(ctx context.Context, key string) (int64, time.Duration, error) {
+	var (
+		ttl *redis.DurationCmd
+		val *redis.StringCmd
+	)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		ttl = pipe.PTTL(ctx, key)
+		val = pipe.GetDel(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	userID, err := strconv.ParseInt(val.Val(), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse password reset token: %w", err)
+	}
+	return userID, ttl.Val(), nil
+}
+
+// restoreResetToken puts back a token claimed for a reset that failed on
+// the way, with the time it had left, so that the user may try again. It
+// runs even if the request was canceled, which may be why it failed.
+func (s *Server) restoreResetToken(ctx context.Context, key string, userID int64, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if err := s.rdb.SetNX(ctx, key, userID, ttl).Err(); err != nil {
+		s.logger.ErrorContext(ctx, "Failed to restore password reset token", "user_id", userID, "err", err)
+	}
+}
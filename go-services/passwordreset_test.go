@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testResetTTL = 30 * time.Minute
+
+// newResetServer returns a test server with user 7, alice, who has an email
+// address, and bob, 8, who has none.
+func newResetServer(t *testing.T) (*Server, redismock.ClientMock) {
+	t.Helper()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.BcryptCost = bcrypt.MinCost
+	s.cfg.PasswordResetTTL = testResetTTL
+	s.resetMails = make(chan resetMail, 1)
+	testUsers(s).add(7, "alice", mustHash(t, "old password"))
+	testUsers(s).setEmail(7, "alice@example.com")
+	testUsers(s).add(8, "bob", mustHash(t, "old password"))
+	return s, redisMock
+}
+
+func postPassword(s *Server, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+// expectStoreResetToken expects a reset token for user 7 to be stored.
+func expectStoreResetToken(redisMock redismock.ClientMock) {
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectSet(`password_reset:[0-9a-f]{64}$`, "^7$", testResetTTL).SetVal("OK")
+	redisMock.Regexp().ExpectSAdd(testKeys.userPasswordResets(7), `password_reset:[0-9a-f]{64}$`).SetVal(1)
+	redisMock.ExpectExpire(testKeys.userPasswordResets(7), testResetTTL).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+}
+
+// expectClaimResetToken expects the reset token at key to be claimed, left
+// with ttl, or missing when ttl is negative.
+func expectClaimResetToken(redisMock redismock.ClientMock, key string, ttl time.Duration) {
+	redisMock.ExpectTxPipeline()
+	if ttl < 0 {
+		// The mock answers the pipeline's first error without an EXEC.
+		redisMock.ExpectPTTL(key).SetVal(-2 * time.Nanosecond)
+		redisMock.ExpectGetDel(key).RedisNil()
+		return
+	}
+	redisMock.ExpectPTTL(key).SetVal(ttl)
+	redisMock.ExpectGetDel(key).SetVal("7")
+	redisMock.ExpectTxPipelineExec()
+}
+
+func TestPasswordReset_FullFlow(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResetServer(t)
+
+	expectStoreResetToken(redisMock)
+	if w := postPassword(s, "/password/forgot", `{"username":"alice"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	if len(s.resetMails) != 1 {
+		t.Fatal("expected a mail queued")
+	}
+	mail := <-s.resetMails
+	if mail.To != "alice@example.com" || mail.Username != "alice" || mail.ExpiresIn != testResetTTL || len(mail.Token) != 2*sessionTokenBytes {
+		t.Fatalf("unexpected mail %+v", mail)
+	}
+
+	// Redis holds the token's hash, never the token.
+	key := testKeys.passwordReset(hashResetToken(mail.Token))
+	if strings.Contains(key, mail.Token) {
+		t.Fatalf("reset key %q holds the token", key)
+	}
+	other := testKeys.passwordReset(hashResetToken("older token"))
+	sessions := testKeys.userSessions(7)
+	expectClaimResetToken(redisMock, key, 20*time.Minute)
+	redisMock.ExpectSMembers(testKeys.userPasswordResets(7)).SetVal([]string{other})
+	expectUnlinkKeys(redisMock, other, testKeys.userPasswordResets(7))
+	redisMock.ExpectSMembers(sessions).SetVal([]string{testKeys.session("old")})
+	expectUnlinkKeys(redisMock, testKeys.session("old"), sessions)
+
+	w := postPassword(s, "/password/reset", `{"token":"`+mail.Token+`","password":"new password"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if bcrypt.CompareHashAndPassword(testUsers(s).passwordHash(7), []byte("new password")) != nil {
+		t.Error("expected the new password stored")
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+
+	var actions []string
+	for len(s.auditQueue) > 0 {
+		ev := <-s.auditQueue
+		actions = append(actions, ev.Action)
+		if ev.UserID == nil || *ev.UserID != 7 {
+			t.Errorf("expected user 7 audited, got %+v", ev)
+		}
+	}
+	if strings.Join(actions, ",") != auditPasswordResetRequested+","+auditPasswordReset {
+		t.Errorf("unexpected audit actions %v", actions)
+	}
+}
+
+func TestForgotPassword_DoesNotEnumerate(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResetServer(t)
+
+	// An unknown user, a user without an address and a failure to store
+	// the token are all answered like a mailed token.
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectSet(`password_reset:`, "^7$", testResetTTL).SetErr(errors.New("connection refused"))
+	for _, username := range []string{"ghost", "bob", "alice"} {
+		w := postPassword(s, "/password/forgot", `{"username":"`+username+`"}`)
+		if w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+			t.Errorf("%s: expected an empty 202, got %d: %s", username, w.Code, w.Body)
+		}
+	}
+	if len(s.resetMails) != 0 {
+		t.Errorf("expected nothing mailed, got %d", len(s.resetMails))
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestForgotPassword_HidesDBFailure(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResetServer(t)
+	testUsers(s).fail(errors.New("connection reset by peer"))
+
+	w := postPassword(s, "/password/forgot", `{"username":"alice"}`)
+	if w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+		t.Errorf("expected an empty 202, got %d: %s", w.Code, w.Body)
+	}
+	if len(s.resetMails) != 0 {
+		t.Errorf("expected nothing mailed, got %d", len(s.resetMails))
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestResetPassword_RejectsSpentAndExpiredTokens(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResetServer(t)
+
+	// A used token and an expired one are both gone from Redis.
+	for _, name := range []string{"reused", "expired"} {
+		expectClaimResetToken(redisMock, testKeys.passwordReset(hashResetToken(name)), -1)
+		w := postPassword(s, "/password/reset", `{"token":"`+name+`","password":"new password"}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", name, w.Code, w.Body)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeInvalidToken {
+			t.Errorf("%s: expected code %q, got %+v", name, codeInvalidToken, got)
+		}
+	}
+
+	// A password breaking the rules is refused without spending the token.
+	w := postPassword(s, "/password/reset", `{"token":"fresh","password":"short"}`)
+	if w.Code != http.StatusBadRequest || decodeError(t, w).Code != codeValidation {
+		t.Errorf("short password: expected a validation error, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+	if bcrypt.CompareHashAndPassword(testUsers(s).passwordHash(7), []byte("old password")) != nil {
+		t.Error("expected the password unchanged")
+	}
+}
+
+func TestResetPassword_RestoresTokenOnDBFailure(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResetServer(t)
+	testUsers(s).fail(errors.New("connection reset by peer"))
+
+	key := testKeys.passwordReset(hashResetToken("fresh"))
+	expectClaimResetToken(redisMock, key, 12*time.Minute)
+	redisMock.ExpectSetNX(key, int64(7), 12*time.Minute).SetVal(true)
+
+	w := postPassword(s, "/password/reset", `{"token":"fresh","password":"new password"}`)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"go-service/store"
+)
+
+// maxProductNameLen is the longest product name accepted, in characters.
+const maxProductNameLen = 255
+
+// productInput is the request body for creating or replacing a product.
+type productInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Price       *float64 `json:"price"`
+	// CategoryID puts the product in that category; null or missing
+	// leaves it without one.
+	CategoryID *int64 `json:"category_id"`
+}
+
+// validate reports every rule the input breaks, as a validationError.
+func (in productInput) validate() error {
+	var v validator
+	v.check(strings.TrimSpace(in.Name) != "", "name", "is required")
+	v.check(utf8.RuneCountInString(in.Name) <= maxProductNameLen, "name", fmt.Sprintf("must be at most %d characters", maxProductNameLen))
+	v.check(in.Price != nil, "price", "is required")
+	v.check(in.Price == nil || (*in.Price >= 0 && !math.IsNaN(*in.Price)), "price", "must not be negative")
+	v.check(in.CategoryID == nil || *in.CategoryID > 0, "category_id", "must be a positive integer")
+	return v.err()
+}
+
+// store returns the input for the product store. It must only be called on
+// input that validates.
+func (in productInput) store() store.ProductInput {
+	return store.ProductInput{Name: in.Name, Description: in.Description, Price: *in.Price, CategoryID: in.CategoryID}
+}
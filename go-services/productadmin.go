@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go-service/store"
+)
+
+// adminProductsHandler lists products as GET /products does, with the same
+// filters and pagination, but never from the cache. With
+// ?include_deleted=true the deleted products that have not been purged are
+// listed too, with their deleted_at.
+func (s *Server) adminProductsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	page, err := parsePage(q)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	filter, err := parseFilter(q)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if v := q.Get("include_deleted"); v != "" {
+		if filter.IncludeDeleted, err = strconv.ParseBool(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "include_deleted must be true or false")
+			return
+		}
+	}
+	if page.Keyset && filter.Sort != store.DefaultProductSort {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "cursor pagination only supports sorting by id")
+		return
+	}
+
+	var resp any
+	if page.Keyset {
+		resp, err = s.keysetPage(ctx, filter, page)
+	} else {
+		resp, err = s.offsetPage(ctx, filter, page)
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// restoreProductHandler undoes the deletion of product {id}, which is
+// listed and served again. It answers 404 if the product is not deleted or
+// was purged.
+func (s *Server) restoreProductHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := s.productID(w, r)
+	if !ok {
+		return
+	}
+	p, err := s.products.Restore(ctx, id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB restore failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	// The product cache may remember it as missing.
+	s.cacheInvalidate(ctx, s.keys.products(), s.keys.product(id))
+	s.publishProductEvent(ctx, eventProductCreated, id, p)
+
+	// Logged at warn so the restore is recorded whatever the level.
+	s.logger.WarnContext(ctx, "Product restored",
+		"audit", true,
+		"actor", auditActor(ctx),
+		"remote_ip", s.clientIP(r),
+		"product_id", id,
+	)
+	s.audit(r, auditProductRestored, 0, map[string]any{"product_id": id})
+
+	s.writeJSON(w, http.StatusOK, p)
+}
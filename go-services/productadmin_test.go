@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-service/store"
+)
+
+// productAdminRequest serves an admin request to the product endpoints on
+// the internal listener.
+func productAdminRequest(s *Server, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func decodeProductPage(t *testing.T, w *httptest.ResponseRecorder) productPage {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var page productPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestDeleteProductHandler_HidesTheProductUntilRestored(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	testProducts(s).add(testProduct(5, "Lamp", 15, time.Now()), testProduct(6, "Rug", 40, time.Now()))
+
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(5))
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, asAdmin(httptest.NewRequest(http.MethodDelete, "/products/5", nil)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	page := decodeProductPage(t, productAdminRequest(s, http.MethodGet, "/admin/products"))
+	if page.Total != 1 || len(page.Items) != 1 || page.Items[0].ID != 6 {
+		t.Errorf("expected only product 6 listed, got %+v", page)
+	}
+	if got, err := s.products.GetMany(context.Background(), []int64{5, 6}); err != nil || len(got) != 1 || got[0].ID != 6 {
+		t.Errorf("expected only product 6 found, got %+v, %v", got, err)
+	}
+	if _, err := s.products.Get(context.Background(), 5); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected the deleted product not found, got %v", err)
+	}
+
+	page = decodeProductPage(t, productAdminRequest(s, http.MethodGet, "/admin/products?include_deleted=true"))
+	if page.Total != 2 || len(page.Items) != 2 || page.Items[0].DeletedAt == nil || page.Items[1].DeletedAt != nil {
+		t.Errorf("expected both products, only 5 deleted, got %+v", page)
+	}
+
+	expectUnlinkKeys(redisMock, testKeys.products(), testKeys.product(5))
+	w = productAdminRequest(s, http.MethodPost, "/admin/products/5/restore")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var restored store.Product
+	if err := json.Unmarshal(w.Body.Bytes(), &restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != 5 || restored.DeletedAt != nil {
+		t.Errorf("unexpected restored product %+v", restored)
+	}
+	if _, err := s.products.Get(context.Background(), 5); err != nil {
+		t.Errorf("expected the restored product found, got %v", err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the caches invalidated on delete and restore: %v", err)
+	}
+
+	if n := len(s.auditQueue); n != 1 {
+		t.Fatalf("expected the restore audited, got %d events", n)
+	}
+	ev := <-s.auditQueue
+	var metadata map[string]any
+	if err := json.Unmarshal(ev.Metadata, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Action != auditProductRestored || ev.Actor != adminTokenActor || metadata["product_id"] != float64(5) {
+		t.Errorf("unexpected audit event %+v with metadata %v", ev, metadata)
+	}
+}
+
+func TestRestoreProductHandler_UnknownProduct(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	w := productAdminRequest(s, http.MethodPost, "/admin/products/99/restore")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d: %s", w.Code, w.Body)
+	}
+	if n := len(s.auditQueue); n != 0 {
+		t.Errorf("expected nothing audited, got %d events", n)
+	}
+}
+
+func TestRestoreProductHandler_LiveProduct(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	p, _ := usePublisher(s, 0)
+	testProducts(s).add(testProduct(5, "Lamp", 15, time.Now()))
+
+	w := productAdminRequest(s, http.MethodPost, "/admin/products/5/restore")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d: %s", w.Code, w.Body)
+	}
+	if sent := p.sent(); len(sent) != 0 {
+		t.Errorf("expected no event published, got %d", len(sent))
+	}
+	if n := len(s.auditQueue); n != 0 {
+		t.Errorf("expected nothing audited, got %d events", n)
+	}
+}
+
+func TestAdminProductsHandler_RejectsBadIncludeDeleted(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	w := productAdminRequest(s, http.MethodGet, "/admin/products?include_deleted=maybe")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeBadRequest {
+		t.Errorf("expected code %q, got %+v", codeBadRequest, got)
+	}
+}
+
+func TestAdminProductsHandler_RequiresAdmin(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/products/5/restore", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+}
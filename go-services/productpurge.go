@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// productsPurgeLock is held by the replica purging deleted products.
+const productsPurgeLock = "products-purge"
+
+// runProductPurger removes products deleted more than ProductPurgeAfter ago,
+// immediately and then every interval until ctx is cancelled. Failures are
+// logged and retried on the next tick.
+func (s *Server) runProductPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.purgeDeletedProducts(ctx, time.Now(), refreshLockTTL(interval))
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			s.logger.WarnContext(ctx, "Deleted products purge failed", "err", err)
+		case n > 0:
+			s.logger.InfoContext(ctx, "Deleted products purged", "products", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeDeletedProducts removes the products deleted ProductPurgeAfter
+// before now and returns how many it removed. It does nothing when another
+// replica holds the lock.
+func (s *Server) purgeDeletedProducts(ctx context.Context, now time.Time, lockTTL time.Duration) (int64, error) {
+	lock, err := newRedisLocker(s.rdb, s.keys).Acquire(ctx, productsPurgeLock, lockTTL)
+	if errors.Is(err, errLockHeld) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			s.logger.WarnContext(ctx, "Failed to release the products purge lock", "err", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, lockTTL)
+	defer cancel()
+	ctx, span := s.tracer.Start(ctx, "products.purge")
+	defer span.End()
+
+	n, err := s.products.Purge(ctx, now.Add(-s.cfg.ProductPurgeAfter))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "purge failed")
+		return 0, err
+	}
+	return n, nil
+}
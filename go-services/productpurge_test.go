@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go-service/store"
+)
+
+// deletedProduct returns a product deleted at the given time.
+func deletedProduct(id int64, deleted time.Time) store.Product {
+	p := testProduct(id, "Lamp", 15, deleted.Add(-time.Hour))
+	p.DeletedAt = &deleted
+	return p
+}
+
+func TestPurgeDeletedProducts_RemovesThoseDeletedBeforeTheCutoff(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductPurgeAfter = 30 * 24 * time.Hour
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	cutoff := now.Add(-s.cfg.ProductPurgeAfter)
+	testProducts(s).add(
+		deletedProduct(1, cutoff.Add(-time.Second)),
+		deletedProduct(2, cutoff),
+		deletedProduct(3, now.Add(-time.Hour)),
+		testProduct(4, "Rug", 40, cutoff.Add(-24*time.Hour)),
+	)
+
+	lockKey := testKeys.lock(productsPurgeLock)
+	redisMock.Regexp().ExpectSetNX(lockKey, `^[0-9a-f]{32}$`, time.Minute).SetVal(true)
+	redisMock.Regexp().ExpectEvalSha(releaseScript.Hash(), []string{lockKey}, `^[0-9a-f]{32}$`).SetVal(int64(1))
+
+	n, err := s.purgeDeletedProducts(context.Background(), now, time.Minute)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one product purged, got %d, %v", n, err)
+	}
+	page := allProducts(t, s)
+	if len(page) != 3 || page[0].ID != 2 || page[1].ID != 3 || page[2].ID != 4 {
+		t.Errorf("expected products 2, 3 and 4 kept, got %+v", page)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPurgeDeletedProducts_SkipsWhileLocked(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductPurgeAfter = time.Hour
+	testProducts(s).add(deletedProduct(1, time.Now().Add(-2*time.Hour)))
+
+	redisMock.Regexp().ExpectSetNX(testKeys.lock(productsPurgeLock), `^[0-9a-f]{32}$`, time.Minute).SetVal(false)
+
+	if n, err := s.purgeDeletedProducts(context.Background(), time.Now(), time.Minute); err != nil || n != 0 {
+		t.Errorf("expected the round to be skipped, got %d, %v", n, err)
+	}
+	if calls := testProducts(s).callCount(); calls != 0 {
+		t.Errorf("expected the store untouched, got %d calls", calls)
+	}
+}
+
+func TestPurgeDeletedProducts_ReportsStoreFailure(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductPurgeAfter = time.Hour
+	testProducts(s).fail(errors.New("connection refused"))
+
+	lockKey := testKeys.lock(productsPurgeLock)
+	redisMock.Regexp().ExpectSetNX(lockKey, `^[0-9a-f]{32}$`, time.Minute).SetVal(true)
+	redisMock.Regexp().ExpectEvalSha(releaseScript.Hash(), []string{lockKey}, `^[0-9a-f]{32}$`).SetVal(int64(1))
+
+	if _, err := s.purgeDeletedProducts(context.Background(), time.Now(), time.Minute); err == nil {
+		t.Error("expected the store failure returned")
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the lock released: %v", err)
+	}
+}
+
+// allProducts returns every product left in the store, deleted or not, in
+// id order.
+func allProducts(t *testing.T, s *Server) []store.Product {
+	t.Helper()
+	items, err := s.products.List(context.Background(), store.ProductList{Filter: store.ProductFilter{IncludeDeleted: true}, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
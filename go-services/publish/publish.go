@@ -0,0 +1,85 @@
+// Package publish sends events to a message broker for other services to
+// consume: a Redis stream or a Kafka topic. Both implement Publisher, so
+// the broker is a deployment choice.
+package publish
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Message is an event to publish. Messages with the same Key are delivered
+// in the order published: on Kafka they share a partition.
+type Message struct {
+	Key   string
+	Value []byte
+}
+
+// Publisher sends messages to a stream or topic.
+type Publisher interface {
+	// Publish returns once the broker has stored msg, or with the error
+	// that kept it from doing so.
+	Publish(ctx context.Context, msg Message) error
+	// Close flushes and releases the publisher's connections.
+	Close() error
+}
+
+// RedisStream publishes to a Redis stream with XADD. Each entry has two
+// fields: key and event, the message's value.
+type RedisStream struct {
+	rdb    redis.StreamCmdable
+	stream string
+	maxLen int64
+}
+
+// NewRedisStream returns a Publisher adding to stream on rdb. The stream
+// is trimmed to about maxLen entries; zero leaves it untrimmed.
+func NewRedisStream(rdb redis.StreamCmdable, stream string, maxLen int64) *RedisStream {
+	return &RedisStream{rdb: rdb, stream: stream, maxLen: maxLen}
+}
+
+func (p *RedisStream) Publish(ctx context.Context, msg Message) error {
+	return p.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: p.stream,
+		MaxLen: p.maxLen,
+		// Trimming to exactly maxLen costs more for no benefit to readers.
+		Approx: p.maxLen > 0,
+		Values: []any{"key", msg.Key, "event", string(msg.Value)},
+	}).Err()
+}
+
+// Close does nothing: the Redis client is the caller's.
+func (p *RedisStream) Close() error {
+	return nil
+}
+
+// Kafka publishes to a Kafka topic, partitioning messages by key and
+// waiting for every in-sync replica to acknowledge them.
+type Kafka struct {
+	w *kafka.Writer
+}
+
+// NewKafka returns a Publisher writing to topic on the cluster reached
+// through brokers. It connects on the first Publish.
+func NewKafka(brokers []string, topic string) *Kafka {
+	return &Kafka{w: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// Publish waits for its message, so a batch is only worth waiting
+		// for briefly; concurrent publishes still share one.
+		BatchTimeout: 10 * time.Millisecond,
+	}}
+}
+
+func (p *Kafka) Publish(ctx context.Context, msg Message) error {
+	return p.w.WriteMessages(ctx, kafka.Message{Key: []byte(msg.Key), Value: msg.Value})
+}
+
+func (p *Kafka) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,82 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	_ Publisher = (*RedisStream)(nil)
+	_ Publisher = (*Kafka)(nil)
+)
+
+func TestRedisStream_Publish(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	t.Cleanup(func() { rdb.Close() })
+	p := NewRedisStream(rdb, "products-events", 1000)
+
+	mock.ExpectXAdd(&redis.XAddArgs{
+		Stream: "products-events",
+		MaxLen: 1000,
+		Approx: true,
+		Values: []any{"key", "42", "event", `{"type":"product.created"}`},
+	}).SetVal("1700000000000-0")
+	if err := p.Publish(context.Background(), Message{Key: "42", Value: []byte(`{"type":"product.created"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedisStream_PublishUntrimmed(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	t.Cleanup(func() { rdb.Close() })
+	p := NewRedisStream(rdb, "products-events", 0)
+
+	mock.ExpectXAdd(&redis.XAddArgs{
+		Stream: "products-events",
+		Values: []any{"key", "42", "event", `{}`},
+	}).SetVal("1700000000000-0")
+	if err := p.Publish(context.Background(), Message{Key: "42", Value: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisStream_PublishError(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	t.Cleanup(func() { rdb.Close() })
+	p := NewRedisStream(rdb, "products-events", 1000)
+
+	mock.ExpectXAdd(&redis.XAddArgs{
+		Stream: "products-events",
+		MaxLen: 1000,
+		Approx: true,
+		Values: []any{"key", "42", "event", `{}`},
+	}).SetErr(errors.New("connection refused"))
+	if err := p.Publish(context.Background(), Message{Key: "42", Value: []byte(`{}`)}); err == nil {
+		t.Error("expected the Redis error")
+	}
+}
+
+func TestKafka_PublishFailsWithoutBroker(t *testing.T) {
+	t.Parallel()
+	// Nothing listens on port 1, so the write can only fail, within the
+	// caller's deadline.
+	p := NewKafka([]string{"127.0.0.1:1"}, "products-events")
+	t.Cleanup(func() { p.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, Message{Key: "42", Value: []byte(`{}`)}); err == nil {
+		t.Error("expected an error without a broker")
+	}
+}
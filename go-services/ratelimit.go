@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tenantHeader names the tenant a request is made for. It is taken as sent,
+// so the gateway in front of the service is expected to set it.
+const tenantHeader = "X-Tenant-ID"
+
+// rateLimit allows Limit requests per Window from each client.
+type rateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+func (l *rateLimit) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Limit  int    `json:"limit"`
+		Window string `json:"window"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	window, err := time.ParseDuration(raw.Window)
+	if err != nil {
+		return fmt.Errorf("window %q is not a duration", raw.Window)
+	}
+	if raw.Limit < 1 {
+		return errors.New("limit must be positive")
+	}
+	if window < time.Second {
+		return fmt.Errorf("window %q must be at least 1s", raw.Window)
+	}
+	l.Limit, l.Window = raw.Limit, window
+	return nil
+}
+
+// rateLimits is RATE_LIMITS, such as
+//
+//	{
+//	  "default": {"limit": 100, "window": "1m"},
+//	  "routes": {"/login": {"limit": 10, "window": "1m"}},
+//	  "tenants": {"enterprise": {"/products": {"limit": 5000, "window": "1m"}}}
+//	}
+//
+// Routes are mux patterns without the method, BasePath or version, as in
+// /products/{id}. A request takes the first limit that applies: its tenant's
+// for its route, then the route's, then the default. Tenants without an
+// entry, and requests without a tenant, skip the first. A request no limit
+// applies to is not limited.
+type rateLimits struct {
+	Default *rateLimit                      `json:"default"`
+	Routes  map[string]rateLimit            `json:"routes"`
+	Tenants map[string]map[string]rateLimit `json:"tenants"`
+}
+
+// parseRateLimits parses and checks a RATE_LIMITS document.
+func parseRateLimits(data []byte) (rateLimits, error) {
+	var l rateLimits
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&l); err != nil {
+		return rateLimits{}, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return rateLimits{}, errors.New("unexpected data after the JSON object")
+	}
+
+	checkRoutes := func(routes map[string]rateLimit) error {
+		for route := range routes {
+			if !strings.HasPrefix(route, "/") {
+				return fmt.Errorf("route %q must start with /", route)
+			}
+		}
+		return nil
+	}
+	if err := checkRoutes(l.Routes); err != nil {
+		return rateLimits{}, err
+	}
+	for tenant, routes := range l.Tenants {
+		if tenant == "" {
+			return rateLimits{}, errors.New("tenant names must not be empty")
+		}
+		if err := checkRoutes(routes); err != nil {
+			return rateLimits{}, fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+	}
+	return l, nil
+}
+
+// enabled reports whether any limit is configured.
+func (l rateLimits) enabled() bool {
+	return l.Default != nil || len(l.Routes) > 0 || len(l.Tenants) > 0
+}
+
+// lookup returns the limit for a request for tenant to route, and the name
+// of the rule it came from, which keeps the counters of the rules apart.
+func (l rateLimits) lookup(tenant, route string) (rateLimit, string, bool) {
+	if limit, ok := l.Tenants[tenant][route]; ok {
+		return limit, "tenant:" + tenant + ":" + route, true
+	}
+	if limit, ok := l.Routes[route]; ok {
+		return limit, "route:" + route, true
+	}
+	if l.Default != nil {
+		return *l.Default, "default", true
+	}
+	return rateLimit{}, "", false
+}
+
+// withRateLimit applies the RATE_LIMITS of a request's route and tenant to
+// its client, counting requests in fixed windows in Redis so the limit holds
+// across replicas. Every limited response carries X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset, the seconds until the window
+// ends; over the limit the request is answered 429. A Redis failure lets the
+// request through: an outage should not turn every client away. Health
+// checks are never limited. The limits are those in effect, so a reload
+// changes them.
+func (s *Server) withRateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits := s.settings().RateLimits
+		if !limits.enabled() || probeRoutes[s.routeLabel(r)] {
+			handler(w, r)
+			return
+		}
+		limit, rule, ok := limits.lookup(r.Header.Get(tenantHeader), s.apiPaths[r.Pattern])
+		if !ok {
+			handler(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		now := time.Now()
+		window := now.UnixNano() / int64(limit.Window)
+		reset := time.Unix(0, (window+1)*int64(limit.Window)).Sub(now)
+		key := s.keys.rateLimit(s.clientIP(r), rule, window)
+
+		var count *redis.IntCmd
+		_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			count = pipe.Incr(ctx, key)
+			pipe.ExpireNX(ctx, key, limit.Window)
+			return nil
+		})
+		if err != nil {
+			s.logger.WarnContext(ctx, "Rate limiter write failed", "err", err)
+			handler(w, r)
+			return
+		}
+
+		remaining := max(int64(limit.Limit)-count.Val(), 0)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		w.Header().Set("X-RateLimit-Reset", retryAfterSeconds(reset))
+		if count.Val() > int64(limit.Limit) {
+			route := s.routeLabel(r)
+			s.metrics.requestsRateLimited.WithLabelValues(route).Inc()
+			s.logger.InfoContext(ctx, "Request rate limited", "path", route, "rule", rule, "limit", limit.Limit, "window", limit.Window)
+			w.Header().Set("Retry-After", retryAfterSeconds(reset))
+			s.writeError(w, http.StatusTooManyRequests, codeTooManyRequests, "rate limit exceeded")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testRateLimits = `{
+	"default": {"limit": 100, "window": "1m"},
+	"routes": {
+		"/login": {"limit": 10, "window": "1m"},
+		"/products": {"limit": 1000, "window": "1m"}
+	},
+	"tenants": {
+		"enterprise": {"/products": {"limit": 5000, "window": "1m"}}
+	}
+}`
+
+func mustParseRateLimits(t *testing.T, doc string) rateLimits {
+	t.Helper()
+	l, err := parseRateLimits([]byte(doc))
+	if err != nil {
+		t.Fatalf("parseRateLimits: %v", err)
+	}
+	return l
+}
+
+func TestRateLimits_Precedence(t *testing.T) {
+	t.Parallel()
+	l := mustParseRateLimits(t, testRateLimits)
+
+	tests := []struct {
+		tenant, route string
+		limit         int
+		rule          string
+	}{
+		{"enterprise", "/products", 5000, "tenant:enterprise:/products"},
+		{"", "/products", 1000, "route:/products"},
+		{"enterprise", "/login", 10, "route:/login"},
+		{"unknown", "/products", 1000, "route:/products"},
+		{"unknown", "/version", 100, "default"},
+		{"enterprise", "", 100, "default"},
+	}
+	for _, tt := range tests {
+		limit, rule, ok := l.lookup(tt.tenant, tt.route)
+		if !ok || limit.Limit != tt.limit || limit.Window != time.Minute || rule != tt.rule {
+			t.Errorf("%q %q: got %+v %q %v, want %d under %q", tt.tenant, tt.route, limit, rule, ok, tt.limit, tt.rule)
+		}
+	}
+
+	l.Default = nil
+	if _, _, ok := l.lookup("", "/version"); ok {
+		t.Error("expected no limit for a route without one and no default")
+	}
+}
+
+func TestParseRateLimits_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`{"default": {"limit": 10}`, "unexpected EOF"},
+		{`{"default": {"limit": 10, "window": "1m"}} {}`, "unexpected data"},
+		{`{"defaults": {"limit": 10, "window": "1m"}}`, `unknown field "defaults"`},
+		{`{"default": {"limit": 10, "window": "1m", "burst": 5}}`, `unknown field "burst"`},
+		{`{"default": {"limit": 0, "window": "1m"}}`, "limit must be positive"},
+		{`{"default": {"limit": 10, "window": "soon"}}`, `window "soon" is not a duration`},
+		{`{"default": {"limit": 10, "window": "100ms"}}`, "must be at least 1s"},
+		{`{"routes": {"login": {"limit": 10, "window": "1m"}}}`, `route "login" must start with /`},
+		{`{"tenants": {"": {"/login": {"limit": 10, "window": "1m"}}}}`, "tenant names must not be empty"},
+		{`{"tenants": {"acme": {"login": {"limit": 10, "window": "1m"}}}}`, `tenant "acme": route "login"`},
+	}
+	for _, tt := range tests {
+		_, err := parseRateLimits([]byte(tt.doc))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.doc, tt.want, err)
+		}
+	}
+}
+
+func TestLoadConfig_RateLimits(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "ratelimits.json")
+	if err := os.WriteFile(path, []byte(testRateLimits), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, set := range map[string]map[string]string{
+		"env":  {"RATE_LIMITS": testRateLimits},
+		"file": {"RATE_LIMITS_FILE": path},
+	} {
+		env := requiredEnv()
+		for k, v := range set {
+			env[k] = v
+		}
+		cfg, err := loadConfig(lookupFrom(env))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if limit, _, _ := cfg.RateLimits.lookup("enterprise", "/products"); limit.Limit != 5000 {
+			t.Errorf("%s: expected the tenant's limit, got %+v", name, limit)
+		}
+	}
+
+	cfg, err := loadConfig(lookupFrom(requiredEnv()))
+	if err != nil || cfg.RateLimits.enabled() {
+		t.Errorf("expected rate limiting off by default, got %+v, %v", cfg.RateLimits, err)
+	}
+}
+
+func TestLoadConfig_InvalidRateLimits(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		set  map[string]string
+		want string
+	}{
+		{map[string]string{"RATE_LIMITS": `{"routes": []}`}, "invalid env RATE_LIMITS: json: cannot unmarshal array"},
+		{map[string]string{"RATE_LIMITS_FILE": "/nonexistent/ratelimits.json"}, "invalid env RATE_LIMITS_FILE: open /nonexistent/ratelimits.json"},
+		{map[string]string{"RATE_LIMITS": testRateLimits, "RATE_LIMITS_FILE": "/etc/ratelimits.json"}, "invalid env RATE_LIMITS_FILE: cannot be combined with RATE_LIMITS"},
+	}
+	for _, tt := range tests {
+		env := requiredEnv()
+		for k, v := range tt.set {
+			env[k] = v
+		}
+		if _, err := loadConfig(lookupFrom(env)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: expected %q, got %v", tt.set, tt.want, err)
+		}
+	}
+}
+
+// expectRateCount expects the counter of client under rule to be
+// incremented to n, in whatever window is current.
+func expectRateCount(redisMock redismock.ClientMock, client, rule string, n int64) {
+	key := regexp.QuoteMeta(strings.TrimSuffix(testKeys.rateLimit(client, rule, 0), "0")) + `\d+`
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectIncr(key).SetVal(n)
+	redisMock.Regexp().ExpectExpireNX(key, time.Minute).SetVal(n == 1)
+	redisMock.ExpectTxPipelineExec()
+}
+
+func getWithTenant(s *Server, path, tenant string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if tenant != "" {
+		req.Header.Set(tenantHeader, tenant)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimit_EmitsHeadersAndRejectsOverLimit(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.RateLimits = mustParseRateLimits(t, `{"routes": {"/version": {"limit": 2, "window": "1m"}}}`)
+
+	for n := int64(1); n <= 3; n++ {
+		expectRateCount(redisMock, "192.0.2.1", "route:/version", n)
+		w := getWithTenant(s, "/version", "")
+
+		wantCode, wantRemaining := http.StatusOK, strconv.FormatInt(max(2-n, 0), 10)
+		if n == 3 {
+			wantCode = http.StatusTooManyRequests
+		}
+		if w.Code != wantCode {
+			t.Fatalf("request %d: expected %d, got %d", n, wantCode, w.Code)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q", n, got)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != wantRemaining {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", n, got, wantRemaining)
+		}
+		if reset, err := strconv.Atoi(w.Header().Get("X-RateLimit-Reset")); err != nil || reset < 1 || reset > 60 {
+			t.Errorf("request %d: expected X-RateLimit-Reset within the window, got %q", n, w.Header().Get("X-RateLimit-Reset"))
+		}
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimit_OverLimitIs429WithRetryAfter(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.RateLimits = mustParseRateLimits(t, `{"default": {"limit": 10, "window": "1m"}}`)
+
+	expectRateCount(redisMock, "192.0.2.1", "default", 11)
+	w := getWithTenant(s, "/version", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeTooManyRequests {
+		t.Errorf("expected code %q, got %+v", codeTooManyRequests, got)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("expected Retry-After and no requests remaining, got %v", w.Header())
+	}
+	if got := testutil.ToFloat64(s.metrics.requestsRateLimited.WithLabelValues("/version")); got != 1 {
+		t.Errorf("expected the rejection to be counted, got %v", got)
+	}
+}
+
+func TestRateLimit_TenantRouteTakesPrecedence(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.RateLimits = mustParseRateLimits(t, `{
+		"default": {"limit": 100, "window": "1m"},
+		"routes": {"/version": {"limit": 10, "window": "1m"}},
+		"tenants": {"enterprise": {"/version": {"limit": 50, "window": "1m"}}}
+	}`)
+
+	for _, tt := range []struct {
+		path, tenant, rule, limit string
+	}{
+		{"/version", "enterprise", "tenant:enterprise:/version", "50"},
+		{"/version", "unknown", "route:/version", "10"},
+		{"/version", "", "route:/version", "10"},
+		{"/docs", "enterprise", "default", "100"},
+	} {
+		expectRateCount(redisMock, "192.0.2.1", tt.rule, 1)
+		w := getWithTenant(s, tt.path, tt.tenant)
+		if got := w.Header().Get("X-RateLimit-Limit"); got != tt.limit {
+			t.Errorf("%s for %q: X-RateLimit-Limit = %q, want %s", tt.path, tt.tenant, got, tt.limit)
+		}
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimit_VersionedAndLegacyRoutesShareALimit(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.BasePath = "/api"
+	s.Handler()
+
+	for _, pattern := range []string{"POST /api/v1/login", "POST /api/login"} {
+		if got := s.apiPaths[pattern]; got != "/login" {
+			t.Errorf("%s: route path %q, want /login", pattern, got)
+		}
+	}
+	if got := s.apiPaths["GET /api/v1/products/{id}"]; got != "/products/{id}" {
+		t.Errorf("expected wildcards to be kept, got %q", got)
+	}
+}
+
+func TestRateLimit_RedisFailureLetsRequestsThrough(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.RateLimits = mustParseRateLimits(t, `{"default": {"limit": 1, "window": "1m"}}`)
+
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectIncr(`ratelimit`).SetErr(errors.New("connection refused"))
+	w := getWithTenant(s, "/version", "")
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("expected the request through without limit headers, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimit_SkipsProbes(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.RateLimits = mustParseRateLimits(t, `{"default": {"limit": 1, "window": "1m"}}`)
+
+	// No Redis call is expected: the mock would fail it.
+	if w := getWithTenant(s, "/livez", ""); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("expected the probe unlimited, got %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecovery turns a panicking handler into a logged 500 JSON response
+// instead of a dropped connection. http.ErrAbortHandler is re-raised so that
+// net/http can abort the response as the handler intended.
+//
+// With error reporting on, panics and the server errors written by the
+// response helpers are also reported.
+func (s *Server) withRecovery(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ew *serverErrorWriter
+		if s.reports != nil {
+			ew = &serverErrorWriter{ResponseWriter: w}
+			w = ew
+		}
+		defer func() {
+			p := recover()
+			if p == nil {
+				if ew != nil && ew.err != nil {
+					s.reportError(r, errorEvent{Message: ew.err.Error(), Status: ew.status, Code: ew.code})
+				}
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			stack := string(debug.Stack())
+			s.metrics.httpPanics.WithLabelValues(r.URL.Path).Inc()
+			s.logger.ErrorContext(r.Context(), "Handler panicked",
+				"path", r.URL.Path,
+				"method", r.Method,
+				"panic", p,
+				"stack", stack,
+			)
+			s.reportError(r, errorEvent{
+				Message: fmt.Sprint("panic: ", p),
+				Status:  http.StatusInternalServerError,
+				Code:    codeInternal,
+				Panic:   true,
+				Stack:   stack,
+			})
+			s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		}()
+		handler(w, r)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go-service/store"
+)
+
+func TestWithRecovery_Returns500AndCountsPanic(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var p *store.Product
+		_ = p.Name
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/boom", nil)
+	w := httptest.NewRecorder()
+	s.withRecovery(handler)(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeInternal {
+		t.Errorf("expected code %q, got %+v", codeInternal, got)
+	}
+	if got := testutil.ToFloat64(s.metrics.httpPanics.WithLabelValues("/boom")); got != 1 {
+		t.Errorf("expected http_panics_total 1, got %v", got)
+	}
+}
+
+func TestWithRecovery_CatchesPanicBehindTimeout(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.RequestTimeout = time.Second
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/boom", nil)
+	w := httptest.NewRecorder()
+	s.withRecovery(s.withTimeout(handler))(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+}
+
+func TestWithRecovery_ReraisesErrAbortHandler(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected ErrAbortHandler to propagate, got %v", p)
+		}
+		if got := testutil.ToFloat64(s.metrics.httpPanics.WithLabelValues("/abort")); got != 0 {
+			t.Errorf("expected no panic counted, got %v", got)
+		}
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/abort", nil)
+	s.withRecovery(handler)(httptest.NewRecorder(), req)
+	t.Fatal("expected the panic to propagate")
+}
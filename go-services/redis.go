@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// REDIS_MODE values.
+const (
+	redisSingle   = "single"
+	redisSentinel = "sentinel"
+	redisCluster  = "cluster"
+)
+
+// redisClient is the part of go-redis the service uses. The single-node
+// client, the Sentinel failover client and the Cluster client all satisfy
+// it, so handlers do not care which one REDIS_MODE picked.
+type redisClient interface {
+	redis.Cmdable
+	AddHook(redis.Hook)
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	Close() error
+}
+
+var (
+	_ redisClient = (*redis.Client)(nil)
+	_ redisClient = (*redis.ClusterClient)(nil)
+)
+
+// getKeys reads keys like MGET, with nil for each key that does not exist,
+// but with one GET each so that keys in different cluster slots can be
+// read in one round trip.
+func getKeys(ctx context.Context, rdb redis.Cmdable, keys ...string) ([]any, error) {
+	cmds, _ := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	vals := make([]any, len(cmds))
+	for i, cmd := range cmds {
+		val, err := cmd.(*redis.StringCmd).Result()
+		switch {
+		case errors.Is(err, redis.Nil):
+		case err != nil:
+			return nil, err
+		default:
+			vals[i] = val
+		}
+	}
+	return vals, nil
+}
+
+// unlinkKeys removes keys, one UNLINK each so that keys in different
+// cluster slots can go in one round trip, and returns how many existed.
+// UNLINK frees the memory in the background, so large values do not block
+// Redis.
+func unlinkKeys(ctx context.Context, rdb redis.Cmdable, keys ...string) (int64, error) {
+	cmds, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Unlink(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, cmd := range cmds {
+		n += cmd.(*redis.IntCmd).Val()
+	}
+	return n, nil
+}
+
+// newRedisClient returns the client REDIS_MODE calls for. A Sentinel
+// client is a *redis.Client that asks the sentinels for the current
+// master.
+func newRedisClient(cfg Config) (redis.UniversalClient, error) {
+	switch cfg.RedisMode {
+	case redisSentinel:
+		opts, err := redisFailoverOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(opts), nil
+	case redisCluster:
+		opts, err := redisClusterOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(opts), nil
+	default:
+		opts, err := redisOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClient(opts), nil
+	}
+}
+
+// redisOptions returns the single-node client options for cfg: those in
+// RedisURL when set, otherwise the individual settings, plus the pool sizes
+// and the TLS CA. It fails if the CA file cannot be used, before any
+// connection is attempted.
+func redisOptions(cfg Config) (*redis.Options, error) {
+	var opts *redis.Options
+	if cfg.RedisURL != "" {
+		var err error
+		if opts, err = redis.ParseURL(cfg.RedisURL); err != nil {
+			// loadConfig rejects these; the URL is not echoed as it may
+			// hold the password.
+			return nil, errors.New("parse REDIS_URL: invalid URL")
+		}
+	} else {
+		opts = &redis.Options{
+			Addr:     net.JoinHostPort(cfg.RedisHost, cfg.RedisPort),
+			Username: cfg.RedisUsername,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+		}
+		if cfg.RedisTLSEnabled {
+			opts.TLSConfig = &tls.Config{ServerName: cfg.RedisHost}
+		}
+	}
+
+	var err error
+	if opts.TLSConfig, err = redisTLSConfig(cfg, opts.TLSConfig); err != nil {
+		return nil, err
+	}
+	if cfg.RedisPoolSize > 0 {
+		opts.PoolSize = cfg.RedisPoolSize
+	}
+	if cfg.RedisMinIdleConns > 0 {
+		opts.MinIdleConns = cfg.RedisMinIdleConns
+	}
+	return opts, nil
+}
+
+// redisFailoverOptions returns the Sentinel client options for cfg. The
+// credentials and database are the master's.
+func redisFailoverOptions(cfg Config) (*redis.FailoverOptions, error) {
+	opts := &redis.FailoverOptions{
+		MasterName:    cfg.RedisMasterName,
+		SentinelAddrs: cfg.RedisSentinelAddrs,
+		Username:      cfg.RedisUsername,
+		Password:      cfg.RedisPassword,
+		DB:            cfg.RedisDB,
+		PoolSize:      cfg.RedisPoolSize,
+		MinIdleConns:  cfg.RedisMinIdleConns,
+	}
+	var err error
+	opts.TLSConfig, err = redisTLSConfig(cfg, nil)
+	return opts, err
+}
+
+// redisClusterOptions returns the Cluster client options for cfg. The pool
+// sizes apply to each node.
+func redisClusterOptions(cfg Config) (*redis.ClusterOptions, error) {
+	opts := &redis.ClusterOptions{
+		Addrs:        cfg.RedisClusterAddrs,
+		Username:     cfg.RedisUsername,
+		Password:     cfg.RedisPassword,
+		PoolSize:     cfg.RedisPoolSize,
+		MinIdleConns: cfg.RedisMinIdleConns,
+	}
+	var err error
+	opts.TLSConfig, err = redisTLSConfig(cfg, nil)
+	return opts, err
+}
+
+// redisTLSConfig completes base, or a new config if TLS is enabled and base
+// is nil, with the minimum version and the CA in RedisTLSCAFile. Without a
+// ServerName, the name is taken from each address dialled, which suits
+// Sentinel and Cluster nodes found at runtime.
+func redisTLSConfig(cfg Config, base *tls.Config) (*tls.Config, error) {
+	if base == nil {
+		if !cfg.RedisTLSEnabled {
+			return nil, nil
+		}
+		base = &tls.Config{}
+	}
+	base.MinVersion = tls.VersionTLS12
+	if cfg.RedisTLSCAFile != "" {
+		pool, err := loadCertPool(cfg.RedisTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_TLS_CA_FILE: %w", err)
+		}
+		base.RootCAs = pool
+	}
+	return base, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// errLockHeld is returned by Acquire when another owner holds the lock.
+	errLockHeld = errors.New("lock is held by another owner")
+	// errLockNotHeld is returned by Release and Extend when the lock has
+	// expired or been taken over, so the caller no longer owns it.
+	errLockNotHeld = errors.New("lock is not held")
+)
+
+var (
+	// releaseScript deletes the lock only if it still holds our token, so an
+	// owner whose lock expired cannot release its successor's.
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+	// extendScript resets the lock's TTL only if it still holds our token.
+	extendScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// redisLocker hands out locks that are exclusive across every replica
+// sharing the Redis instance. Locks expire after their TTL, so a crashed
+// owner cannot hold one forever; work that may outlive the TTL must call
+// Extend.
+type redisLocker struct {
+	rdb  redisClient
+	keys redisKeys
+}
+
+func newRedisLocker(rdb redisClient, keys redisKeys) redisLocker {
+	return redisLocker{rdb: rdb, keys: keys}
+}
+
+// redisLock is a held lock. Its token identifies the owner.
+type redisLock struct {
+	rdb   redisClient
+	key   string
+	token string
+}
+
+// Acquire takes the lock named key for ttl. It does not wait: when the lock
+// is held elsewhere it returns errLockHeld.
+func (l redisLocker) Acquire(ctx context.Context, key string, ttl time.Duration) (*redisLock, error) {
+	token, err := newLockToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate lock token: %w", err)
+	}
+	key = l.keys.lock(key)
+	ok, err := l.rdb.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return nil, fmt.Errorf("acquire lock %s: %w", key, err)
+	}
+	if !ok {
+		return nil, errLockHeld
+	}
+	return &redisLock{rdb: l.rdb, key: key, token: token}, nil
+}
+
+// Release gives up the lock. It returns errLockNotHeld when the lock had
+// already expired.
+func (lk *redisLock) Release(ctx context.Context) error {
+	n, err := releaseScript.Run(ctx, lk.rdb, []string{lk.key}, lk.token).Int64()
+	if err != nil {
+		return fmt.Errorf("release lock %s: %w", lk.key, err)
+	}
+	if n == 0 {
+		return errLockNotHeld
+	}
+	return nil
+}
+
+// Extend resets the lock's expiry to ttl from now. It returns errLockNotHeld
+// when the lock has already expired, in which case the caller must stop the
+// work the lock was protecting.
+func (lk *redisLock) Extend(ctx context.Context, ttl time.Duration) error {
+	n, err := extendScript.Run(ctx, lk.rdb, []string{lk.key}, lk.token, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return fmt.Errorf("extend lock %s: %w", lk.key, err)
+	}
+	if n == 0 {
+		return errLockNotHeld
+	}
+	return nil
+}
+
+// lockTokenBytes is the amount of randomness in a lock token.
+const lockTokenBytes = 16
+
+func newLockToken() (string, error) {
+	b := make([]byte, lockTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
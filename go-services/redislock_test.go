@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	redismock "github.com/go-redis/redismock/v9"
+)
+
+var testLockKey = testKeys.lock("products-warmup")
+
+// acquireTestLock acquires the products-warmup lock through mock.
+func acquireTestLock(t *testing.T, l redisLocker, mock redismock.ClientMock) *redisLock {
+	t.Helper()
+	mock.Regexp().ExpectSetNX(testLockKey, `^[0-9a-f]{32}$`, time.Minute).SetVal(true)
+	lk, err := l.Acquire(context.Background(), "products-warmup", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	return lk
+}
+
+func TestRedisLock_AcquireAndRelease(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	l := newRedisLocker(rdb, testKeys)
+
+	lk := acquireTestLock(t, l, mock)
+	mock.ExpectEvalSha(releaseScript.Hash(), []string{testLockKey}, lk.token).SetVal(int64(1))
+	if err := lk.Release(context.Background()); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestRedisLock_ContentionReturnsErrLockHeld(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	l := newRedisLocker(rdb, testKeys)
+
+	mock.Regexp().ExpectSetNX(testLockKey, `^[0-9a-f]{32}$`, time.Minute).SetVal(false)
+	lk, err := l.Acquire(context.Background(), "products-warmup", time.Minute)
+	if !errors.Is(err, errLockHeld) || lk != nil {
+		t.Errorf("expected errLockHeld, got %v, %v", lk, err)
+	}
+
+	mock.Regexp().ExpectSetNX(testLockKey, `^[0-9a-f]{32}$`, time.Minute).SetErr(errors.New("connection refused"))
+	if _, err := l.Acquire(context.Background(), "products-warmup", time.Minute); err == nil || errors.Is(err, errLockHeld) {
+		t.Errorf("expected the Redis error, got %v", err)
+	}
+}
+
+func TestRedisLock_ReleaseAfterExpiry(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	l := newRedisLocker(rdb, testKeys)
+
+	// The key expired, so the compare-and-delete finds nothing to delete.
+	lk := acquireTestLock(t, l, mock)
+	mock.ExpectEvalSha(releaseScript.Hash(), []string{testLockKey}, lk.token).SetVal(int64(0))
+	if err := lk.Release(context.Background()); !errors.Is(err, errLockNotHeld) {
+		t.Errorf("expected errLockNotHeld, got %v", err)
+	}
+}
+
+func TestRedisLock_ReleaseByWrongOwnerLeavesLock(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	l := newRedisLocker(rdb, testKeys)
+
+	first := acquireTestLock(t, l, mock)
+	// The first lock expired and a second owner took the key over.
+	second := acquireTestLock(t, l, mock)
+	if first.token == second.token {
+		t.Fatal("expected distinct owner tokens")
+	}
+
+	mock.ExpectEvalSha(releaseScript.Hash(), []string{testLockKey}, first.token).SetVal(int64(0))
+	if err := first.Release(context.Background()); !errors.Is(err, errLockNotHeld) {
+		t.Errorf("expected errLockNotHeld for the stale owner, got %v", err)
+	}
+	mock.ExpectEvalSha(releaseScript.Hash(), []string{testLockKey}, second.token).SetVal(int64(1))
+	if err := second.Release(context.Background()); err != nil {
+		t.Errorf("expected the current owner to release, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestRedisLock_Extend(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	l := newRedisLocker(rdb, testKeys)
+
+	lk := acquireTestLock(t, l, mock)
+	mock.ExpectEvalSha(extendScript.Hash(), []string{testLockKey}, lk.token, int64(90000)).SetVal(int64(1))
+	if err := lk.Extend(context.Background(), 90*time.Second); err != nil {
+		t.Errorf("Extend: %v", err)
+	}
+
+	mock.ExpectEvalSha(extendScript.Hash(), []string{testLockKey}, lk.token, int64(90000)).SetVal(int64(0))
+	if err := lk.Extend(context.Background(), 90*time.Second); !errors.Is(err, errLockNotHeld) {
+		t.Errorf("expected errLockNotHeld once the lock is lost, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
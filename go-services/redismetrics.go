@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisCommandNames are the commands that get their own label on the Redis
+// metrics; anything else is counted as redisOtherCommand so a new call site
+// cannot grow the label set unnoticed.
+var redisCommandNames = map[string]bool{
+	"del": true, "eval": true, "evalsha": true, "exec": true, "expire": true,
+	"get": true, "getdel": true, "hget": true, "hmget": true, "hset": true,
+	"incr": true, "mget": true, "multi": true, "ping": true, "sadd": true,
+	"set": true, "smembers": true, "srem": true, "ttl": true,
+}
+
+const (
+	redisOtherCommand = "other"
+	// redisPipelineCommand labels the round trip of a whole pipeline.
+	redisPipelineCommand = "pipeline"
+)
+
+// Redis error types, the values of the type label of redis_errors_total.
+const (
+	redisErrorTimeout = "timeout"
+	redisErrorNetwork = "network"
+	redisErrorReply   = "redis-error"
+)
+
+// redisCommandLabel returns the command label for cmd.
+func redisCommandLabel(cmd redis.Cmder) string {
+	name := strings.ToLower(cmd.Name())
+	if redisCommandNames[name] {
+		return name
+	}
+	return redisOtherCommand
+}
+
+// redisErrorType classifies err from a Redis command, returning "" for
+// outcomes that are not Redis failing: a missing key, a cancelled request or
+// a call the circuit breaker refused.
+func redisErrorType(err error) string {
+	var netErr net.Error
+	var replyErr redis.Error
+	switch {
+	case err == nil,
+		errors.Is(err, redis.Nil),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, errDependencyUnavailable):
+		return ""
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return redisErrorTimeout
+	case errors.As(err, &replyErr):
+		return redisErrorReply
+	}
+	// Anything else, such as a refused dial or a connection closed
+	// mid-reply, happened on the way to Redis.
+	return redisErrorNetwork
+}
+
+// redisMetricsHook is a go-redis hook timing every command and pipeline and
+// counting their failures by type.
+type redisMetricsHook struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+func newRedisMetricsHook(m *metrics) redisMetricsHook {
+	return redisMetricsHook{duration: m.redisCommandDuration, errors: m.redisErrors}
+}
+
+func (h redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.duration.WithLabelValues(redisCommandLabel(cmd)).Observe(time.Since(start).Seconds())
+		h.countError(cmd.Err())
+		return err
+	}
+}
+
+// ProcessPipelineHook times the pipeline as one round trip and counts the
+// errors of each of its commands.
+func (h redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		h.duration.WithLabelValues(redisPipelineCommand).Observe(time.Since(start).Seconds())
+		for _, cmd := range cmds {
+			h.countError(cmd.Err())
+		}
+		return err
+	}
+}
+
+func (h redisMetricsHook) countError(err error) {
+	if typ := redisErrorType(err); typ != "" {
+		h.errors.WithLabelValues(typ).Inc()
+	}
+}
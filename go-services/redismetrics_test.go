@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+)
+
+// replyWith is a redis.ProcessHook answering every command with err.
+func replyWith(err error) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		cmd.SetErr(err)
+		return err
+	}
+}
+
+// replyError is an error reply from Redis, like the ones go-redis parses.
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+func (replyError) RedisError()     {}
+
+// redisCommandCount returns how many commands were timed under command.
+func redisCommandCount(t *testing.T, s *Server, command string) uint64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := s.metrics.redisCommandDuration.WithLabelValues(command).(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
+
+func TestRedisMetricsHook_TimesCommands(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	process := newRedisMetricsHook(s.metrics).ProcessHook(replyWith(nil))
+	ctx := context.Background()
+
+	_ = process(ctx, redis.NewStringCmd(ctx, "get", "k"))
+	_ = process(ctx, redis.NewStatusCmd(ctx, "set", "k", "v"))
+	_ = process(ctx, redis.NewStatusCmd(ctx, "SET", "k", "v"))
+	_ = process(ctx, redis.NewCmd(ctx, "debug", "sleep", "0"))
+
+	for command, want := range map[string]uint64{"get": 1, "set": 2, redisOtherCommand: 1} {
+		if got := redisCommandCount(t, s, command); got != want {
+			t.Errorf("expected %d %s observations, got %d", want, command, got)
+		}
+	}
+	if n := testutil.CollectAndCount(s.metrics.redisCommandDuration); n != 3 {
+		t.Errorf("expected only the get, set and other series, got %d", n)
+	}
+	if n := testutil.CollectAndCount(s.metrics.redisErrors); n != 0 {
+		t.Errorf("expected no errors counted, got %d series", n)
+	}
+}
+
+func TestRedisMetricsHook_CountsErrors(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	h := newRedisMetricsHook(s.metrics)
+	ctx := context.Background()
+
+	for _, err := range []error{
+		redis.Nil,
+		context.Canceled,
+		fmt.Errorf("%w: redis circuit is open", errDependencyUnavailable),
+		os.ErrDeadlineExceeded,
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	} {
+		_ = h.ProcessHook(replyWith(err))(ctx, redis.NewStringCmd(ctx, "get", "k"))
+	}
+	_ = h.ProcessHook(replyWith(replyError("WRONGTYPE Operation against a key holding the wrong kind of value")))(ctx, redis.NewStatusCmd(ctx, "set", "k", "v"))
+
+	for typ, want := range map[string]float64{redisErrorTimeout: 1, redisErrorNetwork: 1, redisErrorReply: 1} {
+		if got := testutil.ToFloat64(s.metrics.redisErrors.WithLabelValues(typ)); got != want {
+			t.Errorf("expected %v %s errors, got %v", want, typ, got)
+		}
+	}
+	if got := redisCommandCount(t, s, "get"); got != 5 {
+		t.Errorf("expected every get to be timed, got %d", got)
+	}
+}
+
+func TestRedisMetricsHook_CoversPipelines(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	h := newRedisMetricsHook(s.metrics)
+	ctx := context.Background()
+
+	pipeline := h.ProcessPipelineHook(func(ctx context.Context, cmds []redis.Cmder) error {
+		cmds[1].SetErr(os.ErrDeadlineExceeded)
+		return os.ErrDeadlineExceeded
+	})
+	_ = pipeline(ctx, []redis.Cmder{
+		redis.NewStringCmd(ctx, "get", "a"),
+		redis.NewStringCmd(ctx, "get", "b"),
+		redis.NewStatusCmd(ctx, "set", "c", "v"),
+	})
+
+	if got := redisCommandCount(t, s, redisPipelineCommand); got != 1 {
+		t.Errorf("expected the pipeline to be timed once, got %d", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.redisErrors.WithLabelValues(redisErrorTimeout)); got != 1 {
+		t.Errorf("expected the failed command to be counted, got %v", got)
+	}
+}
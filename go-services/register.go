@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"go-service/store"
+)
+
+const (
+	minPasswordLen = 8
+	// maxPasswordLen is bcrypt's input limit; longer passwords would be
+	// silently truncated.
+	maxPasswordLen = 72
+	// maxEmailLen is the longest address SMTP can deliver to.
+	maxEmailLen = 254
+)
+
+// usernamePattern is the set of usernames that may be registered.
+var usernamePattern = regexp.MustCompile(`^[a-z0-9]{3,64}$`)
+
+type registerRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Email is where password reset tokens are sent. It is optional.
+	Email string `json:"email,omitempty"`
+}
+
+type registerResponse struct {
+	ID int64 `json:"id"`
+}
+
+// validate reports every rule the request breaks, as a validationError. It
+// never echoes the password.
+func (in registerRequest) validate() error {
+	var v validator
+	v.check(usernamePattern.MatchString(in.Username), "username", "must be 3 to 64 lowercase letters or digits")
+	checkPassword(&v, in.Password)
+	v.check(in.Email == "" || validEmail(in.Email), "email", "must be an email address")
+	return v.err()
+}
+
+// checkPassword records the password rules password breaks in v.
+func checkPassword(v *validator, password string) {
+	v.check(len(password) >= minPasswordLen, "password", fmt.Sprintf("must be at least %d characters", minPasswordLen))
+	v.check(len(password) <= maxPasswordLen, "password", fmt.Sprintf("must be at most %d bytes", maxPasswordLen))
+}
+
+// validEmail reports whether email is a bare address, with no display name
+// or anything else that would need quoting in a mail header.
+func validEmail(email string) bool {
+	a, err := mail.ParseAddress(email)
+	return err == nil && a.Address == email && len(email) <= maxEmailLen
+}
+
+func (s *Server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req registerRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), s.cfg.BcryptCost)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to hash password", "err", err)
+		s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+
+	id, err := s.users.Create(ctx, req.Username, req.Email, hash)
+	switch {
+	case errors.Is(err, store.ErrDuplicate):
+		s.writeError(w, http.StatusConflict, codeConflict, "username is already taken")
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB insert failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	s.logger.InfoContext(ctx, "User registered", "user_id", id)
+	s.writeJSON(w, http.StatusCreated, registerResponse{ID: id})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"go-service/store"
+)
+
+func newRegisterTestServer(t *testing.T) (*Server, *fakeUsers, *bytes.Buffer) {
+	t.Helper()
+	s, _, _ := newTestServer(t)
+	s.cfg.BcryptCost = bcrypt.MinCost
+	var logs bytes.Buffer
+	s.logger = newLogger(&logs, slog.LevelDebug)
+	return s, testUsers(s), &logs
+}
+
+func postRegister(s *Server, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestRegisterHandler_Success(t *testing.T) {
+	t.Parallel()
+	s, users, logs := newRegisterTestServer(t)
+	users.add(11, "bob", mustHash(t, "bobs password"))
+
+	w := postRegister(s, `{"username":"alice42","password":"correct horse"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var resp registerResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if resp.ID != 12 {
+		t.Errorf("expected id 12, got %d", resp.ID)
+	}
+	if strings.Contains(logs.String(), "correct horse") {
+		t.Errorf("password leaked into logs: %s", logs)
+	}
+
+	creds, err := users.Credentials(context.Background(), "alice42")
+	if err != nil || creds.ID != 12 || creds.Role != store.RoleUser {
+		t.Fatalf("expected alice42 stored as user 12, got %+v, %v", creds, err)
+	}
+	if cost, err := bcrypt.Cost(creds.PasswordHash); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("expected a bcrypt hash at the configured cost, got %d, %v", cost, err)
+	}
+	if bcrypt.CompareHashAndPassword(creds.PasswordHash, []byte("correct horse")) != nil {
+		t.Error("stored hash does not match the password")
+	}
+
+	w = postRegister(s, `{"username":"carol","password":"correct horse","email":"carol@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if c, err := users.Contact(context.Background(), "carol"); err != nil || c.Email != "carol@example.com" {
+		t.Errorf("expected carol's email stored, got %+v, %v", c, err)
+	}
+}
+
+func TestRegisterHandler_MapsErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		want     string
+	}{
+		{"duplicate username", nil, http.StatusConflict, codeConflict},
+		{"connection failure", errors.New("connection reset by peer"), http.StatusInternalServerError, codeDBError},
+	}
+	for _, tt := range tests {
+		s, users, logs := newRegisterTestServer(t)
+		users.add(1, "alice", mustHash(t, "taken"))
+		if tt.err != nil {
+			users.fail(tt.err)
+		}
+
+		w := postRegister(s, `{"username":"alice","password":"s3cret-pass"}`)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.wantCode, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != tt.want {
+			t.Errorf("%s: expected code %q, got %+v", tt.name, tt.want, got)
+		}
+		if strings.Contains(logs.String(), "s3cret-pass") {
+			t.Errorf("%s: password leaked into logs: %s", tt.name, logs)
+		}
+	}
+}
+
+func TestRegisterHandler_Validation(t *testing.T) {
+	t.Parallel()
+	s, users, _ := newRegisterTestServer(t)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"short username", `{"username":"al","password":"long enough"}`},
+		{"long username", `{"username":"` + strings.Repeat("a", 65) + `","password":"long enough"}`},
+		{"uppercase username", `{"username":"Alice","password":"long enough"}`},
+		{"punctuation in username", `{"username":"al.ice","password":"long enough"}`},
+		{"short password", `{"username":"alice","password":"short"}`},
+		{"password beyond bcrypt limit", `{"username":"alice","password":"` + strings.Repeat("p", maxPasswordLen+1) + `"}`},
+		{"malformed email", `{"username":"alice","password":"long enough","email":"alice"}`},
+		{"email with a display name", `{"username":"alice","password":"long enough","email":"Alice <alice@example.com>"}`},
+	}
+	for _, tt := range tests {
+		w := postRegister(s, tt.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.name, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeValidation {
+			t.Errorf("%s: expected code %q, got %+v", tt.name, codeValidation, got)
+		}
+	}
+	if n := users.callCount(); n != 0 {
+		t.Errorf("validation failures must not reach the store, got %d calls", n)
+	}
+}
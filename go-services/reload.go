@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+)
+
+// reloadableSettings are the Config fields a reload applies. Changes to any
+// other field, such as the listen addresses or the database credentials,
+// need a restart and are only reported.
+var reloadableSettings = []string{
+	"ProductsCacheTTL",
+	"ProductsStaleTTL",
+	"MaintenanceCacheTTL",
+	"ProductsMissingTTL",
+	"CacheTTLJitter",
+	"LoginMaxAttempts",
+	"LoginLockoutWindow",
+	"LogLevel",
+	"TrustedProxies",
+	"RateLimits",
+}
+
+// settings returns the configuration in effect. Handlers read the
+// reloadable settings through it rather than from cfg, which reload never
+// touches; before the first reload it is cfg itself.
+func (s *Server) settings() *Config {
+	if c := s.live.Load(); c != nil {
+		return c
+	}
+	return &s.cfg
+}
+
+// reloadResult names the Config fields that changed in a reload.
+type reloadResult struct {
+	Applied []string `json:"applied"`
+	Ignored []string `json:"ignored"`
+}
+
+// reload reads the configuration again and applies the changes to the
+// reloadableSettings. An invalid configuration changes nothing.
+func (s *Server) reload(ctx context.Context) (reloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	next, err := s.loadConfig()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	cur := s.settings()
+	applied := *cur
+	res := reloadResult{Applied: []string{}, Ignored: []string{}}
+	curV, nextV, appliedV := reflect.ValueOf(cur).Elem(), reflect.ValueOf(next), reflect.ValueOf(&applied).Elem()
+	for i := range curV.NumField() {
+		if reflect.DeepEqual(curV.Field(i).Interface(), nextV.Field(i).Interface()) {
+			continue
+		}
+		name := curV.Type().Field(i).Name
+		if !slices.Contains(reloadableSettings, name) {
+			res.Ignored = append(res.Ignored, name)
+			continue
+		}
+		appliedV.Field(i).Set(nextV.Field(i))
+		res.Applied = append(res.Applied, name)
+	}
+
+	if applied.LogLevel != cur.LogLevel {
+		s.logLevel.set(applied.LogLevel, 0, nil)
+	}
+	s.live.Store(&applied)
+
+	if len(res.Ignored) > 0 {
+		s.logger.WarnContext(ctx, "Configuration changes need a restart and were ignored", "settings", res.Ignored)
+	}
+	s.logger.InfoContext(ctx, "Configuration reloaded", "applied", res.Applied)
+	return res, nil
+}
+
+// reloadConfigOnSIGHUP reloads the configuration each time the process
+// receives SIGHUP, until ctx is done.
+func (s *Server) reloadConfigOnSIGHUP(ctx context.Context) {
+	onSIGHUP(ctx, func() {
+		if _, err := s.reload(ctx); err != nil {
+			s.logger.Error("Configuration reload failed, keeping the current settings", "err", err)
+		}
+	})
+}
+
+// onSIGHUP calls fn each time the process receives SIGHUP, until ctx is
+// done.
+func onSIGHUP(ctx context.Context, fn func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				fn()
+			}
+		}
+	}()
+}
+
+// reloadHandler reloads the configuration, as SIGHUP does, and lists what
+// changed. It is only served on the internal listener, behind
+// requireRole, and reloads this replica only.
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := s.reload(ctx)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Configuration reload failed, keeping the current settings", "err", err)
+		s.writeError(w, http.StatusUnprocessableEntity, codeInvalidConfig, err.Error())
+		return
+	}
+	s.logger.WarnContext(ctx, "Configuration reload requested",
+		"audit", true,
+		"actor", auditActor(ctx),
+		"remote_ip", s.clientIP(r),
+		"applied", res.Applied,
+		"ignored", res.Ignored,
+	)
+	s.audit(r, auditConfigReloaded, 0, map[string]any{"applied": res.Applied, "ignored": res.Ignored})
+	s.writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// reloadingTo makes s's reloads read cfg.
+func reloadingTo(s *Server, cfg Config) {
+	s.loadConfig = func() (Config, error) { return cfg, nil }
+}
+
+func TestReload_AppliesNewCacheTTL(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	next := s.cfg
+	next.ProductsCacheTTL = 42 * time.Second
+	reloadingTo(s, next)
+	res, err := s.reload(context.Background())
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !slices.Equal(res.Applied, []string{"ProductsCacheTTL"}) || len(res.Ignored) != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	redisMock.ExpectSet(testKeys.product(1), []byte("{}"), 42*time.Second).SetVal("OK")
+	s.cacheSet(context.Background(), testKeys.product(1), []byte("{}"))
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the reloaded TTL to be used: %v", err)
+	}
+}
+
+func TestReload_IgnoresAddressesAndCredentials(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.HTTPAddr, s.cfg.DBPassword = ":8080", "old"
+
+	next := s.cfg
+	next.HTTPAddr, next.DBPassword = ":9999", "new"
+	next.LoginMaxAttempts = 7
+	next.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	reloadingTo(s, next)
+	res, err := s.reload(context.Background())
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if !slices.Equal(res.Ignored, []string{"DBPassword", "HTTPAddr"}) {
+		t.Errorf("expected the address and password to be ignored, got %v", res.Ignored)
+	}
+	if !slices.Equal(res.Applied, []string{"TrustedProxies", "LoginMaxAttempts"}) {
+		t.Errorf("unexpected applied settings %v", res.Applied)
+	}
+	cfg := s.settings()
+	if cfg.HTTPAddr != ":8080" || cfg.DBPassword != "old" {
+		t.Errorf("expected the address and password to stay, got %q %q", cfg.HTTPAddr, cfg.DBPassword)
+	}
+	if cfg.LoginMaxAttempts != 7 || !s.trustedProxy(netip.MustParseAddr("10.1.2.3")) {
+		t.Errorf("expected the login limit and proxies to change, got %+v", cfg)
+	}
+}
+
+func TestReload_AppliesRateLimits(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.RateLimits = mustParseRateLimits(t, `{"default": {"limit": 10, "window": "1m"}}`)
+
+	next := s.cfg
+	next.RateLimits = mustParseRateLimits(t, `{"routes": {"/version": {"limit": 1, "window": "1m"}}}`)
+	reloadingTo(s, next)
+	res, err := s.reload(context.Background())
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !slices.Equal(res.Applied, []string{"RateLimits"}) || len(res.Ignored) != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	// The second request is over the reloaded limit of one, counted under
+	// the new route rule rather than the old default.
+	expectRateCount(redisMock, "192.0.2.1", "route:/version", 2)
+	if w := getWithTenant(s, "/version", ""); w.Code != http.StatusTooManyRequests || w.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Errorf("expected the reloaded limit, got %d with limit %q", w.Code, w.Header().Get("X-RateLimit-Limit"))
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReload_InvalidConfigChangesNothing(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	s.loadConfig = func() (Config, error) { return Config{}, errors.New("invalid env PRODUCTS_CACHE_TTL") }
+
+	if _, err := s.reload(context.Background()); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if got := s.settings().ProductsCacheTTL; got != time.Minute {
+		t.Errorf("expected the TTL to stay 1m, got %v", got)
+	}
+}
+
+func TestReload_AppliesLogLevel(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	next := s.cfg
+	next.LogLevel = slog.LevelDebug
+	reloadingTo(s, next)
+	if _, err := s.reload(context.Background()); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if level, _ := s.logLevel.get(); level != slog.LevelDebug {
+		t.Errorf("expected debug, got %v", level)
+	}
+}
+
+func TestReload_ConcurrentWithReaders(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	reloadingTo(s, Config{ProductsCacheTTL: time.Second})
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _ = s.reload(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			_ = s.settings().ProductsCacheTTL
+			_ = s.trustedProxy(netip.MustParseAddr("10.1.2.3"))
+		}()
+	}
+	wg.Wait()
+	if got := s.settings().ProductsCacheTTL; got != time.Second {
+		t.Errorf("expected 1s, got %v", got)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	next := s.cfg
+	next.ProductsStaleTTL = time.Hour
+	reloadingTo(s, next)
+
+	post := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		s.InternalHandler().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+	w := post("Bearer " + testAdminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var res reloadResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if !slices.Equal(res.Applied, []string{"ProductsStaleTTL"}) {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	s.loadConfig = func() (Config, error) { return Config{}, errors.New("invalid env SESSION_TTL") }
+	if w := post("Bearer " + testAdminToken); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for an invalid configuration, got %d", w.Code)
+	} else if got := decodeError(t, w); got.Code != codeInvalidConfig {
+		t.Errorf("expected code %q, got %+v", codeInvalidConfig, got)
+	}
+}
+
+func TestReloadConfigOnSIGHUP(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	next := s.cfg
+	next.ProductsCacheTTL = 7 * time.Second
+	reloadingTo(s, next)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.reloadConfigOnSIGHUP(ctx)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("failed to send SIGHUP: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.settings().ProductsCacheTTL != 7*time.Second {
+		if time.Now().After(deadline) {
+			t.Fatal("the configuration was not reloaded on SIGHUP")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/httpclient"
+)
+
+const (
+	// reportBuffer is how many errors may wait for runErrorReporter; more
+	// are dropped.
+	reportBuffer = 64
+	// reportDedupWindow is how long an error is not reported again after
+	// it was.
+	reportDedupWindow = time.Minute
+	// reportsPerMinute caps the errors reported by a replica, so an outage
+	// sends a trickle rather than an event per failed request.
+	reportsPerMinute = 30
+	// reportTimeout bounds sending one report.
+	reportTimeout = 5 * time.Second
+)
+
+// Reporter sends an error to an error tracker. runErrorReporter calls it
+// from a single goroutine.
+type Reporter interface {
+	Report(ctx context.Context, ev errorEvent) error
+}
+
+// errorEvent is a reported error. It identifies the request by route, not
+// by URL, and never carries its body or headers, which may hold
+// credentials.
+type errorEvent struct {
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message"`
+	Status    int       `json:"status"`
+	Code      string    `json:"code"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	RequestID string    `json:"request_id,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Panic     bool      `json:"panic,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
+}
+
+// fingerprint identifies repeats of the same error.
+func (ev errorEvent) fingerprint() string {
+	return strings.Join([]string{ev.Method, ev.Route, strconv.Itoa(ev.Status), ev.Code, ev.Message}, "\x00")
+}
+
+// newReporter returns the Reporter for SentryDSN or ErrorWebhookURL, or nil
+// when neither is set.
+func newReporter(cfg Config, client *http.Client, build buildInfo) (Reporter, error) {
+	switch {
+	case cfg.SentryDSN != "":
+		endpoint, key, err := parseSentryDSN(cfg.SentryDSN)
+		if err != nil {
+			return nil, fmt.Errorf("SENTRY_DSN %w", err)
+		}
+		return sentryReporter{endpoint: endpoint, key: key, release: build.Version, client: client}, nil
+	case cfg.ErrorWebhookURL != "":
+		return webhookReporter{url: cfg.ErrorWebhookURL, client: client}, nil
+	}
+	return nil, nil
+}
+
+// reportedStatus reports whether a response with status is worth
+// reporting. 503s are left out: they are the service shedding load or
+// waiting out a dependency, which is already alerted on.
+func reportedStatus(status int) bool {
+	return status >= 500 && status != http.StatusServiceUnavailable
+}
+
+// reportError queues ev, completed with r's method, route, request ID and
+// trace ID, unless reporting is off or ev repeats a recent error.
+func (s *Server) reportError(r *http.Request, ev errorEvent) {
+	if s.reports == nil {
+		return
+	}
+	ctx := r.Context()
+	ev.Time = time.Now()
+	ev.Method = r.Method
+	ev.Route = s.routeLabel(r)
+	ev.RequestID = requestIDFrom(ctx)
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		ev.TraceID = sc.TraceID().String()
+	}
+
+	if result := s.reportLimit.allow(ev.fingerprint(), ev.Time); result != "" {
+		s.metrics.errorReports.WithLabelValues(result).Inc()
+		return
+	}
+	select {
+	case s.reports <- ev:
+	default:
+		s.metrics.errorReports.WithLabelValues("dropped").Inc()
+	}
+}
+
+// runErrorReporter sends the queued errors until ctx is done.
+func (s *Server) runErrorReporter(ctx context.Context) {
+	for {
+		select {
+		case ev := <-s.reports:
+			sendCtx, cancel := context.WithTimeout(ctx, reportTimeout)
+			err := s.reporter.Report(sendCtx, ev)
+			cancel()
+			if err != nil {
+				s.metrics.errorReports.WithLabelValues("failed").Inc()
+				s.logger.WarnContext(ctx, "Failed to report error", "err", err)
+				continue
+			}
+			s.metrics.errorReports.WithLabelValues("sent").Inc()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reportLimiter drops repeats of an error within reportDedupWindow and
+// errors beyond reportsPerMinute. The zero value is ready to use.
+type reportLimiter struct {
+	mu          sync.Mutex
+	last        map[string]time.Time
+	windowStart time.Time
+	sent        int
+}
+
+// allow reports whether the error with fingerprint key may be sent at
+// now, and otherwise why not: "deduplicated" or "rate_limited".
+func (l *reportLimiter) allow(key string, now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.windowStart) >= time.Minute {
+		l.windowStart = now
+		l.sent = 0
+		for k, t := range l.last {
+			if now.Sub(t) >= reportDedupWindow {
+				delete(l.last, k)
+			}
+		}
+	}
+	if t, ok := l.last[key]; ok && now.Sub(t) < reportDedupWindow {
+		return "deduplicated"
+	}
+	if l.sent >= reportsPerMinute {
+		return "rate_limited"
+	}
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	l.last[key] = now
+	l.sent++
+	return ""
+}
+
+// serverErrorWriter remembers the first server error written through it,
+// for withRecovery to report once the handler returns.
+type serverErrorWriter struct {
+	http.ResponseWriter
+	status int
+	code   string
+	err    error
+}
+
+func (w *serverErrorWriter) noteServerError(status int, code string, err error) {
+	if w.err == nil {
+		w.status, w.code, w.err = status, code, err
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *serverErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack passes protocol upgrades through, as statusRecorder does.
+func (w *serverErrorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// serverErrorNoter is implemented by the writers that carry a server error
+// from the response helpers to withRecovery.
+type serverErrorNoter interface {
+	noteServerError(status int, code string, err error)
+}
+
+// noteServerError records err on the serverErrorWriter under w, if any,
+// looking through the writers that wrap it.
+func noteServerError(w http.ResponseWriter, status int, code string, err error) {
+	for {
+		if n, ok := w.(serverErrorNoter); ok {
+			n.noteServerError(status, code, err)
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// webhookReporter posts each error as JSON to a URL.
+type webhookReporter struct {
+	url    string
+	client *http.Client
+}
+
+func (r webhookReporter) Report(ctx context.Context, ev errorEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return postReport(ctx, r.client, r.url, body, nil)
+}
+
+// sentryReporter sends each error to the store endpoint of a Sentry
+// project.
+type sentryReporter struct {
+	endpoint string
+	key      string
+	release  string
+	client   *http.Client
+}
+
+// parseSentryDSN returns the store endpoint and public key of a DSN such
+// as https://key@o1.ingest.sentry.io/42.
+func parseSentryDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User == nil || u.User.Username() == "" {
+		return "", "", errors.New("must be a URL such as https://key@host/project")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 {
+		return "", "", errors.New("must end with a numeric project id")
+	}
+	prefix, project := u.Path[:i], u.Path[i+1:]
+	if _, err := strconv.ParseUint(project, 10, 64); err != nil {
+		return "", "", errors.New("must end with a numeric project id")
+	}
+	return u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/store/", u.User.Username(), nil
+}
+
+// sentryEvent is the subset of Sentry's event payload that is sent.
+type sentryEvent struct {
+	EventID   string            `json:"event_id"`
+	Timestamp string            `json:"timestamp"`
+	Level     string            `json:"level"`
+	Platform  string            `json:"platform"`
+	Logger    string            `json:"logger"`
+	Release   string            `json:"release,omitempty"`
+	Message   string            `json:"message"`
+	Tags      map[string]string `json:"tags"`
+	Extra     map[string]string `json:"extra,omitempty"`
+}
+
+func (r sentryReporter) Report(ctx context.Context, ev errorEvent) error {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	tags := map[string]string{
+		"method":     ev.Method,
+		"route":      ev.Route,
+		"status":     strconv.Itoa(ev.Status),
+		"code":       ev.Code,
+		"request_id": ev.RequestID,
+		"trace_id":   ev.TraceID,
+		"panic":      strconv.FormatBool(ev.Panic),
+	}
+	var extra map[string]string
+	if ev.Stack != "" {
+		extra = map[string]string{"stack": ev.Stack}
+	}
+	body, err := json.Marshal(sentryEvent{
+		EventID:   hex.EncodeToString(id),
+		Timestamp: ev.Time.UTC().Format(time.RFC3339),
+		Level:     "error",
+		Platform:  "go",
+		Logger:    "go-service",
+		Release:   r.release,
+		Message:   ev.Message,
+		Tags:      tags,
+		Extra:     extra,
+	})
+	if err != nil {
+		return err
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=go-service/%s, sentry_key=%s", r.release, r.key)
+	return postReport(ctx, r.client, r.endpoint, body, http.Header{"X-Sentry-Auth": {auth}})
+}
+
+// postReport posts a JSON body and expects a 2xx.
+func postReport(ctx context.Context, client *http.Client, target string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpclient.StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
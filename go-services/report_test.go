@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go-service/store"
+)
+
+// fakeReporter records the errors it is asked to report.
+type fakeReporter struct {
+	mu     sync.Mutex
+	events []errorEvent
+	err    error
+}
+
+func (f *fakeReporter) Report(ctx context.Context, ev errorEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, ev)
+	return f.err
+}
+
+// withFakeReporter turns error reporting on for s, to a fakeReporter.
+func withFakeReporter(s *Server) *fakeReporter {
+	f := &fakeReporter{}
+	s.reporter = f
+	s.reports = make(chan errorEvent, reportBuffer)
+	return f
+}
+
+// queuedReports drains and returns the errors s has queued for reporting.
+func queuedReports(s *Server) []errorEvent {
+	var events []errorEvent
+	for {
+		select {
+		case ev := <-s.reports:
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+// panickingProducts is a product store whose Get panics.
+type panickingProducts struct {
+	store.ProductStore
+}
+
+func (panickingProducts) Get(ctx context.Context, id int64) (store.Product, error) {
+	panic("store exploded")
+}
+
+func TestReportError_ReportsPanicWithRequestContext(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	withFakeReporter(s)
+
+	req := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	s.products = panickingProducts{s.products}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	events := queuedReports(s)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 report, got %d: %+v", len(events), events)
+	}
+	ev := events[0]
+	if !ev.Panic || ev.Method != http.MethodGet || ev.Route != "/products/{id}" || ev.RequestID != "req-42" || ev.Status != http.StatusInternalServerError {
+		t.Errorf("unexpected report: %+v", ev)
+	}
+	if !strings.Contains(ev.Message, "store exploded") || ev.Stack == "" {
+		t.Errorf("expected the panic value and stack, got %+v", ev)
+	}
+	body, _ := json.Marshal(ev)
+	if strings.Contains(string(body), "secret-token") {
+		t.Errorf("report carries the request's credentials: %s", body)
+	}
+}
+
+func TestReportError_ReportsUnderlyingStoreError(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	withFakeReporter(s)
+	testProducts(s).fail(errors.New("connection reset by peer"))
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	events := queuedReports(s)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 report, got %d", len(events))
+	}
+	if ev := events[0]; ev.Panic || ev.Message != "connection reset by peer" || ev.Code != codeDBError || ev.Route != "/products" {
+		t.Errorf("unexpected report: %+v", ev)
+	}
+}
+
+func TestReportError_SkipsClientErrorsAndUnavailable(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	withFakeReporter(s)
+
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/products/999", nil))
+	testProducts(s).fail(errDependencyUnavailable)
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if events := queuedReports(s); len(events) != 0 {
+		t.Errorf("expected no reports, got %+v", events)
+	}
+}
+
+func TestReportError_ReportsBehindTimeout(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.RequestTimeout = time.Second
+	withFakeReporter(s)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		s.writeInternalError(w, errors.New("redis: connection pool timeout"))
+	}
+	s.withRecovery(s.withTimeout(handler))(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/boom", nil))
+
+	events := queuedReports(s)
+	if len(events) != 1 || events[0].Message != "redis: connection pool timeout" {
+		t.Errorf("expected the handler's error to be reported, got %+v", events)
+	}
+}
+
+func TestReportError_OffWithoutReporter(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(errors.New("boom"))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if got := testutil.CollectAndCount(s.metrics.errorReports); got != 0 {
+		t.Errorf("expected no error_reports_total series, got %d", got)
+	}
+}
+
+func TestReportError_DeduplicatesRepeats(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	withFakeReporter(s)
+	testProducts(s).fail(errors.New("boom"))
+
+	for range 5 {
+		s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/products", nil))
+	}
+
+	if events := queuedReports(s); len(events) != 1 {
+		t.Errorf("expected 1 report, got %d", len(events))
+	}
+	if got := testutil.ToFloat64(s.metrics.errorReports.WithLabelValues("deduplicated")); got != 4 {
+		t.Errorf("expected 4 deduplicated, got %v", got)
+	}
+}
+
+func TestReportLimiter(t *testing.T) {
+	t.Parallel()
+	var l reportLimiter
+	now := time.Now()
+
+	if got := l.allow("a", now); got != "" {
+		t.Fatalf("first error: got %q", got)
+	}
+	if got := l.allow("a", now.Add(time.Second)); got != "deduplicated" {
+		t.Errorf("repeat: got %q, want deduplicated", got)
+	}
+	for i := 1; i < reportsPerMinute; i++ {
+		if got := l.allow(string(rune('b'+i)), now); got != "" {
+			t.Fatalf("error %d: got %q", i, got)
+		}
+	}
+	if got := l.allow("new", now); got != "rate_limited" {
+		t.Errorf("beyond the cap: got %q, want rate_limited", got)
+	}
+	if got := l.allow("a", now.Add(reportDedupWindow)); got != "" {
+		t.Errorf("after the window: got %q", got)
+	}
+}
+
+func TestRunErrorReporter_SendsQueuedErrors(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	f := withFakeReporter(s)
+	f.err = errors.New("tracker down")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.runErrorReporter(ctx)
+		close(done)
+	}()
+	s.reports <- errorEvent{Message: "boom"}
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(s.metrics.errorReports.WithLabelValues("failed")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the error was not sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.events) != 1 || f.events[0].Message != "boom" {
+		t.Errorf("unexpected reports: %+v", f.events)
+	}
+}
+
+func TestNewReporter(t *testing.T) {
+	t.Parallel()
+
+	r, err := newReporter(Config{}, http.DefaultClient, buildInfo{})
+	if err != nil || r != nil {
+		t.Errorf("no settings: got %v, %v; want nil", r, err)
+	}
+
+	r, err = newReporter(Config{SentryDSN: "https://pub@o1.ingest.sentry.io/42"}, http.DefaultClient, buildInfo{})
+	if err != nil {
+		t.Fatalf("sentry: %v", err)
+	}
+	if sr, ok := r.(sentryReporter); !ok || sr.endpoint != "https://o1.ingest.sentry.io/api/42/store/" || sr.key != "pub" {
+		t.Errorf("sentry: got %+v", r)
+	}
+
+	if _, err := newReporter(Config{SentryDSN: "https://o1.ingest.sentry.io/42"}, http.DefaultClient, buildInfo{}); err == nil {
+		t.Error("expected a DSN without a key to be rejected")
+	}
+}
+
+func TestWebhookReporter_PostsEvent(t *testing.T) {
+	t.Parallel()
+	var got errorEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("body is not JSON: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	r := webhookReporter{url: srv.URL, client: srv.Client()}
+	ev := errorEvent{Message: "boom", Status: 500, Route: "/products", RequestID: "req-1"}
+	if err := r.Report(context.Background(), ev); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if got.Message != "boom" || got.Route != "/products" || got.RequestID != "req-1" {
+		t.Errorf("unexpected event: %+v", got)
+	}
+}
+
+func TestSentryReporter_SendsAuthHeader(t *testing.T) {
+	t.Parallel()
+	var auth string
+	var got sentryEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("X-Sentry-Auth")
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	r := sentryReporter{endpoint: srv.URL, key: "pub", release: "1.2.3", client: srv.Client()}
+	if err := r.Report(context.Background(), errorEvent{Message: "boom", Method: "GET", Route: "/products", TraceID: "abc"}); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if !strings.Contains(auth, "sentry_key=pub") {
+		t.Errorf("unexpected X-Sentry-Auth %q", auth)
+	}
+	if got.Message != "boom" || got.Release != "1.2.3" || got.Tags["route"] != "/products" || got.Tags["trace_id"] != "abc" {
+		t.Errorf("unexpected event: %+v", got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestWithRequestID_PropagatesSuppliedID(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	s, _, _ := newTestServer(t)
+	s.logger = newLogger(&buf, slog.LevelInfo)
+	exp := withSpanRecorder(t, s)
+
+	testProducts(s).fail(errors.New("connection refused"))
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	if got := w.Header().Get(requestIDHeader); got != "abc-123" {
+		t.Errorf("expected X-Request-ID abc-123 echoed back, got %q", got)
+	}
+
+	var found bool
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("log line is not valid JSON: %v: %s", err, sc.Text())
+		}
+		if entry["msg"] == "DB query failed" {
+			found = true
+			if entry["request_id"] != "abc-123" {
+				t.Errorf("expected request_id on the error log, got %v", entry["request_id"])
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected a DB query failed log line, got %s", buf.String())
+	}
+
+	spans := exp.GetSpans()
+	if len(spans) == 0 {
+		t.Fatal("expected a server span")
+	}
+	server := spans[len(spans)-1]
+	if got := spanAttr(server, "http.request_id").AsString(); got != "abc-123" {
+		t.Errorf("expected request ID on the server span, got %q", got)
+	}
+}
+
+func TestWithRequestID_GeneratesMissingID(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	var seen string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}
+
+	w := httptest.NewRecorder()
+	s.withRequestID(handler)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	got := w.Header().Get(requestIDHeader)
+	if _, err := uuid.Parse(got); err != nil {
+		t.Fatalf("expected a generated UUID, got %q", got)
+	}
+	if seen != got {
+		t.Errorf("expected the handler context to carry %q, got %q", got, seen)
+	}
+}
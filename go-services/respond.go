@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"go-service/store"
+)
+
+// Error codes returned in the "code" field of the error envelope. Clients
+// branch on these, so existing values must not change.
+const (
+	codeBadRequest         = "bad_request"
+	codeBodyTooLarge       = "body_too_large"
+	codeUnsupportedMedia   = "unsupported_media_type"
+	codeValidation         = "validation_failed"
+	codeInvalidCredentials = "invalid_credentials"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeInvalidToken       = "invalid_token"
+	codeTokenExpired       = "token_expired"
+	codeInvalidSignature   = "invalid_signature"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codeInvalidReference   = "invalid_reference"
+	codeInsufficientStock  = "insufficient_stock"
+	codeOutOfStock         = "out_of_stock"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeDBError            = "db_error"
+	codeDBTimeout          = "db_timeout"
+	codeInternal           = "internal_error"
+	codeTimeout            = "timeout"
+	codeCanceled           = "canceled"
+	codeTooManyRequests    = "too_many_requests"
+	codeMaintenance        = "maintenance"
+	codeOverloaded         = "overloaded"
+	codeInvalidConfig      = "invalid_config"
+
+	codeDependencyUnavailable = "dependency_unavailable"
+)
+
+// statusClientClosedRequest is the status nginx logs for a request whose
+// client went away before the response; no client ever sees it, but access
+// logs and metrics do.
+const statusClientClosedRequest = 499
+
+// errorResponse is the envelope for every error response:
+//
+//	{"error":{"code":"db_error","message":"database error"}}
+//
+// The message is meant for clients; internal details belong in the logs.
+// Validation errors also list each invalid field:
+//
+//	{"error":{"code":"validation_failed","message":"price must not be negative",
+//	 "fields":[{"field":"price","message":"must not be negative"}]}}
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+	// Retryable tells the client the same request may succeed if sent
+	// again.
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// writeJSON encodes v as the response body with the given status.
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("Failed to encode response", "err", err)
+		s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// writeJSONBody writes an already-encoded JSON document with a 200 status.
+func writeJSONBody(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// decodeJSON decodes the request body, a single JSON value, into v, reading
+// at most limit bytes. On failure it writes a 415, 413 or 400 error and
+// returns false; fields of the wrong type or not in v are reported as
+// validation errors.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, limit int64, v any) bool {
+	if !isJSONContentType(r.Header.Get("Content-Type")) {
+		s.writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Content-Type must be application/json")
+		return false
+	}
+	if r.ContentLength > limit {
+		s.writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "request body too large")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "request body must be a single JSON value")
+		return false
+	}
+	var maxErr *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &maxErr):
+		s.writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "request body too large")
+	default:
+		if f, ok := decodeFieldError(err); ok {
+			s.writeValidationError(w, validationError{f})
+			return false
+		}
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "invalid JSON body")
+	}
+	return false
+}
+
+// isJSONContentType reports whether a Content-Type header value names
+// application/json, with or without parameters such as charset.
+func isJSONContentType(v string) bool {
+	mediaType, _, err := mime.ParseMediaType(v)
+	return err == nil && mediaType == "application/json"
+}
+
+// writeDBError writes the response for a failed store call.
+func (s *Server) writeDBError(w http.ResponseWriter, err error) {
+	status, detail := dbError(err)
+	if reportedStatus(status) {
+		noteServerError(w, status, detail.Code, err)
+	}
+	s.writeJSON(w, status, errorResponse{Error: detail})
+}
+
+// dbError returns the status and error for a failed store call. Handlers
+// deal with the errors particular to them, such as a missing product,
+// first; the rest are mapped here from the store's typed errors:
+//
+//   - ErrNotFound: 404
+//   - ErrDuplicate: 409
+//   - ErrSerialization: 409, retryable
+//   - ErrForeignKey: 422
+//   - ErrCanceled: 499, the client having gone away
+//   - ErrTimeout: 504
+//   - a circuit breaker refusing the call: 503
+//   - anything else, ErrSchema included: 500
+func dbError(err error) (int, errorDetail) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, errorDetail{Code: codeNotFound, Message: "not found"}
+	case errors.Is(err, store.ErrDuplicate):
+		return http.StatusConflict, errorDetail{Code: codeConflict, Message: "already exists"}
+	case errors.Is(err, store.ErrSerialization):
+		return http.StatusConflict, errorDetail{Code: codeConflict, Message: "conflicted with a concurrent request; retry it", Retryable: true}
+	case errors.Is(err, store.ErrForeignKey):
+		return http.StatusUnprocessableEntity, errorDetail{Code: codeInvalidReference, Message: "references a resource that does not exist"}
+	case errors.Is(err, store.ErrCanceled):
+		return statusClientClosedRequest, errorDetail{Code: codeCanceled, Message: "request canceled"}
+	case errors.Is(err, store.ErrTimeout):
+		return http.StatusGatewayTimeout, errorDetail{Code: codeDBTimeout, Message: "database timed out"}
+	case errors.Is(err, errDependencyUnavailable):
+		return http.StatusServiceUnavailable, errorDetail{Code: codeDependencyUnavailable, Message: "database unavailable"}
+	}
+	return http.StatusInternalServerError, errorDetail{Code: codeDBError, Message: "database error"}
+}
+
+// writeInternalError answers a request that failed on err, typically from
+// Redis: a 503 if a circuit breaker refused the call, a 500 otherwise.
+func (s *Server) writeInternalError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDependencyUnavailable) {
+		s.writeError(w, http.StatusServiceUnavailable, codeDependencyUnavailable, "service temporarily unavailable")
+		return
+	}
+	noteServerError(w, http.StatusInternalServerError, codeInternal, err)
+	s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+}
+
+// writeError writes the error envelope with the given status. Server
+// errors are noted for withRecovery to report; writeDBError and
+// writeInternalError note the underlying error first.
+func (s *Server) writeError(w http.ResponseWriter, status int, code, msg string) {
+	if reportedStatus(status) {
+		noteServerError(w, status, code, errors.New(msg))
+	}
+	s.writeJSON(w, status, errorResponse{Error: errorDetail{Code: code, Message: msg}})
+}
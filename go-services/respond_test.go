@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// decodeError asserts that w holds a JSON error envelope and returns it.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) errorDetail {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected a JSON body, got %v: %s", err, w.Body)
+	}
+	if len(body) != 1 || body["error"] == nil {
+		t.Fatalf("expected only an error key, got %s", w.Body)
+	}
+	var detail errorDetail
+	if err := json.Unmarshal(body["error"], &detail); err != nil {
+		t.Fatalf("malformed error envelope: %v: %s", err, w.Body)
+	}
+	if detail.Code == "" || detail.Message == "" {
+		t.Errorf("expected code and message, got %s", w.Body)
+	}
+	return detail
+}
+
+func TestWriteError_Envelope(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.writeError(w, http.StatusTeapot, "teapot", "short and stout")
+
+	if w.Code != http.StatusTeapot {
+		t.Errorf("expected 418, got %d", w.Code)
+	}
+	want := `{"error":{"code":"teapot","message":"short and stout"}}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestProductsHandler_DBErrorDoesNotLeakDetails(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(errors.New(`pq: password authentication failed for user "app"`))
+
+	w := httptest.NewRecorder()
+	s.productsHandler(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeDBError {
+		t.Errorf("expected code %q, got %+v", codeDBError, got)
+	}
+	if strings.Contains(w.Body.String(), "pq:") {
+		t.Errorf("response leaks the driver error: %s", w.Body)
+	}
+}
+
+func TestLoginHandler_ErrorEnvelopes(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testUsers(s).fail(errors.New("pq: connection reset by peer"))
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"malformed JSON", `{"username":`, http.StatusBadRequest, codeBadRequest},
+		{"missing password", `{"username":"admin"}`, http.StatusBadRequest, codeValidation},
+		{"oversized body", `{"username":"` + strings.Repeat("a", maxSmallBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"DB failure", `{"username":"admin","password":"x"}`, http.StatusInternalServerError, codeInternal},
+	}
+	for _, tt := range tests {
+		w := postLogin(s, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, w.Code)
+		}
+		if got := decodeError(t, w); got.Code != tt.code {
+			t.Errorf("%s: expected code %q, got %+v", tt.name, tt.code, got)
+		}
+		if strings.Contains(w.Body.String(), "pq:") {
+			t.Errorf("%s: response leaks the driver error: %s", tt.name, w.Body)
+		}
+	}
+}
+
+func TestHandlers_SetJSONContentType(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for _, path := range []string{"/", "/livez"} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected JSON content type, got %q", path, ct)
+		}
+	}
+}
+
+func TestWriteEndpoints_RejectNonJSONContentType(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	tests := []struct {
+		method, path, contentType string
+	}{
+		{http.MethodPost, "/login", "text/plain"},
+		{http.MethodPost, "/register", ""},
+		{http.MethodPost, "/products", "application/x-www-form-urlencoded"},
+		{http.MethodPut, "/products/1", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		req := asAdmin(httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"name":"x"}`)))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s %s with %q: expected 415, got %d", tt.method, tt.path, tt.contentType, w.Code)
+		}
+		if got := decodeError(t, w); got.Code != codeUnsupportedMedia {
+			t.Errorf("%s %s: expected code %q, got %+v", tt.method, tt.path, codeUnsupportedMedia, got)
+		}
+	}
+}
+
+func TestDecodeJSON_AcceptsContentTypeParameters(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"admin"}`))
+	req.Header.Set("Content-Type", "Application/JSON; charset=utf-8")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	// The body is decoded and fails validation instead of the media type check.
+	if got := decodeError(t, w); w.Code != http.StatusBadRequest || got.Code != codeValidation {
+		t.Errorf("expected 400 %q, got %d %+v", codeValidation, w.Code, got)
+	}
+}
+
+func TestCreateProductHandler_EnforcesConfiguredBodyLimit(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.MaxBodyBytes = 64
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"oversized body", `{"name":"` + strings.Repeat("x", 64) + `","price":1}`, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"malformed body", `{"name":`, http.StatusBadRequest, codeBadRequest},
+	}
+	for _, tt := range tests {
+		w := postProduct(s, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, w.Code)
+		}
+		if got := decodeError(t, w); got.Code != tt.code {
+			t.Errorf("%s: expected code %q, got %+v", tt.name, tt.code, got)
+		}
+	}
+
+	// A body with no declared length is cut off while reading.
+	req := asAdmin(httptest.NewRequest(http.MethodPost, "/products", io.MultiReader(strings.NewReader(`{"name":"`), strings.NewReader(strings.Repeat("x", 128)+`"}`))))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if got := decodeError(t, w); w.Code != http.StatusRequestEntityTooLarge || got.Code != codeBodyTooLarge {
+		t.Errorf("chunked body: expected 413 %q, got %d %+v", codeBodyTooLarge, w.Code, got)
+	}
+}
+
+func TestWriteDBError_MapsPostgresErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		err           error
+		cancel        bool
+		wantStatus    int
+		wantCode      string
+		wantRetryable bool
+	}{
+		{"unique violation", &pq.Error{Code: "23505"}, false, http.StatusConflict, codeConflict, false},
+		{"foreign key violation", &pq.Error{Code: "23503"}, false, http.StatusUnprocessableEntity, codeInvalidReference, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, false, http.StatusConflict, codeConflict, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, false, http.StatusConflict, codeConflict, true},
+		{"statement timeout", &pq.Error{Code: "57014"}, false, http.StatusGatewayTimeout, codeDBTimeout, false},
+		{"client went away", context.Canceled, true, statusClientClosedRequest, codeCanceled, false},
+		{"undefined table", &pq.Error{Code: "42P01"}, false, http.StatusInternalServerError, codeDBError, false},
+		{"other", &pq.Error{Code: "53300", Message: "too many connections"}, false, http.StatusInternalServerError, codeDBError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s, mockSQL, _ := newTestServer(t)
+			usePostgresStores(s)
+			mockSQL.ExpectQuery(selectProducts + " WHERE p.id").WillReturnError(tt.err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			req := httptest.NewRequest(http.MethodGet, "/products/1", nil).WithContext(ctx)
+			req.SetPathValue("id", "1")
+			w := httptest.NewRecorder()
+			s.productHandler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body)
+			}
+			if got := decodeError(t, w); got.Code != tt.wantCode || got.Retryable != tt.wantRetryable {
+				t.Errorf("expected code %q retryable %t, got %+v", tt.wantCode, tt.wantRetryable, got)
+			}
+			if strings.Contains(w.Body.String(), "pq:") {
+				t.Errorf("response leaks the driver error: %s", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// responseCacheHeaders are the response headers stored and replayed along
+// with a cached body. The middleware around the cache sets the others again
+// on every request.
+var responseCacheHeaders = []string{
+	"Content-Type", "ETag", "Last-Modified", "Cache-Control", "Vary",
+	"Deprecation", "Sunset", "Link",
+}
+
+// cachedResponse is a response stored by withResponseCache.
+type cachedResponse struct {
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"header,omitempty"`
+	Body   []byte              `json:"body,omitempty"`
+}
+
+// write replays the response to r, answering 304 instead when r's
+// If-None-Match names its ETag.
+func (c *cachedResponse) write(w http.ResponseWriter, r *http.Request) {
+	for h, v := range c.Header {
+		w.Header()[h] = v
+	}
+	w.Header().Set("X-Cache", "HIT")
+	if etag := w.Header().Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(c.Status)
+	_, _ = w.Write(c.Body)
+}
+
+// withResponseCache serves the GET routes in ResponseCacheRoutes from
+// Redis for ResponseCacheTTL, marking each response X-Cache: HIT or MISS.
+// Responses are stored under a hash of the path, query, Accept header and
+// Authorization header, so an authenticated caller only ever gets responses
+// made for its own credentials. Only 200 responses without Set-Cookie are
+// stored. A request with Cache-Control: no-cache skips the lookup, and its
+// response replaces the stored one. Concurrent misses for the same request
+// on a replica run the handler once and share its response. When Redis
+// fails every request is a miss.
+func (s *Server) withResponseCache(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.responseCacheable(r) {
+			handler(w, r)
+			return
+		}
+		ctx := r.Context()
+		route := s.routeLabel(r)
+		key := s.keys.response(responseCacheHash(r))
+
+		if noCache(r) {
+			s.metrics.responseCache.WithLabelValues(route, "bypass").Inc()
+			s.storeResponse(ctx, key, captureResponse(w, r, handler))
+			return
+		}
+		if cached, ok := s.loadResponse(ctx, key); ok {
+			s.metrics.responseCache.WithLabelValues(route, "hit").Inc()
+			cached.write(w, r)
+			return
+		}
+
+		var ran bool
+		v, _, _ := s.responseFlight.Do(key, func() (any, error) {
+			ran = true
+			resp := captureResponse(w, r, handler)
+			s.storeResponse(ctx, key, resp)
+			return resp, nil
+		})
+		if ran {
+			s.metrics.responseCache.WithLabelValues(route, "miss").Inc()
+			return
+		}
+		if resp := v.(*cachedResponse); resp != nil {
+			s.metrics.responseCache.WithLabelValues(route, "shared").Inc()
+			resp.write(w, r)
+			return
+		}
+		// What the other request got could not be cached, so it is not
+		// shared either.
+		s.metrics.responseCache.WithLabelValues(route, "miss").Inc()
+		captureResponse(w, r, handler)
+	}
+}
+
+// responseCacheable reports whether r is a GET of one of the
+// ResponseCacheRoutes.
+func (s *Server) responseCacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet || s.cfg.ResponseCacheTTL <= 0 || s.isStream(r) {
+		return false
+	}
+	route, ok := s.apiPaths[r.Pattern]
+	return ok && slices.Contains(s.cfg.ResponseCacheRoutes, route)
+}
+
+// responseCacheHash identifies the responses r may share. The credentials
+// are hashed with the rest, so they are never stored.
+func responseCacheHash(r *http.Request) string {
+	h := sha256.New()
+	for _, part := range []string{r.URL.Path, r.URL.RawQuery, r.Header.Get("Accept"), r.Header.Get("Authorization")} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// noCache reports whether the client asked for a response fresh from the
+// origin, with Cache-Control: no-cache or no-store, or Pragma: no-cache.
+func noCache(r *http.Request) bool {
+	for _, v := range r.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-cache", "no-store":
+				return true
+			}
+		}
+	}
+	return strings.EqualFold(r.Header.Get("Pragma"), "no-cache")
+}
+
+// captureResponse runs handler, marked X-Cache: MISS, and returns its
+// response if it may be cached, or nil.
+func captureResponse(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) *cachedResponse {
+	w.Header().Set("X-Cache", "MISS")
+	rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+	handler(rec, r)
+
+	if rec.status != http.StatusOK || rec.Header().Get("Set-Cookie") != "" || r.Context().Err() != nil {
+		return nil
+	}
+	resp := &cachedResponse{Status: rec.status, Header: make(map[string][]string), Body: rec.body.Bytes()}
+	for _, h := range responseCacheHeaders {
+		if v := rec.Header().Values(h); len(v) > 0 {
+			resp.Header[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+	return resp
+}
+
+func (s *Server) loadResponse(ctx context.Context, key string) (*cachedResponse, bool) {
+	raw, err := s.rdb.Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			s.logger.WarnContext(ctx, "Response cache read failed", "err", err)
+		}
+		return nil, false
+	}
+	var resp cachedResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		s.logger.WarnContext(ctx, "Corrupt cached response", "key", key, "err", err)
+		return nil, false
+	}
+	return &resp, true
+}
+
+// storeResponse caches resp, unless it is nil. The write is not cut short
+// by the client going away.
+func (s *Server) storeResponse(ctx context.Context, key string, resp *cachedResponse) {
+	if resp == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	body, err := json.Marshal(resp)
+	if err == nil {
+		err = s.rdb.Set(ctx, key, string(body), s.cacheTTL(s.cfg.ResponseCacheTTL)).Err()
+	}
+	if err != nil {
+		s.logger.WarnContext(ctx, "Response cache write failed", "err", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newResponseCacheServer returns a test server caching GET /version.
+func newResponseCacheServer(t *testing.T) (*Server, redismock.ClientMock) {
+	t.Helper()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ResponseCacheRoutes = []string{"/version"}
+	s.cfg.ResponseCacheTTL = time.Minute
+	s.Handler()
+	return s, redisMock
+}
+
+// cachedGet serves a GET /version through withResponseCache and handler.
+func cachedGet(s *Server, handler http.HandlerFunc, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/version?x=1", nil)
+	req.Pattern = "GET /version"
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.withResponseCache(handler)(w, req)
+	return w
+}
+
+// countingHandler answers 200 with body and counts its calls.
+func countingHandler(calls *int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Internal", "not replayed")
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func responseKey(header http.Header) string {
+	req := httptest.NewRequest(http.MethodGet, "/version?x=1", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return testKeys.response(responseCacheHash(req))
+}
+
+func TestResponseCache_MissThenHit(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResponseCacheServer(t)
+	var calls int
+	handler := countingHandler(&calls, `{"version":"1"}`)
+	key := responseKey(nil)
+
+	redisMock.ExpectGet(key).RedisNil()
+	redisMock.Regexp().ExpectSet(key, `"status":200`, time.Minute).SetVal("OK")
+	w := cachedGet(s, handler, nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" || w.Body.String() != `{"version":"1"}` {
+		t.Fatalf("expected a MISS served by the handler, got %d %q %s", w.Code, w.Header().Get("X-Cache"), w.Body)
+	}
+
+	redisMock.ExpectGet(key).SetVal(`{"status":200,"header":{"Content-Type":["application/json"]},"body":"eyJ2ZXJzaW9uIjoiMSJ9"}`)
+	w = cachedGet(s, handler, nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "HIT" || w.Body.String() != `{"version":"1"}` {
+		t.Fatalf("expected a HIT, got %d %q %s", w.Code, w.Header().Get("X-Cache"), w.Body)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || w.Header().Get("X-Internal") != "" {
+		t.Errorf("expected only the stored headers replayed, got %v", w.Header())
+	}
+	if calls != 1 {
+		t.Errorf("expected the handler to run once, ran %d times", calls)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	for result, want := range map[string]float64{"miss": 1, "hit": 1} {
+		if got := testutil.ToFloat64(s.metrics.responseCache.WithLabelValues("/version", result)); got != want {
+			t.Errorf("%s: counted %v, want %v", result, got, want)
+		}
+	}
+}
+
+func TestResponseCache_HitAnswers304ForMatchingETag(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResponseCacheServer(t)
+	header := http.Header{"If-None-Match": {`"abc"`}}
+
+	redisMock.ExpectGet(responseKey(header)).SetVal(`{"status":200,"header":{"Etag":["\"abc\""]},"body":"e30="}`)
+	w := cachedGet(s, func(http.ResponseWriter, *http.Request) { t.Error("handler called on a hit") }, header)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected 304 with no body, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestResponseCache_NoCacheBypassesLookup(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResponseCacheServer(t)
+	var calls int
+	header := http.Header{"Cache-Control": {"max-age=0, no-cache"}}
+
+	// No GET: the stored response is replaced without being read.
+	redisMock.Regexp().ExpectSet(responseKey(header), `"status":200`, time.Minute).SetVal("OK")
+	w := cachedGet(s, countingHandler(&calls, `{}`), header)
+	if calls != 1 || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected the handler to run, got %d calls and X-Cache %q", calls, w.Header().Get("X-Cache"))
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(s.metrics.responseCache.WithLabelValues("/version", "bypass")); got != 1 {
+		t.Errorf("expected a bypass counted, got %v", got)
+	}
+}
+
+func TestResponseCache_IsolatesUsers(t *testing.T) {
+	t.Parallel()
+	alice := http.Header{"Authorization": {"Bearer alice-token"}}
+	bob := http.Header{"Authorization": {"Bearer bob-token"}}
+	keys := map[string]bool{responseKey(nil): true, responseKey(alice): true, responseKey(bob): true}
+	if len(keys) != 3 {
+		t.Fatalf("expected a key per caller, got %v", keys)
+	}
+	if responseKey(alice) != responseKey(http.Header{"Authorization": {"Bearer alice-token"}}) {
+		t.Error("expected the same caller to get the same key")
+	}
+
+	s, redisMock := newResponseCacheServer(t)
+	var calls int
+	redisMock.ExpectGet(responseKey(alice)).SetVal(`{"status":200,"body":"ImFsaWNlIg=="}`)
+	redisMock.ExpectGet(responseKey(bob)).RedisNil()
+	redisMock.Regexp().ExpectSet(responseKey(bob), `.*`, time.Minute).SetVal("OK")
+	if w := cachedGet(s, countingHandler(&calls, `"bob"`), alice); w.Body.String() != `"alice"` {
+		t.Errorf("expected alice's cached response, got %s", w.Body)
+	}
+	if w := cachedGet(s, countingHandler(&calls, `"bob"`), bob); w.Body.String() != `"bob"` || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected bob to miss alice's entry, got %s", w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseCache_RefusesUncacheableResponses(t *testing.T) {
+	t.Parallel()
+	handlers := map[string]http.HandlerFunc{
+		"500": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "boom", http.StatusInternalServerError)
+		},
+		"404": func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		},
+		"Set-Cookie": func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+			_, _ = w.Write([]byte(`{}`))
+		},
+	}
+	for name, handler := range handlers {
+		s, redisMock := newResponseCacheServer(t)
+		// Only the lookup is expected: the mock fails any SET.
+		redisMock.ExpectGet(responseKey(nil)).RedisNil()
+		w := cachedGet(s, handler, nil)
+		if w.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("%s: expected X-Cache MISS, got %q", name, w.Header().Get("X-Cache"))
+		}
+		if err := redisMock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestResponseCache_RedisFailureIsAMiss(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newResponseCacheServer(t)
+	var calls int
+
+	redisMock.ExpectGet(responseKey(nil)).SetErr(errors.New("connection refused"))
+	redisMock.Regexp().ExpectSet(responseKey(nil), `.*`, time.Minute).SetErr(errors.New("connection refused"))
+	if w := cachedGet(s, countingHandler(&calls, `{}`), nil); w.Code != http.StatusOK || calls != 1 {
+		t.Errorf("expected the handler to serve the request, got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestResponseCache_OnlyConfiguredRoutes(t *testing.T) {
+	t.Parallel()
+	s, _ := newResponseCacheServer(t)
+	var calls int
+
+	// No Redis call is expected for a route outside RESPONSE_CACHE_ROUTES,
+	// nor for a method other than GET.
+	req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+	req.Pattern = "GET /docs"
+	w := httptest.NewRecorder()
+	s.withResponseCache(countingHandler(&calls, `{}`))(w, req)
+
+	req = httptest.NewRequest(http.MethodHead, "/version", nil)
+	req.Pattern = "GET /version"
+	s.withResponseCache(countingHandler(&calls, `{}`))(w, req)
+
+	if calls != 2 || w.Header().Get("X-Cache") != "" {
+		t.Errorf("expected both requests served uncached, got %d calls and X-Cache %q", calls, w.Header().Get("X-Cache"))
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Cache-Control": {"no-cache"}}, true},
+		{http.Header{"Cache-Control": {"max-age=0", "No-Store"}}, true},
+		{http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{http.Header{"Pragma": {"no-cache"}}, true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header = tt.header
+		if got := noCache(req); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// backoff describes a bounded retry policy with jittered exponential delays.
+type backoff struct {
+	// Attempts is the maximum number of calls, including the first.
+	Attempts int
+	// Timeout caps the total time spent retrying. Zero means no cap.
+	Timeout time.Duration
+	// BaseWait is the delay ceiling after the first failure; it doubles on
+	// every subsequent failure up to MaxWait.
+	BaseWait time.Duration
+	MaxWait  time.Duration
+}
+
+// delay returns the wait before retry number attempt (starting at 1). It uses
+// "full jitter": a uniform random duration between zero and the exponential
+// ceiling, so replicas restarting together don't retry in lockstep.
+func (b backoff) delay(attempt int) time.Duration {
+	ceiling := b.BaseWait
+	for i := 1; i < attempt && ceiling < b.MaxWait; i++ {
+		ceiling *= 2
+	}
+	if b.MaxWait > 0 && ceiling > b.MaxWait {
+		ceiling = b.MaxWait
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling) + 1
+}
+
+// retry calls fn until it succeeds, the attempts are exhausted, or the
+// timeout elapses, logging every failed attempt. It returns the last error.
+func (b backoff) retry(ctx context.Context, logger *slog.Logger, target string, fn func(context.Context) error) error {
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+
+	attempts := max(b.Attempts, 1)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+
+		wait := b.delay(attempt)
+		logger.Warn("Connection attempt failed",
+			"target", target, "attempt", attempt, "max_attempts", attempts,
+			"retry_in", wait.String(), "err", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		case <-time.After(wait):
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+}
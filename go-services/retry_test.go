@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffRetry_SucceedsAfterFailures(t *testing.T) {
+	t.Parallel()
+	b := backoff{Attempts: 5, BaseWait: time.Millisecond, MaxWait: 5 * time.Millisecond}
+
+	calls := 0
+	err := b.retry(context.Background(), discardLogger, "test", func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestBackoffRetry_GivesUpAfterMaxAttempts(t *testing.T) {
+	t.Parallel()
+	b := backoff{Attempts: 4, BaseWait: time.Millisecond, MaxWait: 5 * time.Millisecond}
+
+	calls := 0
+	errRefused := errors.New("connection refused")
+	err := b.retry(context.Background(), discardLogger, "test", func(context.Context) error {
+		calls++
+		return errRefused
+	})
+	if !errors.Is(err, errRefused) {
+		t.Fatalf("expected the last error to be wrapped, got %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("expected 4 calls, got %d", calls)
+	}
+}
+
+func TestBackoffRetry_StopsAtTimeout(t *testing.T) {
+	t.Parallel()
+	b := backoff{Attempts: 100, Timeout: 50 * time.Millisecond, BaseWait: 20 * time.Millisecond, MaxWait: 20 * time.Millisecond}
+
+	start := time.Now()
+	err := b.retry(context.Background(), discardLogger, "test", func(context.Context) error {
+		return errors.New("connection refused")
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry ignored the total timeout, took %v", elapsed)
+	}
+}
+
+func TestBackoffDelay_IsJitteredAndCapped(t *testing.T) {
+	t.Parallel()
+	b := backoff{BaseWait: 100 * time.Millisecond, MaxWait: time.Second}
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 50; i++ {
+		d := b.delay(10)
+		if d <= 0 || d > time.Second {
+			t.Fatalf("delay %v outside (0, 1s]", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected jittered delays, got a constant %v", seen)
+	}
+	for i := 0; i < 50; i++ {
+		if d := b.delay(1); d > 100*time.Millisecond {
+			t.Fatalf("first delay %v exceeds base wait", d)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go-service/store"
+)
+
+// adminTokenActor identifies, in audit log lines, a caller authenticated
+// with AdminAuthToken.
+const adminTokenActor = "admin-token"
+
+type adminActorKey struct{}
+
+// adminActor returns adminTokenActor if requireRole let the caller through
+// on AdminAuthToken, and "" otherwise.
+func adminActor(ctx context.Context) string {
+	actor, _ := ctx.Value(adminActorKey{}).(string)
+	return actor
+}
+
+// hasRole reports whether a user with role may act as want. Admins may do
+// whatever users may.
+func hasRole(role, want string) bool {
+	return role == want || role == store.RoleAdmin
+}
+
+// requireRole returns a middleware letting through callers signed in with
+// role, and answering 401 to callers not signed in and 403 to users without
+// the role. It is the one place roles are checked. For the admin role the
+// bearer token in AdminAuthToken is accepted too, so that the first admin
+// can be appointed.
+func (s *Server) requireRole(role string) func(http.HandlerFunc) http.HandlerFunc {
+	token := s.cfg.AdminAuthToken
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if got, ok := bearerCredentials(r); ok && role == store.RoleAdmin && token != "" && secureEqual(got, token) {
+				ctx = context.WithValue(ctx, adminActorKey{}, adminTokenActor)
+				handler(w, r.WithContext(context.WithValue(ctx, roleKey{}, store.RoleAdmin)))
+				return
+			}
+
+			userID, userRole, ok := s.authenticate(w, r)
+			if !ok {
+				return
+			}
+			if !hasRole(userRole, role) {
+				s.logger.InfoContext(ctx, "Role required", "user_id", userID, "role", userRole, "required", role)
+				s.writeError(w, http.StatusForbidden, codeForbidden, "requires the "+role+" role")
+				return
+			}
+			handler(w, r.WithContext(contextWithUser(ctx, userID, userRole)))
+		}
+	}
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+type roleResponse struct {
+	ID   int64  `json:"id"`
+	Role string `json:"role"`
+}
+
+// setRoleHandler answers PUT /admin/users/{id}/role. Demoting the last
+// admin is refused with 409. The user's sessions are revoked so that the
+// new role applies from their next login; a JWT keeps the role it was
+// issued with until it expires. It is only served on the internal listener,
+// behind requireRole.
+func (s *Server) setRoleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "user id must be a positive integer")
+		return
+	}
+	var req roleRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	var v validator
+	v.check(store.ValidRole(req.Role), "role", `must be "user" or "admin"`)
+	if err := v.err(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	err = s.users.SetRole(ctx, id, req.Role)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+		return
+	case errors.Is(err, store.ErrLastAdmin):
+		s.writeError(w, http.StatusConflict, codeConflict, "cannot demote the last admin")
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB update failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	// The role is changed either way; sessions left behind keep the old
+	// role until they expire, so the failure is logged loudly.
+	sessions, err := s.revokeSessions(ctx, id)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to revoke sessions after role change", "user_id", id, "err", err)
+	}
+
+	// Logged at warn so the change is recorded whatever the level.
+	s.logger.WarnContext(ctx, "User role changed",
+		"audit", true,
+		"actor", auditActor(ctx),
+		"remote_ip", s.clientIP(r),
+		"user_id", id,
+		"role", req.Role,
+	)
+	s.audit(r, auditRoleChanged, id, map[string]any{"role": req.Role, "sessions": sessions})
+	s.writeJSON(w, http.StatusOK, roleResponse{ID: id, Role: req.Role})
+}
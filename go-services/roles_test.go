@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-service/store"
+)
+
+func adminRequest(s *Server, method, path, auth, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestRequireRole_UnauthenticatedVsForbidden(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	s.jwt = hmacIssuer(t, "secret")
+
+	userJWT, _ := s.jwt.sign(7, store.RoleUser, time.Now())
+	adminJWT, _ := s.jwt.sign(9, store.RoleAdmin, time.Now())
+
+	tests := []struct {
+		name    string
+		auth    string
+		session string
+		want    int
+		code    string
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized, codeUnauthorized},
+		{"wrong admin token", "Bearer wrong", "", http.StatusUnauthorized, codeInvalidToken},
+		{"user session", "Bearer " + testToken, "7:user", http.StatusForbidden, codeForbidden},
+		{"session from before roles", "Bearer " + testToken, "7", http.StatusForbidden, codeForbidden},
+		{"user JWT", "Bearer " + userJWT, "", http.StatusForbidden, codeForbidden},
+		{"admin session", "Bearer " + testToken, "9:admin", http.StatusOK, ""},
+		{"admin JWT", "Bearer " + adminJWT, "", http.StatusOK, ""},
+		{"admin token", "Bearer " + testAdminToken, "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		if tt.session != "" {
+			redisMock.ExpectGet(testKeys.session(testToken)).SetVal(tt.session)
+		}
+		w := adminRequest(s, http.MethodGet, "/admin/loglevel", tt.auth, "")
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.want, w.Code, w.Body)
+			continue
+		}
+		if tt.code != "" {
+			if got := decodeError(t, w); got.Code != tt.code {
+				t.Errorf("%s: expected code %q, got %+v", tt.name, tt.code, got)
+			}
+		}
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestSetRoleHandler_PromotesAndAudits(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	testUsers(s).addWithRole(9, "root", "", store.RoleAdmin)
+	testUsers(s).add(7, "alice", "")
+
+	sessions := testKeys.userSessions(7)
+	redisMock.ExpectGet(testKeys.session(testToken)).SetVal("9:admin")
+	redisMock.ExpectSMembers(sessions).SetVal([]string{testKeys.session("old")})
+	expectUnlinkKeys(redisMock, testKeys.session("old"), sessions)
+
+	w := adminRequest(s, http.MethodPut, "/admin/users/7/role", "Bearer "+testToken, `{"role":"admin"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got roleResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (roleResponse{ID: 7, Role: store.RoleAdmin}) || testUsers(s).role(7) != store.RoleAdmin {
+		t.Errorf("expected user 7 promoted, got %+v and %q stored", got, testUsers(s).role(7))
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+
+	if n := len(s.auditQueue); n != 1 {
+		t.Fatalf("expected the change audited, got %d events", n)
+	}
+	ev := <-s.auditQueue
+	if ev.Action != auditRoleChanged || ev.Actor != "user:9" || ev.ActorRole != store.RoleAdmin || ev.UserID == nil || *ev.UserID != 7 {
+		t.Errorf("unexpected audit event %+v", ev)
+	}
+}
+
+func TestSetRoleHandler_KeepsLastAdmin(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	testUsers(s).addWithRole(9, "root", "", store.RoleAdmin)
+
+	w := adminRequest(s, http.MethodPut, "/admin/users/9/role", "Bearer "+testAdminToken, `{"role":"user"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeConflict {
+		t.Errorf("expected code %q, got %+v", codeConflict, got)
+	}
+	if testUsers(s).role(9) != store.RoleAdmin {
+		t.Error("expected the last admin kept")
+	}
+
+	// Once there is another admin the first may step down.
+	testUsers(s).addWithRole(10, "deputy", "", store.RoleAdmin)
+	redisMock.ExpectSMembers(testKeys.userSessions(9)).SetVal(nil)
+	expectUnlinkKeys(redisMock, testKeys.userSessions(9))
+
+	w = adminRequest(s, http.MethodPut, "/admin/users/9/role", "Bearer "+testAdminToken, `{"role":"user"}`)
+	if w.Code != http.StatusOK || testUsers(s).role(9) != store.RoleUser {
+		t.Errorf("expected the demotion, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestSetRoleHandler_Rejects(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	tests := []struct {
+		name, path, body string
+		want             int
+	}{
+		{"bad id", "/admin/users/x/role", `{"role":"admin"}`, http.StatusBadRequest},
+		{"unknown role", "/admin/users/7/role", `{"role":"root"}`, http.StatusBadRequest},
+		{"missing role", "/admin/users/7/role", `{}`, http.StatusBadRequest},
+		{"missing user", "/admin/users/7/role", `{"role":"admin"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := adminRequest(s, http.MethodPut, tt.path, "Bearer "+testAdminToken, tt.body); w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.want, w.Code, w.Body)
+		}
+	}
+	if len(s.auditQueue) != 0 {
+		t.Errorf("expected nothing audited, got %d events", len(s.auditQueue))
+	}
+}
+
+func TestParseSessionValue(t *testing.T) {
+	t.Parallel()
+
+	for val, want := range map[string]struct {
+		id   int64
+		role string
+		ok   bool
+	}{
+		"7":       {7, store.RoleUser, true},
+		"7:user":  {7, store.RoleUser, true},
+		"7:admin": {7, store.RoleAdmin, true},
+		"7:root":  {0, "", false},
+		"x:admin": {0, "", false},
+	} {
+		id, role, err := parseSessionValue(val)
+		if id != want.id || role != want.role || (err == nil) != want.ok {
+			t.Errorf("parseSessionValue(%q) = %d, %q, %v", val, id, role, err)
+		}
+	}
+	if v := sessionValue(7, store.RoleAdmin); v != "7:admin" {
+		t.Errorf("sessionValue = %q, want 7:admin", v)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go-service/store"
+)
+
+// route is an endpoint served by Handler. path is relative to where the
+// route is mounted: the root, BasePath or a version prefix.
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// apiVersion is a version of the API, served under BasePath + prefix.
+type apiVersion struct {
+	prefix string
+	routes []route
+}
+
+// apiVersions lists the API versions, oldest first. Adding one is a matter
+// of adding its prefix and routes here.
+func (s *Server) apiVersions() []apiVersion {
+	return []apiVersion{
+		{prefix: "/v1", routes: s.v1Routes()},
+	}
+}
+
+// legacyVersion is the version whose routes are also served without a
+// prefix, as they were before the API was versioned.
+const legacyVersion = "/v1"
+
+// healthRoutes are served at the root whatever BasePath is, where the
+// kubelet and healthcheck expect them.
+func (s *Server) healthRoutes() []route {
+	return []route{
+		{http.MethodGet, "/livez", s.livezHandler},
+		{http.MethodGet, "/readyz", s.readyzHandler},
+		{http.MethodGet, "/healthz", s.readyzHandler},
+	}
+}
+
+// siteRoutes are served under BasePath, outside any version.
+func (s *Server) siteRoutes() []route {
+	return []route{
+		{http.MethodGet, "/{$}", s.rootHandler},
+		{http.MethodGet, "/version", s.versionHandler},
+		{http.MethodGet, "/openapi.json", s.openAPIHandler},
+		{http.MethodGet, "/docs", s.docsHandler},
+		{http.MethodPost, "/webhooks/payments", s.paymentWebhookHandler},
+	}
+}
+
+// v1Routes are the routes of /v1. Reading the catalog is open to everyone;
+// changing it takes the admin role, like restoring and purging it on the
+// internal listener.
+func (s *Server) v1Routes() []route {
+	admin := s.requireRole(store.RoleAdmin)
+	return []route{
+		{http.MethodPost, "/login", s.loginHandler},
+		{http.MethodPost, "/register", s.registerHandler},
+		{http.MethodPost, "/password/forgot", s.forgotPasswordHandler},
+		{http.MethodPost, "/password/reset", s.resetPasswordHandler},
+		{http.MethodGet, "/me", s.requireSession(s.meHandler)},
+		{http.MethodPost, "/logout", s.logoutHandler},
+		{http.MethodGet, "/products", s.productsHandler},
+		{http.MethodPost, "/products", admin(s.withIdempotency(s.createProductHandler))},
+		{http.MethodPost, "/products:batch", admin(s.withIdempotency(s.bulkCreateProductsHandler))},
+		{http.MethodGet, "/products/top", s.topProductsHandler},
+		{http.MethodGet, "/products/search", s.searchProductsHandler},
+		{http.MethodGet, "/products/stream", s.productStreamHandler},
+		{http.MethodGet, "/products/{id}", s.productHandler},
+		{http.MethodPut, "/products/{id}", admin(s.withIdempotency(s.updateProductHandler))},
+		{http.MethodDelete, "/products/{id}", admin(s.withIdempotency(s.deleteProductHandler))},
+		{http.MethodGet, "/products/{id}/stock", s.stockHandler},
+		{http.MethodPost, "/products/{id}/reserve", s.withIdempotency(s.reserveHandler)},
+		{http.MethodGet, "/categories", s.listCategoriesHandler},
+		{http.MethodPost, "/categories", admin(s.withIdempotency(s.createCategoryHandler))},
+		{http.MethodGet, "/categories/{id}", s.categoryHandler},
+		{http.MethodPut, "/categories/{id}", admin(s.withIdempotency(s.updateCategoryHandler))},
+		{http.MethodDelete, "/categories/{id}", admin(s.withIdempotency(s.deleteCategoryHandler))},
+		{http.MethodGet, "/cart", s.cartHandler},
+		{http.MethodPost, "/cart/items", s.withIdempotency(s.putCartItemHandler)},
+		{http.MethodDelete, "/cart/items/{product_id}", s.withIdempotency(s.deleteCartItemHandler)},
+		{http.MethodPost, "/orders", s.withIdempotency(s.createOrderHandler)},
+		{http.MethodGet, "/ws", s.wsHandler},
+	}
+}
+
+// apiPath returns the path of an API resource under legacyVersion, such as
+// for a Location header.
+func (s *Server) apiPath(path string) string {
+	return s.cfg.BasePath + legacyVersion + path
+}
+
+// deprecatedRoute marks the responses of an unversioned alias as
+// deprecated, with the date it goes away (Sunset, RFC 8594) and a link to
+// the versioned route it aliases.
+func (s *Server) deprecatedRoute(h http.HandlerFunc) http.HandlerFunc {
+	sunset := s.cfg.LegacyRoutesSunset.UTC().Format(http.TimeFormat)
+	return func(w http.ResponseWriter, r *http.Request) {
+		successor := s.apiPath(strings.TrimPrefix(r.URL.Path, s.cfg.BasePath))
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", sunset)
+		w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+		h(w, r)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLegacyAlias_MatchesV1(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.LegacyRoutesSunset = time.Date(2027, 6, 30, 0, 0, 0, 0, time.UTC)
+	testProducts(s).add(testProduct(7, "Chair", 49.5, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)))
+	h := s.Handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	v1, alias := get("/v1/products/7"), get("/products/7")
+	if v1.Code != http.StatusOK || alias.Code != v1.Code || alias.Body.String() != v1.Body.String() {
+		t.Fatalf("expected identical responses, got %d %s and %d %s", v1.Code, v1.Body, alias.Code, alias.Body)
+	}
+
+	if v1.Header().Get("Deprecation") != "" || v1.Header().Get("Sunset") != "" {
+		t.Errorf("expected /v1 not to be deprecated, got %v", v1.Header())
+	}
+	if got := alias.Header().Get("Deprecation"); got != "true" {
+		t.Errorf("expected Deprecation: true, got %q", got)
+	}
+	if got := alias.Header().Get("Sunset"); got != "Wed, 30 Jun 2027 00:00:00 GMT" {
+		t.Errorf("unexpected Sunset %q", got)
+	}
+	if got := alias.Header().Get("Link"); got != `</v1/products/7>; rel="successor-version"` {
+		t.Errorf("unexpected Link %q", got)
+	}
+
+	for _, route := range []string{"/v1/products/{id}", "/products/{id}"} {
+		if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues(route, http.MethodGet, "200")); got != 1 {
+			t.Errorf("expected 1 request labelled %s, got %v", route, got)
+		}
+	}
+}
+
+func TestHandler_CatalogWritesRequireAdmin(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	testProducts(s).add(testProduct(7, "Chair", 49.5, time.Now()))
+	h := s.Handler()
+
+	writes := []struct{ method, path, body string }{
+		{http.MethodPost, "/v1/products", `{"name":"Desk","price":120}`},
+		{http.MethodPost, "/v1/products:batch", `[{"name":"Desk","price":120}]`},
+		{http.MethodPut, "/v1/products/7", `{"name":"Stool","price":20}`},
+		{http.MethodDelete, "/products/7", ""},
+		{http.MethodPost, "/v1/categories", `{"slug":"desks","name":"Desks"}`},
+		{http.MethodPut, "/v1/categories/1", `{"slug":"desks","name":"Desks"}`},
+		{http.MethodDelete, "/categories/1", ""},
+	}
+	for _, tt := range writes {
+		for _, caller := range []struct {
+			auth string
+			want int
+		}{{"", http.StatusUnauthorized}, {"Bearer " + testToken, http.StatusForbidden}} {
+			if caller.auth != "" {
+				redisMock.ExpectGet(testKeys.session(testToken)).SetVal("7:user")
+			}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if caller.auth != "" {
+				req.Header.Set("Authorization", caller.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != caller.want {
+				t.Errorf("%s %s as %q: expected %d, got %d: %s", tt.method, tt.path, caller.auth, caller.want, w.Code, w.Body)
+			}
+		}
+	}
+
+	if p, err := s.products.Get(context.Background(), 7); err != nil || p.Name != "Chair" {
+		t.Errorf("expected product 7 untouched, got %+v, %v", p, err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandler_BasePath(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.BasePath = "/api"
+	testProducts(s).add(testProduct(7, "Chair", 49.5, time.Now()))
+	h := s.Handler()
+
+	tests := []struct {
+		method, path string
+		want         int
+		deprecated   bool
+	}{
+		{http.MethodGet, "/api/v1/products/7", http.StatusOK, false},
+		{http.MethodGet, "/api/products/7", http.StatusOK, true},
+		{http.MethodGet, "/api/version", http.StatusOK, false},
+		{http.MethodGet, "/livez", http.StatusOK, false},
+		{http.MethodGet, "/products/7", http.StatusNotFound, false},
+		{http.MethodPost, "/api/v1/products/top", http.StatusMethodNotAllowed, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, w.Code)
+		}
+		if got := w.Header().Get("Deprecation") != ""; got != tt.deprecated {
+			t.Errorf("%s %s: expected deprecated %v, got %v", tt.method, tt.path, tt.deprecated, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/products/7", nil))
+	if got := w.Header().Get("Link"); got != `</api/v1/products/7>; rel="successor-version"` {
+		t.Errorf("unexpected Link %q", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues("/v1/products/top", http.MethodPost, "405")); got != 1 {
+		t.Errorf("expected the 405 labelled without the base path, got %v", got)
+	}
+}
+
+func TestHandler_StreamRoutesInEveryVersion(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.Handler()
+
+	for _, pattern := range []string{"GET /v1/products/stream", "GET /products/stream", "GET /v1/ws", "GET /ws"} {
+		if !s.streams[pattern] {
+			t.Errorf("expected %s to be a stream route", pattern)
+		}
+	}
+	if s.streams["GET /v1/products/{id}"] {
+		t.Error("expected /v1/products/{id} not to be a stream route")
+	}
+}
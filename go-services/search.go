@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"go-service/store"
+)
+
+// maxSearchQueryLen is the longest search query accepted, in characters.
+const maxSearchQueryLen = 200
+
+// searchPage is the response body of GET /products/search. NextOffset is
+// null once the last page has been returned.
+type searchPage struct {
+	Items      []store.ProductMatch `json:"items"`
+	Limit      int                  `json:"limit"`
+	Offset     int                  `json:"offset"`
+	NextOffset *int                 `json:"next_offset"`
+}
+
+// searchProductsHandler answers GET /products/search?q=, the products
+// matching q in name or description, most relevant first. Pages are offset
+// pages without a total, which would cost a second search; one row more
+// than the limit is fetched to tell whether another page follows.
+func (s *Server) searchProductsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	query := strings.TrimSpace(q.Get("q"))
+	switch {
+	case query == "":
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "q is required")
+		return
+	case utf8.RuneCountInString(query) > maxSearchQueryLen:
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("q must be at most %d characters", maxSearchQueryLen))
+		return
+	}
+	page, err := parsePage(q)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if page.Keyset {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "search only supports offset pagination")
+		return
+	}
+
+	matches, err := s.products.Search(ctx, store.ProductSearch{Query: query, Limit: page.Limit + 1, Offset: page.Offset})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	resp := searchPage{Items: matches, Limit: page.Limit, Offset: page.Offset}
+	if len(matches) > page.Limit {
+		resp.Items = matches[:page.Limit]
+		next := page.Offset + page.Limit
+		resp.NextOffset = &next
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
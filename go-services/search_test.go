@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go-service/store"
+)
+
+func decodeSearchPage(t *testing.T, s *Server, path string) searchPage {
+	t.Helper()
+	w := getPath(s, path)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var page searchPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestSearchProductsHandler_RanksAndPages(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	now := time.Now()
+	desk := testProduct(3, "Standing desk", 300, now)
+	desk.Description = "Pairs with an ergonomic chair"
+	testProducts(s).add(
+		testProduct(1, "Oak chair", 49.5, now),
+		testProduct(2, "Ergonomic chair", 250, now),
+		desk,
+		testProduct(4, "Ergonomic keyboard", 90, now),
+	)
+
+	page := decodeSearchPage(t, s, "/v1/products/search?q="+url.QueryEscape("ergonomic chair")+"&limit=1")
+	if len(page.Items) != 1 || page.Items[0].ID != 2 || page.Items[0].Score <= 0 {
+		t.Fatalf("expected the ergonomic chair first, with a score, got %+v", page.Items)
+	}
+	if page.NextOffset == nil || *page.NextOffset != 1 {
+		t.Errorf("expected the next page at offset 1, got %v", page.NextOffset)
+	}
+
+	page = decodeSearchPage(t, s, "/v1/products/search?q="+url.QueryEscape("ergonomic chair")+"&limit=1&offset=1")
+	if len(page.Items) != 1 || page.Items[0].ID != 3 || page.NextOffset != nil {
+		t.Errorf("expected the desk on the last page, got %+v, next %v", page.Items, page.NextOffset)
+	}
+	if page.Items[0].Score >= 1 {
+		t.Errorf("expected a description match to rank below a name match, got %v", page.Items[0].Score)
+	}
+
+	searches := testProducts(s).searches
+	if len(searches) != 2 || searches[0] != (store.ProductSearch{Query: "ergonomic chair", Limit: 2}) {
+		t.Errorf("expected one row more than the limit asked for, got %+v", searches)
+	}
+}
+
+func TestSearchProductsHandler_Rejects(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for _, q := range []string{
+		"",
+		"q=",
+		"q=" + url.QueryEscape("   "),
+		"q=" + strings.Repeat("a", maxSearchQueryLen+1),
+		"q=chair&cursor=",
+		"q=chair&limit=0",
+	} {
+		w := getPath(s, "/v1/products/search?"+q)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", q, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeBadRequest {
+			t.Errorf("%q: expected code %q, got %+v", q, codeBadRequest, got)
+		}
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+
+	// The longest query accepted is counted in characters, not bytes.
+	if w := getPath(s, "/v1/products/search?q="+url.QueryEscape(strings.Repeat("é", maxSearchQueryLen))); w.Code != http.StatusOK {
+		t.Errorf("expected a %d character query accepted, got %d", maxSearchQueryLen, w.Code)
+	}
+}
+
+func TestSearchProductsHandler_StoreFailure(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	testProducts(s).fail(store.ErrTimeout)
+
+	w := getPath(s, "/v1/products/search?q=chair")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+)
+
+// withSecurityHeaders sets the configured security headers before the
+// handler runs, so they are also present on error responses written by
+// withRecovery and withTimeout. Strict-Transport-Security is only sent over
+// HTTPS. Headers listed for the route in SecurityHeaderExceptions are left
+// out.
+func (s *Server) withSecurityHeaders(handler http.HandlerFunc) http.HandlerFunc {
+	headers := []struct{ name, value string }{
+		{"X-Content-Type-Options", s.cfg.ContentTypeOptions},
+		{"X-Frame-Options", s.cfg.FrameOptions},
+		{"Referrer-Policy", s.cfg.ReferrerPolicy},
+		{"Content-Security-Policy", s.cfg.ContentSecurityPolicy},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		except := s.cfg.SecurityHeaderExceptions[s.routeLabel(r)]
+		h := w.Header()
+		for _, hdr := range headers {
+			if hdr.value != "" && !slices.Contains(except, hdr.name) {
+				h.Set(hdr.name, hdr.value)
+			}
+		}
+		if s.cfg.StrictTransportSecurity != "" && s.isHTTPS(r) && !slices.Contains(except, "Strict-Transport-Security") {
+			h.Set("Strict-Transport-Security", s.cfg.StrictTransportSecurity)
+		}
+		handler(w, r)
+	}
+}
+
+// isHTTPS reports whether the client connected over TLS, either to us or to
+// a trusted proxy that says so in X-Forwarded-Proto.
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	peer, err := netip.ParseAddr(remoteHost(r))
+	return err == nil && s.trustedProxy(peer) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newSecurityTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, _, _ := newTestServer(t)
+	s.cfg.ContentTypeOptions = "nosniff"
+	s.cfg.FrameOptions = "DENY"
+	s.cfg.ReferrerPolicy = defaultReferrerPolicy
+	s.cfg.ContentSecurityPolicy = "default-src 'none'"
+	s.cfg.StrictTransportSecurity = defaultHSTS
+	return s
+}
+
+func assertSecurityHeaders(t *testing.T, name string, h http.Header) {
+	t.Helper()
+	want := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         defaultReferrerPolicy,
+		"Content-Security-Policy": "default-src 'none'",
+	}
+	for k, v := range want {
+		if got := h.Get(k); got != v {
+			t.Errorf("%s: %s = %q, want %q", name, k, got, v)
+		}
+	}
+}
+
+func TestSecurityHeaders_OnResponses(t *testing.T) {
+	t.Parallel()
+	s := newSecurityTestServer(t)
+
+	testProducts(s).add(testProduct(1, "Widget", 9.99, time.Now()))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from /products, got %d: %s", w.Code, w.Body)
+	}
+	assertSecurityHeaders(t, "/products", w.Header())
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("expected no HSTS over plain HTTP, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	assertSecurityHeaders(t, "404", w.Header())
+}
+
+func TestSecurityHeaders_OnRecoveredPanic(t *testing.T) {
+	t.Parallel()
+	s := newSecurityTestServer(t)
+	s.cfg.RequestTimeout = time.Second
+
+	h := s.withSecurityHeaders(s.withRecovery(s.withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	assertSecurityHeaders(t, "panic", w.Header())
+}
+
+func TestSecurityHeaders_HSTSOnlyOverHTTPS(t *testing.T) {
+	t.Parallel()
+	s := newSecurityTestServer(t)
+	s.cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name   string
+		remote string
+		tls    bool
+		proto  string
+		want   bool
+	}{
+		{"plain HTTP", "192.0.2.1:1234", false, "", false},
+		{"direct TLS", "192.0.2.1:1234", true, "", true},
+		{"TLS at a trusted proxy", "10.0.0.5:1234", false, "https", true},
+		{"spoofed proto from client", "192.0.2.1:1234", false, "https", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		if got := w.Header().Get("Strict-Transport-Security") != ""; got != tt.want {
+			t.Errorf("%s: HSTS sent = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSecurityHeaders_RouteExceptions(t *testing.T) {
+	t.Parallel()
+	s := newSecurityTestServer(t)
+	s.cfg.SecurityHeaderExceptions = map[string][]string{"/": {"X-Frame-Options", "Content-Security-Policy"}}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := w.Header().Get("X-Frame-Options"); got != "" {
+		t.Errorf("expected X-Frame-Options to be omitted, got %q", got)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "" {
+		t.Errorf("expected Content-Security-Policy to be omitted, got %q", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("expected other headers to remain, got X-Content-Type-Options %q", got)
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"go-service/flags"
+	"go-service/httpclient"
+	"go-service/publish"
+	"go-service/store"
+)
+
+// Server holds the dependencies shared by the HTTP handlers.
+type Server struct {
+	cfg     Config
+	db      *sql.DB
+	rdb     redisClient
+	logger  *slog.Logger
+	metrics *metrics
+	tracer  trace.Tracer
+	// logLevel adjusts logger's level at runtime.
+	logLevel *logLevelControl
+
+	// live is the configuration in effect once reload has run; see
+	// settings. loadConfig reads it again, and reloadMu keeps reloads from
+	// overlapping.
+	live       atomic.Pointer[Config]
+	loadConfig func() (Config, error)
+	reloadMu   sync.Mutex
+	// replica is the read replica pool, or nil without one.
+	replica *store.Replica
+	// products, categories, users and orders are the data stores the
+	// handlers use; db and replica are kept for health checks and pool
+	// metrics.
+	products   store.ProductStore
+	categories store.CategoryStore
+	users      store.UserStore
+	orders     store.OrderStore
+	// stock seeds the Redis stock counters and takes their write-back.
+	stock store.StockStore
+	// audits keeps the audit log, written by runAuditWriter from
+	// auditQueue.
+	audits     store.AuditStore
+	auditQueue chan store.AuditEvent
+	// publisher sends product changes to EVENTS_PUBLISHER, or is nil when
+	// that is off; outbox keeps those it failed to send.
+	publisher publish.Publisher
+	outbox    store.OutboxStore
+	// webhookSubs are the partners notified of product changes; their
+	// deliveries wait in deliveries for runWebhookDeliveries, which sends
+	// them with webhookClient.
+	webhookSubs   store.WebhookStore
+	deliveries    deliveryQueue
+	webhookClient *httpclient.Client
+	// outbound is the client for calls to other services.
+	outbound *httpclient.Client
+	// notifier sends the password reset mails queued on resetMails by
+	// runResetMailer; it sends nothing without SMTP_ADDR.
+	notifier   Notifier
+	resetMails chan resetMail
+
+	// jwt issues and verifies JWT access tokens; nil when logins use
+	// Redis sessions only.
+	jwt *jwtIssuer
+	// build describes the running binary, for /version.
+	build buildInfo
+	// schemaVersion is the database migration version found at startup,
+	// for /version.
+	schemaVersion int64
+	// keys names every Redis key, under REDIS_KEY_PREFIX.
+	keys redisKeys
+	// cacheCodec encodes the product payloads stored in Redis.
+	cacheCodec cacheCodec
+	// flags are the feature flags, read from Redis.
+	flags *flags.Flags
+	// responseFlight runs concurrent misses of withResponseCache once.
+	responseFlight singleflight.Group
+	// maintenance caches the maintenance flag read from Redis.
+	maintenance maintenanceCache
+	// health shares readiness results between probes.
+	health healthState
+	// draining is set by Drain once shutdown begins.
+	draining atomic.Bool
+
+	// events fans product changes out to the open event streams.
+	events eventHub
+
+	// wsConns counts the open WebSocket connections against
+	// cfg.WSMaxConnections.
+	wsConns atomic.Int64
+
+	// reporter sends the errors queued on reports by reportError; both
+	// are nil when error reporting is off.
+	reporter    Reporter
+	reports     chan errorEvent
+	reportLimit reportLimiter
+
+	// webhooks queues payment events for runWebhookWorker; deliveries
+	// are refused while it is nil or full.
+	webhooks chan paymentEvent
+
+	// views queues product views for runViewRecorder; views are dropped
+	// while it is nil or full.
+	views chan int64
+
+	// inFlight holds a token per request being served under
+	// MaxInFlight; it is set by Handler and nil without a limit.
+	inFlight chan struct{}
+
+	// routes maps the patterns registered by Handler to their metric label.
+	// Only these labels are used, which keeps series cardinality bounded.
+	routes map[string]string
+
+	// methods maps each path registered by Handler to its methods; the
+	// other methods are answered 405.
+	methods map[string][]string
+
+	// streams holds the patterns of the streamRoutes as registered by
+	// Handler.
+	streams map[string]bool
+	// apiPaths maps the patterns registered by Handler to their route path
+	// without BasePath or version, as RATE_LIMITS names routes.
+	apiPaths map[string]string
+
+	// openAPI returns the document served at /openapi.json, loaded once.
+	openAPI func() (openAPIJSON, error)
+}
+
+// NewServer connects to PostgreSQL and Redis and returns a Server ready to
+// serve requests.
+func NewServer(cfg Config) (*Server, error) {
+	logger := slog.Default()
+
+	issuer, err := newJWTIssuer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := initDB(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	replica, err := initReplica(cfg, logger)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	rdb, err := initRedis(cfg, logger)
+	if err != nil {
+		db.Close()
+		if replica != nil {
+			replica.DB.Close()
+		}
+		return nil, err
+	}
+
+	build := readBuildInfo()
+	m := newMetrics(db, cfg.DBName)
+	m.setBuildInfo(build)
+	if replica != nil {
+		m.setReplica(replica.DB, cfg.DBName)
+	}
+
+	tracer := otel.Tracer(tracerName)
+	pg := store.Postgres{DB: db, Replica: replica, Tracer: tracer, QueryDuration: m.dbQueryDuration, Errors: m.dbErrors, Logger: logger, QueryTimeout: cfg.DBQueryTimeout}
+
+	products := store.ProductStore(store.NewPostgresProducts(pg))
+	categories := store.CategoryStore(store.NewPostgresCategories(pg))
+	users := store.UserStore(store.NewPostgresUsers(pg))
+	orders := store.OrderStore(store.NewPostgresOrders(pg))
+	stock := store.StockStore(store.NewPostgresStock(pg))
+	audits := store.AuditStore(store.NewPostgresAudit(pg))
+	outbox := store.OutboxStore(store.NewPostgresOutbox(pg))
+	webhookSubs := store.WebhookStore(store.NewPostgresWebhooks(pg))
+	if cfg.BreakerThreshold > 0 {
+		pgBreaker := newCircuitBreaker("postgres", cfg, logger, m)
+		products = breakerProducts{next: products, breaker: pgBreaker}
+		categories = breakerCategories{next: categories, breaker: pgBreaker}
+		users = breakerUsers{next: users, breaker: pgBreaker}
+		orders = breakerOrders{next: orders, breaker: pgBreaker}
+		stock = breakerStock{next: stock, breaker: pgBreaker}
+		audits = breakerAudit{next: audits, breaker: pgBreaker}
+		outbox = breakerOutbox{next: outbox, breaker: pgBreaker}
+		webhookSubs = breakerWebhooks{next: webhookSubs, breaker: pgBreaker}
+		rdb.AddHook(breakerHook{breaker: newCircuitBreaker("redis", cfg, logger, m)})
+	}
+	// Added last, so it runs closest to Redis and does not time the calls
+	// the breaker refuses.
+	rdb.AddHook(newRedisMetricsHook(m))
+
+	schemaVersion, err := store.SchemaVersion(context.Background(), db)
+	if err != nil {
+		logger.Warn("Failed to read the schema version", "err", err)
+	}
+
+	outbound := httpclient.New(httpclient.Config{Duration: m.outboundDuration})
+	reporter, err := newReporter(cfg, outbound.Client, build)
+	if err != nil {
+		db.Close()
+		if replica != nil {
+			replica.DB.Close()
+		}
+		rdb.Close()
+		return nil, err
+	}
+	var reports chan errorEvent
+	if reporter != nil {
+		reports = make(chan errorEvent, reportBuffer)
+	}
+
+	keys := redisKeys{prefix: cfg.RedisKeyPrefix}
+	return &Server{
+		cfg:        cfg,
+		db:         db,
+		replica:    replica,
+		rdb:        rdb,
+		logger:     logger,
+		logLevel:   newLogLevelControl(logLevel),
+		loadConfig: LoadConfig,
+		metrics:    m,
+		tracer:     tracer,
+		products:   products,
+		categories: categories,
+		users:      users,
+		orders:     orders,
+		stock:      stock,
+		audits:     audits,
+		publisher:  newPublisher(cfg, rdb, keys),
+		outbox:     outbox,
+		outbound:   outbound,
+		reporter:   reporter,
+		reports:    reports,
+		notifier:   newNotifier(cfg),
+		resetMails: make(chan resetMail, resetMailBuffer),
+		jwt:        issuer,
+		build:      build,
+		keys:       keys,
+		cacheCodec: newCacheCodec(cfg),
+		flags: flags.New(rdb, flags.Config{
+			Key:         keys.flags(),
+			Refresh:     cfg.FlagsRefresh,
+			Evaluations: m.flagEvaluations,
+			Logger:      logger,
+		}),
+		views:      make(chan int64, viewsBuffer),
+		webhooks:   make(chan paymentEvent, webhookBuffer),
+		auditQueue: make(chan store.AuditEvent, auditBuffer),
+
+		webhookSubs:   webhookSubs,
+		deliveries:    redisDeliveryQueue{rdb: rdb, keys: keys},
+		webhookClient: newWebhookClient(cfg, m),
+		schemaVersion: schemaVersion,
+	}, nil
+}
+
+// Handler returns the HTTP handler serving the public application routes.
+func (s *Server) Handler() http.Handler {
+	wrap := func(h http.HandlerFunc) http.HandlerFunc {
+		return s.withTracing(s.withRequestID(s.withSecurityHeaders(s.withAccessLog(s.withMetrics(s.withRateLimit(s.withInFlightLimit(s.withCompression(s.withRecovery(s.withDraining(s.withMaintenance(s.withTimeout(s.withResponseCache(h)))))))))))))
+	}
+	if s.cfg.MaxInFlight > 0 {
+		s.inFlight = make(chan struct{}, s.cfg.MaxInFlight)
+	}
+
+	s.openAPI = sync.OnceValues(s.loadOpenAPI)
+
+	mux := http.NewServeMux()
+	s.routes = make(map[string]string)
+	s.methods = make(map[string][]string)
+	s.streams = make(map[string]bool)
+	s.apiPaths = make(map[string]string)
+	labels := make(map[string]string)
+	// handle registers rt under mount. Its metric label is rt's path under
+	// version, so labels do not depend on BasePath.
+	handle := func(mount, version string, rt route) {
+		path := mount + rt.path
+		pattern := rt.method + " " + path
+		labels[path] = version + routePath(rt.path)
+		s.routes[pattern] = labels[path]
+		s.apiPaths[pattern] = routePath(rt.path)
+		s.methods[path] = append(s.methods[path], rt.method)
+		if streamRoutes[rt.path] {
+			s.streams[pattern] = true
+		}
+		mux.HandleFunc(pattern, wrap(rt.handler))
+	}
+	for _, rt := range s.healthRoutes() {
+		handle("", "", rt)
+	}
+	for _, rt := range s.siteRoutes() {
+		handle(s.cfg.BasePath, "", rt)
+	}
+	for _, v := range s.apiVersions() {
+		for _, rt := range v.routes {
+			handle(s.cfg.BasePath+v.prefix, v.prefix, rt)
+			if v.prefix == legacyVersion {
+				rt.handler = s.deprecatedRoute(rt.handler)
+				handle(s.cfg.BasePath, "", rt)
+			}
+		}
+	}
+
+	// A method-less pattern on each path catches the methods not registered
+	// above; the catch-all "/" answers everything else.
+	for path, methods := range s.methods {
+		notAllowed := wrap(s.methodNotAllowed(methods))
+		if !shadowedPath(path, s.methods) {
+			s.routes[path] = labels[path]
+			mux.HandleFunc(path, notAllowed)
+			continue
+		}
+		// A method-less pattern would conflict with the wildcard routes
+		// that also match path, so the common methods are listed instead.
+		for _, method := range fallbackMethods {
+			if slices.Contains(methods, method) || (method == http.MethodHead && slices.Contains(methods, http.MethodGet)) {
+				continue
+			}
+			pattern := method + " " + path
+			s.routes[pattern] = labels[path]
+			mux.HandleFunc(pattern, notAllowed)
+		}
+	}
+	mux.HandleFunc("/", wrap(s.notFoundHandler))
+	if s.cfg.InternalAddr == "" {
+		mux.Handle("/metrics", s.metricsHandler())
+	}
+	return s.withCORS(mux)
+}
+
+// fallbackMethods are the methods answered 405 on a path that cannot have a
+// method-less catch-all; see shadowedPath.
+var fallbackMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// shadowedPath reports whether path, a literal route such as
+// /products/top, is also matched by a wildcard route in paths such as
+// /products/{id}. ServeMux rejects a method-less pattern for such a path
+// as conflicting with the wildcard's method-specific ones.
+func shadowedPath(path string, paths map[string][]string) bool {
+	if strings.Contains(path, "{") {
+		return false
+	}
+	segments := strings.Split(path, "/")
+	for other := range paths {
+		if other == path || !strings.Contains(other, "{") {
+			continue
+		}
+		otherSegments := strings.Split(other, "/")
+		if len(otherSegments) != len(segments) {
+			continue
+		}
+		matches := true
+		for i, seg := range otherSegments {
+			if seg != segments[i] && !strings.HasPrefix(seg, "{") {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// InternalHandler returns the HTTP handler for the internal listener, which
+// exposes operational and admin endpoints (metrics, session revocation,
+// maintenance mode, the log level, configuration reload, the audit log,
+// feature flags, webhook subscriptions, the cache, deleted products and,
+// when enabled, pprof and expvar) that must not be reachable from the
+// public ingress.
+//
+// Importing net/http/pprof and expvar registers their handlers on
+// http.DefaultServeMux as a side effect; every listener is given an explicit
+// mux so that those registrations are never served.
+func (s *Server) InternalHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metricsHandler())
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	admin := s.requireRole(store.RoleAdmin)
+	mux.HandleFunc("POST /admin/sessions/revoke", admin(s.revokeSessionsHandler))
+	mux.HandleFunc("POST /admin/maintenance", admin(s.maintenanceHandler))
+	mux.HandleFunc("GET /admin/loglevel", admin(s.getLogLevelHandler))
+	mux.HandleFunc("PUT /admin/loglevel", admin(s.putLogLevelHandler))
+	mux.HandleFunc("POST /admin/reload", admin(s.reloadHandler))
+	mux.HandleFunc("GET /admin/audit", admin(s.auditHandler))
+	mux.HandleFunc("GET /admin/flags/{name}", admin(s.getFlagHandler))
+	mux.HandleFunc("PUT /admin/flags/{name}", admin(s.putFlagHandler))
+	mux.HandleFunc("GET /admin/webhooks", admin(s.listWebhooksHandler))
+	mux.HandleFunc("POST /admin/webhooks", admin(s.createWebhookHandler))
+	mux.HandleFunc("GET /admin/webhooks/{id}", admin(s.getWebhookHandler))
+	mux.HandleFunc("PUT /admin/webhooks/{id}", admin(s.updateWebhookHandler))
+	mux.HandleFunc("DELETE /admin/webhooks/{id}", admin(s.deleteWebhookHandler))
+	mux.HandleFunc("GET /admin/webhooks/dead-letters", admin(s.deadLettersHandler))
+	mux.HandleFunc("DELETE /admin/cache/products", admin(s.purgeProductsCacheHandler))
+	mux.HandleFunc("DELETE /admin/cache/products/{id}", admin(s.purgeProductCacheHandler))
+	mux.HandleFunc("GET /admin/cache/stats", admin(s.cacheStatsHandler))
+	mux.HandleFunc("GET /admin/products", admin(s.adminProductsHandler))
+	mux.HandleFunc("POST /admin/products/{id}/restore", admin(s.restoreProductHandler))
+	mux.HandleFunc("PUT /admin/users/{id}/role", admin(s.setRoleHandler))
+	if s.cfg.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	return mux
+}
+
+// Close releases the database and Redis connections.
+func (s *Server) Close() error {
+	err := errors.Join(s.db.Close(), s.rdb.Close())
+	if s.publisher != nil {
+		err = errors.Join(err, s.publisher.Close())
+	}
+	if s.replica != nil {
+		err = errors.Join(err, s.replica.DB.Close())
+	}
+	return err
+}
+
+// openDB opens a pool for dsn sized by cfg.
+func openDB(cfg Config, dsn string) (*sql.DB, error) {
+	db, err := otelsql.Open("postgres", dsn, dbTracingOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	return db, nil
+}
+
+func initDB(cfg Config, logger *slog.Logger) (*sql.DB, error) {
+	db, err := openDB(cfg, postgresDSN(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("connect to DB: %w", err)
+	}
+	err = cfg.DBConnect.retry(context.Background(), logger, "postgres", db.PingContext)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping DB: %w", err)
+	}
+
+	if !cfg.MigrationsDisabled {
+		version, err := store.Migrate(context.Background(), db, logger)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("migrate DB: %w", err)
+		}
+		logger.Info("Database schema is up to date", "version", version)
+	}
+
+	logger.Info("Connected to PostgreSQL")
+	return db, nil
+}
+
+// initReplica opens the read replica pool, or returns nil if none is
+// configured. A replica that is down at startup is not an error: reads go to
+// the primary until it answers.
+func initReplica(cfg Config, logger *slog.Logger) (*store.Replica, error) {
+	if cfg.DBReplicaHost == "" {
+		return nil, nil
+	}
+	db, err := openDB(cfg, replicaDSN(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("connect to DB replica: %w", err)
+	}
+	replica := store.NewReplica(db, cfg.DBReplicaRetryInterval)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHealthTimeout)
+	defer cancel()
+	if err := replica.Ping(ctx); err != nil {
+		logger.Warn("PostgreSQL replica is unreachable, reading from the primary", "host", cfg.DBReplicaHost, "err", err)
+	} else {
+		logger.Info("Connected to PostgreSQL replica", "host", cfg.DBReplicaHost)
+	}
+	return replica, nil
+}
+
+func initRedis(cfg Config, logger *slog.Logger) (redisClient, error) {
+	rdb, err := newRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := instrumentRedis(rdb); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("instrument Redis: %w", err)
+	}
+
+	ping := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		return rdb.Ping(ctx).Err()
+	}
+	if err := cfg.RedisConnect.retry(context.Background(), logger, "redis", ping); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("connect to Redis: %w", err)
+	}
+	logger.Info("Connected to Redis", "mode", cfg.RedisMode)
+	return rdb, nil
+}
+
+// dbTracingOptions configures the spans otelsql starts for each driver call.
+// Every statement uses placeholders, so the recorded text never contains
+// argument values.
+func dbTracingOptions() []otelsql.Option {
+	return []otelsql.Option{
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			DisableErrSkip:       true,
+			OmitConnResetSession: true,
+			OmitRows:             true,
+		}),
+	}
+}
+
+// instrumentRedis adds tracing and metrics hooks to rdb. Commands are traced
+// without their arguments, which include session tokens.
+func instrumentRedis(rdb redis.UniversalClient, opts ...redisotel.TracingOption) error {
+	opts = append([]redisotel.TracingOption{redisotel.WithDBStatement(false)}, opts...)
+	return errors.Join(
+		redisotel.InstrumentTracing(rdb, opts...),
+		redisotel.InstrumentMetrics(rdb),
+	)
+}
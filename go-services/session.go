@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-service/store"
+)
+
+type (
+	userIDKey struct{}
+	roleKey   struct{}
+)
+
+// requireSession rejects requests without a valid bearer token and passes
+// the token's user id and role to handler through the request context.
+func (s *Server) requireSession(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, role, ok := s.authenticate(w, r)
+		if !ok {
+			return
+		}
+		handler(w, r.WithContext(contextWithUser(r.Context(), userID, role)))
+	}
+}
+
+// authenticate returns the user id and role of the request's bearer token,
+// or answers the request and returns false if there is no valid one. Opaque
+// tokens are looked up as Redis sessions; when JWTs are enabled, anything
+// else is verified as a JWT, so sessions issued before the switch keep
+// working.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (int64, string, bool) {
+	ctx := r.Context()
+
+	token, ok := bearerCredentials(r)
+	if !ok || (s.jwt == nil && !isSessionToken(token)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeError(w, http.StatusUnauthorized, codeUnauthorized, "missing or malformed bearer token")
+		return 0, "", false
+	}
+
+	if !isSessionToken(token) {
+		userID, role, err := s.jwt.verify(token)
+		if err != nil {
+			s.rejectJWT(w, r, err)
+			return 0, "", false
+		}
+		return userID, role, true
+	}
+
+	val, err := s.rdb.Get(ctx, s.keys.session(token)).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		s.writeError(w, http.StatusUnauthorized, codeInvalidToken, "session is invalid or expired")
+		return 0, "", false
+	case err != nil:
+		s.logger.ErrorContext(ctx, "Session lookup failed", "err", err)
+		s.writeInternalError(w, err)
+		return 0, "", false
+	}
+	userID, role, err := parseSessionValue(val)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Corrupt session value", "err", err)
+		s.writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return 0, "", false
+	}
+	return userID, role, true
+}
+
+// sessionValue is what the key of a session holds: the user id and the
+// role the session was issued for, joined by a colon.
+func sessionValue(userID int64, role string) string {
+	return strconv.FormatInt(userID, 10) + ":" + role
+}
+
+// parseSessionValue reads a sessionValue. Sessions stored before roles hold
+// the user id alone and act as store.RoleUser.
+func parseSessionValue(val string) (int64, string, error) {
+	id, role, ok := strings.Cut(val, ":")
+	if !ok {
+		role = store.RoleUser
+	}
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if !store.ValidRole(role) {
+		return 0, "", fmt.Errorf("unknown role %q", role)
+	}
+	return userID, role, nil
+}
+
+// rejectJWT answers a request whose JWT failed verification with err.
+func (s *Server) rejectJWT(w http.ResponseWriter, r *http.Request, err error) {
+	code, msg := codeInvalidToken, "token is invalid"
+	switch {
+	case errors.Is(err, errTokenExpired):
+		code, msg = codeTokenExpired, "token has expired"
+	case errors.Is(err, errTokenBadSignature):
+		code, msg = codeInvalidSignature, "token signature is invalid"
+	}
+	s.logger.InfoContext(r.Context(), "JWT rejected", "err", err)
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="`+msg+`"`)
+	s.writeError(w, http.StatusUnauthorized, code, msg)
+}
+
+// bearerCredentials returns the token of a Bearer Authorization header.
+func bearerCredentials(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// bearerToken extracts a session token from the Authorization header. Tokens
+// that could not have been issued by newSessionToken are rejected without a
+// Redis round trip.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := bearerCredentials(r)
+	if !ok || !isSessionToken(token) {
+		return "", false
+	}
+	return token, true
+}
+
+// isSessionToken reports whether token has the shape of a token from
+// newSessionToken.
+func isSessionToken(token string) bool {
+	if len(token) != sessionTokenBytes*2 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+func contextWithUser(ctx context.Context, id int64, role string) context.Context {
+	return context.WithValue(context.WithValue(ctx, userIDKey{}, id), roleKey{}, role)
+}
+
+// userIDFrom returns the authenticated user id stored in ctx by
+// requireSession or requireRole.
+func userIDFrom(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(userIDKey{}).(int64)
+	return id, ok
+}
+
+// roleFrom returns the role the caller acts with, stored in ctx by
+// requireSession or requireRole, or "" outside an authenticated request.
+func roleFrom(ctx context.Context) string {
+	role, _ := ctx.Value(roleKey{}).(string)
+	return role
+}
+
+type meResponse struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// meHandler returns the authenticated user. It must be registered behind
+// requireSession.
+func (s *Server) meHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, ok := userIDFrom(ctx)
+	if !ok {
+		s.writeError(w, http.StatusUnauthorized, codeUnauthorized, "authentication required")
+		return
+	}
+
+	username, err := s.users.Username(ctx, userID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, meResponse{ID: userID, Username: username})
+}
+
+// storeSession records token as a session of userID acting as role for
+// SessionTTL, and adds it to the user's session set. The set's TTL is pushed
+// out with each login so it outlives every session it lists.
+func (s *Server) storeSession(ctx context.Context, token string, userID int64, role string) error {
+	key := s.keys.session(token)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, sessionValue(userID, role), s.cfg.SessionTTL)
+		pipe.SAdd(ctx, s.keys.userSessions(userID), key)
+		pipe.Expire(ctx, s.keys.userSessions(userID), s.cfg.SessionTTL)
+		return nil
+	})
+	return err
+}
+
+// logoutHandler revokes the caller's session. It is not behind
+// requireSession so that logging out twice, or after the session expired,
+// still succeeds.
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeError(w, http.StatusUnauthorized, codeUnauthorized, "missing or malformed bearer token")
+		return
+	}
+
+	key := s.keys.session(token)
+	val, err := s.rdb.GetDel(ctx, key).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case err != nil:
+		s.logger.ErrorContext(ctx, "Failed to revoke session", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+
+	// The session is already gone; a stale entry in the user's set is
+	// harmless, so a failure here is only logged.
+	if userID, _, err := parseSessionValue(val); err == nil {
+		if err := s.rdb.SRem(ctx, s.keys.userSessions(userID), key).Err(); err != nil {
+			s.logger.WarnContext(ctx, "Failed to remove session from user set", "user_id", userID, "err", err)
+		}
+		s.logger.InfoContext(ctx, "Logged out", "user_id", userID)
+		s.audit(r, auditLogout, userID, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type revokeSessionsRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+// revokeSessionsHandler deletes every session of a user. It is only served
+// on the internal listener, behind requireRole.
+func (s *Server) revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req revokeSessionsRequest
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &req) {
+		return
+	}
+	if req.UserID < 1 {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "user_id must be a positive integer")
+		return
+	}
+
+	n, err := s.revokeSessions(ctx, req.UserID)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to revoke sessions", "user_id", req.UserID, "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+
+	s.logger.InfoContext(ctx, "Revoked sessions", "user_id", req.UserID, "sessions", n)
+	s.audit(r, auditSessionsRevoked, req.UserID, map[string]any{"sessions": n})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeSessions deletes every session of userID and returns how many
+// there were.
+func (s *Server) revokeSessions(ctx context.Context, userID int64) (int, error) {
+	return s.deleteKeySet(ctx, s.keys.userSessions(userID))
+}
+
+// deleteKeySet deletes the keys listed in the set at setKey, and the set,
+// returning how many keys it listed.
+func (s *Server) deleteKeySet(ctx context.Context, setKey string) (int, error) {
+	keys, err := s.rdb.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	_, err = unlinkKeys(ctx, s.rdb, append(keys, setKey)...)
+	return len(keys), err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testToken = strings.Repeat("ab", sessionTokenBytes)
+
+func getMe(s *Server, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestMe_ValidSession(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	redisMock.ExpectGet(testKeys.session(testToken)).SetVal("7")
+	testUsers(s).add(7, "admin", "")
+
+	w := getMe(s, "Bearer "+testToken)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got meResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got.ID != 7 || got.Username != "admin" {
+		t.Errorf("unexpected user %+v", got)
+	}
+}
+
+func TestMe_RejectsUnauthenticated(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		header string
+		// session is the Redis lookup expected, if the header gets that far.
+		session bool
+		code    string
+	}{
+		{"missing header", "", false, codeUnauthorized},
+		{"wrong scheme", "Basic " + testToken, false, codeUnauthorized},
+		{"no token", "Bearer", false, codeUnauthorized},
+		{"short token", "Bearer abc123", false, codeUnauthorized},
+		{"non-hex token", "Bearer " + strings.Repeat("zz", sessionTokenBytes), false, codeUnauthorized},
+		{"expired session", "Bearer " + testToken, true, codeInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s, _, redisMock := newTestServer(t)
+			if tt.session {
+				redisMock.ExpectGet(testKeys.session(testToken)).RedisNil()
+			}
+
+			w := getMe(s, tt.header)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d", w.Code)
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected a WWW-Authenticate challenge")
+			}
+			if got := decodeError(t, w); got.Code != tt.code {
+				t.Errorf("expected code %q, got %+v", tt.code, got)
+			}
+			if err := redisMock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unexpected redis access: %v", err)
+			}
+			if n := testUsers(s).callCount(); n != 0 {
+				t.Errorf("expected no store access, got %d calls", n)
+			}
+		})
+	}
+}
+
+func TestRequireSession_InjectsUserID(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	redisMock.ExpectGet(testKeys.session(testToken)).SetVal("42")
+
+	var got int64
+	handler := s.requireSession(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = userIDFrom(r.Context())
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "bearer "+testToken)
+	handler(httptest.NewRecorder(), req)
+
+	if got != 42 {
+		t.Errorf("expected user id 42 in context, got %d", got)
+	}
+}
+
+func postLogout(s *Server, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", authorization)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestLogout_RevokedTokenIsRejected(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	key := testKeys.session(testToken)
+	redisMock.ExpectGetDel(key).SetVal("7")
+	redisMock.ExpectSRem(testKeys.userSessions(7), key).SetVal(1)
+	// Once deleted, the middleware finds nothing for the token.
+	redisMock.ExpectGet(key).RedisNil()
+
+	if w := postLogout(s, "Bearer "+testToken); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 from logout, got %d: %s", w.Code, w.Body)
+	}
+	w := getMe(s, "Bearer "+testToken)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked token to be rejected, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeInvalidToken {
+		t.Errorf("expected code %q, got %+v", codeInvalidToken, got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestLogout_IsIdempotent(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	redisMock.ExpectGetDel(testKeys.session(testToken)).RedisNil()
+
+	if w := postLogout(s, "Bearer "+testToken); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 for an already revoked session, got %d", w.Code)
+	}
+	if w := postLogout(s, "Bearer nope"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a malformed token, got %d", w.Code)
+	}
+}
+
+func TestRevokeSessions_RevokesEveryTokenOfTheUser(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	other := strings.Repeat("cd", sessionTokenBytes)
+	keys := []string{testKeys.session(testToken), testKeys.session(other)}
+	redisMock.ExpectSMembers(testKeys.userSessions(7)).SetVal(keys)
+	expectUnlinkKeys(redisMock, append(keys, testKeys.userSessions(7))...)
+	redisMock.ExpectGet(testKeys.session(other)).RedisNil()
+
+	w := adminRequest(s, http.MethodPost, "/admin/sessions/revoke", "Bearer "+testAdminToken, `{"user_id":7}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := getMe(s, "Bearer "+other); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the revoked token to be rejected, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+}
+
+func TestRevokeSessions_RequiresAdmin(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	// A signed-in user who is not an admin may not sign others out.
+	redisMock.ExpectGet(testKeys.session(testToken)).SetVal("7:user")
+	w := adminRequest(s, http.MethodPost, "/admin/sessions/revoke", "Bearer "+testToken, `{"user_id":9}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeForbidden {
+		t.Errorf("expected code %q, got %+v", codeForbidden, got)
+	}
+	if w := adminRequest(s, http.MethodPost, "/admin/sessions/revoke", "", `{"user_id":9}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+	if len(s.auditQueue) != 0 {
+		t.Errorf("expected nothing revoked or audited, got %d events", len(s.auditQueue))
+	}
+}
+
+func TestRevokeSessions_IdempotentAndInternalOnly(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+
+	redisMock.ExpectSMembers(testKeys.userSessions(9)).SetVal(nil)
+	expectUnlinkKeys(redisMock, testKeys.userSessions(9))
+
+	w := adminRequest(s, http.MethodPost, "/admin/sessions/revoke", "Bearer "+testAdminToken, `{"user_id":9}`)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 with no sessions, got %d: %s", w.Code, w.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/sessions/revoke", strings.NewReader(`{"user_id":9}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the admin route to be absent publicly, got %d", w.Code)
+	}
+}
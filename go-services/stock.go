@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/codes"
+
+	"go-service/store"
+)
+
+// stockReconcileLock is held by the replica writing stock changes back to
+// Postgres.
+const stockReconcileLock = "stock-reconcile"
+
+// stockFlushTimeout bounds the last write-back made on shutdown.
+const stockFlushTimeout = 5 * time.Second
+
+// errOutOfStock is returned by reserveStock when the counter is below the
+// quantity asked for.
+var errOutOfStock = errors.New("out of stock")
+
+// reserveScript takes ARGV[1] off the counter KEYS[1] unless that would
+// take it below zero, and records the change in KEYS[2] for the write-back.
+// It returns the stock left, or one of the reserve results below.
+var reserveScript = redis.NewScript(`
+local stock = redis.call("GET", KEYS[1])
+if not stock then
+	return -2
+end
+local qty = tonumber(ARGV[1])
+if tonumber(stock) < qty then
+	return -1
+end
+redis.call("INCRBY", KEYS[2], -qty)
+return redis.call("DECRBY", KEYS[1], qty)`)
+
+// orderedStockScript takes ARGV[1] off the counter KEYS[1], if it is
+// seeded, for stock an order already took out of Postgres. Nothing is
+// recorded for the write-back, and the counter may go below zero when
+// reservations not yet written back took the same stock.
+var orderedStockScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("DECRBY", KEYS[1], ARGV[1])
+end
+return 0`)
+
+// Results of reserveScript other than the stock left.
+const (
+	reserveOutOfStock    = -1
+	reserveUninitialized = -2
+)
+
+type stockResponse struct {
+	ProductID int64 `json:"product_id"`
+	Stock     int64 `json:"stock"`
+}
+
+type reserveRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+type reserveResponse struct {
+	ProductID int64 `json:"product_id"`
+	Reserved  int   `json:"reserved"`
+	Stock     int64 `json:"stock"`
+}
+
+func (s *Server) stockHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := s.productID(w, r)
+	if !ok {
+		return
+	}
+	stock, err := s.stockCounter(ctx, id)
+	if err != nil {
+		s.writeStockError(w, r, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, stockResponse{ProductID: id, Stock: stock})
+}
+
+func (s *Server) reserveHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := s.productID(w, r)
+	if !ok {
+		return
+	}
+	var req reserveRequest
+	if !s.decodeJSON(w, r, int64(s.cfg.MaxBodyBytes), &req) {
+		return
+	}
+	var v validator
+	v.check(req.Quantity >= 1 && req.Quantity <= maxItemQuantity, "quantity", fmt.Sprintf("must be between 1 and %d", maxItemQuantity))
+	if err := v.err(); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	stock, err := s.reserveStock(ctx, id, req.Quantity)
+	if errors.Is(err, errOutOfStock) {
+		s.writeError(w, http.StatusConflict, codeOutOfStock, fmt.Sprintf("not enough of product %d in stock", id))
+		return
+	}
+	if err != nil {
+		s.writeStockError(w, r, err)
+		return
+	}
+	s.logger.InfoContext(ctx, "Stock reserved", "product_id", id, "quantity", req.Quantity, "stock", stock)
+	s.writeJSON(w, http.StatusOK, reserveResponse{ProductID: id, Reserved: req.Quantity, Stock: stock})
+}
+
+// writeStockError answers a request whose stock counter could not be read
+// or changed.
+func (s *Server) writeStockError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+	case errors.Is(err, store.ErrTimeout):
+		s.logger.ErrorContext(r.Context(), "Stock lookup failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+	default:
+		s.logger.ErrorContext(r.Context(), "Stock lookup failed", "err", err, "path", r.URL.Path)
+		s.writeInternalError(w, err)
+	}
+}
+
+// stockCounter returns the stock of product id as counted in Redis,
+// seeding the counter from Postgres on first use.
+func (s *Server) stockCounter(ctx context.Context, id int64) (int64, error) {
+	stock, err := s.rdb.Get(ctx, s.keys.stock(id)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return s.seedStock(ctx, id)
+	}
+	return stock, err
+}
+
+// seedStock creates the counter of product id from its stock in Postgres,
+// unless another request got there first, and returns the counter. Once
+// seeded the counter is authoritative: reservations change it first and
+// Postgres only through reconcileStock, and orders, which change Postgres
+// first, take their items off it through takeOrderedStock.
+func (s *Server) seedStock(ctx context.Context, id int64) (int64, error) {
+	stock, err := s.stock.Stock(ctx, id)
+	if err != nil {
+		return 0, fmt.Errorf("load stock: %w", err)
+	}
+	key := s.keys.stock(id)
+	created, err := s.rdb.SetNX(ctx, key, stock, 0).Result()
+	if err != nil || created {
+		return stock, err
+	}
+	return s.rdb.Get(ctx, key).Int64()
+}
+
+// reserveStock takes quantity off the counter of product id and returns
+// the stock left, or errOutOfStock if there is not enough.
+func (s *Server) reserveStock(ctx context.Context, id int64, quantity int) (int64, error) {
+	keys := []string{s.keys.stock(id), s.keys.stockPending(id)}
+	left, err := reserveScript.Run(ctx, s.rdb, keys, quantity).Int64()
+	if err == nil && left == reserveUninitialized {
+		if _, err := s.seedStock(ctx, id); err != nil {
+			return 0, err
+		}
+		left, err = reserveScript.Run(ctx, s.rdb, keys, quantity).Int64()
+	}
+	switch {
+	case err != nil:
+		return 0, err
+	case left == reserveOutOfStock:
+		return 0, errOutOfStock
+	case left == reserveUninitialized:
+		return 0, errors.New("stock counter vanished after seeding")
+	}
+
+	// The change is already recorded; should this fail, it is written back
+	// after the product's next reservation instead.
+	if err := s.rdb.SAdd(ctx, s.keys.stockDirty(), id).Err(); err != nil {
+		s.logger.WarnContext(ctx, "Failed to mark stock for write-back", "product_id", id, "err", err)
+	}
+	return left, nil
+}
+
+// takeOrderedStock takes the items of an order placed in Postgres off
+// their stock counters, so that the counters keep following the stock
+// column. A failure is only logged: the order is placed by then.
+func (s *Server) takeOrderedStock(ctx context.Context, items []store.OrderItem) {
+	ctx = context.WithoutCancel(ctx)
+	for _, item := range items {
+		err := orderedStockScript.Run(ctx, s.rdb, []string{s.keys.stock(item.ProductID)}, item.Quantity).Err()
+		if err != nil {
+			s.logger.ErrorContext(ctx, "Failed to take ordered stock off the counter",
+				"product_id", item.ProductID, "quantity", item.Quantity, "err", err)
+		}
+	}
+}
+
+// runStockReconciler writes reserved stock back to Postgres every interval
+// until ctx is cancelled, and once more on the way out so that a clean
+// shutdown leaves nothing pending.
+func (s *Server) runStockReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stockFlushTimeout)
+			defer cancel()
+			if _, err := s.reconcileStock(flushCtx, stockFlushTimeout); err != nil {
+				s.logger.WarnContext(flushCtx, "Final stock write-back failed", "err", err)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		n, err := s.reconcileStock(ctx, refreshLockTTL(interval))
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			s.logger.WarnContext(ctx, "Stock write-back failed", "err", err)
+		case n > 0:
+			s.logger.DebugContext(ctx, "Stock written back", "products", n)
+		}
+	}
+}
+
+// reconcileStock adds the stock changes pending in Redis to the stock
+// column, and returns how many products it updated. A change that cannot be
+// written is put back for the next round. It does nothing when another
+// replica holds the lock.
+func (s *Server) reconcileStock(ctx context.Context, lockTTL time.Duration) (int, error) {
+	lock, err := newRedisLocker(s.rdb, s.keys).Acquire(ctx, stockReconcileLock, lockTTL)
+	if errors.Is(err, errLockHeld) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			s.logger.WarnContext(ctx, "Failed to release the stock write-back lock", "err", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, lockTTL)
+	defer cancel()
+	ctx, span := s.tracer.Start(ctx, "stock.reconcile")
+	defer span.End()
+
+	members, err := s.rdb.SMembers(ctx, s.keys.stockDirty()).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "reconcile failed")
+		return 0, err
+	}
+	var updated int
+	var errs []error
+	for _, member := range members {
+		id, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			s.rdb.SRem(ctx, s.keys.stockDirty(), member)
+			continue
+		}
+		ok, err := s.writeBackStock(ctx, id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("product %d: %w", id, err))
+		}
+		if ok {
+			updated++
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "reconcile failed")
+		return updated, err
+	}
+	return updated, nil
+}
+
+// writeBackStock moves the pending change of product id from Redis to
+// Postgres, reporting whether there was one to write.
+func (s *Server) writeBackStock(ctx context.Context, id int64) (bool, error) {
+	// The id leaves the set before the change is taken, so a reservation
+	// in between adds it back for the next round.
+	if err := s.rdb.SRem(ctx, s.keys.stockDirty(), id).Err(); err != nil {
+		return false, err
+	}
+	delta, err := s.rdb.GetDel(ctx, s.keys.stockPending(id)).Int64()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return false, nil
+	case err != nil:
+		s.restoreStockChange(ctx, id, 0)
+		return false, err
+	case delta == 0:
+		return false, nil
+	}
+
+	err = s.stock.AddStock(ctx, id, delta)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.logger.InfoContext(ctx, "Dropping stock changes of a deleted product", "product_id", id, "change", delta)
+		if err := s.rdb.Del(ctx, s.keys.stock(id)).Err(); err != nil {
+			s.logger.WarnContext(ctx, "Failed to delete stock counter", "product_id", id, "err", err)
+		}
+		return false, nil
+	case err != nil:
+		s.restoreStockChange(ctx, id, delta)
+		return false, err
+	}
+	return true, nil
+}
+
+// restoreStockChange puts back a change that could not be written, so the
+// next round retries it.
+func (s *Server) restoreStockChange(ctx context.Context, id, delta int64) {
+	// Not a transaction: the two keys live in different cluster slots.
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if delta != 0 {
+			pipe.IncrBy(ctx, s.keys.stockPending(id), delta)
+		}
+		pipe.SAdd(ctx, s.keys.stockDirty(), id)
+		return nil
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Lost a stock change", "product_id", id, "change", delta, "err", err)
+	}
+}
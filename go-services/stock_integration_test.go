@@ -0,0 +1,104 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-service/store"
+)
+
+// This test needs a disposable Redis, e.g.
+//
+//	TEST_REDIS_ADDR=localhost:6379 go test -tags integration -run Integration .
+//
+// Its keys live under a prefix of their own, deleted when it ends.
+
+func TestIntegration_ConcurrentReservationsNeverOversell(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr, PoolSize: 32})
+	t.Cleanup(func() { rdb.Close() })
+
+	s, _, _ := newTestServer(t)
+	s.rdb = rdb
+	s.keys = redisKeys{prefix: fmt.Sprintf("stocktest%d:", time.Now().UnixNano())}
+	ctx := context.Background()
+	t.Cleanup(func() {
+		rdb.Del(ctx, s.keys.stock(7), s.keys.stockPending(7), s.keys.stockDirty())
+	})
+
+	const stock, buyers = 10, 200
+	if err := rdb.Set(ctx, s.keys.stock(7), stock, 0).Err(); err != nil {
+		t.Fatalf("seed counter: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([]error, buyers)
+	for i := range buyers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, results[i] = s.reserveStock(ctx, 7, 1)
+		}()
+	}
+	wg.Wait()
+
+	var sold int
+	for _, err := range results {
+		switch {
+		case err == nil:
+			sold++
+		case !errors.Is(err, errOutOfStock):
+			t.Fatalf("reserve: %v", err)
+		}
+	}
+	if sold != stock {
+		t.Errorf("expected exactly %d reservations, got %d", stock, sold)
+	}
+	if left, err := rdb.Get(ctx, s.keys.stock(7)).Int64(); err != nil || left != 0 {
+		t.Errorf("expected the counter at 0, got %d, %v", left, err)
+	}
+	if pending, err := rdb.Get(ctx, s.keys.stockPending(7)).Int64(); err != nil || pending != -stock {
+		t.Errorf("expected %d pending, got %d, %v", -stock, pending, err)
+	}
+}
+
+func TestIntegration_OrdersTakeStockOffTheCounter(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { rdb.Close() })
+
+	s, _, _ := newTestServer(t)
+	s.rdb = rdb
+	s.keys = redisKeys{prefix: fmt.Sprintf("stocktest%d:", time.Now().UnixNano())}
+	ctx := context.Background()
+	t.Cleanup(func() {
+		rdb.Del(ctx, s.keys.stock(7), s.keys.stock(8), s.keys.stockPending(7), s.keys.stockDirty())
+	})
+
+	if err := rdb.Set(ctx, s.keys.stock(7), 10, 0).Err(); err != nil {
+		t.Fatalf("seed counter: %v", err)
+	}
+	s.takeOrderedStock(ctx, []store.OrderItem{{ProductID: 7, Quantity: 10}, {ProductID: 8, Quantity: 1}})
+
+	if _, err := s.reserveStock(ctx, 7, 1); !errors.Is(err, errOutOfStock) {
+		t.Errorf("expected the ordered stock gone, got %v", err)
+	}
+	if n, err := rdb.Exists(ctx, s.keys.stock(8), s.keys.stockPending(7)).Result(); err != nil || n != 0 {
+		t.Errorf("expected no counter seeded and nothing pending, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	redismock "github.com/go-redis/redismock/v9"
+)
+
+var (
+	selectStock = regexp.QuoteMeta("SELECT stock FROM products WHERE id = $1")
+	addStock    = regexp.QuoteMeta("UPDATE products SET stock = GREATEST(stock + $2, 0) WHERE id = $1")
+)
+
+// expectReserve expects the reservation script for product id.
+func expectReserve(redisMock redismock.ClientMock, id int64, quantity int) *redismock.ExpectedCmd {
+	return redisMock.ExpectEvalSha(reserveScript.Hash(), []string{testKeys.stock(id), testKeys.stockPending(id)}, quantity)
+}
+
+func reserveRequestFor(id string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/products/"+id+"/reserve", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestStockHandler_SeedsCounterFromPostgres(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+
+	redisMock.ExpectGet(testKeys.stock(7)).RedisNil()
+	mockSQL.ExpectQuery(selectStock).WithArgs(int64(7)).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(12))
+	redisMock.ExpectSetNX(testKeys.stock(7), int64(12), 0).SetVal(true)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/7/stock", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got stockResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got != (stockResponse{ProductID: 7, Stock: 12}) {
+		t.Errorf("unexpected response %+v", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStockHandler_KeepsCounterSeededElsewhere(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+
+	// Another replica seeded the counter and took a reservation between
+	// the GET and the SET NX; its counter wins.
+	redisMock.ExpectGet(testKeys.stock(7)).RedisNil()
+	mockSQL.ExpectQuery(selectStock).WithArgs(int64(7)).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(12))
+	redisMock.ExpectSetNX(testKeys.stock(7), int64(12), 0).SetVal(false)
+	redisMock.ExpectGet(testKeys.stock(7)).SetVal("11")
+
+	stock, err := s.stockCounter(context.Background(), 7)
+	if err != nil || stock != 11 {
+		t.Errorf("expected the existing counter 11, got %d, %v", stock, err)
+	}
+}
+
+func TestStockHandler_UnknownProduct(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+
+	redisMock.ExpectGet(testKeys.stock(99)).RedisNil()
+	mockSQL.ExpectQuery(selectStock).WithArgs(int64(99)).WillReturnRows(sqlmock.NewRows([]string{"stock"}))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/99/stock", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestReserveHandler_TakesStock(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	expectReserve(redisMock, 7, 3).SetVal(int64(9))
+	redisMock.ExpectSAdd(testKeys.stockDirty(), int64(7)).SetVal(1)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, reserveRequestFor("7", `{"quantity":3}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got reserveResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got != (reserveResponse{ProductID: 7, Reserved: 3, Stock: 9}) {
+		t.Errorf("unexpected response %+v", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReserveHandler_OutOfStock(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	expectReserve(redisMock, 7, 5).SetVal(int64(reserveOutOfStock))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, reserveRequestFor("7", `{"quantity":5}`))
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if got := decodeError(t, w); got.Code != codeOutOfStock {
+		t.Errorf("expected code %q, got %+v", codeOutOfStock, got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nothing marked for write-back: %v", err)
+	}
+}
+
+func TestCreateOrder_TakesStockOffTheCounter(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+
+	// The whole stock is ordered; the counter must follow before the next
+	// reservation.
+	mockSQL.ExpectBegin()
+	expectOrderItem(mockSQL, 7, 10, 4.5, true)
+	mockSQL.ExpectQuery("INSERT INTO orders").WithArgs(45.0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mockSQL.ExpectExec("INSERT INTO order_items").WithArgs(int64(1), int64(7), 10, 4.5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit()
+	redisMock.ExpectEvalSha(orderedStockScript.Hash(), []string{testKeys.stock(7)}, 10).SetVal(int64(0))
+	expectReserve(redisMock, 7, 1).SetVal(int64(reserveOutOfStock))
+
+	if w := postOrder(s, `{"items":[{"product_id":7,"quantity":10}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("order: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, reserveRequestFor("7", `{"quantity":1}`))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("reserve: expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the order taken off the counter: %v", err)
+	}
+}
+
+func TestReserveHandler_SeedsCounterOnFirstUse(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+
+	expectReserve(redisMock, 7, 1).SetVal(int64(reserveUninitialized))
+	mockSQL.ExpectQuery(selectStock).WithArgs(int64(7)).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(4))
+	redisMock.ExpectSetNX(testKeys.stock(7), int64(4), 0).SetVal(true)
+	expectReserve(redisMock, 7, 1).SetVal(int64(3))
+	redisMock.ExpectSAdd(testKeys.stockDirty(), int64(7)).SetVal(1)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, reserveRequestFor("7", `{"quantity":1}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReserveHandler_RejectsBadQuantity(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	for _, body := range []string{`{}`, `{"quantity":0}`, `{"quantity":-2}`, `{"quantity":10001}`} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, reserveRequestFor("7", body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+// expectReconcileLock expects the write-back lock to be taken and released.
+func expectReconcileLock(redisMock redismock.ClientMock) (release func()) {
+	lockKey := testKeys.lock(stockReconcileLock)
+	redisMock.Regexp().ExpectSetNX(lockKey, `^[0-9a-f]{32}$`, time.Minute).SetVal(true)
+	return func() {
+		redisMock.Regexp().ExpectEvalSha(releaseScript.Hash(), []string{lockKey}, `^[0-9a-f]{32}$`).SetVal(int64(1))
+	}
+}
+
+func TestReconcileStock_WritesChangesBack(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+
+	release := expectReconcileLock(redisMock)
+	redisMock.ExpectSMembers(testKeys.stockDirty()).SetVal([]string{"7", "8", "9"})
+	// 7 has reservations to write back.
+	redisMock.ExpectSRem(testKeys.stockDirty(), int64(7)).SetVal(1)
+	redisMock.ExpectGetDel(testKeys.stockPending(7)).SetVal("-3")
+	mockSQL.ExpectExec(addStock).WithArgs(int64(7), int64(-3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	// 8 was written back by an earlier round.
+	redisMock.ExpectSRem(testKeys.stockDirty(), int64(8)).SetVal(1)
+	redisMock.ExpectGetDel(testKeys.stockPending(8)).RedisNil()
+	// 9 was deleted, so its counter goes too.
+	redisMock.ExpectSRem(testKeys.stockDirty(), int64(9)).SetVal(1)
+	redisMock.ExpectGetDel(testKeys.stockPending(9)).SetVal("-1")
+	mockSQL.ExpectExec(addStock).WithArgs(int64(9), int64(-1)).WillReturnResult(sqlmock.NewResult(0, 0))
+	redisMock.ExpectDel(testKeys.stock(9)).SetVal(1)
+	release()
+
+	n, err := s.reconcileStock(context.Background(), time.Minute)
+	if err != nil || n != 1 {
+		t.Errorf("expected one product written back, got %d, %v", n, err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconcileStock_PutsBackFailedChanges(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, redisMock := newTestServer(t)
+	usePostgresStores(s)
+
+	release := expectReconcileLock(redisMock)
+	redisMock.ExpectSMembers(testKeys.stockDirty()).SetVal([]string{"7"})
+	redisMock.ExpectSRem(testKeys.stockDirty(), int64(7)).SetVal(1)
+	redisMock.ExpectGetDel(testKeys.stockPending(7)).SetVal("-3")
+	mockSQL.ExpectExec(addStock).WithArgs(int64(7), int64(-3)).WillReturnError(errors.New("connection refused"))
+	redisMock.ExpectIncrBy(testKeys.stockPending(7), -3).SetVal(-5)
+	redisMock.ExpectSAdd(testKeys.stockDirty(), int64(7)).SetVal(1)
+	release()
+
+	n, err := s.reconcileStock(context.Background(), time.Minute)
+	if err == nil || n != 0 {
+		t.Errorf("expected the write-back to fail, got %d, %v", n, err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the change to be put back: %v", err)
+	}
+}
+
+func TestReconcileStock_SkipsWhileLocked(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+
+	redisMock.Regexp().ExpectSetNX(testKeys.lock(stockReconcileLock), `^[0-9a-f]{32}$`, time.Minute).SetVal(false)
+
+	if n, err := s.reconcileStock(context.Background(), time.Minute); err != nil || n != 0 {
+		t.Errorf("expected the round to be skipped, got %d, %v", n, err)
+	}
+}
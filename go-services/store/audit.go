@@ -0,0 +1,138 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEvent is a row of the audit_events table: something done by Actor,
+// to the user UserID when it concerns one.
+type AuditEvent struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor"`
+	// ActorRole is the role Actor acted with, or empty if they were not
+	// signed in.
+	ActorRole string `json:"actor_role"`
+	// UserID is the user the event concerns, or nil.
+	UserID    *int64          `json:"user_id"`
+	ClientIP  string          `json:"client_ip"`
+	UserAgent string          `json:"user_agent"`
+	RequestID string          `json:"request_id"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// AuditList selects audit events, newest first.
+type AuditList struct {
+	// UserID, when positive, keeps the events concerning that user.
+	UserID int64
+	// Since, when set, keeps the events at or after it.
+	Since time.Time
+	// BeforeID, when positive, continues after the event with that id.
+	BeforeID int64
+	Limit    int
+}
+
+// AuditStore keeps the audit log. Events are never changed once written.
+type AuditStore interface {
+	// Insert writes events, all or nothing. Their ID is ignored.
+	Insert(ctx context.Context, events []AuditEvent) error
+	List(ctx context.Context, l AuditList) ([]AuditEvent, error)
+}
+
+// PostgresAudit is the AuditStore backed by the audit_events table.
+type PostgresAudit struct {
+	pg Postgres
+}
+
+// NewPostgresAudit returns an AuditStore using pg.
+func NewPostgresAudit(pg Postgres) *PostgresAudit {
+	return &PostgresAudit{pg: pg}
+}
+
+const auditColumns = "id, created_at, action, actor, actor_role, user_id, client_ip, user_agent, request_id, metadata"
+
+// Insert writes events with one statement.
+func (s *PostgresAudit) Insert(ctx context.Context, events []AuditEvent) (err error) {
+	if len(events) == 0 {
+		return nil
+	}
+	var query strings.Builder
+	query.WriteString("INSERT INTO audit_events (created_at, action, actor, actor_role, user_id, client_ip, user_agent, request_id, metadata) VALUES ")
+	args := make([]any, 0, 9*len(events))
+	for i, ev := range events {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9)
+		metadata := string(ev.Metadata)
+		if metadata == "" {
+			metadata = "{}"
+		}
+		args = append(args, ev.Time, ev.Action, ev.Actor, ev.ActorRole, ev.UserID, ev.ClientIP, ev.UserAgent, ev.RequestID, metadata)
+	}
+
+	ctx, end := s.pg.startQuery(ctx, queryInsertAudit, query.String())
+	defer end(&err)
+
+	_, err = s.pg.DB.ExecContext(ctx, query.String(), args...)
+	return err
+}
+
+// List reads from the primary, so an event is listed as soon as it is
+// written.
+func (s *PostgresAudit) List(ctx context.Context, l AuditList) (events []AuditEvent, err error) {
+	var conds []string
+	var args []any
+	if l.UserID > 0 {
+		args = append(args, l.UserID)
+		conds = append(conds, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if !l.Since.IsZero() {
+		args = append(args, l.Since)
+		conds = append(conds, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if l.BeforeID > 0 {
+		args = append(args, l.BeforeID)
+		conds = append(conds, fmt.Sprintf("id < $%d", len(args)))
+	}
+	var where string
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, l.Limit)
+	query := fmt.Sprintf("SELECT %s FROM audit_events%s ORDER BY id DESC LIMIT $%d", auditColumns, where, len(args))
+
+	ctx, end := s.pg.startQuery(ctx, queryListAudit, query)
+	defer end(&err)
+
+	rows, err := s.pg.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events = []AuditEvent{}
+	for rows.Next() {
+		var (
+			ev       AuditEvent
+			userID   sql.NullInt64
+			metadata []byte
+		)
+		if err := rows.Scan(&ev.ID, &ev.Time, &ev.Action, &ev.Actor, &ev.ActorRole, &userID, &ev.ClientIP, &ev.UserAgent, &ev.RequestID, &metadata); err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			ev.UserID = &userID.Int64
+		}
+		ev.Metadata = metadata
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPostgresAudit_InsertWritesOneStatement(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	audits := NewPostgresAudit(pg)
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	userID := int64(7)
+	events := []AuditEvent{
+		{Time: at, Action: "login.succeeded", Actor: "anonymous", UserID: &userID, ClientIP: "192.0.2.1", UserAgent: "curl", RequestID: "r1"},
+		{Time: at, Action: "maintenance.updated", Actor: "admin-token", ActorRole: "admin", Metadata: json.RawMessage(`{"enabled":true}`)},
+	}
+	mockSQL.ExpectExec("INSERT INTO audit_events (created_at, action, actor, actor_role, user_id, client_ip, user_agent, request_id, metadata) VALUES "+
+		"($1, $2, $3, $4, $5, $6, $7, $8, $9), ($10, $11, $12, $13, $14, $15, $16, $17, $18)").
+		WithArgs(
+			at, "login.succeeded", "anonymous", "", &userID, "192.0.2.1", "curl", "r1", "{}",
+			at, "maintenance.updated", "admin-token", "admin", (*int64)(nil), "", "", "", `{"enabled":true}`,
+		).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := audits.Insert(context.Background(), events); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := audits.Insert(context.Background(), nil); err != nil {
+		t.Fatalf("Insert of nothing: %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresAudit_ListFilters(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	audits := NewPostgresAudit(pg)
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := since.Add(time.Hour)
+	mockSQL.ExpectQuery("SELECT "+auditColumns+" FROM audit_events WHERE user_id = $1 AND created_at >= $2 AND id < $3 ORDER BY id DESC LIMIT $4").
+		WithArgs(int64(7), since, int64(40), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "action", "actor", "actor_role", "user_id", "client_ip", "user_agent", "request_id", "metadata"}).
+			AddRow(39, at, "login.succeeded", "anonymous", "", 7, "192.0.2.1", "curl", "r1", []byte(`{}`)).
+			AddRow(38, at, "sessions.revoked", "user:3", "admin", nil, "", "", "", []byte(`{"sessions":2}`)))
+	mockSQL.ExpectQuery("SELECT " + auditColumns + " FROM audit_events ORDER BY id DESC LIMIT $1").
+		WithArgs(50).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	events, err := audits.List(context.Background(), AuditList{UserID: 7, Since: since, BeforeID: 40, Limit: 2})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(events) != 2 || events[0].UserID == nil || *events[0].UserID != 7 || events[1].UserID != nil || events[1].ActorRole != "admin" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if string(events[1].Metadata) != `{"sessions":2}` {
+		t.Errorf("expected the metadata to be kept, got %s", events[1].Metadata)
+	}
+
+	events, err = audits.List(context.Background(), AuditList{Limit: 50})
+	if err != nil || events == nil || len(events) != 0 {
+		t.Errorf("expected an empty, non-nil list, got %v, %v", events, err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
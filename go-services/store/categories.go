@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Category is a row of the categories table. Slug names it in URLs, such
+// as the category filter of product listings.
+type Category struct {
+	ID        int64     `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CategoryInput is the writable part of a category. Callers validate it.
+type CategoryInput struct {
+	Slug string
+	Name string
+}
+
+// CategoryStore reads and writes product categories.
+type CategoryStore interface {
+	// List returns every category, in name order.
+	List(ctx context.Context) ([]Category, error)
+	// Get returns the category with the given id, or ErrNotFound.
+	Get(ctx context.Context, id int64) (Category, error)
+	// Create returns ErrDuplicate if the slug is taken.
+	Create(ctx context.Context, in CategoryInput) (Category, error)
+	// Update replaces the category with the given id, or returns
+	// ErrNotFound. It returns ErrDuplicate if the slug is taken.
+	Update(ctx context.Context, id int64, in CategoryInput) (Category, error)
+	// Delete removes the category with the given id, or returns
+	// ErrNotFound. While products, deleted ones included, are in the
+	// category it returns ErrForeignKey, unless force is set: they are then
+	// left without a category, in the same transaction.
+	Delete(ctx context.Context, id int64, force bool) error
+}
+
+// PostgresCategories is the CategoryStore backed by the categories table.
+// It reads from the primary: categories are few, and a new one is expected
+// to be usable at once.
+type PostgresCategories struct {
+	pg Postgres
+}
+
+// NewPostgresCategories returns a CategoryStore using pg.
+func NewPostgresCategories(pg Postgres) *PostgresCategories {
+	return &PostgresCategories{pg: pg}
+}
+
+const categoryColumns = "id, slug, name, created_at"
+
+func (s *PostgresCategories) List(ctx context.Context) (categories []Category, err error) {
+	const query = "SELECT " + categoryColumns + " FROM categories ORDER BY name, id"
+
+	ctx, end := s.pg.startQuery(ctx, queryListCategories, query)
+	defer end(&err)
+
+	rows, err := s.pg.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories = []Category{}
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+func (s *PostgresCategories) Get(ctx context.Context, id int64) (_ Category, err error) {
+	const query = "SELECT " + categoryColumns + " FROM categories WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryGetCategory, query)
+	defer end(&err)
+
+	c, err := scanCategory(s.pg.DB.QueryRowContext(ctx, query, id))
+	return c, notFound(err)
+}
+
+func (s *PostgresCategories) Create(ctx context.Context, in CategoryInput) (_ Category, err error) {
+	const query = "INSERT INTO categories (slug, name) VALUES ($1, $2) RETURNING " + categoryColumns
+
+	ctx, end := s.pg.startQuery(ctx, queryCreateCategory, query)
+	defer end(&err)
+
+	return scanCategory(s.pg.DB.QueryRowContext(ctx, query, in.Slug, in.Name))
+}
+
+func (s *PostgresCategories) Update(ctx context.Context, id int64, in CategoryInput) (_ Category, err error) {
+	const query = "UPDATE categories SET slug = $2, name = $3 WHERE id = $1 RETURNING " + categoryColumns
+
+	ctx, end := s.pg.startQuery(ctx, queryUpdateCategory, query)
+	defer end(&err)
+
+	c, err := scanCategory(s.pg.DB.QueryRowContext(ctx, query, id, in.Slug, in.Name))
+	return c, notFound(err)
+}
+
+func (s *PostgresCategories) Delete(ctx context.Context, id int64, force bool) (err error) {
+	tx, err := s.pg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if force {
+		if err := s.detachProducts(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	if err := s.delete(ctx, tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// detachProducts leaves the products in category id without a category.
+func (s *PostgresCategories) detachProducts(ctx context.Context, tx *sql.Tx, id int64) (err error) {
+	const query = "UPDATE products SET category_id = NULL WHERE category_id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryDetachCategory, query)
+	defer end(&err)
+
+	_, err = tx.ExecContext(ctx, query, id)
+	return err
+}
+
+func (s *PostgresCategories) delete(ctx context.Context, tx *sql.Tx, id int64) (err error) {
+	const query = "DELETE FROM categories WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryDeleteCategory, query)
+	defer end(&err)
+
+	res, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// scanCategory reads a row selected with categoryColumns.
+func scanCategory(row interface{ Scan(...any) error }) (Category, error) {
+	var c Category
+	err := row.Scan(&c.ID, &c.Slug, &c.Name, &c.CreatedAt)
+	return c, err
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+var categoryRowColumns = []string{"id", "slug", "name", "created_at"}
+
+func TestPostgresCategories_CreateListAndUpdate(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	categories := NewPostgresCategories(pg)
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mockSQL.ExpectQuery("INSERT INTO categories (slug, name) VALUES ($1, $2) RETURNING id, slug, name, created_at").
+		WithArgs("garden-tools", "Garden tools").
+		WillReturnRows(sqlmock.NewRows(categoryRowColumns).AddRow(3, "garden-tools", "Garden tools", at))
+	mockSQL.ExpectQuery("SELECT id, slug, name, created_at FROM categories ORDER BY name, id").
+		WillReturnRows(sqlmock.NewRows(categoryRowColumns).
+			AddRow(4, "chairs", "Chairs", at).
+			AddRow(3, "garden-tools", "Garden tools", at))
+	mockSQL.ExpectQuery("UPDATE categories SET slug = $2, name = $3 WHERE id = $1 RETURNING id, slug, name, created_at").
+		WithArgs(int64(3), "garden", "Garden").
+		WillReturnRows(sqlmock.NewRows(categoryRowColumns).AddRow(3, "garden", "Garden", at))
+
+	ctx := context.Background()
+	c, err := categories.Create(ctx, CategoryInput{Slug: "garden-tools", Name: "Garden tools"})
+	if err != nil || c.ID != 3 || c.Slug != "garden-tools" || !c.CreatedAt.Equal(at) {
+		t.Errorf("Create: got %+v, %v", c, err)
+	}
+	list, err := categories.List(ctx)
+	if err != nil || len(list) != 2 || list[0].Slug != "chairs" || list[1].ID != 3 {
+		t.Errorf("List: got %+v, %v", list, err)
+	}
+	if c, err := categories.Update(ctx, 3, CategoryInput{Slug: "garden", Name: "Garden"}); err != nil || c.Name != "Garden" {
+		t.Errorf("Update: got %+v, %v", c, err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresCategories_MissingAndDuplicate(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	categories := NewPostgresCategories(pg)
+
+	mockSQL.ExpectQuery("SELECT id, slug, name, created_at FROM categories WHERE id = $1").WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(categoryRowColumns))
+	mockSQL.ExpectQuery("UPDATE categories SET slug = $2, name = $3 WHERE id = $1 RETURNING id, slug, name, created_at").
+		WithArgs(int64(9), "chairs", "Chairs").
+		WillReturnRows(sqlmock.NewRows(categoryRowColumns))
+	mockSQL.ExpectQuery("INSERT INTO categories (slug, name) VALUES ($1, $2) RETURNING id, slug, name, created_at").
+		WithArgs("chairs", "Chairs").
+		WillReturnError(&pq.Error{Code: "23505"})
+
+	ctx := context.Background()
+	in := CategoryInput{Slug: "chairs", Name: "Chairs"}
+	if _, err := categories.Get(ctx, 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if _, err := categories.Update(ctx, 9, in); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update: expected ErrNotFound, got %v", err)
+	}
+	if _, err := categories.Create(ctx, in); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Create: expected ErrDuplicate, got %v", err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresCategories_DeleteInUse(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	categories := NewPostgresCategories(pg)
+
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectExec("DELETE FROM categories WHERE id = $1").WithArgs(int64(3)).
+		WillReturnError(&pq.Error{Code: "23503"})
+	mockSQL.ExpectRollback()
+
+	if err := categories.Delete(context.Background(), 3, false); !errors.Is(err, ErrForeignKey) {
+		t.Errorf("expected ErrForeignKey, got %v", err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresCategories_ForcedDeleteDetachesProductsInOneTransaction(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	categories := NewPostgresCategories(pg)
+
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectExec("UPDATE products SET category_id = NULL WHERE category_id = $1").WithArgs(int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	mockSQL.ExpectExec("DELETE FROM categories WHERE id = $1").WithArgs(int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit()
+	// A missing category rolls back what was detached, which is nothing.
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectExec("UPDATE products SET category_id = NULL WHERE category_id = $1").WithArgs(int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSQL.ExpectExec("DELETE FROM categories WHERE id = $1").WithArgs(int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSQL.ExpectRollback()
+
+	if err := categories.Delete(context.Background(), 3, true); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := categories.Delete(context.Background(), 9, true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of a missing category: expected ErrNotFound, got %v", err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
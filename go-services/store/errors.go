@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// SQLSTATEs the store maps to its errors.
+const (
+	// pgUniqueViolation is reported when an insert conflicts with a unique
+	// constraint.
+	pgUniqueViolation = "23505"
+	// pgForeignKeyViolation is reported when a write references a row that
+	// does not exist, or deletes one still referenced.
+	pgForeignKeyViolation = "23503"
+	// pgSerializationFailure and pgDeadlockDetected are reported when a
+	// transaction lost to a concurrent one; retrying it can succeed.
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+	// pgQueryCanceled is reported for a statement Postgres cancelled,
+	// including one that ran past statement_timeout.
+	pgQueryCanceled = "57014"
+	// pgUndefinedColumn is reported for a missing column; pgUndefinedTable,
+	// in migrate.go, for a missing table.
+	pgUndefinedColumn = "42703"
+)
+
+// Labels of db_errors_total for errors that carry no SQLSTATE.
+const (
+	errorCodeDeadline = "deadline_exceeded"
+	errorCodeCanceled = "canceled"
+	errorCodeOther    = "other"
+)
+
+// storeErrors are the typed errors classify maps to. An error already
+// wrapping one of them is left as it is.
+var storeErrors = []error{ErrNotFound, ErrDuplicate, ErrForeignKey, ErrSerialization, ErrTimeout, ErrCanceled, ErrSchema, ErrInsufficientStock}
+
+// classify maps err, returned by a query run with ctx, to the store's
+// errors, wrapping it so that the driver's error stays inspectable. It also
+// returns the label db_errors_total counts err under, or "" when err is not
+// a failure: a missing row is an answer.
+func classify(ctx context.Context, err error) (error, string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, ErrNotFound) {
+			return err, ""
+		}
+		return fmt.Errorf("%w: %w", ErrNotFound, err), ""
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInsufficientStock) {
+		return err, ""
+	}
+
+	code := errorCode(ctx, err)
+	for _, typed := range storeErrors {
+		if errors.Is(err, typed) {
+			return err, code
+		}
+	}
+	var typed error
+	switch code {
+	case errorCodeDeadline:
+		typed = ErrTimeout
+	case errorCodeCanceled:
+		typed = ErrCanceled
+	case pgQueryCanceled:
+		// Cancelled without ctx asking: statement_timeout.
+		typed = ErrTimeout
+	case pgUniqueViolation:
+		typed = ErrDuplicate
+	case pgForeignKeyViolation:
+		typed = ErrForeignKey
+	case pgSerializationFailure, pgDeadlockDetected:
+		typed = ErrSerialization
+	case pgUndefinedTable, pgUndefinedColumn:
+		typed = ErrSchema
+	default:
+		return err, code
+	}
+	return fmt.Errorf("%w: %w", typed, err), code
+}
+
+// errorCode returns the label db_errors_total counts err under: the
+// SQLSTATE Postgres reported, or why ctx ended, or errorCodeOther.
+func errorCode(ctx context.Context, err error) string {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return errorCodeDeadline
+	case errors.Is(ctx.Err(), context.Canceled):
+		return errorCodeCanceled
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorCodeDeadline
+	case errors.Is(err, context.Canceled):
+		return errorCodeCanceled
+	}
+	return errorCodeOther
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), -1)
+	defer cancelExpired()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		want     error
+		wantCode string
+	}{
+		{"missing row", context.Background(), sql.ErrNoRows, ErrNotFound, ""},
+		{"not found", context.Background(), ErrNotFound, ErrNotFound, ""},
+		{"insufficient stock", context.Background(), fmt.Errorf("product 1: %w", ErrInsufficientStock), ErrInsufficientStock, ""},
+		{"unique violation", context.Background(), &pq.Error{Code: "23505"}, ErrDuplicate, "23505"},
+		{"foreign key violation", context.Background(), &pq.Error{Code: "23503"}, ErrForeignKey, "23503"},
+		{"serialization failure", context.Background(), &pq.Error{Code: "40001"}, ErrSerialization, "40001"},
+		{"deadlock", context.Background(), &pq.Error{Code: "40P01"}, ErrSerialization, "40P01"},
+		{"statement timeout", context.Background(), &pq.Error{Code: "57014"}, ErrTimeout, "57014"},
+		{"undefined table", context.Background(), &pq.Error{Code: "42P01"}, ErrSchema, "42P01"},
+		{"undefined column", context.Background(), &pq.Error{Code: "42703"}, ErrSchema, "42703"},
+		{"deadline", expired, context.DeadlineExceeded, ErrTimeout, errorCodeDeadline},
+		{"deadline cancelling the statement", expired, &pq.Error{Code: "57014"}, ErrTimeout, errorCodeDeadline},
+		{"client went away", canceled, context.Canceled, ErrCanceled, errorCodeCanceled},
+		{"client went away mid statement", canceled, &pq.Error{Code: "57014"}, ErrCanceled, errorCodeCanceled},
+		{"already typed", context.Background(), fmt.Errorf("%w: %w", ErrDuplicate, &pq.Error{Code: "23505"}), ErrDuplicate, "23505"},
+		{"other SQLSTATE", context.Background(), &pq.Error{Code: "53300"}, nil, "53300"},
+		{"connection error", context.Background(), errors.New("connection refused"), nil, errorCodeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, code := classify(tt.ctx, tt.err)
+			if code != tt.wantCode {
+				t.Errorf("code = %q, want %q", code, tt.wantCode)
+			}
+			if !errors.Is(got, tt.err) {
+				t.Errorf("%v no longer wraps %v", got, tt.err)
+			}
+			if tt.want == nil {
+				for _, typed := range storeErrors {
+					if errors.Is(got, typed) {
+						t.Errorf("expected %v left unmapped, got %v", tt.err, got)
+					}
+				}
+				return
+			}
+			if !errors.Is(got, tt.want) {
+				t.Errorf("got %v, want it to wrap %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartQuery_MapsAndCountsErrors(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	pg.Errors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "db_errors_total"}, []string{"code"})
+	users := NewPostgresUsers(pg)
+
+	mockSQL.ExpectQuery("INSERT INTO users (username, email, password_hash) VALUES ($1, NULLIF($2, ''), $3) RETURNING id").
+		WillReturnError(&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"})
+	if _, err := users.Create(context.Background(), "alice", "", []byte("hash")); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("expected ErrDuplicate, got %v", err)
+	}
+
+	mockSQL.ExpectQuery("SELECT username FROM users WHERE id = $1").WillReturnError(sql.ErrNoRows)
+	if _, err := users.Username(context.Background(), 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if got := testutil.ToFloat64(pg.Errors.WithLabelValues("23505")); got != 1 {
+		t.Errorf("db_errors_total{code=23505} = %v, want 1", got)
+	}
+	if n := testutil.CollectAndCount(pg.Errors); n != 1 {
+		t.Errorf("expected only the unique violation counted, got %d series", n)
+	}
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// migrationFiles are the schema migrations, applied in version order. A
+// migration is never edited once released; changes go in a new file named
+// NNNN_description.sql with the next version number.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the Postgres advisory lock key held while migrating,
+// so that replicas starting together apply each migration once.
+const migrationLockID = 720_417_306
+
+// pgUndefinedTable is the SQLSTATE Postgres reports for a missing table.
+const pgUndefinedTable = "42P01"
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+type migration struct {
+	version int64
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the migrations in dir of fsys, sorted by version.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, e := range entries {
+		m := migrationName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_description.sql", e.Name())
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: version must be a positive integer", e.Name())
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: m[2], sql: string(body)})
+	}
+	slices.SortFunc(migrations, func(a, b migration) int { return cmp.Compare(a.version, b.version) })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s share version %d",
+				migrations[i-1].name, migrations[i].name, migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate applies the embedded migrations that db has not seen yet and
+// returns the resulting schema version. It holds an advisory lock while it
+// runs, so a replica that starts while another is migrating waits for it and
+// then finds nothing left to do.
+func Migrate(ctx context.Context, db *sql.DB, logger *slog.Logger) (int64, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	return migrate(ctx, db, migrations, logger)
+}
+
+func migrate(ctx context.Context, db *sql.DB, migrations []migration, logger *slog.Logger) (_ int64, err error) {
+	// Advisory locks belong to a session, so the lock, the checks and the
+	// migrations must all use the same connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Waiting for the lock and building indexes can both outlast the
+	// statement_timeout meant for request queries.
+	if _, err := conn.ExecContext(ctx, "SET statement_timeout = 0"); err != nil {
+		return 0, fmt.Errorf("lift statement timeout: %w", err)
+	}
+	defer func() {
+		// The connection goes back to the pool, so restore the timeout set
+		// when it connected.
+		if _, resetErr := conn.ExecContext(context.Background(), "RESET statement_timeout"); resetErr != nil {
+			err = errors.Join(err, fmt.Errorf("restore statement timeout: %w", resetErr))
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return 0, fmt.Errorf("take migration lock: %w", err)
+	}
+	defer func() {
+		// A fresh context: the lock must be released even if ctx is done.
+		_, unlockErr := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+		if unlockErr != nil {
+			err = errors.Join(err, fmt.Errorf("release migration lock: %w", unlockErr))
+		}
+	}()
+
+	const createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version BIGINT PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+	if _, err := conn.ExecContext(ctx, createTable); err != nil {
+		return 0, fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	var current int64
+	for v := range applied {
+		current = max(current, v)
+	}
+	for _, m := range migrations {
+		if !applied[m.version] {
+			if err := applyMigration(ctx, conn, m); err != nil {
+				return 0, err
+			}
+			logger.InfoContext(ctx, "Applied migration", "version", m.version, "name", m.name)
+		}
+		current = max(current, m.version)
+	}
+	return current, nil
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]bool, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("read schema_migrations: %w", err)
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs m and records it in one transaction, so a migration
+// that fails part way leaves no trace and is retried on the next start.
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+		return fmt.Errorf("record migration %d_%s: %w", m.version, m.name, err)
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion returns the highest migration version applied to db, or 0
+// if migrations have never run there.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int64, error) {
+	var v int64
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&v)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgUndefinedTable {
+		return 0, nil
+	}
+	return v, err
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+var testMigrations = []migration{
+	{version: 1, name: "create_widgets", sql: "CREATE TABLE widgets (id INT)"},
+	{version: 2, name: "add_widget_name", sql: "ALTER TABLE widgets ADD COLUMN name TEXT"},
+}
+
+func TestLoadMigrations_SortsByVersion(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"m/0002_second.sql": {Data: []byte("SELECT 2")},
+		"m/0010_tenth.sql":  {Data: []byte("SELECT 10")},
+		"m/0001_first.sql":  {Data: []byte("SELECT 1")},
+	}
+	got, err := loadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	want := []migration{{1, "first", "SELECT 1"}, {2, "second", "SELECT 2"}, {10, "tenth", "SELECT 10"}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d migrations, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("migration %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLoadMigrations_RejectsBadSets(t *testing.T) {
+	t.Parallel()
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"unnumbered":        {"m/init.sql": {}},
+		"version zero":      {"m/0000_init.sql": {}},
+		"duplicate version": {"m/0001_a.sql": {}, "m/01_b.sql": {}},
+	} {
+		if _, err := loadMigrations(fsys, "m"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEmbeddedMigrations_AreNumberedWithoutGaps(t *testing.T) {
+	t.Parallel()
+
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.version != int64(i+1) {
+			t.Errorf("migration %s has version %d, want %d", m.name, m.version, i+1)
+		}
+		if strings.TrimSpace(m.sql) == "" {
+			t.Errorf("migration %d_%s is empty", m.version, m.name)
+		}
+	}
+}
+
+// expectLockAndApplied expects the statement timeout to be lifted, the lock, the schema_migrations table and
+// the read of the versions already applied.
+func expectLockAndApplied(mockSQL sqlmock.Sqlmock, applied ...int64) *sqlmock.ExpectedExec {
+	mockSQL.ExpectExec("SET statement_timeout = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	lock := mockSQL.ExpectExec("SELECT pg_advisory_lock($1)").WithArgs(migrationLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSQL.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+  version BIGINT PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version"})
+	for _, v := range applied {
+		rows.AddRow(v)
+	}
+	mockSQL.ExpectQuery("SELECT version FROM schema_migrations").WillReturnRows(rows)
+	return lock
+}
+
+func expectApply(mockSQL sqlmock.Sqlmock, m migration) {
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectExec(m.sql).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSQL.ExpectExec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)").
+		WithArgs(m.version, m.name).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit()
+}
+
+func expectUnlock(mockSQL sqlmock.Sqlmock) {
+	mockSQL.ExpectExec("SELECT pg_advisory_unlock($1)").WithArgs(migrationLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSQL.ExpectExec("RESET statement_timeout").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigrate_AppliesPendingInOrder(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+
+	expectLockAndApplied(mockSQL)
+	expectApply(mockSQL, testMigrations[0])
+	expectApply(mockSQL, testMigrations[1])
+	expectUnlock(mockSQL)
+
+	version, err := migrate(context.Background(), pg.DB, testMigrations, discardLogger)
+	if err != nil || version != 2 {
+		t.Errorf("expected version 2, got %d, %v", version, err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMigrate_RerunIsANoop(t *testing.T) {
+	t.Parallel()
+
+	// A database migrated by a newer release reports its own version.
+	for _, applied := range [][]int64{{1, 2}, {1, 2, 3}} {
+		pg, mockSQL := newTestPostgres(t)
+		expectLockAndApplied(mockSQL, applied...)
+		expectUnlock(mockSQL)
+
+		version, err := migrate(context.Background(), pg.DB, testMigrations, discardLogger)
+		if want := applied[len(applied)-1]; err != nil || version != want {
+			t.Errorf("applied %v: expected version %d, got %d, %v", applied, want, version, err)
+		}
+		if err := mockSQL.ExpectationsWereMet(); err != nil {
+			t.Errorf("applied %v: expected nothing to run: %v", applied, err)
+		}
+	}
+}
+
+func TestMigrate_WaitsForLockThenAppliesTheRest(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+
+	// Another replica holds the lock and applies version 1 meanwhile.
+	expectLockAndApplied(mockSQL, 1).WillDelayFor(50 * time.Millisecond)
+	expectApply(mockSQL, testMigrations[1])
+	expectUnlock(mockSQL)
+
+	start := time.Now()
+	version, err := migrate(context.Background(), pg.DB, testMigrations, discardLogger)
+	if err != nil || version != 2 {
+		t.Errorf("expected version 2, got %d, %v", version, err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected to wait for the lock before reading versions")
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMigrate_FailureRollsBackAndReleasesLock(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	boom := errors.New(`column "name" already exists`)
+
+	expectLockAndApplied(mockSQL)
+	expectApply(mockSQL, testMigrations[0])
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectExec(testMigrations[1].sql).WillReturnError(boom)
+	mockSQL.ExpectRollback()
+	expectUnlock(mockSQL)
+
+	_, err := migrate(context.Background(), pg.DB, testMigrations, discardLogger)
+	if !errors.Is(err, boom) || !strings.Contains(err.Error(), "2_add_widget_name") {
+		t.Errorf("expected the failing migration named, got %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	t.Parallel()
+	const query = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"
+
+	pg, mockSQL := newTestPostgres(t)
+	mockSQL.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(3))
+	mockSQL.ExpectQuery(query).WillReturnError(&pq.Error{Code: "42P01"})
+	mockSQL.ExpectQuery(query).WillReturnError(errors.New("connection refused"))
+
+	if v, err := SchemaVersion(context.Background(), pg.DB); err != nil || v != 3 {
+		t.Errorf("expected 3, got %d, %v", v, err)
+	}
+	if v, err := SchemaVersion(context.Background(), pg.DB); err != nil || v != 0 {
+		t.Errorf("expected 0 without schema_migrations, got %d, %v", v, err)
+	}
+	if _, err := SchemaVersion(context.Background(), pg.DB); err == nil {
+		t.Error("expected other errors to be returned")
+	}
+}
@@ -0,0 +1,27 @@
+-- Announces every change to products on the products_changed channel, with
+-- the product id as the payload, so that the Go service can invalidate its
+-- cache for writes made directly to the database.
+CREATE OR REPLACE FUNCTION notify_products_changed() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'TRUNCATE' THEN
+    PERFORM pg_notify('products_changed', '');
+    RETURN NULL;
+  END IF;
+  IF TG_OP = 'DELETE' THEN
+    PERFORM pg_notify('products_changed', OLD.id::text);
+  ELSE
+    PERFORM pg_notify('products_changed', NEW.id::text);
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_changed ON products;
+CREATE TRIGGER products_changed
+  AFTER INSERT OR UPDATE OR DELETE ON products
+  FOR EACH ROW EXECUTE FUNCTION notify_products_changed();
+
+DROP TRIGGER IF EXISTS products_truncated ON products;
+CREATE TRIGGER products_truncated
+  AFTER TRUNCATE ON products
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_products_changed();
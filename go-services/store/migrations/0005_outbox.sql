@@ -0,0 +1,14 @@
+-- Events that could not be published to the message broker when they
+-- happened. The relay retries each at next_attempt_at and deletes it once
+-- published.
+CREATE TABLE IF NOT EXISTS outbox (
+  id BIGSERIAL PRIMARY KEY,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  event_key TEXT NOT NULL,
+  payload BYTEA NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 1,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS outbox_next_attempt_at ON outbox (next_attempt_at, id);
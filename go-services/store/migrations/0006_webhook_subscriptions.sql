@@ -0,0 +1,10 @@
+-- Partners notified of product changes. Each delivery is signed with the
+-- subscription's secret; events lists the event types it is sent.
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+  id BIGSERIAL PRIMARY KEY,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT[] NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT true
+);
@@ -0,0 +1,5 @@
+-- Deleted products are kept for a while before the purge job removes them,
+-- so that an admin can restore them. Only live products are listed.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS products_deleted_at ON products (deleted_at) WHERE deleted_at IS NOT NULL;
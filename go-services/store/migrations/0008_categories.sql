@@ -0,0 +1,12 @@
+-- Product categories. A product is in at most one; deleting a category
+-- still in use is refused unless its products are detached first.
+CREATE TABLE IF NOT EXISTS categories (
+  id SERIAL PRIMARY KEY,
+  slug TEXT NOT NULL UNIQUE,
+  name TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS category_id INTEGER REFERENCES categories (id);
+
+CREATE INDEX IF NOT EXISTS products_category_id ON products (category_id);
@@ -0,0 +1,9 @@
+-- Full-text search over products, names weighted above descriptions. The
+-- column is generated, so every write keeps it current.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector
+  GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', name), 'A') ||
+    setweight(to_tsvector('english', description), 'B')
+  ) STORED;
+
+CREATE INDEX IF NOT EXISTS products_search_vector ON products USING GIN (search_vector);
@@ -0,0 +1,9 @@
+-- User roles. Every user is a plain user until an admin promotes them;
+-- audit events record the role their actor acted with, empty for callers
+-- that were not signed in.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'
+  CHECK (role IN ('user', 'admin'));
+
+CREATE INDEX IF NOT EXISTS users_admins ON users (id) WHERE role = 'admin';
+
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS actor_role TEXT NOT NULL DEFAULT '';
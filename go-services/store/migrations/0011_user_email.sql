@@ -0,0 +1,4 @@
+-- Users may give an email address, which is where password reset tokens
+-- are sent. Users registered before it, or without one, cannot reset their
+-- password.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
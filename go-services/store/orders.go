@@ -0,0 +1,160 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// OrderItem is one line of an order.
+type OrderItem struct {
+	ProductID int64 `json:"product_id"`
+	Quantity  int   `json:"quantity"`
+	// UnitPrice is the product's price when the order was placed.
+	UnitPrice float64 `json:"unit_price"`
+}
+
+// Order is a row of the orders table with its items.
+type Order struct {
+	ID        int64       `json:"id"`
+	Items     []OrderItem `json:"items"`
+	Total     float64     `json:"total"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// OrderItemError reports the item an order failed on. Err is ErrNotFound if
+// the product does not exist, ErrNoPrice if it has no price and
+// ErrInsufficientStock if too few are left.
+type OrderItemError struct {
+	ProductID int64
+	Err       error
+}
+
+func (e *OrderItemError) Error() string {
+	return fmt.Sprintf("product %d: %v", e.ProductID, e.Err)
+}
+
+func (e *OrderItemError) Unwrap() error { return e.Err }
+
+// OrderStore places orders.
+type OrderStore interface {
+	// Create takes the items out of stock and records the order, all or
+	// nothing. Items must name distinct products with positive quantities;
+	// their UnitPrice is ignored and filled in from the products table. It
+	// returns an *OrderItemError if a product is missing, has no price or
+	// is out of stock.
+	Create(ctx context.Context, items []OrderItem) (Order, error)
+}
+
+// PostgresOrders is the OrderStore backed by the orders and order_items
+// tables.
+type PostgresOrders struct {
+	pg Postgres
+}
+
+// NewPostgresOrders returns an OrderStore using pg.
+func NewPostgresOrders(pg Postgres) *PostgresOrders {
+	return &PostgresOrders{pg: pg}
+}
+
+// Create runs in a single transaction. Products are reserved in id order so
+// that concurrent orders for overlapping products lock their rows in the
+// same order instead of deadlocking.
+func (s *PostgresOrders) Create(ctx context.Context, items []OrderItem) (_ Order, err error) {
+	items = slices.SortedFunc(slices.Values(items), func(a, b OrderItem) int {
+		return cmp.Compare(a.ProductID, b.ProductID)
+	})
+
+	tx, err := s.pg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Order{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	order := Order{Items: make([]OrderItem, 0, len(items))}
+	var total float64
+	for _, item := range items {
+		item.UnitPrice, err = s.reserve(ctx, tx, item)
+		if err != nil {
+			return Order{}, err
+		}
+		total += item.UnitPrice * float64(item.Quantity)
+		order.Items = append(order.Items, item)
+	}
+	order.Total = math.Round(total*100) / 100
+
+	if err := s.insertOrder(ctx, tx, &order); err != nil {
+		return Order{}, err
+	}
+	for _, item := range order.Items {
+		if err := s.insertItem(ctx, tx, order.ID, item); err != nil {
+			return Order{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// reserve checks that the item's product exists and has a price, takes the
+// quantity out of its stock and returns the price.
+func (s *PostgresOrders) reserve(ctx context.Context, tx *sql.Tx, item OrderItem) (float64, error) {
+	const (
+		selectPrice = "SELECT price FROM products WHERE id = $1 AND " + productLive
+		takeStock   = "UPDATE products SET stock = stock - $1 WHERE id = $2 AND stock >= $1"
+	)
+
+	queryCtx, end := s.pg.startQuery(ctx, queryOrderProduct, selectPrice)
+	var price sql.NullFloat64
+	err := tx.QueryRowContext(queryCtx, selectPrice, item.ProductID).Scan(&price)
+	end(&err)
+	switch {
+	case err != nil:
+		return 0, &OrderItemError{ProductID: item.ProductID, Err: notFound(err)}
+	case !price.Valid:
+		return 0, &OrderItemError{ProductID: item.ProductID, Err: ErrNoPrice}
+	}
+
+	queryCtx, end = s.pg.startQuery(ctx, queryReserveStock, takeStock)
+	var n int64
+	res, err := tx.ExecContext(queryCtx, takeStock, item.Quantity, item.ProductID)
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	end(&err)
+	switch {
+	case err != nil:
+		return 0, err
+	case n == 0:
+		return 0, &OrderItemError{ProductID: item.ProductID, Err: ErrInsufficientStock}
+	}
+	return price.Float64, nil
+}
+
+func (s *PostgresOrders) insertOrder(ctx context.Context, tx *sql.Tx, order *Order) (err error) {
+	const query = "INSERT INTO orders (total) VALUES ($1) RETURNING id, created_at"
+
+	ctx, end := s.pg.startQuery(ctx, queryCreateOrder, query)
+	defer end(&err)
+
+	return tx.QueryRowContext(ctx, query, order.Total).Scan(&order.ID, &order.CreatedAt)
+}
+
+func (s *PostgresOrders) insertItem(ctx context.Context, tx *sql.Tx, orderID int64, item OrderItem) (err error) {
+	const query = "INSERT INTO order_items (order_id, product_id, quantity, unit_price) VALUES ($1, $2, $3, $4)"
+
+	ctx, end := s.pg.startQuery(ctx, queryCreateOrderItem, query)
+	defer end(&err)
+
+	_, err = tx.ExecContext(ctx, query, orderID, item.ProductID, item.Quantity, item.UnitPrice)
+	return err
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	selectOrderPrice = "SELECT price FROM products WHERE id = $1 AND deleted_at IS NULL"
+	takeOrderStock   = "UPDATE products SET stock = stock - $1 WHERE id = $2 AND stock >= $1"
+	insertOrder      = "INSERT INTO orders (total) VALUES ($1) RETURNING id, created_at"
+	insertOrderItem  = "INSERT INTO order_items (order_id, product_id, quantity, unit_price) VALUES ($1, $2, $3, $4)"
+)
+
+// expectReserve expects the price lookup and stock update for one item,
+// leaving affected rows updated.
+func expectReserve(mockSQL sqlmock.Sqlmock, productID int64, quantity int, price float64, affected int64) {
+	mockSQL.ExpectQuery(selectOrderPrice).WithArgs(productID).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(price))
+	mockSQL.ExpectExec(takeOrderStock).WithArgs(quantity, productID).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+func TestPostgresOrders_CreateCommits(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Items are reserved in product id order, whatever order they came in.
+	mockSQL.ExpectBegin()
+	expectReserve(mockSQL, 2, 3, 5.49, 1)
+	expectReserve(mockSQL, 7, 1, 10.99, 1)
+	mockSQL.ExpectQuery(insertOrder).WithArgs(27.46).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(40, created))
+	mockSQL.ExpectExec(insertOrderItem).WithArgs(int64(40), int64(2), 3, 5.49).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectExec(insertOrderItem).WithArgs(int64(40), int64(7), 1, 10.99).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit()
+
+	order, err := NewPostgresOrders(pg).Create(context.Background(), []OrderItem{
+		{ProductID: 7, Quantity: 1},
+		{ProductID: 2, Quantity: 3},
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if order.ID != 40 || order.Total != 27.46 || !order.CreatedAt.Equal(created) || len(order.Items) != 2 ||
+		order.Items[0] != (OrderItem{ProductID: 2, Quantity: 3, UnitPrice: 5.49}) {
+		t.Errorf("unexpected order %+v", order)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresOrders_CreateRollsBack(t *testing.T) {
+	t.Parallel()
+
+	dbErr := errors.New("connection reset by peer")
+	tests := []struct {
+		name   string
+		expect func(sqlmock.Sqlmock)
+		check  func(error) bool
+	}{
+		{
+			name: "stock runs out mid-way",
+			expect: func(mockSQL sqlmock.Sqlmock) {
+				expectReserve(mockSQL, 2, 3, 5.49, 1)
+				expectReserve(mockSQL, 7, 1, 10.99, 0)
+			},
+			check: func(err error) bool {
+				var itemErr *OrderItemError
+				return errors.As(err, &itemErr) && itemErr.ProductID == 7 && errors.Is(err, ErrInsufficientStock)
+			},
+		},
+		{
+			name: "product does not exist",
+			expect: func(mockSQL sqlmock.Sqlmock) {
+				expectReserve(mockSQL, 2, 3, 5.49, 1)
+				mockSQL.ExpectQuery(selectOrderPrice).WithArgs(int64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"price"}))
+			},
+			check: func(err error) bool {
+				var itemErr *OrderItemError
+				return errors.As(err, &itemErr) && itemErr.ProductID == 7 && errors.Is(err, ErrNotFound)
+			},
+		},
+		{
+			name: "product has no price",
+			expect: func(mockSQL sqlmock.Sqlmock) {
+				expectReserve(mockSQL, 2, 3, 5.49, 1)
+				mockSQL.ExpectQuery(selectOrderPrice).WithArgs(int64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(nil))
+			},
+			check: func(err error) bool {
+				var itemErr *OrderItemError
+				return errors.As(err, &itemErr) && itemErr.ProductID == 7 && errors.Is(err, ErrNoPrice)
+			},
+		},
+		{
+			name: "insert fails",
+			expect: func(mockSQL sqlmock.Sqlmock) {
+				expectReserve(mockSQL, 2, 3, 5.49, 1)
+				expectReserve(mockSQL, 7, 1, 10.99, 1)
+				mockSQL.ExpectQuery(insertOrder).WillReturnError(dbErr)
+			},
+			check: func(err error) bool { return errors.Is(err, dbErr) },
+		},
+		{
+			name: "item insert fails",
+			expect: func(mockSQL sqlmock.Sqlmock) {
+				expectReserve(mockSQL, 2, 3, 5.49, 1)
+				expectReserve(mockSQL, 7, 1, 10.99, 1)
+				mockSQL.ExpectQuery(insertOrder).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(40, time.Now()))
+				mockSQL.ExpectExec(insertOrderItem).WillReturnError(dbErr)
+			},
+			check: func(err error) bool { return errors.Is(err, dbErr) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			pg, mockSQL := newTestPostgres(t)
+
+			mockSQL.ExpectBegin()
+			tt.expect(mockSQL)
+			mockSQL.ExpectRollback()
+
+			_, err := NewPostgresOrders(pg).Create(context.Background(), []OrderItem{
+				{ProductID: 2, Quantity: 3},
+				{ProductID: 7, Quantity: 1},
+			})
+			if !tt.check(err) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if err := mockSQL.ExpectationsWereMet(); err != nil {
+				t.Errorf("expected a rollback and nothing after it: %v", err)
+			}
+		})
+	}
+}
+
+func TestPostgresOrders_BeginAndCommitFailures(t *testing.T) {
+	t.Parallel()
+	dbErr := errors.New("connection refused")
+	items := []OrderItem{{ProductID: 2, Quantity: 1}}
+
+	pg, mockSQL := newTestPostgres(t)
+	mockSQL.ExpectBegin().WillReturnError(dbErr)
+	if _, err := NewPostgresOrders(pg).Create(context.Background(), items); !errors.Is(err, dbErr) {
+		t.Errorf("begin: expected %v, got %v", dbErr, err)
+	}
+
+	pg, mockSQL = newTestPostgres(t)
+	mockSQL.ExpectBegin()
+	expectReserve(mockSQL, 2, 1, 5.49, 1)
+	mockSQL.ExpectQuery(insertOrder).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(40, time.Now()))
+	mockSQL.ExpectExec(insertOrderItem).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit().WillReturnError(dbErr)
+	if _, err := NewPostgresOrders(pg).Create(context.Background(), items); !errors.Is(err, dbErr) {
+		t.Errorf("commit: expected %v, got %v", dbErr, err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
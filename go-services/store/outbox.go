@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// OutboxEvent is a row of the outbox table: an event that could not be
+// published when it happened, kept until a retry succeeds.
+type OutboxEvent struct {
+	ID  int64
+	Key string
+	// Payload is the event exactly as it is to be published.
+	Payload []byte
+	// Attempts counts the failed publishes so far, the first included.
+	Attempts  int
+	CreatedAt time.Time
+	LastError string
+}
+
+// OutboxStore keeps the events waiting to be published again.
+type OutboxStore interface {
+	// Add stores an event whose first publish failed, due for a retry at
+	// once. Its ID, Attempts and CreatedAt are ignored.
+	Add(ctx context.Context, ev OutboxEvent) error
+	// Due returns up to limit events whose retry is due, oldest first.
+	Due(ctx context.Context, limit int) ([]OutboxEvent, error)
+	// Retry records another failed publish of the event with the given id
+	// and puts its next retry off until next.
+	Retry(ctx context.Context, id int64, next time.Time, lastErr string) error
+	// Delete removes the event with the given id once it is published.
+	Delete(ctx context.Context, id int64) error
+}
+
+// PostgresOutbox is the OutboxStore backed by the outbox table.
+type PostgresOutbox struct {
+	pg Postgres
+}
+
+// NewPostgresOutbox returns an OutboxStore using pg.
+func NewPostgresOutbox(pg Postgres) *PostgresOutbox {
+	return &PostgresOutbox{pg: pg}
+}
+
+func (s *PostgresOutbox) Add(ctx context.Context, ev OutboxEvent) (err error) {
+	const query = "INSERT INTO outbox (event_key, payload, last_error) VALUES ($1, $2, $3)"
+
+	ctx, end := s.pg.startQuery(ctx, queryAddOutbox, query)
+	defer end(&err)
+
+	_, err = s.pg.DB.ExecContext(ctx, query, ev.Key, ev.Payload, ev.LastError)
+	return err
+}
+
+// Due reads from the primary, where the relay also writes.
+func (s *PostgresOutbox) Due(ctx context.Context, limit int) (events []OutboxEvent, err error) {
+	const query = "SELECT id, event_key, payload, attempts, created_at, last_error FROM outbox " +
+		"WHERE next_attempt_at <= now() ORDER BY id LIMIT $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryDueOutbox, query)
+	defer end(&err)
+
+	rows, err := s.pg.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events = []OutboxEvent{}
+	for rows.Next() {
+		var ev OutboxEvent
+		if err := rows.Scan(&ev.ID, &ev.Key, &ev.Payload, &ev.Attempts, &ev.CreatedAt, &ev.LastError); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (s *PostgresOutbox) Retry(ctx context.Context, id int64, next time.Time, lastErr string) (err error) {
+	const query = "UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3 WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryRetryOutbox, query)
+	defer end(&err)
+
+	_, err = s.pg.DB.ExecContext(ctx, query, id, next, lastErr)
+	return err
+}
+
+func (s *PostgresOutbox) Delete(ctx context.Context, id int64) (err error) {
+	const query = "DELETE FROM outbox WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryDeleteOutbox, query)
+	defer end(&err)
+
+	_, err = s.pg.DB.ExecContext(ctx, query, id)
+	return err
+}
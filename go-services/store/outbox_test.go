@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPostgresOutbox_AddAndDue(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	outbox := NewPostgresOutbox(pg)
+
+	mockSQL.ExpectExec("INSERT INTO outbox (event_key, payload, last_error) VALUES ($1, $2, $3)").
+		WithArgs("42", []byte(`{"type":"product.created"}`), "connection refused").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	err := outbox.Add(context.Background(), OutboxEvent{Key: "42", Payload: []byte(`{"type":"product.created"}`), LastError: "connection refused"})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mockSQL.ExpectQuery("SELECT id, event_key, payload, attempts, created_at, last_error FROM outbox WHERE next_attempt_at <= now() ORDER BY id LIMIT $1").
+		WithArgs(100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_key", "payload", "attempts", "created_at", "last_error"}).
+			AddRow(1, "42", []byte(`{"type":"product.created"}`), 1, at, "connection refused"))
+	events, err := outbox.Due(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("Due: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != 1 || events[0].Key != "42" || string(events[0].Payload) != `{"type":"product.created"}` || events[0].Attempts != 1 {
+		t.Errorf("unexpected events %+v", events)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresOutbox_RetryAndDelete(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	outbox := NewPostgresOutbox(pg)
+
+	next := time.Date(2024, 1, 2, 3, 5, 0, 0, time.UTC)
+	mockSQL.ExpectExec("UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3 WHERE id = $1").
+		WithArgs(int64(1), next, "timeout").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectExec("DELETE FROM outbox WHERE id = $1").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := outbox.Retry(context.Background(), 1, next, "timeout"); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if err := outbox.Delete(context.Background(), 1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Product is a row of the products table as returned by the API.
+type Product struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Price       *float64  `json:"price"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Category is the category the product is in, if any.
+	Category *ProductCategory `json:"category,omitempty"`
+	// DeletedAt is when the product was deleted. It is only read for
+	// listings that include deleted products.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// ProductCategory is the category of a product, as read with it.
+type ProductCategory struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// ProductInput is the writable part of a product. Callers validate it; a
+// CategoryID naming no category fails the write with ErrForeignKey.
+type ProductInput struct {
+	Name        string
+	Description string
+	Price       float64
+	CategoryID  *int64
+}
+
+// productSorts maps the accepted sort names to ORDER BY clauses. Only these
+// strings are ever interpolated into SQL; id breaks ties so that offset
+// pages are stable.
+var productSorts = map[string]string{
+	"id":              "p.id",
+	"id_desc":         "p.id DESC",
+	"name":            "p.name, p.id",
+	"name_desc":       "p.name DESC, p.id",
+	"price":           "p.price, p.id",
+	"price_desc":      "p.price DESC, p.id",
+	"created_at":      "p.created_at, p.id",
+	"created_at_desc": "p.created_at DESC, p.id",
+}
+
+// DefaultProductSort orders products by id.
+const DefaultProductSort = "id"
+
+// IsProductSort reports whether name is a sort ProductFilter accepts.
+func IsProductSort(name string) bool {
+	_, ok := productSorts[name]
+	return ok
+}
+
+// ProductFilter narrows and orders a product listing. The zero value matches
+// every product, ordered by id.
+type ProductFilter struct {
+	// Query matches product names containing it, case-insensitively.
+	Query    string
+	MinPrice *float64
+	MaxPrice *float64
+	// Category matches the products in the category with this slug.
+	Category string
+	// Sort is one of the names IsProductSort accepts.
+	Sort string
+	// IncludeDeleted also matches deleted products that have not been
+	// purged yet, and reads their DeletedAt.
+	IncludeDeleted bool
+}
+
+// ProductList selects a page of products.
+type ProductList struct {
+	Filter ProductFilter
+	Limit  int
+	// Offset skips that many products in Filter's order.
+	Offset int
+	// Keyset, when set, returns products with an id greater than AfterID
+	// in id order instead, ignoring Offset and Filter.Sort.
+	Keyset  bool
+	AfterID int64
+}
+
+// ProductStore reads and writes products. Deleted products are kept until
+// purged but, unless a filter includes them, are invisible to every other
+// method: they are not listed, found or updated.
+type ProductStore interface {
+	List(ctx context.Context, l ProductList) ([]Product, error)
+	// Stream calls fn with every product matching f, in f's order, as the
+	// rows are read, and stops at the first error fn returns.
+	Stream(ctx context.Context, f ProductFilter, fn func(Product) error) error
+	// Count returns the number of products matching f.
+	Count(ctx context.Context, f ProductFilter) (int64, error)
+	// Get returns ErrNotFound if there is no product with the given id.
+	Get(ctx context.Context, id int64) (Product, error)
+	// GetMany returns those of the products with the given ids that exist,
+	// in no particular order.
+	GetMany(ctx context.Context, ids []int64) ([]Product, error)
+	// Create returns the product as stored, with its id and creation time.
+	Create(ctx context.Context, in ProductInput) (Product, error)
+	// CreateMany inserts products all or nothing and returns their ids in
+	// the order given.
+	CreateMany(ctx context.Context, in []ProductInput) ([]int64, error)
+	// Update replaces the product with the given id and returns it as
+	// stored, or ErrNotFound.
+	Update(ctx context.Context, id int64, in ProductInput) (Product, error)
+	// Delete marks the product with the given id deleted. Deleting a
+	// product that does not exist is not an error.
+	Delete(ctx context.Context, id int64) error
+	// Restore undoes the deletion of the product with the given id and
+	// returns it, or ErrNotFound if it is not deleted, was purged or never
+	// existed.
+	Restore(ctx context.Context, id int64) (Product, error)
+	// Purge removes the products deleted before the given time, except
+	// those still referenced by an order, and returns how many it removed.
+	Purge(ctx context.Context, before time.Time) (int64, error)
+	// Search returns a page of the products matching a full-text query,
+	// most relevant first.
+	Search(ctx context.Context, q ProductSearch) ([]ProductMatch, error)
+}
+
+// productColumns are the columns of a product and its category, selected
+// from productsJoin. Queries alias products as p.
+const productColumns = "p.id, p.name, p.description, p.price, p.created_at, c.id, c.name"
+
+// categoryJoin joins the category of each product p, if it has one.
+const categoryJoin = " LEFT JOIN categories c ON c.id = p.category_id"
+
+// productsJoin is the products table with each product's category.
+const productsJoin = "products p" + categoryJoin
+
+// productLive is the condition matching products that are not deleted.
+const productLive = "deleted_at IS NULL"
+
+// InsertBatchSize is how many products CreateMany inserts per statement.
+// At four parameters a row it stays far below Postgres's limit of 65535.
+const InsertBatchSize = 500
+
+// PostgresProducts is the ProductStore backed by the products table.
+type PostgresProducts struct {
+	pg Postgres
+}
+
+// NewPostgresProducts returns a ProductStore using pg.
+func NewPostgresProducts(pg Postgres) *PostgresProducts {
+	return &PostgresProducts{pg: pg}
+}
+
+// scanProduct reads a row selected with productColumns, followed by
+// deleted_at if withDeleted is set, and then by the columns extra scans
+// into.
+func scanProduct(row interface{ Scan(...any) error }, withDeleted bool, extra ...any) (Product, error) {
+	var p Product
+	var price sql.NullFloat64
+	var categoryID sql.NullInt64
+	var categoryName sql.NullString
+	var deleted sql.NullTime
+	dest := []any{&p.ID, &p.Name, &p.Description, &price, &p.CreatedAt, &categoryID, &categoryName}
+	if withDeleted {
+		dest = append(dest, &deleted)
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return Product{}, err
+	}
+	if price.Valid {
+		p.Price = &price.Float64
+	}
+	if categoryID.Valid {
+		p.Category = &ProductCategory{ID: categoryID.Int64, Name: categoryName.String}
+	}
+	if deleted.Valid {
+		p.DeletedAt = &deleted.Time
+	}
+	return p, nil
+}
+
+func (s *PostgresProducts) List(ctx context.Context, l ProductList) ([]Product, error) {
+	where, args := l.Filter.where(nil)
+	if !l.Keyset {
+		query := fmt.Sprintf("SELECT %s FROM %s%s%s LIMIT $%d OFFSET $%d",
+			l.Filter.columns(), productsJoin, where, l.Filter.orderBy(), len(args)+1, len(args)+2)
+		return s.query(ctx, queryListProducts, l.Filter.IncludeDeleted, query, append(args, l.Limit, l.Offset)...)
+	}
+
+	args = append(args, l.AfterID)
+	if where == "" {
+		where = " WHERE "
+	} else {
+		where += " AND "
+	}
+	where += fmt.Sprintf("p.id > $%d", len(args))
+	query := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY p.id LIMIT $%d",
+		l.Filter.columns(), productsJoin, where, len(args)+1)
+	return s.query(ctx, queryListProducts, l.Filter.IncludeDeleted, query, append(args, l.Limit)...)
+}
+
+// query runs q, a query selecting productColumns, followed by deleted_at if
+// withDeleted is set. Rows that fail to scan are logged and skipped.
+func (s *PostgresProducts) query(ctx context.Context, q dbQuery, withDeleted bool, query string, args ...any) (products []Product, err error) {
+	err = s.pg.read(ctx, func(db *sql.DB, pool string) (err error) {
+		ctx, end := s.pg.startQueryOn(ctx, q, pool, query)
+		defer end(&err)
+
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		products = []Product{}
+		for rows.Next() {
+			p, err := scanProduct(rows, withDeleted)
+			if err != nil {
+				s.pg.Logger.ErrorContext(ctx, "Row scan failed", "err", err)
+				continue
+			}
+			products = append(products, p)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+func (s *PostgresProducts) Stream(ctx context.Context, f ProductFilter, fn func(Product) error) error {
+	where, args := f.where(nil)
+	query := "SELECT " + f.columns() + " FROM " + productsJoin + where + f.orderBy()
+
+	// Once fn has seen a row, a failure must not send the query to the
+	// primary: the caller would see those rows twice.
+	var sent bool
+	var streamErr error
+	err := s.pg.read(ctx, func(db *sql.DB, pool string) error {
+		err := s.stream(ctx, db, pool, query, args, f.IncludeDeleted, func(p Product) error {
+			sent = true
+			return fn(p)
+		})
+		if err != nil && sent {
+			streamErr = err
+			return nil
+		}
+		return err
+	})
+	if streamErr != nil {
+		return streamErr
+	}
+	return err
+}
+
+// stream runs a query selecting productColumns, and deleted_at if
+// withDeleted is set, on db and calls fn with each row. Rows that fail to
+// scan are logged and skipped, as in query.
+func (s *PostgresProducts) stream(ctx context.Context, db *sql.DB, pool, query string, args []any, withDeleted bool, fn func(Product) error) (err error) {
+	ctx, end := s.pg.startQueryOn(ctx, queryStreamProducts, pool, query)
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProduct(rows, withDeleted)
+		if err != nil {
+			s.pg.Logger.ErrorContext(ctx, "Row scan failed", "err", err)
+			continue
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *PostgresProducts) Count(ctx context.Context, f ProductFilter) (n int64, err error) {
+	where, args := f.where(nil)
+	query := "SELECT COUNT(*) FROM products p" + where
+
+	err = s.pg.read(ctx, func(db *sql.DB, pool string) (err error) {
+		ctx, end := s.pg.startQueryOn(ctx, queryCountProducts, pool, query)
+		defer end(&err)
+
+		return db.QueryRowContext(ctx, query, args...).Scan(&n)
+	})
+	return n, err
+}
+
+func (s *PostgresProducts) Get(ctx context.Context, id int64) (p Product, err error) {
+	err = s.pg.read(ctx, func(db *sql.DB, pool string) (err error) {
+		p, err = s.get(ctx, db, pool, id)
+		return err
+	})
+	return p, notFound(err)
+}
+
+func (s *PostgresProducts) GetMany(ctx context.Context, ids []int64) ([]Product, error) {
+	const query = "SELECT " + productColumns + " FROM " + productsJoin + " WHERE p.id = ANY($1) AND p." + productLive
+	return s.query(ctx, queryGetProducts, false, query, pq.Array(ids))
+}
+
+// get reads one product from db, returning sql.ErrNoRows if it is missing.
+func (s *PostgresProducts) get(ctx context.Context, db *sql.DB, pool string, id int64) (_ Product, err error) {
+	const query = "SELECT " + productColumns + " FROM " + productsJoin + " WHERE p.id = $1 AND p." + productLive
+
+	ctx, end := s.pg.startQueryOn(ctx, queryGetProduct, pool, query)
+	defer end(&err)
+
+	return scanProduct(db.QueryRowContext(ctx, query, id), false)
+}
+
+// Create reads the new row back with its category in the same statement.
+func (s *PostgresProducts) Create(ctx context.Context, in ProductInput) (_ Product, err error) {
+	const query = "WITH p AS (INSERT INTO products (name, description, price, category_id) VALUES ($1, $2, $3, $4) RETURNING *) " +
+		"SELECT " + productColumns + " FROM p" + categoryJoin
+
+	ctx, end := s.pg.startQuery(ctx, queryCreateProduct, query)
+	defer end(&err)
+
+	return scanProduct(s.pg.DB.QueryRowContext(ctx, query, in.Name, in.Description, in.Price, in.CategoryID), false)
+}
+
+// CreateMany runs in a single transaction, with one multi-row INSERT per
+// InsertBatchSize products.
+func (s *PostgresProducts) CreateMany(ctx context.Context, in []ProductInput) (_ []int64, err error) {
+	tx, err := s.pg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	ids := make([]int64, 0, len(in))
+	for batch := range slices.Chunk(in, InsertBatchSize) {
+		if ids, err = s.insertBatch(ctx, tx, batch, ids); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// insertBatch inserts products with one statement and appends their ids to
+// ids. Postgres returns the rows of a multi-row VALUES list in order.
+func (s *PostgresProducts) insertBatch(ctx context.Context, tx *sql.Tx, products []ProductInput, ids []int64) (_ []int64, err error) {
+	var query strings.Builder
+	query.WriteString("INSERT INTO products (name, description, price, category_id) VALUES ")
+	args := make([]any, 0, 4*len(products))
+	for i, p := range products {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3, len(args)+4)
+		args = append(args, p.Name, p.Description, p.Price, p.CategoryID)
+	}
+	query.WriteString(" RETURNING id")
+
+	ctx, end := s.pg.startQuery(ctx, queryCreateProducts, query.String())
+	defer end(&err)
+
+	rows, err := tx.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *PostgresProducts) Update(ctx context.Context, id int64, in ProductInput) (Product, error) {
+	const query = "UPDATE products SET name = $1, description = $2, price = $3, category_id = $4 WHERE id = $5 AND " + productLive
+
+	queryCtx, end := s.pg.startQuery(ctx, queryUpdateProduct, query)
+	var n int64
+	res, err := s.pg.DB.ExecContext(queryCtx, query, in.Name, in.Description, in.Price, in.CategoryID, id)
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	end(&err)
+
+	switch {
+	case err != nil:
+		return Product{}, err
+	case n == 0:
+		return Product{}, ErrNotFound
+	}
+	// From the primary: the replica may not have the update yet.
+	p, err := s.get(ctx, s.pg.DB, PoolPrimary, id)
+	return p, notFound(err)
+}
+
+// Delete keeps the row, stamped with deleted_at, for Restore until Purge
+// removes it.
+func (s *PostgresProducts) Delete(ctx context.Context, id int64) (err error) {
+	const query = "UPDATE products SET deleted_at = now() WHERE id = $1 AND " + productLive
+
+	ctx, end := s.pg.startQuery(ctx, queryDeleteProduct, query)
+	defer end(&err)
+
+	_, err = s.pg.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+func (s *PostgresProducts) Restore(ctx context.Context, id int64) (_ Product, err error) {
+	const query = "WITH p AS (UPDATE products SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL RETURNING *) " +
+		"SELECT " + productColumns + " FROM p" + categoryJoin
+
+	ctx, end := s.pg.startQuery(ctx, queryRestoreProduct, query)
+	defer end(&err)
+
+	p, err := scanProduct(s.pg.DB.QueryRowContext(ctx, query, id), false)
+	return p, notFound(err)
+}
+
+// Purge keeps products an order refers to: order_items has no ON DELETE
+// action, so removing them would fail the whole statement.
+func (s *PostgresProducts) Purge(ctx context.Context, before time.Time) (n int64, err error) {
+	const query = "DELETE FROM products WHERE deleted_at < $1" +
+		" AND NOT EXISTS (SELECT 1 FROM order_items WHERE order_items.product_id = products.id)"
+
+	ctx, end := s.pg.startQuery(ctx, queryPurgeProducts, query)
+	defer end(&err)
+
+	res, err := s.pg.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// columns returns the columns the filter's listings select.
+func (f ProductFilter) columns() string {
+	if f.IncludeDeleted {
+		return productColumns + ", p.deleted_at"
+	}
+	return productColumns
+}
+
+// where returns the WHERE clause for the filter, numbering its placeholders
+// after args and appending their values to it. User input only ever reaches
+// the database as a placeholder value.
+func (f ProductFilter) where(args []any) (string, []any) {
+	var conds []string
+	if !f.IncludeDeleted {
+		conds = append(conds, "p."+productLive)
+	}
+	add := func(cond string, v any) {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Query != "" {
+		add("p.name ILIKE $%d", "%"+escapeLike(f.Query)+"%")
+	}
+	if f.MinPrice != nil {
+		add("p.price >= $%d", *f.MinPrice)
+	}
+	if f.MaxPrice != nil {
+		add("p.price <= $%d", *f.MaxPrice)
+	}
+	if f.Category != "" {
+		// A subquery rather than the join, so that Count needs none.
+		add("p.category_id = (SELECT id FROM categories WHERE slug = $%d)", f.Category)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// orderBy returns the ORDER BY clause for the filter's sort.
+func (f ProductFilter) orderBy() string {
+	if clause, ok := productSorts[f.Sort]; ok {
+		return " ORDER BY " + clause
+	}
+	return " ORDER BY " + productSorts[DefaultProductSort]
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike makes s match literally inside an ILIKE pattern.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,495 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const selectProducts = "SELECT p.id, p.name, p.description, p.price, p.created_at, c.id, c.name FROM products p LEFT JOIN categories c ON c.id = p.category_id"
+
+var productRowColumns = []string{"id", "name", "description", "price", "created_at", "id", "name"}
+
+func ptr(f float64) *float64 { return &f }
+
+func TestPostgresProducts_ListBuildsFilteredQueries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		list      ProductList
+		listSQL   string
+		listArgs  []driver.Value
+		countSQL  string
+		countArgs []driver.Value
+	}{
+		{
+			name:      "search with price range and sort",
+			list:      ProductList{Filter: ProductFilter{Query: "chair", MinPrice: ptr(10), MaxPrice: ptr(100), Sort: "price_desc"}, Limit: 50},
+			listSQL:   selectProducts + " WHERE p.deleted_at IS NULL AND p.name ILIKE $1 AND p.price >= $2 AND p.price <= $3 ORDER BY p.price DESC, p.id LIMIT $4 OFFSET $5",
+			listArgs:  []driver.Value{"%chair%", 10.0, 100.0, 50, 0},
+			countSQL:  "SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL AND p.name ILIKE $1 AND p.price >= $2 AND p.price <= $3",
+			countArgs: []driver.Value{"%chair%", 10.0, 100.0},
+		},
+		{
+			name:      "max price only",
+			list:      ProductList{Filter: ProductFilter{MaxPrice: ptr(5.5)}, Limit: 10},
+			listSQL:   selectProducts + " WHERE p.deleted_at IS NULL AND p.price <= $1 ORDER BY p.id LIMIT $2 OFFSET $3",
+			listArgs:  []driver.Value{5.5, 10, 0},
+			countSQL:  "SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL AND p.price <= $1",
+			countArgs: []driver.Value{5.5},
+		},
+		{
+			name:     "sort by name without filters",
+			list:     ProductList{Filter: ProductFilter{Sort: "name_desc"}, Limit: 50, Offset: 20},
+			listSQL:  selectProducts + " WHERE p.deleted_at IS NULL ORDER BY p.name DESC, p.id LIMIT $1 OFFSET $2",
+			listArgs: []driver.Value{50, 20},
+			countSQL: "SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL",
+		},
+		{
+			name:      "LIKE wildcards match literally",
+			list:      ProductList{Filter: ProductFilter{Query: `50%_off\`}, Limit: 50},
+			listSQL:   selectProducts + " WHERE p.deleted_at IS NULL AND p.name ILIKE $1 ORDER BY p.id LIMIT $2 OFFSET $3",
+			listArgs:  []driver.Value{`%50\%\_off\\%`, 50, 0},
+			countSQL:  "SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL AND p.name ILIKE $1",
+			countArgs: []driver.Value{`%50\%\_off\\%`},
+		},
+		{
+			name:      "injection stays a parameter",
+			list:      ProductList{Filter: ProductFilter{Query: `x' OR '1'='1'; DROP TABLE products; --`}, Limit: 50},
+			listSQL:   selectProducts + " WHERE p.deleted_at IS NULL AND p.name ILIKE $1 ORDER BY p.id LIMIT $2 OFFSET $3",
+			listArgs:  []driver.Value{`%x' OR '1'='1'; DROP TABLE products; --%`, 50, 0},
+			countSQL:  "SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL AND p.name ILIKE $1",
+			countArgs: []driver.Value{`%x' OR '1'='1'; DROP TABLE products; --%`},
+		},
+		{
+			name:     "unknown sort falls back to id",
+			list:     ProductList{Filter: ProductFilter{Sort: "price;DROP TABLE products"}, Limit: 5},
+			listSQL:  selectProducts + " WHERE p.deleted_at IS NULL ORDER BY p.id LIMIT $1 OFFSET $2",
+			listArgs: []driver.Value{5, 0},
+			countSQL: "SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			pg, mockSQL := newTestPostgres(t)
+			products := NewPostgresProducts(pg)
+
+			mockSQL.ExpectQuery(tt.listSQL).WithArgs(tt.listArgs...).
+				WillReturnRows(sqlmock.NewRows(productRowColumns))
+			mockSQL.ExpectQuery(tt.countSQL).WithArgs(tt.countArgs...).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+			if got, err := products.List(context.Background(), tt.list); err != nil || got == nil || len(got) != 0 {
+				t.Errorf("expected an empty, non-nil list, got %v, %v", got, err)
+			}
+			if _, err := products.Count(context.Background(), tt.list.Filter); err != nil {
+				t.Errorf("count: %v", err)
+			}
+			if err := mockSQL.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestPostgresProducts_ListKeyset(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mockSQL.ExpectQuery(selectProducts+" WHERE p.deleted_at IS NULL AND p.id > $1 ORDER BY p.id LIMIT $2").
+		WithArgs(int64(4), 3).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).
+			AddRow(5, "Lamp", "", 12.5, created, nil, nil).
+			AddRow(6, "Rug", "", nil, created, nil, nil))
+	mockSQL.ExpectQuery(selectProducts+" WHERE p.deleted_at IS NULL AND p.price >= $1 AND p.id > $2 ORDER BY p.id LIMIT $3").
+		WithArgs(10.0, int64(0), 3).
+		WillReturnRows(sqlmock.NewRows(productRowColumns))
+
+	got, err := products.List(context.Background(), ProductList{Limit: 3, Offset: 40, Keyset: true, AfterID: 4, Filter: ProductFilter{Sort: "name"}})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != 5 || *got[0].Price != 12.5 || got[1].Price != nil || !got[1].CreatedAt.Equal(created) {
+		t.Errorf("unexpected products %+v", got)
+	}
+	if _, err := products.List(context.Background(), ProductList{Limit: 3, Keyset: true, Filter: ProductFilter{MinPrice: ptr(10)}}); err != nil {
+		t.Fatalf("List with filter: %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresProducts_ListSkipsBadRowsAndTimesQuery(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+
+	mockSQL.ExpectQuery(selectProducts+" WHERE p.deleted_at IS NULL ORDER BY p.id LIMIT $1 OFFSET $2").
+		WithArgs(50, 0).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).
+			AddRow(1, "Chair", "", 49.5, time.Now(), nil, nil).
+			AddRow("not-an-id", "Broken", "", 1.0, time.Now(), nil, nil))
+
+	got, err := products.List(context.Background(), ProductList{Limit: 50})
+	if err != nil || len(got) != 1 || got[0].Name != "Chair" {
+		t.Errorf("expected only the good row, got %+v, %v", got, err)
+	}
+	if n := testutil.CollectAndCount(pg.QueryDuration, "db_query_duration_seconds"); n != 1 {
+		t.Errorf("expected one timed query, got %d series", n)
+	}
+}
+
+func TestPostgresProducts_StreamCallsFnPerRow(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.deleted_at IS NULL AND p.price >= $1 ORDER BY p.name, p.id").WithArgs(10.0).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).
+			AddRow(2, "Chair", "", 49.5, time.Now(), nil, nil).
+			AddRow("not-an-id", "Broken", "", 1.0, time.Now(), nil, nil).
+			AddRow(1, "Lamp", "", 12.5, time.Now(), nil, nil))
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.deleted_at IS NULL ORDER BY p.id").
+		WillReturnRows(productRowsN(3))
+
+	var got []int64
+	err := products.Stream(context.Background(), ProductFilter{MinPrice: ptr(10), Sort: "name"}, func(p Product) error {
+		got = append(got, p.ID)
+		return nil
+	})
+	if err != nil || len(got) != 2 || got[0] != 2 || got[1] != 1 {
+		t.Errorf("expected products 2 and 1, got %v, %v", got, err)
+	}
+
+	// An error from fn ends the stream and is returned as it is.
+	stop := errors.New("client went away")
+	calls := 0
+	err = products.Stream(context.Background(), ProductFilter{}, func(Product) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("expected the stream to stop after one call with fn's error, got %d calls, %v", calls, err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func productRowsN(n int) *sqlmock.Rows {
+	rows := sqlmock.NewRows(productRowColumns)
+	for i := 1; i <= n; i++ {
+		rows.AddRow(i, "Chair", "", 49.5, time.Now(), nil, nil)
+	}
+	return rows
+}
+
+func TestPostgresProducts_GetAndUpdateNotFound(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.id = $1 AND p.deleted_at IS NULL").WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(productRowColumns))
+	mockSQL.ExpectExec("UPDATE products SET name = $1, description = $2, price = $3, category_id = $4 WHERE id = $5 AND deleted_at IS NULL").
+		WithArgs("Desk", "", 10.0, nil, int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := products.Get(context.Background(), 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if _, err := products.Update(context.Background(), 9, ProductInput{Name: "Desk", Price: 10}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update: expected ErrNotFound, got %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresProducts_GetMany(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.id = ANY($1) AND p.deleted_at IS NULL").WithArgs("{7,8,9}").
+		WillReturnRows(sqlmock.NewRows(productRowColumns).
+			AddRow(9, "Desk", "", 120.0, time.Now(), nil, nil).
+			AddRow(7, "Chair", "", 49.5, time.Now(), nil, nil))
+
+	got, err := products.GetMany(context.Background(), []int64{7, 8, 9})
+	if err != nil {
+		t.Fatalf("GetMany: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != 9 || got[1].ID != 7 {
+		t.Errorf("expected the existing products 9 and 7, got %+v", got)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresProducts_Writes(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	in := ProductInput{Name: "Chair", Description: "Oak", Price: 49.5}
+
+	mockSQL.ExpectQuery("WITH p AS (INSERT INTO products (name, description, price, category_id) VALUES ($1, $2, $3, $4) RETURNING *) "+
+		"SELECT p.id, p.name, p.description, p.price, p.created_at, c.id, c.name FROM p LEFT JOIN categories c ON c.id = p.category_id").
+		WithArgs("Chair", "Oak", 49.5, nil).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(12, "Chair", "Oak", 49.5, created, nil, nil))
+	mockSQL.ExpectExec("UPDATE products SET name = $1, description = $2, price = $3, category_id = $4 WHERE id = $5 AND deleted_at IS NULL").
+		WithArgs("Chair", "Oak", 49.5, nil, int64(12)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.id = $1 AND p.deleted_at IS NULL").WithArgs(int64(12)).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(12, "Chair", "Oak", 49.5, created, nil, nil))
+	mockSQL.ExpectExec("UPDATE products SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL").WithArgs(int64(12)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	p, err := products.Create(context.Background(), in)
+	if err != nil || p.ID != 12 || !p.CreatedAt.Equal(created) || *p.Price != 49.5 || p.Category != nil {
+		t.Errorf("Create: got %+v, %v", p, err)
+	}
+	if p, err := products.Update(context.Background(), 12, in); err != nil || p.Description != "Oak" {
+		t.Errorf("Update: got %+v, %v", p, err)
+	}
+	if err := products.Delete(context.Background(), 12); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresProducts_ReadsJoinTheCategory(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mockSQL.ExpectQuery(selectProducts+" WHERE p.deleted_at IS NULL AND p.category_id = (SELECT id FROM categories WHERE slug = $1) ORDER BY p.id LIMIT $2 OFFSET $3").
+		WithArgs("chairs", 50, 0).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).
+			AddRow(1, "Chair", "", 49.5, created, 4, "Chairs").
+			AddRow(2, "Stool", "", 19.5, created, 4, "Chairs"))
+	mockSQL.ExpectQuery("SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL AND p.category_id = (SELECT id FROM categories WHERE slug = $1)").
+		WithArgs("chairs").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.id = $1 AND p.deleted_at IS NULL").WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(3, "Lamp", "", 12.5, created, nil, nil))
+
+	ctx := context.Background()
+	f := ProductFilter{Category: "chairs"}
+	got, err := products.List(ctx, ProductList{Filter: f, Limit: 50})
+	if err != nil || len(got) != 2 {
+		t.Fatalf("List: got %+v, %v", got, err)
+	}
+	if c := got[1].Category; c == nil || c.ID != 4 || c.Name != "Chairs" {
+		t.Errorf("expected product 2 in category 4, Chairs; got %+v", c)
+	}
+	if n, err := products.Count(ctx, f); err != nil || n != 2 {
+		t.Errorf("Count: got %d, %v", n, err)
+	}
+	if p, err := products.Get(ctx, 3); err != nil || p.Category != nil {
+		t.Errorf("expected product 3 in no category, got %+v, %v", p, err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresProducts_WriteToMissingCategory(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+	category := int64(99)
+
+	mockSQL.ExpectExec("UPDATE products SET name = $1, description = $2, price = $3, category_id = $4 WHERE id = $5 AND deleted_at IS NULL").
+		WithArgs("Chair", "", 49.5, int64(99), int64(1)).
+		WillReturnError(&pq.Error{Code: "23503"})
+
+	if _, err := products.Update(context.Background(), 1, ProductInput{Name: "Chair", Price: 49.5, CategoryID: &category}); !errors.Is(err, ErrForeignKey) {
+		t.Errorf("expected ErrForeignKey, got %v", err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresProducts_ListIncludingDeleted(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	deleted := created.Add(time.Hour)
+
+	mockSQL.ExpectQuery("SELECT p.id, p.name, p.description, p.price, p.created_at, c.id, c.name, p.deleted_at FROM products p LEFT JOIN categories c ON c.id = p.category_id WHERE p.name ILIKE $1 ORDER BY p.id LIMIT $2 OFFSET $3").
+		WithArgs("%chair%", 50, 0).
+		WillReturnRows(sqlmock.NewRows(append(productRowColumns, "deleted_at")).
+			AddRow(1, "Chair", "", 49.5, created, nil, nil, nil).
+			AddRow(2, "Armchair", "", 99.0, created, nil, nil, deleted))
+	mockSQL.ExpectQuery("SELECT COUNT(*) FROM products p WHERE p.name ILIKE $1").WithArgs("%chair%").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	f := ProductFilter{Query: "chair", IncludeDeleted: true}
+	got, err := products.List(context.Background(), ProductList{Filter: f, Limit: 50})
+	if err != nil || len(got) != 2 {
+		t.Fatalf("List: got %+v, %v", got, err)
+	}
+	if got[0].DeletedAt != nil || got[1].DeletedAt == nil || !got[1].DeletedAt.Equal(deleted) {
+		t.Errorf("expected only product 2 deleted, at %v; got %v and %v", deleted, got[0].DeletedAt, got[1].DeletedAt)
+	}
+	if n, err := products.Count(context.Background(), f); err != nil || n != 2 {
+		t.Errorf("Count: got %d, %v", n, err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresProducts_RestoreAndPurge(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cutoff := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	const restore = "WITH p AS (UPDATE products SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL RETURNING *) " +
+		"SELECT p.id, p.name, p.description, p.price, p.created_at, c.id, c.name FROM p LEFT JOIN categories c ON c.id = p.category_id"
+	mockSQL.ExpectQuery(restore).WithArgs(int64(12)).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(12, "Chair", "Oak", 49.5, created, nil, nil))
+	mockSQL.ExpectQuery(restore).WithArgs(int64(13)).
+		WillReturnRows(sqlmock.NewRows(productRowColumns))
+	mockSQL.ExpectQuery(restore).WithArgs(int64(14)).
+		WillReturnRows(sqlmock.NewRows(productRowColumns))
+	mockSQL.ExpectExec("DELETE FROM products WHERE deleted_at < $1 AND NOT EXISTS (SELECT 1 FROM order_items WHERE order_items.product_id = products.id)").
+		WithArgs(cutoff).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	if p, err := products.Restore(context.Background(), 12); err != nil || p.ID != 12 || p.DeletedAt != nil {
+		t.Errorf("Restore: got %+v, %v", p, err)
+	}
+	if _, err := products.Restore(context.Background(), 13); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Restore of a purged product: expected ErrNotFound, got %v", err)
+	}
+	if _, err := products.Restore(context.Background(), 14); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Restore of a product that is not deleted: expected ErrNotFound, got %v", err)
+	}
+	if n, err := products.Purge(context.Background(), cutoff); err != nil || n != 3 {
+		t.Errorf("Purge: got %d, %v", n, err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+// expectInsertBatch expects the multi-row INSERT of products numbered
+// first to first+n-1 and answers with ids equal to their numbers.
+func expectInsertBatch(mockSQL sqlmock.Sqlmock, first, n int) *sqlmock.ExpectedQuery {
+	var query strings.Builder
+	query.WriteString("INSERT INTO products (name, description, price, category_id) VALUES ")
+	args := make([]driver.Value, 0, 4*n)
+	rows := sqlmock.NewRows([]string{"id"})
+	for i := range n {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d)", 4*i+1, 4*i+2, 4*i+3, 4*i+4)
+		args = append(args, fmt.Sprintf("Product %d", first+i), "", 1.0, nil)
+		rows.AddRow(first + i)
+	}
+	query.WriteString(" RETURNING id")
+	return mockSQL.ExpectQuery(query.String()).WithArgs(args...).WillReturnRows(rows)
+}
+
+func numberedInputs(n int) []ProductInput {
+	in := make([]ProductInput, n)
+	for i := range in {
+		in[i] = ProductInput{Name: fmt.Sprintf("Product %d", i+1), Price: 1}
+	}
+	return in
+}
+
+func TestPostgresProducts_CreateManyBatchesInOneTransaction(t *testing.T) {
+	t.Parallel()
+	for _, n := range []int{1, InsertBatchSize, InsertBatchSize + 1, 2*InsertBatchSize + 3} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			t.Parallel()
+			pg, mockSQL := newTestPostgres(t)
+			products := NewPostgresProducts(pg)
+
+			mockSQL.ExpectBegin()
+			for first := 1; first <= n; first += InsertBatchSize {
+				expectInsertBatch(mockSQL, first, min(InsertBatchSize, n-first+1))
+			}
+			mockSQL.ExpectCommit()
+
+			ids, err := products.CreateMany(context.Background(), numberedInputs(n))
+			if err != nil || len(ids) != n || ids[0] != 1 || ids[n-1] != int64(n) {
+				t.Errorf("expected ids 1 to %d, got %d ids, %v", n, len(ids), err)
+			}
+			if err := mockSQL.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestPostgresProducts_CreateManyRollsBackOnError(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+
+	mockSQL.ExpectBegin()
+	expectInsertBatch(mockSQL, 1, InsertBatchSize)
+	expectInsertBatch(mockSQL, InsertBatchSize+1, 1).WillReturnError(errors.New("disk full"))
+	mockSQL.ExpectRollback()
+
+	if ids, err := products.CreateMany(context.Background(), numberedInputs(InsertBatchSize+1)); err == nil || ids != nil {
+		t.Errorf("expected an error and no ids, got %v, %v", ids, err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresProducts_SlowQueryTimesOut(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	pg.QueryTimeout = 20 * time.Millisecond
+	products := NewPostgresProducts(pg)
+
+	mockSQL.ExpectQuery("SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	start := time.Now()
+	if _, err := products.Count(context.Background(), ProductFilter{}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the query to be abandoned at its timeout, took %v", elapsed)
+	}
+}
+
+func TestPostgresProducts_StatementTimeoutIsATimeout(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.id = $1 AND p.deleted_at IS NULL").WithArgs(int64(1)).
+		WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+	mockSQL.ExpectQuery(selectProducts + " WHERE p.id = $1 AND p.deleted_at IS NULL").WithArgs(int64(1)).
+		WillReturnError(errors.New("connection reset by peer"))
+
+	if _, err := products.Get(context.Background(), 1); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+	if _, err := products.Get(context.Background(), 1); err == nil || errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a plain error, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Pool names, as reported in the pool label of db_query_duration_seconds.
+const (
+	PoolPrimary = "primary"
+	PoolReplica = "replica"
+)
+
+// replicaPingTimeout bounds the ping that decides whether a failed read on
+// the replica is retried on the primary.
+const replicaPingTimeout = time.Second
+
+// Replica is a read-only Postgres pool for reads that tolerate replication
+// lag. While it is down, reads go to the primary instead.
+type Replica struct {
+	DB *sql.DB
+	// retryAfter is how long the replica is avoided after a failed ping.
+	retryAfter time.Duration
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+// NewReplica returns a Replica using db that, once a ping fails, is left
+// alone for retryAfter before reads try it again.
+func NewReplica(db *sql.DB, retryAfter time.Duration) *Replica {
+	return &Replica{DB: db, retryAfter: retryAfter}
+}
+
+// Ping checks the replica and records the result: a failure sends reads to
+// the primary, a success sends them back.
+func (r *Replica) Ping(ctx context.Context) error {
+	err := r.DB.PingContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.downUntil = time.Now().Add(r.retryAfter)
+	} else {
+		r.downUntil = time.Time{}
+	}
+	return err
+}
+
+// up reports whether reads should try the replica. A nil Replica is never
+// up.
+func (r *Replica) up() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !time.Now().Before(r.downUntil)
+}
+
+// read runs fn on the replica while it is up, and on the primary otherwise.
+// A read that fails on the replica is retried on the primary if the replica
+// then fails a ping too; errors from a replica that still answers are the
+// caller's. Writes, and reads that must see them, such as SELECT ... FOR
+// UPDATE, go to pg.DB directly.
+func (pg Postgres) read(ctx context.Context, fn func(db *sql.DB, pool string) error) error {
+	if pg.Replica.up() {
+		err := fn(pg.Replica.DB, PoolReplica)
+		if err == nil || errors.Is(err, sql.ErrNoRows) || ctx.Err() != nil {
+			return err
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, replicaPingTimeout)
+		defer cancel()
+		if pg.Replica.Ping(pingCtx) == nil {
+			return err
+		}
+		pg.Logger.WarnContext(ctx, "Replica is down, reading from the primary", "err", err)
+	}
+	return fn(pg.DB, PoolPrimary)
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const getProduct = selectProducts + " WHERE p.id = $1 AND p.deleted_at IS NULL"
+
+// newTestReplica returns a Postgres whose replica is a second sqlmock pool
+// that expects its pings to be set up too.
+func newTestReplica(t *testing.T, retryAfter time.Duration) (Postgres, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	t.Helper()
+	pg, primary := newTestPostgres(t)
+	db, replica, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual), sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	pg.Replica = NewReplica(db, retryAfter)
+	return pg, primary, replica
+}
+
+func productRow(id int64) *sqlmock.Rows {
+	return sqlmock.NewRows(productRowColumns).AddRow(id, "Chair", "", 49.5, time.Now(), nil, nil)
+}
+
+func assertMet(t *testing.T, name string, mock sqlmock.Sqlmock) {
+	t.Helper()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet %s expectations: %v", name, err)
+	}
+}
+
+func TestPostgresProducts_ReadsUseReplicaAndWritesPrimary(t *testing.T) {
+	t.Parallel()
+	pg, primary, replica := newTestReplica(t, time.Minute)
+	products := NewPostgresProducts(pg)
+
+	replica.ExpectQuery(selectProducts+" WHERE p.deleted_at IS NULL ORDER BY p.id LIMIT $1 OFFSET $2").WithArgs(50, 0).WillReturnRows(productRow(1))
+	replica.ExpectQuery("SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	replica.ExpectQuery(getProduct).WithArgs(int64(1)).WillReturnRows(sqlmock.NewRows(productRowColumns))
+	// The update and the read of its result both go to the primary.
+	primary.ExpectExec("UPDATE products SET name = $1, description = $2, price = $3, category_id = $4 WHERE id = $5 AND deleted_at IS NULL").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	primary.ExpectQuery(getProduct).WithArgs(int64(1)).WillReturnRows(productRow(1))
+
+	ctx := context.Background()
+	if got, err := products.List(ctx, ProductList{Limit: 50}); err != nil || len(got) != 1 {
+		t.Errorf("List: got %v, %v", got, err)
+	}
+	if n, err := products.Count(ctx, ProductFilter{}); err != nil || n != 1 {
+		t.Errorf("Count: got %d, %v", n, err)
+	}
+	// A missing row is an answer, not a reason to ask the primary.
+	if _, err := products.Get(ctx, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if _, err := products.Update(ctx, 1, ProductInput{Name: "Chair", Price: 49.5}); err != nil {
+		t.Errorf("Update: %v", err)
+	}
+	assertMet(t, "replica", replica)
+	assertMet(t, "primary", primary)
+
+	for _, tt := range []struct {
+		query, pool string
+		want        uint64
+	}{
+		{"list_products", PoolReplica, 1},
+		{"list_products", PoolPrimary, 0},
+		{"get_product", PoolReplica, 1},
+		{"get_product", PoolPrimary, 1},
+		{"update_product", PoolPrimary, 1},
+	} {
+		if got := observations(t, pg, tt.query, tt.pool); got != tt.want {
+			t.Errorf("%s on %s: observed %d queries, want %d", tt.query, tt.pool, got, tt.want)
+		}
+	}
+}
+
+// observations returns how many queries pg timed for the query and pool.
+func observations(t *testing.T, pg Postgres, query, pool string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := pg.QueryDuration.WithLabelValues(query, pool).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPostgresProducts_FallsBackWhileReplicaIsDown(t *testing.T) {
+	t.Parallel()
+	pg, primary, replica := newTestReplica(t, time.Minute)
+	products := NewPostgresProducts(pg)
+
+	// The first read fails on the replica, which then fails its ping too.
+	replica.ExpectQuery(getProduct).WithArgs(int64(1)).WillReturnError(errors.New("connection refused"))
+	replica.ExpectPing().WillReturnError(errors.New("connection refused"))
+	primary.ExpectQuery(getProduct).WithArgs(int64(1)).WillReturnRows(productRow(1))
+	// Later reads skip the replica until the retry interval has passed.
+	primary.ExpectQuery(getProduct).WithArgs(int64(2)).WillReturnRows(productRow(2))
+
+	for _, id := range []int64{1, 2} {
+		if p, err := products.Get(context.Background(), id); err != nil || p.ID != id {
+			t.Errorf("Get(%d): got %+v, %v", id, p, err)
+		}
+	}
+	assertMet(t, "replica", replica)
+	assertMet(t, "primary", primary)
+}
+
+func TestPostgresProducts_StreamFailingMidwayIsNotRetried(t *testing.T) {
+	t.Parallel()
+	pg, primary, replica := newTestReplica(t, time.Minute)
+	products := NewPostgresProducts(pg)
+
+	lost := errors.New("connection reset")
+	replica.ExpectQuery(selectProducts + " WHERE p.deleted_at IS NULL ORDER BY p.id").
+		WillReturnRows(productRowsN(2).RowError(1, lost))
+
+	var got []int64
+	err := products.Stream(context.Background(), ProductFilter{}, func(p Product) error {
+		got = append(got, p.ID)
+		return nil
+	})
+	if !errors.Is(err, lost) || len(got) != 1 {
+		t.Errorf("expected one product then the replica's error, got %v, %v", got, err)
+	}
+	// The primary is never asked: it would repeat the rows already sent.
+	assertMet(t, "replica", replica)
+	assertMet(t, "primary", primary)
+}
+
+func TestPostgresProducts_ReturnsToReplicaAfterRetryInterval(t *testing.T) {
+	t.Parallel()
+	pg, primary, replica := newTestReplica(t, 20*time.Millisecond)
+	products := NewPostgresProducts(pg)
+
+	replica.ExpectPing().WillReturnError(errors.New("connection refused"))
+	primary.ExpectQuery(getProduct).WithArgs(int64(1)).WillReturnRows(productRow(1))
+	replica.ExpectQuery(getProduct).WithArgs(int64(1)).WillReturnRows(productRow(1))
+
+	if err := pg.Replica.Ping(context.Background()); err == nil {
+		t.Fatal("expected the ping to fail")
+	}
+	if _, err := products.Get(context.Background(), 1); err != nil {
+		t.Fatalf("Get while down: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := products.Get(context.Background(), 1); err != nil {
+		t.Fatalf("Get after retry interval: %v", err)
+	}
+	assertMet(t, "replica", replica)
+	assertMet(t, "primary", primary)
+}
+
+func TestPostgresProducts_ReplicaErrorsAreReturnedWhileItAnswers(t *testing.T) {
+	t.Parallel()
+	pg, primary, replica := newTestReplica(t, time.Minute)
+	products := NewPostgresProducts(pg)
+	cancelled := errors.New("canceling statement due to conflict with recovery")
+
+	replica.ExpectQuery("SELECT COUNT(*) FROM products p WHERE p.deleted_at IS NULL").WillReturnError(cancelled)
+	replica.ExpectPing()
+
+	if _, err := products.Count(context.Background(), ProductFilter{}); !errors.Is(err, cancelled) {
+		t.Errorf("expected the replica's error, got %v", err)
+	}
+	assertMet(t, "replica", replica)
+	assertMet(t, "primary", primary)
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode/utf8"
+)
+
+// ProductSearch selects a page of the products matching a full-text query.
+type ProductSearch struct {
+	// Query is in web search syntax: words, "quoted phrases", or, and -word
+	// to exclude one.
+	Query  string
+	Limit  int
+	Offset int
+}
+
+// ProductMatch is a product found by Search.
+type ProductMatch struct {
+	Product
+	// Score is the ts_rank of the product for the query; higher is more
+	// relevant. Matches of a short term, searched by name, score 0.
+	Score float64 `json:"score"`
+}
+
+// ShortSearchTermLen is the length, in characters, below which a query of
+// a single term is matched against product names with ILIKE instead: the
+// text search stems whole words, so a fragment such as "ch" finds nothing.
+const ShortSearchTermLen = 3
+
+// searchRanked and searchShort select productColumns followed by the score.
+const (
+	searchRanked = "SELECT " + productColumns + ", ts_rank(p.search_vector, q) AS score FROM " + productsJoin +
+		" CROSS JOIN websearch_to_tsquery('english', $1) q WHERE p." + productLive +
+		" AND p.search_vector @@ q ORDER BY score DESC, p.id LIMIT $2 OFFSET $3"
+	searchShort = "SELECT " + productColumns + ", 0 AS score FROM " + productsJoin +
+		" WHERE p." + productLive + " AND p.name ILIKE $1 ORDER BY p.name, p.id LIMIT $2 OFFSET $3"
+)
+
+// shortSearchTerm reports whether q is a single term too short for the
+// text search.
+func shortSearchTerm(q string) bool {
+	return len(strings.Fields(q)) == 1 && utf8.RuneCountInString(strings.TrimSpace(q)) < ShortSearchTermLen
+}
+
+func (s *PostgresProducts) Search(ctx context.Context, q ProductSearch) (matches []ProductMatch, err error) {
+	query, arg := searchRanked, q.Query
+	if shortSearchTerm(q.Query) {
+		query, arg = searchShort, "%"+escapeLike(strings.TrimSpace(q.Query))+"%"
+	}
+
+	err = s.pg.read(ctx, func(db *sql.DB, pool string) (err error) {
+		ctx, end := s.pg.startQueryOn(ctx, querySearchProducts, pool, query)
+		defer end(&err)
+
+		rows, err := db.QueryContext(ctx, query, arg, q.Limit, q.Offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		matches = []ProductMatch{}
+		for rows.Next() {
+			var score float64
+			p, err := scanProduct(rows, false, &score)
+			if err != nil {
+				s.pg.Logger.ErrorContext(ctx, "Row scan failed", "err", err)
+				continue
+			}
+			matches = append(matches, ProductMatch{Product: p, Score: score})
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
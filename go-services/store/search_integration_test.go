@@ -0,0 +1,85 @@
+//go:build integration
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// integrationProducts returns the product store over a freshly migrated
+// schema of its own.
+func integrationProducts(t *testing.T) *PostgresProducts {
+	t.Helper()
+	db, err := sql.Open("postgres", integrationSchemaDSN(t))
+	if err != nil {
+		t.Fatalf("open DB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := Migrate(context.Background(), db, discardLogger); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return NewPostgresProducts(Postgres{
+		DB:     db,
+		Tracer: noop.NewTracerProvider().Tracer("test"),
+		QueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "db_query_duration_seconds",
+		}, []string{"query", "pool"}),
+		Logger: discardLogger,
+	})
+}
+
+func TestIntegration_SearchRanksNameMatchesFirst(t *testing.T) {
+	products := integrationProducts(t)
+	ctx := context.Background()
+
+	ids := make(map[string]int64)
+	for _, in := range []ProductInput{
+		{Name: "Standing desk", Description: "Pairs well with an ergonomic chair", Price: 300},
+		{Name: "Ergonomic office chair", Description: "Adjustable lumbar support", Price: 250},
+		{Name: "Oak chair", Description: "Solid wood", Price: 50},
+		{Name: "Ergonomic keyboard", Price: 90},
+	} {
+		p, err := products.Create(ctx, in)
+		if err != nil {
+			t.Fatalf("create %q: %v", in.Name, err)
+		}
+		ids[in.Name] = p.ID
+	}
+	deleted, err := products.Create(ctx, ProductInput{Name: "Ergonomic chair, discontinued", Price: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := products.Delete(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := products.Search(ctx, ProductSearch{Query: "ergonomic chairs", Limit: 10})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	// Stemming matches "chairs" to "chair"; the name weighs more than the
+	// description, and products missing a term are left out.
+	if len(got) != 2 || got[0].ID != ids["Ergonomic office chair"] || got[1].ID != ids["Standing desk"] {
+		t.Fatalf("expected the office chair then the desk, got %+v", got)
+	}
+	if got[0].Score <= got[1].Score || got[1].Score <= 0 {
+		t.Errorf("expected decreasing positive scores, got %v and %v", got[0].Score, got[1].Score)
+	}
+
+	got, err = products.Search(ctx, ProductSearch{Query: "ergonomic -keyboard", Limit: 10, Offset: 1})
+	if err != nil || len(got) != 1 || got[0].ID != ids["Standing desk"] {
+		t.Errorf("expected the desk alone on the second page, got %+v, %v", got, err)
+	}
+
+	// A fragment too short for the text search still finds names, in name
+	// order.
+	got, err = products.Search(ctx, ProductSearch{Query: "oa", Limit: 10})
+	if err != nil || len(got) != 2 || got[0].ID != ids["Ergonomic keyboard"] || got[1].ID != ids["Oak chair"] || got[1].Score != 0 {
+		t.Errorf("expected the keyboard and the oak chair, got %+v, %v", got, err)
+	}
+}
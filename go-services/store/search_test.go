@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// selectMatches selects productColumns and the score.
+const selectMatches = "SELECT p.id, p.name, p.description, p.price, p.created_at, c.id, c.name, "
+
+var searchRowColumns = append(productRowColumns, "score")
+
+func TestPostgresProducts_SearchRanks(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	products := NewPostgresProducts(pg)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mockSQL.ExpectQuery(selectMatches+"ts_rank(p.search_vector, q) AS score FROM products p LEFT JOIN categories c ON c.id = p.category_id"+
+		" CROSS JOIN websearch_to_tsquery('english', $1) q WHERE p.deleted_at IS NULL AND p.search_vector @@ q ORDER BY score DESC, p.id LIMIT $2 OFFSET $3").
+		WithArgs("ergonomic chair", 20, 40).
+		WillReturnRows(sqlmock.NewRows(searchRowColumns).
+			AddRow(2, "Ergonomic chair", "", 250.0, created, 4, "Chairs", 0.6).
+			AddRow("not-an-id", "Broken", "", 1.0, created, nil, nil, 0.5).
+			AddRow(3, "Standing desk", "Pairs with an ergonomic chair", 300.0, created, nil, nil, 0.2))
+
+	got, err := products.Search(context.Background(), ProductSearch{Query: "ergonomic chair", Limit: 20, Offset: 40})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != 2 || got[0].Score != 0.6 || got[0].Category == nil || got[1].ID != 3 || got[1].Score != 0.2 {
+		t.Errorf("expected products 2 then 3 with their scores, got %+v", got)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresProducts_SearchFallsBackForShortTerm(t *testing.T) {
+	t.Parallel()
+
+	for q, pattern := range map[string]string{
+		"ch":   "%ch%",
+		" 5% ": `%5\%%`,
+		"é":    "%é%",
+	} {
+		t.Run(q, func(t *testing.T) {
+			t.Parallel()
+			pg, mockSQL := newTestPostgres(t)
+			products := NewPostgresProducts(pg)
+
+			mockSQL.ExpectQuery(selectMatches+"0 AS score FROM products p LEFT JOIN categories c ON c.id = p.category_id"+
+				" WHERE p.deleted_at IS NULL AND p.name ILIKE $1 ORDER BY p.name, p.id LIMIT $2 OFFSET $3").
+				WithArgs(pattern, 10, 0).
+				WillReturnRows(sqlmock.NewRows(searchRowColumns).AddRow(1, "Chair", "", 49.5, time.Now(), nil, nil, 0))
+
+			got, err := products.Search(context.Background(), ProductSearch{Query: q, Limit: 10})
+			if err != nil || len(got) != 1 || got[0].Score != 0 {
+				t.Errorf("expected one unscored match, got %+v, %v", got, err)
+			}
+			assertMet(t, "primary", mockSQL)
+		})
+	}
+}
+
+func TestShortSearchTerm(t *testing.T) {
+	t.Parallel()
+
+	for q, want := range map[string]bool{
+		"x":     true,
+		" tv ":  true,
+		"ét":    true,
+		"été":   false,
+		"chair": false,
+		"a b":   false,
+	} {
+		if got := shortSearchTerm(q); got != want {
+			t.Errorf("shortSearchTerm(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
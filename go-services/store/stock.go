@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+)
+
+// StockStore reads and adjusts the stock column of products.
+type StockStore interface {
+	// Stock returns the stock of the product with the given id, or
+	// ErrNotFound if it is missing or deleted.
+	Stock(ctx context.Context, id int64) (int64, error)
+	// AddStock adds delta, which may be negative, to the product's stock,
+	// stopping at zero. It returns ErrNotFound if the product is gone. A
+	// deleted product's stock is still written, so that a restore finds
+	// it up to date.
+	AddStock(ctx context.Context, id int64, delta int64) error
+}
+
+// PostgresStock is the StockStore backed by the products table.
+type PostgresStock struct {
+	pg Postgres
+}
+
+// NewPostgresStock returns a StockStore using pg.
+func NewPostgresStock(pg Postgres) *PostgresStock {
+	return &PostgresStock{pg: pg}
+}
+
+// Stock reads the primary: the value seeds a counter that is then
+// authoritative, so it must not lag.
+func (s *PostgresStock) Stock(ctx context.Context, id int64) (stock int64, err error) {
+	const query = "SELECT stock FROM products WHERE id = $1 AND " + productLive
+
+	ctx, end := s.pg.startQuery(ctx, queryGetStock, query)
+	defer end(&err)
+
+	err = s.pg.DB.QueryRowContext(ctx, query, id).Scan(&stock)
+	return stock, notFound(err)
+}
+
+func (s *PostgresStock) AddStock(ctx context.Context, id int64, delta int64) (err error) {
+	const query = "UPDATE products SET stock = GREATEST(stock + $2, 0) WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryAddStock, query)
+	defer end(&err)
+
+	res, err := s.pg.DB.ExecContext(ctx, query, id, delta)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPostgresStock_Stock(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	stock := NewPostgresStock(pg)
+
+	const query = "SELECT stock FROM products WHERE id = $1 AND deleted_at IS NULL"
+	mockSQL.ExpectQuery(query).WithArgs(int64(7)).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(12))
+	mockSQL.ExpectQuery(query).WithArgs(int64(9)).WillReturnRows(sqlmock.NewRows([]string{"stock"}))
+
+	if n, err := stock.Stock(context.Background(), 7); err != nil || n != 12 {
+		t.Errorf("Stock: got %d, %v", n, err)
+	}
+	if _, err := stock.Stock(context.Background(), 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stock: expected ErrNotFound, got %v", err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
+
+func TestPostgresStock_AddStock(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	stock := NewPostgresStock(pg)
+
+	const update = "UPDATE products SET stock = GREATEST(stock + $2, 0) WHERE id = $1"
+	mockSQL.ExpectExec(update).WithArgs(int64(7), int64(-3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectExec(update).WithArgs(int64(9), int64(-1)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := stock.AddStock(context.Background(), 7, -3); err != nil {
+		t.Errorf("AddStock: %v", err)
+	}
+	if err := stock.AddStock(context.Background(), 9, -1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AddStock: expected ErrNotFound for a deleted product, got %v", err)
+	}
+	assertMet(t, "primary", mockSQL)
+}
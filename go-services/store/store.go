@@ -0,0 +1,189 @@
+// Package store is the service's data access layer. Handlers depend on the
+// ProductStore and UserStore interfaces; the Postgres implementations here
+// are the only code that builds SQL.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a write would break a unique constraint.
+	ErrDuplicate = errors.New("duplicate")
+	// ErrInsufficientStock is returned when an order asks for more of a
+	// product than is in stock.
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrNoPrice is returned when an order names a product that has no
+	// price, and so cannot be sold.
+	ErrNoPrice = errors.New("no price")
+	// ErrTimeout is returned, wrapping the driver's error, when a query
+	// outlives its deadline or the server's statement_timeout.
+	ErrTimeout = errors.New("query timed out")
+	// ErrCanceled is returned, wrapping the driver's error, when the
+	// caller cancelled the query, typically because its client went away.
+	ErrCanceled = errors.New("query canceled")
+	// ErrForeignKey is returned when a write references a row that does
+	// not exist, or removes one still referenced.
+	ErrForeignKey = errors.New("foreign key violation")
+	// ErrSerialization is returned when a transaction lost to a concurrent
+	// one. Retrying it may succeed.
+	ErrSerialization = errors.New("serialization failure")
+	// ErrSchema is returned when a query names a table or column the
+	// database does not have, which means migrations have not run.
+	ErrSchema = errors.New("schema mismatch")
+	// ErrLastAdmin is returned when a role change would leave no user with
+	// the admin role.
+	ErrLastAdmin = errors.New("last admin")
+)
+
+// Postgres is what the Postgres stores share: the connection pools and the
+// instrumentation every query reports to.
+type Postgres struct {
+	// DB is the primary, which serves every write.
+	DB *sql.DB
+	// Replica, when set, serves product reads; see read.
+	Replica *Replica
+	Tracer  trace.Tracer
+	// QueryDuration is observed once per query, labelled by query name and
+	// pool.
+	QueryDuration *prometheus.HistogramVec
+	// Errors counts failed queries by SQLSTATE, or by errorCode's labels
+	// for errors without one. It may be nil.
+	Errors *prometheus.CounterVec
+	Logger *slog.Logger
+	// QueryTimeout, when positive, bounds every query; a request with an
+	// earlier deadline keeps it.
+	QueryTimeout time.Duration
+}
+
+// dbQuery identifies a database call site. Its name labels the
+// db_query_duration_seconds histogram and the client span, so it must be a
+// constant per call site, never derived from SQL text or request input;
+// declaring every query below keeps that set fixed.
+type dbQuery struct {
+	name       string
+	operation  string
+	collection string
+}
+
+var (
+	queryListProducts   = dbQuery{"list_products", "SELECT", "products"}
+	queryCountProducts  = dbQuery{"count_products", "SELECT", "products"}
+	queryStreamProducts = dbQuery{"stream_products", "SELECT", "products"}
+	querySearchProducts = dbQuery{"search_products", "SELECT", "products"}
+	queryGetProduct     = dbQuery{"get_product", "SELECT", "products"}
+	queryGetProducts    = dbQuery{"get_products", "SELECT", "products"}
+	queryCreateProduct  = dbQuery{"create_product", "INSERT", "products"}
+	queryCreateProducts = dbQuery{"create_products", "INSERT", "products"}
+	queryUpdateProduct  = dbQuery{"update_product", "UPDATE", "products"}
+	queryDeleteProduct  = dbQuery{"delete_product", "UPDATE", "products"}
+	queryRestoreProduct = dbQuery{"restore_product", "UPDATE", "products"}
+	queryPurgeProducts  = dbQuery{"purge_products", "DELETE", "products"}
+	queryGetStock       = dbQuery{"get_stock", "SELECT", "products"}
+	queryAddStock       = dbQuery{"add_stock", "UPDATE", "products"}
+
+	queryListCategories = dbQuery{"list_categories", "SELECT", "categories"}
+	queryGetCategory    = dbQuery{"get_category", "SELECT", "categories"}
+	queryCreateCategory = dbQuery{"create_category", "INSERT", "categories"}
+	queryUpdateCategory = dbQuery{"update_category", "UPDATE", "categories"}
+	queryDeleteCategory = dbQuery{"delete_category", "DELETE", "categories"}
+	queryDetachCategory = dbQuery{"detach_category", "UPDATE", "products"}
+
+	queryGetCredentials = dbQuery{"get_credentials", "SELECT", "users"}
+	queryGetUsername    = dbQuery{"get_username", "SELECT", "users"}
+	queryCreateUser     = dbQuery{"create_user", "INSERT", "users"}
+	queryLockAdmins     = dbQuery{"lock_admins", "SELECT", "users"}
+	querySetRole        = dbQuery{"set_user_role", "UPDATE", "users"}
+	queryGetContact     = dbQuery{"get_contact", "SELECT", "users"}
+	querySetPassword    = dbQuery{"set_user_password", "UPDATE", "users"}
+
+	queryOrderProduct    = dbQuery{"get_order_product", "SELECT", "products"}
+	queryReserveStock    = dbQuery{"reserve_stock", "UPDATE", "products"}
+	queryCreateOrder     = dbQuery{"create_order", "INSERT", "orders"}
+	queryCreateOrderItem = dbQuery{"create_order_item", "INSERT", "order_items"}
+
+	queryInsertAudit = dbQuery{"insert_audit_events", "INSERT", "audit_events"}
+	queryListAudit   = dbQuery{"list_audit_events", "SELECT", "audit_events"}
+
+	queryAddOutbox    = dbQuery{"add_outbox_event", "INSERT", "outbox"}
+	queryDueOutbox    = dbQuery{"due_outbox_events", "SELECT", "outbox"}
+	queryRetryOutbox  = dbQuery{"retry_outbox_event", "UPDATE", "outbox"}
+	queryDeleteOutbox = dbQuery{"delete_outbox_event", "DELETE", "outbox"}
+
+	queryListWebhooks       = dbQuery{"list_webhook_subscriptions", "SELECT", "webhook_subscriptions"}
+	querySubscribedWebhooks = dbQuery{"subscribed_webhooks", "SELECT", "webhook_subscriptions"}
+	queryGetWebhook         = dbQuery{"get_webhook_subscription", "SELECT", "webhook_subscriptions"}
+	queryCreateWebhook      = dbQuery{"create_webhook_subscription", "INSERT", "webhook_subscriptions"}
+	queryUpdateWebhook      = dbQuery{"update_webhook_subscription", "UPDATE", "webhook_subscriptions"}
+	queryDeleteWebhook      = dbQuery{"delete_webhook_subscription", "DELETE", "webhook_subscriptions"}
+)
+
+// startQuery starts a client span and a timer for q running query on the
+// primary, and bounds ctx by QueryTimeout. The returned func must be called
+// with a pointer to the call's error once the call, including reading its
+// rows, is done: it records the outcome, releases the deadline and replaces
+// the error with one wrapping the store error classify maps it to, so that
+// callers need not know the driver's errors. A missing row is recorded as
+// an answer, not a failure.
+func (pg Postgres) startQuery(ctx context.Context, q dbQuery, query string) (context.Context, func(*error)) {
+	return pg.startQueryOn(ctx, q, PoolPrimary, query)
+}
+
+// startQueryOn is startQuery for a query running on the named pool.
+func (pg Postgres) startQueryOn(ctx context.Context, q dbQuery, pool, query string) (context.Context, func(*error)) {
+	start := time.Now()
+	ctx, span := pg.Tracer.Start(ctx, "db."+q.name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(q.operation),
+			semconv.DBCollectionName(q.collection),
+			semconv.DBQueryText(query),
+			attribute.String("db.pool", pool),
+		),
+	)
+	cancel := context.CancelFunc(func() {})
+	if pg.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, pg.QueryTimeout)
+	}
+	return ctx, func(errp *error) {
+		pg.QueryDuration.WithLabelValues(q.name, pool).Observe(time.Since(start).Seconds())
+		if *errp != nil {
+			err, code := classify(ctx, *errp)
+			*errp = err
+			if code != "" {
+				if pg.Errors != nil {
+					pg.Errors.WithLabelValues(code).Inc()
+				}
+				if errors.Is(err, ErrSchema) {
+					pg.Logger.ErrorContext(ctx, "Query names a missing table or column; have the migrations run?",
+						"operator_action", "check_schema", "query", q.name, "err", err)
+				}
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "query failed")
+			}
+		}
+		span.End()
+		cancel()
+	}
+}
+
+// notFound maps sql.ErrNoRows to ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
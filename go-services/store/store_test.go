@@ -0,0 +1,32 @@
+package store
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestPostgres returns a Postgres over sqlmock with exact SQL matching,
+// so tests pin the statements the stores build.
+func newTestPostgres(t *testing.T) (Postgres, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mockSQL, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return Postgres{
+		DB:     db,
+		Tracer: noop.NewTracerProvider().Tracer("test"),
+		QueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "db_query_duration_seconds",
+		}, []string{"query", "pool"}),
+		Logger: discardLogger,
+	}, mockSQL
+}
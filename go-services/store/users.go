@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// The roles a user can have. Admins may use the admin endpoints.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// ValidRole reports whether role is one of the roles above.
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
+
+// Credentials is what logging in checks and hands out: the user's password
+// hash, and the id and role a session is issued for.
+type Credentials struct {
+	ID           int64
+	Role         string
+	PasswordHash []byte
+}
+
+// Contact is where a user can be reached: their id, and their email
+// address or "" if they gave none.
+type Contact struct {
+	ID    int64
+	Email string
+}
+
+// UserStore reads and writes user accounts.
+type UserStore interface {
+	// Credentials returns the credentials of the user with the given
+	// username, or ErrNotFound.
+	Credentials(ctx context.Context, username string) (Credentials, error)
+	// Username returns the username of the user with the given id, or
+	// ErrNotFound.
+	Username(ctx context.Context, id int64) (string, error)
+	// Contact returns the contact details of the user with the given
+	// username, or ErrNotFound.
+	Contact(ctx context.Context, username string) (Contact, error)
+	// Create inserts a user and returns its id, or ErrDuplicate if the
+	// username is taken. An empty email is stored as none.
+	Create(ctx context.Context, username, email string, passwordHash []byte) (int64, error)
+	// SetPassword replaces the password hash of the user with the given
+	// id. It returns ErrNotFound if there is no such user.
+	SetPassword(ctx context.Context, id int64, passwordHash []byte) error
+	// SetRole changes the role of the user with the given id. It returns
+	// ErrNotFound if there is no such user, and ErrLastAdmin rather than
+	// demote the only admin.
+	SetRole(ctx context.Context, id int64, role string) error
+}
+
+// PostgresUsers is the UserStore backed by the users table.
+type PostgresUsers struct {
+	pg Postgres
+}
+
+// NewPostgresUsers returns a UserStore using pg.
+func NewPostgresUsers(pg Postgres) *PostgresUsers {
+	return &PostgresUsers{pg: pg}
+}
+
+func (s *PostgresUsers) Credentials(ctx context.Context, username string) (c Credentials, err error) {
+	const query = "SELECT id, role, password_hash FROM users WHERE username = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryGetCredentials, query)
+	defer end(&err)
+
+	err = s.pg.DB.QueryRowContext(ctx, query, username).Scan(&c.ID, &c.Role, &c.PasswordHash)
+	return c, notFound(err)
+}
+
+func (s *PostgresUsers) Username(ctx context.Context, id int64) (username string, err error) {
+	const query = "SELECT username FROM users WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryGetUsername, query)
+	defer end(&err)
+
+	err = s.pg.DB.QueryRowContext(ctx, query, id).Scan(&username)
+	return username, notFound(err)
+}
+
+func (s *PostgresUsers) Contact(ctx context.Context, username string) (c Contact, err error) {
+	const query = "SELECT id, COALESCE(email, '') FROM users WHERE username = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryGetContact, query)
+	defer end(&err)
+
+	err = s.pg.DB.QueryRowContext(ctx, query, username).Scan(&c.ID, &c.Email)
+	return c, notFound(err)
+}
+
+func (s *PostgresUsers) Create(ctx context.Context, username, email string, passwordHash []byte) (id int64, err error) {
+	const query = "INSERT INTO users (username, email, password_hash) VALUES ($1, NULLIF($2, ''), $3) RETURNING id"
+
+	ctx, end := s.pg.startQuery(ctx, queryCreateUser, query)
+	defer end(&err)
+
+	err = s.pg.DB.QueryRowContext(ctx, query, username, email, string(passwordHash)).Scan(&id)
+	return id, err
+}
+
+func (s *PostgresUsers) SetPassword(ctx context.Context, id int64, passwordHash []byte) (err error) {
+	const query = "UPDATE users SET password_hash = $1 WHERE id = $2"
+
+	ctx, end := s.pg.startQuery(ctx, querySetPassword, query)
+	defer end(&err)
+
+	res, err := s.pg.DB.ExecContext(ctx, query, string(passwordHash), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// SetRole locks the admins' rows before counting them, so of two admins
+// demoting each other at once the second waits for the first and then
+// finds itself the last.
+func (s *PostgresUsers) SetRole(ctx context.Context, id int64, role string) (err error) {
+	tx, err := s.pg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if role != RoleAdmin {
+		admins, err := s.lockAdmins(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(admins) == 1 && admins[0] == id {
+			return ErrLastAdmin
+		}
+	}
+	if err := s.setRole(ctx, tx, id, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockAdmins returns the ids of the admins, locking their rows until tx
+// ends.
+func (s *PostgresUsers) lockAdmins(ctx context.Context, tx *sql.Tx) (ids []int64, err error) {
+	const query = "SELECT id FROM users WHERE role = 'admin' FOR UPDATE"
+
+	ctx, end := s.pg.startQuery(ctx, queryLockAdmins, query)
+	defer end(&err)
+
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *PostgresUsers) setRole(ctx context.Context, tx *sql.Tx, id int64, role string) (err error) {
+	const query = "UPDATE users SET role = $1 WHERE id = $2"
+
+	ctx, end := s.pg.startQuery(ctx, querySetRole, query)
+	defer end(&err)
+
+	res, err := tx.ExecContext(ctx, query, role, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
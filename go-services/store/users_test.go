@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestPostgresUsers_LookupsReturnNotFound(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	users := NewPostgresUsers(pg)
+
+	mockSQL.ExpectQuery("SELECT id, role, password_hash FROM users WHERE username = $1").WithArgs("ghost").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "role", "password_hash"}))
+	mockSQL.ExpectQuery("SELECT username FROM users WHERE id = $1").WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mockSQL.ExpectQuery("SELECT id, role, password_hash FROM users WHERE username = $1").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "role", "password_hash"}).AddRow(7, "admin", "hash"))
+
+	if _, err := users.Credentials(context.Background(), "ghost"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Credentials: expected ErrNotFound, got %v", err)
+	}
+	if _, err := users.Username(context.Background(), 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Username: expected ErrNotFound, got %v", err)
+	}
+	if c, err := users.Credentials(context.Background(), "admin"); err != nil || c.ID != 7 || c.Role != RoleAdmin || string(c.PasswordHash) != "hash" {
+		t.Errorf("Credentials: got %+v, %v", c, err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresUsers_CreateMapsUniqueViolation(t *testing.T) {
+	t.Parallel()
+
+	const insert = "INSERT INTO users (username, email, password_hash) VALUES ($1, NULLIF($2, ''), $3) RETURNING id"
+	tests := []struct {
+		name    string
+		err     error
+		wantDup bool
+	}{
+		{"duplicate username", &pq.Error{Code: "23505", Constraint: "users_username_key"}, true},
+		{"other constraint", &pq.Error{Code: "23503"}, false},
+		{"connection failure", errors.New("connection reset by peer"), false},
+	}
+	for _, tt := range tests {
+		pg, mockSQL := newTestPostgres(t)
+		mockSQL.ExpectQuery(insert).WithArgs("alice", "", "hash").WillReturnError(tt.err)
+
+		_, err := NewPostgresUsers(pg).Create(context.Background(), "alice", "", []byte("hash"))
+		if errors.Is(err, ErrDuplicate) != tt.wantDup || !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+
+	pg, mockSQL := newTestPostgres(t)
+	mockSQL.ExpectQuery(insert).WithArgs("alice", "", "hash").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+	if id, err := NewPostgresUsers(pg).Create(context.Background(), "alice", "", []byte("hash")); err != nil || id != 12 {
+		t.Errorf("expected id 12, got %d, %v", id, err)
+	}
+}
+
+func TestPostgresUsers_SetRoleKeepsLastAdmin(t *testing.T) {
+	t.Parallel()
+
+	const (
+		lockAdmins = "SELECT id FROM users WHERE role = 'admin' FOR UPDATE"
+		update     = "UPDATE users SET role = $1 WHERE id = $2"
+	)
+	adminRows := func(ids ...int64) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id"})
+		for _, id := range ids {
+			rows.AddRow(id)
+		}
+		return rows
+	}
+
+	// Demoting the only admin is refused before anything is written.
+	pg, mockSQL := newTestPostgres(t)
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectQuery(lockAdmins).WillReturnRows(adminRows(3))
+	mockSQL.ExpectRollback()
+	if err := NewPostgresUsers(pg).SetRole(context.Background(), 3, RoleUser); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected ErrLastAdmin, got %v", err)
+	}
+	assertMet(t, "last admin", mockSQL)
+
+	// With another admin left it goes through.
+	pg, mockSQL = newTestPostgres(t)
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectQuery(lockAdmins).WillReturnRows(adminRows(3, 5))
+	mockSQL.ExpectExec(update).WithArgs(RoleUser, int64(3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectCommit()
+	if err := NewPostgresUsers(pg).SetRole(context.Background(), 3, RoleUser); err != nil {
+		t.Errorf("expected the demotion, got %v", err)
+	}
+	assertMet(t, "demotion", mockSQL)
+
+	// Promoting needs no count, and a missing user is reported.
+	pg, mockSQL = newTestPostgres(t)
+	mockSQL.ExpectBegin()
+	mockSQL.ExpectExec(update).WithArgs(RoleAdmin, int64(9)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSQL.ExpectRollback()
+	if err := NewPostgresUsers(pg).SetRole(context.Background(), 9, RoleAdmin); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	assertMet(t, "missing user", mockSQL)
+}
+
+func TestPostgresUsers_ContactAndSetPassword(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	users := NewPostgresUsers(pg)
+
+	const update = "UPDATE users SET password_hash = $1 WHERE id = $2"
+	mockSQL.ExpectQuery("SELECT id, COALESCE(email, '') FROM users WHERE username = $1").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(7, "alice@example.com"))
+	mockSQL.ExpectExec(update).WithArgs("hash", int64(7)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSQL.ExpectExec(update).WithArgs("hash", int64(9)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if c, err := users.Contact(context.Background(), "alice"); err != nil || c != (Contact{ID: 7, Email: "alice@example.com"}) {
+		t.Errorf("Contact: got %+v, %v", c, err)
+	}
+	if err := users.SetPassword(context.Background(), 7, []byte("hash")); err != nil {
+		t.Errorf("SetPassword: %v", err)
+	}
+	if err := users.SetPassword(context.Background(), 9, []byte("hash")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPassword: expected ErrNotFound, got %v", err)
+	}
+	assertMet(t, "contact and password", mockSQL)
+}
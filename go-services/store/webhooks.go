@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WebhookSubscription is a row of the webhook_subscriptions table: a URL
+// notified of the events listed in Events. Secret signs the deliveries and
+// is never returned by the API.
+type WebhookSubscription struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookSubscriptionInput is the writable part of a subscription. Callers
+// validate it.
+type WebhookSubscriptionInput struct {
+	URL string
+	// Secret may be left empty by Update to keep the current one.
+	Secret string
+	Events []string
+	Active bool
+}
+
+// WebhookStore reads and writes webhook subscriptions.
+type WebhookStore interface {
+	// List returns every subscription, in id order.
+	List(ctx context.Context) ([]WebhookSubscription, error)
+	// Get returns the subscription with the given id, or ErrNotFound.
+	Get(ctx context.Context, id int64) (WebhookSubscription, error)
+	Create(ctx context.Context, in WebhookSubscriptionInput) (WebhookSubscription, error)
+	// Update replaces the subscription with the given id, or returns
+	// ErrNotFound.
+	Update(ctx context.Context, id int64, in WebhookSubscriptionInput) (WebhookSubscription, error)
+	// Delete removes the subscription with the given id, or returns
+	// ErrNotFound.
+	Delete(ctx context.Context, id int64) error
+	// Subscribed returns the active subscriptions to the event type event.
+	Subscribed(ctx context.Context, event string) ([]WebhookSubscription, error)
+}
+
+// PostgresWebhooks is the WebhookStore backed by the webhook_subscriptions
+// table. It reads from the primary: subscriptions are few, and a change is
+// expected to apply to the next delivery.
+type PostgresWebhooks struct {
+	pg Postgres
+}
+
+// NewPostgresWebhooks returns a WebhookStore using pg.
+func NewPostgresWebhooks(pg Postgres) *PostgresWebhooks {
+	return &PostgresWebhooks{pg: pg}
+}
+
+const webhookColumns = "id, url, secret, events, active, created_at"
+
+func (s *PostgresWebhooks) List(ctx context.Context) ([]WebhookSubscription, error) {
+	const query = "SELECT " + webhookColumns + " FROM webhook_subscriptions ORDER BY id"
+	return s.query(ctx, queryListWebhooks, query)
+}
+
+func (s *PostgresWebhooks) Subscribed(ctx context.Context, event string) ([]WebhookSubscription, error) {
+	const query = "SELECT " + webhookColumns + " FROM webhook_subscriptions WHERE active AND $1 = ANY(events) ORDER BY id"
+	return s.query(ctx, querySubscribedWebhooks, query, event)
+}
+
+func (s *PostgresWebhooks) query(ctx context.Context, q dbQuery, query string, args ...any) (subs []WebhookSubscription, err error) {
+	ctx, end := s.pg.startQuery(ctx, q, query)
+	defer end(&err)
+
+	rows, err := s.pg.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs = []WebhookSubscription{}
+	for rows.Next() {
+		sub, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *PostgresWebhooks) Get(ctx context.Context, id int64) (_ WebhookSubscription, err error) {
+	const query = "SELECT " + webhookColumns + " FROM webhook_subscriptions WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryGetWebhook, query)
+	defer end(&err)
+
+	sub, err := scanWebhook(s.pg.DB.QueryRowContext(ctx, query, id))
+	return sub, notFound(err)
+}
+
+func (s *PostgresWebhooks) Create(ctx context.Context, in WebhookSubscriptionInput) (_ WebhookSubscription, err error) {
+	const query = "INSERT INTO webhook_subscriptions (url, secret, events, active) VALUES ($1, $2, $3, $4) RETURNING " + webhookColumns
+
+	ctx, end := s.pg.startQuery(ctx, queryCreateWebhook, query)
+	defer end(&err)
+
+	return scanWebhook(s.pg.DB.QueryRowContext(ctx, query, in.URL, in.Secret, pq.Array(in.Events), in.Active))
+}
+
+func (s *PostgresWebhooks) Update(ctx context.Context, id int64, in WebhookSubscriptionInput) (_ WebhookSubscription, err error) {
+	const query = "UPDATE webhook_subscriptions SET url = $2, secret = COALESCE(NULLIF($3, ''), secret), events = $4, active = $5 " +
+		"WHERE id = $1 RETURNING " + webhookColumns
+
+	ctx, end := s.pg.startQuery(ctx, queryUpdateWebhook, query)
+	defer end(&err)
+
+	sub, err := scanWebhook(s.pg.DB.QueryRowContext(ctx, query, id, in.URL, in.Secret, pq.Array(in.Events), in.Active))
+	return sub, notFound(err)
+}
+
+func (s *PostgresWebhooks) Delete(ctx context.Context, id int64) (err error) {
+	const query = "DELETE FROM webhook_subscriptions WHERE id = $1"
+
+	ctx, end := s.pg.startQuery(ctx, queryDeleteWebhook, query)
+	defer end(&err)
+
+	res, err := s.pg.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// scanWebhook reads a row selected with webhookColumns.
+func scanWebhook(row interface{ Scan(...any) error }) (WebhookSubscription, error) {
+	var sub WebhookSubscription
+	err := row.Scan(&sub.ID, &sub.URL, &sub.Secret, pq.Array(&sub.Events), &sub.Active, &sub.CreatedAt)
+	return sub, err
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+var webhookRowColumns = []string{"id", "url", "secret", "events", "active", "created_at"}
+
+func TestPostgresWebhooks_CreateAndSubscribed(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	webhooks := NewPostgresWebhooks(pg)
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	in := WebhookSubscriptionInput{URL: "https://partner.example/hooks", Secret: "s3cret", Events: []string{"product.created"}, Active: true}
+	mockSQL.ExpectQuery("INSERT INTO webhook_subscriptions (url, secret, events, active) VALUES ($1, $2, $3, $4) RETURNING id, url, secret, events, active, created_at").
+		WithArgs(in.URL, in.Secret, pq.Array(in.Events), true).
+		WillReturnRows(sqlmock.NewRows(webhookRowColumns).AddRow(1, in.URL, in.Secret, "{product.created}", true, at))
+	sub, err := webhooks.Create(context.Background(), in)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if sub.ID != 1 || sub.Secret != "s3cret" || !slices.Equal(sub.Events, []string{"product.created"}) || !sub.CreatedAt.Equal(at) {
+		t.Errorf("unexpected subscription %+v", sub)
+	}
+
+	mockSQL.ExpectQuery("SELECT id, url, secret, events, active, created_at FROM webhook_subscriptions WHERE active AND $1 = ANY(events) ORDER BY id").
+		WithArgs("product.created").
+		WillReturnRows(sqlmock.NewRows(webhookRowColumns).AddRow(1, in.URL, in.Secret, "{product.created,product.deleted}", true, at))
+	subs, err := webhooks.Subscribed(context.Background(), "product.created")
+	if err != nil {
+		t.Fatalf("Subscribed: %v", err)
+	}
+	if len(subs) != 1 || !slices.Equal(subs[0].Events, []string{"product.created", "product.deleted"}) {
+		t.Errorf("unexpected subscriptions %+v", subs)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresWebhooks_UpdateKeepsEmptySecret(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	webhooks := NewPostgresWebhooks(pg)
+
+	in := WebhookSubscriptionInput{URL: "https://partner.example/v2", Events: []string{"product.deleted"}}
+	mockSQL.ExpectQuery("UPDATE webhook_subscriptions SET url = $2, secret = COALESCE(NULLIF($3, ''), secret), events = $4, active = $5 WHERE id = $1 RETURNING id, url, secret, events, active, created_at").
+		WithArgs(int64(1), in.URL, "", pq.Array(in.Events), false).
+		WillReturnRows(sqlmock.NewRows(webhookRowColumns).AddRow(1, in.URL, "s3cret", "{product.deleted}", false, time.Now()))
+	sub, err := webhooks.Update(context.Background(), 1, in)
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if sub.Secret != "s3cret" || sub.Active {
+		t.Errorf("unexpected subscription %+v", sub)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresWebhooks_MissingIsNotFound(t *testing.T) {
+	t.Parallel()
+	pg, mockSQL := newTestPostgres(t)
+	webhooks := NewPostgresWebhooks(pg)
+
+	mockSQL.ExpectQuery("SELECT id, url, secret, events, active, created_at FROM webhook_subscriptions WHERE id = $1").
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(webhookRowColumns))
+	mockSQL.ExpectExec("DELETE FROM webhook_subscriptions WHERE id = $1").
+		WithArgs(int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := webhooks.Get(context.Background(), 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if err := webhooks.Delete(context.Background(), 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete: expected ErrNotFound, got %v", err)
+	}
+	if err := mockSQL.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go-service/store"
+)
+
+// postgresFailed reports whether err, from a store call, means Postgres is
+// in trouble. Answers such as a missing row, a duplicate or a lost
+// serialization race are not failures, and neither is a request its client
+// cancelled nor a query the schema does not support, which fails however
+// healthy Postgres is.
+func postgresFailed(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, store.ErrNotFound),
+		errors.Is(err, store.ErrDuplicate),
+		errors.Is(err, store.ErrForeignKey),
+		errors.Is(err, store.ErrSerialization),
+		errors.Is(err, store.ErrSchema),
+		errors.Is(err, store.ErrInsufficientStock),
+		errors.Is(err, store.ErrLastAdmin),
+		errors.Is(err, store.ErrCanceled),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, errDependencyUnavailable):
+		return false
+	}
+	return true
+}
+
+// breakerProducts is a store.ProductStore whose calls go through a
+// circuit breaker.
+type breakerProducts struct {
+	next    store.ProductStore
+	breaker *circuitBreaker
+}
+
+func (p breakerProducts) List(ctx context.Context, l store.ProductList) (items []store.Product, err error) {
+	err = p.breaker.call(func() error {
+		items, err = p.next.List(ctx, l)
+		return err
+	}, postgresFailed)
+	return items, err
+}
+
+// Stream does not count errors from fn, such as a client going away, as
+// failures of Postgres.
+func (p breakerProducts) Stream(ctx context.Context, f store.ProductFilter, fn func(store.Product) error) error {
+	var fnErr error
+	return p.breaker.call(func() error {
+		return p.next.Stream(ctx, f, func(product store.Product) error {
+			fnErr = fn(product)
+			return fnErr
+		})
+	}, func(err error) bool { return err != fnErr && postgresFailed(err) })
+}
+
+func (p breakerProducts) Count(ctx context.Context, f store.ProductFilter) (n int64, err error) {
+	err = p.breaker.call(func() error {
+		n, err = p.next.Count(ctx, f)
+		return err
+	}, postgresFailed)
+	return n, err
+}
+
+func (p breakerProducts) Get(ctx context.Context, id int64) (product store.Product, err error) {
+	err = p.breaker.call(func() error {
+		product, err = p.next.Get(ctx, id)
+		return err
+	}, postgresFailed)
+	return product, err
+}
+
+func (p breakerProducts) GetMany(ctx context.Context, ids []int64) (products []store.Product, err error) {
+	err = p.breaker.call(func() error {
+		products, err = p.next.GetMany(ctx, ids)
+		return err
+	}, postgresFailed)
+	return products, err
+}
+
+func (p breakerProducts) Create(ctx context.Context, in store.ProductInput) (product store.Product, err error) {
+	err = p.breaker.call(func() error {
+		product, err = p.next.Create(ctx, in)
+		return err
+	}, postgresFailed)
+	return product, err
+}
+
+func (p breakerProducts) CreateMany(ctx context.Context, in []store.ProductInput) (ids []int64, err error) {
+	err = p.breaker.call(func() error {
+		ids, err = p.next.CreateMany(ctx, in)
+		return err
+	}, postgresFailed)
+	return ids, err
+}
+
+func (p breakerProducts) Update(ctx context.Context, id int64, in store.ProductInput) (product store.Product, err error) {
+	err = p.breaker.call(func() error {
+		product, err = p.next.Update(ctx, id, in)
+		return err
+	}, postgresFailed)
+	return product, err
+}
+
+func (p breakerProducts) Delete(ctx context.Context, id int64) error {
+	return p.breaker.call(func() error { return p.next.Delete(ctx, id) }, postgresFailed)
+}
+
+func (p breakerProducts) Restore(ctx context.Context, id int64) (product store.Product, err error) {
+	err = p.breaker.call(func() error {
+		product, err = p.next.Restore(ctx, id)
+		return err
+	}, postgresFailed)
+	return product, err
+}
+
+func (p breakerProducts) Purge(ctx context.Context, before time.Time) (n int64, err error) {
+	err = p.breaker.call(func() error {
+		n, err = p.next.Purge(ctx, before)
+		return err
+	}, postgresFailed)
+	return n, err
+}
+
+func (p breakerProducts) Search(ctx context.Context, q store.ProductSearch) (matches []store.ProductMatch, err error) {
+	err = p.breaker.call(func() error {
+		matches, err = p.next.Search(ctx, q)
+		return err
+	}, postgresFailed)
+	return matches, err
+}
+
+// breakerCategories is a store.CategoryStore whose calls go through a
+// circuit breaker.
+type breakerCategories struct {
+	next    store.CategoryStore
+	breaker *circuitBreaker
+}
+
+func (c breakerCategories) List(ctx context.Context) (categories []store.Category, err error) {
+	err = c.breaker.call(func() error {
+		categories, err = c.next.List(ctx)
+		return err
+	}, postgresFailed)
+	return categories, err
+}
+
+func (c breakerCategories) Get(ctx context.Context, id int64) (category store.Category, err error) {
+	err = c.breaker.call(func() error {
+		category, err = c.next.Get(ctx, id)
+		return err
+	}, postgresFailed)
+	return category, err
+}
+
+func (c breakerCategories) Create(ctx context.Context, in store.CategoryInput) (category store.Category, err error) {
+	err = c.breaker.call(func() error {
+		category, err = c.next.Create(ctx, in)
+		return err
+	}, postgresFailed)
+	return category, err
+}
+
+func (c breakerCategories) Update(ctx context.Context, id int64, in store.CategoryInput) (category store.Category, err error) {
+	err = c.breaker.call(func() error {
+		category, err = c.next.Update(ctx, id, in)
+		return err
+	}, postgresFailed)
+	return category, err
+}
+
+func (c breakerCategories) Delete(ctx context.Context, id int64, force bool) error {
+	return c.breaker.call(func() error {
+		return c.next.Delete(ctx, id, force)
+	}, postgresFailed)
+}
+
+// breakerStock is a store.StockStore whose calls go through a circuit
+// breaker.
+type breakerStock struct {
+	next    store.StockStore
+	breaker *circuitBreaker
+}
+
+func (s breakerStock) Stock(ctx context.Context, id int64) (stock int64, err error) {
+	err = s.breaker.call(func() error {
+		stock, err = s.next.Stock(ctx, id)
+		return err
+	}, postgresFailed)
+	return stock, err
+}
+
+func (s breakerStock) AddStock(ctx context.Context, id int64, delta int64) error {
+	return s.breaker.call(func() error { return s.next.AddStock(ctx, id, delta) }, postgresFailed)
+}
+
+// breakerUsers is a store.UserStore whose calls go through a circuit
+// breaker.
+type breakerUsers struct {
+	next    store.UserStore
+	breaker *circuitBreaker
+}
+
+func (u breakerUsers) Credentials(ctx context.Context, username string) (c store.Credentials, err error) {
+	err = u.breaker.call(func() error {
+		c, err = u.next.Credentials(ctx, username)
+		return err
+	}, postgresFailed)
+	return c, err
+}
+
+func (u breakerUsers) Username(ctx context.Context, id int64) (username string, err error) {
+	err = u.breaker.call(func() error {
+		username, err = u.next.Username(ctx, id)
+		return err
+	}, postgresFailed)
+	return username, err
+}
+
+func (u breakerUsers) Contact(ctx context.Context, username string) (c store.Contact, err error) {
+	err = u.breaker.call(func() error {
+		c, err = u.next.Contact(ctx, username)
+		return err
+	}, postgresFailed)
+	return c, err
+}
+
+func (u breakerUsers) Create(ctx context.Context, username, email string, passwordHash []byte) (id int64, err error) {
+	err = u.breaker.call(func() error {
+		id, err = u.next.Create(ctx, username, email, passwordHash)
+		return err
+	}, postgresFailed)
+	return id, err
+}
+
+func (u breakerUsers) SetPassword(ctx context.Context, id int64, passwordHash []byte) error {
+	return u.breaker.call(func() error { return u.next.SetPassword(ctx, id, passwordHash) }, postgresFailed)
+}
+
+func (u breakerUsers) SetRole(ctx context.Context, id int64, role string) error {
+	return u.breaker.call(func() error { return u.next.SetRole(ctx, id, role) }, postgresFailed)
+}
+
+// breakerOrders is a store.OrderStore whose calls go through a circuit
+// breaker.
+type breakerOrders struct {
+	next    store.OrderStore
+	breaker *circuitBreaker
+}
+
+func (o breakerOrders) Create(ctx context.Context, items []store.OrderItem) (order store.Order, err error) {
+	err = o.breaker.call(func() error {
+		order, err = o.next.Create(ctx, items)
+		return err
+	}, postgresFailed)
+	return order, err
+}
+
+// breakerAudit is a store.AuditStore whose calls go through a circuit
+// breaker.
+type breakerAudit struct {
+	next    store.AuditStore
+	breaker *circuitBreaker
+}
+
+func (a breakerAudit) Insert(ctx context.Context, events []store.AuditEvent) error {
+	return a.breaker.call(func() error {
+		return a.next.Insert(ctx, events)
+	}, postgresFailed)
+}
+
+func (a breakerAudit) List(ctx context.Context, l store.AuditList) (events []store.AuditEvent, err error) {
+	err = a.breaker.call(func() error {
+		events, err = a.next.List(ctx, l)
+		return err
+	}, postgresFailed)
+	return events, err
+}
+
+// breakerOutbox is a store.OutboxStore whose calls go through a circuit
+// breaker.
+type breakerOutbox struct {
+	next    store.OutboxStore
+	breaker *circuitBreaker
+}
+
+func (o breakerOutbox) Add(ctx context.Context, ev store.OutboxEvent) error {
+	return o.breaker.call(func() error {
+		return o.next.Add(ctx, ev)
+	}, postgresFailed)
+}
+
+func (o breakerOutbox) Due(ctx context.Context, limit int) (events []store.OutboxEvent, err error) {
+	err = o.breaker.call(func() error {
+		events, err = o.next.Due(ctx, limit)
+		return err
+	}, postgresFailed)
+	return events, err
+}
+
+func (o breakerOutbox) Retry(ctx context.Context, id int64, next time.Time, lastErr string) error {
+	return o.breaker.call(func() error {
+		return o.next.Retry(ctx, id, next, lastErr)
+	}, postgresFailed)
+}
+
+func (o breakerOutbox) Delete(ctx context.Context, id int64) error {
+	return o.breaker.call(func() error {
+		return o.next.Delete(ctx, id)
+	}, postgresFailed)
+}
+
+// breakerWebhooks is a store.WebhookStore whose calls go through a circuit
+// breaker.
+type breakerWebhooks struct {
+	next    store.WebhookStore
+	breaker *circuitBreaker
+}
+
+func (w breakerWebhooks) List(ctx context.Context) (subs []store.WebhookSubscription, err error) {
+	err = w.breaker.call(func() error {
+		subs, err = w.next.List(ctx)
+		return err
+	}, postgresFailed)
+	return subs, err
+}
+
+func (w breakerWebhooks) Get(ctx context.Context, id int64) (sub store.WebhookSubscription, err error) {
+	err = w.breaker.call(func() error {
+		sub, err = w.next.Get(ctx, id)
+		return err
+	}, postgresFailed)
+	return sub, err
+}
+
+func (w breakerWebhooks) Create(ctx context.Context, in store.WebhookSubscriptionInput) (sub store.WebhookSubscription, err error) {
+	err = w.breaker.call(func() error {
+		sub, err = w.next.Create(ctx, in)
+		return err
+	}, postgresFailed)
+	return sub, err
+}
+
+func (w breakerWebhooks) Update(ctx context.Context, id int64, in store.WebhookSubscriptionInput) (sub store.WebhookSubscription, err error) {
+	err = w.breaker.call(func() error {
+		sub, err = w.next.Update(ctx, id, in)
+		return err
+	}, postgresFailed)
+	return sub, err
+}
+
+func (w breakerWebhooks) Delete(ctx context.Context, id int64) error {
+	return w.breaker.call(func() error {
+		return w.next.Delete(ctx, id)
+	}, postgresFailed)
+}
+
+func (w breakerWebhooks) Subscribed(ctx context.Context, event string) (subs []store.WebhookSubscription, err error) {
+	err = w.breaker.call(func() error {
+		subs, err = w.next.Subscribed(ctx, event)
+		return err
+	}, postgresFailed)
+	return subs, err
+}
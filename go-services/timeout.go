@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+)
+
+// withTimeout bounds the handler by cfg.RequestTimeout. The handler's output
+// is buffered so that, if the deadline passes first, the client receives a
+// clean 504 JSON error instead of a partially written response. The request
+// context is cancelled at the deadline so in-flight DB calls are aborted.
+//
+// A handler that flushes commits to its response: what is buffered is sent
+// and later writes go straight through. Past the deadline such a response
+// can no longer become a 504; the cancelled context is what ends it.
+//
+// Stream routes are not bounded: they are meant to stay open.
+func (s *Server) withTimeout(handler http.HandlerFunc) http.HandlerFunc {
+	if s.cfg.RequestTimeout <= 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.isStream(r) {
+			handler(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, header: make(http.Header), code: http.StatusOK}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			handler(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			if err := tw.commit(); err != nil {
+				s.logger.ErrorContext(r.Context(), "Failed to write response", "err", err, "path", r.URL.Path)
+			}
+		case <-ctx.Done():
+			tw.mu.Lock()
+			if tw.committed {
+				tw.mu.Unlock()
+				select {
+				case p := <-panicked:
+					panic(p)
+				case <-done:
+				}
+				return
+			}
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			s.logger.WarnContext(r.Context(), "Request timed out", "path", r.URL.Path, "status", http.StatusGatewayTimeout)
+			s.writeError(w, http.StatusGatewayTimeout, codeTimeout, "request timed out")
+		}
+	}
+}
+
+// timeoutWriter buffers a handler's response until withTimeout decides
+// whether to forward it or discard it, or until the handler flushes.
+type timeoutWriter struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+	// header is w's header once committed.
+	header      http.Header
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	timedOut    bool
+	committed   bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+	if tw.committed {
+		return tw.w.Write(b)
+	}
+	return tw.buf.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.code = code
+}
+
+// Flush sends the response so far and commits to streaming the rest.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.commit() != nil {
+		return
+	}
+	_ = http.NewResponseController(tw.w).Flush()
+}
+
+// commit sends the header, if not yet sent, and the buffered body. tw.mu
+// must be held.
+func (tw *timeoutWriter) commit() error {
+	if !tw.committed {
+		dst := tw.w.Header()
+		for k, v := range tw.header {
+			dst[k] = v
+		}
+		tw.header = dst
+		tw.w.WriteHeader(tw.code)
+		tw.committed = true
+	}
+	_, err := tw.w.Write(tw.buf.Bytes())
+	tw.buf.Reset()
+	return err
+}
+
+// noteServerError passes a server error noted by the handler on to the
+// writer underneath, unless the request has already timed out.
+func (tw *timeoutWriter) noteServerError(status int, code string, err error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		noteServerError(tw.w, status, code, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWithTimeout_CancelsSlowQuery(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	usePostgresStores(s)
+	s.cfg.RequestTimeout = 50 * time.Millisecond
+
+	mockSQL.ExpectQuery(selectProducts).
+		WillDelayFor(2 * time.Second).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(1, "Product A", "", 10.99, time.Now(), nil, nil))
+
+	handlerDone := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		s.productsHandler(w, r)
+		close(handlerDone)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	s.withTimeout(handler)(w, req)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handler did not return at the deadline, took %v", elapsed)
+	}
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeTimeout || got.Message == "" {
+		t.Errorf("expected a timeout error, got %+v", got)
+	}
+
+	// the query context is cancelled, so the query returns long before
+	// sqlmock's delay elapses
+	select {
+	case <-handlerDone:
+	case <-time.After(time.Second):
+		t.Errorf("query was not cancelled at the deadline")
+	}
+}
+
+func TestWithTimeout_PassesThroughFastResponse(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.RequestTimeout = time.Second
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	s.withTimeout(handler)(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected 201, got %d", w.Code)
+	}
+	if w.Header().Get("X-Test") != "yes" {
+		t.Errorf("expected handler header to be forwarded")
+	}
+	if w.Body.String() != "created" {
+		t.Errorf("expected body %q, got %q", "created", w.Body.String())
+	}
+}
+
+func TestWithTimeout_FlushedResponseStreams(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.RequestTimeout = 50 * time.Millisecond
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("first,"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("flush: %v", err)
+		}
+		<-r.Context().Done()
+		_, _ = w.Write([]byte("last"))
+	}
+
+	w := httptest.NewRecorder()
+	s.withTimeout(handler)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// Once flushed, the deadline ends the handler instead of replacing its
+	// response with a 504.
+	if w.Code != http.StatusOK || w.Body.String() != "first,last" || !w.Flushed {
+		t.Errorf("expected the flushed response, got %d %q (flushed %v)", w.Code, w.Body.String(), w.Flushed)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("expected the handler's Content-Type, got %q", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// certReloader serves the listener's certificate and client CA pool from
+// files that can be re-read while the server runs, so rotating them does
+// not need a restart.
+type certReloader struct {
+	certFile, keyFile, clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(certFile, keyFile, clientCAFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload re-reads the files. On error the previously loaded material stays
+// in use.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS key pair: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		if pool, err = loadCertPool(r.clientCAFile); err != nil {
+			return fmt.Errorf("client CA: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	return nil
+}
+
+// loadCertPool reads the PEM certificates in file into a pool.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns a server configuration that always uses the latest
+// loaded certificate and, with a client CA, requires and verifies client
+// certificates.
+func (r *certReloader) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+	if r.clientCAFile == "" {
+		return cfg
+	}
+
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.clientCAs
+		return c, nil
+	}
+	return cfg
+}
+
+// reloadOnSIGHUP re-reads the TLS files each time the process receives
+// SIGHUP, until ctx is done.
+func reloadOnSIGHUP(ctx context.Context, logger *slog.Logger, r *certReloader) {
+	onSIGHUP(ctx, func() {
+		if err := r.reload(); err != nil {
+			logger.Error("TLS reload failed, keeping previous certificate", "err", err)
+			return
+		}
+		logger.Info("TLS certificate reloaded", "cert_file", r.certFile)
+	})
+}
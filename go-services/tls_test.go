@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key signed by a test CA, with PEM copies on
+// disk for newCertReloader.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func (c testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// newTestCert issues a certificate for cn, signed by parent or self-signed
+// when parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	c := testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	writePEM(t, c.certFile, "CERTIFICATE", der)
+	writePEM(t, c.keyFile, "EC PRIVATE KEY", keyDER)
+	return c
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+// serveTLS runs the reloader's config through serve on an ephemeral port,
+// the way main does, and returns its address.
+func serveTLS(t *testing.T, r *certReloader) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }),
+		TLSConfig: r.tlsConfig(),
+		// Rejected handshakes are expected here.
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = serve(ctx, discardLogger, shutdownOptions{timeout: time.Second}, listener{name: "public", srv: srv, ln: ln})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+func tlsClient(ca testCert, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: certs,
+		}},
+	}
+}
+
+func TestTLSListener_ServesTLS12Plus(t *testing.T) {
+	t.Parallel()
+	ca := newTestCert(t, "test CA", nil, 0)
+	server := newTestCert(t, "server", &ca, x509.ExtKeyUsageServerAuth)
+
+	r, err := newCertReloader(server.certFile, server.keyFile, "")
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	addr := serveTLS(t, r)
+
+	resp, err := tlsClient(ca).Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("TLS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2+, got %+v", resp.TLS)
+	}
+
+	old := tlsClient(ca)
+	old.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS11
+	if _, err := old.Get("https://" + addr + "/"); err == nil {
+		t.Error("expected a TLS 1.1 client to be refused")
+	}
+}
+
+func TestTLSListener_MutualTLS(t *testing.T) {
+	t.Parallel()
+	ca := newTestCert(t, "test CA", nil, 0)
+	server := newTestCert(t, "server", &ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "client", &ca, x509.ExtKeyUsageClientAuth)
+	otherCA := newTestCert(t, "other CA", nil, 0)
+	stranger := newTestCert(t, "stranger", &otherCA, x509.ExtKeyUsageClientAuth)
+
+	r, err := newCertReloader(server.certFile, server.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	addr := serveTLS(t, r)
+
+	if _, err := tlsClient(ca).Get("https://" + addr + "/"); err == nil {
+		t.Error("expected a client without a certificate to be rejected")
+	}
+	if _, err := tlsClient(ca, stranger.tlsCertificate()).Get("https://" + addr + "/"); err == nil {
+		t.Error("expected a client certificate from another CA to be rejected")
+	}
+	resp, err := tlsClient(ca, client.tlsCertificate()).Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("expected a client with a valid certificate to be accepted: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", resp.StatusCode)
+	}
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	t.Parallel()
+	ca := newTestCert(t, "test CA", nil, 0)
+	first := newTestCert(t, "first", &ca, x509.ExtKeyUsageServerAuth)
+	second := newTestCert(t, "second", &ca, x509.ExtKeyUsageServerAuth)
+
+	r, err := newCertReloader(first.certFile, first.keyFile, "")
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	get := r.tlsConfig().GetCertificate
+
+	// Rotate the files in place.
+	for src, dst := range map[string]string{second.certFile: first.certFile, second.keyFile: first.keyFile} {
+		b, _ := os.ReadFile(src)
+		if err := os.WriteFile(dst, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	cert, _ := get(nil)
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName != "second" {
+		t.Errorf("expected the rotated certificate, got %q", leaf.Subject.CommonName)
+	}
+
+	// A broken file leaves the current certificate in place.
+	if err := os.WriteFile(first.certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Error("expected reload to fail on a broken certificate")
+	}
+	cert, _ = get(nil)
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName != "second" {
+		t.Errorf("expected the last good certificate to stay, got %q", leaf.Subject.CommonName)
+	}
+}
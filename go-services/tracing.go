@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "go-service"
+
+// withTracing starts a server span for every request, continuing the trace
+// from an incoming traceparent header when present.
+func (s *Server) withTracing(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := routePath(r.Pattern)
+		if route == "" {
+			route = r.URL.Path
+		}
+		ctx, span := s.tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := newStatusRecorder(w)
+		handler(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
+// Supported values of OTEL_EXPORTER.
+const (
+	exporterStdout   = "stdout"
+	exporterOTLPGRPC = "otlp-grpc"
+	exporterOTLPHTTP = "otlp-http"
+	exporterNone     = "none"
+)
+
+// tracerConfig selects the span exporter and describes the service in the
+// exported resource.
+type tracerConfig struct {
+	Exporter       string
+	Endpoint       string
+	SampleRatio    float64
+	ServiceName    string
+	ServiceVersion string
+	Environment    string
+}
+
+func tracerConfigFromEnv() (tracerConfig, error) {
+	cfg := tracerConfig{
+		Exporter:       strings.ToLower(envOr("OTEL_EXPORTER", exporterStdout)),
+		Endpoint:       os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		SampleRatio:    1,
+		ServiceName:    envOr("OTEL_SERVICE_NAME", tracerName),
+		ServiceVersion: envOr("SERVICE_VERSION", "dev"),
+		Environment:    os.Getenv("DEPLOYMENT_ENVIRONMENT"),
+	}
+
+	switch cfg.Exporter {
+	case exporterStdout, exporterOTLPGRPC, exporterOTLPHTTP, exporterNone:
+	default:
+		return tracerConfig{}, fmt.Errorf("invalid OTEL_EXPORTER %q: must be one of stdout, otlp-grpc, otlp-http, none", cfg.Exporter)
+	}
+
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return tracerConfig{}, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q: must be a number between 0 and 1", v)
+		}
+		cfg.SampleRatio = ratio
+	}
+
+	if cfg.Endpoint != "" {
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return tracerConfig{}, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q: must be a URL such as http://collector:4317", cfg.Endpoint)
+		}
+	}
+	return cfg, nil
+}
+
+// newSpanExporter returns the exporter selected by cfg, or nil for "none".
+func newSpanExporter(ctx context.Context, cfg tracerConfig) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case exporterStdout:
+		return stdouttrace.New()
+	case exporterOTLPGRPC:
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(cfg.Endpoint))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case exporterOTLPHTTP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case exporterNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+}
+
+// newTracerProvider builds a provider that samples cfg.SampleRatio of new
+// traces, follows the caller's decision for propagated ones, and batches spans
+// to the configured exporter.
+func newTracerProvider(ctx context.Context, cfg tracerConfig) (*sdktrace.TracerProvider, error) {
+	exporter, err := newSpanExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.ServiceVersion(cfg.ServiceVersion),
+	}
+	if cfg.Environment != "" {
+		attrs = append(attrs, semconv.DeploymentEnvironment(cfg.Environment))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attrs...))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+// envOr returns the named env var, or def when it is unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
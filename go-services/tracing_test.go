@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/XSAM/otelsql"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func init() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// withSpanRecorder points s at an in-memory exporter and returns it.
+func withSpanRecorder(t *testing.T, s *Server) *tracetest.InMemoryExporter {
+	t.Helper()
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	s.tracer = tp.Tracer(tracerName)
+	return exp
+}
+
+func spanAttr(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestWithTracing_ProductsCreatesServerAndDBSpans(t *testing.T) {
+	t.Parallel()
+	s, mockSQL, _ := newTestServer(t)
+	exp := withSpanRecorder(t, s)
+	usePostgresStores(s)
+
+	mockSQL.ExpectQuery(selectProducts).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(1, "Product A", "", 10.99, time.Now(), nil, nil))
+	expectCount(mockSQL, 1)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	var server, db tracetest.SpanStub
+	for _, sp := range spans {
+		switch {
+		case sp.SpanKind == trace.SpanKindServer:
+			server = sp
+		case sp.Name == "db.list_products":
+			db = sp
+		}
+	}
+
+	if got := spanAttr(server, "http.request.method").AsString(); got != "GET" {
+		t.Errorf("expected method GET, got %q", got)
+	}
+	if got := spanAttr(server, "http.route").AsString(); got != "/products" {
+		t.Errorf("expected route /products, got %q", got)
+	}
+	if got := spanAttr(server, "http.response.status_code").AsInt64(); got != 200 {
+		t.Errorf("expected status 200, got %d", got)
+	}
+	if db.Name != "db.list_products" {
+		t.Fatalf("expected a db.list_products span, got %q", db.Name)
+	}
+	if db.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("DB span is not a child of the server span")
+	}
+}
+
+func TestWithTracing_HonorsTraceparent(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	exp := withSpanRecorder(t, s)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	sc := spans[0].SpanContext
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the incoming trace id, got %s", sc.TraceID())
+	}
+	if spans[0].Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the incoming span as parent, got %s", spans[0].Parent.SpanID())
+	}
+	if !spans[0].Parent.IsRemote() {
+		t.Errorf("expected a remote parent")
+	}
+}
+
+func TestTracerConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    tracerConfig
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{},
+			want: tracerConfig{Exporter: "stdout", SampleRatio: 1, ServiceName: "go-service", ServiceVersion: "dev"},
+		},
+		{
+			name: "otlp grpc with sampler and resource",
+			env: map[string]string{
+				"OTEL_EXPORTER":               "OTLP-GRPC",
+				"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317",
+				"OTEL_TRACES_SAMPLER_ARG":     "0.25",
+				"OTEL_SERVICE_NAME":           "products",
+				"SERVICE_VERSION":             "1.2.3",
+				"DEPLOYMENT_ENVIRONMENT":      "staging",
+			},
+			want: tracerConfig{
+				Exporter: "otlp-grpc", Endpoint: "http://collector:4317", SampleRatio: 0.25,
+				ServiceName: "products", ServiceVersion: "1.2.3", Environment: "staging",
+			},
+		},
+		{name: "unknown exporter", env: map[string]string{"OTEL_EXPORTER": "jaeger"}, wantErr: true},
+		{name: "ratio above one", env: map[string]string{"OTEL_TRACES_SAMPLER_ARG": "1.5"}, wantErr: true},
+		{name: "ratio not a number", env: map[string]string{"OTEL_TRACES_SAMPLER_ARG": "half"}, wantErr: true},
+		{name: "endpoint without scheme", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "collector:4317"}, wantErr: true},
+	}
+
+	keys := []string{"OTEL_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_TRACES_SAMPLER_ARG",
+		"OTEL_SERVICE_NAME", "SERVICE_VERSION", "DEPLOYMENT_ENVIRONMENT"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range keys {
+				t.Setenv(k, tt.env[k])
+			}
+			got, err := tracerConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSpanExporter_SelectsByName(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tests := []struct {
+		exporter string
+		wantType string
+	}{
+		{exporterStdout, "*stdouttrace.Exporter"},
+		{exporterOTLPGRPC, "*otlptrace.Exporter"},
+		{exporterOTLPHTTP, "*otlptrace.Exporter"},
+		{exporterNone, "<nil>"},
+	}
+	for _, tt := range tests {
+		exp, err := newSpanExporter(ctx, tracerConfig{Exporter: tt.exporter, Endpoint: "http://localhost:4317"})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.exporter, err)
+		}
+		if got := fmt.Sprintf("%T", exp); got != tt.wantType {
+			t.Errorf("%s: got exporter %s, want %s", tt.exporter, got, tt.wantType)
+		}
+		if exp != nil {
+			_ = exp.Shutdown(ctx)
+		}
+	}
+}
+
+func TestNewTracerProvider_AppliesResourceAndSampler(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	cfg := tracerConfig{Exporter: exporterNone, SampleRatio: 1, ServiceName: "svc", ServiceVersion: "v1", Environment: "prod"}
+
+	tp, err := newTracerProvider(ctx, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tp.Shutdown(ctx)
+	rec := tracetest.NewSpanRecorder()
+	tp.RegisterSpanProcessor(rec)
+
+	_, span := tp.Tracer("test").Start(ctx, "op")
+	span.End()
+
+	ended := rec.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("expected 1 recorded span, got %d", len(ended))
+	}
+	attrs := map[attribute.Key]string{}
+	for _, kv := range ended[0].Resource().Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs["service.name"] != "svc" || attrs["service.version"] != "v1" || attrs["deployment.environment"] != "prod" {
+		t.Errorf("unexpected resource attributes: %v", attrs)
+	}
+
+	cfg.SampleRatio = 0
+	dropAll, err := newTracerProvider(ctx, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer dropAll.Shutdown(ctx)
+	_, span = dropAll.Tracer("test").Start(ctx, "op")
+	defer span.End()
+	if span.SpanContext().IsSampled() {
+		t.Errorf("expected a zero sample ratio to drop new traces")
+	}
+}
+
+func TestTracing_DBSpanIsChildOfRequestSpan(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	s.tracer = tp.Tracer(tracerName)
+
+	dsn := "otelsql_" + t.Name()
+	mockDB, mockSQL, err := sqlmock.NewWithDSN(dsn)
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	// Closing the mock frees its DSN for the next run under -count.
+	t.Cleanup(func() { mockDB.Close() })
+	db, err := otelsql.Open("sqlmock", dsn, append(dbTracingOptions(), otelsql.WithTracerProvider(tp))...)
+	if err != nil {
+		t.Fatalf("open instrumented DB: %v", err)
+	}
+	s.db.Close()
+	s.db = db
+	usePostgresStores(s)
+
+	mockSQL.ExpectQuery(selectProducts).
+		WillReturnRows(sqlmock.NewRows(productRowColumns).AddRow(1, "Product A", "", 10.99, time.Now(), nil, nil))
+	expectCount(mockSQL, 1)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	byID := make(map[trace.SpanID]tracetest.SpanStub)
+	var server, query tracetest.SpanStub
+	for _, sp := range exp.GetSpans() {
+		byID[sp.SpanContext.SpanID()] = sp
+		switch {
+		case sp.SpanKind == trace.SpanKindServer:
+			server = sp
+		case sp.Name == "sql.conn.query" && query.Name == "":
+			query = sp
+		}
+	}
+	if query.Name == "" {
+		t.Fatal("expected a sql.conn.query span")
+	}
+	if got := spanAttr(query, "db.system").AsString(); got != "postgresql" {
+		t.Errorf("expected db.system postgresql, got %q", got)
+	}
+	for sp := query; sp.Parent.SpanID() != server.SpanContext.SpanID(); sp = byID[sp.Parent.SpanID()] {
+		if !sp.Parent.IsValid() {
+			t.Fatalf("DB span is not under the server span")
+		}
+	}
+}
+
+func TestInstrumentRedis_TracesCommandsWithoutArguments(t *testing.T) {
+	t.Parallel()
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+
+	// Nothing listens on port 1; the command fails but is still traced.
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { rdb.Close() })
+	if err := instrumentRedis(rdb, redisotel.WithTracerProvider(tp)); err != nil {
+		t.Fatalf("instrument Redis: %v", err)
+	}
+
+	ctx, parent := tp.Tracer(tracerName).Start(context.Background(), "request")
+	_ = rdb.Get(ctx, "session:secret").Err()
+	parent.End()
+
+	var get tracetest.SpanStub
+	for _, sp := range exp.GetSpans() {
+		if sp.Name == "get" {
+			get = sp
+		}
+	}
+	if get.Name == "" {
+		t.Fatal("expected a get span")
+	}
+	if get.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Redis span is not a child of the caller's span")
+	}
+	if got := spanAttr(get, "db.statement"); got.Type() != attribute.INVALID {
+		t.Errorf("expected no db.statement, got %q", got.Emit())
+	}
+}
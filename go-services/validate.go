@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// fieldError is a rule broken by one field of a request body. Field is the
+// JSON name, dotted for nested fields, such as "items.2.quantity".
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists every invalid field of a request body, in the
+// order they were checked.
+type validationError []fieldError
+
+// Error joins the fields' messages, so "name is required; price must not be
+// negative".
+func (e validationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validator collects the field errors of a request body.
+type validator struct {
+	errs validationError
+}
+
+// check records msg for field unless ok. Only the first failed check of a
+// field is kept, so later checks may assume the earlier ones passed.
+func (v *validator) check(ok bool, field, msg string) {
+	if ok || v.failed(field) {
+		return
+	}
+	v.errs = append(v.errs, fieldError{Field: field, Message: msg})
+}
+
+func (v *validator) failed(field string) bool {
+	for _, f := range v.errs {
+		if f.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns the collected errors, or nil if every check passed.
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// fieldErrors returns the fields of a validationError, and nil for any
+// other error.
+func fieldErrors(err error) []fieldError {
+	var verr validationError
+	if errors.As(err, &verr) {
+		return verr
+	}
+	return nil
+}
+
+// writeValidationError answers 400 validation_failed with err's fields.
+func (s *Server) writeValidationError(w http.ResponseWriter, err error) {
+	s.writeJSON(w, http.StatusBadRequest, errorResponse{Error: errorDetail{Code: codeValidation, Message: err.Error(), Fields: fieldErrors(err)}})
+}
+
+// decodeFieldError turns an error from decoding a request body into the
+// field it concerns: a value of the wrong JSON type or, with
+// DisallowUnknownFields, a field the body must not have. It returns false
+// for other errors.
+func decodeFieldError(err error) (fieldError, bool) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fieldError{Field: typeErr.Field, Message: "must be " + jsonTypeName(typeErr.Type)}, true
+	}
+	// encoding/json has no error type for unknown fields.
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fieldError{Field: strings.Trim(name, `"`), Message: "is not a known field"}, true
+	}
+	return fieldError{}, false
+}
+
+// jsonTypeName describes the JSON value a Go type decodes from.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeJSON_FieldErrors(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		post   func(*Server, string) *httptest.ResponseRecorder
+		body   string
+		code   string
+		fields []fieldError
+	}{
+		{
+			name:   "unknown field",
+			post:   postProduct,
+			body:   `{"name":"Chair","price":1,"colour":"red"}`,
+			code:   codeValidation,
+			fields: []fieldError{{"colour", "is not a known field"}},
+		},
+		{
+			name:   "string where a number is expected",
+			post:   postProduct,
+			body:   `{"name":"Chair","price":"cheap"}`,
+			code:   codeValidation,
+			fields: []fieldError{{"price", "must be a number"}},
+		},
+		{
+			name:   "number where a string is expected",
+			post:   postLogin,
+			body:   `{"username":42,"password":"x"}`,
+			code:   codeValidation,
+			fields: []fieldError{{"username", "must be a string"}},
+		},
+		{
+			name:   "nested type mismatch",
+			post:   postOrder,
+			body:   `{"items":[{"product_id":1,"quantity":"two"}]}`,
+			code:   codeValidation,
+			fields: []fieldError{{"items.0.quantity", "must be an integer"}},
+		},
+		{
+			name: "trailing garbage",
+			post: postProduct,
+			body: `{"name":"Chair","price":1} {"name":"Desk"}`,
+			code: codeBadRequest,
+		},
+		{
+			name: "trailing bracket",
+			post: postRegister,
+			body: `{"username":"alice","password":"correct horse"}}`,
+			code: codeBadRequest,
+		},
+		{
+			name: "malformed JSON",
+			post: postProduct,
+			body: `{"name":`,
+			code: codeBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		w := tt.post(s, tt.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.name, w.Code)
+		}
+		got := decodeError(t, w)
+		if got.Code != tt.code || !reflect.DeepEqual(got.Fields, tt.fields) {
+			t.Errorf("%s: expected %s %v, got %+v", tt.name, tt.code, tt.fields, got)
+		}
+	}
+}
+
+func TestValidate_ReportsEveryField(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		post   func(*Server, string) *httptest.ResponseRecorder
+		body   string
+		fields []fieldError
+	}{
+		{
+			name: "product",
+			post: postProduct,
+			body: `{"name":" ","price":-1}`,
+			fields: []fieldError{
+				{"name", "is required"},
+				{"price", "must not be negative"},
+			},
+		},
+		{
+			name:   "product without price",
+			post:   postProduct,
+			body:   `{"name":"Chair"}`,
+			fields: []fieldError{{"price", "is required"}},
+		},
+		{
+			name: "login",
+			post: postLogin,
+			body: `{}`,
+			fields: []fieldError{
+				{"username", "is required"},
+				{"password", "is required"},
+			},
+		},
+		{
+			name: "register",
+			post: postRegister,
+			body: `{"username":"A","password":"short"}`,
+			fields: []fieldError{
+				{"username", "must be 3 to 64 lowercase letters or digits"},
+				{"password", "must be at least 8 characters"},
+			},
+		},
+		{
+			name: "order",
+			post: postOrder,
+			body: `{"items":[{"product_id":0,"quantity":1},{"product_id":2,"quantity":0},{"product_id":2,"quantity":1}]}`,
+			fields: []fieldError{
+				{"items.0.product_id", "must be a positive integer"},
+				{"items.1.quantity", "must be between 1 and 10000"},
+				{"items.2.product_id", "lists product 2 more than once"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		w := tt.post(s, tt.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.name, w.Code)
+		}
+		got := decodeError(t, w)
+		if got.Code != codeValidation || !reflect.DeepEqual(got.Fields, tt.fields) {
+			t.Errorf("%s: expected fields %v, got %+v", tt.name, tt.fields, got)
+		}
+	}
+}
+
+func TestValidationError_Message(t *testing.T) {
+	t.Parallel()
+	err := validationError{{"name", "is required"}, {"price", "must not be negative"}}
+	if got := err.Error(); got != "name is required; price must not be negative" {
+		t.Errorf("unexpected message %q", got)
+	}
+}
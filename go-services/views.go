@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-service/store"
+)
+
+const (
+	// viewsBuffer is how many product views may wait for the recorder;
+	// views beyond it are dropped rather than holding up requests.
+	viewsBuffer = 4096
+	// viewsFlushInterval is how often the recorder writes its counts to
+	// Redis.
+	viewsFlushInterval = time.Second
+	// viewsWindowDays is how many daily view sets the top products are
+	// computed from; older sets expire.
+	viewsWindowDays = 7
+	// viewsDecay weighs a day's views against those of the day after, so
+	// popularity fades over the window.
+	viewsDecay = 0.8
+	// topProductsTTL is how long the union of the daily sets is reused.
+	topProductsTTL = time.Minute
+
+	defaultTopLimit = 10
+	maxTopLimit     = 100
+)
+
+// countView queues a view of product id for runViewRecorder. It never
+// blocks: without a recorder, or with its queue full, the view is dropped.
+func (s *Server) countView(id int64) {
+	select {
+	case s.views <- id:
+	default:
+		s.metrics.productViewsDropped.Inc()
+	}
+}
+
+// runViewRecorder adds the views queued by countView to today's view set
+// every viewsFlushInterval until ctx is cancelled. Views it fails to write
+// are only logged: the counts are approximate by design.
+func (s *Server) runViewRecorder(ctx context.Context) {
+	ticker := time.NewTicker(viewsFlushInterval)
+	defer ticker.Stop()
+
+	counts := make(map[int64]int64)
+	for {
+		select {
+		case id := <-s.views:
+			counts[id]++
+		case <-ticker.C:
+			s.flushViews(ctx, time.Now(), counts)
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+			s.flushViews(flushCtx, time.Now(), counts)
+			cancel()
+			return
+		}
+	}
+}
+
+// flushViews adds counts to the view set of the day of now and clears
+// them.
+func (s *Server) flushViews(ctx context.Context, now time.Time, counts map[int64]int64) {
+	if len(counts) == 0 {
+		return
+	}
+	defer clear(counts)
+	if err := s.writeViews(ctx, now, counts); err != nil {
+		s.logger.WarnContext(ctx, "Failed to record product views", "products", len(counts), "err", err)
+	}
+}
+
+func (s *Server) writeViews(ctx context.Context, now time.Time, counts map[int64]int64) error {
+	key := s.keys.productViews(now)
+	ids := make([]int64, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.ZIncrBy(ctx, key, float64(counts[id]), strconv.FormatInt(id, 10))
+		}
+		pipe.ExpireNX(ctx, key, (viewsWindowDays+1)*24*time.Hour)
+		return nil
+	})
+	return err
+}
+
+type topProduct struct {
+	ID    int64   `json:"id"`
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+type topProductsResponse struct {
+	Items []topProduct `json:"items"`
+}
+
+// topProductsHandler returns the most viewed products, most popular first.
+func (s *Server) topProductsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	limit := defaultTopLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxTopLimit)
+	}
+
+	ranked, err := s.topProductIDs(ctx, time.Now(), limit)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to rank products", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	ids := make([]int64, len(ranked))
+	for i, r := range ranked {
+		ids[i] = r.id
+	}
+	products, err := s.productsByID(ctx, ids)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "DB query failed", "err", err, "path", r.URL.Path)
+		s.writeDBError(w, err)
+		return
+	}
+
+	resp := topProductsResponse{Items: []topProduct{}}
+	for _, r := range ranked {
+		// Products deleted since they were viewed are left out.
+		if p, ok := products[r.id]; ok {
+			resp.Items = append(resp.Items, topProduct{ID: r.id, Name: p.Name, Score: r.score})
+		}
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// productScore is a product's decayed view count.
+type productScore struct {
+	id    int64
+	score float64
+}
+
+// topProductIDs returns the limit highest scored products of the view sets
+// of the viewsWindowDays up to now, each day weighted viewsDecay times the
+// next. The union is stored for topProductsTTL and reused until then.
+func (s *Server) topProductIDs(ctx context.Context, now time.Time, limit int) ([]productScore, error) {
+	top := s.keys.productViewsTop()
+	n, err := s.rdb.Exists(ctx, top).Result()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		union := redis.ZStore{
+			Keys:    make([]string, viewsWindowDays),
+			Weights: make([]float64, viewsWindowDays),
+		}
+		for day := range viewsWindowDays {
+			union.Keys[day] = s.keys.productViews(now.AddDate(0, 0, -day))
+			union.Weights[day] = math.Pow(viewsDecay, float64(day))
+		}
+		// The keys share a hash tag, so this works in a cluster too.
+		_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZUnionStore(ctx, top, &union)
+			pipe.Expire(ctx, top, topProductsTTL)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	zs, err := s.rdb.ZRevRangeWithScores(ctx, top, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ranked := make([]productScore, 0, len(zs))
+	for _, z := range zs {
+		member, _ := z.Member.(string)
+		if id, err := strconv.ParseInt(member, 10, 64); err == nil {
+			ranked = append(ranked, productScore{id: id, score: z.Score})
+		}
+	}
+	return ranked, nil
+}
+
+// productsByID returns the products with the given ids that exist, reading
+// the product cache first and Postgres for the rest. Products the cache
+// knows to be missing are not looked up again.
+func (s *Server) productsByID(ctx context.Context, ids []int64) (map[int64]store.Product, error) {
+	products := make(map[int64]store.Product, len(ids))
+	if len(ids) == 0 {
+		return products, nil
+	}
+
+	missing := ids
+	if s.settings().ProductsCacheTTL > 0 {
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = s.keys.product(id)
+		}
+		vals, err := getKeys(ctx, s.rdb, keys...)
+		if err != nil {
+			s.logger.WarnContext(ctx, "Product cache read failed", "err", err)
+		} else {
+			missing = nil
+			for i, v := range vals {
+				if p, found, ok := s.cachedProduct(ctx, keys[i], v); !ok {
+					missing = append(missing, ids[i])
+				} else if found {
+					products[ids[i]] = p
+				}
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return products, nil
+	}
+
+	found, err := s.products.GetMany(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range found {
+		products[p.ID] = p
+	}
+	return products, nil
+}
+
+// cachedProduct decodes the value getKeys returned for the product cache key
+// key. ok is false if the value does not settle whether the product exists,
+// and found is false if it is cacheMissing.
+func (s *Server) cachedProduct(ctx context.Context, key string, v any) (p store.Product, found, ok bool) {
+	value, isString := v.(string)
+	if !isString {
+		return p, false, false
+	}
+	if value == string(cacheMissing) {
+		return p, false, true
+	}
+	body, err := s.cacheCodec.decode([]byte(value))
+	if err == nil {
+		err = json.Unmarshal(body, &p)
+	}
+	if err != nil {
+		s.logger.WarnContext(ctx, "Cache read failed", "key", key, "err", err)
+		return p, false, false
+	}
+	return p, true, true
+}
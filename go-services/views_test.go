@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+var testViewDay = time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC)
+
+func TestProductHandler_CountsViewWithoutWaiting(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.views = make(chan int64, 1)
+	testProducts(s).add(testProduct(7, "Product G", 3.5, time.Now()))
+	h := s.Handler()
+
+	// Nothing drains the queue, so the second view does not fit.
+	for range 2 {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/7", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+	}
+
+	if got := <-s.views; got != 7 {
+		t.Errorf("expected a view of product 7, got %d", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.productViewsDropped); got != 1 {
+		t.Errorf("expected one dropped view, got %v", got)
+	}
+}
+
+func TestFlushViews_AddsCountsToTheDay(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	key := testKeys.productViews(testViewDay)
+
+	redisMock.ExpectZIncrBy(key, 2, "7").SetVal(2)
+	redisMock.ExpectZIncrBy(key, 1, "9").SetVal(1)
+	redisMock.ExpectExpireNX(key, 8*24*time.Hour).SetVal(true)
+
+	counts := map[int64]int64{9: 1, 7: 2}
+	s.flushViews(context.Background(), testViewDay, counts)
+
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("expected the counts to be cleared, got %v", counts)
+	}
+}
+
+func TestFlushViews_RedisFailureIsOnlyLogged(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	key := testKeys.productViews(testViewDay)
+
+	redisMock.ExpectZIncrBy(key, 1, "7").SetErr(errors.New("connection refused"))
+	redisMock.ExpectExpireNX(key, 8*24*time.Hour).SetErr(errors.New("connection refused"))
+
+	counts := map[int64]int64{7: 1}
+	s.flushViews(context.Background(), testViewDay, counts)
+
+	if len(counts) != 0 {
+		t.Errorf("expected failed counts to be dropped, got %v", counts)
+	}
+}
+
+func TestTopProductIDs_UnionsDecayedDays(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	top := testKeys.productViewsTop()
+
+	union := redis.ZStore{}
+	// Today's views count fully, yesterday's 0.8 times, and so on for a
+	// week.
+	for day := range 7 {
+		union.Keys = append(union.Keys, testKeys.productViews(testViewDay.AddDate(0, 0, -day)))
+		union.Weights = append(union.Weights, math.Pow(0.8, float64(day)))
+	}
+	redisMock.ExpectExists(top).SetVal(0)
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectZUnionStore(top, &union).SetVal(2)
+	redisMock.ExpectExpire(top, time.Minute).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+	redisMock.ExpectZRevRangeWithScores(top, 0, 9).SetVal([]redis.Z{{Score: 4.8, Member: "9"}, {Score: 2, Member: "7"}})
+
+	ranked, err := s.topProductIDs(context.Background(), testViewDay, 10)
+	if err != nil {
+		t.Fatalf("topProductIDs: %v", err)
+	}
+	want := []productScore{{id: 9, score: 4.8}, {id: 7, score: 2}}
+	if len(ranked) != len(want) || ranked[0] != want[0] || ranked[1] != want[1] {
+		t.Errorf("got %+v, want %+v", ranked, want)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTopProductsHandler_JoinsNamesInScoreOrder(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	top := testKeys.productViewsTop()
+	testProducts(s).add(
+		testProduct(7, "Chair", 49.5, time.Now()),
+		testProduct(9, "Desk", 120, time.Now()),
+	)
+
+	redisMock.ExpectExists(top).SetVal(1)
+	redisMock.ExpectZRevRangeWithScores(top, 0, 2).SetVal([]redis.Z{
+		{Score: 5, Member: "9"},
+		{Score: 3, Member: "8"},
+		{Score: 1, Member: "7"},
+	})
+	// 9 is cached; 8 was deleted and 7 is only in Postgres.
+	cached, _ := json.Marshal(testProduct(9, "Desk", 120, time.Now()))
+	expectGetKeys(redisMock, []string{testKeys.product(9), testKeys.product(8), testKeys.product(7)}, string(cached), nil)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/top?limit=3", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got topProductsResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	want := []topProduct{{ID: 9, Name: "Desk", Score: 5}, {ID: 7, Name: "Chair", Score: 1}}
+	if len(got.Items) != len(want) || got.Items[0] != want[0] || got.Items[1] != want[1] {
+		t.Errorf("got %+v, want %+v", got.Items, want)
+	}
+	if calls := testProducts(s).callCount(); calls != 1 {
+		t.Errorf("expected one store call for the uncached products, got %d", calls)
+	}
+}
+
+func TestProductsByID_DecodesCacheFormats(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	s.cacheCodec = cacheCodec{msgpack: true, compression: cacheSnappy}
+	testProducts(s).add(
+		testProduct(7, "Chair", 49.5, time.Now()),
+		testProduct(8, "Lamp", 15, time.Now()),
+	)
+
+	// 9 is cached as MessagePack compressed with snappy, 8 is cached as
+	// missing and 7 is only in Postgres.
+	body, _ := json.Marshal(testProduct(9, "Desk", 120, time.Now()))
+	cached, _, err := s.cacheCodec.encode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGetKeys(redisMock, []string{testKeys.product(9), testKeys.product(8), testKeys.product(7)}, string(cached), string(cacheMissing), nil)
+
+	products, err := s.productsByID(context.Background(), []int64{9, 8, 7})
+	if err != nil {
+		t.Fatalf("productsByID: %v", err)
+	}
+	if len(products) != 2 || products[9].Name != "Desk" || products[7].Name != "Chair" {
+		t.Errorf("expected Desk from the cache and Chair from Postgres, got %+v", products)
+	}
+	if calls := testProducts(s).callCount(); calls != 1 {
+		t.Errorf("expected one store call for the uncached product, got %d", calls)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTopProductsHandler_Limit(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	top := testKeys.productViewsTop()
+
+	redisMock.ExpectExists(top).SetVal(1)
+	redisMock.ExpectZRevRangeWithScores(top, 0, 99).SetVal([]redis.Z{})
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/top?limit=1000", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the limit to be capped at 100: %v", err)
+	}
+
+	for _, limit := range []string{"0", "-1", "ten"} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/top?limit="+limit, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("limit=%s: expected 400, got %d", limit, w.Code)
+		}
+	}
+}
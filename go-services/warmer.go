@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+
+	"go-service/store"
+)
+
+// productsRefreshLock is taken by the replica refreshing the product list
+// cache, so the others skip that round.
+const productsRefreshLock = "products-refresh"
+
+// refreshLockTTL is how long a replica holds productsRefreshLock for a
+// refresh every interval. It is left to expire rather than released, which
+// limits the whole fleet to one refresh per round; expiring a little before
+// the next tick lets whichever replica ticks first take the next one.
+func refreshLockTTL(interval time.Duration) time.Duration {
+	return interval * 4 / 5
+}
+
+// runProductsWarmer keeps the first page of the product list cached,
+// refreshing it immediately and then every interval until ctx is cancelled.
+// Failures are logged and retried on the next tick.
+func (s *Server) runProductsWarmer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		refreshed, err := s.refreshProductsCache(ctx, refreshLockTTL(interval))
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			s.logger.WarnContext(ctx, "Products cache refresh failed", "err", err)
+		case !refreshed:
+			s.logger.DebugContext(ctx, "Products cache refresh skipped; another replica holds the lock")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshProductsCache loads the page served for a plain GET /products and
+// stores it in the cache and the stale copy. It reports false without error
+// when another replica holds the refresh lock. The work is bounded by
+// lockTTL so it cannot outlast the lock.
+func (s *Server) refreshProductsCache(ctx context.Context, lockTTL time.Duration) (bool, error) {
+	if _, err := newRedisLocker(s.rdb, s.keys).Acquire(ctx, productsRefreshLock, lockTTL); err != nil {
+		if errors.Is(err, errLockHeld) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lockTTL)
+	defer cancel()
+	ctx, span := s.tracer.Start(ctx, "cache.refresh products")
+	defer span.End()
+
+	start := time.Now()
+	err := s.loadProductsCache(ctx)
+	s.metrics.cacheRefreshes.WithLabelValues("products").Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "refresh failed")
+		return false, err
+	}
+	s.metrics.cacheRefreshSuccess.WithLabelValues("products").SetToCurrentTime()
+	return true, nil
+}
+
+func (s *Server) loadProductsCache(ctx context.Context) error {
+	page, filter := pageParams{Limit: defaultPageLimit}, productFilter{Sort: store.DefaultProductSort}
+	resp, err := s.offsetPage(ctx, filter, page)
+	if err != nil {
+		return fmt.Errorf("load products: %w", err)
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("encode products: %w", err)
+	}
+
+	field := productsCacheField(page, filter)
+	if err := s.cacheSetPage(ctx, field, body, etagFor(body)); err != nil {
+		return fmt.Errorf("write products cache: %w", err)
+	}
+	s.staleSetField(ctx, field, body)
+	return nil
+}
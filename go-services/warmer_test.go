@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	redismock "github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var testRefreshLockKey = testKeys.lock(productsRefreshLock)
+
+func expectRefreshLock(redisMock redismock.ClientMock, ttl time.Duration, acquired bool) {
+	redisMock.Regexp().ExpectSetNX(testRefreshLockKey, `^[0-9a-f]{32}$`, ttl).SetVal(acquired)
+}
+
+// refreshCount returns how many refreshes were timed, whatever their outcome.
+func refreshCount(t *testing.T, s *Server) uint64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := s.metrics.cacheRefreshes.WithLabelValues("products").(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
+
+func TestRefreshProductsCache_StoresFirstPage(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectRefreshLock(redisMock, time.Second, true)
+	testProducts(s).add(testProduct(1, "Product A", 10.99, created))
+
+	want := `{"items":[{"id":1,"name":"Product A","description":"","price":10.99,"created_at":"2024-01-02T03:04:05Z"}],"total":1,"limit":50,"offset":0}`
+	field := pageParams{Limit: defaultPageLimit}.cacheField()
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectHSet(testKeys.products(), field, []byte(want), productsETagField(field), etagFor([]byte(want))).SetVal(1)
+	redisMock.ExpectExpireNX(testKeys.products(), time.Minute).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	refreshed, err := s.refreshProductsCache(context.Background(), time.Second)
+	if err != nil || !refreshed {
+		t.Fatalf("expected a refresh, got %v, %v", refreshed, err)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+	if got := refreshCount(t, s); got != 1 {
+		t.Errorf("expected 1 timed refresh, got %d", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheRefreshSuccess.WithLabelValues("products")); got < float64(created.Unix()) {
+		t.Errorf("expected the last-success timestamp to be set, got %v", got)
+	}
+}
+
+func TestRefreshProductsCache_SkipsWhenLockHeld(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	expectRefreshLock(redisMock, time.Second, false)
+	refreshed, err := s.refreshProductsCache(context.Background(), time.Second)
+	if err != nil || refreshed {
+		t.Fatalf("expected the refresh to be skipped, got %v, %v", refreshed, err)
+	}
+	if n := testProducts(s).callCount(); n != 0 {
+		t.Errorf("expected no store access, got %d calls", n)
+	}
+	if got := refreshCount(t, s); got != 0 {
+		t.Errorf("expected a skipped refresh not to be timed, got %d", got)
+	}
+}
+
+func TestRefreshProductsCache_DBFailureIsReported(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+
+	expectRefreshLock(redisMock, time.Second, true)
+	testProducts(s).fail(errors.New("connection refused"))
+
+	if _, err := s.refreshProductsCache(context.Background(), time.Second); err == nil {
+		t.Fatal("expected the DB error")
+	}
+	if got := refreshCount(t, s); got != 1 {
+		t.Errorf("expected the failed refresh to be timed, got %d", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheRefreshSuccess.WithLabelValues("products")); got != 0 {
+		t.Errorf("expected no last-success timestamp, got %v", got)
+	}
+}
+
+func TestRunProductsWarmer_RefreshesEachIntervalUntilCancelled(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.ProductsCacheTTL = time.Minute
+	interval := 50 * time.Millisecond
+	lockTTL := refreshLockTTL(interval)
+
+	// First tick refreshes, the second finds another replica holding the
+	// lock, and the third fails on the database.
+	expectRefreshLock(redisMock, lockTTL, true)
+	redisMock.ExpectTxPipeline()
+	redisMock.Regexp().ExpectHSet(testKeys.products(), pageParams{Limit: defaultPageLimit}.cacheField(), `.*`, productsETagField(pageParams{Limit: defaultPageLimit}.cacheField()), `.*`).SetVal(1)
+	redisMock.ExpectExpireNX(testKeys.products(), time.Minute).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+	expectRefreshLock(redisMock, lockTTL, false)
+	expectRefreshLock(redisMock, lockTTL, true)
+	// The first refresh lists and counts.
+	testProducts(s).failFrom(2, errors.New("connection refused"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runProductsWarmer(ctx, interval)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for refreshCount(t, s) < 2 {
+		if time.Now().After(deadline) {
+			cancel()
+			<-done
+			t.Fatalf("warmer did not reach the third tick: %v", redisMock.ExpectationsWereMet())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("warmer did not stop after cancellation")
+	}
+
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet redis expectations: %v", err)
+	}
+	if n := testProducts(s).callCount(); n != 3 {
+		t.Errorf("expected two refreshes to reach the store, got %d calls", n)
+	}
+	if got := testutil.ToFloat64(s.metrics.cacheRefreshSuccess.WithLabelValues("products")); got == 0 {
+		t.Errorf("expected the first refresh to record its timestamp")
+	}
+}
+
+func TestRunProductsWarmer_StopsPromptlyWhileWaiting(t *testing.T) {
+	t.Parallel()
+	s, _, redisMock := newTestServer(t)
+	expectRefreshLock(redisMock, refreshLockTTL(time.Hour), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runProductsWarmer(ctx, time.Hour)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("warmer kept waiting for the next tick after cancellation")
+	}
+}
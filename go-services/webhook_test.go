@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testWebhookSecret = "whsec-test"
+
+const testPaymentEvent = `{"id":"evt_1","type":"payment.succeeded","data":{"amount":4950}}`
+
+// newWebhookServer returns a test server taking payment webhooks, with room
+// for one queued event.
+func newWebhookServer(t *testing.T) (*Server, redismock.ClientMock) {
+	t.Helper()
+	s, _, redisMock := newTestServer(t)
+	s.cfg.PaymentWebhookSecret = testWebhookSecret
+	s.cfg.PaymentWebhookTolerance = defaultWebhookSkew
+	s.webhooks = make(chan paymentEvent, 1)
+	return s, redisMock
+}
+
+// deliverWebhook posts body to /webhooks/payments with the given timestamp
+// and signature headers.
+func deliverWebhook(s *Server, body, timestamp, signature string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/payments", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signature)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+// deliverSigned posts body signed now with the test secret.
+func deliverSigned(s *Server, body string) *httptest.ResponseRecorder {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return deliverWebhook(s, body, ts, signWebhook(testWebhookSecret, ts, []byte(body)))
+}
+
+func webhookCount(s *Server, result string) float64 {
+	return testutil.ToFloat64(s.metrics.webhookDeliveries.WithLabelValues(result))
+}
+
+func TestPaymentWebhook_ValidDeliveryIsQueued(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newWebhookServer(t)
+
+	redisMock.ExpectSetNX(testKeys.webhookEvent("evt_1"), "payment.succeeded", webhookDedupTTL).SetVal(true)
+	w := deliverSigned(s, testPaymentEvent)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"accepted"`) {
+		t.Fatalf("expected 200 accepted, got %d: %s", w.Code, w.Body)
+	}
+	select {
+	case ev := <-s.webhooks:
+		if ev.ID != "evt_1" || ev.Type != "payment.succeeded" || string(ev.Data) != `{"amount":4950}` {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	default:
+		t.Fatal("expected the event queued for the worker")
+	}
+	if got := webhookCount(s, "accepted"); got != 1 {
+		t.Errorf("expected the delivery counted, got %v", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPaymentWebhook_TamperedBodyIs401(t *testing.T) {
+	t.Parallel()
+	s, _ := newWebhookServer(t)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := signWebhook(testWebhookSecret, ts, []byte(testPaymentEvent))
+	tampered := strings.Replace(testPaymentEvent, "4950", "1", 1)
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"tampered body":    deliverWebhook(s, tampered, ts, signature),
+		"wrong secret":     deliverWebhook(s, testPaymentEvent, ts, signWebhook("other", ts, []byte(testPaymentEvent))),
+		"no signature":     deliverWebhook(s, testPaymentEvent, ts, ""),
+		"bare digest":      deliverWebhook(s, testPaymentEvent, ts, strings.TrimPrefix(signature, webhookSignaturePrefix)),
+		"moved timestamp":  deliverWebhook(s, testPaymentEvent, strconv.FormatInt(time.Now().Unix()+1, 10), signature),
+		"no timestamp":     deliverWebhook(s, testPaymentEvent, "", signature),
+		"digest not hex":   deliverWebhook(s, testPaymentEvent, ts, webhookSignaturePrefix+"zz"),
+		"digest truncated": deliverWebhook(s, testPaymentEvent, ts, signature[:len(signature)-2]),
+	} {
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); got.Code != codeInvalidSignature {
+			t.Errorf("%s: expected code %q, got %+v", name, codeInvalidSignature, got)
+		}
+	}
+	if got := webhookCount(s, "invalid_signature"); got != 8 {
+		t.Errorf("expected every rejection counted, got %v", got)
+	}
+	if len(s.webhooks) != 0 {
+		t.Error("expected nothing queued")
+	}
+}
+
+func TestPaymentWebhook_ReplayedDeliveryIsRejected(t *testing.T) {
+	t.Parallel()
+	s, _ := newWebhookServer(t)
+
+	// A genuine delivery captured and sent again after the tolerance.
+	for _, sent := range []time.Time{time.Now().Add(-6 * time.Minute), time.Now().Add(6 * time.Minute)} {
+		ts := strconv.FormatInt(sent.Unix(), 10)
+		w := deliverWebhook(s, testPaymentEvent, ts, signWebhook(testWebhookSecret, ts, []byte(testPaymentEvent)))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("%v: expected 401, got %d", sent, w.Code)
+		}
+		if got := decodeError(t, w); got.Message != errWebhookStale.Error() {
+			t.Errorf("expected the stale timestamp reported, got %+v", got)
+		}
+	}
+	if got := webhookCount(s, "stale"); got != 2 {
+		t.Errorf("expected the replays counted, got %v", got)
+	}
+}
+
+func TestPaymentWebhook_DuplicateIsAcknowledgedOnce(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newWebhookServer(t)
+
+	redisMock.ExpectSetNX(testKeys.webhookEvent("evt_1"), "payment.succeeded", webhookDedupTTL).SetVal(true)
+	redisMock.ExpectSetNX(testKeys.webhookEvent("evt_1"), "payment.succeeded", webhookDedupTTL).SetVal(false)
+	if w := deliverSigned(s, testPaymentEvent); w.Code != http.StatusOK {
+		t.Fatalf("expected the first delivery accepted, got %d", w.Code)
+	}
+	w := deliverSigned(s, testPaymentEvent)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"duplicate"`) {
+		t.Fatalf("expected the retry acknowledged as a duplicate, got %d: %s", w.Code, w.Body)
+	}
+	if len(s.webhooks) != 1 {
+		t.Errorf("expected the event queued once, got %d", len(s.webhooks))
+	}
+	if got := webhookCount(s, "duplicate"); got != 1 {
+		t.Errorf("expected the duplicate counted, got %v", got)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPaymentWebhook_FullQueueIsRetried(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newWebhookServer(t)
+	s.webhooks <- paymentEvent{ID: "evt_0", Type: "payment.succeeded"}
+
+	redisMock.ExpectSetNX(testKeys.webhookEvent("evt_1"), "payment.succeeded", webhookDedupTTL).SetVal(true)
+	redisMock.ExpectDel(testKeys.webhookEvent("evt_1")).SetVal(1)
+	if w := deliverSigned(s, testPaymentEvent); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for the provider to retry, got %d", w.Code)
+	}
+	if err := redisMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the event forgotten: %v", err)
+	}
+}
+
+func TestPaymentWebhook_RedisFailureIs503(t *testing.T) {
+	t.Parallel()
+	s, redisMock := newWebhookServer(t)
+
+	redisMock.ExpectSetNX(testKeys.webhookEvent("evt_1"), "payment.succeeded", webhookDedupTTL).SetErr(errors.New("connection refused"))
+	if w := deliverSigned(s, testPaymentEvent); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if len(s.webhooks) != 0 {
+		t.Error("expected nothing queued without the dedup record")
+	}
+}
+
+func TestPaymentWebhook_MalformedEventIs400(t *testing.T) {
+	t.Parallel()
+	s, _ := newWebhookServer(t)
+
+	for _, body := range []string{`{"type":"payment.succeeded"}`, `{"id":"evt_1"}`, `not json`} {
+		if w := deliverSigned(s, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestPaymentWebhook_DisabledWithoutSecret(t *testing.T) {
+	t.Parallel()
+	s, _ := newWebhookServer(t)
+	s.cfg.PaymentWebhookSecret = ""
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	// Signed with the empty secret, which must not be accepted either.
+	if w := deliverWebhook(s, testPaymentEvent, ts, signWebhook("", ts, []byte(testPaymentEvent))); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+}
+
+func TestRunWebhookWorker_DrainsQueueOnShutdown(t *testing.T) {
+	t.Parallel()
+	s, _ := newWebhookServer(t)
+	s.webhooks <- paymentEvent{ID: "evt_1", Type: "payment.succeeded"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runWebhookWorker(ctx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the worker to return once cancelled")
+	}
+	if len(s.webhooks) != 0 {
+		t.Error("expected the queued event processed before returning")
+	}
+}
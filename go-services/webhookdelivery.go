@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go-service/httpclient"
+	"go-service/store"
+)
+
+// Headers of an outgoing webhook delivery, besides the signature and
+// timestamp headers the payment provider's deliveries carry too. The
+// delivery id stays the same across the retries of a delivery.
+const (
+	webhookEventHeader    = "X-Webhook-Event"
+	webhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+const (
+	// webhookBatch is the most deliveries a round claims.
+	webhookBatch = 50
+	// webhookSenders is how many deliveries of a round are sent at once,
+	// so one slow subscriber does not hold up the others.
+	webhookSenders = 8
+	// webhookDeadLetterMax is how many dead letters are kept; the oldest
+	// are dropped beyond it.
+	webhookDeadLetterMax = 1000
+	// webhookResponseDrain is how much of a response body is read, so the
+	// connection can be reused.
+	webhookResponseDrain = 4 << 10
+)
+
+// webhookBackoff spaces out the attempts of a delivery: with the default
+// WEBHOOK_MAX_ATTEMPTS, a subscriber gets about an hour to recover.
+var webhookBackoff = backoff{BaseWait: 30 * time.Second, MaxWait: 30 * time.Minute}
+
+// webhookDelivery is a productChange on its way to a webhook subscription.
+// The subscription's URL and secret are read when it is sent, so a
+// subscription changed or deactivated in the meantime applies to it.
+type webhookDelivery struct {
+	ID             string          `json:"id"`
+	SubscriptionID int64           `json:"subscription_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	// Attempts counts the failed attempts so far.
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	// FailedAt is when a dead letter ran out of attempts.
+	FailedAt *time.Time `json:"failed_at,omitempty"`
+}
+
+// deliveryQueue holds the webhook deliveries waiting to be sent, and those
+// that ran out of attempts.
+type deliveryQueue interface {
+	// Push queues d to be sent at at.
+	Push(ctx context.Context, d webhookDelivery, at time.Time) error
+	// Claim removes and returns up to n deliveries due by now. A delivery
+	// is claimed by one replica only.
+	Claim(ctx context.Context, now time.Time, n int) ([]webhookDelivery, error)
+	// DeadLetter keeps d as a dead letter.
+	DeadLetter(ctx context.Context, d webhookDelivery) error
+	// DeadLetters returns up to n dead letters, newest first.
+	DeadLetters(ctx context.Context, n int) ([]webhookDelivery, error)
+	// DeadLetterCount returns how many dead letters are kept.
+	DeadLetterCount(ctx context.Context) (int64, error)
+}
+
+// claimScript pops the members of the sorted set KEYS[1] scored up to
+// ARGV[1], at most ARGV[2] of them, in one step so that replicas polling
+// together never claim the same delivery.
+var claimScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+if #due > 0 then
+	redis.call("ZREM", KEYS[1], unpack(due))
+end
+return due`)
+
+// redisDeliveryQueue is the deliveryQueue kept in Redis: a sorted set of
+// deliveries scored by when they are due, and a capped list of dead
+// letters. A replica that stops between claiming a delivery and queueing
+// it again loses it.
+type redisDeliveryQueue struct {
+	rdb  redisClient
+	keys redisKeys
+}
+
+func (q redisDeliveryQueue) Push(ctx context.Context, d webhookDelivery, at time.Time) error {
+	member, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return q.rdb.ZAdd(ctx, q.keys.webhookQueue(), redis.Z{Score: float64(at.UnixMilli()), Member: member}).Err()
+}
+
+func (q redisDeliveryQueue) Claim(ctx context.Context, now time.Time, n int) ([]webhookDelivery, error) {
+	members, err := claimScript.Run(ctx, q.rdb, []string{q.keys.webhookQueue()}, now.UnixMilli(), n).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	return decodeDeliveries(members)
+}
+
+func (q redisDeliveryQueue) DeadLetter(ctx context.Context, d webhookDelivery) error {
+	member, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	key := q.keys.webhookDeadLetters()
+	if err := q.rdb.LPush(ctx, key, member).Err(); err != nil {
+		return err
+	}
+	return q.rdb.LTrim(ctx, key, 0, webhookDeadLetterMax-1).Err()
+}
+
+func (q redisDeliveryQueue) DeadLetters(ctx context.Context, n int) ([]webhookDelivery, error) {
+	members, err := q.rdb.LRange(ctx, q.keys.webhookDeadLetters(), 0, int64(n)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeDeliveries(members)
+}
+
+func (q redisDeliveryQueue) DeadLetterCount(ctx context.Context) (int64, error) {
+	return q.rdb.LLen(ctx, q.keys.webhookDeadLetters()).Result()
+}
+
+func decodeDeliveries(members []string) ([]webhookDelivery, error) {
+	deliveries := make([]webhookDelivery, 0, len(members))
+	for _, m := range members {
+		var d webhookDelivery
+		if err := json.Unmarshal([]byte(m), &d); err != nil {
+			return nil, fmt.Errorf("decode webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// newWebhookClient returns the client deliveries are sent with. A delivery
+// is retried by the queue, not by the client.
+func newWebhookClient(cfg Config, m *metrics) *httpclient.Client {
+	return httpclient.New(httpclient.Config{Timeout: cfg.WebhookTimeout, MaxRetries: -1, Duration: m.outboundDuration})
+}
+
+// queueWebhooks queues a delivery of a committed change to the product with
+// id to every active subscription to typ. As with publishProductChange the
+// write has succeeded, so a failure is only logged.
+func (s *Server) queueWebhooks(ctx context.Context, typ string, id int64, data json.RawMessage) {
+	if s.webhookSubs == nil || s.deliveries == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	subs, err := s.webhookSubs.Subscribed(ctx, typ)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to read webhook subscriptions; notifications lost", "type", typ, "product_id", id, "err", err)
+		return
+	}
+	if len(subs) == 0 {
+		return
+	}
+	payload, err := encodeProductChange(typ, id, data)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to encode webhook notification", "type", typ, "product_id", id, "err", err)
+		return
+	}
+	now := time.Now()
+	for _, sub := range subs {
+		d := webhookDelivery{ID: uuid.NewString(), SubscriptionID: sub.ID, Event: typ, Payload: payload}
+		if err := s.deliveries.Push(ctx, d, now); err != nil {
+			s.logger.ErrorContext(ctx, "Failed to queue webhook notification; notification lost",
+				"subscription_id", sub.ID, "type", typ, "product_id", id, "err", err)
+		}
+	}
+}
+
+// runWebhookDeliveries sends the due webhook deliveries every interval
+// until ctx is cancelled. Failures are logged and retried on the next tick.
+func (s *Server) runWebhookDeliveries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := s.deliverDueWebhooks(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			s.logger.WarnContext(ctx, "Webhook delivery round failed", "err", err)
+		}
+	}
+}
+
+// deliverDueWebhooks claims the deliveries due by now and sends them,
+// queueing those that fail again or, once out of attempts, keeping them as
+// dead letters. It returns how many were claimed, and refreshes the dead
+// letter gauge.
+func (s *Server) deliverDueWebhooks(ctx context.Context, now time.Time) (int, error) {
+	due, err := s.deliveries.Claim(ctx, now, webhookBatch)
+	if err != nil {
+		return 0, fmt.Errorf("claim webhook deliveries: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	senders := make(chan struct{}, webhookSenders)
+	for _, d := range due {
+		senders <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-senders; wg.Done() }()
+			s.deliverWebhook(ctx, d)
+		}()
+	}
+	wg.Wait()
+
+	total, err := s.deliveries.DeadLetterCount(ctx)
+	if err != nil {
+		return len(due), fmt.Errorf("count dead letters: %w", err)
+	}
+	s.metrics.webhookDeadLetters.Set(float64(total))
+	return len(due), nil
+}
+
+// deliverWebhook makes an attempt at d and records its outcome. A delivery
+// interrupted by shutdown counts as failed and is queued again.
+func (s *Server) deliverWebhook(ctx context.Context, d webhookDelivery) {
+	ctx, span := s.tracer.Start(ctx, "webhook.deliver")
+	defer span.End()
+
+	sub, err := s.webhookSubs.Get(ctx, d.SubscriptionID)
+	switch {
+	case errors.Is(err, store.ErrNotFound), err == nil && !sub.Active:
+		s.logger.InfoContext(ctx, "Dropping webhook notification to a removed or inactive subscription",
+			"delivery_id", d.ID, "subscription_id", d.SubscriptionID)
+		return
+	case err == nil:
+		err = s.sendWebhook(ctx, sub, d)
+	}
+	if err == nil {
+		s.metrics.webhookAttempts.WithLabelValues("delivered").Inc()
+		return
+	}
+
+	// The claim has taken the delivery off the queue: it must be put back
+	// even when ctx is done.
+	ctx = context.WithoutCancel(ctx)
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts >= s.cfg.WebhookMaxAttempts {
+		s.metrics.webhookAttempts.WithLabelValues("dead_lettered").Inc()
+		failed := time.Now().UTC()
+		d.FailedAt = &failed
+		s.logger.WarnContext(ctx, "Webhook notification out of attempts, kept as a dead letter",
+			"delivery_id", d.ID, "subscription_id", d.SubscriptionID, "attempts", d.Attempts, "err", err)
+		if err := s.deliveries.DeadLetter(ctx, d); err != nil {
+			s.logger.ErrorContext(ctx, "Failed to keep webhook dead letter", "delivery_id", d.ID, "err", err)
+		}
+		return
+	}
+	s.metrics.webhookAttempts.WithLabelValues("failed").Inc()
+	wait := webhookBackoff.delay(d.Attempts)
+	s.logger.InfoContext(ctx, "Webhook notification failed; will retry",
+		"delivery_id", d.ID, "subscription_id", d.SubscriptionID, "attempt", d.Attempts, "retry_in", wait.String(), "err", err)
+	if err := s.deliveries.Push(ctx, d, time.Now().Add(wait)); err != nil {
+		s.logger.ErrorContext(ctx, "Failed to requeue webhook notification; notification lost", "delivery_id", d.ID, "err", err)
+	}
+}
+
+// sendWebhook POSTs d's payload to sub, signed with sub's secret as the
+// payment provider signs its deliveries (see verifyWebhook). Any response
+// but a 2xx is a failure.
+func (s *Server) sendWebhook(ctx context.Context, sub store.WebhookSubscription, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhook(sub.Secret, timestamp, d.Payload))
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, webhookResponseDrain))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpclient.StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+
+	"go-service/store"
+)
+
+const testSubscriptionSecret = "partner-secret-0123456789"
+
+// newDeliveryServer returns a test server with fake webhook subscriptions
+// and delivery queue, sending deliveries with a short timeout.
+func newDeliveryServer(t *testing.T) (*Server, *fakeWebhooks, *fakeDeliveries) {
+	t.Helper()
+	s, _, _ := newTestServer(t)
+	s.cfg.WebhookTimeout = time.Second
+	s.cfg.WebhookMaxAttempts = defaultWebhookAttempts
+	s.webhookClient = newWebhookClient(s.cfg, s.metrics)
+	subs, queue := testWebhooks(s)
+	return s, subs, queue
+}
+
+// subscribe adds an active subscription of url to events.
+func subscribe(t *testing.T, subs *fakeWebhooks, url string, events ...string) store.WebhookSubscription {
+	t.Helper()
+	sub, err := subs.Create(context.Background(), store.WebhookSubscriptionInput{URL: url, Secret: testSubscriptionSecret, Events: events, Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+// receiver is a webhook subscriber answering the deliveries it is sent with
+// the statuses in order, then 200.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received []*http.Request
+	bodies   []string
+	*httptest.Server
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	rc := &receiver{statuses: statuses}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.received = append(rc.received, r)
+		rc.bodies = append(rc.bodies, string(body))
+		status := http.StatusOK
+		if len(rc.statuses) > 0 {
+			status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+func (rc *receiver) requests() ([]*http.Request, []string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.received, rc.bodies
+}
+
+func webhookAttemptCount(s *Server, result string) float64 {
+	return testutil.ToFloat64(s.metrics.webhookAttempts.WithLabelValues(result))
+}
+
+func TestCreateProductHandler_QueuesWebhooks(t *testing.T) {
+	t.Parallel()
+	s, subs, queue := newDeliveryServer(t)
+	created := subscribe(t, subs, "https://a.example/hook", eventProductCreated, eventProductDeleted)
+	subscribe(t, subs, "https://b.example/hook", eventProductDeleted)
+	inactive := subscribe(t, subs, "https://c.example/hook", eventProductCreated)
+	if _, err := subs.Update(context.Background(), inactive.ID, store.WebhookSubscriptionInput{URL: inactive.URL, Events: inactive.Events}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(`{"name":"Chair","price":49.5}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.createProductHandler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	pending := queue.pending()
+	if len(pending) != 1 || pending[0].SubscriptionID != created.ID || pending[0].Event != eventProductCreated || pending[0].Attempts != 0 {
+		t.Fatalf("expected one delivery to the active subscriber, got %+v", pending)
+	}
+	var ev productChange
+	if err := json.Unmarshal(pending[0].Payload, &ev); err != nil || ev.Type != eventProductCreated || ev.ProductID != 1 {
+		t.Errorf("expected the change as the payload, got %s", pending[0].Payload)
+	}
+	if pending[0].at.After(time.Now()) {
+		t.Errorf("expected the delivery due at once, got %v", pending[0].at)
+	}
+}
+
+func TestDeliverDueWebhooks_Delivers(t *testing.T) {
+	t.Parallel()
+	s, subs, queue := newDeliveryServer(t)
+	rc := newReceiver(t)
+	sub := subscribe(t, subs, rc.URL+"/hook", eventProductUpdated)
+	s.queueWebhooks(context.Background(), eventProductUpdated, 7, json.RawMessage(`{"id":7}`))
+
+	if n, err := s.deliverDueWebhooks(context.Background(), time.Now()); n != 1 || err != nil {
+		t.Fatalf("expected one delivery sent, got %d and %v", n, err)
+	}
+	received, bodies := rc.requests()
+	if len(received) != 1 {
+		t.Fatalf("expected one request, got %d", len(received))
+	}
+	req := received[0]
+	if req.Method != http.MethodPost || req.URL.Path != "/hook" || req.Header.Get(webhookEventHeader) != eventProductUpdated || req.Header.Get(webhookDeliveryHeader) == "" {
+		t.Errorf("unexpected request %s %s %v", req.Method, req.URL, req.Header)
+	}
+	err := verifyWebhook(sub.Secret, req.Header.Get(webhookTimestampHeader), req.Header.Get(webhookSignatureHeader), []byte(bodies[0]), time.Now(), time.Minute)
+	if err != nil {
+		t.Errorf("expected the body signed with the subscription's secret: %v", err)
+	}
+	if !strings.Contains(bodies[0], `"product_id":7`) {
+		t.Errorf("expected the change as the body, got %s", bodies[0])
+	}
+	if got := webhookAttemptCount(s, "delivered"); got != 1 {
+		t.Errorf("expected the delivery counted, got %v", got)
+	}
+	if len(queue.pending()) != 0 {
+		t.Errorf("expected the queue emptied, got %+v", queue.pending())
+	}
+}
+
+func TestDeliverDueWebhooks_RetriesTransientFailure(t *testing.T) {
+	t.Parallel()
+	s, subs, queue := newDeliveryServer(t)
+	rc := newReceiver(t, http.StatusServiceUnavailable)
+	subscribe(t, subs, rc.URL, eventProductUpdated)
+	s.queueWebhooks(context.Background(), eventProductUpdated, 7, json.RawMessage(`{"id":7}`))
+
+	before := time.Now()
+	if _, err := s.deliverDueWebhooks(context.Background(), before); err != nil {
+		t.Fatal(err)
+	}
+	pending := queue.pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || !strings.Contains(pending[0].LastError, "503") {
+		t.Fatalf("expected the delivery queued again, got %+v", pending)
+	}
+	if !pending[0].at.After(before) || pending[0].at.After(before.Add(webhookBackoff.BaseWait+time.Second)) {
+		t.Errorf("expected the retry put off by the backoff, got %v", pending[0].at.Sub(before))
+	}
+
+	// Not due yet: nothing is sent.
+	if n, _ := s.deliverDueWebhooks(context.Background(), before); n != 0 {
+		t.Fatalf("expected the retry to wait, got %d sent", n)
+	}
+	if n, err := s.deliverDueWebhooks(context.Background(), before.Add(time.Hour)); n != 1 || err != nil {
+		t.Fatalf("expected the retry sent, got %d and %v", n, err)
+	}
+	received, _ := rc.requests()
+	if len(received) != 2 || received[0].Header.Get(webhookDeliveryHeader) != received[1].Header.Get(webhookDeliveryHeader) {
+		t.Errorf("expected the same delivery sent twice, got %d requests", len(received))
+	}
+	if webhookAttemptCount(s, "failed") != 1 || webhookAttemptCount(s, "delivered") != 1 {
+		t.Errorf("expected one failed and one delivered attempt")
+	}
+	if len(queue.pending()) != 0 {
+		t.Errorf("expected the queue emptied, got %+v", queue.pending())
+	}
+}
+
+func TestDeliverDueWebhooks_DeadLettersPermanentFailure(t *testing.T) {
+	t.Parallel()
+	s, subs, queue := newDeliveryServer(t)
+	s.cfg.WebhookMaxAttempts = 3
+	s.cfg.AdminAuthToken = testAdminToken
+	rc := newReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusGone)
+	subscribe(t, subs, rc.URL, eventProductDeleted)
+	s.queueWebhooks(context.Background(), eventProductDeleted, 7, json.RawMessage(`{"id":7}`))
+
+	now := time.Now()
+	for range 4 {
+		if _, err := s.deliverDueWebhooks(context.Background(), now); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(2 * time.Hour)
+	}
+	if received, _ := rc.requests(); len(received) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(received))
+	}
+	if len(queue.pending()) != 0 {
+		t.Fatalf("expected nothing left to retry, got %+v", queue.pending())
+	}
+	if webhookAttemptCount(s, "failed") != 2 || webhookAttemptCount(s, "dead_lettered") != 1 {
+		t.Errorf("expected two failed attempts then a dead letter")
+	}
+	if got := testutil.ToFloat64(s.metrics.webhookDeadLetters); got != 1 {
+		t.Errorf("expected the dead letter counted, got %v", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/webhooks/dead-letters", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	var page deadLettersPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the dead letters listed, got %d and %v", w.Code, err)
+	}
+	if page.Total != 1 || len(page.Items) != 1 {
+		t.Fatalf("expected one dead letter, got %+v", page)
+	}
+	d := page.Items[0]
+	if d.Attempts != 3 || !strings.Contains(d.LastError, "410") || d.FailedAt == nil || d.Event != eventProductDeleted {
+		t.Errorf("unexpected dead letter %+v", d)
+	}
+}
+
+func TestDeliverDueWebhooks_DropsRemovedSubscription(t *testing.T) {
+	t.Parallel()
+	s, subs, queue := newDeliveryServer(t)
+	rc := newReceiver(t)
+	sub := subscribe(t, subs, rc.URL, eventProductUpdated)
+	s.queueWebhooks(context.Background(), eventProductUpdated, 7, json.RawMessage(`{"id":7}`))
+	if err := subs.Delete(context.Background(), sub.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.deliverDueWebhooks(context.Background(), time.Now()); n != 1 || err != nil {
+		t.Fatalf("expected the delivery claimed, got %d and %v", n, err)
+	}
+	if received, _ := rc.requests(); len(received) != 0 {
+		t.Errorf("expected nothing sent, got %d requests", len(received))
+	}
+	if len(queue.pending()) != 0 || len(queue.dead) != 0 {
+		t.Error("expected the delivery dropped")
+	}
+}
+
+func TestRedisDeliveryQueue(t *testing.T) {
+	t.Parallel()
+	rdb, mock := redismock.NewClientMock()
+	q := redisDeliveryQueue{rdb: rdb, keys: testKeys}
+	ctx := context.Background()
+
+	d := webhookDelivery{ID: "d1", SubscriptionID: 3, Event: eventProductCreated, Payload: json.RawMessage(`{"id":"e1"}`)}
+	member := `{"id":"d1","subscription_id":3,"event":"product.created","payload":{"id":"e1"},"attempts":0}`
+	at := time.UnixMilli(1700000000000)
+	mock.ExpectZAdd(testKeys.webhookQueue(), redis.Z{Score: 1700000000000, Member: []byte(member)}).SetVal(1)
+	if err := q.Push(ctx, d, at); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	mock.ExpectEvalSha(claimScript.Hash(), []string{testKeys.webhookQueue()}, at.UnixMilli(), 50).SetVal([]any{member})
+	claimed, err := q.Claim(ctx, at, 50)
+	if err != nil || len(claimed) != 1 || claimed[0].ID != "d1" || string(claimed[0].Payload) != `{"id":"e1"}` {
+		t.Fatalf("Claim: got %+v and %v", claimed, err)
+	}
+
+	mock.ExpectLPush(testKeys.webhookDeadLetters(), []byte(member)).SetVal(1001)
+	mock.ExpectLTrim(testKeys.webhookDeadLetters(), 0, webhookDeadLetterMax-1).SetVal("OK")
+	if err := q.DeadLetter(ctx, d); err != nil {
+		t.Fatalf("DeadLetter: %v", err)
+	}
+	mock.ExpectLRange(testKeys.webhookDeadLetters(), 0, 9).SetVal([]string{member})
+	mock.ExpectLLen(testKeys.webhookDeadLetters()).SetVal(1000)
+	if dead, err := q.DeadLetters(ctx, 10); err != nil || len(dead) != 1 {
+		t.Errorf("DeadLetters: got %+v and %v", dead, err)
+	}
+	if n, err := q.DeadLetterCount(ctx); err != nil || n != 1000 {
+		t.Errorf("DeadLetterCount: got %d and %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"go-service/store"
+)
+
+const (
+	// minWebhookSecretLen is the shortest secret a subscription may sign
+	// with.
+	minWebhookSecretLen = 16
+	// maxDeadLettersLimit is the most dead letters one request lists.
+	maxDeadLettersLimit = webhookDeadLetterMax
+)
+
+// webhookEvents are the event types a subscription may ask for.
+var webhookEvents = []string{eventProductCreated, eventProductUpdated, eventProductDeleted}
+
+// webhookInput is the request body for creating or replacing a webhook
+// subscription. Active defaults to true. On replace, an empty Secret keeps
+// the current one.
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// validate reports every rule the input breaks, as a validationError.
+// create requires the secret.
+func (in webhookInput) validate(create bool) error {
+	var v validator
+	u, err := url.Parse(in.URL)
+	v.check(in.URL != "", "url", "is required")
+	v.check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "must be an absolute http or https URL")
+	v.check(in.Secret != "" || !create, "secret", "is required")
+	v.check(in.Secret == "" || len(in.Secret) >= minWebhookSecretLen, "secret", fmt.Sprintf("must be at least %d characters", minWebhookSecretLen))
+	v.check(len(in.Events) > 0, "events", "must list at least one event type")
+	for i, ev := range in.Events {
+		v.check(slices.Contains(webhookEvents, ev), "events."+strconv.Itoa(i), fmt.Sprintf("%q is not one of %v", ev, webhookEvents))
+	}
+	return v.err()
+}
+
+// store returns the input for the webhook store. It must only be called on
+// input that validates.
+func (in webhookInput) store() store.WebhookSubscriptionInput {
+	active := in.Active == nil || *in.Active
+	return store.WebhookSubscriptionInput{URL: in.URL, Secret: in.Secret, Events: slices.Compact(slices.Sorted(slices.Values(in.Events))), Active: active}
+}
+
+// webhookID parses the {id} path segment. On failure it writes a 400 and
+// returns false.
+func (s *Server) webhookID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		s.writeError(w, http.StatusBadRequest, codeBadRequest, "webhook id must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// writeWebhookError answers a failed call to the webhook store.
+func (s *Server) writeWebhookError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, store.ErrNotFound) {
+		s.writeError(w, http.StatusNotFound, codeNotFound, "webhook subscription not found")
+		return
+	}
+	s.logger.ErrorContext(r.Context(), "DB query failed", "err", err, "path", r.URL.Path)
+	s.writeDBError(w, err)
+}
+
+// listWebhooksHandler lists the webhook subscriptions, without their
+// secrets. The webhook handlers are only served on the internal listener,
+// behind requireRole.
+func (s *Server) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	subs, err := s.webhookSubs.List(r.Context())
+	if err != nil {
+		s.writeWebhookError(w, r, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, subs)
+}
+
+func (s *Server) getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.webhookID(w, r)
+	if !ok {
+		return
+	}
+	sub, err := s.webhookSubs.Get(r.Context(), id)
+	if err != nil {
+		s.writeWebhookError(w, r, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, sub)
+}
+
+func (s *Server) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var in webhookInput
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &in) {
+		return
+	}
+	if err := in.validate(true); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	sub, err := s.webhookSubs.Create(r.Context(), in.store())
+	if err != nil {
+		s.writeWebhookError(w, r, err)
+		return
+	}
+	s.auditWebhook(r, "created", sub)
+	w.Header().Set("Location", "/admin/webhooks/"+strconv.FormatInt(sub.ID, 10))
+	s.writeJSON(w, http.StatusCreated, sub)
+}
+
+func (s *Server) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.webhookID(w, r)
+	if !ok {
+		return
+	}
+	var in webhookInput
+	if !s.decodeJSON(w, r, maxSmallBodyBytes, &in) {
+		return
+	}
+	if err := in.validate(false); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	sub, err := s.webhookSubs.Update(r.Context(), id, in.store())
+	if err != nil {
+		s.writeWebhookError(w, r, err)
+		return
+	}
+	s.auditWebhook(r, "updated", sub)
+	s.writeJSON(w, http.StatusOK, sub)
+}
+
+// deleteWebhookHandler removes a subscription. Its queued deliveries are
+// dropped when their turn comes.
+func (s *Server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.webhookID(w, r)
+	if !ok {
+		return
+	}
+	if err := s.webhookSubs.Delete(r.Context(), id); err != nil {
+		s.writeWebhookError(w, r, err)
+		return
+	}
+	s.auditWebhook(r, "deleted", store.WebhookSubscription{ID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditWebhook records a change to the subscription sub; change is
+// created, updated or deleted.
+func (s *Server) auditWebhook(r *http.Request, change string, sub store.WebhookSubscription) {
+	// Logged at warn so the change is recorded whatever the level.
+	s.logger.WarnContext(r.Context(), "Webhook subscription changed",
+		"audit", true,
+		"actor", auditActor(r.Context()),
+		"remote_ip", s.clientIP(r),
+		"change", change,
+		"subscription_id", sub.ID,
+		"url", sub.URL,
+	)
+	s.audit(r, auditWebhookChanged, 0, map[string]any{"change": change, "subscription_id": sub.ID, "url": sub.URL})
+}
+
+// deadLettersPage is the response body of GET /admin/webhooks/dead-letters.
+// Total counts every dead letter kept, not only those listed.
+type deadLettersPage struct {
+	Items []webhookDelivery `json:"items"`
+	Total int64             `json:"total"`
+}
+
+// deadLettersHandler lists the webhook deliveries that ran out of
+// attempts, newest first, up to ?limit= (default defaultPageLimit).
+func (s *Server) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	limit := defaultPageLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDeadLettersLimit {
+			s.writeError(w, http.StatusBadRequest, codeBadRequest, "limit must be an integer between 1 and "+strconv.Itoa(maxDeadLettersLimit))
+			return
+		}
+		limit = n
+	}
+
+	items, err := s.deliveries.DeadLetters(ctx, limit)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to read webhook dead letters", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	total, err := s.deliveries.DeadLetterCount(ctx)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to count webhook dead letters", "err", err)
+		s.writeInternalError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, deadLettersPage{Items: items, Total: total})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"go-service/store"
+)
+
+// webhookAdminRequest serves an admin request to the webhook endpoints on
+// the internal listener.
+func webhookAdminRequest(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.InternalHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestWebhookAdmin_CRUD(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	subs, _ := testWebhooks(s)
+
+	w := webhookAdminRequest(s, http.MethodPost, "/admin/webhooks",
+		`{"url":"https://partner.example/hook","secret":"`+testSubscriptionSecret+`","events":["product.updated","product.created","product.updated"]}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/admin/webhooks/1" {
+		t.Fatalf("expected 201 with a Location, got %d %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if strings.Contains(w.Body.String(), testSubscriptionSecret) {
+		t.Errorf("expected the secret left out of the response, got %s", w.Body)
+	}
+	var sub store.WebhookSubscription
+	if err := json.Unmarshal(w.Body.Bytes(), &sub); err != nil {
+		t.Fatal(err)
+	}
+	if !sub.Active || !slices.Equal(sub.Events, []string{eventProductCreated, eventProductUpdated}) {
+		t.Errorf("expected an active subscription to each event once, got %+v", sub)
+	}
+
+	// Replacing without a secret keeps the current one.
+	w = webhookAdminRequest(s, http.MethodPut, "/admin/webhooks/1", `{"url":"https://partner.example/v2","events":["product.deleted"],"active":false}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	stored, _ := subs.Get(context.Background(), 1)
+	if stored.URL != "https://partner.example/v2" || stored.Active || stored.Secret != testSubscriptionSecret {
+		t.Errorf("unexpected subscription after update %+v", stored)
+	}
+
+	w = webhookAdminRequest(s, http.MethodGet, "/admin/webhooks", "")
+	var list []store.WebhookSubscription
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 {
+		t.Fatalf("expected one subscription listed, got %s", w.Body)
+	}
+
+	if w := webhookAdminRequest(s, http.MethodDelete, "/admin/webhooks/1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if w := webhookAdminRequest(s, method, "/admin/webhooks/1", ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s after delete: expected 404, got %d", method, w.Code)
+		}
+	}
+
+	if n := len(s.auditQueue); n != 3 {
+		t.Fatalf("expected the create, update and delete audited, got %d events", n)
+	}
+	for range 3 {
+		if ev := <-s.auditQueue; ev.Action != auditWebhookChanged || ev.Actor != adminTokenActor {
+			t.Errorf("unexpected audit event %+v", ev)
+		}
+	}
+}
+
+func TestWebhookAdmin_RejectsInvalidSubscription(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	testWebhooks(s)
+
+	w := webhookAdminRequest(s, http.MethodPost, "/admin/webhooks", `{"url":"ftp://partner.example","secret":"short","events":["product.sold"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var fields []string
+	for _, f := range decodeError(t, w).Fields {
+		fields = append(fields, f.Field)
+	}
+	if !slices.Equal(fields, []string{"url", "secret", "events.0"}) {
+		t.Errorf("expected url, secret and events.0 rejected, got %v", fields)
+	}
+
+	w = webhookAdminRequest(s, http.MethodPost, "/admin/webhooks", `{"url":"https://partner.example","events":[]}`)
+	fields = nil
+	for _, f := range decodeError(t, w).Fields {
+		fields = append(fields, f.Field)
+	}
+	if !slices.Equal(fields, []string{"secret", "events"}) {
+		t.Errorf("expected the secret required and an event, got %v", fields)
+	}
+
+	for _, path := range []string{"/admin/webhooks/abc", "/admin/webhooks/dead-letters?limit=0"} {
+		if w := webhookAdminRequest(s, http.MethodGet, path, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestWebhookAdmin_RequiresAdminToken(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newTestServer(t)
+	s.cfg.AdminAuthToken = testAdminToken
+	testWebhooks(s)
+
+	for _, path := range []string{"/admin/webhooks", "/admin/webhooks/dead-letters"} {
+		w := httptest.NewRecorder()
+		s.InternalHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", path, w.Code)
+		}
+	}
+}
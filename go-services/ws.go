@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait bounds each write to a WebSocket client; a client that
+	// does not read for that long is disconnected.
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a connection may stay silent, pongs included,
+	// before it is considered dead.
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod is how often the server pings; it must be shorter than
+	// wsPongWait.
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsMaxMessageBytes caps a client message.
+	wsMaxMessageBytes = 4 << 10
+)
+
+// WebSocket message types besides the product event types.
+const (
+	wsSubscribe  = "subscribe"
+	wsSubscribed = "subscribed"
+	wsError      = "error"
+)
+
+// wsRequest is a message from a WebSocket client. Products is "*" or an
+// array of product ids; each subscribe replaces the previous one.
+type wsRequest struct {
+	Type     string          `json:"type"`
+	Products json.RawMessage `json:"products"`
+}
+
+// wsReply is a message to a WebSocket client other than an event.
+type wsReply struct {
+	Type     string          `json:"type"`
+	Products json.RawMessage `json:"products,omitempty"`
+	Message  string          `json:"message,omitempty"`
+}
+
+// wsFilter selects the events a connection receives. The zero value
+// selects none, so nothing is sent before the first subscribe.
+type wsFilter struct {
+	all bool
+	ids map[int64]bool
+}
+
+func (f wsFilter) matches(ev productEvent) bool {
+	if f.all {
+		return true
+	}
+	if len(f.ids) == 0 {
+		return false
+	}
+	var ref productRef
+	return json.Unmarshal(ev.Data, &ref) == nil && f.ids[ref.ID]
+}
+
+// parseWSFilter reads the products of a subscribe message.
+func parseWSFilter(raw json.RawMessage) (wsFilter, error) {
+	var all string
+	if json.Unmarshal(raw, &all) == nil {
+		if all != "*" {
+			return wsFilter{}, errors.New(`products must be "*" or an array of product ids`)
+		}
+		return wsFilter{all: true}, nil
+	}
+	var ids []int64
+	if err := json.Unmarshal(raw, &ids); err != nil {
+		return wsFilter{}, errors.New(`products must be "*" or an array of product ids`)
+	}
+	f := wsFilter{ids: make(map[int64]bool, len(ids))}
+	for _, id := range ids {
+		if id < 1 {
+			return wsFilter{}, errors.New("product ids must be positive integers")
+		}
+		f.ids[id] = true
+	}
+	return f, nil
+}
+
+// wsHandler upgrades to a WebSocket that pushes the product events of the
+// products the client subscribes to. Clients send
+// {"type":"subscribe","products":[7,9]} or "products":"*", and receive a
+// "subscribed" acknowledgement, then the events in the same JSON form as
+// they are published.
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if n := s.wsConns.Add(1); n > int64(s.cfg.WSMaxConnections) {
+		s.wsConns.Add(-1)
+		s.metrics.wsConnections.WithLabelValues("rejected").Inc()
+		s.logger.WarnContext(ctx, "WebSocket connection rejected", "max_connections", s.cfg.WSMaxConnections)
+		s.writeError(w, http.StatusServiceUnavailable, codeOverloaded, "too many WebSocket connections")
+		return
+	}
+	defer s.wsConns.Add(-1)
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: s.wsOriginAllowed,
+		Error: func(w http.ResponseWriter, _ *http.Request, status int, reason error) {
+			code := codeBadRequest
+			if status == http.StatusForbidden {
+				code = codeForbidden
+			}
+			s.writeError(w, status, code, reason.Error())
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has answered the request.
+		return
+	}
+	s.metrics.wsConnections.WithLabelValues("accepted").Inc()
+	s.metrics.wsOpen.Inc()
+	defer s.metrics.wsOpen.Dec()
+
+	s.serveWS(ctx, conn)
+}
+
+// wsOriginAllowed accepts requests without an Origin, from the service's
+// own host, and from the CORS allowed origins. Browsers do not apply CORS
+// to WebSockets, so this is what keeps other sites' pages out.
+func (s *Server) wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	return slices.Contains(s.cfg.CORSAllowedOrigins, "*") || slices.Contains(s.cfg.CORSAllowedOrigins, origin)
+}
+
+// serveWS runs an upgraded connection until the client leaves, stops
+// answering pings, falls behind or the server shuts down. Only this
+// goroutine writes data messages; a second one reads.
+func (s *Server) serveWS(ctx context.Context, conn *websocket.Conn) {
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	replies := make(chan wsAnswer)
+	stop := make(chan struct{})
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		s.readWS(ctx, conn, replies, stop)
+	}()
+	defer func() {
+		close(stop)
+		conn.Close()
+		<-readDone
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	done := s.events.done()
+	var filter wsFilter
+	for {
+		select {
+		case <-readDone:
+			return
+		case <-done:
+			s.closeWS(ctx, conn, websocket.CloseGoingAway, "server shutting down")
+			return
+		case reply := <-replies:
+			if reply.filter != nil {
+				filter = *reply.filter
+			}
+			if !s.writeWS(ctx, conn, reply.reply) {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				s.closeWS(ctx, conn, websocket.CloseTryAgainLater, "too slow to keep up")
+				return
+			}
+			if filter.matches(ev) && !s.writeWS(ctx, conn, ev) {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsAnswer is readWS's answer to a client message: the reply to send
+// and, for a valid subscribe, the new filter.
+type wsAnswer struct {
+	filter *wsFilter
+	reply  wsReply
+}
+
+// readWS reads client messages until the connection fails or stop is
+// closed. Pongs and messages both keep the connection alive.
+func (s *Server) readWS(ctx context.Context, conn *websocket.Conn, replies chan<- wsAnswer, stop <-chan struct{}) {
+	conn.SetReadLimit(wsMaxMessageBytes)
+	alive := func(string) error { return conn.SetReadDeadline(time.Now().Add(wsPongWait)) }
+	_ = alive("")
+	conn.SetPongHandler(alive)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				s.logger.DebugContext(ctx, "WebSocket connection lost", "err", err)
+			}
+			return
+		}
+		s.metrics.wsMessages.WithLabelValues("received").Inc()
+		_ = alive("")
+
+		var out wsAnswer
+		var req wsRequest
+		switch {
+		case json.Unmarshal(data, &req) != nil:
+			out.reply = wsReply{Type: wsError, Message: "message must be a JSON object"}
+		case req.Type != wsSubscribe:
+			out.reply = wsReply{Type: wsError, Message: `type must be "subscribe"`}
+		default:
+			filter, err := parseWSFilter(req.Products)
+			if err != nil {
+				out.reply = wsReply{Type: wsError, Message: err.Error()}
+				break
+			}
+			out.filter = &filter
+			out.reply = wsReply{Type: wsSubscribed, Products: req.Products}
+		}
+		select {
+		case replies <- out:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// writeWS sends v as a JSON message and reports whether it was written in
+// time.
+func (s *Server) writeWS(ctx context.Context, conn *websocket.Conn, v any) bool {
+	if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+		return false
+	}
+	if err := conn.WriteJSON(v); err != nil {
+		s.logger.DebugContext(ctx, "WebSocket write failed", "err", err)
+		return false
+	}
+	s.metrics.wsMessages.WithLabelValues("sent").Inc()
+	return true
+}
+
+// closeWS starts the closing handshake with code. The connection is
+// closed right after, without waiting for the client's reply.
+func (s *Server) closeWS(ctx context.Context, conn *websocket.Conn, code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait)); err != nil {
+		s.logger.DebugContext(ctx, "Failed to send WebSocket close", "code", code, "err", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// dialWS connects to h at /ws.
+func dialWS(t *testing.T, h http.Handler) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func readWSJSON(t *testing.T, conn *websocket.Conn, v any) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(v); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+}
+
+func subscribeWS(t *testing.T, conn *websocket.Conn, products string) wsReply {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","products":`+products+`}`)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	var reply wsReply
+	readWSJSON(t, conn, &reply)
+	return reply
+}
+
+func wsTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, _, _ := newTestServer(t)
+	s.cfg.WSMaxConnections = 10
+	return s
+}
+
+func productUpdated(id int64) productEvent {
+	return productEvent{Type: eventProductUpdated, Data: json.RawMessage(`{"id":` + strconv.FormatInt(id, 10) + `}`)}
+}
+
+func TestWS_SubscribeAndFilter(t *testing.T) {
+	t.Parallel()
+	s := wsTestServer(t)
+	conn, _, err := dialWS(t, http.HandlerFunc(s.wsHandler))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+
+	if reply := subscribeWS(t, conn, `[7]`); reply.Type != wsSubscribed || string(reply.Products) != `[7]` {
+		t.Fatalf("expected the subscription acknowledged, got %+v", reply)
+	}
+	s.events.broadcast(productUpdated(8))
+	s.events.broadcast(productUpdated(7))
+
+	var ev productEvent
+	readWSJSON(t, conn, &ev)
+	if ev.Type != eventProductUpdated || string(ev.Data) != `{"id":7}` {
+		t.Fatalf("expected only product 7's event, got %s %s", ev.Type, ev.Data)
+	}
+
+	if reply := subscribeWS(t, conn, `"*"`); reply.Type != wsSubscribed {
+		t.Fatalf("expected the subscription acknowledged, got %+v", reply)
+	}
+	s.events.broadcast(productUpdated(8))
+	readWSJSON(t, conn, &ev)
+	if string(ev.Data) != `{"id":8}` {
+		t.Errorf("expected every product's events with *, got %s", ev.Data)
+	}
+
+	if got := testutil.ToFloat64(s.metrics.wsMessages.WithLabelValues("received")); got != 2 {
+		t.Errorf("expected 2 messages received, got %v", got)
+	}
+}
+
+func TestWS_RejectsBadMessages(t *testing.T) {
+	t.Parallel()
+	s := wsTestServer(t)
+	conn, _, err := dialWS(t, http.HandlerFunc(s.wsHandler))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+
+	for _, msg := range []string{
+		`not json`,
+		`{"type":"unsubscribe"}`,
+		`{"type":"subscribe","products":"all"}`,
+		`{"type":"subscribe","products":[0]}`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		var reply wsReply
+		readWSJSON(t, conn, &reply)
+		if reply.Type != wsError || reply.Message == "" {
+			t.Errorf("%s: expected an error reply, got %+v", msg, reply)
+		}
+	}
+	if reply := subscribeWS(t, conn, `[1]`); reply.Type != wsSubscribed {
+		t.Errorf("expected the connection to stay usable, got %+v", reply)
+	}
+}
+
+func TestWS_ClosesOnShutdown(t *testing.T) {
+	t.Parallel()
+	s := wsTestServer(t)
+	conn, _, err := dialWS(t, http.HandlerFunc(s.wsHandler))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	subscribeWS(t, conn, `"*"`)
+
+	s.CloseStreams()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Errorf("expected close code 1001, got %v", err)
+	}
+}
+
+func TestWS_ConnectionLimit(t *testing.T) {
+	t.Parallel()
+	s := wsTestServer(t)
+	s.cfg.WSMaxConnections = 1
+	h := http.HandlerFunc(s.wsHandler)
+
+	first, _, err := dialWS(t, h)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	subscribeWS(t, first, `"*"`)
+
+	_, resp, err := dialWS(t, h)
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 over the limit, got %v", err)
+	}
+	if got := testutil.ToFloat64(s.metrics.wsConnections.WithLabelValues("rejected")); got != 1 {
+		t.Errorf("expected 1 rejected connection, got %v", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.wsOpen); got != 1 {
+		t.Errorf("expected 1 open connection, got %v", got)
+	}
+}
+
+func TestWS_ThroughMiddleware(t *testing.T) {
+	t.Parallel()
+	s := wsTestServer(t)
+	h := s.Handler()
+
+	conn, _, err := dialWS(t, h)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	subscribeWS(t, conn, `"*"`)
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(s.metrics.httpRequestCount.WithLabelValues("/ws", http.MethodGet, "101")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the upgrade recorded as 101")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWS_RejectsForeignOrigin(t *testing.T) {
+	t.Parallel()
+	s := wsTestServer(t)
+	s.cfg.CORSAllowedOrigins = []string{"https://admin.example.com"}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://admin.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://example.com", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := s.wsOriginAllowed(r); got != tt.want {
+			t.Errorf("origin %q: expected %v, got %v", tt.origin, tt.want, got)
+		}
+	}
+}
@@ -1,11 +0,0 @@
-CREATE TABLE users (
-  id SERIAL PRIMARY KEY,
-  username TEXT NOT NULL,
-  password TEXT NOT NULL
-);
-
-CREATE TABLE products (
-  id SERIAL PRIMARY KEY,
-  name TEXT NOT NULL,
-  price NUMERIC NOT NULL
-);
@@ -1,2 +1,3 @@
-INSERT INTO users (username, password) VALUES ('admin', 'admin123');
-INSERT INTO products (name, price) VALUES ('Product A', 10.99), ('Product B', 5.49);
+-- admin / admin123
+INSERT INTO users (username, password_hash) VALUES ('admin', '$2a$10$ls4bkqs5MMsagl9HpeJTz.erDb8ckSPPicfNgDNWJk1vaDrfku5ba');
+INSERT INTO products (name, description, price) VALUES ('Product A', 'The first product', 10.99), ('Product B', 'The second product', 5.49);